@@ -0,0 +1,463 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package aws contains helpers that facilitate sending Resources to AWS as
+// SQS or SNS messages, with messages too large for SQS or SNS written to S3.
+package aws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// ErrMessageTooLarge is returned (wrapped) by Publish for a message which is
+// too large to send, if no LargeMessageBucket is configured.
+var ErrMessageTooLarge = errors.New("message is too large to send to AWS")
+
+// ErrDeliveryFailed is returned (wrapped) by Close if any messages could not
+// be delivered.
+var ErrDeliveryFailed = errors.New("failed to deliver messages to AWS")
+
+// S3URIAttribute is the message attribute holding the S3 URI of a message body
+// which was too large to send (see PublisherOptions.LargeMessageBucket).
+const S3URIAttribute = "s3Uri"
+
+const (
+	// MaxMessageBytes is the maximum size of an SQS or SNS message, including
+	// its attributes, and of each batch of messages.
+	MaxMessageBytes = 256 * 1024
+	// MaxBatchMessages is the maximum number of messages in an SQS or SNS batch
+	// request.
+	MaxBatchMessages = 10
+
+	defaultMaxConcurrentBatches = 4
+	defaultMaxRetries           = 3
+	defaultInitialBackoff       = time.Second
+	maxBackoff                  = 30 * time.Second
+)
+
+// Message is an SQS or SNS message with string attributes.
+type Message struct {
+	Body       string
+	Attributes map[string]string
+	// The key, relative to PublisherOptions.LargeMessagePrefix, of the S3
+	// object the body is written to if the message is too large to send.
+	ObjectKey string
+}
+
+// Size returns the size of the message, as counted towards the AWS limit.
+func (m Message) Size() int {
+	n := len(m.Body)
+	for k, v := range m.Attributes {
+		n += len(k) + len("String") + len(v)
+	}
+	return n
+}
+
+// A Publisher sends messages to an SQS queue or SNS topic.
+type Publisher interface {
+	// Publish queues a message to be sent. Delivery failures are reported by
+	// Close rather than Publish.
+	Publish(ctx context.Context, m Message) error
+	// Close sends any queued messages and waits for all messages to be
+	// acknowledged, returning an error wrapping ErrDeliveryFailed if any could
+	// not be delivered.
+	Close(ctx context.Context) error
+}
+
+// PublisherOptions contains optional parameters used by NewSQSPublisher and
+// NewSNSPublisher.
+type PublisherOptions struct {
+	// The maximum number of messages sent in each batch request. Defaults to
+	// (and may not be more than) MaxBatchMessages.
+	MaxBatchMessages int
+	// The maximum number of batch requests in flight at once. Defaults to 4.
+	MaxConcurrentBatches int
+	// The number of times messages which failed to send are retried. Defaults
+	// to 3. If negative, messages are not retried.
+	MaxRetries int
+	// The time waited before the first retry, which is doubled for each
+	// subsequent retry. Defaults to 1 second.
+	InitialBackoff time.Duration
+	// If set, the bodies of messages which are too large to send are written
+	// to this S3 bucket, at LargeMessagePrefix + Message.ObjectKey. A message
+	// with the same attributes plus S3URIAttribute is sent instead, with a
+	// body holding those attributes as a JSON object. If not set, Publish
+	// returns an error wrapping ErrMessageTooLarge for such messages.
+	LargeMessageBucket string
+	LargeMessagePrefix string
+	// The session used to create the AWS clients. Defaults to a session
+	// configured from the environment and shared config files.
+	Session *session.Session
+	// If set, these clients are used instead of creating them from the Session.
+	SQSClient sqsiface.SQSAPI
+	SNSClient snsiface.SNSAPI
+	S3Client  s3iface.S3API
+}
+
+// session returns the configured session, or a new session configured from
+// the environment.
+func (o *PublisherOptions) session() (*session.Session, error) {
+	if o.Session != nil {
+		return o.Session, nil
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{SharedConfigState: session.SharedConfigEnable})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create AWS session: %w", err)
+	}
+	return sess, nil
+}
+
+// NewSQSPublisher returns a Publisher which sends messages to the SQS queue at
+// queueURL, in batches of up to 10 with several batches in flight at once.
+// Messages which fail to send are retried with exponential backoff. opts may
+// be nil.
+//
+// It is threadsafe to call Publish from multiple goroutines.
+func NewSQSPublisher(queueURL string, opts *PublisherOptions) (Publisher, error) {
+	if queueURL == "" {
+		return nil, errors.New("an SQS queue URL must be given")
+	}
+	if opts == nil {
+		opts = &PublisherOptions{}
+	}
+	client := opts.SQSClient
+	if client == nil {
+		sess, err := opts.session()
+		if err != nil {
+			return nil, err
+		}
+		client = sqs.New(sess)
+	}
+	return newBatchPublisher(&sqsSender{client: client, queueURL: queueURL}, opts)
+}
+
+// NewSNSPublisher returns a Publisher which publishes messages to the SNS
+// topic with the given ARN. It behaves in the same way as NewSQSPublisher.
+func NewSNSPublisher(topicARN string, opts *PublisherOptions) (Publisher, error) {
+	if topicARN == "" {
+		return nil, errors.New("an SNS topic ARN must be given")
+	}
+	if opts == nil {
+		opts = &PublisherOptions{}
+	}
+	client := opts.SNSClient
+	if client == nil {
+		sess, err := opts.session()
+		if err != nil {
+			return nil, err
+		}
+		client = sns.New(sess)
+	}
+	return newBatchPublisher(&snsSender{client: client, topicARN: topicARN}, opts)
+}
+
+// batchFailure describes a message in a batch which failed to send.
+type batchFailure struct {
+	// The index of the message in the batch, or -1 if AWS returned an unknown
+	// entry id.
+	index int
+	// retryable is false if AWS reported the failure as the sender's fault.
+	retryable bool
+	err       error
+}
+
+// batchSender sends batches of messages to an SQS queue or SNS topic.
+type batchSender interface {
+	// sendBatch sends the messages, returning those which failed. An error is
+	// returned if the request as a whole failed.
+	sendBatch(ctx context.Context, messages []Message) ([]batchFailure, error)
+	// destination describes the queue or topic, for log and error messages.
+	destination() string
+}
+
+type sqsSender struct {
+	client   sqsiface.SQSAPI
+	queueURL string
+}
+
+func (ss *sqsSender) sendBatch(ctx context.Context, messages []Message) ([]batchFailure, error) {
+	input := &sqs.SendMessageBatchInput{QueueUrl: aws.String(ss.queueURL)}
+	for i, m := range messages {
+		attributes := map[string]*sqs.MessageAttributeValue{}
+		for k, v := range m.Attributes {
+			attributes[k] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+		}
+		input.Entries = append(input.Entries, &sqs.SendMessageBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			MessageBody:       aws.String(m.Body),
+			MessageAttributes: attributes,
+		})
+	}
+	output, err := ss.client.SendMessageBatchWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	var failures []batchFailure
+	for _, f := range output.Failed {
+		failures = append(failures, newBatchFailure(f.Id, f.Code, f.Message, f.SenderFault))
+	}
+	return failures, nil
+}
+
+func (ss *sqsSender) destination() string { return "SQS queue " + ss.queueURL }
+
+type snsSender struct {
+	client   snsiface.SNSAPI
+	topicARN string
+}
+
+func (ss *snsSender) sendBatch(ctx context.Context, messages []Message) ([]batchFailure, error) {
+	input := &sns.PublishBatchInput{TopicArn: aws.String(ss.topicARN)}
+	for i, m := range messages {
+		attributes := map[string]*sns.MessageAttributeValue{}
+		for k, v := range m.Attributes {
+			attributes[k] = &sns.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+		}
+		input.PublishBatchRequestEntries = append(input.PublishBatchRequestEntries, &sns.PublishBatchRequestEntry{
+			Id:                aws.String(strconv.Itoa(i)),
+			Message:           aws.String(m.Body),
+			MessageAttributes: attributes,
+		})
+	}
+	output, err := ss.client.PublishBatchWithContext(ctx, input)
+	if err != nil {
+		return nil, err
+	}
+	var failures []batchFailure
+	for _, f := range output.Failed {
+		failures = append(failures, newBatchFailure(f.Id, f.Code, f.Message, f.SenderFault))
+	}
+	return failures, nil
+}
+
+func (ss *snsSender) destination() string { return "SNS topic " + ss.topicARN }
+
+// newBatchFailure converts a failed entry of an SQS or SNS batch response.
+func newBatchFailure(id, code, message *string, senderFault *bool) batchFailure {
+	index, err := strconv.Atoi(aws.StringValue(id))
+	if err != nil {
+		index = -1
+	}
+	return batchFailure{
+		index:     index,
+		retryable: !aws.BoolValue(senderFault),
+		err:       fmt.Errorf("%s: %s", aws.StringValue(code), aws.StringValue(message)),
+	}
+}
+
+// batchPublisher is a Publisher which sends messages in batches with a
+// batchSender.
+type batchPublisher struct {
+	sender   batchSender
+	opts     PublisherOptions
+	s3Client s3iface.S3API
+
+	mu         sync.Mutex
+	batch      []Message
+	batchBytes int
+	// delivered and failed count messages, and firstErr holds the first
+	// delivery error, to be returned by Close.
+	delivered int
+	failed    int
+	firstErr  error
+
+	// inFlight limits the number of batches being sent at once.
+	inFlight chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newBatchPublisher(sender batchSender, opts *PublisherOptions) (*batchPublisher, error) {
+	if opts.MaxBatchMessages > MaxBatchMessages {
+		return nil, fmt.Errorf("MaxBatchMessages must be at most %d, got %d", MaxBatchMessages, opts.MaxBatchMessages)
+	}
+	bp := &batchPublisher{sender: sender, opts: *opts, s3Client: opts.S3Client}
+	if bp.opts.MaxBatchMessages <= 0 {
+		bp.opts.MaxBatchMessages = MaxBatchMessages
+	}
+	if bp.opts.MaxConcurrentBatches <= 0 {
+		bp.opts.MaxConcurrentBatches = defaultMaxConcurrentBatches
+	}
+	if bp.opts.MaxRetries == 0 {
+		bp.opts.MaxRetries = defaultMaxRetries
+	}
+	if bp.opts.InitialBackoff <= 0 {
+		bp.opts.InitialBackoff = defaultInitialBackoff
+	}
+	if bp.opts.LargeMessageBucket != "" && bp.s3Client == nil {
+		sess, err := opts.session()
+		if err != nil {
+			return nil, err
+		}
+		bp.s3Client = s3.New(sess)
+	}
+	bp.inFlight = make(chan struct{}, bp.opts.MaxConcurrentBatches)
+	return bp, nil
+}
+
+func (bp *batchPublisher) Publish(ctx context.Context, m Message) error {
+	if m.Size() > MaxMessageBytes {
+		var err error
+		if m, err = bp.offload(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.batchBytes+m.Size() > MaxMessageBytes {
+		bp.flush(ctx)
+	}
+	bp.batch = append(bp.batch, m)
+	bp.batchBytes += m.Size()
+	if len(bp.batch) >= bp.opts.MaxBatchMessages {
+		bp.flush(ctx)
+	}
+	return nil
+}
+
+// offload writes the body of a message which is too large to send to S3, and
+// returns a message pointing to it.
+func (bp *batchPublisher) offload(ctx context.Context, m Message) (Message, error) {
+	if bp.opts.LargeMessageBucket == "" {
+		return Message{}, fmt.Errorf("%w: the message is %d bytes, and no large message bucket is configured", ErrMessageTooLarge, m.Size())
+	}
+	key := bp.opts.LargeMessagePrefix + m.ObjectKey
+	_, err := bp.s3Client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(bp.opts.LargeMessageBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader([]byte(m.Body)),
+		ContentType: aws.String("application/fhir+json"),
+	})
+	if err != nil {
+		return Message{}, fmt.Errorf("failed to write large message body to S3 at %s: %w", key, err)
+	}
+	attributes := map[string]string{S3URIAttribute: fmt.Sprintf("s3://%s/%s", bp.opts.LargeMessageBucket, key)}
+	for k, v := range m.Attributes {
+		attributes[k] = v
+	}
+	body, err := json.Marshal(attributes)
+	if err != nil {
+		return Message{}, err
+	}
+	return Message{Body: string(body), Attributes: attributes}, nil
+}
+
+func (bp *batchPublisher) Close(ctx context.Context) error {
+	bp.mu.Lock()
+	bp.flush(ctx)
+	bp.mu.Unlock()
+	bp.wg.Wait()
+
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	if bp.failed > 0 {
+		return fmt.Errorf("%w: %d of %d messages were not delivered to %s, first error: %w", ErrDeliveryFailed, bp.failed, bp.failed+bp.delivered, bp.sender.destination(), bp.firstErr)
+	}
+	return nil
+}
+
+// flush starts sending the buffered messages in the background, waiting if
+// the maximum number of batches are already in flight. bp.mu must be held.
+func (bp *batchPublisher) flush(ctx context.Context) {
+	if len(bp.batch) == 0 {
+		return
+	}
+	batch := bp.batch
+	bp.batch, bp.batchBytes = nil, 0
+
+	bp.inFlight <- struct{}{}
+	bp.wg.Add(1)
+	go func() {
+		defer bp.wg.Done()
+		failed, err := bp.send(ctx, batch)
+		// The slot is released before taking bp.mu, as Publish may be waiting
+		// for it while holding bp.mu.
+		<-bp.inFlight
+
+		bp.mu.Lock()
+		defer bp.mu.Unlock()
+		bp.delivered += len(batch) - failed
+		if failed > 0 {
+			log.Warningf("Failed to deliver %d messages to %s: %v", failed, bp.sender.destination(), err)
+			bp.failed += failed
+			if bp.firstErr == nil {
+				bp.firstErr = err
+			}
+		}
+	}()
+}
+
+// send sends a batch of messages, retrying those which fail if appropriate.
+// It returns the number of messages which could not be delivered, and an
+// error describing the first failure.
+func (bp *batchPublisher) send(ctx context.Context, messages []Message) (int, error) {
+	var failed int
+	var firstErr error
+	backoff := bp.opts.InitialBackoff
+	for attempt := 0; ; attempt++ {
+		failures, err := bp.sender.sendBatch(ctx, messages)
+		if err != nil {
+			// The SDK retries failed requests itself, so the request is not
+			// retried again here.
+			return failed + len(messages), errors.Join(firstErr, fmt.Errorf("batch request failed: %w", err))
+		}
+		if len(failures) == 0 {
+			return failed, firstErr
+		}
+		var retry []Message
+		var retryErr error
+		for _, f := range failures {
+			if f.retryable && f.index >= 0 && f.index < len(messages) {
+				retry = append(retry, messages[f.index])
+				retryErr = f.err
+				continue
+			}
+			// Messages the sender is at fault for will not succeed if retried.
+			failed++
+			if firstErr == nil {
+				firstErr = f.err
+			}
+		}
+		if len(retry) == 0 || attempt >= bp.opts.MaxRetries {
+			if firstErr == nil {
+				firstErr = retryErr
+			}
+			return failed + len(retry), firstErr
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return failed + len(retry), errors.Join(firstErr, retryErr, ctx.Err())
+		}
+		backoff = min(2*backoff, maxBackoff)
+		messages = retry
+	}
+}
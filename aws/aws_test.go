@@ -0,0 +1,264 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeSQS records the messages sent to it. Messages whose body contains
+// "retry" fail with a retryable error the first time they are sent, and those
+// containing "reject" always fail as the sender's fault.
+type fakeSQS struct {
+	sqsiface.SQSAPI
+
+	mu         sync.Mutex
+	batchSizes []int
+	bodies     []string
+	attributes []map[string]string
+	retried    map[string]bool
+}
+
+func (fs *fakeSQS) SendMessageBatchWithContext(ctx aws.Context, input *sqs.SendMessageBatchInput, opts ...request.Option) (*sqs.SendMessageBatchOutput, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.retried == nil {
+		fs.retried = map[string]bool{}
+	}
+	fs.batchSizes = append(fs.batchSizes, len(input.Entries))
+	output := &sqs.SendMessageBatchOutput{}
+	for _, e := range input.Entries {
+		body := aws.StringValue(e.MessageBody)
+		switch {
+		case strings.Contains(body, "reject"):
+			output.Failed = append(output.Failed, &sqs.BatchResultErrorEntry{Id: e.Id, Code: aws.String("InvalidMessageContents"), SenderFault: aws.Bool(true)})
+		case strings.Contains(body, "retry") && !fs.retried[body]:
+			fs.retried[body] = true
+			output.Failed = append(output.Failed, &sqs.BatchResultErrorEntry{Id: e.Id, Code: aws.String("InternalError"), SenderFault: aws.Bool(false)})
+		default:
+			attributes := map[string]string{}
+			for k, v := range e.MessageAttributes {
+				attributes[k] = aws.StringValue(v.StringValue)
+			}
+			fs.bodies = append(fs.bodies, body)
+			fs.attributes = append(fs.attributes, attributes)
+		}
+	}
+	return output, nil
+}
+
+type fakeSNS struct {
+	snsiface.SNSAPI
+
+	mu     sync.Mutex
+	bodies []string
+}
+
+func (fs *fakeSNS) PublishBatchWithContext(ctx aws.Context, input *sns.PublishBatchInput, opts ...request.Option) (*sns.PublishBatchOutput, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for _, e := range input.PublishBatchRequestEntries {
+		fs.bodies = append(fs.bodies, aws.StringValue(e.Message))
+		if got := aws.StringValue(e.MessageAttributes["type"].StringValue); got != "test" {
+			return nil, fmt.Errorf("unexpected type attribute %q", got)
+		}
+	}
+	return &sns.PublishBatchOutput{}, nil
+}
+
+type fakeS3 struct {
+	s3iface.S3API
+
+	objects map[string]string
+}
+
+func (fs *fakeS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	fs.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)] = string(data)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func publishAll(t *testing.T, p Publisher, bodies ...string) {
+	t.Helper()
+	for _, b := range bodies {
+		if err := p.Publish(context.Background(), Message{Body: b, Attributes: map[string]string{"type": "test"}}); err != nil {
+			t.Fatalf("Publish(%q) returned unexpected error: %v", b, err)
+		}
+	}
+}
+
+func TestSQSPublisher(t *testing.T) {
+	fs := &fakeSQS{}
+	p, err := NewSQSPublisher("https://sqs.us-east-1.amazonaws.com/123/queue", &PublisherOptions{SQSClient: fs})
+	if err != nil {
+		t.Fatalf("NewSQSPublisher() returned unexpected error: %v", err)
+	}
+	var bodies []string
+	for i := 0; i < 25; i++ {
+		bodies = append(bodies, fmt.Sprintf("m%02d", i))
+	}
+	publishAll(t, p, bodies...)
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+
+	sort.Ints(fs.batchSizes)
+	if diff := cmp.Diff([]int{5, 10, 10}, fs.batchSizes); diff != "" {
+		t.Errorf("unexpected batch sizes (-want +got):\n%s", diff)
+	}
+	sort.Strings(fs.bodies)
+	if diff := cmp.Diff(bodies, fs.bodies); diff != "" {
+		t.Errorf("unexpected message bodies (-want +got):\n%s", diff)
+	}
+	for _, attributes := range fs.attributes {
+		if diff := cmp.Diff(map[string]string{"type": "test"}, attributes); diff != "" {
+			t.Errorf("unexpected message attributes (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestSQSPublisher_FailedMessages(t *testing.T) {
+	fs := &fakeSQS{}
+	p, err := NewSQSPublisher("https://sqs.us-east-1.amazonaws.com/123/queue", &PublisherOptions{
+		SQSClient:      fs,
+		InitialBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewSQSPublisher() returned unexpected error: %v", err)
+	}
+	publishAll(t, p, "ok", "retry", "reject")
+	err = p.Close(context.Background())
+	if !errors.Is(err, ErrDeliveryFailed) || !strings.Contains(err.Error(), "1 of 3 messages") || !strings.Contains(err.Error(), "InvalidMessageContents") {
+		t.Errorf("Close() returned unexpected error: %v, want %v for 1 of 3 messages", err, ErrDeliveryFailed)
+	}
+	sort.Strings(fs.bodies)
+	if diff := cmp.Diff([]string{"ok", "retry"}, fs.bodies); diff != "" {
+		t.Errorf("unexpected message bodies (-want +got):\n%s", diff)
+	}
+}
+
+func TestSQSPublisher_LargeMessages(t *testing.T) {
+	large := Message{
+		Body:       strings.Repeat("a", 300*1024),
+		Attributes: map[string]string{"type": "test"},
+		ObjectKey:  "Patient/big.json",
+	}
+
+	t.Run("without bucket", func(t *testing.T) {
+		p, err := NewSQSPublisher("queue", &PublisherOptions{SQSClient: &fakeSQS{}})
+		if err != nil {
+			t.Fatalf("NewSQSPublisher() returned unexpected error: %v", err)
+		}
+		if err := p.Publish(context.Background(), large); !errors.Is(err, ErrMessageTooLarge) {
+			t.Errorf("Publish() returned unexpected error. got: %v, want: %v", err, ErrMessageTooLarge)
+		}
+	})
+
+	t.Run("with bucket", func(t *testing.T) {
+		fs, f3 := &fakeSQS{}, &fakeS3{objects: map[string]string{}}
+		p, err := NewSQSPublisher("queue", &PublisherOptions{
+			SQSClient:          fs,
+			S3Client:           f3,
+			LargeMessageBucket: "bucket",
+			LargeMessagePrefix: "large/",
+		})
+		if err != nil {
+			t.Fatalf("NewSQSPublisher() returned unexpected error: %v", err)
+		}
+		if err := p.Publish(context.Background(), large); err != nil {
+			t.Fatalf("Publish() returned unexpected error: %v", err)
+		}
+		if err := p.Close(context.Background()); err != nil {
+			t.Fatalf("Close() returned unexpected error: %v", err)
+		}
+		if got := f3.objects["bucket/large/Patient/big.json"]; got != large.Body {
+			t.Errorf("large message body not written to S3 at bucket/large/Patient/big.json")
+		}
+		wantBodies := []string{`{"s3Uri":"s3://bucket/large/Patient/big.json","type":"test"}`}
+		if diff := cmp.Diff(wantBodies, fs.bodies); diff != "" {
+			t.Errorf("unexpected message bodies (-want +got):\n%s", diff)
+		}
+		if got := fs.attributes[0][S3URIAttribute]; got != "s3://bucket/large/Patient/big.json" {
+			t.Errorf("unexpected %s attribute. got: %q, want: %q", S3URIAttribute, got, "s3://bucket/large/Patient/big.json")
+		}
+	})
+}
+
+func TestSNSPublisher(t *testing.T) {
+	fs := &fakeSNS{}
+	p, err := NewSNSPublisher("arn:aws:sns:us-east-1:123:topic", &PublisherOptions{SNSClient: fs, MaxBatchMessages: 2})
+	if err != nil {
+		t.Fatalf("NewSNSPublisher() returned unexpected error: %v", err)
+	}
+	publishAll(t, p, "m1", "m2", "m3")
+	if err := p.Close(context.Background()); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+	sort.Strings(fs.bodies)
+	if diff := cmp.Diff([]string{"m1", "m2", "m3"}, fs.bodies); diff != "" {
+		t.Errorf("unexpected messages published (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewPublisher_Errors(t *testing.T) {
+	if _, err := NewSQSPublisher("", &PublisherOptions{SQSClient: &fakeSQS{}}); err == nil {
+		t.Error("NewSQSPublisher() with no queue URL returned nil error")
+	}
+	if _, err := NewSNSPublisher("", &PublisherOptions{SNSClient: &fakeSNS{}}); err == nil {
+		t.Error("NewSNSPublisher() with no topic ARN returned nil error")
+	}
+	if _, err := NewSQSPublisher("queue", &PublisherOptions{SQSClient: &fakeSQS{}, MaxBatchMessages: 11}); err == nil {
+		t.Error("NewSQSPublisher() with MaxBatchMessages 11 returned nil error")
+	}
+}
+
+func TestNewBatchFailure(t *testing.T) {
+	f := newBatchFailure(aws.String("unknown"), aws.String("InternalError"), aws.String("oops"), aws.Bool(false))
+	if f.index != -1 || !f.retryable || f.err == nil || f.err.Error() != "InternalError: oops" {
+		t.Errorf("newBatchFailure() returned unexpected failure for an unknown entry id: %+v", f)
+	}
+	f = newBatchFailure(aws.String("3"), aws.String("InvalidMessageContents"), nil, aws.Bool(true))
+	if f.index != 3 || f.retryable {
+		t.Errorf("newBatchFailure() returned unexpected failure for a sender fault: %+v", f)
+	}
+}
+
+func TestMessage_Size(t *testing.T) {
+	m := Message{Body: "body", Attributes: map[string]string{"key": "value"}, ObjectKey: "not/counted"}
+	if got, want := m.Size(), len("body")+len("key")+len("String")+len("value"); got != want {
+		t.Errorf("Size() returned unexpected value. got: %d, want: %d", got, want)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package azureblob contains helpers that facilitate data transfer of Resources
+// into Azure Blob Storage (including ADLS Gen2 accounts).
+package azureblob
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// apiVersion is the Blob service REST API version sent with every request.
+const apiVersion = "2021-08-06"
+
+// blockSize is the amount of data buffered by a blob writer before it is
+// uploaded as a block.
+const blockSize = 4 << 20
+
+// ErrUnexpectedStatusCode is returned (wrapped) when the Blob service responds
+// with an unexpected HTTP status code.
+var ErrUnexpectedStatusCode = errors.New("unexpected status code from Azure Blob Storage")
+
+// Credential authorizes requests to the Blob service.
+type Credential interface {
+	Authorize(req *http.Request) error
+}
+
+type sasCredential struct {
+	query url.Values
+}
+
+// NewSASCredential returns a Credential which authorizes requests using a
+// shared access signature token (with or without the leading "?").
+func NewSASCredential(token string) (Credential, error) {
+	query, err := url.ParseQuery(strings.TrimPrefix(token, "?"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SAS token: %w", err)
+	}
+	return &sasCredential{query: query}, nil
+}
+
+func (sc *sasCredential) Authorize(req *http.Request) error {
+	q := req.URL.Query()
+	for k, vals := range sc.query {
+		q[k] = vals
+	}
+	req.URL.RawQuery = q.Encode()
+	return nil
+}
+
+type bearerTokenCredential struct {
+	token func() (string, error)
+}
+
+// NewBearerTokenCredential returns a Credential which authorizes requests with
+// a Microsoft Entra ID (Azure AD) OAuth token returned by the token function.
+// The token function is called before every request, so it should cache tokens
+// until they expire.
+func NewBearerTokenCredential(token func() (string, error)) Credential {
+	return &bearerTokenCredential{token: token}
+}
+
+func (btc *bearerTokenCredential) Authorize(req *http.Request) error {
+	token, err := btc.token()
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return nil
+}
+
+// Client represents a Blob service client for a single container.
+type Client struct {
+	containerURL *url.URL
+	cred         Credential
+	httpClient   *http.Client
+}
+
+// NewClient creates and returns a new Blob service client for use in writing
+// resources to an existing container, identified by its URL (for example
+// https://account.blob.core.windows.net/container).
+func NewClient(containerURL string, cred Credential) (Client, error) {
+	u, err := url.Parse(containerURL)
+	if err != nil {
+		return Client{}, fmt.Errorf("failed to parse container URL %q: %w", containerURL, err)
+	}
+	if !u.IsAbs() || strings.Trim(u.Path, "/") == "" {
+		return Client{}, fmt.Errorf("container URL %q must be absolute and include a container name", containerURL)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	return Client{containerURL: u, cred: cred, httpClient: &http.Client{}}, nil
+}
+
+// GetFileWriter returns a write closer that allows the user to write to a block
+// blob named `fileName` in the container. Data is uploaded in blocks as it is
+// written, and closing the write closer commits the blocks to the blob,
+// replacing any existing blob of the same name.
+func (c Client) GetFileWriter(ctx context.Context, fileName string) io.WriteCloser {
+	return &blobWriter{ctx: ctx, client: c, name: fileName}
+}
+
+// JoinPath joins blob name elements with forward slashes, removing leading and
+// trailing slashes from each element.
+func JoinPath(elems ...string) string {
+	var cleaned []string
+	for _, e := range elems {
+		if e = strings.Trim(strings.ReplaceAll(e, `\`, `/`), `/`); e != "" {
+			cleaned = append(cleaned, e)
+		}
+	}
+	return strings.Join(cleaned, `/`)
+}
+
+func (c Client) do(ctx context.Context, method, blobName string, query url.Values, body []byte) error {
+	u := *c.containerURL
+	u.Path = u.Path + "/" + blobName
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-version", apiVersion)
+	if c.cred != nil {
+		if err := c.cred.Authorize(req); err != nil {
+			return fmt.Errorf("failed to authorize request: %w", err)
+		}
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%w: %s %s returned %d: %s", ErrUnexpectedStatusCode, method, blobName, resp.StatusCode, respBody)
+	}
+	return nil
+}
+
+// blobWriter buffers written data, uploading it in blocks which are committed
+// to the blob on Close.
+type blobWriter struct {
+	ctx      context.Context
+	client   Client
+	name     string
+	buf      bytes.Buffer
+	blockIDs []string
+	err      error
+}
+
+func (bw *blobWriter) Write(p []byte) (int, error) {
+	if bw.err != nil {
+		return 0, bw.err
+	}
+	bw.buf.Write(p)
+	for bw.buf.Len() >= blockSize {
+		if err := bw.putBlock(bw.buf.Next(blockSize)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (bw *blobWriter) putBlock(data []byte) error {
+	// Block IDs must all be the same length within a blob.
+	id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%08d", len(bw.blockIDs))))
+	q := url.Values{"comp": []string{"block"}, "blockid": []string{id}}
+	if err := bw.client.do(bw.ctx, http.MethodPut, bw.name, q, data); err != nil {
+		bw.err = err
+		return err
+	}
+	bw.blockIDs = append(bw.blockIDs, id)
+	return nil
+}
+
+type blockList struct {
+	XMLName     xml.Name `xml:"BlockList"`
+	Uncommitted []string `xml:"Uncommitted"`
+}
+
+func (bw *blobWriter) Close() error {
+	if bw.err != nil {
+		return bw.err
+	}
+	if bw.buf.Len() > 0 {
+		if err := bw.putBlock(bw.buf.Bytes()); err != nil {
+			return err
+		}
+		bw.buf.Reset()
+	}
+	body, err := xml.Marshal(blockList{Uncommitted: bw.blockIDs})
+	if err != nil {
+		return err
+	}
+	body = append([]byte(xml.Header), body...)
+	if err := bw.client.do(bw.ctx, http.MethodPut, bw.name, url.Values{"comp": []string{"blocklist"}}, body); err != nil {
+		bw.err = err
+		return err
+	}
+	bw.err = errors.New("blob writer is closed")
+	return nil
+}
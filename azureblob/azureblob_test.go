@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azureblob
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/testhelpers"
+)
+
+func TestGetFileWriter(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     []byte
+		wantPuts int
+	}{
+		{name: "Empty", data: nil, wantPuts: 1},
+		{name: "SingleBlock", data: []byte("hello\n"), wantPuts: 2},
+		{name: "MultipleBlocks", data: bytes.Repeat([]byte("x"), 2*blockSize+10), wantPuts: 4},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := testhelpers.NewAzureBlobServer(t)
+			cred, err := NewSASCredential("?sv=2021&sig=abc")
+			if err != nil {
+				t.Fatalf("NewSASCredential() returned unexpected error: %v", err)
+			}
+			c, err := NewClient(server.URL()+"/container/", cred)
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+
+			w := c.GetFileWriter(context.Background(), "dir/file.ndjson")
+			if _, err := w.Write(tc.data); err != nil {
+				t.Fatalf("Write() returned unexpected error: %v", err)
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() returned unexpected error: %v", err)
+			}
+
+			got, ok := server.GetBlob("/container/dir/file.ndjson")
+			if !ok {
+				t.Fatalf("blob was not committed; have %v", server.GetAllPaths())
+			}
+			if !bytes.Equal(got, tc.data) {
+				t.Errorf("unexpected blob contents (len %d), want len %d", len(got), len(tc.data))
+			}
+			queries := server.Queries()
+			if len(queries) != tc.wantPuts {
+				t.Errorf("unexpected number of requests. got: %d, want: %d", len(queries), tc.wantPuts)
+			}
+			for _, q := range queries {
+				if !strings.Contains(q, "sig=abc") {
+					t.Errorf("request query %q is missing the SAS token", q)
+				}
+			}
+		})
+	}
+}
+
+func TestGetFileWriter_Error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if got := req.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("unexpected Authorization header. got: %q, want: %q", got, "Bearer token")
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	c, err := NewClient(server.URL+"/container", NewBearerTokenCredential(func() (string, error) { return "token", nil }))
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	w := c.GetFileWriter(context.Background(), "file.ndjson")
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Fatalf("Write() returned unexpected error: %v", err)
+	}
+	if err := w.Close(); !errors.Is(err, ErrUnexpectedStatusCode) {
+		t.Errorf("Close() returned unexpected error. got: %v, want: %v", err, ErrUnexpectedStatusCode)
+	}
+}
+
+func TestNewClient_InvalidURL(t *testing.T) {
+	for _, u := range []string{"container", "https://account.blob.core.windows.net", "https://account.blob.core.windows.net/"} {
+		if _, err := NewClient(u, nil); err == nil {
+			t.Errorf("NewClient(%q) succeeded, want error", u)
+		}
+	}
+}
+
+func TestJoinPath(t *testing.T) {
+	if got, want := JoinPath("/prefix/", "", `a\b`, "c.ndjson"), "prefix/a/b/c.ndjson"; got != want {
+		t.Errorf("JoinPath() = %q, want %q", got, want)
+	}
+}
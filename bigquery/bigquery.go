@@ -0,0 +1,202 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bigquery contains helpers for loading FHIR resources into BigQuery
+// tables.
+package bigquery
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	bigqueryapi "google.golang.org/api/bigquery/v2"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+// DefaultBigQueryEndpoint represents the default BigQuery API endpoint. This
+// should be passed in the Config unless in a test environment.
+const DefaultBigQueryEndpoint = "https://bigquery.googleapis.com/bigquery/v2/"
+
+// ErrLoadJobFailed indicates that a BigQuery load job completed with an error.
+var ErrLoadJobFailed = errors.New("BigQuery load job failed")
+
+// Config represents a BigQuery dataset.
+type Config struct {
+	// BigQueryEndpoint is the BigQuery API endpoint. For example,
+	// DefaultBigQueryEndpoint.
+	BigQueryEndpoint string
+	// ProjectID is the GCP project the dataset belongs to, and in which load
+	// jobs are run.
+	ProjectID string
+	// DatasetID is the BigQuery dataset tables are created in.
+	DatasetID string
+}
+
+// Client is a BigQuery client for a single dataset.
+type Client struct {
+	service *bigqueryapi.Service
+	cfg     *Config
+}
+
+// MinimalSchema is a schema which can hold any FHIR resource, with the full
+// resource stored in a JSON column. Rows for tables with this schema can be
+// created with NewMinimalSchemaRow.
+func MinimalSchema() *bigqueryapi.TableSchema {
+	return &bigqueryapi.TableSchema{
+		Fields: []*bigqueryapi.TableFieldSchema{
+			{Name: "id", Type: "STRING", Mode: "REQUIRED"},
+			{Name: "resourceType", Type: "STRING", Mode: "REQUIRED"},
+			{Name: "lastUpdated", Type: "TIMESTAMP", Mode: "NULLABLE"},
+			{Name: "data", Type: "JSON", Mode: "REQUIRED"},
+		},
+	}
+}
+
+type minimalSchemaRow struct {
+	ID           string          `json:"id"`
+	ResourceType string          `json:"resourceType"`
+	LastUpdated  *string         `json:"lastUpdated"`
+	Data         json.RawMessage `json:"data"`
+}
+
+type resourceHeader struct {
+	ID           string `json:"id"`
+	ResourceType string `json:"resourceType"`
+	Meta         struct {
+		LastUpdated *string `json:"lastUpdated"`
+	} `json:"meta"`
+}
+
+// NewMinimalSchemaRow returns the JSON representation of a row holding the
+// given FHIR resource, for loading into a table with MinimalSchema. The
+// returned JSON does not contain newlines.
+func NewMinimalSchemaRow(resourceJSON []byte) ([]byte, error) {
+	var header resourceHeader
+	if err := json.Unmarshal(resourceJSON, &header); err != nil {
+		return nil, err
+	}
+	if header.ID == "" || header.ResourceType == "" {
+		return nil, errors.New("resource must have an id and resourceType")
+	}
+	return json.Marshal(minimalSchemaRow{
+		ID:           header.ID,
+		ResourceType: header.ResourceType,
+		LastUpdated:  header.Meta.LastUpdated,
+		Data:         resourceJSON,
+	})
+}
+
+// LoadJob identifies a running BigQuery load job.
+type LoadJob struct {
+	ID       string
+	Location string
+}
+
+// NewClient initializes and returns a new BigQuery client.
+func NewClient(ctx context.Context, cfg *Config) (*Client, error) {
+	var service *bigqueryapi.Service
+	var err error
+	if cfg.BigQueryEndpoint == DefaultBigQueryEndpoint {
+		service, err = bigqueryapi.NewService(ctx, option.WithEndpoint(cfg.BigQueryEndpoint))
+	} else {
+		// When not using the default BigQuery endpoint, we provide an empty
+		// http.Client. This case is generally used in the test, so that the
+		// bigquery.Service doesn't complain about not being able to find
+		// credentials in the test environment.
+		service, err = bigqueryapi.NewService(ctx, option.WithHTTPClient(&http.Client{}), option.WithEndpoint(cfg.BigQueryEndpoint))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{service: service, cfg: cfg}, nil
+}
+
+// CreateTableIfNotExists creates a table with the given ID and schema in the
+// dataset, unless a table with that ID already exists. It returns whether the
+// table was created. The schema of an existing table is not checked.
+func (c *Client) CreateTableIfNotExists(ctx context.Context, tableID string, schema *bigqueryapi.TableSchema) (bool, error) {
+	table := &bigqueryapi.Table{
+		TableReference: &bigqueryapi.TableReference{
+			ProjectId: c.cfg.ProjectID,
+			DatasetId: c.cfg.DatasetID,
+			TableId:   tableID,
+		},
+		Schema: schema,
+	}
+	_, err := c.service.Tables.Insert(c.cfg.ProjectID, c.cfg.DatasetID, table).Context(ctx).Do()
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Code == http.StatusConflict {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error creating BigQuery table %s: %w", tableID, err)
+	}
+	return true, nil
+}
+
+// StartLoadJob starts a job which appends the newline delimited JSON files at
+// the given GCS URIs (for example gs://bucket/dir/*.ndjson) to an existing
+// table. The job can be monitored with CheckLoadJob.
+func (c *Client) StartLoadJob(ctx context.Context, tableID string, gcsURIs []string) (*LoadJob, error) {
+	job := &bigqueryapi.Job{
+		Configuration: &bigqueryapi.JobConfiguration{
+			Load: &bigqueryapi.JobConfigurationLoad{
+				SourceUris:   gcsURIs,
+				SourceFormat: "NEWLINE_DELIMITED_JSON",
+				DestinationTable: &bigqueryapi.TableReference{
+					ProjectId: c.cfg.ProjectID,
+					DatasetId: c.cfg.DatasetID,
+					TableId:   tableID,
+				},
+				CreateDisposition: "CREATE_NEVER",
+				WriteDisposition:  "WRITE_APPEND",
+			},
+		},
+	}
+	job, err := c.service.Jobs.Insert(c.cfg.ProjectID, job).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("error starting BigQuery load job for table %s: %w", tableID, err)
+	}
+	return &LoadJob{ID: job.JobReference.JobId, Location: job.JobReference.Location}, nil
+}
+
+// CheckLoadJob checks the status of a load job started by StartLoadJob. If the
+// job is complete, isDone is true and outputRows is the number of rows loaded.
+// If the job completed unsuccessfully, an error wrapping ErrLoadJobFailed is
+// returned.
+func (c *Client) CheckLoadJob(ctx context.Context, job *LoadJob) (isDone bool, outputRows int64, err error) {
+	call := c.service.Jobs.Get(c.cfg.ProjectID, job.ID).Context(ctx)
+	if job.Location != "" {
+		call = call.Location(job.Location)
+	}
+	j, err := call.Do()
+	if err != nil {
+		return false, 0, fmt.Errorf("error getting BigQuery job %s: %w", job.ID, err)
+	}
+	if j.Status == nil || j.Status.State != "DONE" {
+		return false, 0, nil
+	}
+	if j.Status.ErrorResult != nil {
+		return true, 0, fmt.Errorf("%w: job %s: %s", ErrLoadJobFailed, job.ID, j.Status.ErrorResult.Message)
+	}
+	if j.Statistics != nil && j.Statistics.Load != nil {
+		outputRows = j.Statistics.Load.OutputRows
+	}
+	return true, outputRows, nil
+}
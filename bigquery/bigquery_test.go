@@ -0,0 +1,101 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bigquery
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/testhelpers"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClientLoadsFromGCS(t *testing.T) {
+	ctx := context.Background()
+	gcsServer := testhelpers.NewGCSServer(t)
+	gcsServer.AddObject("bucket", "dir/Patient.ndjson", testhelpers.GCSObjectEntry{
+		Data: []byte("{\"id\":\"1\"}\n{\"id\":\"2\"}\n"),
+	})
+	bqServer := testhelpers.NewBigQueryServer(t, gcsServer)
+
+	client, err := NewClient(ctx, &Config{BigQueryEndpoint: bqServer.URL(), ProjectID: "project", DatasetID: "dataset"})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+
+	created, err := client.CreateTableIfNotExists(ctx, "Patient", MinimalSchema())
+	if err != nil || !created {
+		t.Fatalf("CreateTableIfNotExists() = %v, %v, want true, nil", created, err)
+	}
+	created, err = client.CreateTableIfNotExists(ctx, "Patient", MinimalSchema())
+	if err != nil || created {
+		t.Fatalf("CreateTableIfNotExists() for an existing table = %v, %v, want false, nil", created, err)
+	}
+
+	job, err := client.StartLoadJob(ctx, "Patient", []string{"gs://bucket/dir/Patient.ndjson"})
+	if err != nil {
+		t.Fatalf("StartLoadJob() returned unexpected error: %v", err)
+	}
+	isDone, outputRows, err := client.CheckLoadJob(ctx, job)
+	if err != nil {
+		t.Fatalf("CheckLoadJob() returned unexpected error: %v", err)
+	}
+	if !isDone || outputRows != 2 {
+		t.Errorf("CheckLoadJob() = %v, %d, want true, 2", isDone, outputRows)
+	}
+	if got := len(bqServer.TableRows("project.dataset.Patient")); got != 2 {
+		t.Errorf("unexpected number of loaded rows. got: %d, want: 2", got)
+	}
+
+	if _, err := client.StartLoadJob(ctx, "Encounter", []string{"gs://bucket/dir/Patient.ndjson"}); err == nil {
+		t.Errorf("StartLoadJob() for a table which does not exist returned nil error")
+	}
+}
+
+func TestNewMinimalSchemaRow(t *testing.T) {
+	cases := []struct {
+		name     string
+		resource string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "WithLastUpdated",
+			resource: `{"resourceType":"Patient","id":"1","meta":{"lastUpdated":"2024-01-02T03:04:05Z"}}`,
+			want:     `{"id":"1","resourceType":"Patient","lastUpdated":"2024-01-02T03:04:05Z","data":{"resourceType":"Patient","id":"1","meta":{"lastUpdated":"2024-01-02T03:04:05Z"}}}`,
+		},
+		{
+			name:     "WithoutLastUpdated",
+			resource: `{"resourceType":"Patient","id":"1"}`,
+			want:     `{"id":"1","resourceType":"Patient","lastUpdated":null,"data":{"resourceType":"Patient","id":"1"}}`,
+		},
+		{
+			name:     "MissingID",
+			resource: `{"resourceType":"Patient"}`,
+			wantErr:  true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := NewMinimalSchemaRow([]byte(tc.resource))
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("NewMinimalSchemaRow(%s) returned error %v, want error: %v", tc.resource, err, tc.wantErr)
+			}
+			if diff := cmp.Diff(tc.want, string(got)); !tc.wantErr && diff != "" {
+				t.Errorf("NewMinimalSchemaRow(%s) returned unexpected diff (-want +got):\n%s", tc.resource, diff)
+			}
+		})
+	}
+}
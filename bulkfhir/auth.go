@@ -16,6 +16,7 @@ package bulkfhir
 
 import (
 	"bytes"
+	"context"
 	"crypto/rsa"
 	"encoding/json"
 	"errors"
@@ -27,6 +28,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -38,6 +40,12 @@ var timeNow = time.Now
 
 const authorizationHeader = "Authorization"
 
+// tokenRenewalMargin is how long before its expiry a BearerToken is renewed,
+// so that requests are not sent with a token which expires before they reach
+// the server. It is capped at half the lifetime of the token, so that short
+// lived tokens are still used for a while.
+const tokenRenewalMargin = time.Minute
+
 // Authenticator defines a module used for obtaining authentication credentials
 // and attaching them to outbound requests to the Bulk FHIR APIs.
 type Authenticator interface {
@@ -45,30 +53,35 @@ type Authenticator interface {
 	// Authenticate unconditionally performs any credential exchange required to
 	// make requests. It is generally not necessary to call this method, as it
 	// will be called automatically by AddAuthenticationToRequest if credentials
-	// have not yet been exchanged or have expired.
-	Authenticate(hc *http.Client) error
+	// have not yet been exchanged or have expired. Any requests made are
+	// cancelled if ctx is done.
+	Authenticate(ctx context.Context, hc *http.Client) error
 
 	// AuthenticateIfNecessary performs any credential exchange required to make
 	// requests, if the credentials have expired or have not yet been exchanged.
 	// This can be used if you need to track authentication errors, but does not
 	// need to be called otherwise; authentication will be done automatically when
-	// requests are made using AddAuthenticationToRequest.
-	AuthenticateIfNecessary(hc *http.Client) error
+	// requests are made using AddAuthenticationToRequest. Any requests made are
+	// cancelled if ctx is done.
+	AuthenticateIfNecessary(ctx context.Context, hc *http.Client) error
 
 	// Add authentication credentials to an outbound request. This may perform
 	// additional requests to perform credential exchange if required by the
 	// authentication mechanism, both before any initial request, and on
 	// subsequent requests if any acquired credentials have expired.
 	//
-	// Implementations should call their own AuthenticateIfNecessary method if
-	// credential exchange is necessary.
+	// Implementations should call their own AuthenticateIfNecessary method (with
+	// the request's context) if credential exchange is necessary.
 	AddAuthenticationToRequest(hc *http.Client, req *http.Request) error
 }
 
 // BearerToken encapsulates a bearer token presented as an Authorization header.
 type BearerToken struct {
-	Token                        string
-	Expiry                       time.Time
+	Token  string
+	Expiry time.Time
+	// When the token was obtained. If set, the token is renewed shortly before
+	// Expiry (see shouldRenew); otherwise it is renewed once Expiry has passed.
+	IssuedAt                     time.Time
 	AlwaysAuthenticateIfNoExpiry bool
 }
 
@@ -76,9 +89,9 @@ type BearerToken struct {
 //
 // Renewal is necessary if:
 //   - Credential exchange has never been performed (i.e. no token is set)
-//   - The obtained token has expired, based on either an "expires_in" value
-//     from a previous request, or a default expiry set when the authenticator
-//     was created.
+//   - The obtained token has expired, or will expire within the renewal margin
+//     if IssuedAt is set, based on either an "expires_in" value from a previous
+//     request, or a default expiry set when the authenticator was created.
 //   - No expiry time is available, and alwaysAuthenticateIfNoExpiry is true.
 func (bt *BearerToken) shouldRenew() bool {
 	if bt == nil || bt.Token == "" {
@@ -88,12 +101,21 @@ func (bt *BearerToken) shouldRenew() bool {
 		if bt.AlwaysAuthenticateIfNoExpiry {
 			return true
 		}
-	} else if bt.Expiry.Before(timeNow()) {
+	} else if bt.Expiry.Before(timeNow().Add(bt.renewalMargin())) {
 		return true
 	}
 	return false
 }
 
+// renewalMargin returns how long before its expiry the token is renewed: the
+// lesser of tokenRenewalMargin and half of the token's lifetime.
+func (bt *BearerToken) renewalMargin() time.Duration {
+	if bt.IssuedAt.IsZero() {
+		return 0
+	}
+	return max(0, min(tokenRenewalMargin, bt.Expiry.Sub(bt.IssuedAt)/2))
+}
+
 func (bt *BearerToken) addHeader(req *http.Request) {
 	req.Header.Set(authorizationHeader, fmt.Sprintf("Bearer %s", bt.Token))
 }
@@ -101,41 +123,37 @@ func (bt *BearerToken) addHeader(req *http.Request) {
 // CredentialExchanger is used by bearerTokenAuthenticator to exchange
 // long-lived credentials for a short lived bearer token.
 type CredentialExchanger interface {
-	Authenticate(hc *http.Client) (*BearerToken, error)
+	Authenticate(ctx context.Context, hc *http.Client) (*BearerToken, error)
 }
 
 // BearerTokenAuthenticator is an implementation of Authenticator which uses a
 // CredentialExchanger to obtain a bearer token which is presented in an
-// Authorization header.
-//
-// Note: this implementation is not thread safe.
+// Authorization header. It is safe for concurrent use.
 type BearerTokenAuthenticator struct {
 	Exchanger CredentialExchanger
-	token     *BearerToken
+
+	mu    sync.Mutex
+	token *BearerToken
 }
 
 // Authenticate is Authenticator.Authenticate.
 //
 // This Authenticator uses the CredentialExchanger it contains to obtain a
 // bearer token.
-func (bta *BearerTokenAuthenticator) Authenticate(hc *http.Client) error {
-	token, err := bta.Exchanger.Authenticate(hc)
-	if err != nil {
-		return err
-	}
-	bta.token = token
-	return nil
+func (bta *BearerTokenAuthenticator) Authenticate(ctx context.Context, hc *http.Client) error {
+	bta.mu.Lock()
+	defer bta.mu.Unlock()
+	return bta.authenticateLocked(ctx, hc)
 }
 
 // AuthenticateIfNecessary is Authenticator.AuthenticateIfNecessary.
 //
 // This Authenticator uses the CredentialExchanger it contains to obtain a
 // bearer token.
-func (bta *BearerTokenAuthenticator) AuthenticateIfNecessary(hc *http.Client) error {
-	if bta.token.shouldRenew() {
-		return bta.Authenticate(hc)
-	}
-	return nil
+func (bta *BearerTokenAuthenticator) AuthenticateIfNecessary(ctx context.Context, hc *http.Client) error {
+	bta.mu.Lock()
+	defer bta.mu.Unlock()
+	return bta.authenticateIfNecessaryLocked(ctx, hc)
 }
 
 // AddAuthenticationToRequest is Authenticator.AddAuthenticationToRequest.
@@ -143,13 +161,73 @@ func (bta *BearerTokenAuthenticator) AuthenticateIfNecessary(hc *http.Client) er
 // This Authenticator adds an access token as an Authorization: Bearer {token}
 // header, automatically requesting/refreshing the token as necessary.
 func (bta *BearerTokenAuthenticator) AddAuthenticationToRequest(hc *http.Client, req *http.Request) error {
-	if err := bta.AuthenticateIfNecessary(hc); err != nil {
+	bta.mu.Lock()
+	defer bta.mu.Unlock()
+	if err := bta.authenticateIfNecessaryLocked(req.Context(), hc); err != nil {
 		return err
 	}
 	bta.token.addHeader(req)
 	return nil
 }
 
+// authenticateLocked must be called with bta.mu held.
+func (bta *BearerTokenAuthenticator) authenticateLocked(ctx context.Context, hc *http.Client) error {
+	token, err := bta.Exchanger.Authenticate(ctx, hc)
+	if err != nil {
+		return err
+	}
+	bta.token = token
+	return nil
+}
+
+// authenticateIfNecessaryLocked must be called with bta.mu held.
+func (bta *BearerTokenAuthenticator) authenticateIfNecessaryLocked(ctx context.Context, hc *http.Client) error {
+	if bta.token.shouldRenew() {
+		return bta.authenticateLocked(ctx, hc)
+	}
+	return nil
+}
+
+// ErrorNoCredentials is returned by Authenticate for Authenticators which have
+// no credentials to exchange for a new token, such as those created by
+// NewStaticTokenAuthenticator.
+var ErrorNoCredentials = errors.New("no client credentials are configured to authenticate with")
+
+// staticTokenAuthenticator is an implementation of Authenticator which
+// presents a bearer token obtained elsewhere.
+type staticTokenAuthenticator struct {
+	token BearerToken
+}
+
+// NewStaticTokenAuthenticator creates a new Authenticator which presents the
+// given bearer token with every request, without performing any credential
+// exchange. This is useful when tokens are obtained by another component (for
+// example, a sidecar which handles authentication). As the token cannot be
+// renewed, Authenticate returns ErrorNoCredentials.
+func NewStaticTokenAuthenticator(token string) Authenticator {
+	return &staticTokenAuthenticator{token: BearerToken{Token: token}}
+}
+
+// Authenticate is Authenticator.Authenticate. This implementation always
+// returns ErrorNoCredentials.
+func (sta *staticTokenAuthenticator) Authenticate(ctx context.Context, hc *http.Client) error {
+	return ErrorNoCredentials
+}
+
+// AuthenticateIfNecessary is Authenticator.AuthenticateIfNecessary. This
+// implementation is a no-op.
+func (sta *staticTokenAuthenticator) AuthenticateIfNecessary(ctx context.Context, hc *http.Client) error {
+	return nil
+}
+
+// AddAuthenticationToRequest is Authenticator.AddAuthenticationToRequest.
+//
+// This Authenticator adds the token as an Authorization: Bearer {token} header.
+func (sta *staticTokenAuthenticator) AddAuthenticationToRequest(hc *http.Client, req *http.Request) error {
+	sta.token.addHeader(req)
+	return nil
+}
+
 // tokenResponse represents an OAuth response from a token endpoint.
 type tokenResponse struct {
 	Token         string
@@ -202,20 +280,23 @@ func (tr *tokenResponse) UnmarshalJSON(data []byte) error {
 }
 
 func (tr *tokenResponse) toBearerToken(defaultExpiry time.Duration, alwaysAuthenticateIfNoExpiry bool) *BearerToken {
+	now := timeNow()
 	bt := &BearerToken{
 		Token:                        tr.Token,
+		IssuedAt:                     now,
 		AlwaysAuthenticateIfNoExpiry: alwaysAuthenticateIfNoExpiry,
 	}
 	if tr.ExpiresInSecs > 0 {
-		bt.Expiry = timeNow().Add(time.Duration(tr.ExpiresInSecs) * time.Second)
+		bt.Expiry = now.Add(time.Duration(tr.ExpiresInSecs) * time.Second)
 	} else if defaultExpiry > 0 {
-		bt.Expiry = timeNow().Add(defaultExpiry)
+		bt.Expiry = now.Add(defaultExpiry)
 	}
 	return bt
 }
 
 // DoOAuthExchange sends a HTTP request which is expected to return a JSON
-// response with "token" and "expires_in" fields.
+// response with "token" and "expires_in" fields. The request is cancelled if
+// its context is done.
 func DoOAuthExchange(hc *http.Client, req *http.Request, defaultExpiry time.Duration, alwaysAuthenticateIfNoExpiresIn bool) (*BearerToken, error) {
 	resp, err := hc.Do(req)
 	if err != nil {
@@ -223,11 +304,7 @@ func DoOAuthExchange(hc *http.Client, req *http.Request, defaultExpiry time.Dura
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		respBody, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, fmt.Errorf("unexpected status code %v, but also had an error parsing error body: %v %w", resp.StatusCode, err, ErrorUnexpectedStatusCode)
-		}
-		return nil, fmt.Errorf("unexpected status code %v with error body: %s %w", resp.StatusCode, respBody, ErrorUnexpectedStatusCode)
+		return nil, newHTTPError("OAuth token exchange", resp, ErrorUnexpectedStatusCode)
 	}
 
 	var tr tokenResponse
@@ -239,6 +316,25 @@ func DoOAuthExchange(hc *http.Client, req *http.Request, defaultExpiry time.Dura
 	return tr.toBearerToken(defaultExpiry, alwaysAuthenticateIfNoExpiresIn), nil
 }
 
+// ScopeFormat is how OAuth scopes are serialized in the scope parameter of
+// token requests.
+type ScopeFormat int
+
+const (
+	// ScopesSpaceSeparated joins scopes with spaces, as specified by OAuth 2.0.
+	ScopesSpaceSeparated ScopeFormat = iota
+	// ScopesCommaSeparated joins scopes with commas, for servers which require
+	// this non-standard format.
+	ScopesCommaSeparated
+)
+
+func (sf ScopeFormat) join(scopes []string) string {
+	if sf == ScopesCommaSeparated {
+		return strings.Join(scopes, ",")
+	}
+	return strings.Join(scopes, " ")
+}
+
 // httpBasicOAuthExchanger is an implementation of CredentialExchanger for use
 // with bearerTokenAuthenticator which performs a 2-legged OAuth2 handshake
 // using HTTP Basic Authentication to obtain an access token, which is presented
@@ -248,31 +344,54 @@ func DoOAuthExchange(hc *http.Client, req *http.Request, defaultExpiry time.Dura
 type httpBasicOAuthExchanger struct {
 	username, password, tokenURL    string
 	scopes                          []string
+	scopeFormat                     ScopeFormat
+	grantType                       string
+	extraParams                     url.Values
 	defaultExpiry                   time.Duration
 	alwaysAuthenticateIfNoExpiresIn bool
 }
 
 // buildBody serializes the provided slice of scopes for use in
 // authenticate's HTTP body using the expected urlencoded scheme, and adds in
-// the default grant_type.
+// the grant_type and any extra parameters.
 func (hboe *httpBasicOAuthExchanger) buildBody() io.Reader {
-	if len(hboe.scopes) == 0 {
+	if len(hboe.scopes) == 0 && hboe.grantType == "" && len(hboe.extraParams) == 0 {
 		return nil
 	}
 
 	v := url.Values{}
-	v.Add("scope", strings.Join(hboe.scopes, " "))
-	v.Add("grant_type", "client_credentials")
+	if len(hboe.scopes) > 0 {
+		v.Add("scope", hboe.scopeFormat.join(hboe.scopes))
+	}
+	v.Add("grant_type", grantTypeOrDefault(hboe.grantType))
+	mergeParams(v, hboe.extraParams)
 
 	return bytes.NewBufferString(v.Encode())
 }
 
+const defaultGrantType = "client_credentials"
+
+func grantTypeOrDefault(grantType string) string {
+	if grantType == "" {
+		return defaultGrantType
+	}
+	return grantType
+}
+
+// mergeParams copies extra into v, replacing any values v already has for the
+// same keys.
+func mergeParams(v, extra url.Values) {
+	for k, vals := range extra {
+		v[k] = append([]string(nil), vals...)
+	}
+}
+
 // Authenticate is CredentialExchanger.Authenticate.
 //
 // This CredentialExchanger performs 2-legged OAuth using HTTP Basic
 // Authentication to obtain an expiry token.
-func (hboe *httpBasicOAuthExchanger) Authenticate(hc *http.Client) (*BearerToken, error) {
-	req, err := http.NewRequest(http.MethodPost, hboe.tokenURL, hboe.buildBody())
+func (hboe *httpBasicOAuthExchanger) Authenticate(ctx context.Context, hc *http.Client) (*BearerToken, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hboe.tokenURL, hboe.buildBody())
 	if err != nil {
 		return nil, err
 	}
@@ -290,6 +409,10 @@ type HTTPBasicOAuthOptions struct {
 	// OAuth scopes used when authenticating.
 	Scopes []string
 
+	// How Scopes are serialized in the token request. Defaults to
+	// ScopesSpaceSeparated.
+	ScopeFormat ScopeFormat
+
 	// Whether the authenticator should always refresh if the authentication
 	// server does not provide an "expires_in" duration in the response. The
 	// default behaviour is to automatically authenticate upon first use (when
@@ -303,6 +426,15 @@ type HTTPBasicOAuthOptions struct {
 	// A default expiry duration to use if the authentication server does not
 	// provide an "expires_in" duration in the response.
 	DefaultExpiry time.Duration
+
+	// The OAuth grant_type sent in the token request. Defaults to
+	// "client_credentials".
+	GrantType string
+
+	// Additional parameters to send in the token request, such as "audience" or
+	// "resource". These replace any parameters of the same name set by the
+	// authenticator.
+	ExtraParams url.Values
 }
 
 // NewHTTPBasicOAuthAuthenticator creates a new Authenticator which uses
@@ -310,6 +442,14 @@ type HTTPBasicOAuthOptions struct {
 // The username and password are typically a client ID and client secret
 // (respectively) supplied by the Bulk FHIR Provider.
 func NewHTTPBasicOAuthAuthenticator(username, password, tokenURL string, opts *HTTPBasicOAuthOptions) (Authenticator, error) {
+	e, err := newHTTPBasicOAuthExchanger(username, password, tokenURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &BearerTokenAuthenticator{Exchanger: e}, nil
+}
+
+func newHTTPBasicOAuthExchanger(username, password, tokenURL string, opts *HTTPBasicOAuthOptions) (*httpBasicOAuthExchanger, error) {
 	if username == "" || password == "" {
 		return nil, errors.New("username and password must be specified for HTTP Basic OAuth authentication")
 	}
@@ -328,11 +468,14 @@ func NewHTTPBasicOAuthAuthenticator(username, password, tokenURL string, opts *H
 	}
 	if opts != nil {
 		e.scopes = opts.Scopes
+		e.scopeFormat = opts.ScopeFormat
+		e.grantType = opts.GrantType
+		e.extraParams = opts.ExtraParams
 		e.alwaysAuthenticateIfNoExpiresIn = opts.AlwaysAuthenticateIfNoExpiresIn
 		e.defaultExpiry = opts.DefaultExpiry
 	}
 
-	return &BearerTokenAuthenticator{Exchanger: e}, nil
+	return e, nil
 }
 
 // A JWTKeyProvider provides the RSA private key used for signing JSON Web Tokens.
@@ -377,18 +520,42 @@ func NewPEMFileKeyProvider(filename, keyID string) JWTKeyProvider {
 	return &pemFileKeyProvider{filename: filename, keyID: keyID}
 }
 
+// rsaKeyProvider is an implementation of JWTKeyProvider which holds a key in
+// memory.
+type rsaKeyProvider struct {
+	key   *rsa.PrivateKey
+	keyID string
+}
+
+func (rkp *rsaKeyProvider) Key() (*rsa.PrivateKey, error) {
+	return rkp.key, nil
+}
+
+func (rkp *rsaKeyProvider) KeyID() string {
+	return rkp.keyID
+}
+
+// NewRSAKeyProvider returns a JWTKeyProvider for a key which has already been
+// loaded, for example from a secret manager.
+func NewRSAKeyProvider(key *rsa.PrivateKey, keyID string) JWTKeyProvider {
+	return &rsaKeyProvider{key: key, keyID: keyID}
+}
+
 type jwtOAuthExchanger struct {
 	issuer, subject, tokenURL       string
 	keyProvider                     JWTKeyProvider
 	jwtLifetime                     time.Duration
 	scopes                          []string
+	scopeFormat                     ScopeFormat
+	grantType                       string
+	extraParams                     url.Values
 	defaultExpiry                   time.Duration
 	alwaysAuthenticateIfNoExpiresIn bool
 }
 
 // buildBody serializes the provided slice of scopes for use in
 // authenticate's HTTP body using the expected urlencoded scheme, and adds in
-// the default grant_type.
+// the grant_type and any extra parameters.
 func (joe *jwtOAuthExchanger) buildBody() (io.Reader, error) {
 	key, err := joe.keyProvider.Key()
 	if err != nil {
@@ -409,28 +576,29 @@ func (joe *jwtOAuthExchanger) buildBody() (io.Reader, error) {
 	}
 
 	v := url.Values{
-		"grant_type":            []string{"client_credentials"},
+		"grant_type":            []string{grantTypeOrDefault(joe.grantType)},
 		"client_assertion":      []string{tokenString},
 		"client_assertion_type": []string{"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
 	}
 	if len(joe.scopes) > 0 {
-		v.Add("scope", strings.Join(joe.scopes, " "))
+		v.Add("scope", joe.scopeFormat.join(joe.scopes))
 	}
+	mergeParams(v, joe.extraParams)
 
 	return bytes.NewBufferString(v.Encode()), nil
 }
 
 // Authenticate is CredentialExchanger.Authenticate.
 //
-// This CredentialExchanger performs 2-legged OAuth using HTTP Basic
-// Authentication to obtain an expiry token.
-func (joe *jwtOAuthExchanger) Authenticate(hc *http.Client) (*BearerToken, error) {
+// This CredentialExchanger performs 2-legged OAuth using a signed JWT client
+// assertion to obtain an expiry token. A new JWT is generated for each call.
+func (joe *jwtOAuthExchanger) Authenticate(ctx context.Context, hc *http.Client) (*BearerToken, error) {
 	body, err := joe.buildBody()
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, joe.tokenURL, body)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, joe.tokenURL, body)
 	if err != nil {
 		return nil, err
 	}
@@ -443,12 +611,17 @@ func (joe *jwtOAuthExchanger) Authenticate(hc *http.Client) (*BearerToken, error
 // JWTOAuthOptions contains optional parameters used by NewJWTOAuthAuthenticator.
 type JWTOAuthOptions struct {
 	// How long the generated JWT is valid for (according to its "exp" claim).
-	// Defaults to 5 minutes if unset.
+	// Defaults to 1 minute if unset. The SMART Backend Services spec requires
+	// this to be no more than 5 minutes.
 	JWTLifetime time.Duration
 
 	// OAuth scopes used when authenticating.
 	Scopes []string
 
+	// How Scopes are serialized in the token request. Defaults to
+	// ScopesSpaceSeparated.
+	ScopeFormat ScopeFormat
+
 	// Whether the authenticator should always refresh if the authentication
 	// server does not provide an "expires_in" duration in the response. The
 	// default behaviour is to automatically authenticate upon first use (when
@@ -462,11 +635,35 @@ type JWTOAuthOptions struct {
 	// A default expiry duration to use if the authentication server does not
 	// provide an "expires_in" duration in the response.
 	DefaultExpiry time.Duration
+
+	// The OAuth grant_type sent in the token request. Defaults to
+	// "client_credentials".
+	GrantType string
+
+	// Additional parameters to send in the token request, such as "audience" or
+	// "resource". These replace any parameters of the same name set by the
+	// authenticator.
+	ExtraParams url.Values
+
+	// Vendor specific behaviour to use, for token endpoints which deviate from
+	// the SMART Backend Services spec. Defaults to AuthProfileSMART. See the
+	// AuthProfile constants for what each profile changes.
+	Profile AuthProfile
 }
 
 // NewJWTOAuthAuthenticator creates a new Authenticator which uses  2-legged
 // OAuth with JWT authentication (according to RFC9068) to obtain a bearer token.
+// The JWT is signed with RS384, as described by the SMART Backend Services
+// spec, under which the issuer and subject are both the client ID.
 func NewJWTOAuthAuthenticator(issuer, subject, tokenURL string, keyProvider JWTKeyProvider, opts *JWTOAuthOptions) (Authenticator, error) {
+	e, err := newJWTOAuthExchanger(issuer, subject, tokenURL, keyProvider, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &BearerTokenAuthenticator{Exchanger: e}, nil
+}
+
+func newJWTOAuthExchanger(issuer, subject, tokenURL string, keyProvider JWTKeyProvider, opts *JWTOAuthOptions) (*jwtOAuthExchanger, error) {
 	if issuer == "" || subject == "" {
 		return nil, errors.New("issuer and subject must be specified for JWT OAuth authentication")
 	}
@@ -487,12 +684,18 @@ func NewJWTOAuthAuthenticator(issuer, subject, tokenURL string, keyProvider JWTK
 	}
 	if opts != nil {
 		e.scopes = opts.Scopes
+		e.scopeFormat = opts.ScopeFormat
+		e.grantType = opts.GrantType
+		e.extraParams = opts.ExtraParams
 		e.alwaysAuthenticateIfNoExpiresIn = opts.AlwaysAuthenticateIfNoExpiresIn
 		e.defaultExpiry = opts.DefaultExpiry
 		if opts.JWTLifetime > 0 {
 			e.jwtLifetime = opts.JWTLifetime
 		}
+		if err := e.applyProfile(opts.Profile); err != nil {
+			return nil, err
+		}
 	}
 
-	return &BearerTokenAuthenticator{Exchanger: e}, nil
+	return e, nil
 }
@@ -15,12 +15,14 @@
 package bulkfhir
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
@@ -154,11 +156,45 @@ func TestHTTPBasicOAuthAuthenticator_Authenticate_WithError(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewHTTPBasicOAuthAuthenticator(%q, %q, %q, nil) error: %v", clientID, clientSecret, authURL, err)
 	}
-	if err := authenticator.Authenticate(http.DefaultClient); !errors.Is(err, ErrorUnexpectedStatusCode) {
+	if err := authenticator.Authenticate(context.Background(), http.DefaultClient); !errors.Is(err, ErrorUnexpectedStatusCode) {
 		t.Errorf("Authenticate(%s, %s) returned unexpected error. got: %v, want: %v", clientID, clientSecret, err, ErrorUnexpectedStatusCode)
 	}
 }
 
+func TestHTTPBasicOAuthAuthenticator_ContextCanceled(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// The token endpoint hangs until the test ends.
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	authenticator, err := NewHTTPBasicOAuthAuthenticator("id", "secret", server.URL+"/auth/token", nil)
+	if err != nil {
+		t.Fatalf("NewHTTPBasicOAuthAuthenticator() error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := authenticator.Authenticate(ctx, &http.Client{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Authenticate() returned unexpected error. got: %v, want: %v", err, context.DeadlineExceeded)
+	}
+
+	reqCtx, reqCancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer reqCancel()
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := authenticator.AddAuthenticationToRequest(&http.Client{}, req); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("AddAuthenticationToRequest() returned unexpected error. got: %v, want: %v", err, context.DeadlineExceeded)
+	}
+}
+
 func TestHTTPBasicOAuthAuthenticator_AuthenticateOnlyIfNecessary(t *testing.T) {
 	for _, tc := range []struct {
 		description      string
@@ -179,6 +215,24 @@ func TestHTTPBasicOAuthAuthenticator_AuthenticateOnlyIfNecessary(t *testing.T) {
 			advanceTime:      25 * time.Minute,
 			wantAuthHeader:   "Bearer token2",
 		},
+		{
+			description:      "with expires_in, expiry within renewal margin",
+			responseTemplate: `{"access_token": "token%d", "expires_in": 1200}`,
+			advanceTime:      19*time.Minute + 30*time.Second,
+			wantAuthHeader:   "Bearer token2",
+		},
+		{
+			description:      "short lived token, not renewed immediately",
+			responseTemplate: `{"access_token": "token%d", "expires_in": 30}`,
+			advanceTime:      10 * time.Second,
+			wantAuthHeader:   "Bearer token1",
+		},
+		{
+			description:      "short lived token, within half its lifetime of expiry",
+			responseTemplate: `{"access_token": "token%d", "expires_in": 30}`,
+			advanceTime:      20 * time.Second,
+			wantAuthHeader:   "Bearer token2",
+		},
 		{
 			description:      "with string expires_in, expiry reached",
 			responseTemplate: `{"access_token": "token%d", "expires_in": "1200"}`,
@@ -418,6 +472,48 @@ func TestJWTOAuthAuthenticator_AddAuthenticationToRequest(t *testing.T) {
 	}
 }
 
+func TestJWTOAuthAuthenticator_RSAKeyProvider(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var assertions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			t.Errorf("Authenticate() sent a body that could not be parsed as a form: %s", err)
+		}
+		assertion := req.Form.Get("client_assertion")
+		token, err := jwt.Parse(assertion, func(_ *jwt.Token) (any, error) {
+			return key.Public(), nil
+		})
+		if err != nil {
+			t.Fatalf("Failed to parse JWT: %v", err)
+		}
+		if got := token.Method.Alg(); got != jwt.SigningMethodRS384.Alg() {
+			t.Errorf("Authenticate() sent JWT signed with unexpected algorithm. got: %q, want: %q", got, jwt.SigningMethodRS384.Alg())
+		}
+		if got := token.Header["kid"]; got != "kid" {
+			t.Errorf("Authenticate() sent invalid JWT key ID. got: %v, want: %q", got, "kid")
+		}
+		assertions = append(assertions, assertion)
+		w.Write([]byte(`{"access_token": "123", "expires_in": 1200}`))
+	}))
+	defer server.Close()
+
+	authenticator, err := NewJWTOAuthAuthenticator("client-id", "client-id", server.URL+"/auth/token", NewRSAKeyProvider(key, "kid"), nil)
+	if err != nil {
+		t.Fatalf("NewJWTOAuthAuthenticator() error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := authenticator.Authenticate(context.Background(), &http.Client{}); err != nil {
+			t.Fatalf("Authenticate() returned unexpected error: %v", err)
+		}
+	}
+	if len(assertions) != 2 || assertions[0] == assertions[1] {
+		t.Errorf("Authenticate() did not send a new JWT on each call: %v", assertions)
+	}
+}
+
 func TestJWTOAuthAuthenticator_Authenticate_WithError(t *testing.T) {
 	wantErrBody := []byte(`an error`)
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -440,7 +536,7 @@ func TestJWTOAuthAuthenticator_Authenticate_WithError(t *testing.T) {
 	if err != nil {
 		t.Fatalf("NewJWTOAuthAuthenticator(%q, %q, %q, keyProvider, nil) error: %v", issuer, subject, authURL, err)
 	}
-	if err := authenticator.Authenticate(http.DefaultClient); !errors.Is(err, ErrorUnexpectedStatusCode) {
+	if err := authenticator.Authenticate(context.Background(), http.DefaultClient); !errors.Is(err, ErrorUnexpectedStatusCode) {
 		t.Errorf("Authenticate() returned unexpected error. got: %v, want: %v", err, ErrorUnexpectedStatusCode)
 	}
 }
@@ -465,6 +561,24 @@ func TestJWTOAuthAuthenticator_AuthenticateOnlyIfNecessary(t *testing.T) {
 			advanceTime:      25 * time.Minute,
 			wantAuthHeader:   "Bearer token2",
 		},
+		{
+			description:      "with expires_in, expiry within renewal margin",
+			responseTemplate: `{"access_token": "token%d", "expires_in": 1200}`,
+			advanceTime:      19*time.Minute + 30*time.Second,
+			wantAuthHeader:   "Bearer token2",
+		},
+		{
+			description:      "short lived token, not renewed immediately",
+			responseTemplate: `{"access_token": "token%d", "expires_in": 30}`,
+			advanceTime:      10 * time.Second,
+			wantAuthHeader:   "Bearer token1",
+		},
+		{
+			description:      "short lived token, within half its lifetime of expiry",
+			responseTemplate: `{"access_token": "token%d", "expires_in": 30}`,
+			advanceTime:      20 * time.Second,
+			wantAuthHeader:   "Bearer token2",
+		},
 		{
 			description:      "no expires_in, default behaviour",
 			responseTemplate: `{"access_token": "token%d"}`,
@@ -555,3 +669,132 @@ func buildRequestAndCheckHeader(t *testing.T, authenticator Authenticator, wantH
 		t.Fatalf("AddAuthenticationToRequest() added incorrect Authorization header: got %q, want: %q", authHeader, wantHeader)
 	}
 }
+
+func TestStaticTokenAuthenticator(t *testing.T) {
+	a := NewStaticTokenAuthenticator("token")
+	hc := &http.Client{}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err := a.AddAuthenticationToRequest(hc, req); err != nil {
+		t.Fatalf("AddAuthenticationToRequest() returned unexpected error: %v", err)
+	}
+	if got, want := req.Header.Get("Authorization"), "Bearer token"; got != want {
+		t.Errorf("unexpected Authorization header. got: %q, want: %q", got, want)
+	}
+	if err := a.AuthenticateIfNecessary(context.Background(), hc); err != nil {
+		t.Errorf("AuthenticateIfNecessary() returned unexpected error: %v", err)
+	}
+	if err := a.Authenticate(context.Background(), hc); !errors.Is(err, ErrorNoCredentials) {
+		t.Errorf("Authenticate() returned unexpected error. got: %v, want: %v", err, ErrorNoCredentials)
+	}
+}
+
+func TestOAuthAuthenticators_GrantTypeAndExtraParams(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		grantType     string
+		extraParams   url.Values
+		wantGrantType string
+		wantAudience  []string
+	}{
+		{
+			name:          "Defaults",
+			wantGrantType: "client_credentials",
+		},
+		{
+			name:          "CustomGrantType",
+			grantType:     "urn:custom:grant",
+			wantGrantType: "urn:custom:grant",
+		},
+		{
+			name:          "ExtraParams",
+			extraParams:   url.Values{"audience": []string{"https://api.example.com"}},
+			wantGrantType: "client_credentials",
+			wantAudience:  []string{"https://api.example.com"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if err := req.ParseForm(); err != nil {
+					t.Errorf("Authenticate() sent a body that could not be parsed as a form: %s", err)
+				}
+				if diff := cmp.Diff([]string{tc.wantGrantType}, req.Form["grant_type"]); diff != "" {
+					t.Errorf("Authenticate() sent unexpected grant_type (-want +got):\n%s", diff)
+				}
+				if diff := cmp.Diff(tc.wantAudience, req.Form["audience"]); diff != "" {
+					t.Errorf("Authenticate() sent unexpected audience (-want +got):\n%s", diff)
+				}
+				w.Write([]byte(`{"access_token": "123", "expires_in": 1200}`))
+			}))
+			defer server.Close()
+			authURL := server.URL + "/auth/token"
+
+			basic, err := NewHTTPBasicOAuthAuthenticator("id", "secret", authURL, &HTTPBasicOAuthOptions{Scopes: []string{"a"}, GrantType: tc.grantType, ExtraParams: tc.extraParams})
+			if err != nil {
+				t.Fatalf("NewHTTPBasicOAuthAuthenticator() error: %v", err)
+			}
+			buildRequestAndCheckHeader(t, basic, "Bearer 123")
+
+			jwtAuth, err := NewJWTOAuthAuthenticator("issuer", "subject", authURL, &testKeyProvider{key, "kid"}, &JWTOAuthOptions{GrantType: tc.grantType, ExtraParams: tc.extraParams})
+			if err != nil {
+				t.Fatalf("NewJWTOAuthAuthenticator() error: %v", err)
+			}
+			buildRequestAndCheckHeader(t, jwtAuth, "Bearer 123")
+		})
+	}
+}
+
+func TestOAuthAuthenticators_ScopeFormat(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		scopeFormat ScopeFormat
+		wantScope   string
+	}{
+		{
+			name:      "DefaultSpaceSeparated",
+			wantScope: "system/*.read system/Patient.read",
+		},
+		{
+			name:        "CommaSeparated",
+			scopeFormat: ScopesCommaSeparated,
+			wantScope:   "system/*.read,system/Patient.read",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if err := req.ParseForm(); err != nil {
+					t.Errorf("Authenticate() sent a body that could not be parsed as a form: %s", err)
+				}
+				if diff := cmp.Diff([]string{tc.wantScope}, req.Form["scope"]); diff != "" {
+					t.Errorf("Authenticate() sent unexpected scope (-want +got):\n%s", diff)
+				}
+				w.Write([]byte(`{"access_token": "123", "expires_in": 1200}`))
+			}))
+			defer server.Close()
+			authURL := server.URL + "/auth/token"
+			scopes := []string{"system/*.read", "system/Patient.read"}
+
+			basic, err := NewHTTPBasicOAuthAuthenticator("id", "secret", authURL, &HTTPBasicOAuthOptions{Scopes: scopes, ScopeFormat: tc.scopeFormat})
+			if err != nil {
+				t.Fatalf("NewHTTPBasicOAuthAuthenticator() error: %v", err)
+			}
+			buildRequestAndCheckHeader(t, basic, "Bearer 123")
+
+			jwtAuth, err := NewJWTOAuthAuthenticator("issuer", "subject", authURL, &testKeyProvider{key, "kid"}, &JWTOAuthOptions{Scopes: scopes, ScopeFormat: tc.scopeFormat})
+			if err != nil {
+				t.Fatalf("NewJWTOAuthAuthenticator() error: %v", err)
+			}
+			buildRequestAndCheckHeader(t, jwtAuth, "Bearer 123")
+		})
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// AuthProfile selects vendor specific behaviour for NewJWTOAuthAuthenticator,
+// for EHR vendors whose backend services authorization deviates from the SMART
+// Backend Services spec.
+type AuthProfile int
+
+const (
+	// AuthProfileSMART follows the SMART Backend Services spec (and is also
+	// accepted by BCDA). This is the default. The JWT is signed with RS384, with
+	// the token URL as its audience and the key ID in its header, and Scopes (if
+	// any) are sent as given.
+	AuthProfileSMART AuthProfile = iota
+	// AuthProfileEpic is AuthProfileSMART, with the following differences for
+	// Epic:
+	//   - The scope parameter is never sent, as Epic grants the scopes configured
+	//     for the client's registration. Any Scopes given are logged and ignored.
+	//   - The JWT lifetime is capped at 5 minutes, as Epic rejects client
+	//     assertions which expire later than that.
+	AuthProfileEpic
+	// AuthProfileCerner is AuthProfileSMART, with the following differences for
+	// Cerner (Oracle Health):
+	//   - At least one scope is required, as Cerner does not grant any scopes by
+	//     default.
+	//   - Scopes are sent in the SMART v1 format Cerner expects, so SMART v2
+	//     permissions are converted (for example, system/Patient.rs is sent as
+	//     system/Patient.read).
+	//   - The JWT lifetime is capped at 5 minutes.
+	AuthProfileCerner
+)
+
+func (p AuthProfile) String() string {
+	switch p {
+	case AuthProfileSMART:
+		return "SMART"
+	case AuthProfileEpic:
+		return "Epic"
+	case AuthProfileCerner:
+		return "Cerner"
+	default:
+		return fmt.Sprintf("AuthProfile(%d)", int(p))
+	}
+}
+
+// maxVendorJWTLifetime is the maximum JWT lifetime accepted by Epic and
+// Cerner.
+const maxVendorJWTLifetime = 5 * time.Minute
+
+// applyProfile adjusts the exchanger for the given profile.
+func (joe *jwtOAuthExchanger) applyProfile(p AuthProfile) error {
+	switch p {
+	case AuthProfileSMART:
+	case AuthProfileEpic:
+		if len(joe.scopes) > 0 {
+			log.Warningf("Ignoring OAuth scopes %v, as the Epic auth profile does not send scopes.", joe.scopes)
+			joe.scopes = nil
+		}
+		joe.jwtLifetime = min(joe.jwtLifetime, maxVendorJWTLifetime)
+	case AuthProfileCerner:
+		if len(joe.scopes) == 0 {
+			return errors.New("at least one scope must be specified for the Cerner auth profile")
+		}
+		joe.scopes = smartV1Scopes(joe.scopes)
+		joe.jwtLifetime = min(joe.jwtLifetime, maxVendorJWTLifetime)
+	default:
+		return fmt.Errorf("unknown AuthProfile %d", p)
+	}
+	return nil
+}
+
+// smartV1Scopes converts any SMART v2 scopes (such as system/Patient.rs) to
+// their SMART v1 equivalents (system/Patient.read). Scopes which are not SMART
+// v2 resource scopes are returned unchanged. The order of scopes is kept, with
+// duplicates removed.
+func smartV1Scopes(scopes []string) []string {
+	var converted []string
+	seen := map[string]bool{}
+	add := func(s string) {
+		if !seen[s] {
+			seen[s] = true
+			converted = append(converted, s)
+		}
+	}
+	for _, scope := range scopes {
+		i := strings.LastIndex(scope, ".")
+		if i < 0 || !strings.Contains(scope[:i], "/") || !isSMARTV2Permissions(scope[i+1:]) {
+			add(scope)
+			continue
+		}
+		prefix, perms := scope[:i+1], scope[i+1:]
+		if strings.ContainsAny(perms, "rs") {
+			add(prefix + "read")
+		}
+		if strings.ContainsAny(perms, "cud") {
+			add(prefix + "write")
+		}
+	}
+	return converted
+}
+
+// isSMARTV2Permissions returns whether s is a SMART v2 permission string, such
+// as "rs" or "cruds".
+func isSMARTV2Permissions(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !strings.ContainsRune("cruds", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// smartConfiguration holds the fields used from a server's
+// .well-known/smart-configuration document.
+type smartConfiguration struct {
+	TokenEndpoint string `json:"token_endpoint"`
+}
+
+// DiscoverTokenURL returns the token endpoint of the FHIR server with the given
+// base URL, read from its .well-known/smart-configuration document. This is
+// useful for servers (such as Epic and Cerner) whose token endpoints vary
+// between tenants. The request is cancelled if ctx is done.
+func DiscoverTokenURL(ctx context.Context, hc *http.Client, fhirBaseURL string) (string, error) {
+	configURL := strings.TrimSuffix(fhirBaseURL, "/") + "/.well-known/smart-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, configURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add(acceptHeader, acceptHeaderJSON)
+	resp, err := hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", newHTTPError("SMART configuration discovery", resp, ErrorUnexpectedStatusCode)
+	}
+	var config smartConfiguration
+	if err := json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		return "", fmt.Errorf("failed to parse SMART configuration from %s: %w", configURL, err)
+	}
+	if config.TokenEndpoint == "" {
+		return "", fmt.Errorf("SMART configuration from %s has no token_endpoint", configURL)
+	}
+	return config.TokenEndpoint, nil
+}
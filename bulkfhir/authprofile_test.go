@@ -0,0 +1,183 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestJWTOAuthAuthenticator_Profiles(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	timeNow = func() time.Time { return now }
+	defer func() { timeNow = time.Now }()
+
+	cases := []struct {
+		name    string
+		profile AuthProfile
+		scopes  []string
+		// The expected token request, with the client_assertion removed.
+		wantForm url.Values
+		// The expected lifetime of the client assertion.
+		wantJWTLifetime time.Duration
+	}{
+		{
+			name:    "SMART",
+			profile: AuthProfileSMART,
+			scopes:  []string{"system/Patient.rs", "system/Observation.read"},
+			wantForm: url.Values{
+				"grant_type":            {"client_credentials"},
+				"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+				"scope":                 {"system/Patient.rs system/Observation.read"},
+			},
+			wantJWTLifetime: 10 * time.Minute,
+		},
+		{
+			name:    "Epic",
+			profile: AuthProfileEpic,
+			scopes:  []string{"system/Patient.read"},
+			wantForm: url.Values{
+				"grant_type":            {"client_credentials"},
+				"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+			},
+			wantJWTLifetime: 5 * time.Minute,
+		},
+		{
+			name:    "Cerner",
+			profile: AuthProfileCerner,
+			scopes:  []string{"system/Patient.rs", "system/Observation.cruds", "system/Encounter.read", "system/Patient.read"},
+			wantForm: url.Values{
+				"grant_type":            {"client_credentials"},
+				"client_assertion_type": {"urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+				"scope":                 {"system/Patient.read system/Observation.read system/Observation.write system/Encounter.read"},
+			},
+			wantJWTLifetime: 5 * time.Minute,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var tokenURL string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if err := req.ParseForm(); err != nil {
+					t.Fatalf("Failed to parse request form: %v", err)
+				}
+				claims := &jwt.StandardClaims{}
+				token, err := jwt.ParseWithClaims(req.PostForm.Get("client_assertion"), claims, func(_ *jwt.Token) (any, error) {
+					return key.Public(), nil
+				})
+				if err != nil {
+					t.Fatalf("Failed to parse JWT: %v", err)
+				}
+				if token.Method != jwt.SigningMethodRS384 || token.Header["kid"] != "kid" || token.Header["typ"] != "JWT" {
+					t.Errorf("Authenticate() sent unexpected JWT header: %v", token.Header)
+				}
+				if claims.Issuer != "client-id" || claims.Subject != "client-id" || claims.Audience != tokenURL || claims.Id == "" {
+					t.Errorf("Authenticate() sent unexpected JWT claims: %+v", claims)
+				}
+				if got, want := claims.ExpiresAt, now.Add(tc.wantJWTLifetime).Unix(); got != want {
+					t.Errorf("Authenticate() sent incorrect 'exp' claim. got: %d, want: %d", got, want)
+				}
+
+				form := req.PostForm
+				form.Del("client_assertion")
+				if diff := cmp.Diff(tc.wantForm, form); diff != "" {
+					t.Errorf("Authenticate() sent unexpected token request (-want +got):\n%s", diff)
+				}
+				w.Write([]byte(`{"access_token": "123", "expires_in": 1200}`))
+			}))
+			defer server.Close()
+			tokenURL = server.URL + "/oauth2/token"
+
+			opts := &JWTOAuthOptions{Scopes: tc.scopes, JWTLifetime: 10 * time.Minute, Profile: tc.profile}
+			authenticator, err := NewJWTOAuthAuthenticator("client-id", "client-id", tokenURL, &testKeyProvider{key, "kid"}, opts)
+			if err != nil {
+				t.Fatalf("NewJWTOAuthAuthenticator(profile %s) returned unexpected error: %v", tc.profile, err)
+			}
+			buildRequestAndCheckHeader(t, authenticator, "Bearer 123")
+		})
+	}
+}
+
+func TestJWTOAuthAuthenticator_CernerProfileRequiresScopes(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &JWTOAuthOptions{Profile: AuthProfileCerner}
+	if _, err := NewJWTOAuthAuthenticator("client-id", "client-id", "https://example.com/token", &testKeyProvider{key, "kid"}, opts); err == nil {
+		t.Errorf("NewJWTOAuthAuthenticator(profile Cerner, no scopes) succeeded, want error")
+	}
+}
+
+func TestSMARTV1Scopes(t *testing.T) {
+	for _, tc := range []struct {
+		in   []string
+		want []string
+	}{
+		{[]string{"system/Patient.rs"}, []string{"system/Patient.read"}},
+		{[]string{"system/Patient.cud"}, []string{"system/Patient.write"}},
+		{[]string{"system/*.cruds"}, []string{"system/*.read", "system/*.write"}},
+		{[]string{"system/Patient.read", "system/Patient.r"}, []string{"system/Patient.read"}},
+		{[]string{"launch", "offline_access", "system/Patient.write"}, []string{"launch", "offline_access", "system/Patient.write"}},
+	} {
+		if diff := cmp.Diff(tc.want, smartV1Scopes(tc.in)); diff != "" {
+			t.Errorf("smartV1Scopes(%v) returned unexpected scopes (-want +got):\n%s", tc.in, diff)
+		}
+	}
+}
+
+func TestDiscoverTokenURL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/fhir/.well-known/smart-configuration":
+			w.Write([]byte(`{"token_endpoint": "https://example.com/oauth2/token", "grant_types_supported": ["client_credentials"]}`))
+		case "/empty/.well-known/smart-configuration":
+			w.Write([]byte(`{}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	got, err := DiscoverTokenURL(context.Background(), server.Client(), server.URL+"/fhir/")
+	if err != nil {
+		t.Fatalf("DiscoverTokenURL() returned unexpected error: %v", err)
+	}
+	if want := "https://example.com/oauth2/token"; got != want {
+		t.Errorf("DiscoverTokenURL() returned unexpected token URL. got: %q, want: %q", got, want)
+	}
+
+	if _, err := DiscoverTokenURL(context.Background(), server.Client(), server.URL+"/empty"); err == nil {
+		t.Errorf("DiscoverTokenURL() with no token_endpoint succeeded, want error")
+	}
+	if _, err := DiscoverTokenURL(context.Background(), server.Client(), server.URL+"/missing"); !errors.Is(err, ErrorUnexpectedStatusCode) {
+		t.Errorf("DiscoverTokenURL() with missing configuration returned unexpected error. got: %v, want: %v", err, ErrorUnexpectedStatusCode)
+	}
+}
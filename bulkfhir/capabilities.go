@@ -0,0 +1,168 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+var (
+	// ErrorExportNotSupported indicates that the server's CapabilityStatement
+	// does not declare support for the bulk data $export operation.
+	ErrorExportNotSupported = errors.New("server CapabilityStatement does not declare the bulk data $export operation")
+	// ErrorResourceTypeNotSupported indicates that the server's
+	// CapabilityStatement does not list one or more requested resource types.
+	ErrorResourceTypeNotSupported = errors.New("server CapabilityStatement does not declare support for the requested resource type(s)")
+)
+
+// bulkDataCapabilityStatement is the canonical URL of the Bulk Data Access IG
+// CapabilityStatement, which servers may declare in "instantiates".
+const bulkDataCapabilityStatement = "http://hl7.org/fhir/uv/bulkdata/CapabilityStatement/bulk-data"
+
+// capabilityStatement holds the subset of a FHIR CapabilityStatement needed to
+// determine bulk data export support.
+type capabilityStatement struct {
+	Instantiates []string                  `json:"instantiates"`
+	Rest         []capabilityStatementRest `json:"rest"`
+}
+
+type capabilityStatementRest struct {
+	Mode      string                         `json:"mode"`
+	Resource  []capabilityStatementResource  `json:"resource"`
+	Operation []capabilityStatementOperation `json:"operation"`
+}
+
+type capabilityStatementResource struct {
+	Type      string                         `json:"type"`
+	Operation []capabilityStatementOperation `json:"operation"`
+}
+
+type capabilityStatementOperation struct {
+	Name       string `json:"name"`
+	Definition string `json:"definition"`
+}
+
+// isExport returns true if the operation appears to be one of the bulk data
+// $export operations (system, patient or group level).
+func (o capabilityStatementOperation) isExport() bool {
+	switch strings.TrimPrefix(o.Name, "$") {
+	case "export", "patient-export", "group-export":
+		return true
+	}
+	return strings.Contains(o.Definition, "/bulkdata/OperationDefinition/")
+}
+
+// supportsExport returns true if the CapabilityStatement declares a bulk data
+// $export operation at either the system or the resource level.
+func (cs *capabilityStatement) supportsExport() bool {
+	for _, i := range cs.Instantiates {
+		if strings.HasPrefix(i, bulkDataCapabilityStatement) {
+			return true
+		}
+	}
+	for _, r := range cs.Rest {
+		for _, o := range r.Operation {
+			if o.isExport() {
+				return true
+			}
+		}
+		for _, res := range r.Resource {
+			for _, o := range res.Operation {
+				if o.isExport() {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// supportedResourceTypes returns the set of resource type names declared by
+// the server-mode rest entries of the CapabilityStatement.
+func (cs *capabilityStatement) supportedResourceTypes() map[string]bool {
+	types := map[string]bool{}
+	for _, r := range cs.Rest {
+		if r.Mode != "" && r.Mode != "server" {
+			continue
+		}
+		for _, res := range r.Resource {
+			types[res.Type] = true
+		}
+	}
+	return types
+}
+
+// CheckCapabilities fetches the server's CapabilityStatement (from the
+// /metadata endpoint) and verifies that it declares the bulk data $export
+// operation, and that each of the requested resource types is supported. It
+// returns an error wrapping ErrorExportNotSupported or
+// ErrorResourceTypeNotSupported if this is not the case.
+//
+// Calling this before StartBulkDataExport is optional. Some servers publish
+// incomplete CapabilityStatements, so callers may prefer to log the returned
+// error rather than treat it as fatal.
+func (c *Client) CheckCapabilities(ctx context.Context, types []cpb.ResourceTypeCode_Value) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+c.serverProfile().MetadataPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Add(acceptHeader, acceptHeaderFHIRJSON)
+
+	resp, err := c.doHTTP(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return newHTTPError("fetch CapabilityStatement", resp, ErrorUnauthorized)
+	default:
+		return newHTTPError("fetch CapabilityStatement", resp, ErrorUnexpectedStatusCode)
+	}
+
+	var cs capabilityStatement
+	if err := json.NewDecoder(resp.Body).Decode(&cs); err != nil {
+		return fmt.Errorf("failed to parse CapabilityStatement: %w", err)
+	}
+
+	if !cs.supportsExport() {
+		return ErrorExportNotSupported
+	}
+
+	supported := cs.supportedResourceTypes()
+	var missing []string
+	for _, t := range types {
+		name, err := ResourceTypeCodeToName(t)
+		if err != nil {
+			return err
+		}
+		if !supported[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrorResourceTypeNotSupported, strings.Join(missing, ","))
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestClient_CheckCapabilities(t *testing.T) {
+	cases := []struct {
+		name       string
+		statement  string
+		statusCode int
+		types      []cpb.ResourceTypeCode_Value
+		wantErr    error
+	}{
+		{
+			name: "SystemLevelExportWithTypes",
+			statement: `{"resourceType": "CapabilityStatement", "rest": [{"mode": "server",
+				"resource": [{"type": "Patient"}, {"type": "Coverage"}],
+				"operation": [{"name": "export", "definition": "http://hl7.org/fhir/uv/bulkdata/OperationDefinition/export"}]}]}`,
+			types: []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_COVERAGE},
+		},
+		{
+			name: "GroupLevelExport",
+			statement: `{"resourceType": "CapabilityStatement", "rest": [{"mode": "server",
+				"resource": [{"type": "Group", "operation": [{"name": "export", "definition": "http://hl7.org/fhir/uv/bulkdata/OperationDefinition/group-export"}]}, {"type": "Patient"}]}]}`,
+			types: []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT},
+		},
+		{
+			name:      "InstantiatesBulkData",
+			statement: `{"resourceType": "CapabilityStatement", "instantiates": ["http://hl7.org/fhir/uv/bulkdata/CapabilityStatement/bulk-data"]}`,
+		},
+		{
+			name:      "NoExportOperation",
+			statement: `{"resourceType": "CapabilityStatement", "rest": [{"mode": "server", "resource": [{"type": "Patient"}]}]}`,
+			types:     []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT},
+			wantErr:   ErrorExportNotSupported,
+		},
+		{
+			name: "UnsupportedResourceType",
+			statement: `{"resourceType": "CapabilityStatement", "rest": [{"mode": "server",
+				"resource": [{"type": "Patient"}],
+				"operation": [{"name": "export"}]}]}`,
+			types:   []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT},
+			wantErr: ErrorResourceTypeNotSupported,
+		},
+		{
+			name:       "Unauthorized",
+			statusCode: http.StatusUnauthorized,
+			wantErr:    ErrorUnauthorized,
+		},
+		{
+			name:       "ServerError",
+			statusCode: http.StatusInternalServerError,
+			wantErr:    ErrorUnexpectedStatusCode,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/metadata" {
+					t.Errorf("CheckCapabilities made request with unexpected path. got: %v, want: %v", req.URL.Path, "/metadata")
+				}
+				if tc.statusCode != 0 {
+					w.WriteHeader(tc.statusCode)
+					return
+				}
+				w.Write([]byte(tc.statement))
+			}))
+			defer server.Close()
+
+			cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+			err := cl.CheckCapabilities(context.Background(), tc.types)
+			if tc.wantErr == nil && err != nil {
+				t.Errorf("CheckCapabilities(%v) returned unexpected error: %v", tc.types, err)
+			}
+			if tc.wantErr != nil && !errors.Is(err, tc.wantErr) {
+				t.Errorf("CheckCapabilities(%v) returned unexpected error. got: %v, want: %v", tc.types, err, tc.wantErr)
+			}
+		})
+	}
+}
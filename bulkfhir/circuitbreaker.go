@@ -0,0 +1,206 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+const (
+	defaultCircuitBreakerFailureThreshold = 5
+	defaultCircuitBreakerCooldown         = 30 * time.Second
+)
+
+// CircuitBreakerOptions configures the circuit breaker of a Client (see
+// ClientOptions). After FailureThreshold consecutive failed requests (network
+// errors, and 5xx responses) the circuit opens, and requests fail fast with
+// ErrorCircuitOpen without being sent. Once Cooldown has passed, the circuit
+// half-opens, and a single request is sent to probe the server: if it
+// succeeds the circuit closes, and otherwise it opens again for another
+// Cooldown.
+type CircuitBreakerOptions struct {
+	// The number of consecutive failures which open the circuit. Defaults to 5.
+	FailureThreshold int
+	// The time for which the circuit stays open before a probe request is
+	// allowed. Defaults to 30 seconds.
+	Cooldown time.Duration
+	// If set, called whenever the state of the circuit changes, for example to
+	// record metrics. It must not make requests with the Client.
+	OnStateChange func(from, to CircuitState)
+}
+
+// CircuitState is the state of a Client's circuit breaker.
+type CircuitState int
+
+const (
+	// CircuitClosed is the normal state, in which requests are sent.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen is the state after consecutive failures, in which requests
+	// fail fast with ErrorCircuitOpen.
+	CircuitOpen
+	// CircuitHalfOpen is the state once the cooldown has passed, in which a
+	// single probe request is sent to check whether the server has recovered.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	default:
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+}
+
+// CircuitState returns the current state of the Client's circuit breaker. It
+// is always CircuitClosed if the Client has no circuit breaker.
+func (c *Client) CircuitState() CircuitState {
+	return c.breaker.currentState()
+}
+
+// circuitBreaker tracks the outcomes of requests. Its methods may be called on
+// a nil circuitBreaker, which allows every request.
+type circuitBreaker struct {
+	opts CircuitBreakerOptions
+
+	mu    sync.Mutex
+	state CircuitState
+	// failures is the number of consecutive failures while closed.
+	failures int
+	// openedAt is when the circuit last opened.
+	openedAt time.Time
+	// probing is set while the probe request of the half-open state is in
+	// flight.
+	probing bool
+}
+
+func newCircuitBreaker(opts CircuitBreakerOptions) *circuitBreaker {
+	if opts.FailureThreshold <= 0 {
+		opts.FailureThreshold = defaultCircuitBreakerFailureThreshold
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = defaultCircuitBreakerCooldown
+	}
+	return &circuitBreaker{opts: opts}
+}
+
+func (cb *circuitBreaker) currentState() CircuitState {
+	if cb == nil {
+		return CircuitClosed
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == CircuitOpen && !timeNow().Before(cb.openedAt.Add(cb.opts.Cooldown)) {
+		return CircuitHalfOpen
+	}
+	return cb.state
+}
+
+// allow returns ErrorCircuitOpen (wrapped) if a request should not be sent.
+// If it returns nil, the outcome of the request must be passed to record, or
+// abandon called if it is not sent.
+func (cb *circuitBreaker) allow() error {
+	if cb == nil {
+		return nil
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == CircuitOpen {
+		retryAt := cb.openedAt.Add(cb.opts.Cooldown)
+		if timeNow().Before(retryAt) {
+			return fmt.Errorf("%w: retrying after %s", ErrorCircuitOpen, retryAt.Format(time.RFC3339))
+		}
+		cb.setState(CircuitHalfOpen)
+	}
+	if cb.state == CircuitHalfOpen {
+		if cb.probing {
+			return fmt.Errorf("%w: waiting for a probe request", ErrorCircuitOpen)
+		}
+		cb.probing = true
+	}
+	return nil
+}
+
+// abandon is called instead of record if a request allowed by allow is not
+// sent.
+func (cb *circuitBreaker) abandon() {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	cb.probing = false
+}
+
+// record updates the state of the circuit with the outcome of a request.
+// Requests cancelled by the caller are not counted as failures.
+func (cb *circuitBreaker) record(ctx context.Context, resp *http.Response, err error) {
+	if cb == nil {
+		return
+	}
+	failed := err != nil || resp.StatusCode >= 500
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	wasProbe := cb.probing
+	cb.probing = false
+	if err != nil && (ctx.Err() != nil || errors.Is(err, context.Canceled)) {
+		return
+	}
+	switch {
+	case !failed:
+		cb.failures = 0
+		cb.setState(CircuitClosed)
+	case wasProbe || cb.state != CircuitClosed:
+		cb.openedAt = timeNow()
+		cb.setState(CircuitOpen)
+	default:
+		cb.failures++
+		if cb.failures >= cb.opts.FailureThreshold {
+			cb.failures = 0
+			cb.openedAt = timeNow()
+			cb.setState(CircuitOpen)
+		}
+	}
+}
+
+// setState changes the state of the circuit, logging and reporting any
+// change. cb.mu must be held.
+func (cb *circuitBreaker) setState(state CircuitState) {
+	from := cb.state
+	if from == state {
+		return
+	}
+	cb.state = state
+	switch state {
+	case CircuitOpen:
+		log.Warningf("Circuit breaker opened after consecutive server failures; failing requests for %s.", cb.opts.Cooldown)
+	case CircuitClosed:
+		log.Infof("Circuit breaker closed; the server has recovered.")
+	}
+	if cb.opts.OnStateChange != nil {
+		cb.opts.OnStateChange(from, state)
+	}
+}
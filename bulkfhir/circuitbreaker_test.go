@@ -0,0 +1,169 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// newFlakyServer returns a server which responds to every request with 503
+// Service Unavailable while *failing is set, and 200 OK otherwise, and counts
+// the requests received in *requests.
+func newFlakyServer(t *testing.T, failing *bool, requests *int) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		*requests++
+		if *failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"resourceType":"Patient","id":"1"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClient_CircuitBreaker(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	failing := true
+	requests := 0
+	server := newFlakyServer(t, &failing, &requests)
+	var transitions []string
+	cl, err := NewClientWithOptions(server.URL, testAuthenticator{}, &ClientOptions{
+		CircuitBreaker: &CircuitBreakerOptions{
+			FailureThreshold: 3,
+			Cooldown:         time.Minute,
+			OnStateChange: func(from, to CircuitState) {
+				transitions = append(transitions, from.String()+"->"+to.String())
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClientWithOptions() returned unexpected error: %v", err)
+	}
+	getData := func() error {
+		r, err := cl.GetData(context.Background(), server.URL + "/Patient")
+		if err == nil {
+			r.Close()
+		}
+		return err
+	}
+
+	// The circuit opens after 3 consecutive failures.
+	for i := 0; i < 3; i++ {
+		if err := getData(); err == nil || errors.Is(err, ErrorCircuitOpen) {
+			t.Fatalf("GetData() returned unexpected error. got: %v, want server error", err)
+		}
+	}
+	if got := cl.CircuitState(); got != CircuitOpen {
+		t.Errorf("CircuitState() after failures = %v, want %v", got, CircuitOpen)
+	}
+	if err := getData(); !errors.Is(err, ErrorCircuitOpen) {
+		t.Errorf("GetData() while open returned unexpected error. got: %v, want: %v", err, ErrorCircuitOpen)
+	}
+	if requests != 3 {
+		t.Errorf("server received %d requests, want 3", requests)
+	}
+
+	// After the cooldown, a failed probe opens the circuit again.
+	now = now.Add(time.Minute)
+	if got := cl.CircuitState(); got != CircuitHalfOpen {
+		t.Errorf("CircuitState() after cooldown = %v, want %v", got, CircuitHalfOpen)
+	}
+	if err := getData(); err == nil || errors.Is(err, ErrorCircuitOpen) {
+		t.Errorf("GetData() probe returned unexpected error. got: %v, want server error", err)
+	}
+	if err := getData(); !errors.Is(err, ErrorCircuitOpen) {
+		t.Errorf("GetData() after failed probe returned unexpected error. got: %v, want: %v", err, ErrorCircuitOpen)
+	}
+
+	// A successful probe closes the circuit.
+	now = now.Add(time.Minute)
+	failing = false
+	if err := getData(); err != nil {
+		t.Errorf("GetData() probe returned unexpected error: %v", err)
+	}
+	if got := cl.CircuitState(); got != CircuitClosed {
+		t.Errorf("CircuitState() after successful probe = %v, want %v", got, CircuitClosed)
+	}
+	if requests != 5 {
+		t.Errorf("server received %d requests, want 5", requests)
+	}
+
+	wantTransitions := []string{"closed->open", "open->half_open", "half_open->open", "open->half_open", "half_open->closed"}
+	if diff := cmp.Diff(wantTransitions, transitions); diff != "" {
+		t.Errorf("unexpected state transitions (-want +got):\n%s", diff)
+	}
+}
+
+func TestClient_CircuitBreaker_SuccessResetsFailures(t *testing.T) {
+	failing := true
+	requests := 0
+	server := newFlakyServer(t, &failing, &requests)
+	cl, err := NewClientWithOptions(server.URL, testAuthenticator{}, &ClientOptions{
+		CircuitBreaker: &CircuitBreakerOptions{FailureThreshold: 2},
+	})
+	if err != nil {
+		t.Fatalf("NewClientWithOptions() returned unexpected error: %v", err)
+	}
+	for _, fail := range []bool{true, false, true, false, true} {
+		failing = fail
+		r, err := cl.GetData(context.Background(), server.URL + "/Patient")
+		if err == nil {
+			r.Close()
+		}
+		if errors.Is(err, ErrorCircuitOpen) {
+			t.Fatalf("GetData() returned %v, but there were no consecutive failures", err)
+		}
+	}
+	if got := cl.CircuitState(); got != CircuitClosed {
+		t.Errorf("CircuitState() = %v, want %v", got, CircuitClosed)
+	}
+}
+
+func TestClient_CircuitBreaker_DisabledByDefault(t *testing.T) {
+	failing := true
+	requests := 0
+	server := newFlakyServer(t, &failing, &requests)
+	cl, err := NewClient(server.URL, testAuthenticator{})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := cl.GetData(context.Background(), server.URL + "/Patient"); errors.Is(err, ErrorCircuitOpen) {
+			t.Fatalf("GetData() returned %v without a circuit breaker", err)
+		}
+	}
+	if requests != 10 {
+		t.Errorf("server received %d requests, want 10", requests)
+	}
+	if got := cl.CircuitState(); got != CircuitClosed {
+		t.Errorf("CircuitState() = %v, want %v", got, CircuitClosed)
+	}
+}
@@ -18,15 +18,18 @@
 package bulkfhir
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/bulk_fhir_tools/fhir"
@@ -56,9 +59,53 @@ var (
 	ErrorUnexpectedNumberOfXProgress = errors.New("unexpected number of x-progress headers")
 	// ErrorRetryableHTTPStatus may be wrapped into other errors emitted by this package
 	// to indicate to the caller that a retryable http error code was returned
-	// from the server.
-	// TODO(b/239596656): consider adding auto-retry logic within this package.
+	// from the server. Set ClientOptions.RetryPolicy to have the Client retry
+	// such errors itself.
 	ErrorRetryableHTTPStatus = errors.New("this is a retryable but unexpected HTTP status code error")
+	// ErrorClientClosed indicates that a method was called on a Client after
+	// Close was called.
+	ErrorClientClosed = errors.New("the client has been closed")
+	// ErrorSinceInFuture indicates that a _since timestamp after the current
+	// time was passed when starting an export.
+	ErrorSinceInFuture = errors.New("the _since timestamp is in the future")
+	// ErrorUntrustedJobStatusHost indicates that a job status URL is not on the
+	// host of the Client's base URL, or any host allowed by
+	// ClientOptions.JobStatusAllowedHosts.
+	ErrorUntrustedJobStatusHost = errors.New("job status URL host does not match the server")
+	// ErrorJobStatusRetriesExhausted is sent (wrapped, along with the last error)
+	// by MonitorJobStatus if checking the job status fails with more consecutive
+	// transient errors than allowed by the Client's JobStatusRetryPolicy.
+	ErrorJobStatusRetriesExhausted = errors.New("too many consecutive transient errors checking job status")
+	// ErrorNotModified is returned by GetDataIfNoneMatch if the server responds
+	// with 304 Not Modified, as the data has the same ETag as before.
+	ErrorNotModified = errors.New("data not modified")
+	// ErrorJobContinuationLoop is sent by MonitorJobStatus when following job
+	// continuations (see ClientOptions.FollowJobContinuations) if a job links to
+	// a job which has already been monitored.
+	ErrorJobContinuationLoop = errors.New("job continuation links form a loop")
+	// ErrorCredentialsRejected is returned (wrapped, along with the error from
+	// the Authenticator) by MonitorJobStatus if re-authenticating after an
+	// ErrorUnauthorized fails because the token endpoint rejected the client's
+	// credentials (with a 400 or 401 status), as retrying cannot succeed.
+	ErrorCredentialsRejected = errors.New("the token endpoint rejected the client credentials")
+	// ErrorDataURLExpired is returned (wrapped in an HTTPError) by GetData if
+	// the server indicates that the result file URL has expired, either with a
+	// 410 Gone status, or an OperationOutcome with an "expired" issue. Retrying
+	// the same URL cannot succeed; instead, the job status may be checked again
+	// for fresh URLs.
+	ErrorDataURLExpired = errors.New("result file URL has expired")
+	// ErrorCircuitOpen is returned (wrapped) for requests made while the
+	// Client's circuit breaker is open (see CircuitBreakerOptions), as the server
+	// has recently been failing consistently. The request is not sent.
+	ErrorCircuitOpen = errors.New("circuit breaker is open after consecutive server failures")
+	// ErrorDryRun is returned (wrapped) in place of a job status URL by the
+	// methods which start an export when the Client is in dry-run mode (see
+	// SetDryRun). The kick-off request was built and authenticated, but not
+	// sent.
+	ErrorDryRun = errors.New("dry run: the export request was not sent")
+	// ErrorUnsupportedContentEncoding is returned (wrapped) when the server
+	// sends data with a Content-Encoding which the Client cannot decode.
+	ErrorUnsupportedContentEncoding = errors.New("unsupported Content-Encoding")
 )
 
 // ExportGroupAll is a default group ID of "all" which can be supplied to
@@ -69,13 +116,69 @@ var ExportGroupAll = "all"
 // Client represents a Bulk FHIR API client at some API version.
 type Client struct {
 	baseURL string
+	// profile holds the server's endpoint paths. Use serverProfile to access it.
+	profile ServerProfile
 
-	httpClient    *http.Client
+	httpClient *http.Client
+
+	// authMu guards authenticator, which may be replaced by SetToken or
+	// SetTokenSource.
+	authMu        sync.RWMutex
 	authenticator Authenticator
+
+	// lastStatus caches the most recent JobStatus observed by MonitorJobStatus
+	// for each job status URL.
+	lastStatusMu sync.Mutex
+	lastStatus   map[string]JobStatus
+
+	// typeNameOverrides and typeNameOverridesReverse hold the resource type names
+	// set from ClientOptions.ResourceTypeNames.
+	typeNameOverrides        map[cpb.ResourceTypeCode_Value]string
+	typeNameOverridesReverse map[string]cpb.ResourceTypeCode_Value
+
+	// sinceFloor is the earliest _since timestamp used when starting exports, set
+	// from ClientOptions.SinceFloor.
+	sinceFloor time.Time
+
+	// jobStatusHosts holds the hosts allowed by
+	// ClientOptions.JobStatusAllowedHosts, in addition to the base URL's host. If
+	// skipJobStatusHostCheck is set, job status URLs are not validated at all.
+	jobStatusHosts         map[string]bool
+	skipJobStatusHostCheck bool
+
+	// jobStatusRetryPolicy is set from ClientOptions.JobStatusRetryPolicy.
+	jobStatusRetryPolicy *JobStatusRetryPolicy
+
+	// followContinuations is set from ClientOptions.FollowJobContinuations.
+	followContinuations bool
+
+	// dryRun is set by SetDryRun.
+	dryRunMu sync.RWMutex
+	dryRun   bool
+
+	// acceptEncodings is set from ClientOptions.AcceptEncodings. If nil, the
+	// transport's transparent gzip handling is used.
+	acceptEncodings []ContentEncoding
+
+	// breaker is set from ClientOptions.CircuitBreaker, and is nil if the
+	// circuit breaker is disabled.
+	breaker *circuitBreaker
+
+	// retryPolicy is set from ClientOptions.RetryPolicy, and is nil if requests
+	// are not retried.
+	retryPolicy *RetryPolicy
+
+	// done is closed by Close to signal background goroutines to exit. It is
+	// created lazily so that a Client literal is usable.
+	doneOnce  sync.Once
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 // NewClient creates and returns a new bulk fhir API Client for the input
-// baseURL, using the given authenticator.
+// baseURL, using the given authenticator. The server's endpoints are assumed
+// to be those of BCDAServerProfile; use NewClientWithOptions for servers with
+// other endpoints.
 func NewClient(baseURL string, authenticator Authenticator) (*Client, error) {
 	return &Client{
 		baseURL:       baseURL,
@@ -84,9 +187,30 @@ func NewClient(baseURL string, authenticator Authenticator) (*Client, error) {
 	}, nil
 }
 
-// Close is a placeholder for any cleanup actions needed for the Client. Please
-// call this when finished with a Client.
-func (c *Client) Close() error { return nil }
+// Close stops any background goroutines started by the Client (such as those
+// started by MonitorJobStatus). Please call this when finished with a Client.
+// Subsequent calls to methods of the Client return ErrorClientClosed. It is
+// safe to call Close more than once.
+func (c *Client) Close() error {
+	done := c.doneChan()
+	c.closeOnce.Do(func() { close(done) })
+	return nil
+}
+
+func (c *Client) doneChan() chan struct{} {
+	c.doneOnce.Do(func() { c.done = make(chan struct{}) })
+	return c.done
+}
+
+// checkNotClosed returns ErrorClientClosed if Close has been called.
+func (c *Client) checkNotClosed() error {
+	select {
+	case <-c.doneChan():
+		return ErrorClientClosed
+	default:
+		return nil
+	}
+}
 
 // Header constants
 const (
@@ -96,6 +220,7 @@ const (
 
 	contentTypeHeader         = "Content-Type"
 	contentTypeFormURLEncoded = "application/x-www-form-urlencoded"
+	contentTypeFHIRJSON       = "application/fhir+json"
 
 	preferHeader      = "Prefer"
 	preferHeaderAsync = "respond-async"
@@ -105,33 +230,169 @@ const (
 	xProgress = "X-Progress"
 )
 
-// Endpoint locations
 const (
-	exportAllPatientsEndpoint    = "/Patient/$export"
-	bulkDataExportEndpointFmtStr = "/Group/%s/$export"
+	// maxSinceClockSkew is how far in the future a _since timestamp may be before
+	// it is rejected. This allows for the server's clock (which produces the
+	// transaction times typically used as _since values) being slightly ahead.
+	maxSinceClockSkew = time.Minute
+	// staleSinceAge is the age beyond which a _since timestamp is logged as
+	// likely to trigger a much larger export than intended.
+	staleSinceAge = 365 * 24 * time.Hour
 )
 
 // progressREGEX matches strings like "50%" and captures the percentile number (50).
 var progressREGEX = regexp.MustCompile(`([0-9]+?)%`)
 
 // Authenticate calls through to the Authenticator the client was built with to
-// unconditionally perform credential exchange.
-func (c *Client) Authenticate() error {
-	return c.authenticator.Authenticate(c.httpClient)
+// unconditionally perform credential exchange, which is cancelled if ctx is
+// done.
+func (c *Client) Authenticate(ctx context.Context) error {
+	if err := c.checkNotClosed(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.getAuthenticator().Authenticate(ctx, c.httpClient)
 }
 
 // AuthenticateIfNecessary calls through to the Authenticator the client was
-// built with to perform credential exchange if necessary.
-func (c *Client) AuthenticateIfNecessary() error {
-	return c.authenticator.AuthenticateIfNecessary(c.httpClient)
+// built with to perform credential exchange if necessary, which is cancelled if
+// ctx is done.
+func (c *Client) AuthenticateIfNecessary(ctx context.Context) error {
+	if err := c.checkNotClosed(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.getAuthenticator().AuthenticateIfNecessary(ctx, c.httpClient)
+}
+
+// SetToken configures the Client to present the given bearer token with all
+// subsequent requests, replacing the Authenticator the Client was created with.
+// This is useful if tokens are obtained by another component; the Client will
+// not attempt to renew the token, and Authenticate will return
+// ErrorNoCredentials. It is safe to call SetToken while requests are in
+// progress (for example, to supply a refreshed token).
+func (c *Client) SetToken(token string) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	c.authenticator = NewStaticTokenAuthenticator(token)
+}
+
+// SetTokenSource configures the Client to present tokens obtained from ts with
+// all subsequent requests, replacing the Authenticator the Client was created
+// with. See NewTokenSourceAuthenticator.
+func (c *Client) SetTokenSource(ts TokenSource) {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	c.authenticator = NewTokenSourceAuthenticator(ts)
+}
+
+// setResourceTypeNames sets the resource type name overrides from
+// ClientOptions.ResourceTypeNames.
+func (c *Client) setResourceTypeNames(names map[cpb.ResourceTypeCode_Value]string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	c.typeNameOverrides = map[cpb.ResourceTypeCode_Value]string{}
+	c.typeNameOverridesReverse = map[string]cpb.ResourceTypeCode_Value{}
+	for resourceType, name := range names {
+		if other, ok := c.typeNameOverridesReverse[name]; ok {
+			return fmt.Errorf("resource type name %q is given for both %s and %s", name, other, resourceType)
+		}
+		c.typeNameOverrides[resourceType] = name
+		c.typeNameOverridesReverse[name] = resourceType
+	}
+	return nil
+}
+
+// resourceTypeName is like ResourceTypeCodeToName, but consults the names
+// set from ClientOptions.ResourceTypeNames first.
+func (c *Client) resourceTypeName(resourceType cpb.ResourceTypeCode_Value) (string, error) {
+	if name, ok := c.typeNameOverrides[resourceType]; ok {
+		return name, nil
+	}
+	return ResourceTypeCodeToName(resourceType)
+}
+
+// resourceTypeFromName is like ResourceTypeCodeFromName, but consults the
+// names set from ClientOptions.ResourceTypeNames first.
+func (c *Client) resourceTypeFromName(name string) (cpb.ResourceTypeCode_Value, error) {
+	if resourceType, ok := c.typeNameOverridesReverse[name]; ok {
+		return resourceType, nil
+	}
+	return ResourceTypeCodeFromName(name)
+}
+
+// applySinceFloor returns since, or ClientOptions.SinceFloor if it is later.
+func (c *Client) applySinceFloor(since time.Time) time.Time {
+	if since.Before(c.sinceFloor) {
+		log.Infof("Using the _since floor %s instead of the earlier timestamp %s.", fhir.ToFHIRInstant(c.sinceFloor), fhir.ToFHIRInstant(since))
+		return c.sinceFloor
+	}
+	return since
+}
+
+// allowJobStatusHosts adds the hosts in ClientOptions.JobStatusAllowedHosts to
+// those allowed by ValidateJobStatusURL.
+func (c *Client) allowJobStatusHosts(hosts []string) {
+	if len(hosts) == 0 {
+		return
+	}
+	c.jobStatusHosts = map[string]bool{}
+	for _, h := range hosts {
+		c.jobStatusHosts[strings.ToLower(h)] = true
+	}
+}
+
+// ValidateJobStatusURL returns an error wrapping ErrorUntrustedJobStatusHost
+// if the job status URL is not on the host of the Client's base URL, or a host
+// allowed by ClientOptions.JobStatusAllowedHosts. JobStatus and MonitorJobStatus validate the
+// URL before making any requests, so that credentials are never sent to an
+// unexpected host (for example, via a crafted Content-Location header).
+func (c *Client) ValidateJobStatusURL(jobStatusURL string) error {
+	if c.skipJobStatusHostCheck {
+		return nil
+	}
+	u, err := url.Parse(jobStatusURL)
+	if err != nil {
+		return fmt.Errorf("invalid job status URL %q: %w", jobStatusURL, err)
+	}
+	host := strings.ToLower(u.Host)
+	if host != "" {
+		if base, err := url.Parse(c.baseURL); err == nil && host == strings.ToLower(base.Host) {
+			return nil
+		}
+		if c.jobStatusHosts[host] || c.jobStatusHosts[strings.ToLower(u.Hostname())] {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q", ErrorUntrustedJobStatusHost, jobStatusURL)
+}
+
+func (c *Client) getAuthenticator() Authenticator {
+	c.authMu.RLock()
+	defer c.authMu.RUnlock()
+	return c.authenticator
 }
 
 // doHTTP wraps a call to c.httpClient.Do to apply authentication.
 func (c *Client) doHTTP(req *http.Request) (*http.Response, error) {
-	if err := c.authenticator.AddAuthenticationToRequest(c.httpClient, req); err != nil {
+	if err := c.checkNotClosed(); err != nil {
 		return nil, err
 	}
-	return c.httpClient.Do(req)
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	if err := c.getAuthenticator().AddAuthenticationToRequest(c.httpClient, req); err != nil {
+		c.breaker.abandon()
+		return nil, err
+	}
+	resp, err := c.httpClient.Do(req)
+	c.breaker.record(req.Context(), resp, err)
+	return resp, err
 }
 
 // StartBulkDataExport starts a job via the bulk FHIR API to begin exporting the
@@ -139,34 +400,45 @@ func (c *Client) doHTTP(req *http.Request) (*http.Response, error) {
 // and returns the URL to query the job status (from the response Content-
 // Location header). StartBulkDataExportAll can be used if you wish to export
 // all FHIR resources without a group ID.
-func (c *Client) StartBulkDataExport(types []cpb.ResourceTypeCode_Value, since time.Time, groupID string) (jobStatusURL string, err error) {
-	u, err := url.Parse(c.baseURL + fmt.Sprintf(bulkDataExportEndpointFmtStr, groupID))
+//
+// If since is the zero time, the _since parameter is omitted and all data is
+// exported. A since in the future results in ErrorSinceInFuture, and a warning
+// is logged if since is more than a year ago, as this is likely to result in a
+// much larger export than an incremental export was intended to be. If
+// ClientOptions.SinceFloor is set, it is used instead of any earlier since.
+func (c *Client) StartBulkDataExport(ctx context.Context, types []cpb.ResourceTypeCode_Value, since time.Time, groupID string) (jobStatusURL string, err error) {
+	u, err := url.Parse(c.baseURL + fmt.Sprintf(c.serverProfile().GroupExportPathFmt, groupID))
 	if err != nil {
 		return "", err
 	}
-	return c.startBulkDataExportInternal(u, types, since)
+	return c.startBulkDataExportInternal(ctx, u, types, since)
 }
 
 // StartBulkDataExportAll starts a job via the bulk FHIR to begin exporting the
 // requested resource types since the provided timestamp for all patients and
-// returns the URL to query the job status.
-func (c *Client) StartBulkDataExportAll(types []cpb.ResourceTypeCode_Value, since time.Time) (jobStatusURL string, err error) {
-	u, err := url.Parse(c.baseURL + exportAllPatientsEndpoint)
+// returns the URL to query the job status. since is handled as for
+// StartBulkDataExport.
+func (c *Client) StartBulkDataExportAll(ctx context.Context, types []cpb.ResourceTypeCode_Value, since time.Time) (jobStatusURL string, err error) {
+	u, err := url.Parse(c.baseURL + c.serverProfile().ExportAllPatientsPath)
 	if err != nil {
 		return "", err
 	}
-	return c.startBulkDataExportInternal(u, types, since)
+	return c.startBulkDataExportInternal(ctx, u, types, since)
 }
 
-func (c *Client) startBulkDataExportInternal(u *url.URL, types []cpb.ResourceTypeCode_Value, since time.Time) (jobStatusURL string, err error) {
+func (c *Client) startBulkDataExportInternal(ctx context.Context, u *url.URL, types []cpb.ResourceTypeCode_Value, since time.Time) (jobStatusURL string, err error) {
 	qParams := u.Query()
 
+	since = c.applySinceFloor(since)
 	if !since.IsZero() {
+		if err := checkSince(since); err != nil {
+			return "", err
+		}
 		qParams.Add("_since", fhir.ToFHIRInstant(since))
 	}
 
 	if len(types) > 0 {
-		v, err := resourceTypesToQueryValue(types)
+		v, err := c.resourceTypesToQueryValue(types)
 		if err != nil {
 			return "", err
 		}
@@ -174,25 +446,55 @@ func (c *Client) startBulkDataExportInternal(u *url.URL, types []cpb.ResourceTyp
 	}
 
 	u.RawQuery = qParams.Encode()
-	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
 		return "", err
 	}
 
+	return c.kickOff(req)
+}
+
+// checkSince returns ErrorSinceInFuture if since is in the future, and logs a
+// warning if it is more than a year ago.
+func checkSince(since time.Time) error {
+	now := timeNow()
+	if since.After(now.Add(maxSinceClockSkew)) {
+		return fmt.Errorf("%w: %s", ErrorSinceInFuture, fhir.ToFHIRInstant(since))
+	}
+	if since.Before(now.Add(-staleSinceAge)) {
+		log.Warningf("The _since timestamp %s is more than a year ago; this export may include much more data than an incremental export is expected to.", fhir.ToFHIRInstant(since))
+	}
+	return nil
+}
+
+// kickOff sends a bulk data kick-off request, returning the URL to query the
+// job status.
+func (c *Client) kickOff(req *http.Request) (jobStatusURL string, err error) {
 	req.Header.Add(acceptHeader, acceptHeaderFHIRJSON)
 	req.Header.Add(preferHeader, preferHeaderAsync)
 
+	if c.DryRun() {
+		if err := c.checkNotClosed(); err != nil {
+			return "", err
+		}
+		if err := c.getAuthenticator().AddAuthenticationToRequest(c.httpClient, req); err != nil {
+			return "", err
+		}
+		log.Infof("Dry run: not sending export request %s %s", req.Method, req.URL)
+		return "", fmt.Errorf("%w: %s %s", ErrorDryRun, req.Method, req.URL)
+	}
+
 	resp, err := c.doHTTP(req)
 	if err != nil {
 		return "", err
 	}
 
 	if resp.StatusCode == http.StatusUnauthorized {
-		return "", ErrorUnauthorized
+		return "", newHTTPError("start export", resp, ErrorUnauthorized)
 	}
 	// TODO(b/163811116): revisit possibly accecpting other 2xx status codes
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
-		return "", fmt.Errorf("unexpected non-OK and non-Accepted http status code: %d %w", resp.StatusCode, ErrorUnexpectedStatusCode)
+		return "", newHTTPError("start export", resp, ErrorUnexpectedStatusCode)
 	}
 
 	// Extract the URL location used to check job status
@@ -211,8 +513,68 @@ type JobStatus struct {
 	RetryAfter      time.Duration
 	// ResultURLs holds the final NDJSON URLs for the job by resource type (if the job is complete).
 	ResultURLs map[cpb.ResourceTypeCode_Value][]string
+	// OutputFiles holds the same NDJSON URLs as ResultURLs (in the same order),
+	// along with any additional information the server reported about each file.
+	OutputFiles map[cpb.ResourceTypeCode_Value][]OutputFile
 	// Indicates the FHIR server time when the bulk data export was processed.
 	TransactionTime time.Time
+	// NextJobStatusURL is the job status URL of the next part of the export, if
+	// the server split the export across several jobs (either with a "next"
+	// link in the response, or a Link header with rel="next"). It is empty if
+	// this is the last (or only) part. See ClientOptions.FollowJobContinuations.
+	NextJobStatusURL string
+}
+
+// mergeContinuation returns the status of an export made up of the completed
+// part s followed by the part next. The transaction time of the first part is
+// kept, as the export as a whole is only complete up to that time.
+func (s JobStatus) mergeContinuation(next JobStatus) JobStatus {
+	merged := next
+	merged.TransactionTime = s.TransactionTime
+	merged.ResultURLs = make(map[cpb.ResourceTypeCode_Value][]string)
+	merged.OutputFiles = make(map[cpb.ResourceTypeCode_Value][]OutputFile)
+	for _, part := range []JobStatus{s, next} {
+		for r, urls := range part.ResultURLs {
+			merged.ResultURLs[r] = append(merged.ResultURLs[r], urls...)
+		}
+		for r, files := range part.OutputFiles {
+			merged.OutputFiles[r] = append(merged.OutputFiles[r], files...)
+		}
+	}
+	return merged
+}
+
+// OutputFile describes a single NDJSON result file of a completed export job.
+type OutputFile struct {
+	URL string
+	// Count is the number of resources in the file as reported by the server, or
+	// -1 if the server did not report a count.
+	Count int
+}
+
+// URLsForType returns the result URLs of the job for a single resource type,
+// or nil if there are none.
+func (s JobStatus) URLsForType(resourceType cpb.ResourceTypeCode_Value) []string {
+	return s.ResultURLs[resourceType]
+}
+
+// ExpectedResourceCount returns the total number of resources across all
+// output files, as reported by the server. The returned bool is false if the
+// server did not report a count for at least one of the files, in which case
+// the total only includes the files that did have a count.
+func (s JobStatus) ExpectedResourceCount() (int, bool) {
+	total := 0
+	allReported := true
+	for _, files := range s.OutputFiles {
+		for _, f := range files {
+			if f.Count < 0 {
+				allReported = false
+				continue
+			}
+			total += f.Count
+		}
+	}
+	return total, allReported
 }
 
 func getProgress(resp *http.Response) int {
@@ -257,9 +619,32 @@ func getRetryAfter(resp *http.Response) time.Duration {
 }
 
 // JobStatus retrieves the current JobStatus via the bulk fhir API for the
-// provided job status URL.
-func (c *Client) JobStatus(jobStatusURL string) (st JobStatus, err error) {
-	req, err := http.NewRequest(http.MethodGet, jobStatusURL, nil)
+// provided job status URL. The URL is checked with ValidateJobStatusURL first.
+// If the Client has a RetryPolicy, requests which fail with a 429 or 503 status
+// are retried.
+func (c *Client) JobStatus(ctx context.Context, jobStatusURL string) (st JobStatus, err error) {
+	if err := c.ValidateJobStatusURL(jobStatusURL); err != nil {
+		return JobStatus{}, err
+	}
+	err = c.withRetries(ctx, "job status", retryableJobStatusError, func() error {
+		st, err = c.jobStatus(ctx, jobStatusURL)
+		return err
+	})
+	return st, err
+}
+
+// jobStatusOnce is like JobStatus, but makes a single request whatever the
+// Client's RetryPolicy, for callers which handle retries themselves.
+func (c *Client) jobStatusOnce(ctx context.Context, jobStatusURL string) (JobStatus, error) {
+	if err := c.ValidateJobStatusURL(jobStatusURL); err != nil {
+		return JobStatus{}, err
+	}
+	return c.jobStatus(ctx, jobStatusURL)
+}
+
+// jobStatus makes a single job status request.
+func (c *Client) jobStatus(ctx context.Context, jobStatusURL string) (JobStatus, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jobStatusURL, nil)
 	if err != nil {
 		return JobStatus{}, err
 	}
@@ -268,6 +653,7 @@ func (c *Client) JobStatus(jobStatusURL string) (st JobStatus, err error) {
 	if err != nil {
 		return JobStatus{}, err
 	}
+	defer resp.Body.Close()
 
 	switch resp.StatusCode {
 	case http.StatusAccepted:
@@ -279,7 +665,11 @@ func (c *Client) JobStatus(jobStatusURL string) (st JobStatus, err error) {
 
 	case http.StatusOK:
 		// Job is finished, NDJSON is ready for download.
-		jobStatus := JobStatus{IsComplete: true, ResultURLs: make(map[cpb.ResourceTypeCode_Value][]string)}
+		jobStatus := JobStatus{
+			IsComplete:  true,
+			ResultURLs:  make(map[cpb.ResourceTypeCode_Value][]string),
+			OutputFiles: make(map[cpb.ResourceTypeCode_Value][]OutputFile),
+		}
 		var jr jobStatusResponse
 
 		dec := json.NewDecoder(resp.Body)
@@ -288,11 +678,16 @@ func (c *Client) JobStatus(jobStatusURL string) (st JobStatus, err error) {
 		}
 
 		for _, item := range jr.Output {
-			r, err := ResourceTypeCodeFromName(item.ResourceType)
+			r, err := c.resourceTypeFromName(item.ResourceType)
 			if err != nil {
 				return JobStatus{}, err
 			}
 			jobStatus.ResultURLs[r] = append(jobStatus.ResultURLs[r], item.URL)
+			count := -1
+			if item.Count != nil {
+				count = *item.Count
+			}
+			jobStatus.OutputFiles[r] = append(jobStatus.OutputFiles[r], OutputFile{URL: item.URL, Count: count})
 		}
 
 		t, err := fhir.ParseFHIRInstant(jr.TransactionTime)
@@ -300,23 +695,155 @@ func (c *Client) JobStatus(jobStatusURL string) (st JobStatus, err error) {
 			return JobStatus{}, err
 		}
 		jobStatus.TransactionTime = t
+		jobStatus.NextJobStatusURL = nextJobStatusURL(resp, jr.Link)
 
 		return jobStatus, nil
 	case http.StatusUnauthorized:
-		return JobStatus{}, ErrorUnauthorized
+		return JobStatus{}, newHTTPError("job status", resp, ErrorUnauthorized)
 	case http.StatusNotFound:
-		return JobStatus{}, ErrorExportJobNotFound
+		return JobStatus{}, newHTTPError("job status", resp, ErrorExportJobNotFound)
 	default:
-		return JobStatus{}, fmt.Errorf("%w: %d", ErrorUnexpectedStatusCode, resp.StatusCode)
+		return JobStatus{}, newHTTPError("job status", resp, ErrorUnexpectedStatusCode)
 	}
 }
 
+// linkHeaderNextREGEX matches the URL of a rel="next" entry in a Link header.
+var linkHeaderNextREGEX = regexp.MustCompile(`<([^>]*)>[^,]*;\s*rel="?next"?`)
+
+// nextJobStatusURL returns the URL of the next part of the export from a
+// completed job status response, or an empty string if there is none.
+// Relative URLs are resolved against the job status URL.
+func nextJobStatusURL(resp *http.Response, links []jobStatusLink) string {
+	next := ""
+	for _, l := range links {
+		if l.Relation == "next" {
+			next = l.URL
+			break
+		}
+	}
+	if next == "" {
+		for _, h := range resp.Header.Values("Link") {
+			if m := linkHeaderNextREGEX.FindStringSubmatch(h); m != nil {
+				next = m[1]
+				break
+			}
+		}
+	}
+	if next == "" || resp.Request == nil {
+		return next
+	}
+	u, err := url.Parse(next)
+	if err != nil {
+		return next
+	}
+	return resp.Request.URL.ResolveReference(u).String()
+}
+
 // MonitorResult holds either a JobStatus or an error.
 type MonitorResult struct {
 	// Status holdes the JobStatus
 	Status JobStatus
 	// Error holds an error associated with this entry (if any)
 	Error error
+	// Elapsed is the time since MonitorJobStatus was called.
+	Elapsed time.Duration
+	// EstimatedTimeRemaining is the estimated time until the job completes,
+	// extrapolated from the progress reported by the server so far. It is zero
+	// if the job is complete, or if no meaningful estimate can be made (for
+	// example if the server does not report progress, or progress has gone
+	// backwards or stalled).
+	EstimatedTimeRemaining time.Duration
+}
+
+const (
+	defaultJobStatusInitialBackoff = time.Second
+	defaultJobStatusMaxBackoff     = time.Minute
+	// maxConsecutiveReauthentications is the number of times MonitorJobStatus
+	// re-authenticates in a row (because the job status endpoint keeps
+	// responding 401 with the new token) before giving up.
+	maxConsecutiveReauthentications = 3
+)
+
+// JobStatusRetryPolicy configures how MonitorJobStatus handles transient
+// errors checking the status of a job, such as network errors and retryable
+// HTTP statuses (408, 429 and 5xx).
+type JobStatusRetryPolicy struct {
+	// The number of consecutive transient errors tolerated. Once exceeded, an
+	// error wrapping ErrorJobStatusRetriesExhausted is sent and monitoring
+	// stops.
+	MaxConsecutiveErrors int
+	// The time waited before retrying after the first transient error, which is
+	// doubled for each subsequent consecutive error. Defaults to 1 second.
+	InitialBackoff time.Duration
+	// The maximum time waited before retrying. Defaults to 1 minute.
+	MaxBackoff time.Duration
+}
+
+// backoff returns the time to wait before retrying after the given number of
+// consecutive errors.
+func (p *JobStatusRetryPolicy) backoff(consecutiveErrors int) time.Duration {
+	wait := p.InitialBackoff
+	if wait <= 0 {
+		wait = defaultJobStatusInitialBackoff
+	}
+	maxWait := p.MaxBackoff
+	if maxWait <= 0 {
+		maxWait = defaultJobStatusMaxBackoff
+	}
+	for i := 1; i < consecutiveErrors && wait < maxWait; i++ {
+		wait *= 2
+	}
+	return min(wait, maxWait)
+}
+
+// SetDryRun sets whether the Client is in dry-run mode, for validating a
+// configuration without starting an export. In dry-run mode, the methods which
+// start an export authenticate (fetching a token if necessary) and build the
+// kick-off request, but instead of sending it they log it and return
+// ErrorDryRun. Other requests, such as checking the status of an existing job
+// or downloading its data, are made as usual, as they do not change anything
+// on the server.
+func (c *Client) SetDryRun(dryRun bool) {
+	c.dryRunMu.Lock()
+	defer c.dryRunMu.Unlock()
+	c.dryRun = dryRun
+}
+
+// DryRun reports whether the Client is in dry-run mode (see SetDryRun).
+func (c *Client) DryRun() bool {
+	c.dryRunMu.RLock()
+	defer c.dryRunMu.RUnlock()
+	return c.dryRun
+}
+
+// credentialsRejected returns true if err, from an Authenticator, indicates
+// that the token endpoint rejected the credentials rather than failing for
+// some other reason.
+func credentialsRejected(err error) bool {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	return httpErr.StatusCode == http.StatusBadRequest || httpErr.StatusCode == http.StatusUnauthorized
+}
+
+// isTransientError returns true if err is likely to be resolved by retrying
+// the request: a network error, a response body which was cut short, or a
+// retryable HTTP status.
+func isTransientError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrorRetryableHTTPStatus) {
+		return true
+	}
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	switch httpErr.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return httpErr.StatusCode >= 500
 }
 
 // MonitorJobStatus will asynchronously check the status of job at the
@@ -326,98 +853,347 @@ type MonitorResult struct {
 // or the job is completed, the final completed JobStatus will be sent to the
 // channel (or the ErrorTimeout error), and the channel will be closed.
 // If an ErrorUnauthroized is encountered, MonitorJobStatus will attempt to
-// reauthenticate and continue trying.
-func (c *Client) MonitorJobStatus(jobStatusURL string, checkPeriod, timeout time.Duration) <-chan *MonitorResult {
+// reauthenticate and continue trying (unless the Client's Authenticator has no
+// credentials to authenticate with, in which case ErrorUnauthorized is sent and
+// monitoring stops). If the token endpoint rejects the credentials, an error
+// wrapping ErrorCredentialsRejected is sent and monitoring stops. If the job
+// status is still unauthorized after re-authenticating, re-authentication is
+// retried with backoff a few times before ErrorUnauthorized is sent and
+// monitoring stops. If the Client is closed, monitoring stops
+// and the channel is closed (after ErrorClientClosed is sent, if there is room
+// in the channel). If the job status URL fails ValidateJobStatusURL, the error
+// is sent and monitoring stops. Transient errors are handled according to
+// ClientOptions.JobStatusRetryPolicy, if one is set; other errors are always
+// sent immediately. If the Client follows job continuations (see
+// ClientOptions.FollowJobContinuations), the completed JobStatus is only sent
+// once every part of the export is complete.
+// If ctx is cancelled, monitoring stops and the channel is closed in the same
+// way as when the Client is closed, after the ctx error is sent (if there is
+// room in the channel).
+func (c *Client) MonitorJobStatus(ctx context.Context, jobStatusURL string, checkPeriod, timeout time.Duration) <-chan *MonitorResult {
 	out := make(chan *MonitorResult, 100)
 	deadline := time.Now().Add(timeout)
+	done := c.doneChan()
 	go func() {
 		defer close(out)
-		var jobStatus JobStatus
-		var err error
-		for !jobStatus.IsComplete && time.Now().Before(deadline) {
-			jobStatus, err = c.JobStatus(jobStatusURL)
-			if err != nil {
-				if errors.Is(err, ErrorExportJobNotFound) {
-					out <- &MonitorResult{Error: err}
-					return
+		// send returns false if the client was closed or ctx was done while
+		// waiting to send.
+		send := func(r *MonitorResult) bool {
+			select {
+			case out <- r:
+				return true
+			case <-done:
+				return false
+			case <-ctx.Done():
+				return false
+			}
+		}
+		err := c.pollJobStatus(ctx, jobStatusURL, checkPeriod, deadline, send)
+		if err == nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if errors.Is(err, ErrorClientClosed) || (ctx.Err() != nil && errors.Is(err, ctx.Err())) {
+			// ErrorClientClosed and the ctx error are only sent if there is room in
+			// the channel, so that they do not block if the caller has stopped
+			// reading.
+			select {
+			case out <- &MonitorResult{Error: err}:
+			default:
+			}
+		} else if err != nil {
+			send(&MonitorResult{Error: err})
+		}
+	}()
+	return out
+}
+
+// MonitorJobStatusCallback is like MonitorJobStatus, but calls cb with each
+// MonitorResult (in the goroutine MonitorJobStatusCallback was called from)
+// rather than sending it to a channel, and runs until ctx is done rather than
+// until a timeout. Monitoring stops when the job completes (after cb is called
+// with the completed JobStatus), or as soon as cb returns false, in either of
+// which cases nil is returned. Errors which stop monitoring (such as
+// ErrorExportJobNotFound, ErrorClientClosed or the ctx error) are returned
+// rather than passed to cb.
+func (c *Client) MonitorJobStatusCallback(ctx context.Context, jobStatusURL string, checkPeriod time.Duration, cb func(MonitorResult) bool) error {
+	return c.pollJobStatus(ctx, jobStatusURL, checkPeriod, time.Time{}, func(r *MonitorResult) bool {
+		return cb(*r)
+	})
+}
+
+// pollJobStatus implements MonitorJobStatus and MonitorJobStatusCallback. It
+// checks the job status until the job completes or the deadline (if not zero)
+// passes, calling emit with each result. If emit returns false, pollJobStatus
+// returns nil immediately. Errors after which monitoring cannot continue are
+// returned rather than emitted, including ErrorTimeout, ErrorClientClosed if
+// the Client is closed, and the ctx error if ctx is done.
+func (c *Client) pollJobStatus(ctx context.Context, jobStatusURL string, checkPeriod time.Duration, deadline time.Time, emit func(*MonitorResult) bool) error {
+	start := time.Now()
+	done := c.doneChan()
+	// wait returns an error if the Client is closed or ctx is done before d has
+	// passed.
+	wait := func(d time.Duration) error {
+		select {
+		case <-time.After(d):
+			return nil
+		case <-done:
+			return ErrorClientClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	var estimator progressEstimator
+	var jobStatus JobStatus
+	var err error
+	retryPolicy := c.jobStatusRetryPolicy
+	consecutiveErrors := 0
+	// consecutiveUnauthorized is the number of ErrorUnauthorized responses since
+	// the last successful status check. Re-authentication is backed off (with
+	// the retry policy's backoff, or the default backoff), so that credentials
+	// which are not accepted do not cause a storm of token requests.
+	consecutiveUnauthorized := 0
+	followContinuations := c.followContinuations
+	// When following continuations, partURL is the job status URL of the part
+	// of the export being monitored, and completedParts holds the merged
+	// status of the parts before it.
+	partURL := jobStatusURL
+	var completedParts *JobStatus
+	monitoredParts := map[string]bool{jobStatusURL: true}
+	for !jobStatus.IsComplete && (deadline.IsZero() || time.Now().Before(deadline)) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// Retries are handled here (see JobStatusRetryPolicy), so the Client's
+		// RetryPolicy is not applied as well.
+		jobStatus, err = c.jobStatusOnce(ctx, partURL)
+		if err != nil {
+			if errors.Is(err, ErrorClientClosed) || errors.Is(err, ErrorExportJobNotFound) || errors.Is(err, ErrorUntrustedJobStatusHost) {
+				return err
+			}
+			if errors.Is(err, ErrorUnauthorized) {
+				consecutiveUnauthorized++
+				if consecutiveUnauthorized > maxConsecutiveReauthentications {
+					return fmt.Errorf("%w: still unauthorized after re-authenticating %d times", ErrorUnauthorized, maxConsecutiveReauthentications)
 				}
-				if errors.Is(err, ErrorUnauthorized) {
-					err = c.Authenticate()
-					if err != nil {
-						out <- &MonitorResult{Error: err}
+				if consecutiveUnauthorized > 1 {
+					// Re-authenticating did not help the last time, so wait before trying
+					// again.
+					policy := retryPolicy
+					if policy == nil {
+						policy = &JobStatusRetryPolicy{}
+					}
+					backoff := policy.backoff(consecutiveUnauthorized - 1)
+					log.Warningf("Job status still unauthorized after re-authenticating, retrying in %s", backoff)
+					if err := wait(backoff); err != nil {
+						return err
 					}
-					continue
 				}
-				out <- &MonitorResult{Error: err}
-			} else {
-				out <- &MonitorResult{Status: jobStatus}
+				err = c.Authenticate(ctx)
+				if errors.Is(err, ErrorNoCredentials) {
+					// There is no way to obtain a new token, so retrying is pointless.
+					return ErrorUnauthorized
+				}
+				if credentialsRejected(err) {
+					return fmt.Errorf("%w: %w", ErrorCredentialsRejected, err)
+				}
+				if err != nil && !emit(&MonitorResult{Error: err}) {
+					return nil
+				}
+				continue
 			}
-
-			if !jobStatus.IsComplete {
-				if jobStatus.RetryAfter > 0 {
-					log.Infof("Server requests that we retry after %s", jobStatus.RetryAfter)
-					time.Sleep(jobStatus.RetryAfter)
-				} else {
-					time.Sleep(checkPeriod)
+			if retryPolicy != nil && isTransientError(err) {
+				consecutiveErrors++
+				if consecutiveErrors > retryPolicy.MaxConsecutiveErrors {
+					return fmt.Errorf("%w: %w", ErrorJobStatusRetriesExhausted, err)
 				}
+				backoff := retryPolicy.backoff(consecutiveErrors)
+				log.Warningf("Transient error checking job status (%d of %d tolerated), retrying in %s: %v", consecutiveErrors, retryPolicy.MaxConsecutiveErrors, backoff, err)
+				if err := wait(backoff); err != nil {
+					return err
+				}
+				continue
+			}
+			if !emit(&MonitorResult{Error: err}) {
+				return nil
+			}
+		} else {
+			consecutiveErrors = 0
+			consecutiveUnauthorized = 0
+			if jobStatus.IsComplete && completedParts != nil {
+				jobStatus = completedParts.mergeContinuation(jobStatus)
+			}
+			if jobStatus.IsComplete && followContinuations && jobStatus.NextJobStatusURL != "" {
+				next := jobStatus.NextJobStatusURL
+				if monitoredParts[next] {
+					return fmt.Errorf("%w: %q", ErrorJobContinuationLoop, next)
+				}
+				log.Infof("Export continues in job %s", next)
+				monitoredParts[next] = true
+				completed := jobStatus
+				completed.NextJobStatusURL = ""
+				completedParts = &completed
+				partURL = next
+				jobStatus = JobStatus{}
+				continue
+			}
+			c.setLastStatus(jobStatusURL, jobStatus)
+			now := time.Now()
+			r := &MonitorResult{Status: jobStatus, Elapsed: now.Sub(start)}
+			if !jobStatus.IsComplete {
+				r.EstimatedTimeRemaining = estimator.observe(now, jobStatus.PercentComplete)
+			}
+			if !emit(r) {
+				return nil
 			}
 		}
+
 		if !jobStatus.IsComplete {
-			out <- &MonitorResult{Error: ErrorTimeout}
+			period := checkPeriod
+			if jobStatus.RetryAfter > 0 {
+				log.Infof("Server requests that we retry after %s", jobStatus.RetryAfter)
+				period = jobStatus.RetryAfter
+			}
+			if err := wait(period); err != nil {
+				return err
+			}
 		}
-	}()
-	return out
+	}
+	if !jobStatus.IsComplete {
+		return ErrorTimeout
+	}
+	return nil
+}
+
+// LastStatus returns the most recent JobStatus observed by MonitorJobStatus for
+// the given job status URL, without making any requests to the server. The
+// second return value is false if no status has been observed for the job. This
+// allows several readers to follow the progress of a job which is being
+// monitored, without each of them polling the server. LastStatus is safe to
+// call from multiple goroutines.
+func (c *Client) LastStatus(jobStatusURL string) (JobStatus, bool) {
+	c.lastStatusMu.Lock()
+	defer c.lastStatusMu.Unlock()
+	st, ok := c.lastStatus[jobStatusURL]
+	return st, ok
+}
+
+func (c *Client) setLastStatus(jobStatusURL string, st JobStatus) {
+	c.lastStatusMu.Lock()
+	defer c.lastStatusMu.Unlock()
+	if c.lastStatus == nil {
+		c.lastStatus = map[string]JobStatus{}
+	}
+	c.lastStatus[jobStatusURL] = st
 }
 
 // GetData retrieves the NDJSON data result from the provided BCDA result url.
 // The caller must close the dataStream io.ReadCloser when finished.
-func (c *Client) GetData(bcdaURL string) (dataStream io.ReadCloser, err error) {
-	req, err := http.NewRequest(http.MethodGet, bcdaURL, nil)
+//
+// If the server responds with an error status, the returned HTTPError holds
+// the issues of the OperationOutcome in the response body, if there is one. If
+// the server indicates that the URL has expired, ErrorDataURLExpired is
+// returned (wrapped). If the Client has a RetryPolicy, requests which fail with
+// a 404, 429 or 503 status are retried.
+func (c *Client) GetData(ctx context.Context, bcdaURL string) (dataStream io.ReadCloser, err error) {
+	dataStream, _, err = c.getData(ctx, bcdaURL, "")
+	return dataStream, err
+}
+
+// getData is like GetData, but if etag is non-empty it is sent in an
+// If-None-Match header (and ErrorNotModified is returned if the server
+// responds with 304 Not Modified). The ETag of the response is also returned,
+// or an empty string if the server did not send one.
+func (c *Client) getData(ctx context.Context, bcdaURL, etag string) (body io.ReadCloser, newETag string, err error) {
+	err = c.withRetries(ctx, "get data", retryableDataError, func() error {
+		body, newETag, err = c.getDataOnce(ctx, bcdaURL, etag)
+		return err
+	})
+	return body, newETag, err
+}
+
+// getDataOnce makes a single data request for getData and
+// getDataWithRetries.
+func (c *Client) getDataOnce(ctx context.Context, bcdaURL, etag string) (io.ReadCloser, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, bcdaURL, nil)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
 	}
+	negotiated := c.setAcceptEncoding(req)
 
 	resp, err := c.doHTTP(req)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	// TODO(b/163811116): revisit possibly accecpting other 2xx status codes
 	switch resp.StatusCode {
 	case http.StatusOK:
-		return resp.Body, nil
+		if !negotiated {
+			return resp.Body, resp.Header.Get("ETag"), nil
+		}
+		body, err := decodeContentEncoding(resp.Body, resp.Header.Values("Content-Encoding"))
+		if err != nil {
+			resp.Body.Close()
+			return nil, "", err
+		}
+		return body, resp.Header.Get("ETag"), nil
 	// Handle some explicit error cases
-	case http.StatusUnauthorized:
-		return nil, ErrorUnauthorized
-	case http.StatusNotFound:
-		// BCDA 404s need to be retried in some instances.
-		return nil, retryableNonOKError(resp.StatusCode)
-	default:
-		return nil, fmt.Errorf("unexpected non-OK http status code: %d %w", resp.StatusCode, ErrorUnexpectedStatusCode)
+	case http.StatusNotModified:
+		resp.Body.Close()
+		return nil, etag, ErrorNotModified
 	}
+	return nil, "", dataStatusError(resp)
 }
 
-func retryableNonOKError(code int) error {
-	return fmt.Errorf("unexpected non-OK http status code: %d %w", code, ErrorRetryableHTTPStatus)
+// dataStatusError returns the error for an unsuccessful response to a data
+// request.
+func dataStatusError(resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized:
+		return newHTTPError("get data", resp, ErrorUnauthorized)
+	case http.StatusGone:
+		return newHTTPError("get data", resp, ErrorDataURLExpired)
+	}
+	httpErr := newHTTPError("get data", resp, ErrorUnexpectedStatusCode)
+	switch {
+	case httpErr.hasIssueCode(issueCodeExpired):
+		httpErr.Err = ErrorDataURLExpired
+	case resp.StatusCode == http.StatusNotFound:
+		// BCDA 404s need to be retried in some instances.
+		httpErr.Err = ErrorRetryableHTTPStatus
+	}
+	return httpErr
 }
 
 // jobStatusResponse represents the BCDA api response from the JobStatus endpoint.
 type jobStatusResponse struct {
 	Output          []jobStatusOutput `json:"output"`
 	TransactionTime string            `json:"transactionTime"`
+	Link            []jobStatusLink   `json:"link"`
+}
+
+type jobStatusLink struct {
+	Relation string `json:"relation"`
+	URL      string `json:"url"`
 }
 
 type jobStatusOutput struct {
 	ResourceType string `json:"type"`
 	URL          string `json:"url"`
+	// Count is optional in the bulk data spec, so a nil value indicates that the
+	// server did not report it.
+	Count *int `json:"count"`
 }
 
 // resourceTypestoQueryValue takes a slice of cpb.ResourceTypeCode_Value and converts it into a query string value
 // that can be sent to the bulk fhir API.
 //
 // For example [ExplanationOfBenefit, Patient] would result in "ExplanationOfBenefit,Patient"
-func resourceTypesToQueryValue(types []cpb.ResourceTypeCode_Value) (string, error) {
-	v, err := ResourceTypeCodeToName(types[0])
+func (c *Client) resourceTypesToQueryValue(types []cpb.ResourceTypeCode_Value) (string, error) {
+	v, err := c.resourceTypeName(types[0])
 	if err != nil {
 		return "", err
 	}
@@ -425,7 +1201,7 @@ func resourceTypesToQueryValue(types []cpb.ResourceTypeCode_Value) (string, erro
 	var b strings.Builder
 	b.WriteString(v)
 	for _, t := range types[1:] {
-		a, err := ResourceTypeCodeToName(t)
+		a, err := c.resourceTypeName(t)
 		if err != nil {
 			return "", err
 		}
@@ -15,11 +15,13 @@
 package bulkfhir
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -32,8 +34,8 @@ import (
 
 type testAuthenticator struct{}
 
-func (testAuthenticator) Authenticate(hc *http.Client) error            { return nil }
-func (testAuthenticator) AuthenticateIfNecessary(hc *http.Client) error { return nil }
+func (testAuthenticator) Authenticate(ctx context.Context, hc *http.Client) error            { return nil }
+func (testAuthenticator) AuthenticateIfNecessary(ctx context.Context, hc *http.Client) error { return nil }
 func (testAuthenticator) AddAuthenticationToRequest(hc *http.Client, req *http.Request) error {
 	return nil
 }
@@ -65,11 +67,11 @@ func startBulkDataExportCases(t *testing.T, useGroupEndpoint bool) {
 		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
 		var err error
 		if useGroupEndpoint {
-			_, err = cl.StartBulkDataExport(nil, time.Time{}, ExportGroupAll)
+			_, err = cl.StartBulkDataExport(context.Background(), nil, time.Time{}, ExportGroupAll)
 		} else {
-			_, err = cl.StartBulkDataExportAll(nil, time.Time{})
+			_, err = cl.StartBulkDataExportAll(context.Background(), nil, time.Time{})
 		}
-		if err != ErrorUnauthorized {
+		if !errors.Is(err, ErrorUnauthorized) {
 			t.Errorf("StartBulkDataExport unexpected error returned: got: %v, want: %v", err, ErrorUnauthorized)
 		}
 	})
@@ -135,9 +137,9 @@ func startBulkDataExportCases(t *testing.T, useGroupEndpoint bool) {
 		var err error
 		var jobURL string
 		if useGroupEndpoint {
-			jobURL, err = cl.StartBulkDataExport(resourceTypes, since, group)
+			jobURL, err = cl.StartBulkDataExport(context.Background(), resourceTypes, since, group)
 		} else {
-			jobURL, err = cl.StartBulkDataExportAll(resourceTypes, since)
+			jobURL, err = cl.StartBulkDataExportAll(context.Background(), resourceTypes, since)
 		}
 
 		if err != nil {
@@ -203,9 +205,9 @@ func startBulkDataExportCases(t *testing.T, useGroupEndpoint bool) {
 				var jobURL string
 				var err error
 				if useGroupEndpoint {
-					jobURL, err = cl.StartBulkDataExport(tc.resourceTypes, tc.since, ExportGroupAll)
+					jobURL, err = cl.StartBulkDataExport(context.Background(), tc.resourceTypes, tc.since, ExportGroupAll)
 				} else {
-					jobURL, err = cl.StartBulkDataExportAll(tc.resourceTypes, tc.since)
+					jobURL, err = cl.StartBulkDataExportAll(context.Background(), tc.resourceTypes, tc.since)
 				}
 				if err != nil {
 					t.Errorf("StartBulkDataExport(%v, %v) returned unexpected error: %v", tc.resourceTypes, tc.since, err)
@@ -217,6 +219,25 @@ func startBulkDataExportCases(t *testing.T, useGroupEndpoint bool) {
 		}
 	})
 
+	t.Run("since in the future", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			t.Errorf("StartBulkDataExport made unexpected request with future since: %v", req.URL)
+		}))
+		defer server.Close()
+
+		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+		since := time.Now().Add(time.Hour)
+		var err error
+		if useGroupEndpoint {
+			_, err = cl.StartBulkDataExport(context.Background(), nil, since, ExportGroupAll)
+		} else {
+			_, err = cl.StartBulkDataExportAll(context.Background(), nil, since)
+		}
+		if !errors.Is(err, ErrorSinceInFuture) {
+			t.Errorf("StartBulkDataExport(nil, %v) unexpected error got: %v want: %v", since, err, ErrorSinceInFuture)
+		}
+	})
+
 	t.Run("server returns unexpected Content-Location", func(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			w.Header()["Content-Location"] = []string{"some/info/jobid", "extra content location"}
@@ -226,9 +247,9 @@ func startBulkDataExportCases(t *testing.T, useGroupEndpoint bool) {
 		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
 		var err error
 		if useGroupEndpoint {
-			_, err = cl.StartBulkDataExport(nil, time.Time{}, ExportGroupAll)
+			_, err = cl.StartBulkDataExport(context.Background(), nil, time.Time{}, ExportGroupAll)
 		} else {
-			_, err = cl.StartBulkDataExportAll(nil, time.Time{})
+			_, err = cl.StartBulkDataExportAll(context.Background(), nil, time.Time{})
 		}
 		if !errors.Is(err, ErrorGreaterThanOneContentLocation) {
 			t.Errorf("StartBulkDataExport(nil, %v) unexpected underlying error got: %v want: %v", time.Time{}, err, ErrorGreaterThanOneContentLocation)
@@ -236,12 +257,95 @@ func startBulkDataExportCases(t *testing.T, useGroupEndpoint bool) {
 	})
 }
 
+func TestClient_SinceFloor(t *testing.T) {
+	floor := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	cases := []struct {
+		name      string
+		since     time.Time
+		wantSince string
+	}{
+		{name: "ZeroSince", since: time.Time{}, wantSince: "2024-01-02T03:04:05.000+00:00"},
+		{name: "EarlierSince", since: floor.Add(-time.Hour), wantSince: "2024-01-02T03:04:05.000+00:00"},
+		{name: "LaterSince", since: floor.Add(time.Hour), wantSince: "2024-01-02T04:04:05.000+00:00"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotSince []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				gotSince = req.URL.Query()["_since"]
+				w.Header().Set("Content-Location", "/some/url/job/1")
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			defer server.Close()
+
+			cl, err := NewClientWithOptions(server.URL, testAuthenticator{}, &ClientOptions{SinceFloor: floor})
+			if err != nil {
+				t.Fatalf("NewClientWithOptions() returned unexpected error: %v", err)
+			}
+			if _, err := cl.StartBulkDataExportAll(context.Background(), nil, tc.since); err != nil {
+				t.Fatalf("StartBulkDataExportAll() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff([]string{tc.wantSince}, gotSince); diff != "" {
+				t.Errorf("StartBulkDataExportAll() sent unexpected _since (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// failingAuthenticator fails to add authentication to requests with err.
+type failingAuthenticator struct{ err error }
+
+func (failingAuthenticator) Authenticate(ctx context.Context, hc *http.Client) error            { return nil }
+func (failingAuthenticator) AuthenticateIfNecessary(ctx context.Context, hc *http.Client) error { return nil }
+func (fa failingAuthenticator) AddAuthenticationToRequest(hc *http.Client, req *http.Request) error {
+	return fa.err
+}
+
+func TestClient_DryRun(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.Header().Set("Content-Location", "http://example.com/jobs/1")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+	cl.SetDryRun(true)
+	_, err := cl.StartBulkDataExport(context.Background(), []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT}, time.Time{}, "group")
+	if !errors.Is(err, ErrorDryRun) {
+		t.Errorf("StartBulkDataExport() returned unexpected error. got: %v, want: %v", err, ErrorDryRun)
+	}
+	if want := server.URL + "/Group/group/$export?_type=Patient"; !strings.Contains(err.Error(), want) {
+		t.Errorf("StartBulkDataExport() error %q does not describe the request %s", err, want)
+	}
+	if requests != 0 {
+		t.Errorf("server received %d requests in dry-run mode, want 0", requests)
+	}
+
+	// Authentication failures are still reported.
+	authErr := errors.New("auth failed")
+	cl.authenticator = failingAuthenticator{err: authErr}
+	if _, err := cl.StartBulkDataExportAll(context.Background(), nil, time.Time{}); !errors.Is(err, authErr) {
+		t.Errorf("StartBulkDataExportAll() returned unexpected error. got: %v, want: %v", err, authErr)
+	}
+
+	cl.authenticator = testAuthenticator{}
+	cl.SetDryRun(false)
+	if _, err := cl.StartBulkDataExportAll(context.Background(), nil, time.Time{}); err != nil {
+		t.Errorf("StartBulkDataExportAll() after SetDryRun(false) returned unexpected error: %v", err)
+	}
+	if requests != 1 {
+		t.Errorf("server received %d requests, want 1", requests)
+	}
+}
+
 func TestClient_GetJobStatus(t *testing.T) {
 	t.Run("unauthorized", func(t *testing.T) {
 		server := newUnauthorizedServer(t)
 		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
-		_, err := cl.JobStatus(server.URL + "/some/url")
-		if err != ErrorUnauthorized {
+		_, err := cl.JobStatus(context.Background(), server.URL + "/some/url")
+		if !errors.Is(err, ErrorUnauthorized) {
 			t.Errorf("GetJobStatus returned unexpected error returned: got: %v, want: %v", err, ErrorUnauthorized)
 		}
 	})
@@ -261,7 +365,7 @@ func TestClient_GetJobStatus(t *testing.T) {
 		}))
 		jobStatusURL := server.URL + expectedURLSuffix
 		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
-		_, err := cl.JobStatus(jobStatusURL)
+		_, err := cl.JobStatus(context.Background(), jobStatusURL)
 		if err != nil {
 			t.Errorf("GetJobStatus(%v) returned unexpected error: %v", jobID, err)
 		}
@@ -292,7 +396,7 @@ func TestClient_GetJobStatus(t *testing.T) {
 				}))
 				jobStatusURL := server.URL
 				cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
-				jobStatus, err := cl.JobStatus(jobStatusURL)
+				jobStatus, err := cl.JobStatus(context.Background(), jobStatusURL)
 				if err != nil {
 					t.Errorf("GetJobStatus(%v) returned unexpected error: %v", jobStatusURL, err)
 				}
@@ -318,7 +422,7 @@ func TestClient_GetJobStatus(t *testing.T) {
 		jobStatusURL := server.URL
 
 		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
-		jobStatus, err := cl.JobStatus(jobStatusURL)
+		jobStatus, err := cl.JobStatus(context.Background(), jobStatusURL)
 		if err != nil {
 			t.Errorf("GetJobStatus(%v) returned unexpected error: %v", jobStatusURL, err)
 		}
@@ -356,7 +460,7 @@ func TestClient_GetJobStatus(t *testing.T) {
 		jobStatusURL := server.URL
 
 		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
-		jobStatus, err := cl.JobStatus(jobStatusURL)
+		jobStatus, err := cl.JobStatus(context.Background(), jobStatusURL)
 		if err != nil {
 			t.Errorf("GetJobStatus(%v) returned unexpected error: %v", jobStatusURL, err)
 		}
@@ -372,6 +476,41 @@ func TestClient_GetJobStatus(t *testing.T) {
 		if diff := cmp.Diff(expectedMap, jobStatus.ResultURLs, cmpopts.SortMaps(func(k1, k2 string) bool { return k1 < k2 })); diff != "" {
 			t.Errorf("GetJobStatus(%v) returned unexpected diff (-want +got):\n%s", jobStatusURL, diff)
 		}
+		if diff := cmp.Diff([]string{"url_5", "url_6"}, jobStatus.URLsForType(cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT)); diff != "" {
+			t.Errorf("URLsForType(EXPLANATION_OF_BENEFIT) returned unexpected diff (-want +got):\n%s", diff)
+		}
+		if got := jobStatus.URLsForType(cpb.ResourceTypeCode_ENCOUNTER); got != nil {
+			t.Errorf("URLsForType(ENCOUNTER) = %v, want nil", got)
+		}
+	})
+
+	t.Run("job completed with counts", func(t *testing.T) {
+		jsonResponse := `{"transactionTime": "2020-09-15T17:53:11.476Z",
+												"output":[
+												{"type": "Patient","url": "url_1", "count": 10},
+												{"type": "Patient","url": "url_2", "count": 0},
+												{"type": "Coverage","url": "url_3"}]}`
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(jsonResponse))
+		}))
+		jobStatusURL := server.URL
+
+		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+		jobStatus, err := cl.JobStatus(context.Background(), jobStatusURL)
+		if err != nil {
+			t.Errorf("GetJobStatus(%v) returned unexpected error: %v", jobStatusURL, err)
+		}
+		wantOutputFiles := map[cpb.ResourceTypeCode_Value][]OutputFile{
+			cpb.ResourceTypeCode_PATIENT:  {{URL: "url_1", Count: 10}, {URL: "url_2", Count: 0}},
+			cpb.ResourceTypeCode_COVERAGE: {{URL: "url_3", Count: -1}},
+		}
+		if diff := cmp.Diff(wantOutputFiles, jobStatus.OutputFiles); diff != "" {
+			t.Errorf("GetJobStatus(%v) returned unexpected OutputFiles diff (-want +got):\n%s", jobStatusURL, diff)
+		}
+		gotCount, gotAllReported := jobStatus.ExpectedResourceCount()
+		if gotCount != 10 || gotAllReported {
+			t.Errorf("ExpectedResourceCount() = %d, %t; want 10, false", gotCount, gotAllReported)
+		}
 	})
 
 	t.Run("unexpected number of X-Progress", func(t *testing.T) {
@@ -382,7 +521,7 @@ func TestClient_GetJobStatus(t *testing.T) {
 		jobStatusURL := server.URL
 
 		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
-		jobStatus, err := cl.JobStatus(jobStatusURL)
+		jobStatus, err := cl.JobStatus(context.Background(), jobStatusURL)
 		if err != nil {
 			t.Errorf("GetJobStatus(%v) returned unexpected error: %v", jobStatusURL, err)
 		}
@@ -399,7 +538,7 @@ func TestClient_GetJobStatus(t *testing.T) {
 		jobStatusURL := server.URL
 
 		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
-		jobStatus, err := cl.JobStatus(jobStatusURL)
+		jobStatus, err := cl.JobStatus(context.Background(), jobStatusURL)
 		if err != nil {
 			t.Errorf("GetJobStatus(%v) returned unexpected error: %v", jobStatusURL, err)
 		}
@@ -416,7 +555,7 @@ func TestClient_GetJobStatus(t *testing.T) {
 		jobStatusURL := server.URL
 
 		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
-		jobStatus, err := cl.JobStatus(jobStatusURL)
+		jobStatus, err := cl.JobStatus(context.Background(), jobStatusURL)
 		if err != nil {
 			t.Errorf("GetJobStatus(%v) returned unexpected error: %v", jobStatusURL, err)
 		}
@@ -433,7 +572,7 @@ func TestClient_GetJobStatus(t *testing.T) {
 		jobStatusURL := server.URL
 
 		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
-		jobStatus, err := cl.JobStatus(jobStatusURL)
+		jobStatus, err := cl.JobStatus(context.Background(), jobStatusURL)
 		if err != nil {
 			t.Errorf("GetJobStatus(%v) returned unexpected error: %v", jobStatusURL, err)
 		}
@@ -453,7 +592,7 @@ func TestClient_GetJobStatus(t *testing.T) {
 		jobStatusURL := server.URL
 
 		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
-		_, err := cl.JobStatus(jobStatusURL)
+		_, err := cl.JobStatus(context.Background(), jobStatusURL)
 		if err == nil {
 			t.Errorf("GetJobStatus(%v) succeeded, want error", jobStatusURL)
 		}
@@ -464,8 +603,8 @@ func TestClient_GetData(t *testing.T) {
 	t.Run("unauthorized", func(t *testing.T) {
 		server := newUnauthorizedServer(t)
 		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
-		_, err := cl.GetData(server.URL + "/id")
-		if err != ErrorUnauthorized {
+		_, err := cl.GetData(context.Background(), server.URL + "/id")
+		if !errors.Is(err, ErrorUnauthorized) {
 			t.Errorf("GetData returned unexpected error returned: got: %v, want: %v", err, ErrorUnauthorized)
 		}
 	})
@@ -475,23 +614,112 @@ func TestClient_GetData(t *testing.T) {
 			w.WriteHeader(http.StatusInternalServerError)
 		}))
 		c := Client{authenticator: testAuthenticator{}, httpClient: &http.Client{}}
-		_, err := c.GetData(server.URL)
+		_, err := c.GetData(context.Background(), server.URL)
 		if !errors.Is(err, ErrorUnexpectedStatusCode) {
 			t.Errorf("GetData(%v) returned incorrect underlying error. got: %v, want: %v", server.URL, err, ErrorUnexpectedStatusCode)
 		}
 	})
 
+	t.Run("HTTPError details", func(t *testing.T) {
+		body := strings.Repeat("x", 5000)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(body))
+		}))
+		c := Client{authenticator: testAuthenticator{}, httpClient: &http.Client{}}
+		_, err := c.GetData(context.Background(), server.URL + "/data?signature=secret")
+		var httpErr *HTTPError
+		if !errors.As(err, &httpErr) {
+			t.Fatalf("GetData returned unexpected error. got: %v, want: *HTTPError", err)
+		}
+		if !errors.Is(err, ErrorUnexpectedStatusCode) {
+			t.Errorf("GetData returned incorrect underlying error. got: %v, want: %v", err, ErrorUnexpectedStatusCode)
+		}
+		want := HTTPError{
+			Op:         "get data",
+			URL:        server.URL + "/data",
+			StatusCode: http.StatusServiceUnavailable,
+			Body:       []byte(body[:4096]),
+			Err:        ErrorUnexpectedStatusCode,
+		}
+		if diff := cmp.Diff(want, *httpErr, cmpopts.EquateErrors()); diff != "" {
+			t.Errorf("GetData returned unexpected HTTPError (-want +got):\n%s", diff)
+		}
+		if strings.Contains(err.Error(), "secret") {
+			t.Errorf("GetData error %q contains the URL query string", err)
+		}
+	})
+
 	t.Run("retryable not-OK http response", func(t *testing.T) {
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 			w.WriteHeader(http.StatusNotFound)
 		}))
 		c := Client{authenticator: testAuthenticator{}, httpClient: &http.Client{}}
-		_, err := c.GetData(server.URL)
+		_, err := c.GetData(context.Background(), server.URL)
 		if !errors.Is(err, ErrorRetryableHTTPStatus) {
 			t.Errorf("GetData(%v) returned incorrect underlying error. got: %v, want: %v", server.URL, err, ErrorRetryableHTTPStatus)
 		}
 	})
 
+	t.Run("OperationOutcome", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"resourceType": "OperationOutcome", "issue": [{"severity": "error", "code": "forbidden", "details": {"text": "Access denied"}, "diagnostics": "client is not authorized for this file"}]}`))
+		}))
+		c := Client{authenticator: testAuthenticator{}, httpClient: &http.Client{}}
+		_, err := c.GetData(context.Background(), server.URL)
+		if !errors.Is(err, ErrorUnexpectedStatusCode) {
+			t.Errorf("GetData(%v) returned incorrect underlying error. got: %v, want: %v", server.URL, err, ErrorUnexpectedStatusCode)
+		}
+		var httpErr *HTTPError
+		if !errors.As(err, &httpErr) {
+			t.Fatalf("GetData returned unexpected error. got: %v, want: *HTTPError", err)
+		}
+		wantIssues := []OperationOutcomeIssue{{Severity: "error", Code: "forbidden", Diagnostics: "client is not authorized for this file", Details: "Access denied"}}
+		if diff := cmp.Diff(wantIssues, httpErr.Issues); diff != "" {
+			t.Errorf("GetData returned unexpected OperationOutcome issues (-want +got):\n%s", diff)
+		}
+		wantMsg := "with OperationOutcome: [error forbidden: Access denied: client is not authorized for this file]"
+		if !strings.HasSuffix(err.Error(), wantMsg) {
+			t.Errorf("GetData error %q does not end with %q", err, wantMsg)
+		}
+	})
+
+	t.Run("expired URL", func(t *testing.T) {
+		cases := []struct {
+			name   string
+			status int
+			body   string
+		}{
+			{
+				name:   "OperationOutcome",
+				status: http.StatusNotFound,
+				body:   `{"resourceType": "OperationOutcome", "issue": [{"severity": "error", "code": "expired", "diagnostics": "the result file has expired"}]}`,
+			},
+			{
+				name:   "Gone",
+				status: http.StatusGone,
+			},
+		}
+		for _, tc := range cases {
+			t.Run(tc.name, func(t *testing.T) {
+				server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+					w.WriteHeader(tc.status)
+					w.Write([]byte(tc.body))
+				}))
+				defer server.Close()
+				c := Client{authenticator: testAuthenticator{}, httpClient: &http.Client{}}
+				_, err := c.GetData(context.Background(), server.URL)
+				if !errors.Is(err, ErrorDataURLExpired) {
+					t.Errorf("GetData(%v) returned incorrect underlying error. got: %v, want: %v", server.URL, err, ErrorDataURLExpired)
+				}
+				if errors.Is(err, ErrorRetryableHTTPStatus) {
+					t.Errorf("GetData(%v) returned a retryable error for an expired URL: %v", server.URL, err)
+				}
+			})
+		}
+	})
+
 	t.Run("valid GetData", func(t *testing.T) {
 		expectedResponse := []byte("the response")
 		expectedPath := "/data"
@@ -505,7 +733,7 @@ func TestClient_GetData(t *testing.T) {
 
 		cl := Client{baseURL: server.URL, authenticator: testAuthenticator{}, httpClient: &http.Client{}}
 		path := server.URL + expectedPath
-		r, err := cl.GetData(path)
+		r, err := cl.GetData(context.Background(), path)
 		if err != nil {
 			t.Errorf("GetData(%v) returned unexpected error: %v", path, err)
 		}
@@ -538,7 +766,7 @@ func TestClient_MonitorJobStatus(t *testing.T) {
 		jobStatusURL := server.URL
 		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
 		results := make([]*MonitorResult, 0, 1)
-		for st := range cl.MonitorJobStatus(jobStatusURL, period, timeout) {
+		for st := range cl.MonitorJobStatus(context.Background(), jobStatusURL, period, timeout) {
 			results = append(results, st)
 		}
 		if got, want := results[len(results)-1].Error, ErrorTimeout; got != want {
@@ -556,7 +784,7 @@ func TestClient_MonitorJobStatus(t *testing.T) {
 		jobStatusURL := server.URL
 		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
 		results := []*MonitorResult{}
-		for st := range cl.MonitorJobStatus(jobStatusURL, period, timeout) {
+		for st := range cl.MonitorJobStatus(context.Background(), jobStatusURL, period, timeout) {
 			results = append(results, st)
 		}
 		if len(results) != 1 {
@@ -577,6 +805,7 @@ func TestClient_MonitorJobStatus(t *testing.T) {
 		completeJobStatus := JobStatus{
 			IsComplete:      true,
 			ResultURLs:      map[cpb.ResourceTypeCode_Value][]string{wantResource: []string{wantResultURL}},
+			OutputFiles:     map[cpb.ResourceTypeCode_Value][]OutputFile{wantResource: []OutputFile{{URL: wantResultURL, Count: -1}}},
 			TransactionTime: time.Date(2020, 9, 15, 17, 53, 11, 476000000, time.UTC)}
 
 		cases := []struct {
@@ -633,7 +862,11 @@ func TestClient_MonitorJobStatus(t *testing.T) {
 				cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
 				results := make([]JobStatus, 0, 1)
 
-				for st := range cl.MonitorJobStatus(jobStatusURL, tc.period, tc.timeout) {
+				if _, ok := cl.LastStatus(jobStatusURL); ok {
+					t.Errorf("LastStatus(%v) returned a status before monitoring started", jobStatusURL)
+				}
+
+				for st := range cl.MonitorJobStatus(context.Background(), jobStatusURL, tc.period, tc.timeout) {
 					if st.Error != nil {
 						t.Errorf("MonitorJobStatus(%v,%v,%v) returned unexpected error: %v", jobStatusURL, tc.period, tc.timeout, st.Error)
 					}
@@ -643,6 +876,22 @@ func TestClient_MonitorJobStatus(t *testing.T) {
 				if diff := cmp.Diff(tc.wantJobStatuses, results); diff != "" {
 					t.Errorf("MonitorJobStatus(%v,%v,%v) unexpected diff in result (-want +got):\n%s", jobStatusURL, tc.period, tc.timeout, diff)
 				}
+
+				counter.Lock()
+				wantRequests := counter.count
+				counter.Unlock()
+				lastStatus, ok := cl.LastStatus(jobStatusURL)
+				if !ok {
+					t.Fatalf("LastStatus(%v) returned no status after monitoring", jobStatusURL)
+				}
+				if diff := cmp.Diff(tc.wantJobStatuses[len(tc.wantJobStatuses)-1], lastStatus); diff != "" {
+					t.Errorf("LastStatus(%v) unexpected diff in result (-want +got):\n%s", jobStatusURL, diff)
+				}
+				counter.Lock()
+				if counter.count != wantRequests {
+					t.Errorf("LastStatus(%v) made requests to the server", jobStatusURL)
+				}
+				counter.Unlock()
 			})
 		}
 	})
@@ -663,6 +912,7 @@ func TestClient_MonitorJobStatus(t *testing.T) {
 		completeJobStatus := JobStatus{
 			IsComplete:      true,
 			ResultURLs:      map[cpb.ResourceTypeCode_Value][]string{wantResource: []string{wantURL}},
+			OutputFiles:     map[cpb.ResourceTypeCode_Value][]OutputFile{wantResource: []OutputFile{{URL: wantURL, Count: -1}}},
 			TransactionTime: time.Date(2020, 9, 15, 17, 53, 11, 476000000, time.UTC)}
 
 		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -708,7 +958,7 @@ func TestClient_MonitorJobStatus(t *testing.T) {
 		monitorPeriod := time.Millisecond
 		monitorTimeout := 2 * time.Second
 
-		for st := range cl.MonitorJobStatus(jobStatusURL, monitorPeriod, monitorTimeout) {
+		for st := range cl.MonitorJobStatus(context.Background(), jobStatusURL, monitorPeriod, monitorTimeout) {
 			if st.Error != nil {
 				t.Errorf("MonitorJobStatus(%v,%v,%v) returned unexpected error: %v", jobStatusURL, monitorPeriod, monitorTimeout, st.Error)
 			}
@@ -738,3 +988,571 @@ func newUnauthorizedServer(t *testing.T) *httptest.Server {
 	t.Cleanup(func() { server.Close() })
 	return server
 }
+
+func TestClient_Close(t *testing.T) {
+	t.Run("stops monitoring", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer server.Close()
+		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+
+		results := cl.MonitorJobStatus(context.Background(), server.URL, time.Hour, 2*time.Hour)
+		if r := <-results; r.Error != nil {
+			t.Fatalf("MonitorJobStatus returned unexpected error: %v", r.Error)
+		}
+		if err := cl.Close(); err != nil {
+			t.Fatalf("Close() returned unexpected error: %v", err)
+		}
+
+		var last *MonitorResult
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case r, ok := <-results:
+				if !ok {
+					if last == nil || !errors.Is(last.Error, ErrorClientClosed) {
+						t.Errorf("MonitorJobStatus did not report ErrorClientClosed, last result: %+v", last)
+					}
+					return
+				}
+				last = r
+			case <-timeout:
+				t.Fatal("MonitorJobStatus channel was not closed after Close()")
+			}
+		}
+	})
+
+	t.Run("methods return ErrorClientClosed", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			t.Errorf("unexpected request to %s after Close()", req.URL)
+		}))
+		defer server.Close()
+		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+		if err := cl.Close(); err != nil {
+			t.Fatalf("Close() returned unexpected error: %v", err)
+		}
+		// Closing twice should be safe.
+		if err := cl.Close(); err != nil {
+			t.Fatalf("second Close() returned unexpected error: %v", err)
+		}
+
+		if _, err := cl.StartBulkDataExportAll(context.Background(), nil, time.Time{}); !errors.Is(err, ErrorClientClosed) {
+			t.Errorf("StartBulkDataExportAll() returned unexpected error. got: %v, want: %v", err, ErrorClientClosed)
+		}
+		if _, err := cl.JobStatus(context.Background(), server.URL); !errors.Is(err, ErrorClientClosed) {
+			t.Errorf("JobStatus() returned unexpected error. got: %v, want: %v", err, ErrorClientClosed)
+		}
+		if _, err := cl.GetData(context.Background(), server.URL); !errors.Is(err, ErrorClientClosed) {
+			t.Errorf("GetData() returned unexpected error. got: %v, want: %v", err, ErrorClientClosed)
+		}
+		if err := cl.Authenticate(context.Background()); !errors.Is(err, ErrorClientClosed) {
+			t.Errorf("Authenticate() returned unexpected error. got: %v, want: %v", err, ErrorClientClosed)
+		}
+		var results []*MonitorResult
+		for r := range cl.MonitorJobStatus(context.Background(), server.URL, time.Millisecond, time.Minute) {
+			results = append(results, r)
+		}
+		if len(results) != 1 || !errors.Is(results[0].Error, ErrorClientClosed) {
+			t.Errorf("MonitorJobStatus() returned unexpected results: %v, want a single ErrorClientClosed", results)
+		}
+	})
+}
+
+func TestClient_MonitorJobStatus_Reauthentication(t *testing.T) {
+	cases := []struct {
+		name              string
+		tokenStatus       int
+		wantErr           error
+		wantTokenRequests int
+	}{
+		{
+			name:              "CredentialsRejected",
+			tokenStatus:       http.StatusUnauthorized,
+			wantErr:           ErrorCredentialsRejected,
+			wantTokenRequests: 1,
+		},
+		{
+			name:              "StillUnauthorized",
+			tokenStatus:       http.StatusOK,
+			wantErr:           ErrorUnauthorized,
+			wantTokenRequests: maxConsecutiveReauthentications,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			tokenRequests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path == "/auth/token" {
+					mu.Lock()
+					tokenRequests++
+					mu.Unlock()
+					w.WriteHeader(tc.tokenStatus)
+					w.Write([]byte(`{"access_token": "token", "expires_in": 1200}`))
+					return
+				}
+				w.WriteHeader(http.StatusUnauthorized)
+			}))
+			defer server.Close()
+
+			auth, err := NewHTTPBasicOAuthAuthenticator("username", "password", server.URL+"/auth/token", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			auth.(*BearerTokenAuthenticator).token = &BearerToken{Token: "123", Expiry: time.Now().Add(5 * time.Minute)}
+			cl, err := NewClientWithOptions(server.URL, auth, &ClientOptions{
+				JobStatusRetryPolicy: &JobStatusRetryPolicy{InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond},
+			})
+			if err != nil {
+				t.Fatalf("NewClientWithOptions() returned unexpected error: %v", err)
+			}
+
+			var results []*MonitorResult
+			for r := range cl.MonitorJobStatus(context.Background(), server.URL+"/jobs/1", time.Millisecond, time.Minute) {
+				results = append(results, r)
+			}
+			if len(results) != 1 || !errors.Is(results[0].Error, tc.wantErr) {
+				t.Errorf("MonitorJobStatus() returned unexpected results: %v, want a single %v", results, tc.wantErr)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if tokenRequests != tc.wantTokenRequests {
+				t.Errorf("unexpected number of token requests. got: %d, want: %d", tokenRequests, tc.wantTokenRequests)
+			}
+		})
+	}
+}
+
+func TestClient_SetToken(t *testing.T) {
+	var gotAuthHeaders []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		gotAuthHeaders = append(gotAuthHeaders, req.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+	cl.SetToken("external-token")
+
+	// The Client cannot obtain a new token, so monitoring should stop at the
+	// first ErrorUnauthorized rather than retrying until the timeout.
+	var results []*MonitorResult
+	for r := range cl.MonitorJobStatus(context.Background(), server.URL, time.Millisecond, time.Minute) {
+		results = append(results, r)
+	}
+	if len(results) != 1 || !errors.Is(results[0].Error, ErrorUnauthorized) {
+		t.Errorf("MonitorJobStatus() returned unexpected results: %v, want a single ErrorUnauthorized", results)
+	}
+	if diff := cmp.Diff([]string{"Bearer external-token"}, gotAuthHeaders); diff != "" {
+		t.Errorf("unexpected Authorization headers sent (-want +got):\n%s", diff)
+	}
+	if err := cl.Authenticate(context.Background()); !errors.Is(err, ErrorNoCredentials) {
+		t.Errorf("Authenticate() returned unexpected error. got: %v, want: %v", err, ErrorNoCredentials)
+	}
+}
+
+func TestClient_ResourceTypeNames(t *testing.T) {
+	jobStatusPath := "/job/1"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == jobStatusPath {
+			w.Write([]byte(`{"output": [{"type": "LegacyPatient", "url": "url1"}, {"type": "Patient", "url": "url2"}, {"type": "Coverage", "url": "url3"}], "transactionTime" : "2013-12-09T11:00:00.000Z"}`))
+			return
+		}
+		if got, want := req.URL.Query().Get("_type"), "LegacyPatient,Coverage"; got != want {
+			t.Errorf("StartBulkDataExportAll() sent unexpected _type. got: %q, want: %q", got, want)
+		}
+		w.Header()["Content-Location"] = []string{jobStatusPath}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	cl, err := NewClientWithOptions(server.URL, testAuthenticator{}, &ClientOptions{
+		ResourceTypeNames: map[cpb.ResourceTypeCode_Value]string{cpb.ResourceTypeCode_PATIENT: "LegacyPatient"},
+	})
+	if err != nil {
+		t.Fatalf("NewClientWithOptions() returned unexpected error: %v", err)
+	}
+
+	if _, err := cl.StartBulkDataExportAll(context.Background(), []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_COVERAGE}, time.Time{}); err != nil {
+		t.Fatalf("StartBulkDataExportAll() returned unexpected error: %v", err)
+	}
+	jobStatus, err := cl.JobStatus(context.Background(), server.URL + jobStatusPath)
+	if err != nil {
+		t.Fatalf("JobStatus() returned unexpected error: %v", err)
+	}
+	wantURLs := map[cpb.ResourceTypeCode_Value][]string{
+		cpb.ResourceTypeCode_PATIENT:  {"url1", "url2"},
+		cpb.ResourceTypeCode_COVERAGE: {"url3"},
+	}
+	if diff := cmp.Diff(wantURLs, jobStatus.ResultURLs); diff != "" {
+		t.Errorf("JobStatus() returned unexpected ResultURLs (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewClientWithOptions_DuplicateResourceTypeName(t *testing.T) {
+	_, err := NewClientWithOptions("https://example.com", testAuthenticator{}, &ClientOptions{
+		ResourceTypeNames: map[cpb.ResourceTypeCode_Value]string{
+			cpb.ResourceTypeCode_PATIENT:  "Legacy",
+			cpb.ResourceTypeCode_COVERAGE: "Legacy",
+		},
+	})
+	if err == nil {
+		t.Error("NewClientWithOptions() with a duplicate resource type name returned nil error")
+	}
+}
+
+func TestClient_ValidateJobStatusURL(t *testing.T) {
+	cases := []struct {
+		name         string
+		jobStatusURL string
+		allowedHosts []string
+		skipCheck    bool
+		wantErr      error
+	}{
+		{name: "SameHost", jobStatusURL: "https://fhir.example.com/jobs/1"},
+		{name: "SameHostDifferentCase", jobStatusURL: "https://FHIR.example.com/jobs/1"},
+		{name: "DifferentHost", jobStatusURL: "https://attacker.example.com/jobs/1", wantErr: ErrorUntrustedJobStatusHost},
+		{name: "DifferentPort", jobStatusURL: "https://fhir.example.com:8443/jobs/1", wantErr: ErrorUntrustedJobStatusHost},
+		{name: "RelativeURL", jobStatusURL: "/jobs/1", wantErr: ErrorUntrustedJobStatusHost},
+		{name: "AllowedHost", jobStatusURL: "https://results.example.com:8443/jobs/1", allowedHosts: []string{"results.example.com"}},
+		{name: "AllowedHostAndPort", jobStatusURL: "https://results.example.com:8443/jobs/1", allowedHosts: []string{"results.example.com:8443"}},
+		{name: "AllowedHostWrongPort", jobStatusURL: "https://results.example.com:9443/jobs/1", allowedHosts: []string{"results.example.com:8443"}, wantErr: ErrorUntrustedJobStatusHost},
+		{name: "CheckSkipped", jobStatusURL: "https://attacker.example.com/jobs/1", skipCheck: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cl, err := NewClientWithOptions("https://fhir.example.com/api/v2", testAuthenticator{}, &ClientOptions{
+				JobStatusAllowedHosts:  tc.allowedHosts,
+				SkipJobStatusHostCheck: tc.skipCheck,
+			})
+			if err != nil {
+				t.Fatalf("NewClientWithOptions() returned unexpected error: %v", err)
+			}
+			if err := cl.ValidateJobStatusURL(tc.jobStatusURL); !errors.Is(err, tc.wantErr) {
+				t.Errorf("ValidateJobStatusURL(%q) returned unexpected error. got: %v, want: %v", tc.jobStatusURL, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestClient_MonitorJobStatus_UntrustedHost(t *testing.T) {
+	otherServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Errorf("unexpected request to untrusted host with Authorization %q", req.Header.Get("Authorization"))
+	}))
+	defer otherServer.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer server.Close()
+
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+	var results []*MonitorResult
+	for r := range cl.MonitorJobStatus(context.Background(), otherServer.URL+"/jobs/1", time.Millisecond, time.Minute) {
+		results = append(results, r)
+	}
+	if len(results) != 1 || !errors.Is(results[0].Error, ErrorUntrustedJobStatusHost) {
+		t.Errorf("MonitorJobStatus() returned unexpected results: %v, want a single ErrorUntrustedJobStatusHost", results)
+	}
+}
+
+func TestClient_MonitorJobStatus_RetryPolicy(t *testing.T) {
+	completeBody := `{"transactionTime": "2020-12-09T11:00:00.123+00:00", "output": []}`
+	cases := []struct {
+		name string
+		// statuses are the status codes returned by successive job status
+		// requests. The job is complete on the request after the last one.
+		statuses []int
+		// wantErrs are the errors which should be sent, in order.
+		wantErrs     []error
+		wantComplete bool
+	}{
+		{
+			name:         "TransientErrorsTolerated",
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusAccepted, http.StatusBadGateway, http.StatusServiceUnavailable},
+			wantComplete: true,
+		},
+		{
+			name:     "RetriesExhausted",
+			statuses: []int{http.StatusServiceUnavailable, http.StatusGatewayTimeout, http.StatusInternalServerError},
+			wantErrs: []error{ErrorJobStatusRetriesExhausted},
+		},
+		{
+			name:         "NonRetryableSentImmediately",
+			statuses:     []int{http.StatusBadRequest},
+			wantErrs:     []error{ErrorUnexpectedStatusCode},
+			wantComplete: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				n := requests
+				requests++
+				mu.Unlock()
+				if n < len(tc.statuses) {
+					w.WriteHeader(tc.statuses[n])
+					return
+				}
+				w.Write([]byte(completeBody))
+			}))
+			defer server.Close()
+
+			cl, err := NewClientWithOptions(server.URL, testAuthenticator{}, &ClientOptions{
+				JobStatusRetryPolicy: &JobStatusRetryPolicy{MaxConsecutiveErrors: 2, InitialBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond},
+			})
+			if err != nil {
+				t.Fatalf("NewClientWithOptions() returned unexpected error: %v", err)
+			}
+			var errs []error
+			complete := false
+			for r := range cl.MonitorJobStatus(context.Background(), server.URL+"/jobs/1", time.Millisecond, time.Minute) {
+				if r.Error != nil {
+					errs = append(errs, r.Error)
+				}
+				complete = complete || r.Status.IsComplete
+			}
+			if len(errs) != len(tc.wantErrs) {
+				t.Fatalf("MonitorJobStatus() sent unexpected errors. got: %v, want: %v", errs, tc.wantErrs)
+			}
+			for i, err := range errs {
+				if !errors.Is(err, tc.wantErrs[i]) {
+					t.Errorf("MonitorJobStatus() sent unexpected error. got: %v, want: %v", err, tc.wantErrs[i])
+				}
+			}
+			if complete != tc.wantComplete {
+				t.Errorf("unexpected job completion. got: %t, want: %t", complete, tc.wantComplete)
+			}
+		})
+	}
+}
+
+func TestClient_MonitorJobStatus_FollowContinuations(t *testing.T) {
+	var serverURL string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/jobs/1":
+			w.Write([]byte(`{"transactionTime": "2020-12-09T11:00:00.123+00:00", "output": [{"type": "Patient", "url": "` + serverURL + `/data/1"}], "link": [{"relation": "next", "url": "/jobs/2"}]}`))
+		case "/jobs/2":
+			w.Header().Set("Link", `<`+serverURL+`/jobs/3>; rel="next"`)
+			w.Write([]byte(`{"transactionTime": "2020-12-10T11:00:00.123+00:00", "output": [{"type": "Patient", "url": "` + serverURL + `/data/2", "count": 3}]}`))
+		case "/jobs/3":
+			w.Write([]byte(`{"transactionTime": "2020-12-11T11:00:00.123+00:00", "output": [{"type": "Observation", "url": "` + serverURL + `/data/3"}]}`))
+		default:
+			t.Errorf("unexpected request to %s", req.URL.Path)
+		}
+	}))
+	defer server.Close()
+	serverURL = server.URL
+
+	cases := []struct {
+		name   string
+		follow bool
+		want   JobStatus
+	}{
+		{
+			name: "NotFollowed",
+			want: JobStatus{
+				IsComplete:       true,
+				ResultURLs:       map[cpb.ResourceTypeCode_Value][]string{cpb.ResourceTypeCode_PATIENT: {serverURL + "/data/1"}},
+				OutputFiles:      map[cpb.ResourceTypeCode_Value][]OutputFile{cpb.ResourceTypeCode_PATIENT: {{URL: serverURL + "/data/1", Count: -1}}},
+				TransactionTime:  time.Date(2020, 12, 9, 11, 0, 0, 123000000, time.UTC),
+				NextJobStatusURL: serverURL + "/jobs/2",
+			},
+		},
+		{
+			name:   "Followed",
+			follow: true,
+			want: JobStatus{
+				IsComplete: true,
+				ResultURLs: map[cpb.ResourceTypeCode_Value][]string{
+					cpb.ResourceTypeCode_PATIENT:     {serverURL + "/data/1", serverURL + "/data/2"},
+					cpb.ResourceTypeCode_OBSERVATION: {serverURL + "/data/3"},
+				},
+				OutputFiles: map[cpb.ResourceTypeCode_Value][]OutputFile{
+					cpb.ResourceTypeCode_PATIENT:     {{URL: serverURL + "/data/1", Count: -1}, {URL: serverURL + "/data/2", Count: 3}},
+					cpb.ResourceTypeCode_OBSERVATION: {{URL: serverURL + "/data/3", Count: -1}},
+				},
+				TransactionTime: time.Date(2020, 12, 9, 11, 0, 0, 123000000, time.UTC),
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cl, err := NewClientWithOptions(server.URL, testAuthenticator{}, &ClientOptions{FollowJobContinuations: tc.follow})
+			if err != nil {
+				t.Fatalf("NewClientWithOptions() returned unexpected error: %v", err)
+			}
+			var got []*MonitorResult
+			for r := range cl.MonitorJobStatus(context.Background(), server.URL+"/jobs/1", time.Millisecond, time.Minute) {
+				got = append(got, r)
+			}
+			if len(got) != 1 || got[0].Error != nil {
+				t.Fatalf("MonitorJobStatus() sent unexpected results: %v, want a single completed status", got)
+			}
+			if diff := cmp.Diff(tc.want, got[0].Status); diff != "" {
+				t.Errorf("MonitorJobStatus() sent unexpected status (-want +got):\n%s", diff)
+			}
+			if last, _ := cl.LastStatus(server.URL + "/jobs/1"); !cmp.Equal(tc.want, last) {
+				t.Errorf("LastStatus() = %v, want %v", last, tc.want)
+			}
+		})
+	}
+}
+
+func TestClient_MonitorJobStatus_ContinuationLoop(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		next := "/jobs/1"
+		if req.URL.Path == "/jobs/1" {
+			next = "/jobs/2"
+		}
+		w.Header().Set("Link", "<"+next+">; rel=\"next\"")
+		w.Write([]byte(`{"transactionTime": "2020-12-09T11:00:00.123+00:00", "output": []}`))
+	}))
+	defer server.Close()
+
+	cl, err := NewClientWithOptions(server.URL, testAuthenticator{}, &ClientOptions{FollowJobContinuations: true})
+	if err != nil {
+		t.Fatalf("NewClientWithOptions() returned unexpected error: %v", err)
+	}
+	var results []*MonitorResult
+	for r := range cl.MonitorJobStatus(context.Background(), server.URL+"/jobs/1", time.Millisecond, time.Minute) {
+		results = append(results, r)
+	}
+	if len(results) != 1 || !errors.Is(results[0].Error, ErrorJobContinuationLoop) {
+		t.Errorf("MonitorJobStatus() returned unexpected results: %v, want a single ErrorJobContinuationLoop", results)
+	}
+}
+
+func TestClient_MonitorJobStatusCallback(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		n := requests
+		requests++
+		mu.Unlock()
+		if n < 2 {
+			w.Header().Set("X-Progress", fmt.Sprintf("%d%%", (n+1)*25))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		w.Write([]byte(`{"transactionTime": "2020-12-09T11:00:00.123+00:00", "output": []}`))
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		name string
+		// stopAt is the percent complete at which the callback returns false.
+		stopAt      int
+		wantPercent []int
+	}{
+		{name: "UntilComplete", stopAt: -1, wantPercent: []int{25, 50, 0}},
+		{name: "StoppedByCallback", stopAt: 50, wantPercent: []int{25, 50}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			mu.Lock()
+			requests = 0
+			mu.Unlock()
+			cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+			var gotPercent []int
+			err := cl.MonitorJobStatusCallback(context.Background(), server.URL+"/jobs/1", time.Millisecond, func(r MonitorResult) bool {
+				if r.Error != nil {
+					t.Errorf("MonitorJobStatusCallback() called back with unexpected error: %v", r.Error)
+				}
+				gotPercent = append(gotPercent, r.Status.PercentComplete)
+				return r.Status.PercentComplete != tc.stopAt
+			})
+			if err != nil {
+				t.Fatalf("MonitorJobStatusCallback() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(tc.wantPercent, gotPercent); diff != "" {
+				t.Errorf("MonitorJobStatusCallback() called back with unexpected progress (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClient_MonitorJobStatusCallback_ContextCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := cl.MonitorJobStatusCallback(ctx, server.URL+"/jobs/1", time.Minute, func(r MonitorResult) bool {
+		calls++
+		cancel()
+		return true
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("MonitorJobStatusCallback() returned unexpected error: %v, want %v", err, context.Canceled)
+	}
+	if calls != 1 {
+		t.Errorf("MonitorJobStatusCallback() called back %d times, want 1", calls)
+	}
+}
+
+func TestClient_MonitorJobStatus_ContextCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	results := cl.MonitorJobStatus(ctx, server.URL+"/jobs/1", time.Minute, time.Hour)
+	if r := <-results; r.Error != nil || r.Status.IsComplete {
+		t.Fatalf("MonitorJobStatus() sent unexpected first result: %+v", r)
+	}
+	cancel()
+
+	var lastErr error
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case r, ok := <-results:
+			if !ok {
+				if !errors.Is(lastErr, context.Canceled) {
+					t.Errorf("MonitorJobStatus() sent unexpected last error: %v, want %v", lastErr, context.Canceled)
+				}
+				return
+			}
+			lastErr = r.Error
+		case <-timeout:
+			t.Fatal("MonitorJobStatus() channel was not closed after the context was cancelled")
+		}
+	}
+}
+
+func TestClient_StartBulkDataExport_ContextCanceled(t *testing.T) {
+	requested := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requested = true
+		w.Header().Set("Content-Location", "jobs/1")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cl.StartBulkDataExportAll(ctx, nil, time.Time{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("StartBulkDataExportAll() returned unexpected error: %v, want %v", err, context.Canceled)
+	}
+	if requested {
+		t.Error("StartBulkDataExportAll() sent a request after the context was cancelled")
+	}
+}
+
+func TestJobStatusRetryPolicy_Backoff(t *testing.T) {
+	p := &JobStatusRetryPolicy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	for consecutiveErrors, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if got := p.backoff(consecutiveErrors); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", consecutiveErrors, got, want)
+		}
+	}
+}
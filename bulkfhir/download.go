@@ -0,0 +1,200 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/internal/iohelpers"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// defaultDataRetryDelay is the time waited before retrying a failed data
+// request.
+const defaultDataRetryDelay = 2 * time.Second
+
+// dataRetryDelay is a variable so that it can be overridden in tests.
+var dataRetryDelay = defaultDataRetryDelay
+
+// defaultDownloadRetries is the number of times DownloadToDir retries each
+// result file.
+const defaultDownloadRetries = 5
+
+// GetDataWithRetries calls GetData, retrying up to maxRetries times if the
+// server returns an unauthorized or retryable status. The client is
+// re-authenticated before each retry, as these errors sometimes appear to be
+// related to authentication. The Client's RetryPolicy is not applied to the
+// individual attempts, so that retries are not compounded.
+func (c *Client) GetDataWithRetries(ctx context.Context, url string, maxRetries int) (io.ReadCloser, error) {
+	r, _, err := c.getDataWithRetries(ctx, url, "", maxRetries)
+	return r, err
+}
+
+// GetDataIfNoneMatch is like GetDataWithRetries, but only retrieves the data
+// if it has changed since it was retrieved with the given ETag, so that
+// unchanged result files need not be downloaded again. If etag is non-empty it
+// is sent in an If-None-Match header, and ErrorNotModified is returned
+// (wrapped) if the server responds with 304 Not Modified. Otherwise, the data
+// is returned along with its new ETag, which is empty if the server does not
+// send ETags.
+func (c *Client) GetDataIfNoneMatch(ctx context.Context, url, etag string, maxRetries int) (io.ReadCloser, string, error) {
+	return c.getDataWithRetries(ctx, url, etag, maxRetries)
+}
+
+func (c *Client) getDataWithRetries(ctx context.Context, url, etag string, maxRetries int) (io.ReadCloser, string, error) {
+	r, newETag, err := c.getDataOnce(ctx, url, etag)
+	numRetries := 0
+	for (errors.Is(err, ErrorUnauthorized) || errors.Is(err, ErrorRetryableHTTPStatus)) && numRetries < maxRetries {
+		select {
+		case <-time.After(dataRetryDelay):
+		case <-ctx.Done():
+			return nil, "", fmt.Errorf("failed to fetch data from %s: %w", url, errors.Join(err, ctx.Err()))
+		}
+		log.Infof("Got retryable error from Bulk FHIR server. Re-authenticating and trying again.")
+		if err := c.Authenticate(ctx); err != nil {
+			return nil, "", fmt.Errorf("failed to authenticate: %w", err)
+		}
+		r, newETag, err = c.getDataOnce(ctx, url, etag)
+		numRetries++
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch data from %s: %w", url, err)
+	}
+	return r, newETag, nil
+}
+
+// GetDataWithGzipArchive is like GetData, but also writes a gzip compressed
+// copy of the data to archive as the returned stream is read, so that result
+// files can be archived and processed in a single pass. The returned stream is
+// always plaintext: data which the server sends gzip compressed is archived
+// unchanged (rather than being compressed again) and decompressed for reading.
+//
+// The archive is only complete once the stream has been read to EOF and closed.
+// Closing the stream before then returns iohelpers.ErrArchiveIncomplete. The
+// archive writer is not closed.
+func (c *Client) GetDataWithGzipArchive(ctx context.Context, url string, archive io.Writer) (io.ReadCloser, error) {
+	r, err := c.GetData(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	gtr, err := iohelpers.NewGzipTeeReader(r, archive)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("failed to read data from %s: %w", url, err)
+	}
+	return gtr, nil
+}
+
+type downloadTask struct {
+	url, path string
+}
+
+// DownloadToDir downloads every result file of a completed job to dir,
+// without any processing, for example for archival. Files are named
+// {ResourceType}_{index}.ndjson, where index is the position of the file
+// within the job's results for that resource type. Gzip compressed files are
+// decompressed. Up to concurrency files are downloaded at the same time, and
+// each is retried as in GetDataWithRetries.
+//
+// The paths of the files successfully written are returned in a deterministic
+// order, along with the errors for any files which failed (which are not left
+// in dir). If ctx is cancelled, downloads in progress are stopped, and the
+// remaining files fail with the ctx error.
+func (c *Client) DownloadToDir(ctx context.Context, status JobStatus, dir string, concurrency int) ([]string, error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var resourceTypes []cpb.ResourceTypeCode_Value
+	for rt := range status.ResultURLs {
+		resourceTypes = append(resourceTypes, rt)
+	}
+	sort.Slice(resourceTypes, func(i, j int) bool { return resourceTypes[i] < resourceTypes[j] })
+	var tasks []downloadTask
+	for _, rt := range resourceTypes {
+		name, err := ResourceTypeCodeToName(rt)
+		if err != nil {
+			return nil, err
+		}
+		for i, url := range status.URLsForType(rt) {
+			tasks = append(tasks, downloadTask{url: url, path: filepath.Join(dir, fmt.Sprintf("%s_%d.ndjson", name, i))})
+		}
+	}
+
+	errs := make([]error, len(tasks))
+	taskChan := make(chan int)
+	wg := &sync.WaitGroup{}
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range taskChan {
+				errs[i] = c.downloadToFile(ctx, tasks[i].url, tasks[i].path)
+			}
+		}()
+	}
+	for i := range tasks {
+		taskChan <- i
+	}
+	close(taskChan)
+	wg.Wait()
+
+	var paths []string
+	for i, t := range tasks {
+		if errs[i] == nil {
+			paths = append(paths, t.path)
+		}
+	}
+	return paths, errors.Join(errs...)
+}
+
+// downloadToFile downloads the data at url to a file at path. The data is
+// written to a temporary file which is renamed once complete, so that partial
+// files are never left at path.
+func (c *Client) downloadToFile(ctx context.Context, url, path string) error {
+	body, err := c.GetDataWithRetries(ctx, url, defaultDownloadRetries)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	r, err := iohelpers.MaybeGunzip(body)
+	if err != nil {
+		return fmt.Errorf("failed to read data from %s: %w", url, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,238 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestClient_DownloadToDir(t *testing.T) {
+	dataRetryDelay = 0
+	t.Cleanup(func() { dataRetryDelay = defaultDataRetryDelay })
+
+	patients := []byte(`{"resourceType":"Patient","id":"1"}` + "\n")
+	observations := []byte(`{"resourceType":"Observation","id":"2"}` + "\n")
+	encounters := []byte(`{"resourceType":"Encounter","id":"3"}` + "\n")
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(observations)
+	gw.Close()
+
+	var mu sync.Mutex
+	encounterRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/Patient":
+			w.Write(patients)
+		case "/Observation.gz":
+			w.Write(gzipped.Bytes())
+		case "/Encounter":
+			// The first request fails with a retryable status.
+			mu.Lock()
+			encounterRequests++
+			n := encounterRequests
+			mu.Unlock()
+			if n == 1 {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write(encounters)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+
+	t.Run("Success", func(t *testing.T) {
+		dir := t.TempDir()
+		status := JobStatus{
+			IsComplete: true,
+			ResultURLs: map[cpb.ResourceTypeCode_Value][]string{
+				cpb.ResourceTypeCode_PATIENT:     {server.URL + "/Patient", server.URL + "/Patient"},
+				cpb.ResourceTypeCode_OBSERVATION: {server.URL + "/Observation.gz"},
+				cpb.ResourceTypeCode_ENCOUNTER:   {server.URL + "/Encounter"},
+			},
+		}
+
+		got, err := cl.DownloadToDir(context.Background(), status, dir, 2)
+		if err != nil {
+			t.Fatalf("DownloadToDir() returned unexpected error: %v", err)
+		}
+
+		want := map[string][]byte{
+			filepath.Join(dir, "Encounter_0.ndjson"):   encounters,
+			filepath.Join(dir, "Observation_0.ndjson"): observations,
+			filepath.Join(dir, "Patient_0.ndjson"):     patients,
+			filepath.Join(dir, "Patient_1.ndjson"):     patients,
+		}
+		wantPaths := []string{
+			filepath.Join(dir, "Encounter_0.ndjson"),
+			filepath.Join(dir, "Observation_0.ndjson"),
+			filepath.Join(dir, "Patient_0.ndjson"),
+			filepath.Join(dir, "Patient_1.ndjson"),
+		}
+		if diff := cmp.Diff(wantPaths, got); diff != "" {
+			t.Errorf("DownloadToDir() returned unexpected paths (-want +got):\n%s", diff)
+		}
+		for path, wantData := range want {
+			gotData, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", path, err)
+			}
+			if !bytes.Equal(gotData, wantData) {
+				t.Errorf("unexpected data in %s. got: %s, want: %s", path, gotData, wantData)
+			}
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("failed to read dir: %v", err)
+		}
+		if len(entries) != len(want) {
+			t.Errorf("unexpected number of files in dir. got: %d, want: %d", len(entries), len(want))
+		}
+	})
+
+	t.Run("Failure", func(t *testing.T) {
+		dir := t.TempDir()
+		status := JobStatus{
+			IsComplete: true,
+			ResultURLs: map[cpb.ResourceTypeCode_Value][]string{
+				cpb.ResourceTypeCode_PATIENT: {server.URL + "/Patient", server.URL + "/Forbidden"},
+			},
+		}
+
+		got, err := cl.DownloadToDir(context.Background(), status, dir, 0)
+		if !errors.Is(err, ErrorUnexpectedStatusCode) {
+			t.Errorf("DownloadToDir() returned unexpected error. got: %v, want: %v", err, ErrorUnexpectedStatusCode)
+		}
+		if diff := cmp.Diff([]string{filepath.Join(dir, "Patient_0.ndjson")}, got); diff != "" {
+			t.Errorf("DownloadToDir() returned unexpected paths (-want +got):\n%s", diff)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "Patient_1.ndjson")); !os.IsNotExist(err) {
+			t.Errorf("failed download was written to dir: %v", err)
+		}
+	})
+}
+
+func TestClient_GetDataWithGzipArchive(t *testing.T) {
+	data := []byte(`{"resourceType":"Patient","id":"1"}` + "\n" + `{"resourceType":"Patient","id":"2"}` + "\n")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(data)
+	}))
+	defer server.Close()
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+
+	var archive bytes.Buffer
+	r, err := cl.GetDataWithGzipArchive(context.Background(), server.URL+"/Patient", &archive)
+	if err != nil {
+		t.Fatalf("GetDataWithGzipArchive() returned unexpected error: %v", err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read data: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(data, got); diff != "" {
+		t.Errorf("GetDataWithGzipArchive() returned unexpected data (-want +got):\n%s", diff)
+	}
+
+	zr, err := gzip.NewReader(&archive)
+	if err != nil {
+		t.Fatalf("archive is not gzip compressed: %v", err)
+	}
+	gotArchived, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("failed to decompress archive: %v", err)
+	}
+	if diff := cmp.Diff(data, gotArchived); diff != "" {
+		t.Errorf("GetDataWithGzipArchive() archived unexpected data (-want +got):\n%s", diff)
+	}
+}
+
+func TestClient_GetDataIfNoneMatch(t *testing.T) {
+	data := []byte(`{"resourceType":"Patient","id":"1"}` + "\n")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/etag":
+			if req.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			w.Write(data)
+		case "/no-etag":
+			w.Write(data)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+
+	cases := []struct {
+		name        string
+		path        string
+		etag        string
+		wantETag    string
+		notModified bool
+	}{
+		{name: "NoPreviousETag", path: "/etag", wantETag: `"v1"`},
+		{name: "Changed", path: "/etag", etag: `"v0"`, wantETag: `"v1"`},
+		{name: "NotModified", path: "/etag", etag: `"v1"`, notModified: true},
+		{name: "ServerWithoutETags", path: "/no-etag", etag: `"v1"`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			r, gotETag, err := cl.GetDataIfNoneMatch(context.Background(), server.URL+tc.path, tc.etag, 0)
+			if tc.notModified {
+				if !errors.Is(err, ErrorNotModified) {
+					t.Errorf("GetDataIfNoneMatch() returned unexpected error. got: %v, want: %v", err, ErrorNotModified)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetDataIfNoneMatch() returned unexpected error: %v", err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("failed to read data: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("unexpected data. got: %s, want: %s", got, data)
+			}
+			if gotETag != tc.wantETag {
+				t.Errorf("unexpected ETag. got: %q, want: %q", gotETag, tc.wantETag)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// ContentEncoding is a content coding which the Client can accept for result
+// data (see ClientOptions.AcceptEncodings).
+type ContentEncoding string
+
+const (
+	// EncodingGzip is the gzip content coding.
+	EncodingGzip ContentEncoding = "gzip"
+	// EncodingDeflate is the deflate content coding. Both zlib wrapped (as the
+	// HTTP specification requires) and raw deflate data are accepted, as some
+	// servers send the latter.
+	EncodingDeflate ContentEncoding = "deflate"
+	// EncodingBrotli is the Brotli content coding, which usually compresses
+	// NDJSON noticeably better than gzip.
+	EncodingBrotli ContentEncoding = "br"
+)
+
+// setAcceptEncodings validates and sets the content codings from
+// ClientOptions.AcceptEncodings. A nil encodings leaves the default.
+func (c *Client) setAcceptEncodings(encodings []ContentEncoding) error {
+	if encodings == nil {
+		return nil
+	}
+	for _, e := range encodings {
+		switch e {
+		case EncodingGzip, EncodingDeflate, EncodingBrotli:
+		default:
+			return fmt.Errorf("%w: %q", ErrorUnsupportedContentEncoding, e)
+		}
+	}
+	c.acceptEncodings = append([]ContentEncoding{}, encodings...)
+	return nil
+}
+
+// ParseContentEncodings parses a comma separated list of content codings, such
+// as "br,gzip", for ClientOptions.AcceptEncodings. "identity" may be listed
+// (alone) to request uncompressed data.
+func ParseContentEncodings(list string) ([]ContentEncoding, error) {
+	encodings := []ContentEncoding{}
+	for _, e := range strings.Split(list, ",") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		switch ContentEncoding(e) {
+		case "", "identity":
+		case EncodingGzip, EncodingDeflate, EncodingBrotli:
+			encodings = append(encodings, ContentEncoding(e))
+		default:
+			return nil, fmt.Errorf("%w: %q", ErrorUnsupportedContentEncoding, e)
+		}
+	}
+	return encodings, nil
+}
+
+// setAcceptEncoding sets the Accept-Encoding header of a data request, if
+// ClientOptions.AcceptEncodings is set. It returns true if it did, in which
+// case the response must be decoded with decodeContentEncoding.
+func (c *Client) setAcceptEncoding(req *http.Request) bool {
+	if c.acceptEncodings == nil {
+		return false
+	}
+	if len(c.acceptEncodings) == 0 {
+		req.Header.Set("Accept-Encoding", "identity")
+		return true
+	}
+	names := make([]string, 0, len(c.acceptEncodings))
+	for _, e := range c.acceptEncodings {
+		names = append(names, string(e))
+	}
+	req.Header.Set("Accept-Encoding", strings.Join(names, ", "))
+	return true
+}
+
+// decodeContentEncoding returns a stream of the data in body decoded according
+// to the values of the Content-Encoding header. Codings are listed in the
+// order they were applied, so are removed in reverse order. Closing the
+// returned stream closes each decoder and body.
+func decodeContentEncoding(body io.ReadCloser, contentEncoding []string) (io.ReadCloser, error) {
+	var codings []string
+	for _, v := range contentEncoding {
+		for _, coding := range strings.Split(v, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "" && coding != "identity" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+	if len(codings) == 0 {
+		return body, nil
+	}
+	dr := &decodingReader{r: body, closers: []io.Closer{body}}
+	for i := len(codings) - 1; i >= 0; i-- {
+		if err := dr.decode(codings[i]); err != nil {
+			dr.Close()
+			return nil, err
+		}
+	}
+	return dr, nil
+}
+
+// decodingReader reads data through one or more decoders.
+type decodingReader struct {
+	r io.Reader
+	// closers holds the underlying body and any decoders which must be closed,
+	// innermost first.
+	closers []io.Closer
+}
+
+// decode adds a decoder for the given coding on top of the reader.
+func (dr *decodingReader) decode(coding string) error {
+	switch ContentEncoding(coding) {
+	case EncodingGzip, "x-gzip":
+		zr, err := gzip.NewReader(dr.r)
+		if err != nil {
+			return fmt.Errorf("failed to read gzip data: %w", err)
+		}
+		dr.r = zr
+		dr.closers = append(dr.closers, zr)
+	case EncodingDeflate:
+		br := bufio.NewReader(dr.r)
+		header, err := br.Peek(2)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read deflate data: %w", err)
+		}
+		var fr io.ReadCloser
+		if isZlibHeader(header) {
+			if fr, err = zlib.NewReader(br); err != nil {
+				return fmt.Errorf("failed to read deflate data: %w", err)
+			}
+		} else {
+			fr = flate.NewReader(br)
+		}
+		dr.r = fr
+		dr.closers = append(dr.closers, fr)
+	case EncodingBrotli:
+		dr.r = brotli.NewReader(dr.r)
+	default:
+		return fmt.Errorf("%w: %q", ErrorUnsupportedContentEncoding, coding)
+	}
+	return nil
+}
+
+// isZlibHeader returns true if header is a valid zlib stream header (RFC 1950)
+// using the deflate compression method.
+func isZlibHeader(header []byte) bool {
+	return len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+func (dr *decodingReader) Read(p []byte) (int, error) {
+	return dr.r.Read(p)
+}
+
+// Close closes every decoder, and then the underlying body.
+func (dr *decodingReader) Close() error {
+	var errs []error
+	for i := len(dr.closers) - 1; i >= 0; i-- {
+		if err := dr.closers[i].Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
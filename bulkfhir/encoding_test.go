@@ -0,0 +1,208 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+const encodingTestData = `{"resourceType":"Patient","id":"1"}
+{"resourceType":"Patient","id":"2"}
+`
+
+func compress(t *testing.T, coding string, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch coding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "rawdeflate":
+		fw, err := flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			t.Fatalf("flate.NewWriter() returned unexpected error: %v", err)
+		}
+		w = fw
+	case "br":
+		w = brotli.NewWriter(&buf)
+	default:
+		t.Fatalf("unknown coding %q", coding)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("failed to compress data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to compress data: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestClient_GetData_ContentEncoding(t *testing.T) {
+	cases := []struct {
+		name                 string
+		acceptEncodings      []ContentEncoding
+		wantAcceptEncoding   string
+		contentEncodings     []string
+		compressed           func(t *testing.T) []byte
+		wantErrUnsupportedCE bool
+	}{
+		{
+			name:               "Brotli",
+			acceptEncodings:    []ContentEncoding{EncodingBrotli, EncodingGzip},
+			wantAcceptEncoding: "br, gzip",
+			contentEncodings:   []string{"br"},
+			compressed:         func(t *testing.T) []byte { return compress(t, "br", []byte(encodingTestData)) },
+		},
+		{
+			name:               "Gzip",
+			acceptEncodings:    []ContentEncoding{EncodingBrotli, EncodingGzip},
+			wantAcceptEncoding: "br, gzip",
+			contentEncodings:   []string{"gzip"},
+			compressed:         func(t *testing.T) []byte { return compress(t, "gzip", []byte(encodingTestData)) },
+		},
+		{
+			name:               "Deflate",
+			acceptEncodings:    []ContentEncoding{EncodingDeflate},
+			wantAcceptEncoding: "deflate",
+			contentEncodings:   []string{"deflate"},
+			compressed:         func(t *testing.T) []byte { return compress(t, "deflate", []byte(encodingTestData)) },
+		},
+		{
+			name:               "RawDeflate",
+			acceptEncodings:    []ContentEncoding{EncodingDeflate},
+			wantAcceptEncoding: "deflate",
+			contentEncodings:   []string{"deflate"},
+			compressed:         func(t *testing.T) []byte { return compress(t, "rawdeflate", []byte(encodingTestData)) },
+		},
+		{
+			name:               "MultipleCodings",
+			acceptEncodings:    []ContentEncoding{EncodingBrotli, EncodingGzip},
+			wantAcceptEncoding: "br, gzip",
+			// gzip was applied first, then br.
+			contentEncodings: []string{"gzip, br"},
+			compressed: func(t *testing.T) []byte {
+				return compress(t, "br", compress(t, "gzip", []byte(encodingTestData)))
+			},
+		},
+		{
+			name:               "Identity",
+			acceptEncodings:    []ContentEncoding{},
+			wantAcceptEncoding: "identity",
+			compressed:         func(t *testing.T) []byte { return []byte(encodingTestData) },
+		},
+		{
+			name:               "DefaultGzip",
+			wantAcceptEncoding: "gzip",
+			contentEncodings:   []string{"gzip"},
+			compressed:         func(t *testing.T) []byte { return compress(t, "gzip", []byte(encodingTestData)) },
+		},
+		{
+			name:                 "UnsupportedCoding",
+			acceptEncodings:      []ContentEncoding{EncodingGzip},
+			wantAcceptEncoding:   "gzip",
+			contentEncodings:     []string{"zstd"},
+			compressed:           func(t *testing.T) []byte { return []byte(encodingTestData) },
+			wantErrUnsupportedCE: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := tc.compressed(t)
+			var gotAcceptEncoding string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				gotAcceptEncoding = req.Header.Get("Accept-Encoding")
+				for _, ce := range tc.contentEncodings {
+					w.Header().Add("Content-Encoding", ce)
+				}
+				w.Write(body)
+			}))
+			defer server.Close()
+
+			cl, err := NewClientWithOptions(server.URL, testAuthenticator{}, &ClientOptions{AcceptEncodings: tc.acceptEncodings})
+			if err != nil {
+				t.Fatalf("NewClientWithOptions() returned unexpected error: %v", err)
+			}
+
+			r, err := cl.GetData(context.Background(), server.URL + "/data")
+			if tc.wantErrUnsupportedCE {
+				if !errors.Is(err, ErrorUnsupportedContentEncoding) {
+					t.Fatalf("GetData() returned unexpected error. got: %v, want: %v", err, ErrorUnsupportedContentEncoding)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("GetData() returned unexpected error: %v", err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("failed to read data: %v", err)
+			}
+			if string(got) != encodingTestData {
+				t.Errorf("GetData() returned unexpected data. got: %q, want: %q", got, encodingTestData)
+			}
+			if gotAcceptEncoding != tc.wantAcceptEncoding {
+				t.Errorf("GetData() sent unexpected Accept-Encoding. got: %q, want: %q", gotAcceptEncoding, tc.wantAcceptEncoding)
+			}
+		})
+	}
+}
+
+type recordingCloser struct {
+	io.Reader
+	closed bool
+}
+
+func (rc *recordingCloser) Close() error {
+	rc.closed = true
+	return nil
+}
+
+func TestDecodeContentEncoding_ClosesBody(t *testing.T) {
+	body := &recordingCloser{Reader: bytes.NewReader(compress(t, "br", compress(t, "gzip", []byte(encodingTestData))))}
+	r, err := decodeContentEncoding(body, []string{"gzip", "br"})
+	if err != nil {
+		t.Fatalf("decodeContentEncoding() returned unexpected error: %v", err)
+	}
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatalf("failed to read data: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Errorf("Close() returned unexpected error: %v", err)
+	}
+	if !body.closed {
+		t.Error("Close() did not close the underlying body")
+	}
+}
+
+func TestNewClientWithOptions_UnsupportedAcceptEncoding(t *testing.T) {
+	_, err := NewClientWithOptions("https://example.com", testAuthenticator{}, &ClientOptions{AcceptEncodings: []ContentEncoding{"zstd"}})
+	if !errors.Is(err, ErrorUnsupportedContentEncoding) {
+		t.Errorf("NewClientWithOptions() with AcceptEncodings zstd returned unexpected error. got: %v, want: %v", err, ErrorUnsupportedContentEncoding)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// ETagStore persists the ETags of result files between runs, so that files
+// which have not changed since a previous run need not be downloaded and
+// processed again (see GetDataIfNoneMatch). Implementations must be safe for
+// concurrent use.
+type ETagStore interface {
+	// Load returns the ETag previously stored for the result file URL, or an
+	// empty string if there is none.
+	Load(ctx context.Context, url string) (string, error)
+	// Store saves the ETags of the given result file URLs, replacing any
+	// previously stored for the same URLs, so that they can be retrieved by
+	// Load the next time the program is run.
+	Store(ctx context.Context, etags map[string]string) error
+}
+
+type inMemoryETagStore struct {
+	mu    sync.Mutex
+	etags map[string]string
+}
+
+func (imes *inMemoryETagStore) Load(ctx context.Context, url string) (string, error) {
+	imes.mu.Lock()
+	defer imes.mu.Unlock()
+	return imes.etags[url], nil
+}
+
+func (imes *inMemoryETagStore) Store(ctx context.Context, etags map[string]string) error {
+	imes.mu.Lock()
+	defer imes.mu.Unlock()
+	for url, etag := range etags {
+		imes.etags[url] = etag
+	}
+	return nil
+}
+
+// NewInMemoryETagStore returns an implementation of ETagStore which does not
+// persist ETags anywhere, for use when a process runs several fetches.
+func NewInMemoryETagStore() ETagStore {
+	return &inMemoryETagStore{etags: map[string]string{}}
+}
+
+type localFileETagStore struct {
+	path string
+
+	mu sync.Mutex
+	// etags holds the contents of the file, once it has been read.
+	etags map[string]string
+}
+
+func (lfes *localFileETagStore) Load(ctx context.Context, url string) (string, error) {
+	lfes.mu.Lock()
+	defer lfes.mu.Unlock()
+	if err := lfes.read(); err != nil {
+		return "", err
+	}
+	return lfes.etags[url], nil
+}
+
+func (lfes *localFileETagStore) Store(ctx context.Context, etags map[string]string) error {
+	lfes.mu.Lock()
+	defer lfes.mu.Unlock()
+	if err := lfes.read(); err != nil {
+		return err
+	}
+	for url, etag := range etags {
+		lfes.etags[url] = etag
+	}
+	data, err := json.MarshalIndent(lfes.etags, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file which is renamed once complete, so that a
+	// failure part way through does not lose the ETags of earlier runs.
+	tmp, err := os.CreateTemp(filepath.Dir(lfes.path), filepath.Base(lfes.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create ETag file: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write ETags to %s: %w", lfes.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write ETags to %s: %w", lfes.path, err)
+	}
+	return os.Rename(tmp.Name(), lfes.path)
+}
+
+// read reads the file into etags, if it has not already been read. mu must be
+// held.
+func (lfes *localFileETagStore) read() error {
+	if lfes.etags != nil {
+		return nil
+	}
+	data, err := os.ReadFile(lfes.path)
+	if os.IsNotExist(err) {
+		// If the file has not been created, this is the first run.
+		lfes.etags = map[string]string{}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read ETag file %s: %w", lfes.path, err)
+	}
+	etags := map[string]string{}
+	if err := json.Unmarshal(data, &etags); err != nil {
+		return fmt.Errorf("failed to parse ETag file %s: %w", lfes.path, err)
+	}
+	lfes.etags = etags
+	return nil
+}
+
+// NewLocalFileETagStore returns an implementation of ETagStore which persists
+// ETags to a local JSON file at the given path, mapping each result file URL
+// to its ETag. The file is created by the first call to Store if it does not
+// exist.
+func NewLocalFileETagStore(path string) ETagStore {
+	return &localFileETagStore{path: path}
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalFileETagStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "etags.json")
+
+	store := NewLocalFileETagStore(path)
+	got, err := store.Load(ctx, "https://example.com/1")
+	if err != nil {
+		t.Fatalf("Load() on a missing file returned unexpected error: %v", err)
+	}
+	if got != "" {
+		t.Errorf("Load() on a missing file returned unexpected ETag %q", got)
+	}
+	if err := store.Store(ctx, map[string]string{"https://example.com/1": `"a"`, "https://example.com/2": `"b"`}); err != nil {
+		t.Fatalf("Store() returned unexpected error: %v", err)
+	}
+
+	// A later run updates one ETag, keeping the other.
+	store = NewLocalFileETagStore(path)
+	if err := store.Store(ctx, map[string]string{"https://example.com/2": `"c"`}); err != nil {
+		t.Fatalf("Store() returned unexpected error: %v", err)
+	}
+
+	store = NewLocalFileETagStore(path)
+	for url, want := range map[string]string{"https://example.com/1": `"a"`, "https://example.com/2": `"c"`, "https://example.com/3": ""} {
+		got, err := store.Load(ctx, url)
+		if err != nil {
+			t.Fatalf("Load(%q) returned unexpected error: %v", url, err)
+		}
+		if got != want {
+			t.Errorf("Load(%q) returned unexpected ETag. got: %q, want: %q", url, got, want)
+		}
+	}
+}
+
+func TestLocalFileETagStore_InvalidFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "etags.json")
+	if err := os.WriteFile(path, []byte("not json"), 0644); err != nil {
+		t.Fatalf("failed to write ETag file: %v", err)
+	}
+	if _, err := NewLocalFileETagStore(path).Load(context.Background(), "https://example.com/1"); err == nil {
+		t.Error("Load() with an invalid file succeeded, want error")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/gcs"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// errUnexpectedContentRange is returned if the server responds to a range
+// request with data which does not start at the requested offset.
+var errUnexpectedContentRange = errors.New("server responded with an unexpected Content-Range")
+
+// DownloadToGCS downloads the result file at url straight into a GCS object
+// named objectName, using a resumable upload (see gcs.ResumableUpload) so that
+// large files need not be held in memory or on disk. opts may be nil.
+//
+// If the download or upload fails part way through, it is retried up to
+// maxRetries times from the offset which GCS last committed: the rest of the
+// file is requested from the server with a Range header, so neither the data
+// already downloaded nor the data already uploaded is transferred again.
+// Servers which do not support range requests are handled by discarding the
+// start of the file. The client is re-authenticated before retrying if the
+// server responds with an unauthorized status.
+//
+// The data is stored exactly as the server sends it (gzip compressed files
+// are not decompressed). If the download fails, the upload is cancelled and no
+// object is created.
+func (c *Client) DownloadToGCS(ctx context.Context, url string, gcsClient gcs.Client, objectName string, maxRetries int, opts *gcs.ResumableUploadOptions) error {
+	upload, err := gcsClient.NewResumableUpload(ctx, objectName, opts)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	numRetries := 0
+	for {
+		err := c.copyDataFrom(ctx, url, offset, upload)
+		if err == nil {
+			err = upload.Close()
+		}
+		if err == nil {
+			return nil
+		}
+		if !isResumableDownloadError(ctx, err) || numRetries >= maxRetries {
+			if cancelErr := upload.Cancel(); cancelErr != nil {
+				log.Warningf("failed to cancel resumable upload of %s: %v", objectName, cancelErr)
+			}
+			return fmt.Errorf("failed to download %s to GCS: %w", url, err)
+		}
+		numRetries++
+		log.Infof("Download of %s to GCS failed, resuming: %v", url, err)
+		time.Sleep(dataRetryDelay)
+		if errors.Is(err, ErrorUnauthorized) {
+			if err := c.Authenticate(ctx); err != nil {
+				upload.Cancel()
+				return fmt.Errorf("failed to authenticate: %w", err)
+			}
+		}
+		offset, err = upload.Query()
+		if errors.Is(err, gcs.ErrUploadComplete) {
+			// The final chunk was committed, but the response was lost.
+			return nil
+		}
+		if err != nil {
+			upload.Cancel()
+			return fmt.Errorf("failed to resume upload of %s to GCS: %w", url, err)
+		}
+	}
+}
+
+// copyDataFrom writes the data at url, starting at offset, to w.
+func (c *Client) copyDataFrom(ctx context.Context, url string, offset int64, w io.Writer) error {
+	r, err := c.getDataFrom(ctx, url, offset)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// getDataFrom is like getData, but returns the data starting at offset. A
+// Range header is always sent, which also stops the transport from
+// transparently decompressing the data, so that offsets refer to the data as
+// sent by the server.
+func (c *Client) getDataFrom(ctx context.Context, url string, offset int64) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	resp, err := c.doHTTP(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if cr := resp.Header.Get("Content-Range"); !strings.HasPrefix(cr, fmt.Sprintf("bytes %d-", offset)) {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%w: requested offset %d, got %q", errUnexpectedContentRange, offset, cr)
+		}
+		return resp.Body, nil
+	case http.StatusOK:
+		// The server ignored the Range header and sent the whole file.
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	return nil, dataStatusError(resp)
+}
+
+// isResumableDownloadError returns true if a DownloadToGCS attempt which failed
+// with err should be resumed. Failures reading from the server or writing to
+// GCS are resumed, but not errors which retrying will not resolve.
+func isResumableDownloadError(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	return !errors.Is(err, ErrorUnexpectedStatusCode) &&
+		!errors.Is(err, ErrorDataURLExpired) &&
+		!errors.Is(err, errUnexpectedContentRange) &&
+		!errors.Is(err, ErrorClientClosed)
+}
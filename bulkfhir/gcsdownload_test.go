@@ -0,0 +1,141 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/gcs"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+)
+
+const testGCSChunkSize = 256 * 1024
+
+func TestClient_DownloadToGCS(t *testing.T) {
+	dataRetryDelay = 0
+	t.Cleanup(func() { dataRetryDelay = defaultDataRetryDelay })
+
+	data := make([]byte, 2*testGCSChunkSize+1000)
+	for i := range data {
+		data[i] = byte('a' + i%26)
+	}
+
+	cases := []struct {
+		name string
+		// supportsRange is whether the server responds to range requests with
+		// partial content.
+		supportsRange bool
+	}{
+		{name: "RangeSupported", supportsRange: true},
+		{name: "RangeNotSupported", supportsRange: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var ranges []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				ranges = append(ranges, req.Header.Get("Range"))
+				n := len(ranges)
+				mu.Unlock()
+
+				start := 0
+				if tc.supportsRange {
+					if _, err := fmt.Sscanf(req.Header.Get("Range"), "bytes=%d-", &start); err != nil {
+						t.Errorf("unexpected Range header %q", req.Header.Get("Range"))
+					}
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(data)-start))
+				if start > 0 {
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+					w.WriteHeader(http.StatusPartialContent)
+				}
+				if n == 1 {
+					// The first response is cut short part way through the
+					// second chunk.
+					w.Write(data[:testGCSChunkSize+1000])
+					w.(http.Flusher).Flush()
+					panic(http.ErrAbortHandler)
+				}
+				w.Write(data[start:])
+			}))
+			defer server.Close()
+			cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+
+			gcsServer := testhelpers.NewGCSServer(t)
+			ctx := context.Background()
+			gcsClient, err := gcs.NewClient(ctx, "bucket", gcsServer.URL())
+			if err != nil {
+				t.Fatalf("gcs.NewClient() returned unexpected error: %v", err)
+			}
+
+			err = cl.DownloadToGCS(ctx, server.URL+"/Patient", gcsClient, "Patient.ndjson", 1, &gcs.ResumableUploadOptions{ChunkSize: testGCSChunkSize})
+			if err != nil {
+				t.Fatalf("DownloadToGCS() returned unexpected error: %v", err)
+			}
+
+			obj, ok := gcsServer.GetObject("bucket", "Patient.ndjson")
+			if !ok {
+				t.Fatalf("object was not written to GCS")
+			}
+			if !bytes.Equal(obj.Data, data) {
+				t.Errorf("object has %d bytes which differ from the %d bytes served", len(obj.Data), len(data))
+			}
+			wantRanges := []string{"bytes=0-", fmt.Sprintf("bytes=%d-", testGCSChunkSize)}
+			if len(ranges) != len(wantRanges) || ranges[0] != wantRanges[0] || ranges[1] != wantRanges[1] {
+				t.Errorf("unexpected Range headers. got: %v, want: %v", ranges, wantRanges)
+			}
+		})
+	}
+}
+
+func TestClient_DownloadToGCS_Expired(t *testing.T) {
+	dataRetryDelay = 0
+	t.Cleanup(func() { dataRetryDelay = defaultDataRetryDelay })
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer server.Close()
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+
+	gcsServer := testhelpers.NewGCSServer(t)
+	ctx := context.Background()
+	gcsClient, err := gcs.NewClient(ctx, "bucket", gcsServer.URL())
+	if err != nil {
+		t.Fatalf("gcs.NewClient() returned unexpected error: %v", err)
+	}
+
+	err = cl.DownloadToGCS(ctx, server.URL+"/Patient", gcsClient, "Patient.ndjson", 3, nil)
+	if !errors.Is(err, ErrorDataURLExpired) {
+		t.Errorf("DownloadToGCS() returned unexpected error. got: %v, want: %v", err, ErrorDataURLExpired)
+	}
+	if requests != 1 {
+		t.Errorf("DownloadToGCS() made %d requests, want 1", requests)
+	}
+	if _, ok := gcsServer.GetObject("bucket", "Patient.ndjson"); ok {
+		t.Errorf("object was written to GCS for a failed download")
+	}
+}
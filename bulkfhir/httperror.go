@@ -0,0 +1,151 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxHTTPErrorBodySize is the maximum number of bytes of a response body held
+// in an HTTPError.
+const maxHTTPErrorBodySize = 4 * 1024
+
+// HTTPError is returned (possibly wrapped) when a server responds to a request
+// with an unexpected HTTP status code. It wraps one of the sentinel errors of
+// this package (such as ErrorUnauthorized or ErrorUnexpectedStatusCode), so
+// callers may either check for the sentinel with errors.Is, or use errors.As to
+// access the details of the response.
+type HTTPError struct {
+	// Op is the operation which failed, for example "job status".
+	Op string
+	// URL is the URL of the request, without its query string (which may hold
+	// credentials, for example in signed data URLs).
+	URL        string
+	StatusCode int
+	// Body holds up to the first 4KiB of the response body.
+	Body []byte
+	// Issues holds the issues of the OperationOutcome in the response body, if
+	// the body is an OperationOutcome (as FHIR servers usually return to explain
+	// a failure).
+	Issues []OperationOutcomeIssue
+	// RetryAfter is the delay requested by the response's Retry-After header,
+	// or zero if it had none.
+	RetryAfter time.Duration
+	// Err is the sentinel error describing the failure.
+	Err error
+}
+
+func (e *HTTPError) Error() string {
+	msg := fmt.Sprintf("%s %s: %v: %d", e.Op, e.URL, e.Err, e.StatusCode)
+	if len(e.Issues) > 0 {
+		msg += " with OperationOutcome:"
+		for _, i := range e.Issues {
+			msg += " " + i.String()
+		}
+	} else if len(e.Body) > 0 {
+		msg += fmt.Sprintf(" with body: %s", e.Body)
+	}
+	return msg
+}
+
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// newHTTPError creates an HTTPError for the given response, reading (up to
+// maxHTTPErrorBodySize of) its body and then closing it.
+func newHTTPError(op string, resp *http.Response, err error) *HTTPError {
+	e := &HTTPError{Op: op, StatusCode: resp.StatusCode, RetryAfter: getRetryAfter(resp), Err: err}
+	if resp.Request != nil && resp.Request.URL != nil {
+		u := *resp.Request.URL
+		u.RawQuery = ""
+		u.User = nil
+		e.URL = u.String()
+	}
+	if resp.Body != nil {
+		// The body is only informational, so errors reading it are ignored.
+		e.Body, _ = io.ReadAll(io.LimitReader(resp.Body, maxHTTPErrorBodySize))
+		e.Issues = parseOperationOutcomeIssues(e.Body)
+		resp.Body.Close()
+	}
+	return e
+}
+
+// issueCodeExpired is the OperationOutcome issue type code indicating that
+// something (such as a session or a URL) has expired.
+const issueCodeExpired = "expired"
+
+// OperationOutcomeIssue holds a single issue from an OperationOutcome returned
+// by the server.
+type OperationOutcomeIssue struct {
+	Severity    string
+	Code        string
+	Diagnostics string
+	// Details is the text of the issue's details CodeableConcept.
+	Details string
+}
+
+func (i OperationOutcomeIssue) String() string {
+	msg := fmt.Sprintf("[%s %s", i.Severity, i.Code)
+	for _, s := range []string{i.Details, i.Diagnostics} {
+		if s != "" {
+			msg += ": " + s
+		}
+	}
+	return msg + "]"
+}
+
+type operationOutcomeJSON struct {
+	ResourceType string `json:"resourceType"`
+	Issue        []struct {
+		Severity    string `json:"severity"`
+		Code        string `json:"code"`
+		Diagnostics string `json:"diagnostics"`
+		Details     struct {
+			Text string `json:"text"`
+		} `json:"details"`
+	} `json:"issue"`
+}
+
+// parseOperationOutcomeIssues returns the issues of the OperationOutcome in
+// body, or nil if body is not an OperationOutcome (including if it was
+// truncated).
+func parseOperationOutcomeIssues(body []byte) []OperationOutcomeIssue {
+	var oo operationOutcomeJSON
+	if err := json.Unmarshal(body, &oo); err != nil || oo.ResourceType != "OperationOutcome" {
+		return nil
+	}
+	var issues []OperationOutcomeIssue
+	for _, i := range oo.Issue {
+		issues = append(issues, OperationOutcomeIssue{Severity: i.Severity, Code: i.Code, Diagnostics: i.Diagnostics, Details: i.Details.Text})
+	}
+	return issues
+}
+
+// hasIssueCode returns whether the response held an OperationOutcome with an
+// issue of the given type code.
+func (e *HTTPError) hasIssueCode(code string) bool {
+	for _, i := range e.Issues {
+		if strings.EqualFold(i.Code, code) {
+			return true
+		}
+	}
+	return false
+}
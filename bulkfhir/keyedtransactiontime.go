@@ -0,0 +1,296 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/bulk_fhir_tools/fhir"
+	"github.com/google/bulk_fhir_tools/gcs"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// TransactionTimeKey identifies the data whose transaction time is tracked
+// separately by a KeyedTransactionTimeStore: the resources of a single type
+// exported for a group.
+type TransactionTimeKey struct {
+	// Group is the ID of the exported group, or empty for exports of all
+	// patients.
+	Group        string
+	ResourceType cpb.ResourceTypeCode_Value
+}
+
+// String returns the key in the form group/ResourceType, as used in the files
+// written by KeyedTransactionTimeStores.
+func (k TransactionTimeKey) String() string {
+	name, err := ResourceTypeCodeToName(k.ResourceType)
+	if err != nil {
+		name = k.ResourceType.String()
+	}
+	return k.Group + "/" + name
+}
+
+// parseTransactionTimeKey parses a key written by TransactionTimeKey.String.
+func parseTransactionTimeKey(s string) (TransactionTimeKey, error) {
+	group, name, ok := strings.Cut(s, "/")
+	if !ok {
+		return TransactionTimeKey{}, fmt.Errorf("invalid transaction time key %q: must be in the form group/ResourceType", s)
+	}
+	resourceType, err := ResourceTypeCodeFromName(name)
+	if err != nil {
+		return TransactionTimeKey{}, fmt.Errorf("invalid transaction time key %q: %w", s, err)
+	}
+	return TransactionTimeKey{Group: group, ResourceType: resourceType}, nil
+}
+
+// KeyedTransactionTimeStore manages the transaction times of Bulk FHIR fetches
+// separately for each group and resource type, so that resource types may be
+// synced independently, each with its own _since parameter (see
+// fetcher.PerTypeFetcher). Implementations must be safe for concurrent use.
+type KeyedTransactionTimeStore interface {
+	// Load the transaction time previously stored for the key. If none has
+	// been stored, this should return a zero time with no error.
+	Load(ctx context.Context, key TransactionTimeKey) (time.Time, error)
+	// Store saves the given transaction times, replacing any previously stored
+	// for the same keys, so that they can be retrieved by Load the next time the
+	// program is run.
+	Store(ctx context.Context, timestamps map[TransactionTimeKey]time.Time) error
+}
+
+// TransactionTimeStoreForKeys returns a TransactionTimeStore for a single
+// export covering all of the given keys, for example a _type-scoped export of
+// several resource types. Load returns the earliest of the keys' transaction
+// times (or a zero time if any has none), so that no data is missed for any of
+// them, and Store saves the transaction time for every key.
+func TransactionTimeStoreForKeys(store KeyedTransactionTimeStore, keys ...TransactionTimeKey) TransactionTimeStore {
+	return &keyedTransactionTimeStoreView{store: store, keys: keys}
+}
+
+type keyedTransactionTimeStoreView struct {
+	store KeyedTransactionTimeStore
+	keys  []TransactionTimeKey
+}
+
+func (v *keyedTransactionTimeStoreView) Load(ctx context.Context) (time.Time, error) {
+	var earliest time.Time
+	for i, key := range v.keys {
+		ts, err := v.store.Load(ctx, key)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if ts.IsZero() {
+			return time.Time{}, nil
+		}
+		if i == 0 || ts.Before(earliest) {
+			earliest = ts
+		}
+	}
+	return earliest, nil
+}
+
+func (v *keyedTransactionTimeStoreView) Store(ctx context.Context, ts time.Time) error {
+	timestamps := make(map[TransactionTimeKey]time.Time, len(v.keys))
+	for _, key := range v.keys {
+		timestamps[key] = ts
+	}
+	return v.store.Store(ctx, timestamps)
+}
+
+type inMemoryKeyedTransactionTimeStore struct {
+	mu         sync.Mutex
+	timestamps map[TransactionTimeKey]time.Time
+}
+
+func (imktts *inMemoryKeyedTransactionTimeStore) Load(ctx context.Context, key TransactionTimeKey) (time.Time, error) {
+	imktts.mu.Lock()
+	defer imktts.mu.Unlock()
+	return imktts.timestamps[key], nil
+}
+
+func (imktts *inMemoryKeyedTransactionTimeStore) Store(ctx context.Context, timestamps map[TransactionTimeKey]time.Time) error {
+	imktts.mu.Lock()
+	defer imktts.mu.Unlock()
+	for key, ts := range timestamps {
+		imktts.timestamps[key] = ts
+	}
+	return nil
+}
+
+// NewInMemoryKeyedTransactionTimeStore returns an implementation of
+// KeyedTransactionTimeStore which does not persist transaction times anywhere,
+// for use when a process runs several fetches.
+func NewInMemoryKeyedTransactionTimeStore() KeyedTransactionTimeStore {
+	return &inMemoryKeyedTransactionTimeStore{timestamps: map[TransactionTimeKey]time.Time{}}
+}
+
+// fileKeyedTransactionTimeStore persists transaction times to a JSON file,
+// mapping each key (see TransactionTimeKey.String) to a FHIR instant.
+type fileKeyedTransactionTimeStore struct {
+	// name is the file's path or URI, for error messages.
+	name string
+	// read returns the contents of the file, or nil if it does not exist.
+	read  func(ctx context.Context) ([]byte, error)
+	write func(ctx context.Context, data []byte) error
+
+	mu sync.Mutex
+}
+
+func (fktts *fileKeyedTransactionTimeStore) Load(ctx context.Context, key TransactionTimeKey) (time.Time, error) {
+	fktts.mu.Lock()
+	defer fktts.mu.Unlock()
+	timestamps, err := fktts.readTimestamps(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return timestamps[key], nil
+}
+
+func (fktts *fileKeyedTransactionTimeStore) Store(ctx context.Context, timestamps map[TransactionTimeKey]time.Time) error {
+	fktts.mu.Lock()
+	defer fktts.mu.Unlock()
+	stored, err := fktts.readTimestamps(ctx)
+	if err != nil {
+		return err
+	}
+	for key, ts := range timestamps {
+		stored[key] = ts
+	}
+	instants := make(map[string]string, len(stored))
+	for key, ts := range stored {
+		instants[key.String()] = fhir.ToFHIRInstant(ts)
+	}
+	data, err := json.MarshalIndent(instants, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := fktts.write(ctx, data); err != nil {
+		return fmt.Errorf("failed to write transaction times to %s: %w", fktts.name, err)
+	}
+	return nil
+}
+
+// readTimestamps reads and parses the file. mu must be held.
+func (fktts *fileKeyedTransactionTimeStore) readTimestamps(ctx context.Context) (map[TransactionTimeKey]time.Time, error) {
+	timestamps := map[TransactionTimeKey]time.Time{}
+	data, err := fktts.read(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read transaction time file %s: %w", fktts.name, err)
+	}
+	if data == nil {
+		// If the file has not been created, this is the first run.
+		return timestamps, nil
+	}
+	instants := map[string]string{}
+	if err := json.Unmarshal(data, &instants); err != nil {
+		return nil, fmt.Errorf("failed to parse transaction time file %s: %w", fktts.name, err)
+	}
+	for k, instant := range instants {
+		key, err := parseTransactionTimeKey(k)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse transaction time file %s: %w", fktts.name, err)
+		}
+		ts, err := fhir.ParseFHIRInstant(instant)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse transaction time file %s: invalid timestamp for %s: %w", fktts.name, k, err)
+		}
+		timestamps[key] = ts
+	}
+	return timestamps, nil
+}
+
+// NewLocalFileKeyedTransactionTimeStore returns an implementation of
+// KeyedTransactionTimeStore which persists transaction times to a local JSON
+// file at the given path, mapping each group/ResourceType key to a FHIR
+// instant. The file is created by the first call to Store if it does not
+// exist.
+func NewLocalFileKeyedTransactionTimeStore(path string) KeyedTransactionTimeStore {
+	return &fileKeyedTransactionTimeStore{
+		name: path,
+		read: func(ctx context.Context) ([]byte, error) {
+			data, err := os.ReadFile(path)
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return data, err
+		},
+		write: func(ctx context.Context, data []byte) error {
+			// Write to a temporary file which is renamed once complete, so that a
+			// failure part way through does not lose the transaction times of
+			// earlier runs.
+			tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+			if err != nil {
+				return err
+			}
+			if _, err := tmp.Write(data); err != nil {
+				tmp.Close()
+				os.Remove(tmp.Name())
+				return err
+			}
+			if err := tmp.Close(); err != nil {
+				os.Remove(tmp.Name())
+				return err
+			}
+			return os.Rename(tmp.Name(), path)
+		},
+	}
+}
+
+// NewGCSKeyedTransactionTimeStore returns an implementation of
+// KeyedTransactionTimeStore which persists transaction times to a JSON file in
+// GCS at the given URI, in the same format as
+// NewLocalFileKeyedTransactionTimeStore.
+func NewGCSKeyedTransactionTimeStore(ctx context.Context, gcsEndpoint, uri string) (KeyedTransactionTimeStore, error) {
+	bucket, relativePath, err := gcs.PathComponents(uri)
+	if err != nil {
+		return nil, err
+	}
+	client, err := gcs.NewClient(ctx, bucket, gcsEndpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get GCS client: %w", err)
+	}
+	return &fileKeyedTransactionTimeStore{
+		name: uri,
+		read: func(ctx context.Context) ([]byte, error) {
+			reader, err := client.GetFileReader(ctx, relativePath)
+			if errors.Is(err, storage.ErrObjectNotExist) {
+				return nil, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			defer reader.Close()
+			return io.ReadAll(reader)
+		},
+		write: func(ctx context.Context, data []byte) error {
+			writer := client.GetFileWriter(ctx, relativePath)
+			if _, err := writer.Write(data); err != nil {
+				writer.Close()
+				return err
+			}
+			return writer.Close()
+		},
+	}, nil
+}
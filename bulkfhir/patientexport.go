@@ -0,0 +1,170 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/fhir"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// DefaultMaxPatientsPerJob is the default maximum number of patient references
+// sent in a single export kick-off request by StartBulkDataExportForPatients.
+const DefaultMaxPatientsPerJob = 1000
+
+// ErrorNoPatients is returned by StartBulkDataExportForPatients if no patient
+// IDs are provided.
+var ErrorNoPatients = errors.New("no patient IDs provided")
+
+// PatientExportOptions contains optional parameters used by
+// StartBulkDataExportForPatients.
+type PatientExportOptions struct {
+	// The maximum number of patient references sent in a single kick-off
+	// request. If more patient IDs are provided, they are split between several
+	// export jobs. Defaults to DefaultMaxPatientsPerJob.
+	MaxPatientsPerJob int
+}
+
+type parameterJSON struct {
+	Name           string         `json:"name"`
+	ValueString    string         `json:"valueString,omitempty"`
+	ValueInstant   string         `json:"valueInstant,omitempty"`
+	ValueReference *referenceJSON `json:"valueReference,omitempty"`
+}
+
+type referenceJSON struct {
+	Reference string `json:"reference"`
+}
+
+type parametersJSON struct {
+	ResourceType string          `json:"resourceType"`
+	Parameter    []parameterJSON `json:"parameter"`
+}
+
+// StartBulkDataExportForPatients starts export jobs for the given patients, by
+// POSTing a Parameters resource holding a patient reference for each of them
+// to the export endpoint of groupID (or to the Patient export endpoint if
+// groupID is empty). types and since are handled as for StartBulkDataExport.
+//
+// As some servers limit the number of patient references per request, if
+// there are more than opts.MaxPatientsPerJob patient IDs they are split into
+// several jobs, and the job status URLs for all of them are returned. The
+// results of the jobs can be combined with MergeJobStatuses once complete. If
+// starting one of the jobs fails, the URLs of the jobs which were already
+// started are returned along with the error.
+func (c *Client) StartBulkDataExportForPatients(ctx context.Context, types []cpb.ResourceTypeCode_Value, since time.Time, groupID string, patientIDs []string, opts *PatientExportOptions) (jobStatusURLs []string, err error) {
+	if opts == nil {
+		opts = &PatientExportOptions{}
+	}
+	maxPatients := opts.MaxPatientsPerJob
+	if maxPatients <= 0 {
+		maxPatients = DefaultMaxPatientsPerJob
+	}
+	if len(patientIDs) == 0 {
+		return nil, ErrorNoPatients
+	}
+
+	endpoint := c.baseURL + c.serverProfile().ExportAllPatientsPath
+	if groupID != "" {
+		endpoint = c.baseURL + fmt.Sprintf(c.serverProfile().GroupExportPathFmt, groupID)
+	}
+
+	var params []parameterJSON
+	since = c.applySinceFloor(since)
+	if !since.IsZero() {
+		if err := checkSince(since); err != nil {
+			return nil, err
+		}
+		params = append(params, parameterJSON{Name: "_since", ValueInstant: fhir.ToFHIRInstant(since)})
+	}
+	if len(types) > 0 {
+		v, err := c.resourceTypesToQueryValue(types)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, parameterJSON{Name: "_type", ValueString: v})
+	}
+
+	for start := 0; start < len(patientIDs); start += maxPatients {
+		end := start + maxPatients
+		if end > len(patientIDs) {
+			end = len(patientIDs)
+		}
+		jobStatusURL, err := c.startPatientExportJob(ctx, endpoint, params, patientIDs[start:end])
+		if err != nil {
+			return jobStatusURLs, fmt.Errorf("failed to start export job for patients %d to %d: %w", start, end-1, err)
+		}
+		jobStatusURLs = append(jobStatusURLs, jobStatusURL)
+	}
+	return jobStatusURLs, nil
+}
+
+func (c *Client) startPatientExportJob(ctx context.Context, endpoint string, params []parameterJSON, patientIDs []string) (jobStatusURL string, err error) {
+	body := parametersJSON{ResourceType: "Parameters", Parameter: append([]parameterJSON{}, params...)}
+	for _, id := range patientIDs {
+		body.Parameter = append(body.Parameter, parameterJSON{Name: "patient", ValueReference: &referenceJSON{Reference: "Patient/" + id}})
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Add(contentTypeHeader, contentTypeFHIRJSON)
+	return c.kickOff(req)
+}
+
+// MergeJobStatuses combines the statuses of several complete export jobs (for
+// example those started by StartBulkDataExportForPatients) into one, holding
+// the result files of all of them. The TransactionTime of the merged status is
+// the earliest of the jobs' transaction times, so that it is safe to use as
+// the _since time of a later incremental export.
+func MergeJobStatuses(statuses ...JobStatus) JobStatus {
+	merged := JobStatus{
+		IsComplete:      true,
+		PercentComplete: 100,
+		ResultURLs:      map[cpb.ResourceTypeCode_Value][]string{},
+		OutputFiles:     map[cpb.ResourceTypeCode_Value][]OutputFile{},
+	}
+	for i, s := range statuses {
+		merged.IsComplete = merged.IsComplete && s.IsComplete
+		if s.PercentComplete < merged.PercentComplete {
+			merged.PercentComplete = s.PercentComplete
+		}
+		if s.RetryAfter > merged.RetryAfter {
+			merged.RetryAfter = s.RetryAfter
+		}
+		if i == 0 || s.TransactionTime.Before(merged.TransactionTime) {
+			merged.TransactionTime = s.TransactionTime
+		}
+		for rt, urls := range s.ResultURLs {
+			merged.ResultURLs[rt] = append(merged.ResultURLs[rt], urls...)
+		}
+		for rt, files := range s.OutputFiles {
+			merged.OutputFiles[rt] = append(merged.OutputFiles[rt], files...)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,165 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestClient_StartBulkDataExportForPatients(t *testing.T) {
+	since := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	types := []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_OBSERVATION}
+	patients := []string{"1", "2", "3", "4", "5"}
+
+	var mu sync.Mutex
+	var gotBodies []parametersJSON
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.URL.Path != "/Group/mygroup/$export" {
+			t.Errorf("unexpected request: %s %s", req.Method, req.URL.Path)
+		}
+		if got := req.Header.Get(contentTypeHeader); got != contentTypeFHIRJSON {
+			t.Errorf("unexpected Content-Type header. got: %s, want: %s", got, contentTypeFHIRJSON)
+		}
+		if got := req.Header.Get(preferHeader); got != preferHeaderAsync {
+			t.Errorf("unexpected Prefer header. got: %s, want: %s", got, preferHeaderAsync)
+		}
+		var body parametersJSON
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode request body: %v", err)
+		}
+		mu.Lock()
+		gotBodies = append(gotBodies, body)
+		n := len(gotBodies)
+		mu.Unlock()
+		w.Header().Set(contentLocation, fmt.Sprintf("https://example.com/jobs/%d", n))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+
+	got, err := cl.StartBulkDataExportForPatients(context.Background(), types, since, "mygroup", patients, &PatientExportOptions{MaxPatientsPerJob: 2})
+	if err != nil {
+		t.Fatalf("StartBulkDataExportForPatients() returned unexpected error: %v", err)
+	}
+
+	wantURLs := []string{"https://example.com/jobs/1", "https://example.com/jobs/2", "https://example.com/jobs/3"}
+	if diff := cmp.Diff(wantURLs, got); diff != "" {
+		t.Errorf("StartBulkDataExportForPatients() returned unexpected job URLs (-want +got):\n%s", diff)
+	}
+	commonParams := []parameterJSON{
+		{Name: "_since", ValueInstant: "2024-01-02T03:04:05.000+00:00"},
+		{Name: "_type", ValueString: "Patient,Observation"},
+	}
+	var wantBodies []parametersJSON
+	for _, chunk := range [][]string{{"1", "2"}, {"3", "4"}, {"5"}} {
+		b := parametersJSON{ResourceType: "Parameters", Parameter: append([]parameterJSON{}, commonParams...)}
+		for _, id := range chunk {
+			b.Parameter = append(b.Parameter, parameterJSON{Name: "patient", ValueReference: &referenceJSON{Reference: "Patient/" + id}})
+		}
+		wantBodies = append(wantBodies, b)
+	}
+	if diff := cmp.Diff(wantBodies, gotBodies); diff != "" {
+		t.Errorf("unexpected kick-off request bodies (-want +got):\n%s", diff)
+	}
+}
+
+func TestClient_StartBulkDataExportForPatients_Errors(t *testing.T) {
+	t.Run("NoPatients", func(t *testing.T) {
+		cl := Client{authenticator: testAuthenticator{}, baseURL: "https://example.com", httpClient: &http.Client{}}
+		if _, err := cl.StartBulkDataExportForPatients(context.Background(), nil, time.Time{}, "", nil, nil); !errors.Is(err, ErrorNoPatients) {
+			t.Errorf("StartBulkDataExportForPatients() returned unexpected error. got: %v, want: %v", err, ErrorNoPatients)
+		}
+	})
+	t.Run("LaterJobFails", func(t *testing.T) {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if req.URL.Path != "/Patient/$export" {
+				t.Errorf("unexpected request path: %s", req.URL.Path)
+			}
+			requests++
+			if requests > 1 {
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Header().Set(contentLocation, "https://example.com/jobs/1")
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer server.Close()
+		cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+
+		got, err := cl.StartBulkDataExportForPatients(context.Background(), nil, time.Time{}, "", []string{"1", "2"}, &PatientExportOptions{MaxPatientsPerJob: 1})
+		if !errors.Is(err, ErrorUnexpectedStatusCode) {
+			t.Errorf("StartBulkDataExportForPatients() returned unexpected error. got: %v, want: %v", err, ErrorUnexpectedStatusCode)
+		}
+		if diff := cmp.Diff([]string{"https://example.com/jobs/1"}, got); diff != "" {
+			t.Errorf("StartBulkDataExportForPatients() returned unexpected job URLs (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestMergeJobStatuses(t *testing.T) {
+	early := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	late := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	statuses := []JobStatus{
+		{
+			IsComplete:      true,
+			PercentComplete: 100,
+			ResultURLs:      map[cpb.ResourceTypeCode_Value][]string{cpb.ResourceTypeCode_PATIENT: {"p1"}},
+			OutputFiles:     map[cpb.ResourceTypeCode_Value][]OutputFile{cpb.ResourceTypeCode_PATIENT: {{URL: "p1", Count: 1}}},
+			TransactionTime: late,
+		},
+		{
+			IsComplete:      true,
+			PercentComplete: 100,
+			ResultURLs: map[cpb.ResourceTypeCode_Value][]string{
+				cpb.ResourceTypeCode_PATIENT:     {"p2"},
+				cpb.ResourceTypeCode_OBSERVATION: {"o1"},
+			},
+			OutputFiles: map[cpb.ResourceTypeCode_Value][]OutputFile{
+				cpb.ResourceTypeCode_PATIENT:     {{URL: "p2", Count: -1}},
+				cpb.ResourceTypeCode_OBSERVATION: {{URL: "o1", Count: 3}},
+			},
+			TransactionTime: early,
+		},
+	}
+	want := JobStatus{
+		IsComplete:      true,
+		PercentComplete: 100,
+		ResultURLs: map[cpb.ResourceTypeCode_Value][]string{
+			cpb.ResourceTypeCode_PATIENT:     {"p1", "p2"},
+			cpb.ResourceTypeCode_OBSERVATION: {"o1"},
+		},
+		OutputFiles: map[cpb.ResourceTypeCode_Value][]OutputFile{
+			cpb.ResourceTypeCode_PATIENT:     {{URL: "p1", Count: 1}, {URL: "p2", Count: -1}},
+			cpb.ResourceTypeCode_OBSERVATION: {{URL: "o1", Count: 3}},
+		},
+		TransactionTime: early,
+	}
+	if diff := cmp.Diff(want, MergeJobStatuses(statuses...)); diff != "" {
+		t.Errorf("MergeJobStatuses() returned unexpected JobStatus (-want +got):\n%s", diff)
+	}
+}
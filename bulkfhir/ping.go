@@ -0,0 +1,74 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+)
+
+// PingResult holds timing information from a successful Ping.
+type PingResult struct {
+	// AuthLatency is the time taken to authenticate, which is close to zero if
+	// an existing token was reused.
+	AuthLatency time.Duration
+	// RequestLatency is the time taken by the authenticated request, including
+	// reading the response.
+	RequestLatency time.Duration
+}
+
+// Ping is a lightweight health check of the FHIR server. It authenticates if
+// necessary (reusing any valid token), and then makes an authenticated request
+// for a summary of the server's CapabilityStatement, returning an error
+// wrapping ErrorUnauthorized if the server rejects the client's credentials,
+// or another error if the server is unreachable or returns any other non-200
+// status. Unlike CheckCapabilities, the response is not inspected, so a server
+// which does not declare bulk data export support is not an error.
+func (c *Client) Ping(ctx context.Context) (PingResult, error) {
+	var result PingResult
+	start := time.Now()
+	if err := c.AuthenticateIfNecessary(ctx); err != nil {
+		return result, err
+	}
+	result.AuthLatency = time.Since(start)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+c.serverProfile().MetadataPath+"?_summary=true", nil)
+	if err != nil {
+		return result, err
+	}
+	req.Header.Add(acceptHeader, acceptHeaderFHIRJSON)
+
+	start = time.Now()
+	resp, err := c.doHTTP(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized:
+		return result, newHTTPError("ping", resp, ErrorUnauthorized)
+	default:
+		return result, newHTTPError("ping", resp, ErrorUnexpectedStatusCode)
+	}
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return result, err
+	}
+	result.RequestLatency = time.Since(start)
+	return result, nil
+}
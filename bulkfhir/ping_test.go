@@ -0,0 +1,69 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestClient_Ping(t *testing.T) {
+	cases := []struct {
+		name    string
+		status  int
+		wantErr error
+	}{
+		{name: "OK", status: http.StatusOK},
+		{name: "Unauthorized", status: http.StatusUnauthorized, wantErr: ErrorUnauthorized},
+		{name: "ServerError", status: http.StatusServiceUnavailable, wantErr: ErrorUnexpectedStatusCode},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if req.URL.Path != "/metadata" || req.URL.Query().Get("_summary") != "true" {
+					t.Errorf("Ping() made a request to unexpected URL %s", req.URL)
+				}
+				time.Sleep(10 * time.Millisecond)
+				w.WriteHeader(tc.status)
+				w.Write([]byte(`{"resourceType": "CapabilityStatement"}`))
+			}))
+			defer server.Close()
+
+			cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+			got, err := cl.Ping(context.Background())
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Ping() returned unexpected error. got: %v, want: %v", err, tc.wantErr)
+			}
+			if tc.wantErr == nil && got.RequestLatency < 10*time.Millisecond {
+				t.Errorf("Ping() returned RequestLatency %s, want at least 10ms", got.RequestLatency)
+			}
+		})
+	}
+}
+
+func TestClient_Ping_Unreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	serverURL := server.URL
+	server.Close()
+
+	cl := Client{authenticator: testAuthenticator{}, baseURL: serverURL, httpClient: &http.Client{}}
+	if _, err := cl.Ping(context.Background()); err == nil {
+		t.Error("Ping() of an unreachable server succeeded, want error")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// ResourceTypesInStatus returns the distinct resource types which have at
+// least one result URL in the given JobStatus, sorted by enum value.
+func ResourceTypesInStatus(s JobStatus) []cpb.ResourceTypeCode_Value {
+	var types []cpb.ResourceTypeCode_Value
+	for resourceType, urls := range s.ResultURLs {
+		if len(urls) > 0 {
+			types = append(types, resourceType)
+		}
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	return types
+}
+
+// ProbeResourceTypes starts an export of all resource types since the provided
+// timestamp for the given group (or for all patients if groupID is empty),
+// waits for it to complete, and returns the resource types present in its
+// output, as for ResourceTypesInStatus. A recent since keeps the export small,
+// but a server only reports the types of resources which were exported, so
+// types without recent changes will be missing. The job status is checked
+// every checkPeriod until timeout (ErrorTimeout), or until ctx is done. None
+// of the exported data is downloaded.
+func (c *Client) ProbeResourceTypes(ctx context.Context, since time.Time, groupID string, checkPeriod, timeout time.Duration) ([]cpb.ResourceTypeCode_Value, error) {
+	var jobStatusURL string
+	var err error
+	if groupID == "" {
+		jobStatusURL, err = c.StartBulkDataExportAll(ctx, nil, since)
+	} else {
+		jobStatusURL, err = c.StartBulkDataExport(ctx, nil, since, groupID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	results := c.MonitorJobStatus(ctx, jobStatusURL, checkPeriod, timeout)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case r, ok := <-results:
+			if !ok {
+				return nil, ErrorTimeout
+			}
+			if r.Error != nil {
+				return nil, r.Error
+			}
+			if r.Status.IsComplete {
+				return ResourceTypesInStatus(r.Status), nil
+			}
+		}
+	}
+}
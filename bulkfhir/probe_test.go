@@ -0,0 +1,112 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestResourceTypesInStatus(t *testing.T) {
+	s := JobStatus{
+		IsComplete: true,
+		ResultURLs: map[cpb.ResourceTypeCode_Value][]string{
+			cpb.ResourceTypeCode_OBSERVATION: {"url1", "url2"},
+			cpb.ResourceTypeCode_PATIENT:     {"url3"},
+			cpb.ResourceTypeCode_ENCOUNTER:   {},
+		},
+	}
+	want := []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_OBSERVATION, cpb.ResourceTypeCode_PATIENT}
+	if diff := cmp.Diff(want, ResourceTypesInStatus(s)); diff != "" {
+		t.Errorf("ResourceTypesInStatus() unexpected diff (-want +got):\n%s", diff)
+	}
+	if got := ResourceTypesInStatus(JobStatus{}); len(got) != 0 {
+		t.Errorf("ResourceTypesInStatus() of an incomplete job returned %v, want none", got)
+	}
+}
+
+func TestClient_ProbeResourceTypes(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		groupID  string
+		wantPath string
+	}{
+		{name: "AllPatients", wantPath: "/Patient/$export"},
+		{name: "Group", groupID: "mygroup", wantPath: "/Group/mygroup/$export"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			statusChecks := 0
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				switch req.URL.Path {
+				case tc.wantPath:
+					if got := req.URL.Query().Get("_type"); got != "" {
+						t.Errorf("ProbeResourceTypes() sent unexpected _type %q, want none", got)
+					}
+					w.Header().Set("Content-Location", server.URL+"/status")
+					w.WriteHeader(http.StatusAccepted)
+				case "/status":
+					statusChecks++
+					if statusChecks == 1 {
+						w.WriteHeader(http.StatusAccepted)
+						return
+					}
+					w.Write([]byte(`{"output": [{"type": "Patient", "url": "url1"}, {"type": "Observation", "url": "url2"}, {"type": "Patient", "url": "url3"}], "transactionTime": "2020-09-17T17:53:11.476Z"}`))
+				default:
+					t.Errorf("ProbeResourceTypes() made a request to unexpected path %q", req.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+			got, err := cl.ProbeResourceTypes(context.Background(), time.Time{}, tc.groupID, time.Millisecond, time.Minute)
+			if err != nil {
+				t.Fatalf("ProbeResourceTypes() returned unexpected error: %v", err)
+			}
+			want := []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_OBSERVATION, cpb.ResourceTypeCode_PATIENT}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("ProbeResourceTypes() unexpected diff (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestClient_ProbeResourceTypes_ContextCanceled(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/Patient/$export" {
+			w.Header().Set("Content-Location", server.URL+"/status")
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	cl := Client{authenticator: testAuthenticator{}, baseURL: server.URL, httpClient: &http.Client{}}
+	defer cl.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := cl.ProbeResourceTypes(ctx, time.Time{}, "", time.Millisecond, time.Minute); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ProbeResourceTypes() returned unexpected error. got: %v, want: %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import "time"
+
+// progressEstimator estimates the time remaining for an export job from the
+// progress percentages reported while monitoring it.
+//
+// The estimate is based on the average rate of progress between the first
+// observation (the baseline) and the most recent observation at which the
+// percentage increased. Time spent since that increase without further progress
+// is subtracted from the estimate. No estimate is made if:
+//   - progress is not reported, or has not yet increased from the baseline;
+//   - progress goes backwards (in which case the baseline is reset);
+//   - progress has been stuck for longer than the time previously estimated.
+type progressEstimator struct {
+	baselineTime    time.Time
+	baselinePercent int
+	lastTime        time.Time
+	lastPercent     int
+	started         bool
+}
+
+// observe records the percent complete reported at time now, and returns the
+// estimated time remaining, or zero if no estimate can be made.
+func (pe *progressEstimator) observe(now time.Time, percent int) time.Duration {
+	if percent < 0 || percent > 100 {
+		return 0
+	}
+	if !pe.started || percent < pe.lastPercent {
+		pe.baselineTime, pe.baselinePercent = now, percent
+		pe.lastTime, pe.lastPercent = now, percent
+		pe.started = true
+		return 0
+	}
+	if percent > pe.lastPercent {
+		pe.lastTime, pe.lastPercent = now, percent
+	}
+	if pe.lastPercent == pe.baselinePercent {
+		return 0
+	}
+
+	progressed := float64(pe.lastPercent - pe.baselinePercent)
+	perPercent := float64(pe.lastTime.Sub(pe.baselineTime)) / progressed
+	remaining := time.Duration(perPercent*float64(100-pe.lastPercent)) - now.Sub(pe.lastTime)
+	if remaining <= 0 {
+		return 0
+	}
+	return remaining
+}
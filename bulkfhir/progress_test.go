@@ -0,0 +1,92 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgressEstimator(t *testing.T) {
+	type observation struct {
+		elapsed       time.Duration
+		percent       int
+		wantRemaining time.Duration
+	}
+	cases := []struct {
+		name         string
+		observations []observation
+	}{
+		{
+			name: "SteadyProgress",
+			observations: []observation{
+				{0, 0, 0},
+				{time.Minute, 10, 9 * time.Minute},
+				{2 * time.Minute, 20, 8 * time.Minute},
+			},
+		},
+		{
+			name: "StartsPartWayThrough",
+			observations: []observation{
+				{0, 50, 0},
+				{time.Minute, 60, 4 * time.Minute},
+			},
+		},
+		{
+			name: "NoProgressReported",
+			observations: []observation{
+				{0, -1, 0},
+				{time.Minute, -1, 0},
+			},
+		},
+		{
+			name: "NoProgressYet",
+			observations: []observation{
+				{0, 10, 0},
+				{time.Minute, 10, 0},
+			},
+		},
+		{
+			name: "StuckProgressCountsDown",
+			observations: []observation{
+				{0, 0, 0},
+				{time.Minute, 50, time.Minute},
+				{90 * time.Second, 50, 30 * time.Second},
+				// Stuck for longer than the estimate.
+				{3 * time.Minute, 50, 0},
+			},
+		},
+		{
+			name: "ProgressGoesBackwards",
+			observations: []observation{
+				{0, 0, 0},
+				{time.Minute, 50, time.Minute},
+				{2 * time.Minute, 20, 0},
+				{3 * time.Minute, 40, 3 * time.Minute},
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			start := time.Now()
+			var pe progressEstimator
+			for _, o := range tc.observations {
+				if got := pe.observe(start.Add(o.elapsed), o.percent); got != o.wantRemaining {
+					t.Errorf("observe(%v, %d) = %v, want %v", o.elapsed, o.percent, got, o.wantRemaining)
+				}
+			}
+		})
+	}
+}
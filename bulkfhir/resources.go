@@ -15,6 +15,8 @@
 package bulkfhir
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"sync"
 
@@ -78,3 +80,18 @@ func ResourceTypeCodeFromName(name string) (cpb.ResourceTypeCode_Value, error) {
 	}
 	return cpb.ResourceTypeCode_INVALID_UNINITIALIZED, fmt.Errorf("could not find a ResourceTypeCode with FHIR resource name %q", name)
 }
+
+// ResourceTypeCodeFromJSON returns the ResourceTypeCode of the given FHIR
+// resource JSON, based on its resourceType field.
+func ResourceTypeCodeFromJSON(resourceJSON []byte) (cpb.ResourceTypeCode_Value, error) {
+	var r struct {
+		ResourceType string `json:"resourceType"`
+	}
+	if err := json.Unmarshal(resourceJSON, &r); err != nil {
+		return cpb.ResourceTypeCode_INVALID_UNINITIALIZED, fmt.Errorf("failed to parse resource JSON: %w", err)
+	}
+	if r.ResourceType == "" {
+		return cpb.ResourceTypeCode_INVALID_UNINITIALIZED, errors.New("resource JSON has no resourceType")
+	}
+	return ResourceTypeCodeFromName(r.ResourceType)
+}
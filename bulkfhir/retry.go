@@ -0,0 +1,124 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+const (
+	defaultRetryBaseDelay = time.Second
+	defaultRetryMaxDelay  = time.Minute
+)
+
+// RetryPolicy configures how a Client retries requests which fail with a
+// transient HTTP status (see ClientOptions): GetData retries 429 Too Many
+// Requests, 503 Service Unavailable, and 404 Not Found (which BCDA returns for
+// result files which are not yet available), and JobStatus retries 429 and
+// 503. Other errors are returned immediately. GetDataWithRetries (and so
+// DownloadToDir) and MonitorJobStatus have retry loops of their own, and make
+// single attempts rather than applying the RetryPolicy.
+type RetryPolicy struct {
+	// The maximum number of attempts at each request, including the first. If
+	// less than 2, requests are not retried.
+	MaxAttempts int
+	// The time waited before the first retry, which is doubled for each
+	// subsequent retry. Defaults to 1 second.
+	BaseDelay time.Duration
+	// The maximum time waited before a retry. Defaults to 1 minute. This also
+	// caps the delay requested by a Retry-After header.
+	MaxDelay time.Duration
+}
+
+// delay returns the time to wait before the given retry (starting from 1).
+// If the server sent a Retry-After header, its delay is used instead of the
+// exponential backoff.
+func (p *RetryPolicy) delay(retry int, retryAfter time.Duration) time.Duration {
+	maxDelay := p.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultRetryMaxDelay
+	}
+	if retryAfter > 0 {
+		return min(retryAfter, maxDelay)
+	}
+	wait := p.BaseDelay
+	if wait <= 0 {
+		wait = defaultRetryBaseDelay
+	}
+	for i := 1; i < retry && wait < maxDelay; i++ {
+		wait *= 2
+	}
+	return min(wait, maxDelay)
+}
+
+// retryableDataError returns whether a GetData error may be retried under a
+// RetryPolicy.
+func retryableDataError(err error) bool {
+	return errors.Is(err, ErrorRetryableHTTPStatus) || retryableJobStatusError(err)
+}
+
+// retryableJobStatusError returns whether a JobStatus error may be retried
+// under a RetryPolicy.
+func retryableJobStatusError(err error) bool {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return false
+	}
+	return httpErr.StatusCode == http.StatusTooManyRequests || httpErr.StatusCode == http.StatusServiceUnavailable
+}
+
+// withRetries calls f until it succeeds, returns an error which is not
+// retryable, or the attempts allowed by the Client's RetryPolicy have been
+// made. Waits between attempts end early if ctx is cancelled or the Client is
+// closed. If more than one attempt was made, the last error is returned
+// wrapped with the number of attempts.
+func (c *Client) withRetries(ctx context.Context, op string, retryable func(error) bool, f func() error) error {
+	policy := c.retryPolicy
+	if policy == nil || policy.MaxAttempts < 2 {
+		return f()
+	}
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !retryable(err) {
+			if err != nil && attempt > 1 {
+				return fmt.Errorf("%s failed after %d attempts: %w", op, attempt, err)
+			}
+			return err
+		}
+		if attempt >= policy.MaxAttempts {
+			return fmt.Errorf("%s failed after %d attempts: %w", op, attempt, err)
+		}
+		var retryAfter time.Duration
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) {
+			retryAfter = httpErr.RetryAfter
+		}
+		wait := policy.delay(attempt, retryAfter)
+		log.Infof("Retrying %s in %s after attempt %d failed: %v", op, wait, attempt, err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return fmt.Errorf("%s failed after %d attempts: %w", op, attempt, errors.Join(err, ctx.Err()))
+		case <-c.doneChan():
+			return fmt.Errorf("%s failed after %d attempts: %w", op, attempt, errors.Join(err, ErrorClientClosed))
+		}
+	}
+}
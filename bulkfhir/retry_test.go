@@ -0,0 +1,252 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newStatusSequenceServer returns a server which responds to successive
+// requests with the given statuses, and then with 200 OK and body. It counts
+// the requests received in *requests.
+func newStatusSequenceServer(t *testing.T, statuses []int, body string, requests *int) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		*requests++
+		if *requests <= len(statuses) {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(statuses[*requests-1])
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestClient_GetData_RetryPolicy(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	cases := []struct {
+		name         string
+		policy       *RetryPolicy
+		statuses     []int
+		wantErr      error
+		wantAttempts string
+		wantRequests int
+	}{
+		{
+			name:         "succeeds after retries",
+			policy:       policy,
+			statuses:     []int{http.StatusNotFound, http.StatusTooManyRequests},
+			wantRequests: 3,
+		},
+		{
+			name:         "attempts exhausted",
+			policy:       policy,
+			statuses:     []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+			wantErr:      ErrorUnexpectedStatusCode,
+			wantAttempts: "after 3 attempts",
+			wantRequests: 3,
+		},
+		{
+			name:         "non-retryable status",
+			policy:       policy,
+			statuses:     []int{http.StatusTooManyRequests, http.StatusUnauthorized},
+			wantErr:      ErrorUnauthorized,
+			wantAttempts: "after 2 attempts",
+			wantRequests: 2,
+		},
+		{
+			name:         "no policy",
+			statuses:     []int{http.StatusNotFound},
+			wantErr:      ErrorRetryableHTTPStatus,
+			wantRequests: 1,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			requests := 0
+			server := newStatusSequenceServer(t, tc.statuses, "data", &requests)
+			cl, err := NewClientWithOptions(server.URL, testAuthenticator{}, &ClientOptions{RetryPolicy: tc.policy})
+			if err != nil {
+				t.Fatalf("NewClientWithOptions() returned unexpected error: %v", err)
+			}
+			r, err := cl.GetData(context.Background(), server.URL+"/data")
+			if tc.wantErr == nil {
+				if err != nil {
+					t.Fatalf("GetData() returned unexpected error: %v", err)
+				}
+				defer r.Close()
+				if data, _ := io.ReadAll(r); string(data) != "data" {
+					t.Errorf("GetData() returned unexpected data %q", data)
+				}
+			} else if !errors.Is(err, tc.wantErr) || !strings.Contains(err.Error(), tc.wantAttempts) {
+				t.Errorf("GetData() returned unexpected error. got: %v, want: %v %s", err, tc.wantErr, tc.wantAttempts)
+			}
+			if requests != tc.wantRequests {
+				t.Errorf("server received %d requests, want %d", requests, tc.wantRequests)
+			}
+		})
+	}
+}
+
+func TestClient_JobStatus_RetryPolicy(t *testing.T) {
+	requests := 0
+	server := newStatusSequenceServer(t, []int{http.StatusServiceUnavailable, http.StatusAccepted}, "", &requests)
+	cl, err := NewClientWithOptions(server.URL, testAuthenticator{}, &ClientOptions{
+		RetryPolicy: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("NewClientWithOptions() returned unexpected error: %v", err)
+	}
+	st, err := cl.JobStatus(context.Background(), server.URL+"/jobs/1")
+	if err != nil {
+		t.Fatalf("JobStatus() returned unexpected error: %v", err)
+	}
+	if st.IsComplete {
+		t.Error("JobStatus() returned a complete job, want the in progress status")
+	}
+	if requests != 2 {
+		t.Errorf("server received %d requests, want 2", requests)
+	}
+}
+
+// closeCountingTransport counts the response bodies which are closed (at least
+// once).
+type closeCountingTransport struct {
+	closed int
+}
+
+type countingBody struct {
+	io.ReadCloser
+	t      *closeCountingTransport
+	closed bool
+}
+
+func (b *countingBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		b.t.closed++
+	}
+	return b.ReadCloser.Close()
+}
+
+func (t *closeCountingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = &countingBody{ReadCloser: resp.Body, t: t}
+	return resp, nil
+}
+
+func TestClient_RetryPolicy_ClosesResponses(t *testing.T) {
+	for _, op := range []string{"GetData", "JobStatus"} {
+		t.Run(op, func(t *testing.T) {
+			requests := 0
+			server := newStatusSequenceServer(t, []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusServiceUnavailable}, "", &requests)
+			cl, err := NewClientWithOptions(server.URL, testAuthenticator{}, &ClientOptions{
+				RetryPolicy: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+			})
+			if err != nil {
+				t.Fatalf("NewClientWithOptions() returned unexpected error: %v", err)
+			}
+			transport := &closeCountingTransport{}
+			cl.httpClient = &http.Client{Transport: transport}
+			if op == "GetData" {
+				_, err = cl.GetData(context.Background(), server.URL+"/data")
+			} else {
+				_, err = cl.JobStatus(context.Background(), server.URL+"/jobs/1")
+			}
+			if !errors.Is(err, ErrorUnexpectedStatusCode) {
+				t.Fatalf("%s() returned unexpected error. got: %v, want: %v", op, err, ErrorUnexpectedStatusCode)
+			}
+			if transport.closed != requests {
+				t.Errorf("%s() closed %d of %d response bodies", op, transport.closed, requests)
+			}
+		})
+	}
+}
+
+func TestClient_GetDataWithRetries_IgnoresRetryPolicy(t *testing.T) {
+	dataRetryDelay = 0
+	t.Cleanup(func() { dataRetryDelay = defaultDataRetryDelay })
+
+	requests := 0
+	statuses := []int{http.StatusNotFound, http.StatusNotFound, http.StatusNotFound, http.StatusNotFound, http.StatusNotFound}
+	server := newStatusSequenceServer(t, statuses, "data", &requests)
+	cl, err := NewClientWithOptions(server.URL, testAuthenticator{}, &ClientOptions{
+		RetryPolicy: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("NewClientWithOptions() returned unexpected error: %v", err)
+	}
+	if _, err := cl.GetDataWithRetries(context.Background(), server.URL+"/data", 2); !errors.Is(err, ErrorRetryableHTTPStatus) {
+		t.Errorf("GetDataWithRetries() returned unexpected error. got: %v, want: %v", err, ErrorRetryableHTTPStatus)
+	}
+	if requests != 3 {
+		t.Errorf("server received %d requests, want 3", requests)
+	}
+}
+
+func TestClient_WithRetries_ContextCancelled(t *testing.T) {
+	cl, err := NewClientWithOptions("https://example.com", testAuthenticator{}, &ClientOptions{
+		RetryPolicy: &RetryPolicy{MaxAttempts: 3, BaseDelay: time.Hour, MaxDelay: time.Hour},
+	})
+	if err != nil {
+		t.Fatalf("NewClientWithOptions() returned unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	attempts := 0
+	err = cl.withRetries(ctx, "test", retryableDataError, func() error {
+		attempts++
+		return &HTTPError{StatusCode: http.StatusServiceUnavailable, Err: ErrorUnexpectedStatusCode}
+	})
+	if !errors.Is(err, context.Canceled) || !errors.Is(err, ErrorUnexpectedStatusCode) {
+		t.Errorf("withRetries() returned unexpected error. got: %v, want: %v and %v", err, context.Canceled, ErrorUnexpectedStatusCode)
+	}
+	if attempts != 1 {
+		t.Errorf("withRetries() made %d attempts, want 1", attempts)
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	p := &RetryPolicy{BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+	cases := []struct {
+		retry      int
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{retry: 1, want: time.Second},
+		{retry: 2, want: 2 * time.Second},
+		{retry: 3, want: 4 * time.Second},
+		{retry: 5, want: 10 * time.Second},
+		{retry: 1, retryAfter: 5 * time.Second, want: 5 * time.Second},
+		{retry: 1, retryAfter: time.Minute, want: 10 * time.Second},
+	}
+	for _, tc := range cases {
+		if got := p.delay(tc.retry, tc.retryAfter); got != tc.want {
+			t.Errorf("delay(%d, %s) = %s, want %s", tc.retry, tc.retryAfter, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// ServerProfile holds the paths of the endpoints of a bulk FHIR server, which
+// (beyond those defined by the bulk data spec) vary between server
+// implementations. Paths are relative to the Client's base URL, except for
+// TokenPath. Empty fields default to those of BCDAServerProfile.
+type ServerProfile struct {
+	// TokenPath is the path of the OAuth token endpoint, relative to the root
+	// (scheme and host) of the base URL. It is used by TokenURL.
+	TokenPath string
+	// ExportAllPatientsPath is the path of the patient level $export operation.
+	ExportAllPatientsPath string
+	// GroupExportPathFmt is the path of the group level $export operation, with
+	// a %s verb for the group id.
+	GroupExportPathFmt string
+	// MetadataPath is the path of the server's CapabilityStatement.
+	MetadataPath string
+	// JobsPath is the path at which the server lists export jobs.
+	JobsPath string
+}
+
+// BCDAServerProfile is the ServerProfile of the BCDA API, which follows the
+// bulk data spec for the standard endpoints. It is used by NewClient.
+var BCDAServerProfile = ServerProfile{
+	TokenPath:             "/auth/token",
+	ExportAllPatientsPath: "/Patient/$export",
+	GroupExportPathFmt:    "/Group/%s/$export",
+	MetadataPath:          "/metadata",
+	JobsPath:              "/jobs",
+}
+
+// withDefaults returns the profile with empty fields set from
+// BCDAServerProfile.
+func (p ServerProfile) withDefaults() ServerProfile {
+	if p.TokenPath == "" {
+		p.TokenPath = BCDAServerProfile.TokenPath
+	}
+	if p.ExportAllPatientsPath == "" {
+		p.ExportAllPatientsPath = BCDAServerProfile.ExportAllPatientsPath
+	}
+	if p.GroupExportPathFmt == "" {
+		p.GroupExportPathFmt = BCDAServerProfile.GroupExportPathFmt
+	}
+	if p.MetadataPath == "" {
+		p.MetadataPath = BCDAServerProfile.MetadataPath
+	}
+	if p.JobsPath == "" {
+		p.JobsPath = BCDAServerProfile.JobsPath
+	}
+	return p
+}
+
+// TokenURL returns the URL of the OAuth token endpoint for a server with the
+// given base URL, for use when creating an Authenticator.
+func (p ServerProfile) TokenURL(baseURL string) (string, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid base URL %q: %w", baseURL, err)
+	}
+	if !u.IsAbs() {
+		return "", fmt.Errorf("base URL %q is not absolute", baseURL)
+	}
+	return u.Scheme + "://" + u.Host + p.withDefaults().TokenPath, nil
+}
+
+// ClientOptions contains optional parameters used by NewClientWithOptions.
+type ClientOptions struct {
+	// The endpoint paths of the server. Defaults to BCDAServerProfile.
+	Profile ServerProfile
+	// If set, requests fail fast with ErrorCircuitOpen while the server is
+	// failing consistently. By default there is no circuit breaker.
+	CircuitBreaker *CircuitBreakerOptions
+	// If set, GetData and JobStatus retry requests which fail with a transient
+	// HTTP status. By default requests are not retried.
+	RetryPolicy *RetryPolicy
+	// Overrides of the names used for resource types when communicating with
+	// the server, for servers which use non-standard (for example, legacy)
+	// resource type names. A name is used in the _type parameter when starting
+	// exports, and resources listed under the name in job status responses are
+	// parsed as the given type. The standard name for the type is still
+	// recognised in job status responses. Each name may be given for only one
+	// type.
+	ResourceTypeNames map[cpb.ResourceTypeCode_Value]string
+	// If set, the earliest _since timestamp used when starting exports. If an
+	// export is started with an earlier (or zero) since, SinceFloor is used
+	// instead. This prevents data from before the floor (for example, data
+	// which has already been processed by another system) being exported again
+	// if the stored transaction time is lost or mismanaged.
+	SinceFloor time.Time
+	// Hosts (each either a host name, which matches any port, or a host:port)
+	// on which job status URLs are allowed, in addition to the host of the base
+	// URL. This is needed for servers which legitimately serve job status from
+	// a different host.
+	JobStatusAllowedHosts []string
+	// If true, job status URLs are not validated by ValidateJobStatusURL. This
+	// should only be set for servers whose job status hosts cannot be listed in
+	// JobStatusAllowedHosts.
+	SkipJobStatusHostCheck bool
+	// If set, MonitorJobStatus retries transient errors checking the status of
+	// a job with exponential backoff, without sending them to the caller,
+	// unless there are more than MaxConsecutiveErrors in a row. By default,
+	// every error is sent to the caller, and monitoring continues at the usual
+	// check period.
+	JobStatusRetryPolicy *JobStatusRetryPolicy
+	// If true, MonitorJobStatus follows exports which the server has split
+	// across several jobs: if a completed job has a NextJobStatusURL, the next
+	// job is monitored in turn, and only once the last job is complete is a
+	// complete JobStatus sent, with the ResultURLs and OutputFiles of all of the
+	// jobs and the TransactionTime of the first. By default, monitoring stops
+	// when the first job completes, and the caller must follow
+	// NextJobStatusURL themselves.
+	FollowJobContinuations bool
+	// The content codings advertised in the Accept-Encoding header of requests
+	// for result data (GetData and the methods built on it), in order of
+	// preference. Data the server sends with any of these codings (according to
+	// its Content-Encoding header) is decompressed transparently, and closing
+	// the returned stream closes every layer. A non-nil empty slice requests
+	// uncompressed data, and NewClientWithOptions returns an error wrapping
+	// ErrorUnsupportedContentEncoding for an unsupported coding.
+	//
+	// If nil, only gzip is accepted (which Go's HTTP transport negotiates and
+	// decompresses itself). Brotli and deflate must be opted in to, for example
+	// with []ContentEncoding{EncodingBrotli, EncodingGzip}. Requests with a
+	// Range header (see DownloadToGCS) are not affected, as they store data
+	// exactly as the server sends it.
+	AcceptEncodings []ContentEncoding
+}
+
+// NewClientWithOptions is like NewClient, but with the given options. opts may
+// be nil.
+func NewClientWithOptions(baseURL string, authenticator Authenticator, opts *ClientOptions) (*Client, error) {
+	c, err := NewClient(baseURL, authenticator)
+	if err != nil {
+		return nil, err
+	}
+	if opts != nil {
+		c.profile = opts.Profile
+		if opts.CircuitBreaker != nil {
+			c.breaker = newCircuitBreaker(*opts.CircuitBreaker)
+		}
+		if opts.RetryPolicy != nil {
+			policy := *opts.RetryPolicy
+			c.retryPolicy = &policy
+		}
+		if err := c.setResourceTypeNames(opts.ResourceTypeNames); err != nil {
+			return nil, err
+		}
+		c.sinceFloor = opts.SinceFloor
+		c.allowJobStatusHosts(opts.JobStatusAllowedHosts)
+		c.skipJobStatusHostCheck = opts.SkipJobStatusHostCheck
+		if opts.JobStatusRetryPolicy != nil {
+			policy := *opts.JobStatusRetryPolicy
+			c.jobStatusRetryPolicy = &policy
+		}
+		c.followContinuations = opts.FollowJobContinuations
+		if err := c.setAcceptEncodings(opts.AcceptEncodings); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// serverProfile returns the Client's ServerProfile, with defaults applied.
+func (c *Client) serverProfile() ServerProfile {
+	return c.profile.withDefaults()
+}
@@ -0,0 +1,109 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewClientWithOptions_Profile(t *testing.T) {
+	var mu sync.Mutex
+	var gotPaths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		gotPaths = append(gotPaths, req.URL.Path)
+		mu.Unlock()
+		if req.URL.Path == "/meta" {
+			w.Write([]byte(`{"resourceType": "CapabilityStatement"}`))
+			return
+		}
+		w.Header().Set(contentLocation, "http://"+req.Host+"/jobs/1")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	cl, err := NewClientWithOptions(server.URL, testAuthenticator{}, &ClientOptions{
+		Profile: ServerProfile{
+			ExportAllPatientsPath: "/bulk/Patient/export",
+			GroupExportPathFmt:    "/bulk/groups/%s/export",
+			MetadataPath:          "/meta",
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewClientWithOptions() returned unexpected error: %v", err)
+	}
+	defer cl.Close()
+	if _, err := cl.StartBulkDataExportAll(context.Background(), nil, time.Time{}); err != nil {
+		t.Errorf("StartBulkDataExportAll() returned unexpected error: %v", err)
+	}
+	if _, err := cl.StartBulkDataExport(context.Background(), nil, time.Time{}, "g"); err != nil {
+		t.Errorf("StartBulkDataExport() returned unexpected error: %v", err)
+	}
+	if _, err := cl.Ping(context.Background()); err != nil {
+		t.Errorf("Ping() returned unexpected error: %v", err)
+	}
+
+	want := []string{"/bulk/Patient/export", "/bulk/groups/g/export", "/meta"}
+	if diff := cmp.Diff(want, gotPaths); diff != "" {
+		t.Errorf("unexpected request paths (-want +got):\n%s", diff)
+	}
+}
+
+func TestServerProfile_TokenURL(t *testing.T) {
+	cases := []struct {
+		name    string
+		profile ServerProfile
+		baseURL string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "BCDA",
+			profile: BCDAServerProfile,
+			baseURL: "https://sandbox.bcda.cms.gov/api/v2",
+			want:    "https://sandbox.bcda.cms.gov/auth/token",
+		},
+		{
+			name:    "Custom",
+			profile: ServerProfile{TokenPath: "/oauth2/token"},
+			baseURL: "http://localhost:8000/fhir",
+			want:    "http://localhost:8000/oauth2/token",
+		},
+		{
+			name:    "Relative",
+			profile: BCDAServerProfile,
+			baseURL: "/api/v2",
+			wantErr: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := tc.profile.TokenURL(tc.baseURL)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("TokenURL(%q) returned unexpected error: %v, want error: %t", tc.baseURL, err, tc.wantErr)
+			}
+			if got != tc.want {
+				t.Errorf("TokenURL(%q) = %q, want %q", tc.baseURL, got, tc.want)
+			}
+		})
+	}
+}
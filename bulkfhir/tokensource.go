@@ -0,0 +1,180 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// TokenSource supplies bearer tokens for requests to the Bulk FHIR APIs. It is
+// modelled on golang.org/x/oauth2.TokenSource, and is called before every
+// request, so implementations should cache tokens until they expire.
+// Implementations must be safe for concurrent use.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// TokenSourceFunc adapts an ordinary function to a TokenSource. For example, a
+// golang.org/x/oauth2.TokenSource ts may be used with:
+//
+//	bulkfhir.TokenSourceFunc(func() (string, error) {
+//		t, err := ts.Token()
+//		if err != nil {
+//			return "", err
+//		}
+//		return t.AccessToken, nil
+//	})
+type TokenSourceFunc func() (string, error)
+
+// Token is TokenSource.Token.
+func (f TokenSourceFunc) Token() (string, error) {
+	return f()
+}
+
+// tokenInvalidator is implemented by TokenSources which cache tokens, and can
+// be made to obtain a fresh token on the next call to Token.
+type tokenInvalidator interface {
+	invalidate()
+}
+
+// contextTokenSource is implemented by the TokenSources provided by this
+// package, whose requests for tokens can be cancelled.
+type contextTokenSource interface {
+	tokenWithContext(ctx context.Context) (string, error)
+}
+
+// tokenSourceAuthenticator is an implementation of Authenticator which presents
+// tokens obtained from a TokenSource.
+type tokenSourceAuthenticator struct {
+	ts TokenSource
+}
+
+// NewTokenSourceAuthenticator creates a new Authenticator which presents a
+// token obtained from ts as an Authorization: Bearer {token} header with every
+// request. Caching and renewal of tokens is left to the TokenSource.
+func NewTokenSourceAuthenticator(ts TokenSource) Authenticator {
+	return &tokenSourceAuthenticator{ts: ts}
+}
+
+// token requests a token from the TokenSource. Only the TokenSources provided
+// by this package can be cancelled by ctx; other TokenSources are just called
+// once ctx has been checked.
+func (tsa *tokenSourceAuthenticator) token(ctx context.Context) (string, error) {
+	if cts, ok := tsa.ts.(contextTokenSource); ok {
+		return cts.tokenWithContext(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	return tsa.ts.Token()
+}
+
+// Authenticate is Authenticator.Authenticate.
+//
+// This Authenticator discards any token cached by the TokenSources provided by
+// this package before requesting a token. Other TokenSources are just called.
+func (tsa *tokenSourceAuthenticator) Authenticate(ctx context.Context, hc *http.Client) error {
+	if ti, ok := tsa.ts.(tokenInvalidator); ok {
+		ti.invalidate()
+	}
+	_, err := tsa.token(ctx)
+	return err
+}
+
+// AuthenticateIfNecessary is Authenticator.AuthenticateIfNecessary.
+//
+// This Authenticator requests a token from its TokenSource.
+func (tsa *tokenSourceAuthenticator) AuthenticateIfNecessary(ctx context.Context, hc *http.Client) error {
+	_, err := tsa.token(ctx)
+	return err
+}
+
+// AddAuthenticationToRequest is Authenticator.AddAuthenticationToRequest.
+//
+// This Authenticator adds the token returned by its TokenSource as an
+// Authorization: Bearer {token} header.
+func (tsa *tokenSourceAuthenticator) AddAuthenticationToRequest(hc *http.Client, req *http.Request) error {
+	token, err := tsa.token(req.Context())
+	if err != nil {
+		return err
+	}
+	(&BearerToken{Token: token}).addHeader(req)
+	return nil
+}
+
+// exchangerTokenSource is an implementation of TokenSource which uses a
+// CredentialExchanger to obtain tokens, caching them until they expire.
+type exchangerTokenSource struct {
+	exchanger CredentialExchanger
+	hc        *http.Client
+
+	mu    sync.Mutex
+	token *BearerToken
+}
+
+func newExchangerTokenSource(exchanger CredentialExchanger) *exchangerTokenSource {
+	return &exchangerTokenSource{exchanger: exchanger, hc: &http.Client{}}
+}
+
+// Token is TokenSource.Token.
+//
+// This TokenSource performs credential exchange if no token has been obtained,
+// or the cached token has expired.
+func (ets *exchangerTokenSource) Token() (string, error) {
+	return ets.tokenWithContext(context.Background())
+}
+
+func (ets *exchangerTokenSource) tokenWithContext(ctx context.Context) (string, error) {
+	ets.mu.Lock()
+	defer ets.mu.Unlock()
+	if ets.token.shouldRenew() {
+		token, err := ets.exchanger.Authenticate(ctx, ets.hc)
+		if err != nil {
+			return "", err
+		}
+		ets.token = token
+	}
+	return ets.token.Token, nil
+}
+
+func (ets *exchangerTokenSource) invalidate() {
+	ets.mu.Lock()
+	defer ets.mu.Unlock()
+	ets.token = nil
+}
+
+// NewHTTPBasicOAuthTokenSource creates a new TokenSource which uses 2-legged
+// OAuth with HTTP Basic authentication to obtain tokens. The arguments are as
+// for NewHTTPBasicOAuthAuthenticator.
+func NewHTTPBasicOAuthTokenSource(username, password, tokenURL string, opts *HTTPBasicOAuthOptions) (TokenSource, error) {
+	e, err := newHTTPBasicOAuthExchanger(username, password, tokenURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newExchangerTokenSource(e), nil
+}
+
+// NewJWTOAuthTokenSource creates a new TokenSource which uses 2-legged OAuth
+// with JWT authentication to obtain tokens. The arguments are as for
+// NewJWTOAuthAuthenticator.
+func NewJWTOAuthTokenSource(issuer, subject, tokenURL string, keyProvider JWTKeyProvider, opts *JWTOAuthOptions) (TokenSource, error) {
+	e, err := newJWTOAuthExchanger(issuer, subject, tokenURL, keyProvider, opts)
+	if err != nil {
+		return nil, err
+	}
+	return newExchangerTokenSource(e), nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bulkfhir
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenSourceAuthenticator(t *testing.T) {
+	calls := 0
+	a := NewTokenSourceAuthenticator(TokenSourceFunc(func() (string, error) {
+		calls++
+		return fmt.Sprintf("token%d", calls), nil
+	}))
+
+	buildRequestAndCheckHeader(t, a, "Bearer token1")
+	buildRequestAndCheckHeader(t, a, "Bearer token2")
+}
+
+func TestTokenSourceAuthenticator_Error(t *testing.T) {
+	wantErr := errors.New("token error")
+	a := NewTokenSourceAuthenticator(TokenSourceFunc(func() (string, error) {
+		return "", wantErr
+	}))
+	hc := &http.Client{}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com", nil)
+	if err := a.AddAuthenticationToRequest(hc, req); !errors.Is(err, wantErr) {
+		t.Errorf("AddAuthenticationToRequest() returned unexpected error. got: %v, want: %v", err, wantErr)
+	}
+	if err := a.AuthenticateIfNecessary(context.Background(), hc); !errors.Is(err, wantErr) {
+		t.Errorf("AuthenticateIfNecessary() returned unexpected error. got: %v, want: %v", err, wantErr)
+	}
+	if err := a.Authenticate(context.Background(), hc); !errors.Is(err, wantErr) {
+		t.Errorf("Authenticate() returned unexpected error. got: %v, want: %v", err, wantErr)
+	}
+}
+
+func TestHTTPBasicOAuthTokenSource(t *testing.T) {
+	now := time.Now()
+	timeNow = func() time.Time {
+		return now
+	}
+	defer func() {
+		timeNow = time.Now
+	}()
+
+	counter := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		counter++
+		w.Write([]byte(fmt.Sprintf(`{"access_token": "token%d", "expires_in": 1200}`, counter)))
+	}))
+	defer server.Close()
+
+	ts, err := NewHTTPBasicOAuthTokenSource("id", "secret", server.URL+"/auth/token", nil)
+	if err != nil {
+		t.Fatalf("NewHTTPBasicOAuthTokenSource() returned unexpected error: %v", err)
+	}
+
+	checkToken := func(want string) {
+		t.Helper()
+		got, err := ts.Token()
+		if err != nil {
+			t.Fatalf("Token() returned unexpected error: %v", err)
+		}
+		if got != want {
+			t.Errorf("Token() returned unexpected token. got: %q, want: %q", got, want)
+		}
+	}
+
+	checkToken("token1")
+	// The token is cached until it expires.
+	now = now.Add(5 * time.Minute)
+	checkToken("token1")
+	now = now.Add(20 * time.Minute)
+	checkToken("token2")
+
+	// Authenticate forces a new token to be obtained.
+	a := NewTokenSourceAuthenticator(ts)
+	if err := a.Authenticate(context.Background(), &http.Client{}); err != nil {
+		t.Fatalf("Authenticate() returned unexpected error: %v", err)
+	}
+	buildRequestAndCheckHeader(t, a, "Bearer token3")
+}
+
+func TestHTTPBasicOAuthTokenSource_Error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	if _, err := NewHTTPBasicOAuthTokenSource("", "", server.URL, nil); err == nil {
+		t.Errorf("NewHTTPBasicOAuthTokenSource() with no credentials succeeded, want error")
+	}
+
+	ts, err := NewHTTPBasicOAuthTokenSource("id", "secret", server.URL, nil)
+	if err != nil {
+		t.Fatalf("NewHTTPBasicOAuthTokenSource() returned unexpected error: %v", err)
+	}
+	if _, err := ts.Token(); !errors.Is(err, ErrorUnexpectedStatusCode) {
+		t.Errorf("Token() returned unexpected error. got: %v, want: %v", err, ErrorUnexpectedStatusCode)
+	}
+}
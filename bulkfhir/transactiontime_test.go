@@ -23,6 +23,8 @@ import (
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
 )
 
 func TestInMemoryTransactionTimeStore(t *testing.T) {
@@ -183,3 +185,122 @@ func testStoreAndRetrieve(ctx context.Context, t *testing.T, s TransactionTimeSt
 		t.Errorf("unexpected timestamp from Load(): want %s; got %s", ts, got)
 	}
 }
+
+func TestLocalFileKeyedTransactionTimeStore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "since.json")
+	patients := TransactionTimeKey{Group: "g1", ResourceType: cpb.ResourceTypeCode_PATIENT}
+	eobs := TransactionTimeKey{Group: "g1", ResourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT}
+
+	s := NewLocalFileKeyedTransactionTimeStore(path)
+	got, err := s.Load(ctx, patients)
+	if err != nil {
+		t.Fatalf("Load() on a missing file returned unexpected error: %v", err)
+	}
+	if !got.IsZero() {
+		t.Errorf("expected initial timestamp to be zero; got %s", got)
+	}
+
+	time1 := time.Date(2022, 11, 25, 14, 54, 33, 0, time.UTC)
+	time2 := time.Date(2022, 11, 26, 14, 51, 22, 0, time.UTC)
+	if err := s.Store(ctx, map[TransactionTimeKey]time.Time{patients: time1, eobs: time1}); err != nil {
+		t.Fatalf("Store() returned unexpected error: %v", err)
+	}
+	// A later run updates one type, keeping the other.
+	s = NewLocalFileKeyedTransactionTimeStore(path)
+	if err := s.Store(ctx, map[TransactionTimeKey]time.Time{patients: time2}); err != nil {
+		t.Fatalf("Store() returned unexpected error: %v", err)
+	}
+
+	s = NewLocalFileKeyedTransactionTimeStore(path)
+	for key, want := range map[TransactionTimeKey]time.Time{patients: time2, eobs: time1, {Group: "g2", ResourceType: cpb.ResourceTypeCode_PATIENT}: {}} {
+		got, err := s.Load(ctx, key)
+		if err != nil {
+			t.Fatalf("Load(%s) returned unexpected error: %v", key, err)
+		}
+		if !got.Equal(want) {
+			t.Errorf("unexpected timestamp from Load(%s): want %s; got %s", key, want, got)
+		}
+	}
+
+	gotContents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	wantContents := "{\n  \"g1/ExplanationOfBenefit\": \"2022-11-25T14:54:33.000+00:00\",\n  \"g1/Patient\": \"2022-11-26T14:51:22.000+00:00\"\n}"
+	if diff := cmp.Diff(wantContents, string(gotContents)); diff != "" {
+		t.Errorf("unexpected diff in since file (-want, +got):\n%s", diff)
+	}
+}
+
+func TestLocalFileKeyedTransactionTimeStore_InvalidFile(t *testing.T) {
+	for _, contents := range []string{"not json", `{"g1": "2022-11-25T14:54:33Z"}`, `{"g1/Patient": "invalid"}`} {
+		path := filepath.Join(t.TempDir(), "since.json")
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("failed to write since file: %v", err)
+		}
+		if _, err := NewLocalFileKeyedTransactionTimeStore(path).Load(context.Background(), TransactionTimeKey{ResourceType: cpb.ResourceTypeCode_PATIENT}); err == nil {
+			t.Errorf("Load() with file contents %s succeeded, want error", contents)
+		}
+	}
+}
+
+func TestGCSKeyedTransactionTimeStore(t *testing.T) {
+	ctx := context.Background()
+	gcsServer := testhelpers.NewGCSServer(t)
+	s, err := NewGCSKeyedTransactionTimeStore(ctx, gcsServer.URL(), "gs://sinceBucket/since.json")
+	if err != nil {
+		t.Fatalf("NewGCSKeyedTransactionTimeStore() returned unexpected error: %v", err)
+	}
+	key := TransactionTimeKey{ResourceType: cpb.ResourceTypeCode_COVERAGE}
+	got, err := s.Load(ctx, key)
+	if err != nil {
+		t.Fatalf("Load() returned unexpected error: %v", err)
+	}
+	if !got.IsZero() {
+		t.Errorf("expected initial timestamp to be zero; got %s", got)
+	}
+	ts := time.Date(2022, 11, 25, 14, 54, 33, 0, time.UTC)
+	testStoreAndRetrieve(ctx, t, TransactionTimeStoreForKeys(s, key), ts)
+
+	obj, ok := gcsServer.GetObject("sinceBucket", "since.json")
+	if !ok {
+		t.Fatal("since.json not found")
+	}
+	if diff := cmp.Diff("{\n  \"/Coverage\": \"2022-11-25T14:54:33.000+00:00\"\n}", string(obj.Data)); diff != "" {
+		t.Errorf("unexpected diff in since file (-want, +got):\n%s", diff)
+	}
+}
+
+func TestTransactionTimeStoreForKeys(t *testing.T) {
+	ctx := context.Background()
+	patients := TransactionTimeKey{Group: "g1", ResourceType: cpb.ResourceTypeCode_PATIENT}
+	encounters := TransactionTimeKey{Group: "g1", ResourceType: cpb.ResourceTypeCode_ENCOUNTER}
+	practitioners := TransactionTimeKey{Group: "g1", ResourceType: cpb.ResourceTypeCode_PRACTITIONER}
+	time1 := time.Date(2022, 11, 25, 14, 54, 33, 0, time.UTC)
+	time2 := time.Date(2022, 11, 26, 14, 51, 22, 0, time.UTC)
+
+	keyed := NewInMemoryKeyedTransactionTimeStore()
+	if err := keyed.Store(ctx, map[TransactionTimeKey]time.Time{patients: time2, encounters: time1}); err != nil {
+		t.Fatalf("Store() returned unexpected error: %v", err)
+	}
+	cases := []struct {
+		name string
+		keys []TransactionTimeKey
+		want time.Time
+	}{
+		{name: "Earliest", keys: []TransactionTimeKey{patients, encounters}, want: time1},
+		{name: "OneNeverStored", keys: []TransactionTimeKey{patients, practitioners}, want: time.Time{}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := TransactionTimeStoreForKeys(keyed, tc.keys...).Load(ctx)
+			if err != nil {
+				t.Fatalf("Load() returned unexpected error: %v", err)
+			}
+			if !got.Equal(tc.want) {
+				t.Errorf("unexpected timestamp from Load(): want %s; got %s", tc.want, got)
+			}
+		})
+	}
+}
@@ -56,8 +56,25 @@ var (
 	since                = flag.String("since", "", "The optional timestamp after which data should be fetched for. If not specified, fetches all available data. This should be a FHIR instant in the form of YYYY-MM-DDThh:mm:ss.sss+zz:zz.")
 	sinceFile            = flag.String("since_file", "", "Optional. If specified, the fetch program will read the latest since timestamp in this file to use when fetching data from the FHIR API. DO NOT run simultaneous fetch programs with the same since file. Once the fetch is completed successfully, fetch will write the FHIR API transaction timestamp for this fetch operation to the end of the file specified here, to be used in the subsequent run (to only fetch new data since the last successful run). The first time fetch is run with this flag set, it will fetch all data. If the file is of the form `gs://<GCS Bucket Name>/<Since File Name>` it will attempt to write the since file to the GCS bucket and file specified.")
 	noFailOnUploadErrors = flag.Bool("no_fail_on_upload_errors", false, "If true, fetch will not fail on FHIR store upload errors, and will continue (and write out updates to since_file) as normal.")
+	checkCapabilities    = flag.Bool("check_server_capabilities", false, "If true, the FHIR server's CapabilityStatement is checked for bulk data export support (and support for the requested fhir_resource_types) before starting a new export job. Some servers publish incomplete CapabilityStatements, so this is off by default.")
 	pendingJobURL        = flag.String("pending_job_url", "", "(For debug/manual use). If set, skip creating a new FHIR export job on the bulk fhir server. Instead, bulk_fhir_fetch will download and process the data from the existing pending job url provided by this flag. bulk_fhir_fetch will wait until the provided job id is complete before proceeding.")
 
+	jobStatusAllowedHosts  = flag.String("job_status_allowed_hosts", "", "An optional comma separated list of hosts (host or host:port) which job status URLs may be on, in addition to the host of fhir_server_base_url. Job status URLs on other hosts are rejected, so that credentials are not sent to an unexpected host.")
+	skipJobStatusHostCheck = flag.Bool("skip_job_status_host_check", false, "If true, job status URLs returned by the server are not checked to be on the host of fhir_server_base_url (or a host in job_status_allowed_hosts). Prefer job_status_allowed_hosts where possible.")
+	followContinuations    = flag.Bool("follow_job_continuations", false, "If true, and the server splits the export across several jobs (with a \"next\" link in the completed job status), each of the jobs is monitored in turn and the data from all of them is fetched.")
+	acceptEncodings        = flag.String("accept_encodings", "", "An optional comma separated list of the compression encodings (gzip, deflate or br) to accept for result files, in order of preference, for example br,gzip. Result files are decompressed as they are downloaded. If unset, only gzip is accepted. Set to identity to request uncompressed result files.")
+
+	downloadConcurrency   = flag.Int("download_concurrency", 1, "The number of result files to download at the same time. If this or processing_concurrency is greater than 1, result files are downloaded to temporary files and queued for processing.")
+	processingConcurrency = flag.Int("processing_concurrency", 1, "The number of downloaded result files to process at the same time.")
+	downloadQueueSize     = flag.Int("download_queue_size", 0, "The maximum number of downloaded result files waiting to be processed. Downloads pause while the queue is full. Defaults to processing_concurrency.")
+	streamWithoutStaging  = flag.Bool("stream_without_staging", false, "If true, result files are never written to local disk, even with download_concurrency greater than 1: each file is streamed from the server directly into processing. processing_concurrency and download_queue_size are ignored.")
+	etagFile              = flag.String("etag_file", "", "Optional. If specified, the ETags of result files (for servers which send them) are saved to this local file after a successful fetch, and result files which have not changed since they were saved are skipped by later fetches. This is useful when re-running against an export whose result files may not have changed.")
+	outputFileTemplate    = flag.String("output_filename_template", "", "Optional. If specified, the template for the names of the NDJSON files written to output_dir, for example group-{group}_{transaction_time}_{resource_type}_{index}.ndjson. The template must contain {index}, and may contain {resource_type} (in which case each file holds a single resource type), {group} (the group_id, or \"all\") and {transaction_time}. This allows files from several fetches to be kept in the same directory.")
+	outputManifest        = flag.Bool("output_manifest", false, "If true, a manifest.json listing the name, size in bytes, SHA-256 hash and resource count of each NDJSON file written is also written to output_dir once the fetch is complete, so that the files can be verified later.")
+	maxResources          = flag.Int("max_resources", 0, "Optional. If set, the fetch stops once this many resources have been processed: no further result files are downloaded, and the resources already processed are written out. since_file and etag_file are not updated, and the program exits with an error reporting that the limit was reached.")
+	maxBytes              = flag.Int64("max_bytes", 0, "Optional. Like max_resources, but the fetch stops once the resources processed total this many bytes of JSON.")
+	dryRun                = flag.Bool("dry_run", false, "If true, the configuration is validated without writing anything: authentication is checked and the export request is built but not sent. If pending_job_url is set, the data from the job is downloaded and run through the processing steps, but not written to any outputs, and counts of the resources that would have been written are logged. since_file and etag_file are not updated.")
+
 	enableGCPLogging            = flag.Bool("enable_gcp_logging", false, "If true, logs and metrics will be written to GCP instead of stdout. If true, fhirStoreGCPProject must be set to specify which GCP Project ID to write logs to.")
 	enableFHIRStore             = flag.Bool("enable_fhir_store", false, "If true, this enables write to GCP FHIR store. If true, all other fhir_store_* flags and the rectify flag must be set.")
 	maxFHIRStoreUploadWorkers   = flag.Int("max_fhir_store_upload_workers", 10, "The max number of concurrent FHIR store upload workers.")
@@ -68,6 +85,7 @@ var (
 	fhirStoreUploadErrorFileDir = flag.String("fhir_store_upload_error_file_dir", "", "An optional path to a directory where an upload errors file should be written. This file will contain the FHIR NDJSON and error information of FHIR resources that fail to upload to FHIR store. If using the batch upload option, if one or more FHIR resources in the bundle failed to upload then all FHIR resources in the bundle (including those that were sucessfully uploaded) will be written to error file.")
 	fhirStoreEnableBatchUpload  = flag.Bool("fhir_store_enable_batch_upload", false, "If true, uploads FHIR resources to FHIR Store in batch bundles.")
 	fhirStoreBatchUploadSize    = flag.Int("fhir_store_batch_upload_size", 0, "If set, this is the batch size used to upload FHIR batch bundles to FHIR store. If this flag is not set and fhir_store_enable_batch_upload is true, a default batch size is used.")
+	fhirStorePreferOutcome      = flag.Bool("fhir_store_prefer_operation_outcome", false, "If true, FHIR Store uploads request Prefer: return=OperationOutcome, and warnings in successful responses are logged and written to the upload errors file (if fhir_store_upload_error_file_dir is set).")
 
 	fhirStoreEnableGCSBasedUpload = flag.Bool("fhir_store_enable_gcs_based_upload", false, "If true, writes NDJSONs from the FHIR server to GCS, and then triggers a batch FHIR store import job from the GCS location. fhir_store_gcs_based_upload_bucket must also be set.")
 	fhirStoreGCSBasedUploadBucket = flag.String("fhir_store_gcs_based_upload_bucket", "", "If fhir_store_enable_gcs_based_upload is set, this must be provided to indicate the GCS bucket to write NDJSONs to.")
@@ -164,7 +182,12 @@ func bulkFHIRFetch(ctx context.Context, cfg bulkFHIRFetchConfig) error {
 	if err != nil {
 		return err
 	}
-	cl, err := bulkfhir.NewClient(cfg.baseServerURL, authenticator)
+	cl, err := bulkfhir.NewClientWithOptions(cfg.baseServerURL, authenticator, &bulkfhir.ClientOptions{
+		JobStatusAllowedHosts:  cfg.jobStatusAllowedHosts,
+		SkipJobStatusHostCheck: cfg.skipJobStatusHostCheck,
+		FollowJobContinuations: cfg.followContinuations,
+		AcceptEncodings:        cfg.acceptEncodings,
+	})
 	if err != nil {
 		return fmt.Errorf("Error making bulkfhir client: %v", err)
 	}
@@ -188,19 +211,25 @@ func bulkFHIRFetch(ctx context.Context, cfg bulkFHIRFetchConfig) error {
 
 	var sinks []processing.Sink
 	if cfg.outputDir != "" {
+		ndjsonOpts := &processing.NDJSONSinkOptions{
+			FilenameTemplate: cfg.outputFileTemplate,
+			Group:            cfg.groupID,
+			TransactionTime:  transactionTime,
+			Manifest:         cfg.outputManifest,
+		}
 		if strings.HasPrefix(cfg.outputDir, "gs://") {
 			bucket, relativePath, err := gcs.PathComponents(cfg.outputDir)
 			if err != nil {
 				return err
 			}
-			gcsSink, err := processing.NewGCSNDJSONSink(ctx, cfg.gcsEndpoint, bucket, relativePath)
+			gcsSink, err := processing.NewGCSNDJSONSinkWithOptions(ctx, cfg.gcsEndpoint, bucket, relativePath, ndjsonOpts)
 			if err != nil {
 				return fmt.Errorf("error making GCS output sink: %v", err)
 			}
 			sinks = append(sinks, gcsSink)
 		} else {
 			// Add a local directory NDJSON sink.
-			ndjsonSink, err := processing.NewNDJSONSink(ctx, cfg.outputDir)
+			ndjsonSink, err := processing.NewNDJSONSinkWithOptions(ctx, cfg.outputDir, ndjsonOpts)
 			if err != nil {
 				return fmt.Errorf("error making ndjson sink: %v", err)
 			}
@@ -217,6 +246,7 @@ func bulkFHIRFetch(ctx context.Context, cfg bulkFHIRFetchConfig) error {
 				ProjectID:               cfg.fhirStoreGCPProject,
 				DatasetID:               cfg.fhirStoreGCPDatasetID,
 				Location:                cfg.fhirStoreGCPLocation,
+				PreferOperationOutcome:  cfg.fhirStorePreferOutcome,
 			},
 			NoFailOnUploadErrors: cfg.noFailOnUploadErrors,
 
@@ -239,19 +269,32 @@ func bulkFHIRFetch(ctx context.Context, cfg bulkFHIRFetchConfig) error {
 		sinks = append(sinks, fhirStoreSink)
 	}
 
-	pipeline, err := processing.NewPipeline(processors, sinks)
+	pipeline, err := processing.NewPipelineWithOptions(processors, sinks, &processing.PipelineOptions{DryRun: cfg.dryRun})
 	if err != nil {
 		return fmt.Errorf("error making output pipeline: %v", err)
 	}
 
 	f := &fetcher.Fetcher{
-		Client:               cl,
-		Pipeline:             pipeline,
-		TransactionTimeStore: ttStore,
-		TransactionTime:      transactionTime,
-		JobURL:               cfg.pendingJobURL,
-		ResourceTypes:        cfg.fhirResourceTypes,
-		ExportGroup:          cfg.groupID,
+		Client:                cl,
+		Pipeline:              pipeline,
+		TransactionTimeStore:  ttStore,
+		TransactionTime:       transactionTime,
+		JobURL:                cfg.pendingJobURL,
+		ResourceTypes:         cfg.fhirResourceTypes,
+		ExportGroup:           cfg.groupID,
+		CheckCapabilities:     cfg.checkCapabilities,
+		DownloadConcurrency:   cfg.downloadConcurrency,
+		ProcessingConcurrency: cfg.processingConcurrency,
+		DownloadQueueSize:     cfg.downloadQueueSize,
+		StreamWithoutStaging:  cfg.streamWithoutStaging,
+		MaxResources:          cfg.maxResources,
+		MaxBytes:              cfg.maxBytes,
+		DryRun:                cfg.dryRun,
+		// Flush the resources already processed if the fetch is interrupted.
+		HandleSignals: true,
+	}
+	if cfg.etagFile != "" {
+		f.ETagStore = bulkfhir.NewLocalFileETagStore(cfg.etagFile)
 	}
 	return f.Run(ctx)
 }
@@ -381,6 +424,7 @@ type bulkFHIRFetchConfig struct {
 	fhirStoreUploadErrorFileDir   string
 	fhirStoreEnableBatchUpload    bool
 	fhirStoreBatchUploadSize      int
+	fhirStorePreferOutcome        bool
 	fhirStoreEnableGCSBasedUpload bool
 	fhirStoreGCSBasedUploadBucket string
 	enforceGCSBucketInSameProject bool
@@ -392,7 +436,22 @@ type bulkFHIRFetchConfig struct {
 	since                         string
 	sinceFile                     string
 	noFailOnUploadErrors          bool
+	checkCapabilities             bool
 	pendingJobURL                 string
+	jobStatusAllowedHosts         []string
+	skipJobStatusHostCheck        bool
+	followContinuations           bool
+	acceptEncodings               []bulkfhir.ContentEncoding
+	downloadConcurrency           int
+	processingConcurrency         int
+	downloadQueueSize             int
+	streamWithoutStaging          bool
+	etagFile                      string
+	outputFileTemplate            string
+	outputManifest                bool
+	maxResources                  int
+	maxBytes                      int64
+	dryRun                        bool
 }
 
 func buildBulkFHIRFetchConfig() (bulkFHIRFetchConfig, error) {
@@ -416,6 +475,7 @@ func buildBulkFHIRFetchConfig() (bulkFHIRFetchConfig, error) {
 		fhirStoreUploadErrorFileDir: *fhirStoreUploadErrorFileDir,
 		fhirStoreEnableBatchUpload:  *fhirStoreEnableBatchUpload,
 		fhirStoreBatchUploadSize:    *fhirStoreBatchUploadSize,
+		fhirStorePreferOutcome:      *fhirStorePreferOutcome,
 
 		fhirStoreEnableGCSBasedUpload: *fhirStoreEnableGCSBasedUpload,
 		fhirStoreGCSBasedUploadBucket: *fhirStoreGCSBasedUploadBucket,
@@ -429,7 +489,22 @@ func buildBulkFHIRFetchConfig() (bulkFHIRFetchConfig, error) {
 		since:                *since,
 		sinceFile:            *sinceFile,
 		noFailOnUploadErrors: *noFailOnUploadErrors,
+		checkCapabilities:    *checkCapabilities,
 		pendingJobURL:        *pendingJobURL,
+
+		skipJobStatusHostCheck: *skipJobStatusHostCheck,
+		followContinuations:    *followContinuations,
+
+		downloadConcurrency:   *downloadConcurrency,
+		processingConcurrency: *processingConcurrency,
+		downloadQueueSize:     *downloadQueueSize,
+		streamWithoutStaging:  *streamWithoutStaging,
+		etagFile:              *etagFile,
+		outputFileTemplate:    *outputFileTemplate,
+		outputManifest:        *outputManifest,
+		maxResources:          *maxResources,
+		maxBytes:              *maxBytes,
+		dryRun:                *dryRun,
 	}
 
 	if *enableGeneralizedBulkImport != false {
@@ -441,6 +516,18 @@ func buildBulkFHIRFetchConfig() (bulkFHIRFetchConfig, error) {
 		c.authURL = *bcdaServerURL + "/auth/token"
 	}
 
+	if *jobStatusAllowedHosts != "" {
+		c.jobStatusAllowedHosts = strings.Split(*jobStatusAllowedHosts, ",")
+	}
+
+	if *acceptEncodings != "" {
+		encodings, err := bulkfhir.ParseContentEncodings(*acceptEncodings)
+		if err != nil {
+			return bulkFHIRFetchConfig{}, fmt.Errorf("accept_encodings flag invalid: %w", err)
+		}
+		c.acceptEncodings = encodings
+	}
+
 	if *fhirResourceTypes != "" {
 		for _, r := range strings.Split(*fhirResourceTypes, ",") {
 			v, err := bulkfhir.ResourceTypeCodeFromName(r)
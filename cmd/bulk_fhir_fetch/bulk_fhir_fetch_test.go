@@ -1358,6 +1358,7 @@ func TestBuildBulkFHIRFetchWrapperConfig(t *testing.T) {
 	flag.Set("fhir_store_upload_error_file_dir", "uploadDir")
 	flag.Set("fhir_store_enable_batch_upload", "true")
 	flag.Set("fhir_store_batch_upload_size", "10")
+	flag.Set("fhir_store_prefer_operation_outcome", "true")
 	flag.Set("fhir_store_enable_gcs_based_upload", "true")
 	flag.Set("fhir_store_gcs_based_upload_bucket", "my-bucket")
 	flag.Set("enforce_gcs_bucket_in_same_project", "true")
@@ -1371,6 +1372,13 @@ func TestBuildBulkFHIRFetchWrapperConfig(t *testing.T) {
 	flag.Set("since_file", "sinceFile")
 	flag.Set("no_fail_on_upload_errors", "true")
 	flag.Set("pending_job_url", "jobURL")
+	flag.Set("download_concurrency", "4")
+	flag.Set("processing_concurrency", "2")
+	flag.Set("download_queue_size", "8")
+	flag.Set("stream_without_staging", "true")
+	flag.Set("etag_file", "etagFile")
+	flag.Set("follow_job_continuations", "true")
+	flag.Set("output_filename_template", "{resource_type}_{index}.ndjson")
 
 	expectedCfg := bulkFHIRFetchConfig{
 		fhirStoreEndpoint:             fhirstore.DefaultHealthcareEndpoint,
@@ -1389,6 +1397,7 @@ func TestBuildBulkFHIRFetchWrapperConfig(t *testing.T) {
 		fhirStoreUploadErrorFileDir:   "uploadDir",
 		fhirStoreEnableBatchUpload:    true,
 		fhirStoreBatchUploadSize:      10,
+		fhirStorePreferOutcome:        true,
 		fhirStoreEnableGCSBasedUpload: true,
 		fhirStoreGCSBasedUploadBucket: "my-bucket",
 		enforceGCSBucketInSameProject: true,
@@ -1400,6 +1409,13 @@ func TestBuildBulkFHIRFetchWrapperConfig(t *testing.T) {
 		sinceFile:                     "sinceFile",
 		noFailOnUploadErrors:          true,
 		pendingJobURL:                 "jobURL",
+		downloadConcurrency:           4,
+		processingConcurrency:         2,
+		downloadQueueSize:             8,
+		streamWithoutStaging:          true,
+		etagFile:                      "etagFile",
+		followContinuations:           true,
+		outputFileTemplate:            "{resource_type}_{index}.ndjson",
 	}
 
 	cfg, err := buildBulkFHIRFetchConfig()
@@ -1425,6 +1441,8 @@ func TestBuildBulkFHIRFetchWrapperConfigBCDAFlag(t *testing.T) {
 		baseServerURL:                 "url/api/v2",
 		authURL:                       "url/auth/token",
 		enforceGCSBucketInSameProject: true,
+		downloadConcurrency:           1,
+		processingConcurrency:         1,
 	}
 
 	cfg, err := buildBulkFHIRFetchConfig()
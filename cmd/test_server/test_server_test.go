@@ -15,6 +15,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -165,7 +166,7 @@ func TestTestServer_ValidPatientExport(t *testing.T) {
 			}
 
 			// Start export:
-			jobURL, err := c.StartBulkDataExport([]cpb.ResourceTypeCode_Value{
+			jobURL, err := c.StartBulkDataExport(context.Background(), []cpb.ResourceTypeCode_Value{
 				cpb.ResourceTypeCode_PATIENT}, time.Time{}, tc.groupName)
 			if err != nil {
 				t.Fatalf("Error starting bulk fhir export: %v", err)
@@ -173,7 +174,7 @@ func TestTestServer_ValidPatientExport(t *testing.T) {
 
 			// Check job status:
 			var result *bulkfhir.MonitorResult
-			for result = range c.MonitorJobStatus(jobURL, time.Second, 5*time.Second) {
+			for result = range c.MonitorJobStatus(context.Background(), jobURL, time.Second, 5*time.Second) {
 				if result.Error != nil {
 					t.Fatalf("Error in checking job status: %v", result.Error)
 				}
@@ -191,7 +192,7 @@ func TestTestServer_ValidPatientExport(t *testing.T) {
 			}
 
 			// Download data:
-			d, err := c.GetData(result.Status.ResultURLs[cpb.ResourceTypeCode_PATIENT][0])
+			d, err := c.GetData(context.Background(), result.Status.ResultURLs[cpb.ResourceTypeCode_PATIENT][0])
 			if err != nil {
 				t.Fatalf("Error getting data: %v", err)
 			}
@@ -22,6 +22,8 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/google/bulk_fhir_tools/bulkfhir"
@@ -37,6 +39,19 @@ import (
 // fails to produce a valid timestamp. This is primarily used for testing.
 var ErrInvalidTransactionTime = errors.New("failed to get transaction timestamp")
 
+// ErrResourceCountMismatch is returned (wrapped) when VerifyResourceCounts is
+// set and a result file contains a different number of resources to the count
+// reported by the server.
+var ErrResourceCountMismatch = errors.New("number of resources in result file does not match the count reported by the server")
+
+// ErrInterrupted is returned (wrapped) when HandleSignals is set and the
+// process receives SIGINT or SIGTERM before the fetch is complete.
+var ErrInterrupted = errors.New("bulk FHIR fetch interrupted by signal")
+
+// ErrLimitReached is returned (wrapped) when MaxResources or MaxBytes is set
+// and the limit is reached before all of the result files have been processed.
+var ErrLimitReached = errors.New("bulk FHIR fetch stopped at a resource limit")
+
 const (
 	defaultJobStatusPeriod  = 5 * time.Second
 	defaultJobStatusTimeout = 6 * time.Hour
@@ -68,10 +83,29 @@ type Fetcher struct {
 	// Resource types to request if no JobURL is specified. May be empty.
 	ResourceTypes []cpb.ResourceTypeCode_Value
 
+	// If non-empty, only result files for these resource types are downloaded
+	// and processed, even if the export job returned other resource types.
+	ProcessResourceTypes []cpb.ResourceTypeCode_Value
+
 	// Group to export if no JobURL is specified. If empty, defaults to exporting
 	// data for all patients.
 	ExportGroup string
 
+	// If non-empty and no JobURL is specified, only data for these patient IDs
+	// is exported. If there are more than MaxPatientsPerJob patients, they are
+	// split between several export jobs, and the results of all of the jobs are
+	// processed together once they are all complete.
+	Patients []string
+
+	// The maximum number of patients per export job when Patients is set.
+	// Defaults to bulkfhir.DefaultMaxPatientsPerJob.
+	MaxPatientsPerJob int
+
+	// If true, the server's CapabilityStatement is checked for bulk data export
+	// support (and support for ResourceTypes) before a new job is started. This
+	// is off by default, as some servers publish incomplete CapabilityStatements.
+	CheckCapabilities bool
+
 	// The following parameters may all be omitted, and sane defaults will be used.
 
 	// How frequently to poll for job status if the server does not return a
@@ -83,31 +117,199 @@ type Fetcher struct {
 
 	// How many times to retry fetching each data URL.
 	DataRetryCount int
+
+	// If true, the number of resources in each result file is checked against
+	// the count reported by the server (if it reported one), and the Run fails
+	// with ErrResourceCountMismatch if they differ. This detects truncated
+	// downloads. Note that the mismatched file's resources will already have
+	// been passed through the pipeline.
+	VerifyResourceCounts bool
+
+	// The number of result files downloaded at the same time. Defaults to 1. If
+	// this or ProcessingConcurrency is greater than 1 (and StreamWithoutStaging
+	// is not set), result files are downloaded to temporary files in
+	// DownloadDir, and queued for processing; otherwise each file is processed
+	// as it is downloaded.
+	DownloadConcurrency int
+
+	// The number of downloaded result files processed at the same time. Defaults
+	// to 1. As a Pipeline is not safe for concurrent use, calls to Pipeline are
+	// serialized, so additional processing workers only overlap reading (and
+	// decompressing) files with the Pipeline.
+	ProcessingConcurrency int
+
+	// The maximum number of downloaded result files waiting to be processed.
+	// Downloads pause while the queue is full, so that downloading does not get
+	// far ahead of processing (and fill the disk) when the network is faster
+	// than the Pipeline. Defaults to ProcessingConcurrency.
+	DownloadQueueSize int
+
+	// The directory that result files are downloaded to, if they are queued for
+	// processing. Defaults to the default directory for temporary files.
+	DownloadDir string
+
+	// If true, result files are never written to disk: each file is streamed
+	// from the server directly into the Pipeline as it is downloaded, with only
+	// a single line of NDJSON buffered at a time. Up to DownloadConcurrency
+	// files are streamed at the same time, and ProcessingConcurrency,
+	// DownloadQueueSize and DownloadDir are ignored. This is for environments
+	// without the disk space to stage result files, at the cost of holding
+	// connections to the server open while the Pipeline is busy.
+	StreamWithoutStaging bool
+
+	// If non-nil, the ETag of each result file (if the server sends one) is
+	// saved to this store once a Run succeeds, and sent in an If-None-Match
+	// header when the same URL is downloaded by a later Run. Files which the
+	// server reports are not modified are skipped. Query strings are removed
+	// from URLs before they are used as keys, as these may hold credentials.
+	// This is for servers whose result URLs map to stable storage objects.
+	ETagStore bulkfhir.ETagStore
+
+	// If set, Run stops once this many resources have been passed to the
+	// Pipeline, or once the resources passed to the Pipeline total this many
+	// bytes of JSON, whichever comes first. No further result files are
+	// downloaded, the Pipeline is finalized so that sinks flush the resources
+	// already processed, and Run then returns an error wrapping ErrLimitReached
+	// (and Status reports PhaseLimitReached). As with an interruption, the
+	// transaction time and ETags are not stored. This bounds the cost of a
+	// fetch from a server with more data than expected. MaxBytes may be
+	// exceeded by up to the size of a single resource.
+	MaxResources int
+	MaxBytes     int64
+
+	// If true, Run handles SIGINT and SIGTERM by shutting down gracefully:
+	// downloads are cancelled, no further resources are passed to the Pipeline,
+	// and the Pipeline is finalized so that sinks flush the resources already
+	// processed. Run then returns an error wrapping ErrInterrupted, and the
+	// transaction time is not stored. A second signal terminates the process
+	// immediately. This is off by default, so that programs embedding the
+	// Fetcher keep control of signal handling.
+	HandleSignals bool
+
+	// If true, the Client is put in dry-run mode (see Client.SetDryRun) for the
+	// duration of Run, so that authentication is checked and the export request
+	// is built but not sent, and Run then returns without error. If JobURL is
+	// set, the results of the existing job are downloaded and processed as usual
+	// (the Pipeline should be created with PipelineOptions.DryRun). In both
+	// cases, neither the transaction time nor ETags are stored. The Client's
+	// previous mode is restored when Run returns.
+	DryRun bool
+
+	// If non-nil, progress updates for each result file are sent on this channel
+	// as the file is downloaded and processed. The consumer must keep receiving
+	// from the channel, as sends block. Run closes the channel before returning.
+	FileProgress chan<- FileProgress
+
+	// Set by MultiGroupFetcher, which shares a single Pipeline between several
+	// Fetchers running concurrently.
+	pipelineMu *sync.Mutex
+	attributes map[string]string
+
+	// jobURLs holds the jobs started for Patients, if there was more than one.
+	jobURLs []string
+
+	// etags holds the ETags of the result files downloaded, to be saved to
+	// ETagStore once the Run succeeds.
+	etagsMu sync.Mutex
+	etags   map[string]string
+
+	// status holds the progress of the Run, reported by Status.
+	status statusTracker
+
+	// limits counts the resources processed towards MaxResources and MaxBytes.
+	// It is shared between Fetchers by MultiGroupFetcher.
+	limits *limitTracker
 }
 
+// FileProgress reports the progress of downloading and processing a single
+// result file from a bulk FHIR export job.
+type FileProgress struct {
+	// The result file URL, as returned by the bulk FHIR server.
+	URL          string
+	ResourceType cpb.ResourceTypeCode_Value
+	// The number of resources from this file passed through the pipeline so far.
+	ResourcesProcessed int
+	// True if this is the final update for this file.
+	Complete bool
+	// Set (along with Complete) if processing the file failed.
+	Err error
+	// True (along with Complete) if the file was skipped, as the server
+	// reported it had not changed since a previous Run (see ETagStore).
+	NotModified bool
+}
+
+// fileProgressInterval is the number of resources processed between
+// intermediate FileProgress updates for a single file.
+const fileProgressInterval = 10000
+
 // Run the bulk FHIR fetch end-to-end. Note that while this does finalize the
-// configured processing pipeline, it does not close the bulk FHIR client.
+// configured processing pipeline, it does not close the bulk FHIR client. The
+// progress of the Run is reported by Status.
 func (f *Fetcher) Run(ctx context.Context) error {
+	f.status.start()
+	err := f.run(ctx)
+	f.status.finish(err)
+	return err
+}
+
+func (f *Fetcher) run(ctx context.Context) error {
 	f.setDefaultParameters()
+	f.limits = &limitTracker{}
+	if f.FileProgress != nil {
+		defer close(f.FileProgress)
+	}
 
-	if err := f.maybeStartJob(ctx); err != nil {
-		return err
+	// workCtx is cancelled by a shutdown signal if HandleSignals is set, while
+	// ctx is still used to flush the Pipeline afterwards.
+	workCtx := ctx
+	var sh *shutdownHandler
+	if f.HandleSignals {
+		workCtx, sh = handleShutdownSignals(ctx)
+		defer sh.stop()
 	}
 
-	jobStatus, err := f.waitForJob()
+	if f.DryRun {
+		// The Client belongs to the caller, so its previous mode is restored
+		// when Run returns.
+		defer f.Client.SetDryRun(f.Client.DryRun())
+		f.Client.SetDryRun(true)
+	}
+
+	if err := f.Client.AuthenticateIfNecessary(workCtx); err != nil {
+		return fmt.Errorf("failed to authenticate: %w", err)
+	}
+
+	f.status.setPhase(PhaseExporting)
+	if err := f.maybeStartJob(workCtx); err != nil {
+		if errors.Is(err, bulkfhir.ErrorDryRun) {
+			log.Infof("Dry run complete; the export was not started: %v", err)
+			return nil
+		}
+		return sh.wrap(err)
+	}
+
+	jobStatus, err := f.waitForJob(workCtx)
 	if err != nil {
-		return err
+		return sh.wrap(err)
 	}
 
 	f.TransactionTime.Set(jobStatus.TransactionTime)
 
-	if err := f.processData(ctx, jobStatus); err != nil {
+	if err := f.processData(ctx, workCtx, jobStatus, sh); err != nil {
 		return err
 	}
 
+	if f.DryRun {
+		log.Info("Dry run complete; the transaction time and ETags were not stored.")
+		return nil
+	}
+
 	if err := f.TransactionTimeStore.Store(ctx, jobStatus.TransactionTime); err != nil {
 		return fmt.Errorf("failed to store transaction timestamp: %v", err)
 	}
+	if err := f.storeETags(ctx); err != nil {
+		return err
+	}
 
 	log.Info("Bulk FHIR fetch job and processing complete.")
 	return nil
@@ -130,17 +332,26 @@ func (f *Fetcher) maybeStartJob(ctx context.Context) error {
 		return nil
 	}
 
+	if f.CheckCapabilities {
+		if err := f.Client.CheckCapabilities(ctx, f.ResourceTypes); err != nil {
+			return fmt.Errorf("server capability check failed: %w", err)
+		}
+	}
+
 	since, err := f.TransactionTimeStore.Load(ctx)
 	if err != nil {
 		// We match the text of ErrInvalidTransactionTime in tests; fmt.Errorf does
 		// not allow using multiple %w verbs.
 		return fmt.Errorf("%v: %w", ErrInvalidTransactionTime, err)
 	}
+	if len(f.Patients) > 0 {
+		return f.startPatientJobs(ctx, since)
+	}
 	if f.ExportGroup != "" {
-		f.JobURL, err = f.Client.StartBulkDataExport(f.ResourceTypes, since, f.ExportGroup)
+		f.JobURL, err = f.Client.StartBulkDataExport(ctx, f.ResourceTypes, since, f.ExportGroup)
 	} else {
 		log.Warning("No export Group ID set, so defaulting to the Patient endpoint to export all resources.")
-		f.JobURL, err = f.Client.StartBulkDataExportAll(f.ResourceTypes, since)
+		f.JobURL, err = f.Client.StartBulkDataExportAll(ctx, f.ResourceTypes, since)
 	}
 	if err != nil {
 		return fmt.Errorf("unable to start Bulk FHIR export job: %w", err)
@@ -149,15 +360,68 @@ func (f *Fetcher) maybeStartJob(ctx context.Context) error {
 	return nil
 }
 
-func (f *Fetcher) waitForJob() (bulkfhir.JobStatus, error) {
+// startPatientJobs starts the export jobs for Patients.
+func (f *Fetcher) startPatientJobs(ctx context.Context, since time.Time) error {
+	jobURLs, err := f.Client.StartBulkDataExportForPatients(ctx, f.ResourceTypes, since, f.ExportGroup, f.Patients, &bulkfhir.PatientExportOptions{MaxPatientsPerJob: f.MaxPatientsPerJob})
+	if err != nil {
+		return fmt.Errorf("unable to start Bulk FHIR export jobs for %d patients (%d jobs already started: %v): %w", len(f.Patients), len(jobURLs), jobURLs, err)
+	}
+	log.Infof("Started %d Bulk FHIR export jobs for %d patients: %v", len(jobURLs), len(f.Patients), jobURLs)
+	if len(jobURLs) == 1 {
+		f.JobURL = jobURLs[0]
+	} else {
+		f.jobURLs = jobURLs
+	}
+	return nil
+}
+
+// waitForJob waits for the export job (or all of the jobs started for
+// Patients) to complete, returning the status of the job, or the merged status
+// of all of the jobs.
+func (f *Fetcher) waitForJob(ctx context.Context) (bulkfhir.JobStatus, error) {
+	if len(f.jobURLs) == 0 {
+		return f.waitForJobURL(ctx, f.JobURL)
+	}
+	var statuses []bulkfhir.JobStatus
+	for _, jobURL := range f.jobURLs {
+		st, err := f.waitForJobURL(ctx, jobURL)
+		if err != nil {
+			return st, fmt.Errorf("job %s: %w", jobURL, err)
+		}
+		statuses = append(statuses, st)
+	}
+	return bulkfhir.MergeJobStatuses(statuses...), nil
+}
+
+func (f *Fetcher) waitForJobURL(ctx context.Context, jobURL string) (bulkfhir.JobStatus, error) {
 	start := time.Now()
+	results := f.Client.MonitorJobStatus(ctx, jobURL, f.JobStatusPeriod, f.JobStatusTimeout)
 	var monitorResult *bulkfhir.MonitorResult
-	for monitorResult = range f.Client.MonitorJobStatus(f.JobURL, f.JobStatusPeriod, f.JobStatusTimeout) {
+	for {
+		var r *bulkfhir.MonitorResult
+		var ok bool
+		select {
+		case r, ok = <-results:
+		case <-ctx.Done():
+			return bulkfhir.JobStatus{}, fmt.Errorf("stopped waiting for Bulk FHIR export job: %w", ctx.Err())
+		}
+		if !ok {
+			break
+		}
+		monitorResult = r
 		if monitorResult.Error != nil {
 			log.Errorf("error while checking job status: %v", monitorResult.Error)
+			f.status.addError(monitorResult.Error)
+		}
+		if monitorResult.Status.IsComplete {
+			f.status.setPercentComplete(100)
+		} else {
+			f.status.setPercentComplete(monitorResult.Status.PercentComplete)
 		}
 		if !monitorResult.Status.IsComplete {
-			if monitorResult.Status.PercentComplete >= 0 {
+			if monitorResult.EstimatedTimeRemaining > 0 {
+				log.Infof("Bulk FHIR export job pending, progress: %d, estimated time remaining: %s", monitorResult.Status.PercentComplete, monitorResult.EstimatedTimeRemaining.Round(time.Second))
+			} else if monitorResult.Status.PercentComplete >= 0 {
 				log.Infof("Bulk FHIR export job pending, progress: %d", monitorResult.Status.PercentComplete)
 			} else {
 				log.Info("Bulk FHIR export job pending, progress unknown")
@@ -175,21 +439,34 @@ func (f *Fetcher) waitForJob() (bulkfhir.JobStatus, error) {
 	return jobStatus, nil
 }
 
-func (f *Fetcher) processData(ctx context.Context, jobStatus bulkfhir.JobStatus) error {
+// processData downloads and processes the result files using workCtx, and
+// finalizes the Pipeline using ctx. If sh was interrupted while processing,
+// the Pipeline is still finalized, so that the resources already processed
+// are flushed.
+func (f *Fetcher) processData(ctx, workCtx context.Context, jobStatus bulkfhir.JobStatus, sh *shutdownHandler) error {
 	log.Infof("Starting data download and processing.")
+	f.status.setPhase(PhaseDownloading)
 	start := time.Now()
-	for resourceType, urls := range jobStatus.ResultURLs {
-		for _, url := range urls {
-			start := time.Now()
-			if err := f.processURL(ctx, resourceType, url); err != nil {
-				return err
-			}
-			if err := processURLTime.Record(ctx, float64(time.Since(start)/time.Minute)); err != nil {
-				return err
+	if err := f.processFiles(workCtx, jobStatus); err != nil {
+		if errors.Is(err, ErrLimitReached) {
+			log.Warningf("Finalizing the output pipeline after reaching a limit: %v", err)
+			f.status.setPhase(PhaseProcessing)
+			if err := f.Pipeline.Finalize(ctx); err != nil {
+				return fmt.Errorf("failed to finalize output pipeline after reaching a limit: %w", err)
 			}
+			return fmt.Errorf("%w: stopped after %s, with the output pipeline finalized", err, time.Since(start).Round(time.Second))
 		}
+		if !sh.wasInterrupted() {
+			return err
+		}
+		log.Warning("Finalizing the output pipeline after shutdown signal.")
+		if err := f.Pipeline.Finalize(ctx); err != nil {
+			return fmt.Errorf("%w: failed to finalize output pipeline: %w", ErrInterrupted, err)
+		}
+		return fmt.Errorf("%w: stopped after %s, with the output pipeline finalized", ErrInterrupted, time.Since(start).Round(time.Second))
 	}
 
+	f.status.setPhase(PhaseProcessing)
 	if err := f.Pipeline.Finalize(ctx); err != nil {
 		return fmt.Errorf("failed to finalize output pipeline: %w", err)
 	}
@@ -197,39 +474,209 @@ func (f *Fetcher) processData(ctx context.Context, jobStatus bulkfhir.JobStatus)
 	return nil
 }
 
-func (f *Fetcher) processURL(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, url string) error {
-	r, err := f.getDataWithRetries(url)
+// resultFile is a result file of the job to be downloaded and processed.
+type resultFile struct {
+	resourceType cpb.ResourceTypeCode_Value
+	url          string
+	// expectedCount is the number of resources the server reported the file
+	// holds, or -1 if it did not report a count.
+	expectedCount int
+}
+
+// processFiles downloads and processes all of the result files of the job,
+// without finalizing the pipeline.
+func (f *Fetcher) processFiles(ctx context.Context, jobStatus bulkfhir.JobStatus) error {
+	expectedCounts := map[string]int{}
+	for _, files := range jobStatus.OutputFiles {
+		for _, file := range files {
+			expectedCounts[file.URL] = file.Count
+		}
+	}
+	var files []resultFile
+	for resourceType, urls := range f.resultURLsToProcess(jobStatus) {
+		for _, url := range urls {
+			expectedCount, ok := expectedCounts[url]
+			if !ok {
+				expectedCount = -1
+			}
+			files = append(files, resultFile{resourceType: resourceType, url: url, expectedCount: expectedCount})
+		}
+	}
+	f.status.setFilesTotal(len(files))
+	if f.StreamWithoutStaging && f.DownloadConcurrency > 1 {
+		return f.streamFilesConcurrently(ctx, files)
+	}
+	if !f.StreamWithoutStaging && (f.DownloadConcurrency > 1 || f.ProcessingConcurrency > 1) {
+		return f.processFilesConcurrently(ctx, files)
+	}
+
+	for _, file := range files {
+		start := time.Now()
+		if err := f.processURL(ctx, file); err != nil {
+			return err
+		}
+		if err := processURLTime.Record(ctx, float64(time.Since(start)/time.Minute)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resultURLsToProcess returns the result URLs of the job, filtered to
+// ProcessResourceTypes if set.
+func (f *Fetcher) resultURLsToProcess(jobStatus bulkfhir.JobStatus) map[cpb.ResourceTypeCode_Value][]string {
+	if len(f.ProcessResourceTypes) == 0 {
+		return jobStatus.ResultURLs
+	}
+	resultURLs := map[cpb.ResourceTypeCode_Value][]string{}
+	for _, resourceType := range f.ProcessResourceTypes {
+		if urls := jobStatus.URLsForType(resourceType); len(urls) > 0 {
+			resultURLs[resourceType] = urls
+		}
+	}
+	for resourceType, urls := range jobStatus.ResultURLs {
+		if _, ok := resultURLs[resourceType]; !ok {
+			log.Infof("Skipping %d result files for unselected resource type %s", len(urls), resourceType)
+		}
+	}
+	return resultURLs
+}
+
+// processURL downloads and processes a single result file.
+func (f *Fetcher) processURL(ctx context.Context, file resultFile) error {
+	if err := f.limits.check(f.MaxResources, f.MaxBytes); err != nil {
+		return err
+	}
+	r, err := f.getData(ctx, file.url)
+	if errors.Is(err, bulkfhir.ErrorNotModified) {
+		f.skipNotModified(file)
+		return nil
+	}
 	if err != nil {
+		f.reportProgress(FileProgress{URL: file.url, ResourceType: file.resourceType, Complete: true, Err: err})
 		return err
 	}
 	defer r.Close()
+	// Closing the body unblocks any read in progress, so that a slow download
+	// stops promptly when ctx is cancelled.
+	defer context.AfterFunc(ctx, func() { r.Close() })()
+	return f.processFile(ctx, file, r)
+}
+
+// processFile processes the resources of a result file read from r, and
+// reports its final progress.
+func (f *Fetcher) processFile(ctx context.Context, file resultFile, r io.Reader) error {
+	processed := 0
+	err := f.processResources(ctx, file, r, &processed)
+	if err == nil && f.VerifyResourceCounts && file.expectedCount >= 0 && processed != file.expectedCount {
+		err = fmt.Errorf("%w: %s file %s contained %d resources, but the server reported %d", ErrResourceCountMismatch, file.resourceType, file.url, processed, file.expectedCount)
+		log.Errorf("%v", err)
+	}
+	f.reportProgress(FileProgress{URL: file.url, ResourceType: file.resourceType, ResourcesProcessed: processed, Complete: true, Err: err})
+	return err
+}
+
+func (f *Fetcher) processResources(ctx context.Context, file resultFile, r io.Reader, processed *int) error {
 	s := bufio.NewScanner(r)
 	// The default bufio.MaxScanTokenSize of 64kB is too small for some resources.
 	s.Buffer(make([]byte, initialBufferSize), maxTokenSize)
 	for s.Scan() {
-		if err := f.Pipeline.Process(ctx, resourceType, url, s.Bytes()); err != nil {
+		// Stop promptly if another file failed while processing files
+		// concurrently.
+		if err := ctx.Err(); err != nil {
 			return err
 		}
+		if err := f.processResource(ctx, file.resourceType, file.url, s.Bytes()); err != nil {
+			return err
+		}
+		*processed++
+		if *processed%fileProgressInterval == 0 {
+			f.reportProgress(FileProgress{URL: file.url, ResourceType: file.resourceType, ResourcesProcessed: *processed})
+		}
 	}
 	return s.Err()
 }
 
-func (f *Fetcher) getDataWithRetries(url string) (io.ReadCloser, error) {
-	r, err := f.Client.GetData(url)
-	numRetries := 0
-	// Retry both unauthorized and other retryable errors by re-authenticating,
-	// as sometimes they appear to be related.
-	for (errors.Is(err, bulkfhir.ErrorUnauthorized) || errors.Is(err, bulkfhir.ErrorRetryableHTTPStatus)) && numRetries < 5 {
-		time.Sleep(2 * time.Second)
-		log.Infof("Got retryable error from Bulk FHIR server. Re-authenticating and trying again.")
-		if err := f.Client.Authenticate(); err != nil {
-			return nil, fmt.Errorf("failed to authenticate: %w", err)
-		}
-		r, err = f.Client.GetData(url)
-		numRetries++
+func (f *Fetcher) processResource(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, url string, json []byte) error {
+	if f.pipelineMu != nil {
+		f.pipelineMu.Lock()
+		defer f.pipelineMu.Unlock()
+	}
+	if err := f.limits.check(f.MaxResources, f.MaxBytes); err != nil {
+		return err
+	}
+	if err := f.Pipeline.ProcessWithAttributes(ctx, resourceType, url, json, f.attributes); err != nil {
+		return err
+	}
+	f.status.addResource(resourceType)
+	f.limits.add(len(json))
+	return nil
+}
+
+func (f *Fetcher) reportProgress(p FileProgress) {
+	f.status.fileProgress(p)
+	if f.FileProgress != nil {
+		f.FileProgress <- p
+	}
+}
+
+func (f *Fetcher) getDataWithRetries(ctx context.Context, url string) (io.ReadCloser, error) {
+	return f.Client.GetDataWithRetries(ctx, url, f.DataRetryCount)
+}
+
+// getData downloads a result file. If ETagStore is set, the file's ETag from a
+// previous Run is sent, and ErrorNotModified is returned (wrapped) if the file
+// has not changed.
+func (f *Fetcher) getData(ctx context.Context, url string) (io.ReadCloser, error) {
+	if f.ETagStore == nil {
+		return f.getDataWithRetries(ctx, url)
+	}
+	key := etagKey(url)
+	etag, err := f.ETagStore.Load(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ETag for %s: %w", key, err)
 	}
+	r, newETag, err := f.Client.GetDataIfNoneMatch(ctx, url, etag, f.DataRetryCount)
 	if err != nil {
-		return nil, fmt.Errorf("failed to fetch data from %s: %w", url, err)
+		return nil, err
+	}
+	// Servers which do not send ETags are handled as if ETagStore was not set.
+	if newETag != "" {
+		f.etagsMu.Lock()
+		if f.etags == nil {
+			f.etags = map[string]string{}
+		}
+		f.etags[key] = newETag
+		f.etagsMu.Unlock()
 	}
 	return r, nil
 }
+
+// skipNotModified reports that a result file was skipped as it has not changed
+// since a previous Run.
+func (f *Fetcher) skipNotModified(file resultFile) {
+	log.Infof("Skipping %s result file %s, which has not changed since it was last processed.", file.resourceType, file.url)
+	f.reportProgress(FileProgress{URL: file.url, ResourceType: file.resourceType, Complete: true, NotModified: true})
+}
+
+// storeETags saves the ETags of the result files downloaded to ETagStore.
+func (f *Fetcher) storeETags(ctx context.Context) error {
+	if f.ETagStore == nil || len(f.etags) == 0 {
+		return nil
+	}
+	if err := f.ETagStore.Store(ctx, f.etags); err != nil {
+		return fmt.Errorf("failed to store ETags: %w", err)
+	}
+	return nil
+}
+
+// etagKey returns url without its query string, for use as an ETagStore key.
+func etagKey(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	u.RawQuery = ""
+	u.User = nil
+	return u.String()
+}
@@ -0,0 +1,688 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestFetcher_ProcessResourceTypes(t *testing.T) {
+	ctx := context.Background()
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/jobs/1":
+			fmt.Fprintf(w, `{"transactionTime": "2020-12-09T11:00:00.123+00:00", "output": [{"type": "Patient", "url": "%[1]s/data/patient"}, {"type": "Encounter", "url": "%[1]s/data/encounter"}]}`, server.URL)
+		case "/data/patient":
+			fmt.Fprint(w, `{"resourceType": "Patient", "id": "1"}`)
+		default:
+			t.Errorf("unexpected request to %s", req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := bulkfhir.NewClient(server.URL, noopAuthenticator{})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	ts := &processing.TestSink{}
+	pipeline, err := processing.NewPipeline(nil, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	f := &Fetcher{
+		Client:               client,
+		Pipeline:             pipeline,
+		TransactionTimeStore: &recordingTransactionTimeStore{},
+		TransactionTime:      bulkfhir.NewTransactionTime(),
+		JobURL:               server.URL + "/jobs/1",
+		ProcessResourceTypes: []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_OBSERVATION},
+		JobStatusPeriod:      10 * time.Millisecond,
+	}
+	if err := f.Run(ctx); err != nil {
+		t.Fatalf("Run() returned unexpected error: %v", err)
+	}
+	if len(ts.WrittenResources) != 1 || ts.WrittenResources[0].Type() != cpb.ResourceTypeCode_PATIENT {
+		t.Errorf("unexpected resources written. got: %v, want a single Patient", ts.WrittenResources)
+	}
+}
+
+func TestFetcher_DryRun(t *testing.T) {
+	cases := []struct {
+		name        string
+		existingJob bool
+		wantWritten map[cpb.ResourceTypeCode_Value]int
+	}{
+		{name: "NewJob"},
+		{name: "ExistingJob", existingJob: true, wantWritten: map[cpb.ResourceTypeCode_Value]int{cpb.ResourceTypeCode_PATIENT: 1}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				switch {
+				case tc.existingJob && req.URL.Path == "/jobs/1":
+					fmt.Fprintf(w, `{"transactionTime": "2020-12-09T11:00:00.123+00:00", "output": [{"type": "Patient", "url": "%s/data/patient"}]}`, server.URL)
+				case tc.existingJob && req.URL.Path == "/data/patient":
+					fmt.Fprint(w, `{"resourceType": "Patient", "id": "1"}`)
+				default:
+					t.Errorf("unexpected request to %s", req.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			client, err := bulkfhir.NewClient(server.URL, noopAuthenticator{})
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			pipeline, err := processing.NewPipelineWithOptions(nil, []processing.Sink{ts}, &processing.PipelineOptions{DryRun: true})
+			if err != nil {
+				t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+			}
+			store := &recordingTransactionTimeStore{}
+			f := &Fetcher{
+				Client:               client,
+				Pipeline:             pipeline,
+				TransactionTimeStore: store,
+				TransactionTime:      bulkfhir.NewTransactionTime(),
+				ExportGroup:          "mygroup",
+				JobStatusPeriod:      10 * time.Millisecond,
+				DryRun:               true,
+			}
+			if tc.existingJob {
+				f.JobURL = server.URL + "/jobs/1"
+			}
+			if err := f.Run(ctx); err != nil {
+				t.Fatalf("Run() returned unexpected error: %v", err)
+			}
+			if len(ts.WrittenResources) != 0 {
+				t.Errorf("unexpected number of resources written. got: %d, want: 0", len(ts.WrittenResources))
+			}
+			if got := pipeline.DryRunReport().Written; len(got) != len(tc.wantWritten) || got[cpb.ResourceTypeCode_PATIENT] != tc.wantWritten[cpb.ResourceTypeCode_PATIENT] {
+				t.Errorf("unexpected dry run counts of resources written. got: %v, want: %v", got, tc.wantWritten)
+			}
+			if !store.stored.IsZero() {
+				t.Errorf("transaction time %s stored in dry run", store.stored)
+			}
+			if client.DryRun() {
+				t.Error("Run() left the Client in dry-run mode")
+			}
+		})
+	}
+}
+
+func TestFetcher_PatientsSplitBetweenJobs(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	jobs := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.Method == http.MethodPost && req.URL.Path == "/Group/mygroup/$export":
+			mu.Lock()
+			jobs++
+			n := jobs
+			mu.Unlock()
+			w.Header().Set("Content-Location", fmt.Sprintf("%s/jobs/%d", server.URL, n))
+			w.WriteHeader(http.StatusAccepted)
+		case req.URL.Path == "/jobs/1":
+			fmt.Fprintf(w, `{"transactionTime": "2020-12-09T11:00:00.123+00:00", "output": [{"type": "Patient", "url": "%s/data/1"}]}`, server.URL)
+		case req.URL.Path == "/jobs/2":
+			fmt.Fprintf(w, `{"transactionTime": "2020-12-09T10:00:00.123+00:00", "output": [{"type": "Patient", "url": "%s/data/2"}]}`, server.URL)
+		case strings.HasPrefix(req.URL.Path, "/data/"):
+			fmt.Fprintf(w, `{"resourceType": "Patient", "id": "%s"}`, strings.TrimPrefix(req.URL.Path, "/data/"))
+		default:
+			t.Errorf("unexpected request to %s", req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := bulkfhir.NewClient(server.URL, noopAuthenticator{})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	ts := &processing.TestSink{}
+	pipeline, err := processing.NewPipeline(nil, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	store := &recordingTransactionTimeStore{}
+	f := &Fetcher{
+		Client:               client,
+		Pipeline:             pipeline,
+		TransactionTimeStore: store,
+		TransactionTime:      bulkfhir.NewTransactionTime(),
+		ExportGroup:          "mygroup",
+		Patients:             []string{"1", "2", "3"},
+		MaxPatientsPerJob:    2,
+		JobStatusPeriod:      10 * time.Millisecond,
+	}
+	if err := f.Run(ctx); err != nil {
+		t.Fatalf("Run() returned unexpected error: %v", err)
+	}
+	if jobs != 2 {
+		t.Errorf("unexpected number of export jobs started. got: %d, want: 2", jobs)
+	}
+	if len(ts.WrittenResources) != 2 {
+		t.Errorf("unexpected number of resources written. got: %d, want: 2", len(ts.WrittenResources))
+	}
+	// The earliest of the jobs' transaction times is stored.
+	wantTime := time.Date(2020, 12, 9, 10, 0, 0, 123000000, time.UTC)
+	if !store.stored.Equal(wantTime) {
+		t.Errorf("unexpected transaction time stored. got: %s, want: %s", store.stored, wantTime)
+	}
+}
+
+func TestFetcher_VerifyResourceCounts(t *testing.T) {
+	cases := []struct {
+		name          string
+		reportedCount string
+		verify        bool
+		wantErr       error
+	}{
+		{name: "Match", reportedCount: `, "count": 2`, verify: true},
+		{name: "Mismatch", reportedCount: `, "count": 3`, verify: true, wantErr: ErrResourceCountMismatch},
+		{name: "MismatchNotVerified", reportedCount: `, "count": 3`},
+		{name: "NoCountReported", verify: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				switch req.URL.Path {
+				case "/jobs/1":
+					fmt.Fprintf(w, `{"transactionTime": "2020-12-09T11:00:00.123+00:00", "output": [{"type": "Patient", "url": "%s/data/patient"%s}]}`, server.URL, tc.reportedCount)
+				case "/data/patient":
+					fmt.Fprint(w, `{"resourceType": "Patient", "id": "1"}`+"\n"+`{"resourceType": "Patient", "id": "2"}`)
+				default:
+					t.Errorf("unexpected request to %s", req.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			client, err := bulkfhir.NewClient(server.URL, noopAuthenticator{})
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+			pipeline, err := processing.NewPipeline(nil, []processing.Sink{&processing.TestSink{}})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			f := &Fetcher{
+				Client:               client,
+				Pipeline:             pipeline,
+				TransactionTimeStore: &recordingTransactionTimeStore{},
+				TransactionTime:      bulkfhir.NewTransactionTime(),
+				JobURL:               server.URL + "/jobs/1",
+				JobStatusPeriod:      10 * time.Millisecond,
+				VerifyResourceCounts: tc.verify,
+			}
+			if err := f.Run(ctx); !errors.Is(err, tc.wantErr) {
+				t.Errorf("Run() returned unexpected error. got: %v, want: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+// newMultiFileServer returns a server with a complete job at /jobs/1, with
+// numFiles Patient result files of two resources each.
+func newMultiFileServer(t *testing.T, numFiles int) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/jobs/1":
+			var output []string
+			for i := 0; i < numFiles; i++ {
+				output = append(output, fmt.Sprintf(`{"type": "Patient", "url": "%s/data/%d", "count": 2}`, server.URL, i))
+			}
+			fmt.Fprintf(w, `{"transactionTime": "2020-12-09T11:00:00.123+00:00", "output": [%s]}`, strings.Join(output, ","))
+		case strings.HasPrefix(req.URL.Path, "/data/"):
+			n := strings.TrimPrefix(req.URL.Path, "/data/")
+			fmt.Fprintf(w, `{"resourceType": "Patient", "id": "%[1]s-a"}`+"\n"+`{"resourceType": "Patient", "id": "%[1]s-b"}`, n)
+		default:
+			t.Errorf("unexpected request to %s", req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetcher_Concurrency(t *testing.T) {
+	ctx := context.Background()
+	const numFiles = 10
+	server := newMultiFileServer(t, numFiles)
+
+	client, err := bulkfhir.NewClient(server.URL, noopAuthenticator{})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	ts := &processing.TestSink{}
+	pipeline, err := processing.NewPipeline(nil, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	downloadDir := t.TempDir()
+	f := &Fetcher{
+		Client:                client,
+		Pipeline:              pipeline,
+		TransactionTimeStore:  &recordingTransactionTimeStore{},
+		TransactionTime:       bulkfhir.NewTransactionTime(),
+		JobURL:                server.URL + "/jobs/1",
+		JobStatusPeriod:       10 * time.Millisecond,
+		VerifyResourceCounts:  true,
+		DownloadConcurrency:   3,
+		ProcessingConcurrency: 2,
+		DownloadQueueSize:     1,
+		DownloadDir:           downloadDir,
+	}
+	if err := f.Run(ctx); err != nil {
+		t.Fatalf("Run() returned unexpected error: %v", err)
+	}
+	if len(ts.WrittenResources) != 2*numFiles {
+		t.Errorf("unexpected number of resources written. got: %d, want: %d", len(ts.WrittenResources), 2*numFiles)
+	}
+	// Downloaded files are removed once processed.
+	if entries, err := os.ReadDir(downloadDir); err != nil || len(entries) != 0 {
+		t.Errorf("unexpected files left in the download directory: %v (err: %v)", entries, err)
+	}
+}
+
+func TestFetcher_StreamWithoutStaging(t *testing.T) {
+	ctx := context.Background()
+	const numFiles = 10
+	server := newMultiFileServer(t, numFiles)
+
+	client, err := bulkfhir.NewClient(server.URL, noopAuthenticator{})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	ts := &processing.TestSink{}
+	pipeline, err := processing.NewPipeline(nil, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	f := &Fetcher{
+		Client:               client,
+		Pipeline:             pipeline,
+		TransactionTimeStore: &recordingTransactionTimeStore{},
+		TransactionTime:      bulkfhir.NewTransactionTime(),
+		JobURL:               server.URL + "/jobs/1",
+		JobStatusPeriod:      10 * time.Millisecond,
+		VerifyResourceCounts: true,
+		DownloadConcurrency:  3,
+		StreamWithoutStaging: true,
+		// Staging a file here would fail, as the directory does not exist.
+		DownloadDir: filepath.Join(t.TempDir(), "missing"),
+	}
+	if err := f.Run(ctx); err != nil {
+		t.Fatalf("Run() returned unexpected error: %v", err)
+	}
+	if len(ts.WrittenResources) != 2*numFiles {
+		t.Errorf("unexpected number of resources written. got: %d, want: %d", len(ts.WrittenResources), 2*numFiles)
+	}
+}
+
+// notifyingSink is a TestSink which sends on written after each Write.
+type notifyingSink struct {
+	processing.TestSink
+	written chan struct{}
+}
+
+func (ns *notifyingSink) Write(ctx context.Context, resource processing.ResourceWrapper) error {
+	if err := ns.TestSink.Write(ctx, resource); err != nil {
+		return err
+	}
+	ns.written <- struct{}{}
+	return nil
+}
+
+func TestFetcher_HandleSignals(t *testing.T) {
+	cases := []struct {
+		name                 string
+		downloadConcurrency  int
+		streamWithoutStaging bool
+	}{
+		{name: "Sequential"},
+		{name: "StreamWithoutStaging", downloadConcurrency: 2, streamWithoutStaging: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			release := make(chan struct{})
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				switch req.URL.Path {
+				case "/jobs/1":
+					fmt.Fprintf(w, `{"transactionTime": "2020-12-09T11:00:00.123+00:00", "output": [{"type": "Patient", "url": "%s/data/1"}]}`, server.URL)
+				case "/data/1":
+					// Send two resources, and then stall until the client goes away.
+					fmt.Fprint(w, `{"resourceType": "Patient", "id": "1"}`+"\n"+`{"resourceType": "Patient", "id": "2"}`+"\n")
+					w.(http.Flusher).Flush()
+					select {
+					case <-req.Context().Done():
+					case <-release:
+					}
+				default:
+					t.Errorf("unexpected request to %s", req.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+			defer close(release)
+
+			client, err := bulkfhir.NewClient(server.URL, noopAuthenticator{})
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+			sink := &notifyingSink{written: make(chan struct{}, 2)}
+			pipeline, err := processing.NewPipeline(nil, []processing.Sink{sink})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			store := &recordingTransactionTimeStore{}
+			f := &Fetcher{
+				Client:               client,
+				Pipeline:             pipeline,
+				TransactionTimeStore: store,
+				TransactionTime:      bulkfhir.NewTransactionTime(),
+				JobURL:               server.URL + "/jobs/1",
+				JobStatusPeriod:      10 * time.Millisecond,
+				DownloadConcurrency:  tc.downloadConcurrency,
+				StreamWithoutStaging: tc.streamWithoutStaging,
+				HandleSignals:        true,
+			}
+			runErr := make(chan error, 1)
+			go func() { runErr <- f.Run(ctx) }()
+
+			for i := 0; i < 2; i++ {
+				select {
+				case <-sink.written:
+				case err := <-runErr:
+					t.Fatalf("Run() returned before processing the resources sent: %v", err)
+				}
+			}
+			if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+				t.Fatalf("failed to send SIGINT: %v", err)
+			}
+
+			select {
+			case err := <-runErr:
+				if !errors.Is(err, ErrInterrupted) {
+					t.Errorf("Run() returned unexpected error. got: %v, want: %v", err, ErrInterrupted)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("Run() did not return after SIGINT")
+			}
+			if !sink.FinalizeCalled {
+				t.Error("pipeline was not finalized after SIGINT")
+			}
+			if len(sink.WrittenResources) != 2 {
+				t.Errorf("unexpected number of resources written. got: %d, want: 2", len(sink.WrittenResources))
+			}
+			if !store.stored.IsZero() {
+				t.Errorf("transaction time was stored after SIGINT: %v", store.stored)
+			}
+		})
+	}
+}
+
+func TestFetcher_Limits(t *testing.T) {
+	patient := `{"resourceType": "Patient", "id": "1"}`
+	cases := []struct {
+		name                string
+		maxResources        int
+		maxBytes            int64
+		downloadConcurrency int
+		wantWritten         int
+		wantLimitReached    bool
+		wantRequested       []string
+	}{
+		{name: "WithinFile", maxResources: 4, wantWritten: 4, wantLimitReached: true, wantRequested: []string{"/data/1", "/data/2"}},
+		{name: "AtEndOfFile", maxResources: 3, wantWritten: 3, wantLimitReached: true, wantRequested: []string{"/data/1"}},
+		{name: "NotReached", maxResources: 6, wantWritten: 6, wantRequested: []string{"/data/1", "/data/2"}},
+		{name: "MaxBytes", maxBytes: int64(2*len(patient) - 1), wantWritten: 2, wantLimitReached: true, wantRequested: []string{"/data/1"}},
+		{name: "Concurrent", maxResources: 4, downloadConcurrency: 2, wantWritten: 4, wantLimitReached: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			var mu sync.Mutex
+			var requested []string
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				switch req.URL.Path {
+				case "/jobs/1":
+					fmt.Fprintf(w, `{"transactionTime": "2020-12-09T11:00:00.123+00:00", "output": [{"type": "Patient", "url": "%[1]s/data/1"}, {"type": "Patient", "url": "%[1]s/data/2"}]}`, server.URL)
+				case "/data/1", "/data/2":
+					mu.Lock()
+					requested = append(requested, req.URL.Path)
+					mu.Unlock()
+					fmt.Fprint(w, strings.Repeat(patient+"\n", 3))
+				default:
+					t.Errorf("unexpected request to %s", req.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			client, err := bulkfhir.NewClient(server.URL, noopAuthenticator{})
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			pipeline, err := processing.NewPipeline(nil, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			store := &recordingTransactionTimeStore{}
+			f := &Fetcher{
+				Client:               client,
+				Pipeline:             pipeline,
+				TransactionTimeStore: store,
+				TransactionTime:      bulkfhir.NewTransactionTime(),
+				JobURL:               server.URL + "/jobs/1",
+				JobStatusPeriod:      10 * time.Millisecond,
+				DownloadConcurrency:  tc.downloadConcurrency,
+				DownloadDir:          t.TempDir(),
+				MaxResources:         tc.maxResources,
+				MaxBytes:             tc.maxBytes,
+			}
+			err = f.Run(ctx)
+			if tc.wantLimitReached {
+				if !errors.Is(err, ErrLimitReached) {
+					t.Errorf("Run() returned unexpected error. got: %v, want: %v", err, ErrLimitReached)
+				}
+				if !store.stored.IsZero() {
+					t.Errorf("transaction time was stored after reaching a limit: %v", store.stored)
+				}
+				if got := f.Status().Phase; got != PhaseLimitReached {
+					t.Errorf("unexpected Status().Phase. got: %s, want: %s", got, PhaseLimitReached)
+				}
+			} else if err != nil {
+				t.Errorf("Run() returned unexpected error: %v", err)
+			}
+			if !ts.FinalizeCalled {
+				t.Error("pipeline was not finalized")
+			}
+			if len(ts.WrittenResources) != tc.wantWritten {
+				t.Errorf("unexpected number of resources written. got: %d, want: %d", len(ts.WrittenResources), tc.wantWritten)
+			}
+			if tc.wantRequested != nil && !slices.Equal(requested, tc.wantRequested) {
+				t.Errorf("unexpected result files requested. got: %v, want: %v", requested, tc.wantRequested)
+			}
+		})
+	}
+}
+
+func TestFetcher_ETagStore(t *testing.T) {
+	cases := []struct {
+		name                string
+		downloadConcurrency int
+	}{
+		{name: "Sequential"},
+		{name: "Concurrent", downloadConcurrency: 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			run := 0
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				switch req.URL.Path {
+				case "/jobs/1":
+					// The signature of the result URLs changes between runs.
+					fmt.Fprintf(w, `{"transactionTime": "2020-12-09T11:00:00.123+00:00", "output": [{"type": "Patient", "url": "%[1]s/data/etag?sig=%[2]d"}, {"type": "Patient", "url": "%[1]s/data/plain?sig=%[2]d"}]}`, server.URL, run)
+				case "/data/etag":
+					if req.Header.Get("If-None-Match") == `"v1"` {
+						w.WriteHeader(http.StatusNotModified)
+						return
+					}
+					w.Header().Set("ETag", `"v1"`)
+					fmt.Fprint(w, `{"resourceType": "Patient", "id": "1"}`)
+				case "/data/plain":
+					fmt.Fprint(w, `{"resourceType": "Patient", "id": "2"}`)
+				default:
+					t.Errorf("unexpected request to %s", req.URL.Path)
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			client, err := bulkfhir.NewClient(server.URL, noopAuthenticator{})
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+			etags := bulkfhir.NewInMemoryETagStore()
+			// The unchanged file is skipped by the second run.
+			for _, want := range []struct{ written, notModified int }{{2, 0}, {1, 1}} {
+				run++
+				ts := &processing.TestSink{}
+				pipeline, err := processing.NewPipeline(nil, []processing.Sink{ts})
+				if err != nil {
+					t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+				}
+				progress := make(chan FileProgress)
+				notModified := make(chan int)
+				go func() {
+					n := 0
+					for p := range progress {
+						if p.NotModified {
+							n++
+						}
+					}
+					notModified <- n
+				}()
+				f := &Fetcher{
+					Client:               client,
+					Pipeline:             pipeline,
+					TransactionTimeStore: &recordingTransactionTimeStore{},
+					TransactionTime:      bulkfhir.NewTransactionTime(),
+					JobURL:               server.URL + "/jobs/1",
+					JobStatusPeriod:      10 * time.Millisecond,
+					DownloadConcurrency:  tc.downloadConcurrency,
+					DownloadDir:          t.TempDir(),
+					ETagStore:            etags,
+					FileProgress:         progress,
+				}
+				if err := f.Run(ctx); err != nil {
+					t.Fatalf("run %d: Run() returned unexpected error: %v", run, err)
+				}
+				if got := len(ts.WrittenResources); got != want.written {
+					t.Errorf("run %d: unexpected number of resources written. got: %d, want: %d", run, got, want.written)
+				}
+				if got := <-notModified; got != want.notModified {
+					t.Errorf("run %d: unexpected number of files not modified. got: %d, want: %d", run, got, want.notModified)
+				}
+			}
+			got, err := etags.Load(ctx, server.URL+"/data/etag")
+			if err != nil || got != `"v1"` {
+				t.Errorf("unexpected stored ETag. got: %q (err: %v), want: %q", got, err, `"v1"`)
+			}
+		})
+	}
+}
+
+func TestFetcher_DataRetryCount(t *testing.T) {
+	ctx := context.Background()
+	var mu sync.Mutex
+	dataRequests := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/jobs/1":
+			fmt.Fprintf(w, `{"transactionTime": "2020-12-09T11:00:00.123+00:00", "output": [{"type": "Patient", "url": "%s/data/patient"}]}`, server.URL)
+		case "/data/patient":
+			// Not Found is retried, as BCDA sometimes returns it for files which
+			// are not yet available.
+			mu.Lock()
+			dataRequests++
+			mu.Unlock()
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			t.Errorf("unexpected request to %s", req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := bulkfhir.NewClient(server.URL, noopAuthenticator{})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	pipeline, err := processing.NewPipeline(nil, []processing.Sink{&processing.TestSink{}})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	f := &Fetcher{
+		Client:               client,
+		Pipeline:             pipeline,
+		TransactionTimeStore: &recordingTransactionTimeStore{},
+		TransactionTime:      bulkfhir.NewTransactionTime(),
+		JobURL:               server.URL + "/jobs/1",
+		JobStatusPeriod:      10 * time.Millisecond,
+		DataRetryCount:       1,
+	}
+	if err := f.Run(ctx); !errors.Is(err, bulkfhir.ErrorRetryableHTTPStatus) {
+		t.Errorf("Run() returned unexpected error. got: %v, want: %v", err, bulkfhir.ErrorRetryableHTTPStatus)
+	}
+	if dataRequests != 2 {
+		t.Errorf("unexpected number of data requests. got: %d, want: 2", dataRequests)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// limitTracker counts the resources passed to the Pipeline, for enforcing
+// MaxResources and MaxBytes. It is safe for concurrent use, and the zero
+// value is ready for use. A nil *limitTracker enforces no limits.
+type limitTracker struct {
+	resources atomic.Int64
+	bytes     atomic.Int64
+}
+
+// add records that a resource of the given size has been processed.
+func (lt *limitTracker) add(size int) {
+	if lt == nil {
+		return
+	}
+	lt.resources.Add(1)
+	lt.bytes.Add(int64(size))
+}
+
+// check returns ErrLimitReached (wrapped) if either of the limits has been
+// reached, and so no further resources should be processed. It is called
+// before each resource, rather than after, so that a fetch which processes
+// exactly MaxResources resources is not reported as stopped. Limits which are
+// not positive are not enforced.
+func (lt *limitTracker) check(maxResources int, maxBytes int64) error {
+	if lt == nil {
+		return nil
+	}
+	if n := lt.resources.Load(); maxResources > 0 && n >= int64(maxResources) {
+		return fmt.Errorf("%w: processed %d resources (MaxResources is %d)", ErrLimitReached, n, maxResources)
+	}
+	if n := lt.bytes.Load(); maxBytes > 0 && n >= maxBytes {
+		return fmt.Errorf("%w: processed %d bytes of resources (MaxBytes is %d)", ErrLimitReached, n, maxBytes)
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// GroupAttribute is the ResourceWrapper attribute which MultiGroupFetcher sets
+// to the ID of the group each resource was exported for.
+const GroupAttribute = "group"
+
+const defaultMaxConcurrentJobs = 1
+
+// MultiGroupFetcher runs bulk FHIR exports for several groups, feeding the
+// results of all of them through a single shared Pipeline. The Client is used
+// from multiple goroutines, so its Authenticator must be safe for concurrent
+// use (as the Authenticators provided by the bulkfhir package are).
+type MultiGroupFetcher struct {
+	Client   *bulkfhir.Client
+	Pipeline *processing.Pipeline
+
+	// Groups to export, each mapped to the TransactionTimeStore used to load the
+	// _since timestamp for, and store the transaction time of, that group's
+	// export.
+	Groups map[string]bulkfhir.TransactionTimeStore
+
+	// If non-nil, this is set to the transaction time of the first export job to
+	// complete, before any data is processed. This may be used by pipeline steps
+	// which require a TransactionTime.
+	TransactionTime *bulkfhir.TransactionTime
+
+	// Resource types to request. May be empty.
+	ResourceTypes []cpb.ResourceTypeCode_Value
+
+	// If non-empty, only result files for these resource types are processed.
+	// See the equivalent Fetcher field.
+	ProcessResourceTypes []cpb.ResourceTypeCode_Value
+
+	// The following parameters may all be omitted, and sane defaults will be used.
+
+	// The maximum number of export jobs to run at the same time. Many servers
+	// limit the number of concurrent exports per client. Defaults to 1.
+	MaxConcurrentJobs int
+
+	// See the equivalent Fetcher fields.
+	JobStatusPeriod  time.Duration
+	JobStatusTimeout time.Duration
+	DataRetryCount   int
+
+	// See the equivalent Fetcher field.
+	VerifyResourceCounts bool
+
+	// See the equivalent Fetcher fields. The limits apply to each group's
+	// Fetcher separately.
+	DownloadConcurrency   int
+	ProcessingConcurrency int
+	DownloadQueueSize     int
+	DownloadDir           string
+	StreamWithoutStaging  bool
+
+	// See the equivalent Fetcher fields. The limits apply to the total number of
+	// resources processed for all groups. The exports for groups which are
+	// stopped at a limit fail with ErrLimitReached (in the GroupErrors
+	// returned), and their transaction times are not stored.
+	MaxResources int
+	MaxBytes     int64
+
+	// See the equivalent Fetcher field. ETags are stored for each group whose
+	// export succeeded.
+	ETagStore bulkfhir.ETagStore
+
+	// If true, Run handles SIGINT and SIGTERM by stopping the exports for all
+	// groups, and finalizing the Pipeline so that the resources already
+	// processed are flushed. The transaction times of groups whose exports had
+	// already completed are stored, and an error wrapping ErrInterrupted (and
+	// the GroupErrors of the stopped groups) is returned. See the equivalent
+	// Fetcher field.
+	HandleSignals bool
+}
+
+// GroupErrors is returned by MultiGroupFetcher.Run if the export for one or
+// more groups failed. It maps each failed group ID to the error encountered.
+type GroupErrors map[string]error
+
+func (ge GroupErrors) Error() string {
+	groups := make([]string, 0, len(ge))
+	for g := range ge {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	msgs := make([]string, 0, len(groups))
+	for _, g := range groups {
+		msgs = append(msgs, fmt.Sprintf("group %s: %v", g, ge[g]))
+	}
+	return fmt.Sprintf("bulk FHIR export failed for %d group(s): %s", len(ge), strings.Join(msgs, "; "))
+}
+
+// Unwrap allows errors.Is and errors.As to match any of the group errors.
+func (ge GroupErrors) Unwrap() []error {
+	errs := make([]error, 0, len(ge))
+	for _, err := range ge {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// Run the bulk FHIR exports for all groups end-to-end. Export jobs are started
+// and monitored concurrently (up to MaxConcurrentJobs at a time), and the
+// results of each are processed as soon as that job completes. Each resource
+// has the GroupAttribute set to the group it was exported for.
+//
+// A failure for one group does not stop the exports for other groups. Once all
+// exports have finished, the pipeline is finalized, and the transaction time is
+// stored for each group whose export succeeded. If any group failed, a
+// GroupErrors is returned. Note that resources from a group which failed part
+// way through processing may still have been written by the pipeline.
+func (m *MultiGroupFetcher) Run(ctx context.Context) error {
+	maxJobs := m.MaxConcurrentJobs
+	if maxJobs < 1 {
+		maxJobs = defaultMaxConcurrentJobs
+	}
+	sem := make(chan struct{}, maxJobs)
+
+	// workCtx is cancelled by a shutdown signal if HandleSignals is set, while
+	// ctx is still used to flush the Pipeline afterwards.
+	workCtx := ctx
+	var sh *shutdownHandler
+	if m.HandleSignals {
+		workCtx, sh = handleShutdownSignals(ctx)
+		defer sh.stop()
+	}
+
+	// mu guards the Pipeline, TransactionTime and the results below.
+	var mu sync.Mutex
+	groupErrs := GroupErrors{}
+	transactionTimes := map[string]time.Time{}
+	succeeded := map[string]*Fetcher{}
+	limits := &limitTracker{}
+
+	var wg sync.WaitGroup
+	for group, store := range m.Groups {
+		group, store := group, store
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-workCtx.Done():
+				mu.Lock()
+				groupErrs[group] = workCtx.Err()
+				mu.Unlock()
+				return
+			}
+			defer func() { <-sem }()
+
+			f := &Fetcher{
+				Client:                m.Client,
+				Pipeline:              m.Pipeline,
+				TransactionTimeStore:  store,
+				ResourceTypes:         m.ResourceTypes,
+				ProcessResourceTypes:  m.ProcessResourceTypes,
+				ExportGroup:           group,
+				JobStatusPeriod:       m.JobStatusPeriod,
+				JobStatusTimeout:      m.JobStatusTimeout,
+				DataRetryCount:        m.DataRetryCount,
+				VerifyResourceCounts:  m.VerifyResourceCounts,
+				DownloadConcurrency:   m.DownloadConcurrency,
+				ProcessingConcurrency: m.ProcessingConcurrency,
+				DownloadQueueSize:     m.DownloadQueueSize,
+				DownloadDir:           m.DownloadDir,
+				StreamWithoutStaging:  m.StreamWithoutStaging,
+				ETagStore:             m.ETagStore,
+				MaxResources:          m.MaxResources,
+				MaxBytes:              m.MaxBytes,
+				pipelineMu:            &mu,
+				limits:                limits,
+				attributes:            map[string]string{GroupAttribute: group},
+			}
+			tt, err := m.runGroup(workCtx, f, &mu)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Errorf("Bulk FHIR export for group %s failed: %v", group, err)
+				groupErrs[group] = err
+				return
+			}
+			transactionTimes[group] = tt
+			succeeded[group] = f
+		}()
+	}
+	wg.Wait()
+
+	if err := m.Pipeline.Finalize(ctx); err != nil {
+		return sh.wrap(fmt.Errorf("failed to finalize output pipeline: %w", err))
+	}
+
+	for group, tt := range transactionTimes {
+		if err := m.Groups[group].Store(ctx, tt); err != nil {
+			groupErrs[group] = fmt.Errorf("failed to store transaction timestamp: %w", err)
+			continue
+		}
+		if err := succeeded[group].storeETags(ctx); err != nil {
+			groupErrs[group] = err
+		}
+	}
+	if len(groupErrs) > 0 {
+		return sh.wrap(groupErrs)
+	}
+	log.Info("Bulk FHIR fetch jobs and processing complete for all groups.")
+	return nil
+}
+
+// runGroup starts, waits for and processes the export job for a single group,
+// returning the job's transaction time.
+func (m *MultiGroupFetcher) runGroup(ctx context.Context, f *Fetcher, mu *sync.Mutex) (time.Time, error) {
+	f.setDefaultParameters()
+	if err := f.maybeStartJob(ctx); err != nil {
+		return time.Time{}, err
+	}
+	jobStatus, err := f.waitForJob(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if m.TransactionTime != nil {
+		mu.Lock()
+		if _, err := m.TransactionTime.Get(); err != nil {
+			m.TransactionTime.Set(jobStatus.TransactionTime)
+		}
+		mu.Unlock()
+	}
+
+	if err := f.processFiles(ctx, jobStatus); err != nil {
+		return time.Time{}, err
+	}
+	return jobStatus.TransactionTime, nil
+}
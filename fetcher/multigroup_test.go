@@ -0,0 +1,235 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+type noopAuthenticator struct{}
+
+func (noopAuthenticator) Authenticate(ctx context.Context, hc *http.Client) error            { return nil }
+func (noopAuthenticator) AuthenticateIfNecessary(ctx context.Context, hc *http.Client) error { return nil }
+func (noopAuthenticator) AddAuthenticationToRequest(hc *http.Client, req *http.Request) error {
+	return nil
+}
+
+type recordingTransactionTimeStore struct {
+	stored time.Time
+}
+
+func (rtts *recordingTransactionTimeStore) Load(ctx context.Context) (time.Time, error) {
+	return time.Time{}, nil
+}
+
+func (rtts *recordingTransactionTimeStore) Store(ctx context.Context, ts time.Time) error {
+	rtts.stored = ts
+	return nil
+}
+
+// newMultiGroupTestServer returns a bulk FHIR server which exports one Patient
+// per group. Kick-off requests for the group "bad" fail. The returned function
+// reports the maximum number of jobs which were in progress at once.
+func newMultiGroupTestServer(t *testing.T) (*httptest.Server, func() int) {
+	t.Helper()
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+		switch {
+		case len(parts) == 3 && parts[0] == "Group" && parts[2] == "$export":
+			if parts[1] == "bad" {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			mu.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mu.Unlock()
+			w.Header().Set("Content-Location", server.URL+"/jobs/"+parts[1])
+			w.WriteHeader(http.StatusAccepted)
+		case len(parts) == 2 && parts[0] == "jobs":
+			// Keep the job in progress for a little while so that jobs overlap if
+			// they are run concurrently.
+			time.Sleep(50 * time.Millisecond)
+			fmt.Fprintf(w, `{"transactionTime": "2020-12-09T11:00:00.123+00:00", "output": [{"type": "Patient", "url": "%s/data/%s"}]}`, server.URL, parts[1])
+		case len(parts) == 2 && parts[0] == "data":
+			mu.Lock()
+			active--
+			mu.Unlock()
+			fmt.Fprintf(w, `{"resourceType": "Patient", "id": "%s"}`, parts[1])
+		default:
+			t.Errorf("unexpected request to %s", req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return maxActive
+	}
+}
+
+func TestMultiGroupFetcher(t *testing.T) {
+	cases := []struct {
+		name              string
+		maxConcurrentJobs int
+	}{
+		{name: "Serial", maxConcurrentJobs: 1},
+		{name: "Concurrent", maxConcurrentJobs: 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			server, maxActive := newMultiGroupTestServer(t)
+			defer server.Close()
+
+			client, err := bulkfhir.NewClient(server.URL, noopAuthenticator{})
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			pipeline, err := processing.NewPipeline(nil, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			stores := map[string]*recordingTransactionTimeStore{"g1": {}, "g2": {}, "g3": {}, "bad": {}}
+			groups := map[string]bulkfhir.TransactionTimeStore{}
+			for g, s := range stores {
+				groups[g] = s
+			}
+			transactionTime := bulkfhir.NewTransactionTime()
+
+			m := &MultiGroupFetcher{
+				Client:            client,
+				Pipeline:          pipeline,
+				Groups:            groups,
+				TransactionTime:   transactionTime,
+				MaxConcurrentJobs: tc.maxConcurrentJobs,
+				JobStatusPeriod:   10 * time.Millisecond,
+			}
+			err = m.Run(ctx)
+
+			var groupErrs GroupErrors
+			if !errors.As(err, &groupErrs) {
+				t.Fatalf("Run() returned unexpected error. got: %v, want GroupErrors", err)
+			}
+			if len(groupErrs) != 1 || !errors.Is(groupErrs["bad"], bulkfhir.ErrorUnexpectedStatusCode) {
+				t.Errorf("Run() returned unexpected group errors. got: %v, want error for group bad only", groupErrs)
+			}
+			if !errors.Is(err, bulkfhir.ErrorUnexpectedStatusCode) {
+				t.Errorf("errors.Is(%v, %v) = false, want true", err, bulkfhir.ErrorUnexpectedStatusCode)
+			}
+
+			if !ts.FinalizeCalled {
+				t.Errorf("pipeline was not finalized")
+			}
+			gotGroups := map[string]string{}
+			for _, r := range ts.WrittenResources {
+				group, ok := processing.ResourceAttribute(r, GroupAttribute)
+				if !ok {
+					t.Errorf("resource from %s has no group attribute", r.SourceURL())
+				}
+				gotGroups[r.SourceURL()] = group
+			}
+			wantGroups := map[string]string{
+				server.URL + "/data/g1": "g1",
+				server.URL + "/data/g2": "g2",
+				server.URL + "/data/g3": "g3",
+			}
+			if diff := cmp.Diff(wantGroups, gotGroups); diff != "" {
+				t.Errorf("unexpected resources written (-want +got):\n%s", diff)
+			}
+
+			wantTime := time.Date(2020, 12, 9, 11, 0, 0, 123000000, time.UTC)
+			for g, s := range stores {
+				want := wantTime
+				if g == "bad" {
+					want = time.Time{}
+				}
+				if !cmp.Equal(s.stored, want, cmpopts.EquateApproxTime(0)) {
+					t.Errorf("unexpected transaction time stored for group %s. got: %v, want: %v", g, s.stored, want)
+				}
+			}
+			if got, err := transactionTime.Get(); err != nil || !got.Equal(wantTime) {
+				t.Errorf("TransactionTime.Get() = %v, %v, want %v, nil", got, err, wantTime)
+			}
+
+			if got := maxActive(); got > tc.maxConcurrentJobs {
+				t.Errorf("up to %d jobs ran concurrently, want at most %d", got, tc.maxConcurrentJobs)
+			}
+		})
+	}
+}
+
+func TestMultiGroupFetcher_MaxResources(t *testing.T) {
+	ctx := context.Background()
+	server, _ := newMultiGroupTestServer(t)
+	defer server.Close()
+
+	client, err := bulkfhir.NewClient(server.URL, noopAuthenticator{})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	ts := &processing.TestSink{}
+	pipeline, err := processing.NewPipeline(nil, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	stores := map[string]*recordingTransactionTimeStore{"g1": {}, "g2": {}, "g3": {}}
+	groups := map[string]bulkfhir.TransactionTimeStore{}
+	for g, s := range stores {
+		groups[g] = s
+	}
+	m := &MultiGroupFetcher{
+		Client:          client,
+		Pipeline:        pipeline,
+		Groups:          groups,
+		JobStatusPeriod: 10 * time.Millisecond,
+		MaxResources:    2,
+	}
+	err = m.Run(ctx)
+	var groupErrs GroupErrors
+	if !errors.As(err, &groupErrs) || len(groupErrs) != 1 || !errors.Is(err, ErrLimitReached) {
+		t.Fatalf("Run() returned unexpected error. got: %v, want GroupErrors for one group wrapping %v", err, ErrLimitReached)
+	}
+	if len(ts.WrittenResources) != 2 {
+		t.Errorf("unexpected number of resources written. got: %d, want: 2", len(ts.WrittenResources))
+	}
+	if !ts.FinalizeCalled {
+		t.Error("pipeline was not finalized")
+	}
+	for g, s := range stores {
+		if _, failed := groupErrs[g]; failed != s.stored.IsZero() {
+			t.Errorf("group %s: transaction time stored: %v, but group failed: %v", g, !s.stored.IsZero(), failed)
+		}
+	}
+}
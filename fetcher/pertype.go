@@ -0,0 +1,214 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// TypeSchedule is a set of resource types synced on the same cadence by
+// PerTypeFetcher.
+type TypeSchedule struct {
+	ResourceTypes []cpb.ResourceTypeCode_Value
+	// The minimum time between syncs of each of the resource types. A type is
+	// exported by a Run if its transaction time was stored at least Interval
+	// before the Run (or has never been stored). If zero, the types are
+	// exported by every Run.
+	Interval time.Duration
+}
+
+// PerTypeFetcher runs incremental bulk FHIR exports in which each resource type
+// has its own _since watermark, so that resource types can be synced on
+// different cadences (for example, Patients daily and ExplanationOfBenefits
+// weekly), avoiding re-exporting slow-changing types as often as fast-changing
+// ones.
+type PerTypeFetcher struct {
+	Client   *bulkfhir.Client
+	Pipeline *processing.Pipeline
+
+	// Store holds the transaction time of each (ExportGroup, resource type),
+	// which is used as the _since parameter for that type's next export.
+	Store bulkfhir.KeyedTransactionTimeStore
+
+	// The resource types to sync, and how often.
+	Schedules []TypeSchedule
+
+	// Group to export. If empty, defaults to exporting data for all patients.
+	ExportGroup string
+
+	// If non-nil, this is set to the transaction time of the first export job to
+	// complete, before any data is processed. This may be used by pipeline steps
+	// which require a TransactionTime.
+	TransactionTime *bulkfhir.TransactionTime
+
+	// The following parameters may all be omitted, and sane defaults will be used.
+
+	// See the equivalent Fetcher fields.
+	JobStatusPeriod  time.Duration
+	JobStatusTimeout time.Duration
+	DataRetryCount   int
+
+	// now returns the current time, and is overridden in tests.
+	now func() time.Time
+}
+
+// typeExport is a single _type-scoped export run by PerTypeFetcher.
+type typeExport struct {
+	resourceTypes []cpb.ResourceTypeCode_Value
+	since         time.Time
+}
+
+func (te typeExport) String() string {
+	names := make([]string, 0, len(te.resourceTypes))
+	for _, rt := range te.resourceTypes {
+		name, _ := bulkfhir.ResourceTypeCodeToName(rt)
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
+
+// Run the exports for the resource types which are due to be synced. The
+// types of each TypeSchedule which are due and have the same transaction time
+// are exported together, with a single _type-scoped export job using that
+// transaction time as _since. Jobs are run one at a time, and only the result
+// files for the requested types are processed.
+//
+// A failure for one export does not stop the others. Once all exports have
+// finished, the pipeline is finalized, and the transaction time of each
+// export which succeeded is stored for each of its resource types, so that
+// each type's watermark only advances once its data has been processed. If
+// any export failed, an error describing each failure is returned.
+func (p *PerTypeFetcher) Run(ctx context.Context) error {
+	exports, err := p.dueExports(ctx)
+	if err != nil {
+		return err
+	}
+	if len(exports) == 0 {
+		log.Info("No resource types are due to be synced.")
+	}
+
+	var errs []error
+	succeeded := map[bulkfhir.TransactionTimeKey]time.Time{}
+	for _, export := range exports {
+		log.Infof("Exporting %s resources for group %q since %s.", export, p.ExportGroup, export.since)
+		tt, err := p.runExport(ctx, export)
+		if err != nil {
+			log.Errorf("Bulk FHIR export of %s resources failed: %v", export, err)
+			errs = append(errs, fmt.Errorf("resource types %s: %w", export, err))
+			continue
+		}
+		for _, rt := range export.resourceTypes {
+			succeeded[bulkfhir.TransactionTimeKey{Group: p.ExportGroup, ResourceType: rt}] = tt
+		}
+	}
+
+	if err := p.Pipeline.Finalize(ctx); err != nil {
+		return fmt.Errorf("failed to finalize output pipeline: %w", err)
+	}
+	if len(succeeded) > 0 {
+		if err := p.Store.Store(ctx, succeeded); err != nil {
+			return fmt.Errorf("failed to store transaction timestamps: %w", err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("bulk FHIR export failed for %d of %d export(s): %w", len(errs), len(exports), errors.Join(errs...))
+	}
+	log.Info("Bulk FHIR fetch jobs and processing complete for all resource types due to be synced.")
+	return nil
+}
+
+// dueExports returns the exports to run for the resource types which are due
+// to be synced.
+func (p *PerTypeFetcher) dueExports(ctx context.Context) ([]typeExport, error) {
+	now := time.Now()
+	if p.now != nil {
+		now = p.now()
+	}
+	var exports []typeExport
+	for _, schedule := range p.Schedules {
+		bySince := map[time.Time]*typeExport{}
+		for _, rt := range schedule.ResourceTypes {
+			since, err := p.Store.Load(ctx, bulkfhir.TransactionTimeKey{Group: p.ExportGroup, ResourceType: rt})
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrInvalidTransactionTime, err)
+			}
+			if !since.IsZero() && now.Sub(since) < schedule.Interval {
+				continue
+			}
+			since = since.UTC()
+			if bySince[since] == nil {
+				bySince[since] = &typeExport{since: since}
+			}
+			bySince[since].resourceTypes = append(bySince[since].resourceTypes, rt)
+		}
+		var scheduleExports []typeExport
+		for _, export := range bySince {
+			scheduleExports = append(scheduleExports, *export)
+		}
+		sort.Slice(scheduleExports, func(i, j int) bool { return scheduleExports[i].since.Before(scheduleExports[j].since) })
+		exports = append(exports, scheduleExports...)
+	}
+	return exports, nil
+}
+
+// runExport starts, waits for and processes a single export job, returning
+// the job's transaction time.
+func (p *PerTypeFetcher) runExport(ctx context.Context, export typeExport) (time.Time, error) {
+	keys := make([]bulkfhir.TransactionTimeKey, 0, len(export.resourceTypes))
+	for _, rt := range export.resourceTypes {
+		keys = append(keys, bulkfhir.TransactionTimeKey{Group: p.ExportGroup, ResourceType: rt})
+	}
+	// The Fetcher only loads the _since timestamp; the transaction time is
+	// stored by Run once the pipeline has been finalized.
+	f := &Fetcher{
+		Client:               p.Client,
+		Pipeline:             p.Pipeline,
+		TransactionTimeStore: bulkfhir.TransactionTimeStoreForKeys(p.Store, keys...),
+		ResourceTypes:        export.resourceTypes,
+		ProcessResourceTypes: export.resourceTypes,
+		ExportGroup:          p.ExportGroup,
+		JobStatusPeriod:      p.JobStatusPeriod,
+		JobStatusTimeout:     p.JobStatusTimeout,
+		DataRetryCount:       p.DataRetryCount,
+	}
+	f.setDefaultParameters()
+	if err := f.maybeStartJob(ctx); err != nil {
+		return time.Time{}, err
+	}
+	jobStatus, err := f.waitForJob(ctx)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if p.TransactionTime != nil {
+		if _, err := p.TransactionTime.Get(); err != nil {
+			p.TransactionTime.Set(jobStatus.TransactionTime)
+		}
+	}
+	if err := f.processFiles(ctx, jobStatus); err != nil {
+		return time.Time{}, err
+	}
+	return jobStatus.TransactionTime, nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// newPerTypeTestServer returns a bulk FHIR server whose export jobs have one
+// result file for each requested type, and an Observation file which was not
+// requested. Exports of Coverage fail. The returned function reports the
+// _type and _since parameters of each kick-off request.
+func newPerTypeTestServer(t *testing.T) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var kickoffs []string
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch {
+		case req.URL.Path == "/Group/g1/$export":
+			types, since := req.URL.Query().Get("_type"), req.URL.Query().Get("_since")
+			mu.Lock()
+			kickoffs = append(kickoffs, fmt.Sprintf("_type=%s _since=%s", types, since))
+			mu.Unlock()
+			if strings.Contains(types, "Coverage") {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Location", server.URL+"/jobs?types="+url.QueryEscape(types))
+			w.WriteHeader(http.StatusAccepted)
+		case req.URL.Path == "/jobs":
+			var output []string
+			for _, rt := range strings.Split(req.URL.Query().Get("types")+",Observation", ",") {
+				output = append(output, fmt.Sprintf(`{"type": "%s", "url": "%s/data/%s"}`, rt, server.URL, rt))
+			}
+			fmt.Fprintf(w, `{"transactionTime": "2020-12-09T11:00:00.000+00:00", "output": [%s]}`, strings.Join(output, ","))
+		case strings.HasPrefix(req.URL.Path, "/data/"):
+			rt := strings.TrimPrefix(req.URL.Path, "/data/")
+			fmt.Fprintf(w, `{"resourceType": "%s", "id": "1"}`, rt)
+		default:
+			t.Errorf("unexpected request to %s", req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return kickoffs
+	}
+}
+
+func TestPerTypeFetcher(t *testing.T) {
+	ctx := context.Background()
+	server, kickoffs := newPerTypeTestServer(t)
+	defer server.Close()
+
+	client, err := bulkfhir.NewClient(server.URL, noopAuthenticator{})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	ts := &processing.TestSink{}
+	pipeline, err := processing.NewPipeline(nil, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+
+	now := time.Date(2020, 12, 10, 0, 0, 0, 0, time.UTC)
+	key := func(rt cpb.ResourceTypeCode_Value) bulkfhir.TransactionTimeKey {
+		return bulkfhir.TransactionTimeKey{Group: "g1", ResourceType: rt}
+	}
+	store := bulkfhir.NewInMemoryKeyedTransactionTimeStore()
+	err = store.Store(ctx, map[bulkfhir.TransactionTimeKey]time.Time{
+		// Synced 2 days ago, so due for a daily sync.
+		key(cpb.ResourceTypeCode_PATIENT):   now.Add(-48 * time.Hour),
+		key(cpb.ResourceTypeCode_ENCOUNTER): now.Add(-48 * time.Hour),
+		// Synced 2 days ago, so not due for a weekly sync.
+		key(cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT): now.Add(-48 * time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("Store() returned unexpected error: %v", err)
+	}
+
+	f := &PerTypeFetcher{
+		Client:      client,
+		Pipeline:    pipeline,
+		Store:       store,
+		ExportGroup: "g1",
+		Schedules: []TypeSchedule{
+			{ResourceTypes: []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_ENCOUNTER, cpb.ResourceTypeCode_PRACTITIONER}, Interval: 24 * time.Hour},
+			{ResourceTypes: []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, cpb.ResourceTypeCode_COVERAGE}, Interval: 7 * 24 * time.Hour},
+		},
+		JobStatusPeriod: 10 * time.Millisecond,
+		now:             func() time.Time { return now },
+	}
+	err = f.Run(ctx)
+	if err == nil || !strings.Contains(err.Error(), "Coverage") {
+		t.Errorf("Run() returned unexpected error: %v, want an error for the failed Coverage export", err)
+	}
+
+	// Types with the same transaction time are exported together, and
+	// Practitioner and Coverage, which have never been synced, are exported
+	// without _since.
+	wantKickoffs := []string{
+		"_type=Practitioner _since=",
+		"_type=Patient,Encounter _since=2020-12-08T00:00:00.000+00:00",
+		"_type=Coverage _since=",
+	}
+	if diff := cmp.Diff(wantKickoffs, kickoffs()); diff != "" {
+		t.Errorf("unexpected kick-off requests (-want +got):\n%s", diff)
+	}
+
+	var gotTypes []string
+	for _, r := range ts.WrittenResources {
+		gotTypes = append(gotTypes, r.Type().String())
+	}
+	sort.Strings(gotTypes)
+	if diff := cmp.Diff([]string{"ENCOUNTER", "PATIENT", "PRACTITIONER"}, gotTypes); diff != "" {
+		t.Errorf("unexpected resource types written (-want +got):\n%s", diff)
+	}
+	if !ts.FinalizeCalled {
+		t.Error("Run() did not finalize the pipeline")
+	}
+
+	transactionTime := time.Date(2020, 12, 9, 11, 0, 0, 0, time.UTC)
+	for rt, want := range map[cpb.ResourceTypeCode_Value]time.Time{
+		cpb.ResourceTypeCode_PATIENT:                transactionTime,
+		cpb.ResourceTypeCode_ENCOUNTER:              transactionTime,
+		cpb.ResourceTypeCode_PRACTITIONER:           transactionTime,
+		cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT: now.Add(-48 * time.Hour),
+		cpb.ResourceTypeCode_COVERAGE:               {},
+	} {
+		got, err := store.Load(ctx, key(rt))
+		if err != nil {
+			t.Fatalf("Load(%s) returned unexpected error: %v", rt, err)
+		}
+		if !got.Equal(want) {
+			t.Errorf("unexpected transaction time stored for %s. got: %s, want: %s", rt, got, want)
+		}
+	}
+}
+
+type failingKeyedTransactionTimeStore struct{}
+
+func (failingKeyedTransactionTimeStore) Load(ctx context.Context, key bulkfhir.TransactionTimeKey) (time.Time, error) {
+	return time.Time{}, errors.New("load failed")
+}
+
+func (failingKeyedTransactionTimeStore) Store(ctx context.Context, timestamps map[bulkfhir.TransactionTimeKey]time.Time) error {
+	return nil
+}
+
+func TestPerTypeFetcher_LoadError(t *testing.T) {
+	f := &PerTypeFetcher{
+		Store:     failingKeyedTransactionTimeStore{},
+		Schedules: []TypeSchedule{{ResourceTypes: []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT}}},
+	}
+	if err := f.Run(context.Background()); !errors.Is(err, ErrInvalidTransactionTime) {
+		t.Errorf("Run() returned unexpected error. got: %v, want: %v", err, ErrInvalidTransactionTime)
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// downloadedFile is a result file which has been downloaded to a temporary
+// file, and is waiting to be processed.
+type downloadedFile struct {
+	file  resultFile
+	path  string
+	start time.Time
+}
+
+// processFilesConcurrently downloads result files with DownloadConcurrency
+// workers, and processes them with ProcessingConcurrency workers. Downloaded
+// files are held in a queue of DownloadQueueSize files between the two stages,
+// and downloads block while the queue is full. The first error stops all
+// workers, and is returned once they have exited.
+func (f *Fetcher) processFilesConcurrently(ctx context.Context, files []resultFile) error {
+	downloaders := max(f.DownloadConcurrency, 1)
+	processors := max(f.ProcessingConcurrency, 1)
+	queueSize := f.DownloadQueueSize
+	if queueSize <= 0 {
+		queueSize = processors
+	}
+	// The Pipeline is not safe for concurrent use. MultiGroupFetcher sets its own
+	// mutex shared between Fetchers.
+	if f.pipelineMu == nil {
+		f.pipelineMu = &sync.Mutex{}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := &firstError{cancel: cancel}
+	toDownload := feedFiles(ctx, files)
+
+	queue := make(chan downloadedFile, queueSize)
+	var downloadWG sync.WaitGroup
+	for i := 0; i < downloaders; i++ {
+		downloadWG.Add(1)
+		go func() {
+			defer downloadWG.Done()
+			for file := range toDownload {
+				df, err := f.download(ctx, file)
+				if errors.Is(err, bulkfhir.ErrorNotModified) {
+					f.skipNotModified(file)
+					continue
+				}
+				if err != nil {
+					f.reportProgress(FileProgress{URL: file.url, ResourceType: file.resourceType, Complete: true, Err: err})
+					errs.set(err)
+					return
+				}
+				select {
+				case queue <- df:
+				case <-ctx.Done():
+					removeDownload(df.path)
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		downloadWG.Wait()
+		close(queue)
+	}()
+
+	var processWG sync.WaitGroup
+	for i := 0; i < processors; i++ {
+		processWG.Add(1)
+		go func() {
+			defer processWG.Done()
+			for df := range queue {
+				// Keep draining the queue after an error, so that downloaded files are
+				// removed.
+				if ctx.Err() == nil {
+					if err := f.processDownload(ctx, df); err != nil {
+						errs.set(err)
+					}
+				}
+				removeDownload(df.path)
+			}
+		}()
+	}
+	processWG.Wait()
+
+	return errs.get(ctx)
+}
+
+// streamFilesConcurrently streams result files into the Pipeline with
+// DownloadConcurrency workers, without staging them on disk. The first error
+// stops all workers, and is returned once they have exited.
+func (f *Fetcher) streamFilesConcurrently(ctx context.Context, files []resultFile) error {
+	if f.pipelineMu == nil {
+		f.pipelineMu = &sync.Mutex{}
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := &firstError{cancel: cancel}
+	toStream := feedFiles(ctx, files)
+
+	var wg sync.WaitGroup
+	for i := 0; i < f.DownloadConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range toStream {
+				start := time.Now()
+				if err := f.processURL(ctx, file); err != nil {
+					errs.set(err)
+					return
+				}
+				if err := processURLTime.Record(ctx, float64(time.Since(start)/time.Minute)); err != nil {
+					errs.set(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return errs.get(ctx)
+}
+
+// feedFiles returns a channel which is sent each of files in turn, and closed
+// once they have all been sent or ctx is done.
+func feedFiles(ctx context.Context, files []resultFile) <-chan resultFile {
+	ch := make(chan resultFile)
+	go func() {
+		defer close(ch)
+		for _, file := range files {
+			select {
+			case ch <- file:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// firstError records the first error from a group of workers, and cancels
+// their context so that the others stop.
+type firstError struct {
+	cancel context.CancelFunc
+	once   sync.Once
+	err    error
+}
+
+func (fe *firstError) set(err error) {
+	fe.once.Do(func() {
+		fe.err = err
+		fe.cancel()
+	})
+}
+
+// get returns the first error, or the error of ctx if it was cancelled without
+// any worker failing. It must only be called once all workers have exited.
+func (fe *firstError) get(ctx context.Context) error {
+	if fe.err != nil {
+		return fe.err
+	}
+	return ctx.Err()
+}
+
+// download downloads a result file to a temporary file in DownloadDir.
+func (f *Fetcher) download(ctx context.Context, file resultFile) (downloadedFile, error) {
+	if err := f.limits.check(f.MaxResources, f.MaxBytes); err != nil {
+		return downloadedFile{}, err
+	}
+	start := time.Now()
+	r, err := f.getData(ctx, file.url)
+	if err != nil {
+		return downloadedFile{}, err
+	}
+	defer r.Close()
+	defer context.AfterFunc(ctx, func() { r.Close() })()
+	tmp, err := os.CreateTemp(f.DownloadDir, "bulk_fhir_download_*.ndjson")
+	if err != nil {
+		return downloadedFile{}, fmt.Errorf("failed to create file to download %s to: %w", file.url, err)
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		err = errors.Join(err, tmp.Close())
+		removeDownload(tmp.Name())
+		return downloadedFile{}, fmt.Errorf("failed to download %s: %w", file.url, err)
+	}
+	if err := tmp.Close(); err != nil {
+		removeDownload(tmp.Name())
+		return downloadedFile{}, fmt.Errorf("failed to download %s: %w", file.url, err)
+	}
+	return downloadedFile{file: file, path: tmp.Name(), start: start}, nil
+}
+
+// processDownload processes a downloaded result file, and records the time
+// since its download started.
+func (f *Fetcher) processDownload(ctx context.Context, df downloadedFile) error {
+	r, err := os.Open(df.path)
+	if err != nil {
+		f.reportProgress(FileProgress{URL: df.file.url, ResourceType: df.file.resourceType, Complete: true, Err: err})
+		return err
+	}
+	defer r.Close()
+	if err := f.processFile(ctx, df.file, r); err != nil {
+		return err
+	}
+	return processURLTime.Record(ctx, float64(time.Since(df.start)/time.Minute))
+}
+
+func removeDownload(path string) {
+	if err := os.Remove(path); err != nil {
+		log.Warningf("failed to remove downloaded file %s: %v", path, err)
+	}
+}
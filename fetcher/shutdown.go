@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// shutdownSignals are the signals handled when HandleSignals is set.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// shutdownHandler cancels a context when the process receives one of
+// shutdownSignals. A nil *shutdownHandler is never interrupted.
+type shutdownHandler struct {
+	sigs        chan os.Signal
+	done        chan struct{}
+	cancel      context.CancelFunc
+	interrupted atomic.Bool
+}
+
+// handleShutdownSignals returns a copy of ctx which is cancelled when the
+// process receives SIGINT or SIGTERM, and the handler, which must be stopped
+// once the work using the context is done. Only the first signal is handled;
+// the default behavior is then restored, so that a second signal terminates
+// the process immediately.
+func handleShutdownSignals(ctx context.Context) (context.Context, *shutdownHandler) {
+	ctx, cancel := context.WithCancel(ctx)
+	h := &shutdownHandler{
+		sigs:   make(chan os.Signal, 1),
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	signal.Notify(h.sigs, shutdownSignals...)
+	go func() {
+		select {
+		case sig := <-h.sigs:
+			signal.Stop(h.sigs)
+			log.Warningf("Received %v, stopping downloads and flushing the resources already processed. Send it again to exit immediately.", sig)
+			h.interrupted.Store(true)
+			cancel()
+		case <-h.done:
+		}
+	}()
+	return ctx, h
+}
+
+// stop stops handling signals, and cancels the handler's context.
+func (h *shutdownHandler) stop() {
+	if h == nil {
+		return
+	}
+	signal.Stop(h.sigs)
+	close(h.done)
+	h.cancel()
+}
+
+// wasInterrupted returns true if a shutdown signal was received.
+func (h *shutdownHandler) wasInterrupted() bool {
+	return h != nil && h.interrupted.Load()
+}
+
+// wrap returns err wrapped with ErrInterrupted if a shutdown signal was
+// received, and err unchanged otherwise.
+func (h *shutdownHandler) wrap(err error) error {
+	if err == nil || !h.wasInterrupted() {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrInterrupted, err)
+}
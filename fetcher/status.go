@@ -0,0 +1,211 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// Phase is the phase of a Fetcher's Run, as reported in its Status.
+type Phase string
+
+const (
+	// PhaseNotStarted is reported before Run is called.
+	PhaseNotStarted Phase = "not_started"
+	// PhaseAuthenticating is reported while credentials are exchanged for a
+	// token, if necessary.
+	PhaseAuthenticating Phase = "authenticating"
+	// PhaseExporting is reported while export jobs are started, and while
+	// waiting for them to complete.
+	PhaseExporting Phase = "exporting"
+	// PhaseDownloading is reported while result files are downloaded and their
+	// resources passed through the Pipeline.
+	PhaseDownloading Phase = "downloading"
+	// PhaseProcessing is reported once all result files have been processed,
+	// while the Pipeline is finalized (and sinks flush their output).
+	PhaseProcessing Phase = "processing"
+	// PhaseComplete is reported once Run has succeeded.
+	PhaseComplete Phase = "complete"
+	// PhaseFailed is reported once Run has returned an error.
+	PhaseFailed Phase = "failed"
+	// PhaseLimitReached is reported once Run has stopped at MaxResources or
+	// MaxBytes, with the resources processed up to the limit flushed.
+	PhaseLimitReached Phase = "limit_reached"
+)
+
+// maxStatusErrors is the number of most recent errors kept in a Status.
+const maxStatusErrors = 20
+
+// Status is a snapshot of the progress of a Fetcher's Run, as returned by
+// Fetcher.Status and served as JSON by Fetcher.StatusHandler.
+type Status struct {
+	Phase Phase `json:"phase"`
+	// The progress of the export job reported by the server, or -1 if it is not
+	// known. This is 100 once the job is complete.
+	PercentComplete int `json:"percentComplete"`
+	// The number of result files to be processed, and the number processed so
+	// far (including those which failed or were skipped).
+	FilesTotal    int `json:"filesTotal"`
+	FilesComplete int `json:"filesComplete"`
+	// The number of resources passed through the Pipeline so far, keyed by FHIR
+	// resource type name (for example "Patient").
+	ResourcesProcessed map[string]int `json:"resourcesProcessed"`
+	// The number of errors encountered so far, including those which were
+	// retried, and the most recent of them.
+	ErrorCount int      `json:"errorCount"`
+	Errors     []string `json:"errors"`
+	// When Run was called, and when the Status last changed.
+	StartTime  time.Time `json:"startTime"`
+	UpdateTime time.Time `json:"updateTime"`
+}
+
+// statusTracker holds a Fetcher's Status. The zero value is ready for use.
+type statusTracker struct {
+	mu sync.Mutex
+	st Status
+}
+
+// update calls f with the Status, holding the lock, and sets its UpdateTime.
+func (t *statusTracker) update(f func(st *Status)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(&t.st)
+	t.st.UpdateTime = time.Now()
+}
+
+func (t *statusTracker) start() {
+	t.update(func(st *Status) {
+		*st = Status{Phase: PhaseAuthenticating, PercentComplete: -1, StartTime: time.Now()}
+	})
+}
+
+func (t *statusTracker) setPhase(p Phase) {
+	t.update(func(st *Status) { st.Phase = p })
+}
+
+func (t *statusTracker) setPercentComplete(percent int) {
+	t.update(func(st *Status) { st.PercentComplete = percent })
+}
+
+func (t *statusTracker) setFilesTotal(n int) {
+	t.update(func(st *Status) { st.FilesTotal = n })
+}
+
+func (t *statusTracker) addResource(resourceType cpb.ResourceTypeCode_Value) {
+	name, err := bulkfhir.ResourceTypeCodeToName(resourceType)
+	if err != nil {
+		name = resourceType.String()
+	}
+	t.update(func(st *Status) {
+		if st.ResourcesProcessed == nil {
+			st.ResourcesProcessed = map[string]int{}
+		}
+		st.ResourcesProcessed[name]++
+	})
+}
+
+func (t *statusTracker) addError(err error) {
+	t.update(func(st *Status) {
+		st.ErrorCount++
+		st.Errors = append(st.Errors, err.Error())
+		if len(st.Errors) > maxStatusErrors {
+			st.Errors = st.Errors[len(st.Errors)-maxStatusErrors:]
+		}
+	})
+}
+
+// fileProgress records a FileProgress update.
+func (t *statusTracker) fileProgress(p FileProgress) {
+	if !p.Complete {
+		return
+	}
+	t.update(func(st *Status) { st.FilesComplete++ })
+	if p.Err != nil {
+		t.addError(p.Err)
+	}
+}
+
+// finish records the result of Run.
+func (t *statusTracker) finish(err error) {
+	if errors.Is(err, ErrLimitReached) {
+		t.setPhase(PhaseLimitReached)
+		return
+	}
+	if err != nil {
+		t.addError(err)
+		t.setPhase(PhaseFailed)
+		return
+	}
+	t.setPhase(PhaseComplete)
+}
+
+func (t *statusTracker) snapshot() Status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st := t.st
+	if st.Phase == "" {
+		st.Phase = PhaseNotStarted
+		st.PercentComplete = -1
+	}
+	st.ResourcesProcessed = map[string]int{}
+	for k, v := range t.st.ResourcesProcessed {
+		st.ResourcesProcessed[k] = v
+	}
+	st.Errors = append([]string{}, t.st.Errors...)
+	return st
+}
+
+// Status returns a snapshot of the progress of the current (or last) Run. It
+// is safe to call Status while Run is in progress.
+func (f *Fetcher) Status() Status {
+	return f.status.snapshot()
+}
+
+// StatusHandler returns an http.Handler which serves the Fetcher's Status as
+// JSON, for live visibility into a long running Run. The handler can be
+// registered on any mux, so that the embedding program controls the server,
+// for example:
+//
+//	mux.Handle("/status", f.StatusHandler())
+//
+// The response status is 200 OK, unless the Run has failed, in which case it
+// is 500 Internal Server Error, so that the handler may also be used as a
+// health check.
+func (f *Fetcher) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		st := f.Status()
+		w.Header().Set("Content-Type", "application/json")
+		if st.Phase == PhaseFailed {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		if err := json.NewEncoder(w).Encode(st); err != nil {
+			log.Warningf("failed to write fetcher status: %v", err)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fetcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/go-cmp/cmp"
+)
+
+func getStatus(t *testing.T, mux *http.ServeMux) (int, Status) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/status", nil))
+	var st Status
+	if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+		t.Fatalf("failed to parse status %s: %v", rec.Body.Bytes(), err)
+	}
+	return rec.Code, st
+}
+
+func TestFetcher_StatusHandler(t *testing.T) {
+	ctx := context.Background()
+	f := &Fetcher{
+		TransactionTimeStore: &recordingTransactionTimeStore{},
+		TransactionTime:      bulkfhir.NewTransactionTime(),
+		JobStatusPeriod:      10 * time.Millisecond,
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/status", f.StatusHandler())
+
+	if code, st := getStatus(t, mux); code != http.StatusOK || st.Phase != PhaseNotStarted {
+		t.Errorf("unexpected status before Run: %d %+v", code, st)
+	}
+
+	var midRun Status
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/jobs/1":
+			fmt.Fprintf(w, `{"transactionTime": "2020-12-09T11:00:00.123+00:00", "output": [{"type": "Patient", "url": "%[1]s/data/patient"}, {"type": "Encounter", "url": "%[1]s/data/encounter"}]}`, server.URL)
+		case "/data/patient":
+			fmt.Fprint(w, `{"resourceType": "Patient", "id": "1"}`+"\n"+`{"resourceType": "Patient", "id": "2"}`)
+		case "/data/encounter":
+			_, midRun = getStatus(t, mux)
+			fmt.Fprint(w, `{"resourceType": "Encounter", "id": "1"}`)
+		default:
+			t.Errorf("unexpected request to %s", req.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := bulkfhir.NewClient(server.URL, noopAuthenticator{})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	pipeline, err := processing.NewPipeline(nil, []processing.Sink{&processing.TestSink{}})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	f.Client = client
+	f.Pipeline = pipeline
+	f.JobURL = server.URL + "/jobs/1"
+	if err := f.Run(ctx); err != nil {
+		t.Fatalf("Run() returned unexpected error: %v", err)
+	}
+
+	if midRun.Phase != PhaseDownloading || midRun.PercentComplete != 100 || midRun.FilesTotal != 2 {
+		t.Errorf("unexpected status during download: %+v", midRun)
+	}
+	code, st := getStatus(t, mux)
+	if code != http.StatusOK {
+		t.Errorf("unexpected response code after Run. got: %d, want: %d", code, http.StatusOK)
+	}
+	if st.Phase != PhaseComplete || st.FilesComplete != 2 || st.ErrorCount != 0 {
+		t.Errorf("unexpected status after Run: %+v", st)
+	}
+	wantResources := map[string]int{"Patient": 2, "Encounter": 1}
+	if diff := cmp.Diff(wantResources, st.ResourcesProcessed); diff != "" {
+		t.Errorf("unexpected resources processed (-want +got):\n%s", diff)
+	}
+}
+
+func TestFetcher_StatusHandler_Failed(t *testing.T) {
+	ctx := context.Background()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client, err := bulkfhir.NewClient(server.URL, noopAuthenticator{})
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	pipeline, err := processing.NewPipeline(nil, []processing.Sink{&processing.TestSink{}})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	f := &Fetcher{
+		Client:               client,
+		Pipeline:             pipeline,
+		TransactionTimeStore: &recordingTransactionTimeStore{},
+		TransactionTime:      bulkfhir.NewTransactionTime(),
+		ExportGroup:          "mygroup",
+	}
+	if err := f.Run(ctx); err == nil {
+		t.Fatal("Run() succeeded, want error")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/status", f.StatusHandler())
+	code, st := getStatus(t, mux)
+	if code != http.StatusInternalServerError {
+		t.Errorf("unexpected response code. got: %d, want: %d", code, http.StatusInternalServerError)
+	}
+	if st.Phase != PhaseFailed || st.ErrorCount != 1 || len(st.Errors) != 1 {
+		t.Errorf("unexpected status after failed Run: %+v", st)
+	}
+}
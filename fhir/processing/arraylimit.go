@@ -0,0 +1,193 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	rpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// ErrArrayLimitExceeded is passed (wrapped) as the dead letter reason for
+// resources with a repeated field longer than allowed by an
+// ArrayLimitProcessor, if the ArrayLimitDeadLetter action is used.
+var ErrArrayLimitExceeded = errors.New("resource has a repeated field exceeding its length limit")
+
+// ArrayLimitAttribute is the ResourceWrapper attribute which the processor
+// returned by NewArrayLimitProcessor sets to a comma separated list of the
+// fields which were truncated (each a field path and its original length, as
+// path=length), if the ArrayLimitTruncate action is used.
+const ArrayLimitAttribute = "array_limit_exceeded"
+
+var arrayLimitCounter *metrics.Counter = metrics.NewCounter("array-limit-counter", "Count of FHIR Resources with repeated fields exceeding their length limit. The counter is tagged by the FHIR Resource type ex) OBSERVATION, and the action taken.", "1", aggregation.Count, "FHIRResourceType", "Action")
+
+// ArrayLimitAction is the action taken by NewArrayLimitProcessor on resources
+// with repeated fields exceeding their limit.
+type ArrayLimitAction int
+
+const (
+	// ArrayLimitTruncate keeps the first elements of the field, up to the
+	// limit, and drops the rest. The ArrayLimitAttribute of the resource is
+	// set, and a warning is logged.
+	ArrayLimitTruncate ArrayLimitAction = iota
+	// ArrayLimitDeadLetter passes the resource to the pipeline's dead letter
+	// function.
+	ArrayLimitDeadLetter
+)
+
+func (a ArrayLimitAction) String() string {
+	switch a {
+	case ArrayLimitTruncate:
+		return "truncate"
+	case ArrayLimitDeadLetter:
+		return "dead_letter"
+	default:
+		return fmt.Sprintf("ArrayLimitAction(%d)", int(a))
+	}
+}
+
+// limitedField is a parsed field path, with the maximum length of the
+// repeated field it ends in.
+type limitedField struct {
+	requiredField
+	maxLen int
+}
+
+type arrayLimitProcessor struct {
+	BaseProcessor
+	action ArrayLimitAction
+	rules  map[cpb.ResourceTypeCode_Value][]limitedField
+}
+
+// Assert arrayLimitProcessor satisfies the Processor interface.
+var _ Processor = &arrayLimitProcessor{}
+
+// NewArrayLimitProcessor creates a Processor which checks the repeated fields
+// listed for each resource type in rules against the maximum length given for
+// them, and takes the given action on resources where they are longer. For
+// example, {PATIENT: {"identifier": 100, "telecom": 20}} allows Patients at
+// most 100 identifiers and 20 telecoms. This guards against degenerate
+// resources which would otherwise bloat storage and slow downstream queries.
+//
+// Fields are given as dot separated paths of FHIR JSON field names ending in a
+// repeated field, as for NewRequiredFieldsProcessor. If the path traverses
+// another repeated field, the limit applies to each element separately (for
+// example, "contact.telecom" limits the telecoms of each contact). Resources
+// of types with no rules are passed through.
+func NewArrayLimitProcessor(rules map[cpb.ResourceTypeCode_Value]map[string]int, action ArrayLimitAction) (Processor, error) {
+	switch action {
+	case ArrayLimitTruncate, ArrayLimitDeadLetter:
+	default:
+		return nil, fmt.Errorf("unknown ArrayLimitAction %d", action)
+	}
+	containedFields := (&rpb.ContainedResource{}).ProtoReflect().Descriptor().Fields()
+	alp := &arrayLimitProcessor{action: action, rules: map[cpb.ResourceTypeCode_Value][]limitedField{}}
+	for resourceType, fields := range rules {
+		resourceField := containedFields.ByName(protoreflect.Name(strings.ToLower(resourceType.String())))
+		if resourceField == nil {
+			return nil, fmt.Errorf("unsupported resource type %s", resourceType)
+		}
+		for path, maxLen := range fields {
+			rf, err := parseRequiredField(resourceField.Message(), path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid array limit field for %s: %w", resourceType, err)
+			}
+			if !rf.fields[len(rf.fields)-1].IsList() {
+				return nil, fmt.Errorf("invalid array limit field for %s: %q is not a repeated field", resourceType, path)
+			}
+			if maxLen < 1 {
+				return nil, fmt.Errorf("invalid array limit for %s field %q: %d, must be at least 1", resourceType, path, maxLen)
+			}
+			alp.rules[resourceType] = append(alp.rules[resourceType], limitedField{requiredField: rf, maxLen: maxLen})
+		}
+		// Sorted so that fields are reported in a consistent order.
+		sort.Slice(alp.rules[resourceType], func(i, j int) bool {
+			return alp.rules[resourceType][i].path < alp.rules[resourceType][j].path
+		})
+	}
+	return alp, nil
+}
+
+func (alp *arrayLimitProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rules, ok := alp.rules[resource.Type()]
+	if !ok {
+		return alp.Output(ctx, resource)
+	}
+	cr, err := resource.Proto()
+	if err != nil {
+		return err
+	}
+	msg := cr.ProtoReflect()
+	populated := msg.WhichOneof(msg.Descriptor().Oneofs().Get(0))
+	if populated == nil {
+		return fmt.Errorf("%s resource from %s has no content", resource.Type(), resource.SourceURL())
+	}
+	res := msg.Get(populated).Message()
+
+	// Check all fields before truncating any, so that the resource is not
+	// modified if it is dead lettered.
+	var exceeded []string
+	var lists []protoreflect.List
+	var limits []int
+	for _, lf := range rules {
+		visitParents(res, lf.fields, func(parent protoreflect.Message) {
+			fd := lf.fields[len(lf.fields)-1]
+			if !parent.Has(fd) {
+				return
+			}
+			list := parent.Mutable(fd).List()
+			if list.Len() > lf.maxLen {
+				exceeded = append(exceeded, fmt.Sprintf("%s=%d", lf.path, list.Len()))
+				lists = append(lists, list)
+				limits = append(limits, lf.maxLen)
+			}
+		})
+	}
+	if len(exceeded) == 0 {
+		return alp.Output(ctx, resource)
+	}
+	if err := arrayLimitCounter.Record(ctx, 1, resource.Type().String(), alp.action.String()); err != nil {
+		return err
+	}
+	if alp.action == ArrayLimitDeadLetter {
+		return alp.DeadLetterResource(ctx, resource, fmt.Errorf("%w: %s", ErrArrayLimitExceeded, strings.Join(exceeded, ", ")))
+	}
+	for i, list := range lists {
+		list.Truncate(limits[i])
+	}
+	log.Warningf("%s resource from %s had repeated fields truncated: %s", resource.Type(), resource.SourceURL(), strings.Join(exceeded, ", "))
+	SetResourceAttribute(resource, ArrayLimitAttribute, strings.Join(exceeded, ","))
+	return alp.Output(ctx, resource)
+}
+
+// visitParents calls f with each message which holds the last of the given
+// path of fields in msg.
+func visitParents(msg protoreflect.Message, fields []protoreflect.FieldDescriptor, f func(protoreflect.Message)) {
+	if len(fields) == 1 {
+		f(msg)
+		return
+	}
+	visitPath(msg, fields[:len(fields)-1], f)
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestArrayLimitProcessor(t *testing.T) {
+	rules := map[cpb.ResourceTypeCode_Value]map[string]int{
+		cpb.ResourceTypeCode_PATIENT: {
+			"identifier":      2,
+			"contact.telecom": 1,
+		},
+	}
+	cases := []struct {
+		name          string
+		resourceType  cpb.ResourceTypeCode_Value
+		json          string
+		wantTruncated string
+		wantExceeded  string
+	}{
+		{
+			name:         "WithinLimits",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         `{"resourceType":"Patient","id":"1","identifier":[{"value":"a"},{"value":"b"}],"contact":[{"telecom":[{"value":"1"}]}]}`,
+		},
+		{
+			name:          "Exceeded",
+			resourceType:  cpb.ResourceTypeCode_PATIENT,
+			json:          `{"resourceType":"Patient","id":"1","identifier":[{"value":"a"},{"value":"b"},{"value":"c"}],"contact":[{"telecom":[{"value":"1"}]},{"telecom":[{"value":"2"},{"value":"3"}]}]}`,
+			wantTruncated: `{"resourceType":"Patient","id":"1","identifier":[{"value":"a"},{"value":"b"}],"contact":[{"telecom":[{"value":"1"}]},{"telecom":[{"value":"2"}]}]}`,
+			wantExceeded:  "contact.telecom=2,identifier=3",
+		},
+		{
+			name:         "NoRulesForType",
+			resourceType: cpb.ResourceTypeCode_ORGANIZATION,
+			json:         `{"resourceType":"Organization","id":"1","identifier":[{"value":"a"},{"value":"b"},{"value":"c"}]}`,
+		},
+	}
+	for _, tc := range cases {
+		for _, action := range []processing.ArrayLimitAction{processing.ArrayLimitTruncate, processing.ArrayLimitDeadLetter} {
+			t.Run(tc.name+"_"+action.String(), func(t *testing.T) {
+				alp, err := processing.NewArrayLimitProcessor(rules, action)
+				if err != nil {
+					t.Fatalf("NewArrayLimitProcessor() returned unexpected error: %v", err)
+				}
+				ts := &processing.TestSink{}
+				var deadLetterReasons []error
+				opts := &processing.PipelineOptions{
+					DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+						deadLetterReasons = append(deadLetterReasons, reason)
+						return nil
+					},
+				}
+				p, err := processing.NewPipelineWithOptions([]processing.Processor{alp}, []processing.Sink{ts}, opts)
+				if err != nil {
+					t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+				}
+				if err := p.Process(context.Background(), tc.resourceType, "", []byte(tc.json)); err != nil {
+					t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", tc.json, err)
+				}
+
+				if tc.wantExceeded == "" || action == processing.ArrayLimitTruncate {
+					if len(ts.WrittenResources) != 1 || len(deadLetterReasons) != 0 {
+						t.Fatalf("resource was not passed through: written %d, dead lettered: %v", len(ts.WrittenResources), deadLetterReasons)
+					}
+					want := tc.json
+					if tc.wantTruncated != "" {
+						want = tc.wantTruncated
+					}
+					got, err := ts.WrittenResources[0].JSON()
+					if err != nil {
+						t.Fatalf("JSON() returned unexpected error: %v", err)
+					}
+					if diff := cmp.Diff(testhelpers.NormalizeJSONString(t, want), testhelpers.NormalizeJSONString(t, string(got))); diff != "" {
+						t.Errorf("unexpected resource (-want +got):\n%s", diff)
+					}
+					gotExceeded, _ := processing.ResourceAttribute(ts.WrittenResources[0], processing.ArrayLimitAttribute)
+					if gotExceeded != tc.wantExceeded {
+						t.Errorf("Attribute(ArrayLimitAttribute) = %q, want %q", gotExceeded, tc.wantExceeded)
+					}
+					return
+				}
+				if len(ts.WrittenResources) != 0 || len(deadLetterReasons) != 1 {
+					t.Fatalf("resource was not dead lettered: written %d, dead lettered: %v", len(ts.WrittenResources), deadLetterReasons)
+				}
+				if !errors.Is(deadLetterReasons[0], processing.ErrArrayLimitExceeded) {
+					t.Errorf("dead letter reason %v does not wrap ErrArrayLimitExceeded", deadLetterReasons[0])
+				}
+				if !strings.Contains(deadLetterReasons[0].Error(), "identifier=3") {
+					t.Errorf("dead letter reason %v does not name the exceeded field", deadLetterReasons[0])
+				}
+			})
+		}
+	}
+}
+
+func TestNewArrayLimitProcessor_Invalid(t *testing.T) {
+	cases := []struct {
+		name   string
+		rules  map[cpb.ResourceTypeCode_Value]map[string]int
+		action processing.ArrayLimitAction
+	}{
+		{
+			name:  "UnknownField",
+			rules: map[cpb.ResourceTypeCode_Value]map[string]int{cpb.ResourceTypeCode_PATIENT: {"nope": 1}},
+		},
+		{
+			name:  "NotRepeated",
+			rules: map[cpb.ResourceTypeCode_Value]map[string]int{cpb.ResourceTypeCode_PATIENT: {"gender": 1}},
+		},
+		{
+			name:  "ZeroLimit",
+			rules: map[cpb.ResourceTypeCode_Value]map[string]int{cpb.ResourceTypeCode_PATIENT: {"identifier": 0}},
+		},
+		{
+			name:   "UnknownAction",
+			action: processing.ArrayLimitAction(99),
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := processing.NewArrayLimitProcessor(tc.rules, tc.action); err == nil {
+				t.Error("NewArrayLimitProcessor() succeeded, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/bulk_fhir_tools/aws"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/uuid"
+)
+
+// ErrAWSMessageTooLarge is returned (wrapped) by the Write method of an SQS or
+// SNS Sink for a resource which is too large to send in a message, if no
+// LargeMessageBucket is configured.
+var ErrAWSMessageTooLarge = aws.ErrMessageTooLarge
+
+// ErrAWSDeliveryFailed is returned (wrapped) by the Finalize method of an SQS
+// or SNS Sink if any resources could not be delivered.
+var ErrAWSDeliveryFailed = aws.ErrDeliveryFailed
+
+// The names of the message attributes set by the SQS and SNS Sinks.
+const (
+	// AWSMessageResourceTypeAttribute holds the FHIR resource type, for example
+	// Patient.
+	AWSMessageResourceTypeAttribute = "resourceType"
+	// AWSMessageResourceIDAttribute holds the resource id, if it has one.
+	AWSMessageResourceIDAttribute = "resourceId"
+	// AWSMessageS3URIAttribute holds the S3 URI of a resource which was too
+	// large to send in a message (see aws.PublisherOptions.LargeMessageBucket).
+	AWSMessageS3URIAttribute = aws.S3URIAttribute
+)
+
+// AWSMessageSinkOptions contains optional parameters used by
+// NewSQSSinkWithOptions and NewSNSSinkWithOptions.
+type AWSMessageSinkOptions struct {
+	// Options for the Publisher which sends the messages. Resources which are
+	// too large to send in a message are written to S3 at
+	// LargeMessagePrefix + ResourceType/id.json if a LargeMessageBucket is set.
+	PublisherOptions *aws.PublisherOptions
+}
+
+type awsMessageSink struct {
+	publisher aws.Publisher
+}
+
+// Assert awsMessageSink satisfies the Sink interface.
+var _ Sink = &awsMessageSink{}
+
+// NewSQSSink creates a Sink which sends each resource as a message to the SQS
+// queue at queueURL, with the resource JSON as the message body and the
+// resource type and id as message attributes (see
+// AWSMessageResourceTypeAttribute and AWSMessageResourceIDAttribute).
+//
+// Messages are sent in batches by an aws.Publisher (see aws.NewSQSPublisher),
+// and Finalize waits for all of them to be acknowledged. Resources which
+// cannot be delivered do not stop the pipeline; instead, Finalize returns an
+// error wrapping ErrAWSDeliveryFailed with the number of undelivered resources
+// and the first error.
+//
+// Messages are limited to 256KiB by AWS. Larger resources are offloaded to S3
+// if a LargeMessageBucket is set, and otherwise cause Write to return an error
+// wrapping ErrAWSMessageTooLarge.
+//
+// It is threadsafe to call Write on this Sink from multiple goroutines.
+func NewSQSSink(queueURL string) (Sink, error) {
+	return NewSQSSinkWithOptions(queueURL, nil)
+}
+
+// NewSQSSinkWithOptions is like NewSQSSink, but allows optional parameters to
+// be set.
+func NewSQSSinkWithOptions(queueURL string, opts *AWSMessageSinkOptions) (Sink, error) {
+	if opts == nil {
+		opts = &AWSMessageSinkOptions{}
+	}
+	publisher, err := aws.NewSQSPublisher(queueURL, opts.PublisherOptions)
+	if err != nil {
+		return nil, err
+	}
+	return NewAWSMessageSink(publisher), nil
+}
+
+// NewSNSSink creates a Sink which publishes each resource as a message to the
+// SNS topic with the given ARN. It behaves in the same way as NewSQSSink.
+func NewSNSSink(topicARN string) (Sink, error) {
+	return NewSNSSinkWithOptions(topicARN, nil)
+}
+
+// NewSNSSinkWithOptions is like NewSNSSink, but allows optional parameters to
+// be set.
+func NewSNSSinkWithOptions(topicARN string, opts *AWSMessageSinkOptions) (Sink, error) {
+	if opts == nil {
+		opts = &AWSMessageSinkOptions{}
+	}
+	publisher, err := aws.NewSNSPublisher(topicARN, opts.PublisherOptions)
+	if err != nil {
+		return nil, err
+	}
+	return NewAWSMessageSink(publisher), nil
+}
+
+// NewAWSMessageSink creates a Sink which sends each resource as a message with
+// the given Publisher, in the same way as NewSQSSink. Finalize closes the
+// Publisher.
+func NewAWSMessageSink(publisher aws.Publisher) Sink {
+	return &awsMessageSink{publisher: publisher}
+}
+
+func (ams *awsMessageSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	doc, err := normalizeNDJSONLine(rawJSON)
+	if err != nil {
+		return err
+	}
+	var res idJSON
+	if err := json.Unmarshal(doc, &res); err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	name, err := bulkfhir.ResourceTypeCodeToName(resource.Type())
+	if err != nil {
+		return err
+	}
+	m := aws.Message{Body: string(doc), Attributes: map[string]string{AWSMessageResourceTypeAttribute: name}}
+	objectID := res.ID
+	if res.ID != "" {
+		m.Attributes[AWSMessageResourceIDAttribute] = res.ID
+	} else {
+		objectID = uuid.New().String()
+	}
+	m.ObjectKey = fmt.Sprintf("%s/%s.json", name, objectID)
+	if err := ams.publisher.Publish(ctx, m); err != nil {
+		return fmt.Errorf("failed to send %s resource %q: %w", name, res.ID, err)
+	}
+	return nil
+}
+
+// Finalize waits for all resources to be delivered, returning an error if any
+// could not be.
+func (ams *awsMessageSink) Finalize(ctx context.Context) error {
+	return ams.publisher.Close(ctx)
+}
@@ -0,0 +1,139 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/aws"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// fakePublisher records the messages published to it. Publish returns
+// publishErr, if set, and Close returns closeErr.
+type fakePublisher struct {
+	mu         sync.Mutex
+	messages   []aws.Message
+	closed     bool
+	publishErr error
+	closeErr   error
+}
+
+func (fp *fakePublisher) Publish(ctx context.Context, m aws.Message) error {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if fp.publishErr != nil {
+		return fp.publishErr
+	}
+	fp.messages = append(fp.messages, m)
+	return nil
+}
+
+func (fp *fakePublisher) Close(ctx context.Context) error {
+	fp.closed = true
+	return fp.closeErr
+}
+
+func writeAWSPatients(t *testing.T, sink processing.Sink, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		r := &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte(fmt.Sprintf(`{"resourceType":"Patient","id":%q}`, id))}
+		if err := sink.Write(context.Background(), r); err != nil {
+			t.Fatalf("Write(%s) returned unexpected error: %v", id, err)
+		}
+	}
+}
+
+func TestAWSMessageSink(t *testing.T) {
+	fp := &fakePublisher{}
+	sink := processing.NewAWSMessageSink(fp)
+	writeAWSPatients(t, sink, "p1", "p2")
+	if err := sink.Write(context.Background(), &testResourceWrapper{resourceType: cpb.ResourceTypeCode_OBSERVATION, json: []byte("{\r\n  \"resourceType\": \"Observation\", \"id\": \"o1\"\r\n}")}); err != nil {
+		t.Fatalf("Write(o1) returned unexpected error: %v", err)
+	}
+	if err := sink.Finalize(context.Background()); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+
+	want := []aws.Message{
+		{
+			Body:       `{"resourceType":"Patient","id":"p1"}`,
+			Attributes: map[string]string{processing.AWSMessageResourceTypeAttribute: "Patient", processing.AWSMessageResourceIDAttribute: "p1"},
+			ObjectKey:  "Patient/p1.json",
+		},
+		{
+			Body:       `{"resourceType":"Patient","id":"p2"}`,
+			Attributes: map[string]string{processing.AWSMessageResourceTypeAttribute: "Patient", processing.AWSMessageResourceIDAttribute: "p2"},
+			ObjectKey:  "Patient/p2.json",
+		},
+		{
+			Body:       `{"resourceType":"Observation","id":"o1"}`,
+			Attributes: map[string]string{processing.AWSMessageResourceTypeAttribute: "Observation", processing.AWSMessageResourceIDAttribute: "o1"},
+			ObjectKey:  "Observation/o1.json",
+		},
+	}
+	if diff := cmp.Diff(want, fp.messages); diff != "" {
+		t.Errorf("unexpected messages published (-want +got):\n%s", diff)
+	}
+	if !fp.closed {
+		t.Error("Finalize() did not close the Publisher")
+	}
+}
+
+func TestAWSMessageSink_NoID(t *testing.T) {
+	fp := &fakePublisher{}
+	sink := processing.NewAWSMessageSink(fp)
+	if err := sink.Write(context.Background(), &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte(`{"resourceType":"Patient"}`)}); err != nil {
+		t.Fatalf("Write() returned unexpected error: %v", err)
+	}
+	if len(fp.messages) != 1 {
+		t.Fatalf("unexpected number of messages published. got: %d, want: 1", len(fp.messages))
+	}
+	m := fp.messages[0]
+	if _, ok := m.Attributes[processing.AWSMessageResourceIDAttribute]; ok {
+		t.Errorf("unexpected %s attribute for a resource without an id", processing.AWSMessageResourceIDAttribute)
+	}
+	if !strings.HasPrefix(m.ObjectKey, "Patient/") || !strings.HasSuffix(m.ObjectKey, ".json") || m.ObjectKey == "Patient/.json" {
+		t.Errorf("unexpected ObjectKey for a resource without an id: %q", m.ObjectKey)
+	}
+}
+
+func TestAWSMessageSink_Errors(t *testing.T) {
+	fp := &fakePublisher{publishErr: fmt.Errorf("%w: too big", processing.ErrAWSMessageTooLarge), closeErr: processing.ErrAWSDeliveryFailed}
+	sink := processing.NewAWSMessageSink(fp)
+	if err := sink.Write(context.Background(), &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte(`{"resourceType":"Patient","id":"big"}`)}); !errors.Is(err, processing.ErrAWSMessageTooLarge) {
+		t.Errorf("Write() returned unexpected error. got: %v, want: %v", err, processing.ErrAWSMessageTooLarge)
+	}
+	if err := sink.Finalize(context.Background()); !errors.Is(err, processing.ErrAWSDeliveryFailed) {
+		t.Errorf("Finalize() returned unexpected error. got: %v, want: %v", err, processing.ErrAWSDeliveryFailed)
+	}
+}
+
+func TestNewSQSSink_Errors(t *testing.T) {
+	if _, err := processing.NewSQSSink(""); err == nil {
+		t.Error("NewSQSSink() with no queue URL returned nil error")
+	}
+	if _, err := processing.NewSNSSink(""); err == nil {
+		t.Error("NewSNSSink() with no topic ARN returned nil error")
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+var beneficiaryCanonicalizeCounter *metrics.Counter = metrics.NewCounter("beneficiary-canonicalize-counter", "Count of beneficiary references in Coverage and ExplanationOfBenefit resources seen by the beneficiary canonicalization processor. The counter is tagged by the FHIR Resource type ex) COVERAGE and action taken ex) REWRITTEN.", "1", aggregation.Count, "FHIRResourceType", "Action")
+
+// BeneficiaryResolver maps the member ids of beneficiaries to the ids of their
+// canonical Patient resources. Implementations must be safe for concurrent
+// use.
+type BeneficiaryResolver interface {
+	// CanonicalPatientID returns the id of the canonical Patient for the member
+	// with the given id (the id of the Patient referred to by a Coverage or
+	// ExplanationOfBenefit). The returned bool is false if the member is not
+	// known.
+	CanonicalPatientID(ctx context.Context, memberID string) (string, bool, error)
+}
+
+type mapBeneficiaryResolver map[string]string
+
+func (m mapBeneficiaryResolver) CanonicalPatientID(ctx context.Context, memberID string) (string, bool, error) {
+	id, ok := m[memberID]
+	return id, ok, nil
+}
+
+// NewMapBeneficiaryResolver returns a BeneficiaryResolver which looks up
+// member ids in ids, which maps member ids to canonical Patient ids. ids must
+// not be modified while the resolver is in use.
+func NewMapBeneficiaryResolver(ids map[string]string) BeneficiaryResolver {
+	return mapBeneficiaryResolver(ids)
+}
+
+// beneficiaryFields holds the fields which refer to the beneficiary, for each
+// of the resource types handled by the processor.
+var beneficiaryFields = map[cpb.ResourceTypeCode_Value][]string{
+	cpb.ResourceTypeCode_COVERAGE:               {"beneficiary", "subscriber", "policyHolder"},
+	cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT: {"patient"},
+}
+
+type beneficiaryCanonicalizeProcessor struct {
+	BaseProcessor
+	resolver BeneficiaryResolver
+}
+
+// Assert beneficiaryCanonicalizeProcessor satisfies the Processor interface.
+var _ Processor = &beneficiaryCanonicalizeProcessor{}
+
+// NewBeneficiaryCanonicalizeProcessor creates a Processor which rewrites the
+// Patient references to the beneficiary of Coverage and ExplanationOfBenefit
+// resources to refer to the canonical Patient for the member, as returned by
+// resolver. This ensures that all of a member's claims link to a single
+// Patient when the source data uses several Patient ids for the same person.
+//
+// Coverage.beneficiary and ExplanationOfBenefit.patient are rewritten, along
+// with Coverage.subscriber and Coverage.policyHolder where they refer to a
+// Patient, so that a member's own coverage stays consistent. Only relative
+// references (Patient/id, optionally with a version) are rewritten. References
+// to members unknown to resolver, and resources of other types, are passed
+// through unchanged.
+func NewBeneficiaryCanonicalizeProcessor(resolver BeneficiaryResolver) Processor {
+	return &beneficiaryCanonicalizeProcessor{resolver: resolver}
+}
+
+func (bcp *beneficiaryCanonicalizeProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	fields, ok := beneficiaryFields[resource.Type()]
+	if !ok {
+		return bcp.Output(ctx, resource)
+	}
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	res, err := decodeResourceJSON(rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+
+	rewritten := false
+	for _, field := range fields {
+		refObj, _ := res[field].(map[string]any)
+		ref, _ := refObj["reference"].(string)
+		if !strings.HasPrefix(ref, "Patient/") {
+			continue
+		}
+		var resolveErr error
+		action := "UNRESOLVED"
+		newRef := rewriteReference(ref, func(memberID string) string {
+			id, ok, err := bcp.resolver.CanonicalPatientID(ctx, memberID)
+			if err != nil {
+				resolveErr = err
+				return memberID
+			}
+			if !ok {
+				return memberID
+			}
+			action = "UNCHANGED"
+			return id
+		})
+		if resolveErr != nil {
+			return fmt.Errorf("failed to resolve the canonical Patient for %s in %s.%s: %w", ref, resource.Type(), field, resolveErr)
+		}
+		if newRef != ref {
+			refObj["reference"] = newRef
+			rewritten = true
+			action = "REWRITTEN"
+		}
+		if err := beneficiaryCanonicalizeCounter.Record(ctx, 1, resource.Type().String(), action); err != nil {
+			return err
+		}
+	}
+	if rewritten {
+		if err := setResourceJSON(resource, res); err != nil {
+			return err
+		}
+	}
+	return bcp.Output(ctx, resource)
+}
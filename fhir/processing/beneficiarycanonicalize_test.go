@@ -0,0 +1,138 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestBeneficiaryCanonicalizeProcessor(t *testing.T) {
+	resolver := processing.NewMapBeneficiaryResolver(map[string]string{"member-1": "canonical-1", "member-2": "canonical-1", "canonical-1": "canonical-1"})
+	cases := []struct {
+		name         string
+		resourceType cpb.ResourceTypeCode_Value
+		jsonIn       string
+		wantJSON     string
+		wantCounts   map[string]int64
+	}{
+		{
+			name:         "Coverage",
+			resourceType: cpb.ResourceTypeCode_COVERAGE,
+			jsonIn:       `{"resourceType":"Coverage","id":"cov1","status":"active","beneficiary":{"reference":"Patient/member-1"},"subscriber":{"reference":"Patient/member-1"},"policyHolder":{"reference":"Organization/member-1"},"payor":[{"reference":"Organization/payor"}]}`,
+			wantJSON:     `{"resourceType":"Coverage","id":"cov1","status":"active","beneficiary":{"reference":"Patient/canonical-1"},"subscriber":{"reference":"Patient/canonical-1"},"policyHolder":{"reference":"Organization/member-1"},"payor":[{"reference":"Organization/payor"}]}`,
+			wantCounts:   map[string]int64{"COVERAGE-REWRITTEN": 2},
+		},
+		{
+			name:         "ExplanationOfBenefitWithVersion",
+			resourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT,
+			jsonIn:       `{"resourceType":"ExplanationOfBenefit","id":"eob1","status":"active","patient":{"reference":"Patient/member-2/_history/3"}}`,
+			wantJSON:     `{"resourceType":"ExplanationOfBenefit","id":"eob1","status":"active","patient":{"reference":"Patient/canonical-1/_history/3"}}`,
+			wantCounts:   map[string]int64{"EXPLANATION_OF_BENEFIT-REWRITTEN": 1},
+		},
+		{
+			name:         "CanonicalPatientUnchanged",
+			resourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT,
+			jsonIn:       `{"resourceType":"ExplanationOfBenefit","id":"eob1","status":"active","patient":{"reference":"Patient/canonical-1"}}`,
+			wantJSON:     `{"resourceType":"ExplanationOfBenefit","id":"eob1","status":"active","patient":{"reference":"Patient/canonical-1"}}`,
+			wantCounts:   map[string]int64{"EXPLANATION_OF_BENEFIT-UNCHANGED": 1},
+		},
+		{
+			name:         "UnknownMember",
+			resourceType: cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT,
+			jsonIn:       `{"resourceType":"ExplanationOfBenefit","id":"eob1","status":"active","patient":{"reference":"Patient/unknown"}}`,
+			wantJSON:     `{"resourceType":"ExplanationOfBenefit","id":"eob1","status":"active","patient":{"reference":"Patient/unknown"}}`,
+			wantCounts:   map[string]int64{"EXPLANATION_OF_BENEFIT-UNRESOLVED": 1},
+		},
+		{
+			name:         "AbsoluteReferenceUnchanged",
+			resourceType: cpb.ResourceTypeCode_COVERAGE,
+			jsonIn:       `{"resourceType":"Coverage","id":"cov1","status":"active","beneficiary":{"reference":"https://example.com/fhir/Patient/member-1"}}`,
+			wantJSON:     `{"resourceType":"Coverage","id":"cov1","status":"active","beneficiary":{"reference":"https://example.com/fhir/Patient/member-1"}}`,
+		},
+		{
+			name:         "OtherResourceTypeUnchanged",
+			resourceType: cpb.ResourceTypeCode_ENCOUNTER,
+			jsonIn:       `{"resourceType":"Encounter","id":"enc1","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Patient/member-1"}}`,
+			wantJSON:     `{"resourceType":"Encounter","id":"enc1","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Patient/member-1"}}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{processing.NewBeneficiaryCanonicalizeProcessor(resolver)}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			if err := p.Process(context.Background(), tc.resourceType, "", []byte(tc.jsonIn)); err != nil {
+				t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", tc.jsonIn, err)
+			}
+			if len(ts.WrittenResources) != 1 {
+				t.Fatalf("unexpected number of written resources. got: %d, want: 1", len(ts.WrittenResources))
+			}
+			gotJSON, err := ts.WrittenResources[0].JSON()
+			if err != nil {
+				t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+			}
+			normalizedWantJSON := testhelpers.NormalizeJSON(t, []byte(tc.wantJSON))
+			normalizedGotJSON := testhelpers.NormalizeJSON(t, gotJSON)
+			if !cmp.Equal(normalizedGotJSON, normalizedWantJSON) {
+				t.Errorf("pipeline.Process(..., %s) produced unexpected output. got: %s, want: %s", tc.jsonIn, normalizedGotJSON, normalizedWantJSON)
+			}
+
+			gotCount, _, err := metrics.GetResults()
+			if err != nil {
+				t.Errorf("GetResults failed; err = %s", err)
+			}
+			wantCounts := tc.wantCounts
+			if wantCounts == nil {
+				wantCounts = map[string]int64{}
+			}
+			if diff := cmp.Diff(wantCounts, gotCount["beneficiary-canonicalize-counter"].Count); diff != "" {
+				t.Errorf("GetResults() returned unexpected count (-want +got): \n%s", diff)
+			}
+		})
+	}
+}
+
+type failingBeneficiaryResolver struct{}
+
+func (failingBeneficiaryResolver) CanonicalPatientID(ctx context.Context, memberID string) (string, bool, error) {
+	return "", false, errors.New("lookup failed")
+}
+
+func TestBeneficiaryCanonicalizeProcessor_ResolverError(t *testing.T) {
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline([]processing.Processor{processing.NewBeneficiaryCanonicalizeProcessor(failingBeneficiaryResolver{})}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	jsonIn := `{"resourceType":"Coverage","id":"cov1","status":"active","beneficiary":{"reference":"Patient/member-1"}}`
+	if err := p.Process(context.Background(), cpb.ResourceTypeCode_COVERAGE, "", []byte(jsonIn)); err == nil {
+		t.Errorf("pipeline.Process() succeeded, want error")
+	}
+	if len(ts.WrittenResources) != 0 {
+		t.Errorf("unexpected number of written resources. got: %d, want: 0", len(ts.WrittenResources))
+	}
+}
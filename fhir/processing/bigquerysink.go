@@ -0,0 +1,231 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/bigquery"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/gcs"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/uuid"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+const defaultBigQueryStagingDirectory = "bigquery-staging"
+
+// BigQuerySinkConfig defines the configuration passed to NewBigQuerySink.
+type BigQuerySinkConfig struct {
+	BigQueryConfig *bigquery.Config
+
+	// The GCS bucket in which NDJSON files are staged before being loaded.
+	GCSEndpoint string
+	GCSBucket   string
+	// The directory within GCSBucket under which files are staged. Each sink
+	// uses a unique subdirectory. Defaults to "bigquery-staging".
+	GCSStagingDirectory string
+
+	LoadJobTimeout time.Duration
+	LoadJobPeriod  time.Duration
+}
+
+// BigQuerySink is a Sink which loads resources into BigQuery tables using
+// load jobs, which are considerably cheaper than streaming inserts for large
+// exports. Resources are written to a table per resource type, named for the
+// resource type (e.g. "Observation"); tables which do not exist are created
+// with bigquery.MinimalSchema.
+//
+// Resources are staged as NDJSON files in GCS as they are written, and loaded
+// when Finalize is called. Staged files are deleted once their load job
+// completes.
+type BigQuerySink struct {
+	bqClient  *bigquery.Client
+	gcsClient gcs.Client
+	// gcsCtx is used *only* for creating GCS writers, as if they were created
+	// when the Sink was created, in case the context passed to Write is
+	// cancelled before subsequent Write calls.
+	gcsCtx     context.Context
+	gcsBucket  string
+	stagingDir string
+
+	loadJobTimeout time.Duration
+	loadJobPeriod  time.Duration
+
+	mu        sync.Mutex
+	writers   map[cpb.ResourceTypeCode_Value]io.WriteCloser
+	rowCounts map[cpb.ResourceTypeCode_Value]int64
+}
+
+// Assert BigQuerySink satisfies the Sink interface.
+var _ Sink = &BigQuerySink{}
+
+// NewBigQuerySink creates a new BigQuerySink. It is threadsafe to call Write
+// on this Sink from multiple goroutines.
+func NewBigQuerySink(ctx context.Context, cfg *BigQuerySinkConfig) (*BigQuerySink, error) {
+	bqClient, err := bigquery.NewClient(ctx, cfg.BigQueryConfig)
+	if err != nil {
+		return nil, err
+	}
+	gcsClient, err := gcs.NewClient(ctx, cfg.GCSBucket, cfg.GCSEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	stagingDir := cfg.GCSStagingDirectory
+	if stagingDir == "" {
+		stagingDir = defaultBigQueryStagingDirectory
+	}
+	return &BigQuerySink{
+		bqClient:       bqClient,
+		gcsClient:      gcsClient,
+		gcsCtx:         ctx,
+		gcsBucket:      cfg.GCSBucket,
+		stagingDir:     gcs.JoinPath(stagingDir, uuid.New().String()),
+		loadJobTimeout: cfg.LoadJobTimeout,
+		loadJobPeriod:  cfg.LoadJobPeriod,
+		writers:        map[cpb.ResourceTypeCode_Value]io.WriteCloser{},
+	}, nil
+}
+
+func (bqs *BigQuerySink) stagingFile(resourceType cpb.ResourceTypeCode_Value) (string, error) {
+	name, err := bulkfhir.ResourceTypeCodeToName(resourceType)
+	if err != nil {
+		return "", err
+	}
+	return gcs.JoinPath(bqs.stagingDir, name+".ndjson"), nil
+}
+
+// Write stages the resource in GCS, to be loaded by Finalize.
+func (bqs *BigQuerySink) Write(ctx context.Context, resource ResourceWrapper) error {
+	json, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	row, err := bigquery.NewMinimalSchemaRow(json)
+	if err != nil {
+		return fmt.Errorf("failed to create BigQuery row for %s resource: %w", resource.Type(), err)
+	}
+
+	bqs.mu.Lock()
+	defer bqs.mu.Unlock()
+	w, ok := bqs.writers[resource.Type()]
+	if !ok {
+		file, err := bqs.stagingFile(resource.Type())
+		if err != nil {
+			return err
+		}
+		w = bqs.gcsClient.GetFileWriter(bqs.gcsCtx, file)
+		bqs.writers[resource.Type()] = w
+	}
+	if _, err := w.Write(append(row, '\n')); err != nil {
+		return fmt.Errorf("failed to stage %s resource in GCS: %w", resource.Type(), err)
+	}
+	return nil
+}
+
+// Finalize loads all staged resources into BigQuery, creating tables as
+// needed, and waits for the load jobs to complete before deleting the staged
+// files. The number of rows loaded for each resource type is logged, and is
+// available from RowCounts.
+func (bqs *BigQuerySink) Finalize(ctx context.Context) error {
+	bqs.mu.Lock()
+	defer bqs.mu.Unlock()
+
+	var resourceTypes []cpb.ResourceTypeCode_Value
+	for rt, w := range bqs.writers {
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("failed to close GCS staging file for %s: %w", rt, err)
+		}
+		resourceTypes = append(resourceTypes, rt)
+	}
+	sort.Slice(resourceTypes, func(i, j int) bool { return resourceTypes[i] < resourceTypes[j] })
+
+	jobs := map[cpb.ResourceTypeCode_Value]*bigquery.LoadJob{}
+	for _, rt := range resourceTypes {
+		table, err := bulkfhir.ResourceTypeCodeToName(rt)
+		if err != nil {
+			return err
+		}
+		created, err := bqs.bqClient.CreateTableIfNotExists(ctx, table, bigquery.MinimalSchema())
+		if err != nil {
+			return err
+		}
+		if created {
+			log.Infof("Created BigQuery table %s", table)
+		}
+		file, err := bqs.stagingFile(rt)
+		if err != nil {
+			return err
+		}
+		job, err := bqs.bqClient.StartLoadJob(ctx, table, []string{fmt.Sprintf("gs://%s/%s", bqs.gcsBucket, file)})
+		if err != nil {
+			return err
+		}
+		log.Infof("Started BigQuery load job %s for table %s", job.ID, table)
+		jobs[rt] = job
+	}
+
+	bqs.rowCounts = map[cpb.ResourceTypeCode_Value]int64{}
+	var errs []error
+	deadline := time.Now().Add(bqs.loadJobTimeout)
+	for len(jobs) > 0 && time.Now().Before(deadline) {
+		time.Sleep(bqs.loadJobPeriod)
+		for _, rt := range resourceTypes {
+			job, ok := jobs[rt]
+			if !ok {
+				continue
+			}
+			isDone, rows, err := bqs.bqClient.CheckLoadJob(ctx, job)
+			if !isDone && err == nil {
+				continue
+			}
+			delete(jobs, rt)
+			if err != nil {
+				errs = append(errs, err)
+			} else {
+				bqs.rowCounts[rt] = rows
+				log.Infof("BigQuery load job %s loaded %d %s rows", job.ID, rows, rt)
+			}
+			// The job will no longer read the staged file, so it can be cleaned up
+			// whether or not it succeeded.
+			file, err := bqs.stagingFile(rt)
+			if err != nil {
+				return err
+			}
+			if err := bqs.gcsClient.DeleteFile(ctx, file); err != nil {
+				log.Warningf("Failed to delete GCS staging file %s: %v", file, err)
+			}
+		}
+	}
+	for rt, job := range jobs {
+		errs = append(errs, fmt.Errorf("BigQuery load job %s for %s exceeded %s. It may still complete, but staged files in gs://%s/%s will not be deleted", job.ID, rt, bqs.loadJobTimeout, bqs.gcsBucket, bqs.stagingDir))
+	}
+	return errors.Join(errs...)
+}
+
+// RowCounts returns the number of rows loaded for each resource type by
+// Finalize.
+func (bqs *BigQuerySink) RowCounts() map[cpb.ResourceTypeCode_Value]int64 {
+	bqs.mu.Lock()
+	defer bqs.mu.Unlock()
+	return bqs.rowCounts
+}
@@ -0,0 +1,102 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/bigquery"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestBigQuerySink(t *testing.T) {
+	ctx := context.Background()
+	gcsServer := testhelpers.NewGCSServer(t)
+	bqServer := testhelpers.NewBigQueryServer(t, gcsServer)
+	// The Patient table already exists, and should be appended to.
+	bqServer.AddTable("project.dataset.Patient")
+
+	sink, err := processing.NewBigQuerySink(ctx, &processing.BigQuerySinkConfig{
+		BigQueryConfig: &bigquery.Config{
+			BigQueryEndpoint: bqServer.URL(),
+			ProjectID:        "project",
+			DatasetID:        "dataset",
+		},
+		GCSEndpoint:    gcsServer.URL(),
+		GCSBucket:      "bucket",
+		LoadJobTimeout: time.Minute,
+		LoadJobPeriod:  time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewBigQuerySink() returned unexpected error: %v", err)
+	}
+	p, err := processing.NewPipeline(nil, []processing.Sink{sink})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+
+	resources := []struct {
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+	}{
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","meta":{"lastUpdated":"2024-01-02T03:04:05Z"}}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"2"}`},
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"3"}`},
+	}
+	for _, r := range resources {
+		if err := p.Process(ctx, r.resourceType, "url", []byte(r.json)); err != nil {
+			t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", r.json, err)
+		}
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+
+	wantTables := []string{"project.dataset.Observation", "project.dataset.Patient"}
+	if diff := cmp.Diff(wantTables, bqServer.Tables()); diff != "" {
+		t.Errorf("unexpected BigQuery tables (-want +got):\n%s", diff)
+	}
+	var gotIDs []string
+	for _, row := range bqServer.TableRows("project.dataset.Patient") {
+		var r struct {
+			ID   string          `json:"id"`
+			Data json.RawMessage `json:"data"`
+		}
+		if err := json.Unmarshal(row, &r); err != nil {
+			t.Fatalf("failed to unmarshal row %s: %v", row, err)
+		}
+		gotIDs = append(gotIDs, r.ID)
+	}
+	if diff := cmp.Diff([]string{"1", "2"}, gotIDs); diff != "" {
+		t.Errorf("unexpected Patient rows (-want +got):\n%s", diff)
+	}
+	wantRowCounts := map[cpb.ResourceTypeCode_Value]int64{
+		cpb.ResourceTypeCode_PATIENT:     2,
+		cpb.ResourceTypeCode_OBSERVATION: 1,
+	}
+	if diff := cmp.Diff(wantRowCounts, sink.RowCounts()); diff != "" {
+		t.Errorf("unexpected row counts (-want +got):\n%s", diff)
+	}
+	if paths := gcsServer.GetAllPaths(); len(paths) != 0 {
+		t.Errorf("staged files were not cleaned up: %v", paths)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/fhir/go/jsonformat"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	rpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// ErrInvalidBundleReference is passed (wrapped) as the dead letter reason for
+// Bundles with references which do not resolve to an entry of the Bundle, or
+// which refer to a disallowed external server.
+var ErrInvalidBundleReference = errors.New("Bundle contains an invalid reference")
+
+var bundleValidationCounter *metrics.Counter = metrics.NewCounter("bundle-validation-counter", "Count of Bundles dropped because they contained references which did not resolve to an entry of the Bundle.", "1", aggregation.Count)
+
+var referenceDescriptor = (&dpb.Reference{}).ProtoReflect().Descriptor()
+
+// BundleValidationProcessorOptions contains optional parameters used by
+// NewBundleValidationProcessorWithOptions.
+type BundleValidationProcessorOptions struct {
+	// If non-empty, absolute references which do not resolve to an entry must
+	// start with one of these base URLs (for example
+	// "https://example.com/fhir/"). Otherwise, any absolute reference is allowed.
+	AllowedExternalBaseURLs []string
+	// If true, relative references (such as Patient/123) must resolve to an
+	// entry. Otherwise, relative references which do not resolve to an entry are
+	// allowed, as they may refer to resources already on the server.
+	RequireRelativeReferencesResolve bool
+}
+
+type bundleValidationProcessor struct {
+	BaseProcessor
+	opts BundleValidationProcessorOptions
+}
+
+// Assert bundleValidationProcessor satisfies the Processor interface.
+var _ Processor = &bundleValidationProcessor{}
+
+// NewBundleValidationProcessor creates a Processor which checks that the
+// references within each Bundle's entries are consistent, passing Bundles with
+// invalid references to the pipeline's dead letter function (with a reason
+// wrapping ErrInvalidBundleReference, describing each broken entry and
+// reference). This catches malformed transaction Bundles before they are
+// submitted to a FHIR server, where they would cause confusing partial
+// failures.
+//
+// urn:uuid: and urn:oid: references must match the fullUrl of an entry.
+// Absolute references must match the fullUrl of an entry, or be to an allowed
+// external server. Relative references are resolved against the type and id
+// of the entries. Conditional references and references to contained
+// resources are not checked. Resources other than Bundles are passed through.
+func NewBundleValidationProcessor() Processor {
+	return NewBundleValidationProcessorWithOptions(nil)
+}
+
+// NewBundleValidationProcessorWithOptions is like NewBundleValidationProcessor,
+// but allows optional parameters to be set.
+func NewBundleValidationProcessorWithOptions(opts *BundleValidationProcessorOptions) Processor {
+	if opts == nil {
+		opts = &BundleValidationProcessorOptions{}
+	}
+	return &bundleValidationProcessor{opts: *opts}
+}
+
+func (bvp *bundleValidationProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	if resource.Type() != cpb.ResourceTypeCode_BUNDLE {
+		return bvp.Output(ctx, resource)
+	}
+	cr, err := resource.Proto()
+	if err != nil {
+		return err
+	}
+	problems, err := bvp.validate(cr.GetBundle())
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		return bvp.Output(ctx, resource)
+	}
+	if err := bundleValidationCounter.Record(ctx, 1); err != nil {
+		return err
+	}
+	return bvp.DeadLetterResource(ctx, resource, fmt.Errorf("%w: %s", ErrInvalidBundleReference, strings.Join(problems, "; ")))
+}
+
+// bundleEntries indexes the entries of a Bundle for resolving references.
+type bundleEntries struct {
+	fullURLs map[string]bool
+	// relative holds the "Type/id" of each entry's resource.
+	relative map[string]bool
+}
+
+// validate returns a description of each invalid reference in the Bundle.
+func (bvp *bundleValidationProcessor) validate(bundle *rpb.Bundle) ([]string, error) {
+	entries := bundleEntries{fullURLs: map[string]bool{}, relative: map[string]bool{}}
+	for _, e := range bundle.GetEntry() {
+		if fullURL := e.GetFullUrl().GetValue(); fullURL != "" {
+			entries.fullURLs[fullURL] = true
+		}
+		if typeAndID := entryTypeAndID(e); typeAndID != "" {
+			entries.relative[typeAndID] = true
+		}
+	}
+
+	var problems []string
+	for i, e := range bundle.GetEntry() {
+		label := fmt.Sprintf("entry[%d]", i)
+		if typeAndID := entryTypeAndID(e); typeAndID != "" {
+			label += " (" + typeAndID + ")"
+		}
+		res := containedResourceMessage(e.GetResource())
+		if res == nil {
+			continue
+		}
+		err := walkProtoReferences(res, "", func(path string, ref *dpb.Reference) error {
+			refStr, err := referenceString(ref)
+			if err != nil {
+				return err
+			}
+			if problem := bvp.check(entries, refStr); problem != "" {
+				problems = append(problems, fmt.Sprintf("%s %s: %q %s", label, path, refStr, problem))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
+
+// check returns a description of why ref is invalid, or an empty string if it
+// is valid.
+func (bvp *bundleValidationProcessor) check(entries bundleEntries, ref string) string {
+	switch {
+	case ref == "", strings.HasPrefix(ref, "#"), strings.Contains(ref, "?"):
+		// Not a reference to an entry, a reference to a contained resource, or a
+		// conditional reference which is resolved by the server.
+		return ""
+	case entries.fullURLs[ref]:
+		return ""
+	case strings.HasPrefix(ref, "urn:"):
+		return "does not match the fullUrl of any entry"
+	case isAbsoluteURI(ref):
+		if len(bvp.opts.AllowedExternalBaseURLs) == 0 {
+			return ""
+		}
+		for _, base := range bvp.opts.AllowedExternalBaseURLs {
+			if strings.HasPrefix(ref, base) {
+				return ""
+			}
+		}
+		return "does not match the fullUrl of any entry, and is not to an allowed external server"
+	}
+	// A relative reference, possibly to a specific version.
+	typeAndID, _, _ := strings.Cut(ref, "/_history/")
+	if entries.relative[typeAndID] || !bvp.opts.RequireRelativeReferencesResolve {
+		return ""
+	}
+	for fullURL := range entries.fullURLs {
+		if strings.HasSuffix(fullURL, "/"+typeAndID) {
+			return ""
+		}
+	}
+	return "does not match any entry"
+}
+
+// entryTypeAndID returns the "Type/id" of the entry's resource, or an empty
+// string if it has no id.
+func entryTypeAndID(e *rpb.Bundle_Entry) string {
+	res := containedResourceMessage(e.GetResource())
+	if res == nil {
+		return ""
+	}
+	idField := res.Descriptor().Fields().ByName("id")
+	if idField == nil || !res.Has(idField) {
+		return ""
+	}
+	id, ok := res.Get(idField).Message().Interface().(*dpb.Id)
+	if !ok || id.GetValue() == "" {
+		return ""
+	}
+	return string(res.Descriptor().Name()) + "/" + id.GetValue()
+}
+
+// containedResourceMessage returns the resource held by cr, or nil if it is
+// empty.
+func containedResourceMessage(cr *rpb.ContainedResource) protoreflect.Message {
+	if cr == nil {
+		return nil
+	}
+	msg := cr.ProtoReflect()
+	populated := msg.WhichOneof(msg.Descriptor().Oneofs().Get(0))
+	if populated == nil {
+		return nil
+	}
+	return msg.Get(populated).Message()
+}
+
+// referenceString returns the reference of ref as it would appear in JSON (for
+// example "Patient/123"), or an empty string if it only has an identifier.
+func referenceString(ref *dpb.Reference) (string, error) {
+	denormalized, err := jsonformat.NewDenormalizedReference(ref)
+	if err != nil {
+		return "", err
+	}
+	return denormalized.(*dpb.Reference).GetUri().GetValue(), nil
+}
+
+// walkProtoReferences calls f for each Reference within msg, with the JSON path of
+// the Reference relative to msg.
+func walkProtoReferences(msg protoreflect.Message, path string, f func(path string, ref *dpb.Reference) error) error {
+	if msg.Descriptor() == referenceDescriptor {
+		ref, ok := msg.Interface().(*dpb.Reference)
+		if !ok {
+			return fmt.Errorf("unexpected reference type %T", msg.Interface())
+		}
+		return f(path, ref)
+	}
+	var err error
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.Message() == nil {
+			return true
+		}
+		fieldPath := fd.JSONName()
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+		if fd.IsList() {
+			list := v.List()
+			for i := 0; i < list.Len() && err == nil; i++ {
+				err = walkProtoReferences(list.Get(i).Message(), fmt.Sprintf("%s[%d]", fieldPath, i), f)
+			}
+		} else {
+			err = walkProtoReferences(v.Message(), fieldPath, f)
+		}
+		return err == nil
+	})
+	return err
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// transactionBundle returns a transaction Bundle with a Patient entry, and an
+// Observation entry with the given subject and performer references.
+func transactionBundle(subject, performer string) string {
+	return fmt.Sprintf(`{
+		"resourceType": "Bundle",
+		"type": "transaction",
+		"entry": [
+			{
+				"fullUrl": "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a",
+				"resource": {"resourceType": "Patient", "id": "p1"},
+				"request": {"method": "POST", "url": "Patient"}
+			},
+			{
+				"fullUrl": "urn:uuid:88f151c0-a954-468a-88bd-5ae15c08e059",
+				"resource": {
+					"resourceType": "Observation",
+					"id": "o1",
+					"status": "final",
+					"code": {"text": "c"},
+					"subject": {"reference": %q},
+					"performer": [{"display": "Dr. Who"}, {"reference": %q}]
+				},
+				"request": {"method": "POST", "url": "Observation"}
+			}
+		]
+	}`, subject, performer)
+}
+
+func TestBundleValidationProcessor(t *testing.T) {
+	cases := []struct {
+		name      string
+		opts      *processing.BundleValidationProcessorOptions
+		subject   string
+		performer string
+		// wantProblems are substrings of the dead letter reason, or empty if the
+		// Bundle is valid.
+		wantProblems []string
+	}{
+		{
+			name:      "InternalReferences",
+			subject:   "urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a",
+			performer: "Patient/p1",
+		},
+		{
+			name:      "ExternalReferences",
+			subject:   "https://example.com/fhir/Patient/1",
+			performer: "Practitioner/1",
+		},
+		{
+			name:      "AllowedExternalReference",
+			opts:      &processing.BundleValidationProcessorOptions{AllowedExternalBaseURLs: []string{"https://example.com/fhir/"}},
+			subject:   "https://example.com/fhir/Patient/1",
+			performer: "Patient?identifier=https://example.com|1",
+		},
+		{
+			name:         "DanglingURN",
+			subject:      "urn:uuid:00000000-0000-0000-0000-000000000000",
+			performer:    "Patient/p1",
+			wantProblems: []string{`entry[1] (Observation/o1) subject: "urn:uuid:00000000-0000-0000-0000-000000000000" does not match the fullUrl of any entry`},
+		},
+		{
+			name:         "DisallowedExternalReference",
+			opts:         &processing.BundleValidationProcessorOptions{AllowedExternalBaseURLs: []string{"https://example.com/fhir/"}},
+			subject:      "https://other.example.com/Patient/1",
+			performer:    "Patient/p1",
+			wantProblems: []string{`entry[1] (Observation/o1) subject: "https://other.example.com/Patient/1" does not match the fullUrl of any entry, and is not to an allowed external server`},
+		},
+		{
+			name:      "UnresolvedRelativeReferences",
+			opts:      &processing.BundleValidationProcessorOptions{RequireRelativeReferencesResolve: true},
+			subject:   "Patient/p2",
+			performer: "Patient/p1/_history/2",
+			wantProblems: []string{
+				`entry[1] (Observation/o1) subject: "Patient/p2" does not match any entry`,
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := &processing.TestSink{}
+			var reasons []error
+			p, err := processing.NewPipelineWithOptions(
+				[]processing.Processor{processing.NewBundleValidationProcessorWithOptions(tc.opts)},
+				[]processing.Sink{ts},
+				&processing.PipelineOptions{
+					DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+						reasons = append(reasons, reason)
+						return nil
+					},
+				})
+			if err != nil {
+				t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+			}
+			if err := p.Process(context.Background(), cpb.ResourceTypeCode_BUNDLE, "", []byte(transactionBundle(tc.subject, tc.performer))); err != nil {
+				t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+			}
+
+			if len(tc.wantProblems) == 0 {
+				if len(reasons) != 0 || len(ts.WrittenResources) != 1 {
+					t.Errorf("valid Bundle was not written. dead letter reasons: %v", reasons)
+				}
+				return
+			}
+			if len(reasons) != 1 || len(ts.WrittenResources) != 0 {
+				t.Fatalf("invalid Bundle was not dead lettered. got %d reasons and %d written resources", len(reasons), len(ts.WrittenResources))
+			}
+			if !errors.Is(reasons[0], processing.ErrInvalidBundleReference) {
+				t.Errorf("unexpected dead letter reason. got: %v, want: %v", reasons[0], processing.ErrInvalidBundleReference)
+			}
+			for _, want := range tc.wantProblems {
+				if !strings.Contains(reasons[0].Error(), want) {
+					t.Errorf("dead letter reason %q does not contain %q", reasons[0], want)
+				}
+			}
+		})
+	}
+}
+
+func TestBundleValidationProcessor_OtherResourceTypes(t *testing.T) {
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline([]processing.Processor{processing.NewBundleValidationProcessor()}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	if err := p.Process(context.Background(), cpb.ResourceTypeCode_OBSERVATION, "", []byte(`{"resourceType":"Observation","id":"1","status":"final","code":{"text":"c"},"subject":{"reference":"urn:uuid:1"}}`)); err != nil {
+		t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+	}
+	if len(ts.WrittenResources) != 1 {
+		t.Errorf("unexpected number of written resources. got: %d, want: 1", len(ts.WrittenResources))
+	}
+}
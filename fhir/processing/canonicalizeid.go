@@ -0,0 +1,225 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+)
+
+// ErrInvalidID is passed (wrapped) as the dead letter reason for resources
+// with a non-conforming id or reference.
+var ErrInvalidID = errors.New("resource id or reference does not match [A-Za-z0-9\\-\\.]{1,64}")
+
+var canonicalizeIDCounter *metrics.Counter = metrics.NewCounter("canonicalize-id-counter", "Count of FHIR Resources with ids or references which do not conform to the FHIR id format. The counter is tagged by the FHIR Resource type ex) OBSERVATION and action taken ex) REWRITTEN_ID.", "1", aggregation.Count, "FHIRResourceType", "Action")
+
+// validIDRegex matches ids accepted by the FHIR specification (and so by GCP
+// FHIR store).
+var validIDRegex = regexp.MustCompile(`^[A-Za-z0-9\-\.]{1,64}$`)
+
+// originalIDExtensionURL is the URL of the extension added to a rewritten
+// resource id, recording the id the resource had in the source data.
+const originalIDExtensionURL = "https://g.co/bulk-fhir-tools/original-id"
+
+// IDCanonicalizationStrategy determines how a CanonicalizeIDProcessor handles
+// resources with non-conforming ids.
+type IDCanonicalizationStrategy int
+
+const (
+	// RewriteInvalidIDs replaces non-conforming ids (and references to them)
+	// with a deterministic, valid id derived from a hash of the original id.
+	RewriteInvalidIDs IDCanonicalizationStrategy = iota
+	// DeadLetterInvalidIDs drops resources with non-conforming ids or
+	// references, passing them to the pipeline's dead letter function.
+	DeadLetterInvalidIDs
+)
+
+type canonicalizeIDProcessor struct {
+	BaseProcessor
+	strategy IDCanonicalizationStrategy
+	// mapping holds original id -> canonical id for every id rewritten so far.
+	mapping map[string]string
+}
+
+// Assert canonicalizeIDProcessor satisfies the Processor interface.
+var _ Processor = &canonicalizeIDProcessor{}
+
+// NewCanonicalizeIDProcessor creates a Processor which detects resources whose
+// id, or the id in any of their relative literal references, does not conform
+// to the FHIR id format ([A-Za-z0-9\-\.]{1,64}), and handles them according to
+// strategy.
+//
+// When rewriting, the new id is the hex encoded SHA-256 hash of the original
+// id, and the original id is recorded in an extension on the resource's id.
+// Because the rewrite is deterministic, references are rewritten consistently
+// regardless of the order in which the referencing and referenced resources
+// are processed (including across separate runs).
+//
+// Resources with non-conforming ids cannot be parsed into protos, so this
+// processor operates on the resource JSON, and must come before any other
+// processors in the pipeline.
+func NewCanonicalizeIDProcessor(strategy IDCanonicalizationStrategy) Processor {
+	return &canonicalizeIDProcessor{strategy: strategy, mapping: map[string]string{}}
+}
+
+func (cip *canonicalizeIDProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	res, err := decodeResourceJSON(rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+
+	if cip.strategy == DeadLetterInvalidIDs {
+		invalid := []string{}
+		if id, ok := res["id"].(string); ok && !validIDRegex.MatchString(id) {
+			invalid = append(invalid, id)
+		}
+		walkReferences(res, func(refID string) string {
+			if !validIDRegex.MatchString(refID) {
+				invalid = append(invalid, refID)
+			}
+			return refID
+		})
+		if len(invalid) > 0 {
+			if err := canonicalizeIDCounter.Record(ctx, 1, resource.Type().String(), "DEAD_LETTERED"); err != nil {
+				return err
+			}
+			return cip.DeadLetterResource(ctx, resource, fmt.Errorf("%w: %q", ErrInvalidID, invalid))
+		}
+		return cip.Output(ctx, resource)
+	}
+
+	changed := false
+	if id, ok := res["id"].(string); ok && !validIDRegex.MatchString(id) {
+		res["id"] = cip.canonicalID(id)
+		addOriginalIDExtension(res, id)
+		changed = true
+		if err := canonicalizeIDCounter.Record(ctx, 1, resource.Type().String(), "REWRITTEN_ID"); err != nil {
+			return err
+		}
+	}
+	rewrittenRefs := 0
+	walkReferences(res, func(refID string) string {
+		if validIDRegex.MatchString(refID) {
+			return refID
+		}
+		rewrittenRefs++
+		return cip.canonicalID(refID)
+	})
+	if rewrittenRefs > 0 {
+		changed = true
+		if err := canonicalizeIDCounter.Record(ctx, int64(rewrittenRefs), resource.Type().String(), "REWRITTEN_REFERENCE"); err != nil {
+			return err
+		}
+	}
+
+	if changed {
+		if err := setResourceJSON(resource, res); err != nil {
+			return err
+		}
+	}
+	return cip.Output(ctx, resource)
+}
+
+func (cip *canonicalizeIDProcessor) Finalize(ctx context.Context) error {
+	if len(cip.mapping) > 0 {
+		log.Infof("Rewrote %d distinct non-conforming resource ids.", len(cip.mapping))
+	}
+	return nil
+}
+
+// canonicalID returns the valid id which replaces the given non-conforming id.
+func (cip *canonicalizeIDProcessor) canonicalID(original string) string {
+	if c, ok := cip.mapping[original]; ok {
+		return c
+	}
+	sum := sha256.Sum256([]byte(original))
+	c := hex.EncodeToString(sum[:])
+	cip.mapping[original] = c
+	return c
+}
+
+// addOriginalIDExtension records the original id of a resource in an extension
+// on its (primitive) id element.
+func addOriginalIDExtension(res map[string]any, original string) {
+	idElement, ok := res["_id"].(map[string]any)
+	if !ok {
+		idElement = map[string]any{}
+		res["_id"] = idElement
+	}
+	extensions, _ := idElement["extension"].([]any)
+	idElement["extension"] = append(extensions, map[string]any{
+		"url":         originalIDExtensionURL,
+		"valueString": original,
+	})
+}
+
+// walkReferences finds every relative literal reference within the given JSON
+// value, and replaces the referenced id with the result of calling fn.
+func walkReferences(v any, fn func(id string) string) {
+	walkReferenceStrings(v, func(ref string) string {
+		return rewriteReference(ref, fn)
+	})
+}
+
+// walkReferenceStrings finds every reference string within the given JSON
+// value, and replaces it with the result of calling fn. Contained resources are
+// skipped, as they are referenced by local fragment ids.
+func walkReferenceStrings(v any, fn func(ref string) string) {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, child := range t {
+			if k == "contained" {
+				continue
+			}
+			if ref, ok := child.(string); ok && k == "reference" {
+				t[k] = fn(ref)
+				continue
+			}
+			walkReferenceStrings(child, fn)
+		}
+	case []any:
+		for _, child := range t {
+			walkReferenceStrings(child, fn)
+		}
+	}
+}
+
+// rewriteReference rewrites the id of a relative reference of the form Type/id
+// or Type/id/_history/version. Other references (absolute URLs, fragments, etc)
+// are returned unchanged.
+func rewriteReference(ref string, fn func(id string) string) string {
+	if strings.Contains(ref, "://") || strings.HasPrefix(ref, "#") {
+		return ref
+	}
+	parts := strings.SplitN(ref, "/", 3)
+	if len(parts) < 2 || (len(parts) == 3 && !strings.HasPrefix(parts[2], "_history/")) {
+		return ref
+	}
+	parts[1] = fn(parts[1])
+	return strings.Join(parts, "/")
+}
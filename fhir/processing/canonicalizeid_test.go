@@ -0,0 +1,141 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestCanonicalizeIDProcessor_Rewrite(t *testing.T) {
+	longID := strings.Repeat("a", 65)
+	canonicalPat1 := sha256Hex("pat_1")
+	cases := []struct {
+		name         string
+		resourceType cpb.ResourceTypeCode_Value
+		jsonIn       string
+		wantJSON     string
+	}{
+		{
+			name:         "ValidIDUnchanged",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			jsonIn:       `{"resourceType":"Patient","id":"PatientA-1.2"}`,
+			wantJSON:     `{"resourceType":"Patient","id":"PatientA-1.2"}`,
+		},
+		{
+			name:         "IllegalCharacters",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			jsonIn:       `{"resourceType":"Patient","id":"pat_1"}`,
+			wantJSON:     `{"resourceType":"Patient","id":"` + canonicalPat1 + `","_id":{"extension":[{"url":"https://g.co/bulk-fhir-tools/original-id","valueString":"pat_1"}]}}`,
+		},
+		{
+			name:         "TooLong",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			jsonIn:       `{"resourceType":"Patient","id":"` + longID + `"}`,
+			wantJSON:     `{"resourceType":"Patient","id":"` + sha256Hex(longID) + `","_id":{"extension":[{"url":"https://g.co/bulk-fhir-tools/original-id","valueString":"` + longID + `"}]}}`,
+		},
+		{
+			name:         "References",
+			resourceType: cpb.ResourceTypeCode_ENCOUNTER,
+			jsonIn:       `{"resourceType":"Encounter","id":"enc1","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Patient/pat_1"},"participant":[{"individual":{"reference":"Practitioner/ok"}}],"partOf":{"reference":"Encounter/pat_1/_history/2"}}`,
+			wantJSON:     `{"resourceType":"Encounter","id":"enc1","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Patient/` + canonicalPat1 + `"},"participant":[{"individual":{"reference":"Practitioner/ok"}}],"partOf":{"reference":"Encounter/` + canonicalPat1 + `/_history/2"}}`,
+		},
+		{
+			name:         "AbsoluteReferenceUnchanged",
+			resourceType: cpb.ResourceTypeCode_ENCOUNTER,
+			jsonIn:       `{"resourceType":"Encounter","id":"enc1","status":"finished","class":{"code":"AMB"},"subject":{"reference":"https://example.com/fhir/Patient/pat_1"}}`,
+			wantJSON:     `{"resourceType":"Encounter","id":"enc1","status":"finished","class":{"code":"AMB"},"subject":{"reference":"https://example.com/fhir/Patient/pat_1"}}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{processing.NewCanonicalizeIDProcessor(processing.RewriteInvalidIDs)}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			if err := p.Process(context.Background(), tc.resourceType, "", []byte(tc.jsonIn)); err != nil {
+				t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", tc.jsonIn, err)
+			}
+			if len(ts.WrittenResources) != 1 {
+				t.Fatalf("unexpected number of written resources. got: %d, want: 1", len(ts.WrittenResources))
+			}
+			gotJSON, err := ts.WrittenResources[0].JSON()
+			if err != nil {
+				t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+			}
+			normalizedWantJSON := testhelpers.NormalizeJSON(t, []byte(tc.wantJSON))
+			normalizedGotJSON := testhelpers.NormalizeJSON(t, gotJSON)
+			if !cmp.Equal(normalizedGotJSON, normalizedWantJSON) {
+				t.Errorf("pipeline.Process(..., %s) produced unexpected output. got: %s, want: %s", tc.jsonIn, normalizedGotJSON, normalizedWantJSON)
+			}
+		})
+	}
+}
+
+func TestCanonicalizeIDProcessor_DeadLetter(t *testing.T) {
+	ts := &processing.TestSink{}
+	var deadLettered []error
+	opts := &processing.PipelineOptions{
+		DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+			deadLettered = append(deadLettered, reason)
+			return nil
+		},
+	}
+	p, err := processing.NewPipelineWithOptions([]processing.Processor{processing.NewCanonicalizeIDProcessor(processing.DeadLetterInvalidIDs)}, []processing.Sink{ts}, opts)
+	if err != nil {
+		t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	inputs := []struct {
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+	}{
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"good"}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"pat_1"}`},
+		{cpb.ResourceTypeCode_ENCOUNTER, `{"resourceType":"Encounter","id":"enc1","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Patient/pat_1"}}`},
+	}
+	for _, in := range inputs {
+		if err := p.Process(ctx, in.resourceType, "", []byte(in.json)); err != nil {
+			t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", in.json, err)
+		}
+	}
+	if len(ts.WrittenResources) != 1 {
+		t.Errorf("unexpected number of written resources. got: %d, want: 1", len(ts.WrittenResources))
+	}
+	if len(deadLettered) != 2 {
+		t.Fatalf("unexpected number of dead lettered resources. got: %d, want: 2", len(deadLettered))
+	}
+	for _, reason := range deadLettered {
+		if !errors.Is(reason, processing.ErrInvalidID) {
+			t.Errorf("unexpected dead letter reason. got: %v, want: %v", reason, processing.ErrInvalidID)
+		}
+	}
+}
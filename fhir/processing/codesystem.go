@@ -0,0 +1,258 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	rpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// ErrDisallowedCodeSystem is passed (wrapped) as the dead letter reason for
+// resources with a coded field which is not from one of the code systems
+// allowed by a CodeSystemEnforcementProcessor, if the CodeSystemDeadLetter
+// action is used.
+var ErrDisallowedCodeSystem = errors.New("resource has a code from a disallowed code system")
+
+// CodeSystemViolationAttribute is the ResourceWrapper attribute which the
+// processor returned by NewCodeSystemEnforcementProcessor sets to a comma
+// separated list of the violations found (each a field path and the disallowed
+// system, as path=system), if the CodeSystemFlag action is used.
+const CodeSystemViolationAttribute = "code_system_violations"
+
+var codeSystemCounter *metrics.Counter = metrics.NewCounter("code-system-enforcement-counter", "Count of FHIR Resources with codes from disallowed code systems. The counter is tagged by the FHIR Resource type ex) OBSERVATION, and the action taken.", "1", aggregation.Count, "FHIRResourceType", "Action")
+
+// CodeSystemAction is the action taken by NewCodeSystemEnforcementProcessor on
+// resources with codes from disallowed code systems.
+type CodeSystemAction int
+
+const (
+	// CodeSystemDeadLetter passes the resource to the pipeline's dead letter
+	// function.
+	CodeSystemDeadLetter CodeSystemAction = iota
+	// CodeSystemFlag sets the CodeSystemViolationAttribute of the resource, and
+	// logs a warning. The resource is not modified.
+	CodeSystemFlag
+)
+
+func (a CodeSystemAction) String() string {
+	switch a {
+	case CodeSystemDeadLetter:
+		return "dead_letter"
+	case CodeSystemFlag:
+		return "flag"
+	default:
+		return fmt.Sprintf("CodeSystemAction(%d)", int(a))
+	}
+}
+
+// codedField is a parsed field path, with the code systems allowed in it.
+type codedField struct {
+	requiredField
+	allowed map[string]bool
+}
+
+type codeSystemEnforcementProcessor struct {
+	BaseProcessor
+	action CodeSystemAction
+	rules  map[cpb.ResourceTypeCode_Value][]codedField
+}
+
+// Assert codeSystemEnforcementProcessor satisfies the Processor interface.
+var _ Processor = &codeSystemEnforcementProcessor{}
+
+// NewCodeSystemEnforcementProcessor creates a Processor which checks that the
+// coded fields listed for each resource type in rules use one of the code
+// systems listed for them, and takes the given action on resources which do
+// not. For example, {OBSERVATION: {"code": {"http://loinc.org"}}} requires
+// Observation codes to be LOINC.
+//
+// Fields are given as dot separated paths of FHIR JSON field names to a
+// CodeableConcept or Coding (or a choice type with one of those options, using
+// the name without the type suffix), as for NewRequiredFieldsProcessor. If a
+// path traverses a repeated field, every element is checked. A CodeableConcept
+// is allowed if any of its codings is from an allowed system (so that codes
+// may be accompanied by translations into other systems), while a Coding must
+// itself be from an allowed system. Fields which are not populated are not
+// checked; use NewRequiredFieldsProcessor to require them. Resources of types
+// with no rules are passed through.
+func NewCodeSystemEnforcementProcessor(rules map[cpb.ResourceTypeCode_Value]map[string][]string, action CodeSystemAction) (Processor, error) {
+	switch action {
+	case CodeSystemDeadLetter, CodeSystemFlag:
+	default:
+		return nil, fmt.Errorf("unknown CodeSystemAction %d", action)
+	}
+	containedFields := (&rpb.ContainedResource{}).ProtoReflect().Descriptor().Fields()
+	csp := &codeSystemEnforcementProcessor{action: action, rules: map[cpb.ResourceTypeCode_Value][]codedField{}}
+	for resourceType, fields := range rules {
+		resourceField := containedFields.ByName(protoreflect.Name(strings.ToLower(resourceType.String())))
+		if resourceField == nil {
+			return nil, fmt.Errorf("unsupported resource type %s", resourceType)
+		}
+		for path, systems := range fields {
+			rf, err := parseRequiredField(resourceField.Message(), path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid coded field for %s: %w", resourceType, err)
+			}
+			if !isCodedMessage(rf.fields[len(rf.fields)-1].Message()) {
+				return nil, fmt.Errorf("invalid coded field for %s: %q is not a CodeableConcept or Coding", resourceType, path)
+			}
+			cf := codedField{requiredField: rf, allowed: map[string]bool{}}
+			for _, s := range systems {
+				cf.allowed[s] = true
+			}
+			csp.rules[resourceType] = append(csp.rules[resourceType], cf)
+		}
+		// Sorted so that violations are reported in a consistent order.
+		sort.Slice(csp.rules[resourceType], func(i, j int) bool {
+			return csp.rules[resourceType][i].path < csp.rules[resourceType][j].path
+		})
+	}
+	return csp, nil
+}
+
+var (
+	codeableConceptName = (&dpb.CodeableConcept{}).ProtoReflect().Descriptor().FullName()
+	codingName          = (&dpb.Coding{}).ProtoReflect().Descriptor().FullName()
+)
+
+// isCodedMessage returns whether md is a CodeableConcept or Coding, or a
+// choice type with one of them as an option.
+func isCodedMessage(md protoreflect.MessageDescriptor) bool {
+	if md == nil {
+		return false
+	}
+	if md.FullName() == codeableConceptName || md.FullName() == codingName {
+		return true
+	}
+	if md.Oneofs().Len() == 0 {
+		return false
+	}
+	fields := md.Oneofs().Get(0).Fields()
+	for i := 0; i < fields.Len(); i++ {
+		if fm := fields.Get(i).Message(); fm != nil && (fm.FullName() == codeableConceptName || fm.FullName() == codingName) {
+			return true
+		}
+	}
+	return false
+}
+
+func (csp *codeSystemEnforcementProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rules, ok := csp.rules[resource.Type()]
+	if !ok {
+		return csp.Output(ctx, resource)
+	}
+	cr, err := resource.Proto()
+	if err != nil {
+		return err
+	}
+	msg := cr.ProtoReflect()
+	populated := msg.WhichOneof(msg.Descriptor().Oneofs().Get(0))
+	if populated == nil {
+		return fmt.Errorf("%s resource from %s has no content", resource.Type(), resource.SourceURL())
+	}
+	res := msg.Get(populated).Message()
+
+	var violations []string
+	for _, cf := range rules {
+		visitPath(res, cf.fields, func(m protoreflect.Message) {
+			if system, ok := disallowedSystem(m, cf.allowed); !ok {
+				violations = append(violations, cf.path+"="+system)
+			}
+		})
+	}
+	if len(violations) == 0 {
+		return csp.Output(ctx, resource)
+	}
+	if err := codeSystemCounter.Record(ctx, 1, resource.Type().String(), csp.action.String()); err != nil {
+		return err
+	}
+	if csp.action == CodeSystemDeadLetter {
+		return csp.DeadLetterResource(ctx, resource, fmt.Errorf("%w: %s", ErrDisallowedCodeSystem, strings.Join(violations, ", ")))
+	}
+	log.Warningf("%s resource from %s has codes from disallowed code systems: %s", resource.Type(), resource.SourceURL(), strings.Join(violations, ", "))
+	SetResourceAttribute(resource, CodeSystemViolationAttribute, strings.Join(violations, ","))
+	return csp.Output(ctx, resource)
+}
+
+// visitPath calls f with each message at the given path of fields in msg.
+func visitPath(msg protoreflect.Message, fields []protoreflect.FieldDescriptor, f func(protoreflect.Message)) {
+	fd, rest := fields[0], fields[1:]
+	var values []protoreflect.Message
+	if fd.IsList() {
+		list := msg.Get(fd).List()
+		for i := 0; i < list.Len(); i++ {
+			values = append(values, list.Get(i).Message())
+		}
+	} else if msg.Has(fd) {
+		values = append(values, msg.Get(fd).Message())
+	}
+	for _, v := range values {
+		if len(rest) == 0 {
+			f(v)
+		} else {
+			visitPath(v, rest, f)
+		}
+	}
+}
+
+// disallowedSystem checks the CodeableConcept or Coding m (or the populated
+// option of a choice type) against the allowed systems. If it is not allowed,
+// the returned bool is false and the string holds the disallowed system (or
+// the first of them, for a CodeableConcept).
+func disallowedSystem(m protoreflect.Message, allowed map[string]bool) (string, bool) {
+	if m.Descriptor().FullName() != codeableConceptName && m.Descriptor().FullName() != codingName {
+		populated := m.WhichOneof(m.Descriptor().Oneofs().Get(0))
+		if populated == nil || populated.Message() == nil {
+			return "", true
+		}
+		m = m.Get(populated).Message()
+	}
+	switch v := m.Interface().(type) {
+	case *dpb.Coding:
+		system := v.GetSystem().GetValue()
+		return systemName(system), allowed[system]
+	case *dpb.CodeableConcept:
+		if len(v.GetCoding()) == 0 {
+			return "(no coding)", false
+		}
+		for _, c := range v.GetCoding() {
+			if allowed[c.GetSystem().GetValue()] {
+				return "", true
+			}
+		}
+		return systemName(v.GetCoding()[0].GetSystem().GetValue()), false
+	}
+	// Other options of a choice type are not coded.
+	return "", true
+}
+
+func systemName(system string) string {
+	if system == "" {
+		return "(no system)"
+	}
+	return system
+}
@@ -0,0 +1,138 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestCodeSystemEnforcementProcessor(t *testing.T) {
+	rules := map[cpb.ResourceTypeCode_Value]map[string][]string{
+		cpb.ResourceTypeCode_OBSERVATION: {
+			"code":          {"http://loinc.org"},
+			"category":      {"http://terminology.hl7.org/CodeSystem/observation-category"},
+			"value":         {"http://snomed.info/sct"},
+			"meta.security": {"http://terminology.hl7.org/CodeSystem/v3-Confidentiality"},
+		},
+	}
+	cases := []struct {
+		name           string
+		resourceType   cpb.ResourceTypeCode_Value
+		json           string
+		wantViolations string
+	}{
+		{
+			name:         "Allowed",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         `{"resourceType":"Observation","id":"1","status":"final","code":{"coding":[{"system":"http://example.com/local","code":"x"},{"system":"http://loinc.org","code":"1234-5"}]},"valueCodeableConcept":{"coding":[{"system":"http://snomed.info/sct","code":"1"}]}}`,
+		},
+		{
+			name:         "OtherChoiceTypeNotChecked",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         `{"resourceType":"Observation","id":"1","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"1234-5"}]},"valueString":"v"}`,
+		},
+		{
+			name:           "Disallowed",
+			resourceType:   cpb.ResourceTypeCode_OBSERVATION,
+			json:           `{"resourceType":"Observation","id":"1","meta":{"security":[{"system":"http://terminology.hl7.org/CodeSystem/v3-Confidentiality","code":"R"},{"code":"X"}]},"status":"final","category":[{"text":"vitals"}],"code":{"coding":[{"system":"http://example.com/local","code":"x"}]}}`,
+			wantViolations: "category=(no coding),code=http://example.com/local,meta.security=(no system)",
+		},
+		{
+			name:         "NoRulesForType",
+			resourceType: cpb.ResourceTypeCode_CONDITION,
+			json:         `{"resourceType":"Condition","id":"1","subject":{"reference":"Patient/1"},"code":{"coding":[{"system":"http://example.com/local","code":"x"}]}}`,
+		},
+	}
+	for _, tc := range cases {
+		for _, action := range []processing.CodeSystemAction{processing.CodeSystemDeadLetter, processing.CodeSystemFlag} {
+			t.Run(tc.name+"_"+action.String(), func(t *testing.T) {
+				csp, err := processing.NewCodeSystemEnforcementProcessor(rules, action)
+				if err != nil {
+					t.Fatalf("NewCodeSystemEnforcementProcessor() returned unexpected error: %v", err)
+				}
+				ts := &processing.TestSink{}
+				var deadLetterReasons []error
+				opts := &processing.PipelineOptions{
+					DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+						deadLetterReasons = append(deadLetterReasons, reason)
+						return nil
+					},
+				}
+				p, err := processing.NewPipelineWithOptions([]processing.Processor{csp}, []processing.Sink{ts}, opts)
+				if err != nil {
+					t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+				}
+				if err := p.Process(context.Background(), tc.resourceType, "", []byte(tc.json)); err != nil {
+					t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", tc.json, err)
+				}
+
+				if tc.wantViolations == "" || action == processing.CodeSystemFlag {
+					if len(ts.WrittenResources) != 1 || len(deadLetterReasons) != 0 {
+						t.Fatalf("resource was not passed through: written %d, dead lettered: %v", len(ts.WrittenResources), deadLetterReasons)
+					}
+					got, _ := processing.ResourceAttribute(ts.WrittenResources[0], processing.CodeSystemViolationAttribute)
+					if got != tc.wantViolations {
+						t.Errorf("Attribute(CodeSystemViolationAttribute) = %q, want %q", got, tc.wantViolations)
+					}
+					return
+				}
+				if len(ts.WrittenResources) != 0 || len(deadLetterReasons) != 1 {
+					t.Fatalf("resource was not dead lettered: written %d, dead lettered: %v", len(ts.WrittenResources), deadLetterReasons)
+				}
+				if !errors.Is(deadLetterReasons[0], processing.ErrDisallowedCodeSystem) {
+					t.Errorf("dead letter reason %v does not wrap ErrDisallowedCodeSystem", deadLetterReasons[0])
+				}
+			})
+		}
+	}
+}
+
+func TestNewCodeSystemEnforcementProcessor_Invalid(t *testing.T) {
+	cases := []struct {
+		name   string
+		rules  map[cpb.ResourceTypeCode_Value]map[string][]string
+		action processing.CodeSystemAction
+	}{
+		{
+			name:  "UnknownField",
+			rules: map[cpb.ResourceTypeCode_Value]map[string][]string{cpb.ResourceTypeCode_OBSERVATION: {"nope": {"s"}}},
+		},
+		{
+			name:  "NotCoded",
+			rules: map[cpb.ResourceTypeCode_Value]map[string][]string{cpb.ResourceTypeCode_OBSERVATION: {"subject": {"s"}}},
+		},
+		{
+			name:  "ChoiceWithoutCodes",
+			rules: map[cpb.ResourceTypeCode_Value]map[string][]string{cpb.ResourceTypeCode_OBSERVATION: {"effective": {"s"}}},
+		},
+		{
+			name:   "UnknownAction",
+			action: processing.CodeSystemAction(99),
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := processing.NewCodeSystemEnforcementProcessor(tc.rules, tc.action); err == nil {
+				t.Error("NewCodeSystemEnforcementProcessor() succeeded, want error")
+			}
+		})
+	}
+}
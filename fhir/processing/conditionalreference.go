@@ -0,0 +1,276 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+)
+
+// ErrUnresolvableReference is passed (wrapped) as the dead letter reason for
+// resources with conditional references which could not be resolved by a
+// ConditionalReferenceResolverProcessor.
+var ErrUnresolvableReference = errors.New("conditional reference could not be resolved")
+
+var unresolvedReferenceCounter *metrics.Counter = metrics.NewCounter("unresolved-reference-counter", "Count of conditional references which could not be resolved to a literal reference. The counter is tagged by the FHIR Resource type ex) OBSERVATION.", "1", aggregation.Count, "FHIRResourceType")
+
+type identifierKey struct {
+	resourceType, system, value string
+	// anySystem is set for the keys used to look up identifiers without
+	// regard to their system.
+	anySystem bool
+}
+
+// IdentifierIndex maps the business identifiers of resources to their logical
+// ids, for resolving conditional references. It is safe for concurrent use.
+type IdentifierIndex struct {
+	mu  sync.RWMutex
+	ids map[identifierKey]map[string]bool
+}
+
+// NewIdentifierIndex returns an empty IdentifierIndex.
+func NewIdentifierIndex() *IdentifierIndex {
+	return &IdentifierIndex{ids: map[identifierKey]map[string]bool{}}
+}
+
+// Add records that the resource of the given type (for example "Patient")
+// with logical id id has the identifier with the given system and value.
+func (ii *IdentifierIndex) Add(resourceType, system, value, id string) {
+	ii.mu.Lock()
+	defer ii.mu.Unlock()
+	for _, k := range []identifierKey{
+		{resourceType: resourceType, system: system, value: value},
+		{resourceType: resourceType, value: value, anySystem: true},
+	} {
+		if ii.ids[k] == nil {
+			ii.ids[k] = map[string]bool{}
+		}
+		ii.ids[k][id] = true
+	}
+}
+
+type identifierJSON struct {
+	System string `json:"system"`
+	Value  string `json:"value"`
+}
+
+type identifiedResourceJSON struct {
+	ResourceType string           `json:"resourceType"`
+	ID           string           `json:"id"`
+	Identifier   []identifierJSON `json:"identifier"`
+}
+
+// AddResourceJSON records all of the identifiers of the given FHIR JSON
+// resource. Resources without an id are ignored.
+func (ii *IdentifierIndex) AddResourceJSON(resourceJSON []byte) error {
+	var r identifiedResourceJSON
+	if err := json.Unmarshal(resourceJSON, &r); err != nil {
+		return err
+	}
+	if r.ID == "" {
+		return nil
+	}
+	for _, i := range r.Identifier {
+		if i.Value != "" {
+			ii.Add(r.ResourceType, i.System, i.Value, r.ID)
+		}
+	}
+	return nil
+}
+
+// Lookup returns the logical id of the resource of the given type with the
+// given identifier. If system is empty, identifiers with any system match.
+// The returned bool is false if there is not exactly one matching resource.
+func (ii *IdentifierIndex) Lookup(resourceType, system, value string) (string, bool) {
+	k := identifierKey{resourceType: resourceType, system: system, value: value}
+	if system == "" {
+		k = identifierKey{resourceType: resourceType, value: value, anySystem: true}
+	}
+	ii.mu.RLock()
+	defer ii.mu.RUnlock()
+	if len(ii.ids[k]) != 1 {
+		return "", false
+	}
+	for id := range ii.ids[k] {
+		return id, true
+	}
+	return "", false
+}
+
+// resolve returns the literal reference for a conditional reference of the
+// form Type?identifier=[system|]value.
+func (ii *IdentifierIndex) resolve(reference string) (string, bool) {
+	resourceType, query, _ := strings.Cut(reference, "?")
+	params, err := url.ParseQuery(query)
+	if err != nil || len(params) != 1 || len(params["identifier"]) != 1 {
+		return "", false
+	}
+	token := params["identifier"][0]
+	system, value := "", token
+	// Strictly, an empty system (|value) only matches identifiers without a
+	// system, but it is treated in the same way as no system here.
+	if s, v, ok := strings.Cut(token, "|"); ok {
+		system, value = s, v
+	}
+	id, ok := ii.Lookup(resourceType, system, value)
+	if !ok {
+		return "", false
+	}
+	return resourceType + "/" + id, true
+}
+
+// isConditionalReference returns whether reference is a conditional reference
+// (for example Patient?identifier=123) rather than a literal one.
+func isConditionalReference(reference string) bool {
+	resourceType, _, ok := strings.Cut(reference, "?")
+	return ok && resourceType != "" && !strings.ContainsAny(resourceType, "/:")
+}
+
+type pendingResource struct {
+	resource ResourceWrapper
+	res      map[string]any
+}
+
+type conditionalReferenceProcessor struct {
+	BaseProcessor
+	index *IdentifierIndex
+	// pending holds resources with conditional references to resources which
+	// had not been seen yet.
+	pending []pendingResource
+}
+
+// Assert conditionalReferenceProcessor satisfies the Processor interface.
+var _ Processor = &conditionalReferenceProcessor{}
+
+// NewConditionalReferenceResolverProcessor creates a Processor which rewrites
+// conditional references of the form Type?identifier=[system|]value to literal
+// Type/id references, for loading data with individual requests rather than
+// transaction Bundles (in which the server would resolve them).
+//
+// The identifiers of every resource passing through the processor are added
+// to index, which may also be pre-populated (for example, with resources
+// loaded by an earlier batch). If index is nil, a new IdentifierIndex is used.
+// As a reference may be to a resource later in the batch, resources with
+// references which cannot be resolved yet are held until Finalize. Resources
+// with references which still cannot be resolved then (because no resource, or
+// more than one, has the identifier) are passed to the pipeline's dead letter
+// function.
+func NewConditionalReferenceResolverProcessor(index *IdentifierIndex) Processor {
+	if index == nil {
+		index = NewIdentifierIndex()
+	}
+	return &conditionalReferenceProcessor{index: index}
+}
+
+func (crp *conditionalReferenceProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	if err := crp.index.AddResourceJSON(rawJSON); err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	if !bytes.Contains(rawJSON, []byte("?")) {
+		return crp.Output(ctx, resource)
+	}
+
+	res, err := decodeResourceJSON(rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	resolved, unresolved := crp.resolveReferences(res)
+	if len(unresolved) > 0 {
+		// The JSON may be reused by the caller, so a copy is held.
+		if err := setJSON(resource, append([]byte(nil), rawJSON...)); err != nil {
+			return err
+		}
+		crp.pending = append(crp.pending, pendingResource{resource: resource, res: res})
+		return nil
+	}
+	if resolved > 0 {
+		if err := setResourceJSON(resource, res); err != nil {
+			return err
+		}
+	}
+	return crp.Output(ctx, resource)
+}
+
+func (crp *conditionalReferenceProcessor) Finalize(ctx context.Context) error {
+	pending := crp.pending
+	crp.pending = nil
+	for _, p := range pending {
+		_, unresolved := crp.resolveReferences(p.res)
+		if len(unresolved) > 0 {
+			if err := unresolvedReferenceCounter.Record(ctx, int64(len(unresolved)), p.resource.Type().String()); err != nil {
+				return err
+			}
+			sort.Strings(unresolved)
+			reason := fmt.Errorf("%w: %s", ErrUnresolvableReference, strings.Join(unresolved, ", "))
+			if err := crp.DeadLetterResource(ctx, p.resource, reason); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := setResourceJSON(p.resource, p.res); err != nil {
+			return err
+		}
+		if err := crp.Output(ctx, p.resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveReferences replaces the conditional references within v which can be
+// resolved, returning the number replaced and the references which could not
+// be.
+func (crp *conditionalReferenceProcessor) resolveReferences(v any) (int, []string) {
+	resolved := 0
+	var unresolved []string
+	switch t := v.(type) {
+	case map[string]any:
+		for k, child := range t {
+			if ref, ok := child.(string); ok && k == "reference" && isConditionalReference(ref) {
+				if literal, ok := crp.index.resolve(ref); ok {
+					t[k] = literal
+					resolved++
+				} else {
+					unresolved = append(unresolved, ref)
+				}
+				continue
+			}
+			n, u := crp.resolveReferences(child)
+			resolved += n
+			unresolved = append(unresolved, u...)
+		}
+	case []any:
+		for _, child := range t {
+			n, u := crp.resolveReferences(child)
+			resolved += n
+			unresolved = append(unresolved, u...)
+		}
+	}
+	return resolved, unresolved
+}
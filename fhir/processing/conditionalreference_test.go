@@ -0,0 +1,136 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestConditionalReferenceResolverProcessor(t *testing.T) {
+	ctx := context.Background()
+	index := processing.NewIdentifierIndex()
+	// The Practitioner was loaded in an earlier batch.
+	index.Add("Practitioner", "npi", "999", "pr1")
+
+	resources := []struct {
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+	}{
+		// References a Patient later in the batch.
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"o1","status":"final","code":{"text":"c"},"subject":{"reference":"Patient?identifier=mrn|123"},"performer":[{"reference":"Practitioner?identifier=999"}],"valueQuantity":{"value":1.50}}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p1","identifier":[{"system":"mrn","value":"123"}]}`},
+		{cpb.ResourceTypeCode_ENCOUNTER, `{"resourceType":"Encounter","id":"e1","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Patient?identifier=123"}}`},
+		{cpb.ResourceTypeCode_ENCOUNTER, `{"resourceType":"Encounter","id":"e2","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Patient?identifier=mrn|456"}}`},
+		{cpb.ResourceTypeCode_ENCOUNTER, `{"resourceType":"Encounter","id":"e3","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Patient/p1"}}`},
+	}
+
+	crp := processing.NewConditionalReferenceResolverProcessor(index)
+	ts := &processing.TestSink{}
+	var deadLettered []string
+	var deadLetterReasons []error
+	opts := &processing.PipelineOptions{
+		DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+			json, err := resource.JSON()
+			if err != nil {
+				t.Fatalf("JSON() returned unexpected error: %v", err)
+			}
+			deadLettered = append(deadLettered, string(json))
+			deadLetterReasons = append(deadLetterReasons, reason)
+			return nil
+		},
+	}
+	p, err := processing.NewPipelineWithOptions([]processing.Processor{crp}, []processing.Sink{ts}, opts)
+	if err != nil {
+		t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+	}
+	for _, r := range resources {
+		// The JSON is passed in a buffer which is overwritten afterwards, as it may
+		// be by the fetcher.
+		buf := []byte(r.json)
+		if err := p.Process(ctx, r.resourceType, "url", buf); err != nil {
+			t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", r.json, err)
+		}
+		for i := range buf {
+			buf[i] = ' '
+		}
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+
+	want := []string{
+		`{"resourceType":"Patient","id":"p1","identifier":[{"system":"mrn","value":"123"}]}`,
+		`{"resourceType":"Encounter","id":"e1","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Patient/p1"}}`,
+		`{"resourceType":"Encounter","id":"e3","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Patient/p1"}}`,
+		`{"resourceType":"Observation","id":"o1","status":"final","code":{"text":"c"},"subject":{"reference":"Patient/p1"},"performer":[{"reference":"Practitioner/pr1"}],"valueQuantity":{"value":1.50}}`,
+	}
+	var got []string
+	for _, r := range ts.WrittenResources {
+		json, err := r.JSON()
+		if err != nil {
+			t.Fatalf("JSON() returned unexpected error: %v", err)
+		}
+		got = append(got, testhelpers.NormalizeJSONString(t, string(json)))
+	}
+	for i := range want {
+		want[i] = testhelpers.NormalizeJSONString(t, want[i])
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected resources written (-want +got):\n%s", diff)
+	}
+
+	wantDeadLettered := []string{resources[3].json}
+	if diff := cmp.Diff(wantDeadLettered, deadLettered); diff != "" {
+		t.Errorf("unexpected resources dead lettered (-want +got):\n%s", diff)
+	}
+	if len(deadLetterReasons) != 1 || !errors.Is(deadLetterReasons[0], processing.ErrUnresolvableReference) {
+		t.Errorf("unexpected dead letter reasons. got: %v, want: [%v]", deadLetterReasons, processing.ErrUnresolvableReference)
+	}
+}
+
+func TestIdentifierIndex_Lookup(t *testing.T) {
+	index := processing.NewIdentifierIndex()
+	index.Add("Patient", "a", "1", "p1")
+	index.Add("Patient", "b", "1", "p2")
+	index.Add("Patient", "a", "2", "p3")
+
+	cases := []struct {
+		resourceType, system, value string
+		wantID                      string
+		wantOK                      bool
+	}{
+		{resourceType: "Patient", system: "a", value: "1", wantID: "p1", wantOK: true},
+		{resourceType: "Patient", system: "b", value: "1", wantID: "p2", wantOK: true},
+		// Ambiguous without the system.
+		{resourceType: "Patient", value: "1"},
+		{resourceType: "Patient", value: "2", wantID: "p3", wantOK: true},
+		{resourceType: "Patient", system: "a", value: "3"},
+		{resourceType: "Practitioner", system: "a", value: "1"},
+	}
+	for _, tc := range cases {
+		gotID, gotOK := index.Lookup(tc.resourceType, tc.system, tc.value)
+		if gotID != tc.wantID || gotOK != tc.wantOK {
+			t.Errorf("Lookup(%q, %q, %q) = %q, %v, want: %q, %v", tc.resourceType, tc.system, tc.value, gotID, gotOK, tc.wantID, tc.wantOK)
+		}
+	}
+}
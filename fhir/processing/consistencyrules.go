@@ -0,0 +1,268 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// ageObservationCode is the LOINC code of Observations stating a patient's age.
+const ageObservationCode = "30525-0"
+
+// fhirDatePrefixRegex matches the date part of a FHIR date or dateTime, at
+// whatever precision it has.
+var fhirDatePrefixRegex = regexp.MustCompile(`^\d{4}(-\d{2}(-\d{2})?)?`)
+
+// decodedResource is a resource passed to a ConsistencyRule, along with its
+// parsed JSON.
+type decodedResource struct {
+	resource ResourceWrapper
+	res      map[string]any
+}
+
+// decodeResources parses the JSON of each of resources.
+func decodeResources(resources []ResourceWrapper) ([]decodedResource, error) {
+	decoded := make([]decodedResource, 0, len(resources))
+	for _, r := range resources {
+		rawJSON, err := r.JSON()
+		if err != nil {
+			return nil, err
+		}
+		res, err := decodeResourceJSON(rawJSON)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s resource JSON: %w", r.Type(), err)
+		}
+		decoded = append(decoded, decodedResource{resource: r, res: res})
+	}
+	return decoded, nil
+}
+
+// patientFieldValues returns the distinct non-empty values of a string field
+// of the Patient resources among decoded, in order, along with the Patients
+// which have the field set.
+func patientFieldValues(decoded []decodedResource, field string) ([]string, []ResourceWrapper) {
+	var values []string
+	var patients []ResourceWrapper
+	seen := map[string]bool{}
+	for _, d := range decoded {
+		if d.resource.Type() != cpb.ResourceTypeCode_PATIENT {
+			continue
+		}
+		v, _ := d.res[field].(string)
+		if v == "" {
+			continue
+		}
+		patients = append(patients, d.resource)
+		if !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	sort.Strings(values)
+	return values, patients
+}
+
+type birthDateRule struct {
+	fields map[cpb.ResourceTypeCode_Value][][]string
+}
+
+// NewBirthDateConsistencyRule returns a ConsistencyRule which checks that a
+// patient's birthDate is consistent with their other resources. The
+// inconsistencies found are:
+//
+//   - Patient resources for the patient with different birthDates.
+//   - Resources with clinical timestamps (the DefaultFutureTimestampFields)
+//     before the birthDate, compared at the precision of the less precise of
+//     the two.
+//   - Observations of age (LOINC 30525-0) in years which differ by more than a
+//     year from the age computed from the birthDate and the Observation's
+//     effectiveDateTime.
+//
+// The Patient resources are involved in every inconsistency found.
+func NewBirthDateConsistencyRule() ConsistencyRule {
+	fields := map[cpb.ResourceTypeCode_Value][][]string{}
+	for resourceType, paths := range DefaultFutureTimestampFields {
+		for _, p := range paths {
+			fields[resourceType] = append(fields[resourceType], strings.Split(p, "."))
+		}
+	}
+	return &birthDateRule{fields: fields}
+}
+
+func (bdr *birthDateRule) Name() string {
+	return "birth_date"
+}
+
+func (bdr *birthDateRule) Check(patientID string, resources []ResourceWrapper) ([]Inconsistency, error) {
+	decoded, err := decodeResources(resources)
+	if err != nil {
+		return nil, err
+	}
+	birthDates, patients := patientFieldValues(decoded, "birthDate")
+	if len(birthDates) > 1 {
+		return []Inconsistency{{
+			Description: fmt.Sprintf("Patient resources have different birthDates: %s", strings.Join(birthDates, ", ")),
+			Resources:   patients,
+		}}, nil
+	}
+	if len(birthDates) == 0 || !fhirDatePrefixRegex.MatchString(birthDates[0]) {
+		return nil, nil
+	}
+	birthDate := birthDates[0]
+
+	var inconsistencies []Inconsistency
+	involving := func(r ResourceWrapper, description string) {
+		inconsistencies = append(inconsistencies, Inconsistency{
+			Description: description,
+			Resources:   append(append([]ResourceWrapper{}, patients...), r),
+		})
+	}
+	for _, d := range decoded {
+		for _, parts := range bdr.fields[d.resource.Type()] {
+			var before []string
+			visitTimestamps(d.res, parts, parts[0], func(value, path string, set func(string)) {
+				if dateBefore(value, birthDate) {
+					before = append(before, fmt.Sprintf("%s %s", path, value))
+				}
+			})
+			for _, b := range before {
+				involving(d.resource, fmt.Sprintf("birthDate %s is after %s %s", birthDate, d.resource.Type(), b))
+			}
+		}
+		if stated, effective, ok := statedAge(d); ok {
+			if age, ok := ageOn(birthDate, effective); ok && math.Abs(stated-float64(age)) > 1 {
+				involving(d.resource, fmt.Sprintf("Observation on %s states age %v, but birthDate %s gives age %d", effective, stated, birthDate, age))
+			}
+		}
+	}
+	return inconsistencies, nil
+}
+
+// dateBefore returns true if the FHIR date or dateTime a is before b, comparing
+// their date parts at the precision of the less precise of the two, so that
+// 2000 is not before 2000-06-01.
+func dateBefore(a, b string) bool {
+	pa, pb := fhirDatePrefixRegex.FindString(a), fhirDatePrefixRegex.FindString(b)
+	if pa == "" || pb == "" {
+		return false
+	}
+	n := min(len(pa), len(pb))
+	return pa[:n] < pb[:n]
+}
+
+// statedAge returns the age in years stated by an age Observation, and its
+// effectiveDateTime.
+func statedAge(d decodedResource) (float64, string, bool) {
+	if d.resource.Type() != cpb.ResourceTypeCode_OBSERVATION || !hasCoding(d.res["code"], "http://loinc.org", ageObservationCode) {
+		return 0, "", false
+	}
+	effective, _ := d.res["effectiveDateTime"].(string)
+	quantity, _ := d.res["valueQuantity"].(map[string]any)
+	value, ok := quantity["value"].(json.Number)
+	if effective == "" || !ok {
+		return 0, "", false
+	}
+	code, _ := quantity["code"].(string)
+	unit, _ := quantity["unit"].(string)
+	switch {
+	case code == "a":
+	case code == "" && (unit == "a" || unit == "yr" || unit == "year" || unit == "years"):
+	default:
+		return 0, "", false
+	}
+	years, err := value.Float64()
+	if err != nil {
+		return 0, "", false
+	}
+	return years, effective, true
+}
+
+// hasCoding returns true if the CodeableConcept JSON value has a coding with
+// the given system and code.
+func hasCoding(codeableConcept any, system, code string) bool {
+	cc, _ := codeableConcept.(map[string]any)
+	codings, _ := cc["coding"].([]any)
+	for _, c := range codings {
+		coding, _ := c.(map[string]any)
+		if coding["system"] == system && coding["code"] == code {
+			return true
+		}
+	}
+	return false
+}
+
+// ageOn returns the age in whole years on the given FHIR date or dateTime of a
+// person born on birthDate. Both must be precise to the day.
+func ageOn(birthDate, date string) (int, bool) {
+	pb, pd := fhirDatePrefixRegex.FindString(birthDate), fhirDatePrefixRegex.FindString(date)
+	born, err := time.Parse("2006-01-02", pb)
+	if err != nil {
+		return 0, false
+	}
+	on, err := time.Parse("2006-01-02", pd)
+	if err != nil {
+		return 0, false
+	}
+	age := on.Year() - born.Year()
+	if on.Month() < born.Month() || (on.Month() == born.Month() && on.Day() < born.Day()) {
+		age--
+	}
+	return age, true
+}
+
+type genderRule struct{}
+
+// NewGenderConsistencyRule returns a ConsistencyRule which checks that the
+// Patient resources for a patient (for example, from several result files or
+// groups) all have the same gender.
+func NewGenderConsistencyRule() ConsistencyRule {
+	return genderRule{}
+}
+
+func (genderRule) Name() string {
+	return "gender"
+}
+
+func (genderRule) Check(patientID string, resources []ResourceWrapper) ([]Inconsistency, error) {
+	var patientResources []ResourceWrapper
+	for _, r := range resources {
+		if r.Type() == cpb.ResourceTypeCode_PATIENT {
+			patientResources = append(patientResources, r)
+		}
+	}
+	if len(patientResources) < 2 {
+		return nil, nil
+	}
+	decoded, err := decodeResources(patientResources)
+	if err != nil {
+		return nil, err
+	}
+	genders, patients := patientFieldValues(decoded, "gender")
+	if len(genders) < 2 {
+		return nil, nil
+	}
+	return []Inconsistency{{
+		Description: fmt.Sprintf("Patient resources have different genders: %s", strings.Join(genders, ", ")),
+		Resources:   patients,
+	}}, nil
+}
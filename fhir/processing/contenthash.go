@@ -0,0 +1,167 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// ContentHashAttribute is the ResourceWrapper attribute which the processor
+// returned by NewContentHashProcessor sets to the hex encoded SHA-256 hash of
+// the resource's canonical content.
+const ContentHashAttribute = "content_hash"
+
+// DefaultContentHashTagSystem is the system of the meta.tag added by the
+// processor returned by NewContentHashProcessorWithOptions if AddTag is set,
+// and no other system is configured.
+const DefaultContentHashTagSystem = "https://github.com/google/bulk_fhir_tools/content-hash"
+
+// volatileMetaFields are the elements of meta which are excluded from content
+// hashes, as they change without the content of the resource changing.
+var volatileMetaFields = []string{"lastUpdated", "versionId", "source"}
+
+// ContentHashProcessorOptions contains optional parameters used by
+// NewContentHashProcessorWithOptions.
+type ContentHashProcessorOptions struct {
+	// If true, the hash is also added to the resource as a meta.tag, replacing
+	// any existing tag with the same system.
+	AddTag bool
+	// The system of the tag. Defaults to DefaultContentHashTagSystem. Tags with
+	// this system are always excluded from the hash.
+	TagSystem string
+	// The systems of other meta.tag codings to exclude from the hash, for
+	// example DefaultRunIDTagSystem if resources are tagged by NewRunIDProcessor
+	// before they are hashed.
+	IgnoredTagSystems []string
+}
+
+type contentHashProcessor struct {
+	BaseProcessor
+	addTag         bool
+	tagSystem      string
+	ignoredSystems map[string]bool
+}
+
+// Assert contentHashProcessor satisfies the Processor interface.
+var _ Processor = &contentHashProcessor{}
+
+// NewContentHashProcessor creates a Processor which sets the
+// ContentHashAttribute of each resource to a SHA-256 hash of its canonical
+// content, for detecting whether a resource has changed since it was last
+// written (so that sinks may skip unchanged resources, for example).
+//
+// The canonical content is the resource's JSON with object keys sorted and
+// insignificant whitespace removed, excluding the volatile meta.lastUpdated,
+// meta.versionId and meta.source elements. Numbers are hashed as they appear
+// in the JSON, so 1.5 and 1.50 (which are different FHIR decimals) produce
+// different hashes.
+func NewContentHashProcessor() Processor {
+	return NewContentHashProcessorWithOptions(nil)
+}
+
+// NewContentHashProcessorWithOptions is like NewContentHashProcessor, but
+// allows optional parameters to be set.
+func NewContentHashProcessorWithOptions(opts *ContentHashProcessorOptions) Processor {
+	if opts == nil {
+		opts = &ContentHashProcessorOptions{}
+	}
+	tagSystem := opts.TagSystem
+	if tagSystem == "" {
+		tagSystem = DefaultContentHashTagSystem
+	}
+	ignoredSystems := map[string]bool{tagSystem: true}
+	for _, s := range opts.IgnoredTagSystems {
+		ignoredSystems[s] = true
+	}
+	return &contentHashProcessor{addTag: opts.AddTag, tagSystem: tagSystem, ignoredSystems: ignoredSystems}
+}
+
+func (chp *contentHashProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	// The JSON is read rather than the proto, as calling Proto() would cause the
+	// JSON to be regenerated for sinks.
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	hash, err := chp.hash(rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to hash %s resource: %w", resource.Type(), err)
+	}
+	SetResourceAttribute(resource, ContentHashAttribute, hash)
+
+	if chp.addTag {
+		meta, err := mutableMeta(resource)
+		if err != nil {
+			return err
+		}
+		setTag(meta, chp.tagSystem, hash)
+	}
+	return chp.Output(ctx, resource)
+}
+
+// hash returns the hex encoded SHA-256 hash of the canonical form of the
+// resource JSON.
+func (chp *contentHashProcessor) hash(rawJSON []byte) (string, error) {
+	res, err := decodeResourceJSON(rawJSON)
+	if err != nil {
+		return "", err
+	}
+	chp.removeVolatileFields(res)
+	// json.Marshal sorts map keys, and does not add whitespace.
+	canonical, err := json.Marshal(res)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// removeVolatileFields removes the elements of res which are excluded from the
+// hash. meta is removed entirely if nothing else remains in it, so that
+// resources differing only in volatile elements have the same hash.
+func (chp *contentHashProcessor) removeVolatileFields(res map[string]any) {
+	meta, ok := res["meta"].(map[string]any)
+	if !ok {
+		return
+	}
+	for _, f := range volatileMetaFields {
+		delete(meta, f)
+		// Any extensions of the primitive element.
+		delete(meta, "_"+f)
+	}
+	if tags, ok := meta["tag"].([]any); ok {
+		var kept []any
+		for _, t := range tags {
+			if coding, ok := t.(map[string]any); ok {
+				if system, _ := coding["system"].(string); chp.ignoredSystems[system] {
+					continue
+				}
+			}
+			kept = append(kept, t)
+		}
+		if len(kept) > 0 {
+			meta["tag"] = kept
+		} else {
+			delete(meta, "tag")
+		}
+	}
+	if len(meta) == 0 {
+		delete(res, "meta")
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestContentHashProcessor(t *testing.T) {
+	base := `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"c"},"valueQuantity":{"value":1.5}}`
+	opts := &processing.ContentHashProcessorOptions{IgnoredTagSystems: []string{processing.DefaultRunIDTagSystem}}
+	cases := []struct {
+		name     string
+		json     string
+		wantSame bool
+	}{
+		{
+			name:     "ReorderedWithWhitespace",
+			json:     `{"id": "1", "resourceType": "Observation", "valueQuantity": {"value": 1.5}, "code": {"text": "c"}, "status": "final"}`,
+			wantSame: true,
+		},
+		{
+			name:     "VolatileMeta",
+			json:     `{"resourceType":"Observation","id":"1","meta":{"lastUpdated":"2024-01-02T03:04:05Z","versionId":"7","source":"https://example.com/job/1"},"status":"final","code":{"text":"c"},"valueQuantity":{"value":1.5}}`,
+			wantSame: true,
+		},
+		{
+			name:     "IgnoredTag",
+			json:     `{"resourceType":"Observation","id":"1","meta":{"tag":[{"system":"https://github.com/google/bulk_fhir_tools/run-id","code":"run-1"}]},"status":"final","code":{"text":"c"},"valueQuantity":{"value":1.5}}`,
+			wantSame: true,
+		},
+		{
+			name: "OtherTag",
+			json: `{"resourceType":"Observation","id":"1","meta":{"tag":[{"system":"https://example.com","code":"a"}]},"status":"final","code":{"text":"c"},"valueQuantity":{"value":1.5}}`,
+		},
+		{
+			name: "ChangedValue",
+			json: `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"c"},"valueQuantity":{"value":2.5}}`,
+		},
+		{
+			name: "ChangedPrecision",
+			json: `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"c"},"valueQuantity":{"value":1.50}}`,
+		},
+	}
+	baseHash, _ := processWithContentHash(t, opts, cpb.ResourceTypeCode_OBSERVATION, base)
+	if len(baseHash) != 64 {
+		t.Fatalf("unexpected hash %q, want a hex encoded SHA-256 hash", baseHash)
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, _ := processWithContentHash(t, opts, cpb.ResourceTypeCode_OBSERVATION, tc.json)
+			if same := got == baseHash; same != tc.wantSame {
+				t.Errorf("unexpected hash %s for %s compared to %s for %s. got same: %t, want same: %t", got, tc.json, baseHash, base, same, tc.wantSame)
+			}
+		})
+	}
+}
+
+func TestContentHashProcessor_AddTag(t *testing.T) {
+	opts := &processing.ContentHashProcessorOptions{AddTag: true}
+	hash, got := processWithContentHash(t, opts, cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"https://github.com/google/bulk_fhir_tools/content-hash","code":"stale"}]}}`)
+
+	var res struct {
+		Meta struct {
+			Tag []struct {
+				System string `json:"system"`
+				Code   string `json:"code"`
+			} `json:"tag"`
+		} `json:"meta"`
+	}
+	if err := json.Unmarshal(got, &res); err != nil {
+		t.Fatalf("failed to unmarshal resource: %v", err)
+	}
+	if len(res.Meta.Tag) != 1 || res.Meta.Tag[0].System != processing.DefaultContentHashTagSystem || res.Meta.Tag[0].Code != hash {
+		t.Errorf("unexpected tags %+v, want a single tag with the code %s", res.Meta.Tag, hash)
+	}
+
+	// The tag is excluded from the hash, so hashing the tagged resource again
+	// gives the same hash.
+	if rehash, _ := processWithContentHash(t, opts, cpb.ResourceTypeCode_PATIENT, string(got)); rehash != hash {
+		t.Errorf("hash of tagged resource changed. got: %s, want: %s", rehash, hash)
+	}
+}
+
+// processWithContentHash returns the ContentHashAttribute and JSON of the
+// resource written by a pipeline with a content hash processor.
+func processWithContentHash(t *testing.T, opts *processing.ContentHashProcessorOptions, resourceType cpb.ResourceTypeCode_Value, resourceJSON string) (string, []byte) {
+	t.Helper()
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline([]processing.Processor{processing.NewContentHashProcessorWithOptions(opts)}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	if err := p.Process(context.Background(), resourceType, "", []byte(resourceJSON)); err != nil {
+		t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", resourceJSON, err)
+	}
+	if len(ts.WrittenResources) != 1 {
+		t.Fatalf("unexpected number of resources written. got: %d, want: 1", len(ts.WrittenResources))
+	}
+	hash, ok := processing.ResourceAttribute(ts.WrittenResources[0], processing.ContentHashAttribute)
+	if !ok {
+		t.Fatalf("%s attribute was not set", processing.ContentHashAttribute)
+	}
+	got, err := ts.WrittenResources[0].JSON()
+	if err != nil {
+		t.Fatalf("JSON() returned unexpected error: %v", err)
+	}
+	return hash, got
+}
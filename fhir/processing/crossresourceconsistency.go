@@ -0,0 +1,365 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/fhir/go/jsonformat"
+)
+
+// ErrInconsistentResources is passed (wrapped) as the dead letter reason for
+// resources involved in an inconsistency found by a
+// CrossResourceConsistencyProcessor, if the ConsistencyDeadLetter action is
+// used.
+var ErrInconsistentResources = errors.New("resource is inconsistent with other resources for the same patient")
+
+// ConsistencyAttribute is the ResourceWrapper attribute which the processor
+// returned by NewCrossResourceConsistencyProcessor sets to a comma separated
+// list of the names of the rules a resource is inconsistent under, if the
+// ConsistencyFlag action is used.
+const ConsistencyAttribute = "consistency_violations"
+
+var crossResourceConsistencyCounter *metrics.Counter = metrics.NewCounter("cross-resource-consistency-counter", "Count of FHIR Resources found to be inconsistent with other resources for the same patient. The counter is tagged by the FHIR Resource type ex) OBSERVATION, and the action taken.", "1", aggregation.Count, "FHIRResourceType", "Action")
+
+// ConsistencyAction is the action taken by a CrossResourceConsistencyProcessor
+// on the resources involved in an inconsistency.
+type ConsistencyAction int
+
+const (
+	// ConsistencyFlag sets the ConsistencyAttribute of the resources, and logs
+	// each inconsistency. The resources are output as usual.
+	ConsistencyFlag ConsistencyAction = iota
+	// ConsistencyDeadLetter passes the resources to the pipeline's dead letter
+	// function, which then acts as the QA output for inconsistent data (see
+	// NewNDJSONDeadLetterFunction).
+	ConsistencyDeadLetter
+)
+
+func (a ConsistencyAction) String() string {
+	switch a {
+	case ConsistencyFlag:
+		return "flag"
+	case ConsistencyDeadLetter:
+		return "dead_letter"
+	default:
+		return fmt.Sprintf("ConsistencyAction(%d)", int(a))
+	}
+}
+
+// Inconsistency is an inconsistency between resources for a single patient,
+// found by a ConsistencyRule.
+type Inconsistency struct {
+	// Description describes the inconsistency, for example "birthDate 2001-02-03
+	// is after Encounter period.start 2000-01-01".
+	Description string
+	// Resources holds the resources involved, which must be among those passed
+	// to the rule.
+	Resources []ResourceWrapper
+}
+
+// ConsistencyRule checks the resources for a single patient for
+// inconsistencies between them. Rules are used by
+// NewCrossResourceConsistencyProcessor.
+type ConsistencyRule interface {
+	// Name identifies the rule in the ConsistencyAttribute and logs, for example
+	// "birth_date".
+	Name() string
+	// Check returns the inconsistencies between resources, which are all of the
+	// resources for the patient with the given id (including any Patient
+	// resources with the id). The resources must not be modified.
+	Check(patientID string, resources []ResourceWrapper) ([]Inconsistency, error)
+}
+
+// CrossResourceConsistencyProcessorOptions contains optional parameters used
+// by NewCrossResourceConsistencyProcessorWithOptions.
+type CrossResourceConsistencyProcessorOptions struct {
+	// The action taken on the resources involved in an inconsistency. Defaults
+	// to ConsistencyFlag.
+	Action ConsistencyAction
+	// If greater than zero, buffered resources are spilled to temporary files
+	// whenever more than this many are held in memory.
+	MaxBufferedResources int
+	// The directory temporary files are created in. Defaults to os.TempDir().
+	SpillDirectory string
+}
+
+type crossResourceConsistencyProcessor struct {
+	BaseProcessor
+	rules        []ConsistencyRule
+	action       ConsistencyAction
+	unmarshaller *jsonformat.Unmarshaller
+	marshaller   *jsonformat.Marshaller
+
+	maxBuffered int
+
+	// buffered holds resources by patient id.
+	buffered    map[string][]ResourceWrapper
+	numBuffered int
+	spilled     *patientSpillStore
+}
+
+// Assert crossResourceConsistencyProcessor satisfies the Processor interface.
+var _ Processor = &crossResourceConsistencyProcessor{}
+
+// NewCrossResourceConsistencyProcessor creates a Processor which groups
+// resources by the patient they belong to (as for NewPatientBundleProcessor),
+// and on Finalize checks each patient's resources with rules, flagging the
+// resources involved in any inconsistencies found. This is for checks which
+// must reason across several resources for a patient, such as
+// NewBirthDateConsistencyRule, which a processor of single resources cannot
+// make.
+//
+// Resources which belong to no patient are output straight away, but all
+// others are held until Finalize, which requires enough memory to hold most
+// of a batch. Use NewCrossResourceConsistencyProcessorWithOptions to set
+// MaxBufferedResources, which limits memory use by spilling resources to
+// temporary files. The resources for a single patient are always read back
+// into memory together.
+func NewCrossResourceConsistencyProcessor(rules []ConsistencyRule) (Processor, error) {
+	return NewCrossResourceConsistencyProcessorWithOptions(rules, nil)
+}
+
+// NewCrossResourceConsistencyProcessorWithOptions is like
+// NewCrossResourceConsistencyProcessor, but with the given options. opts may
+// be nil.
+func NewCrossResourceConsistencyProcessorWithOptions(rules []ConsistencyRule, opts *CrossResourceConsistencyProcessorOptions) (Processor, error) {
+	if len(rules) == 0 {
+		return nil, errors.New("no consistency rules given")
+	}
+	if opts == nil {
+		opts = &CrossResourceConsistencyProcessorOptions{}
+	}
+	switch opts.Action {
+	case ConsistencyFlag, ConsistencyDeadLetter:
+	default:
+		return nil, fmt.Errorf("unknown ConsistencyAction %d", opts.Action)
+	}
+	unmarshaller, err := jsonformat.NewUnmarshallerWithoutValidation("UTC", fhirversion.R4)
+	if err != nil {
+		return nil, err
+	}
+	marshaller, err := jsonformat.NewMarshaller(false, "", "", fhirversion.R4)
+	if err != nil {
+		return nil, err
+	}
+	return &crossResourceConsistencyProcessor{
+		rules:        rules,
+		action:       opts.Action,
+		unmarshaller: unmarshaller,
+		marshaller:   marshaller,
+		maxBuffered:  opts.MaxBufferedResources,
+		buffered:     map[string][]ResourceWrapper{},
+		spilled:      newPatientSpillStore(opts.SpillDirectory, "consistency-"),
+	}, nil
+}
+
+func (crcp *crossResourceConsistencyProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	id, err := patientID(resource.Type(), rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	if id == "" {
+		return crcp.Output(ctx, resource)
+	}
+	crcp.buffered[id] = append(crcp.buffered[id], resource)
+	crcp.numBuffered++
+	if crcp.maxBuffered > 0 && crcp.numBuffered > crcp.maxBuffered {
+		return crcp.spill()
+	}
+	return nil
+}
+
+// spilledResourceJSON is a line of a spill file, holding a resource along with
+// the fields of its ResourceWrapper.
+type spilledResourceJSON struct {
+	Type       string            `json:"type"`
+	SourceURL  string            `json:"sourceURL,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Resource   json.RawMessage   `json:"resource"`
+}
+
+// spill appends all buffered resources to temporary files.
+func (crcp *crossResourceConsistencyProcessor) spill() error {
+	for id, resources := range crcp.buffered {
+		lines := make([][]byte, 0, len(resources))
+		for _, r := range resources {
+			line, err := encodeSpilledResource(r)
+			if err != nil {
+				return fmt.Errorf("failed to spill resources: %w", err)
+			}
+			lines = append(lines, line)
+		}
+		if err := crcp.spilled.append(id, lines); err != nil {
+			return err
+		}
+	}
+	crcp.buffered = map[string][]ResourceWrapper{}
+	crcp.numBuffered = 0
+	return nil
+}
+
+// encodeSpilledResource returns the spill file line for a resource.
+func encodeSpilledResource(r ResourceWrapper) ([]byte, error) {
+	rawJSON, err := r.JSON()
+	if err != nil {
+		return nil, err
+	}
+	name, err := bulkfhir.ResourceTypeCodeToName(r.Type())
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(spilledResourceJSON{Type: name, SourceURL: r.SourceURL(), Attributes: resourceAttributes(r), Resource: rawJSON})
+}
+
+// resourceAttributes returns the attributes of a resource created by the
+// Pipeline, so that they can be restored once it has been spilled.
+func resourceAttributes(resource ResourceWrapper) map[string]string {
+	if rw, ok := resource.(*resourceWrapper); ok {
+		return rw.attributes
+	}
+	return nil
+}
+
+// readSpilled returns the resources for a patient which were spilled.
+func (crcp *crossResourceConsistencyProcessor) readSpilled(patientID string) ([]ResourceWrapper, error) {
+	lines, err := crcp.spilled.read(patientID)
+	if err != nil {
+		return nil, err
+	}
+	var resources []ResourceWrapper
+	for _, line := range lines {
+		var sr spilledResourceJSON
+		if err := json.Unmarshal(line, &sr); err != nil {
+			return nil, err
+		}
+		resourceType, err := bulkfhir.ResourceTypeCodeFromName(sr.Type)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, &resourceWrapper{
+			unmarshaller: crcp.unmarshaller,
+			marshaller:   crcp.marshaller,
+			resourceType: resourceType,
+			sourceURL:    sr.SourceURL,
+			attributes:   sr.Attributes,
+			jsonMut:      &sync.Mutex{},
+			json:         sr.Resource,
+		})
+	}
+	return resources, nil
+}
+
+func (crcp *crossResourceConsistencyProcessor) Finalize(ctx context.Context) error {
+	defer crcp.spilled.cleanup()
+
+	ids := crcp.spilled.patientIDs()
+	for id := range crcp.buffered {
+		if !crcp.spilled.has(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		resources, err := crcp.readSpilled(id)
+		if err != nil {
+			return fmt.Errorf("failed to read spilled resources: %w", err)
+		}
+		resources = append(resources, crcp.buffered[id]...)
+		if err := crcp.checkPatient(ctx, id, resources); err != nil {
+			return err
+		}
+	}
+	crcp.buffered = map[string][]ResourceWrapper{}
+	crcp.numBuffered = 0
+	return nil
+}
+
+// checkPatient applies the rules to the resources for a patient, and outputs
+// them.
+func (crcp *crossResourceConsistencyProcessor) checkPatient(ctx context.Context, patientID string, resources []ResourceWrapper) error {
+	index := map[ResourceWrapper]int{}
+	for i, r := range resources {
+		index[r] = i
+	}
+	// violations holds the names of the rules, and the descriptions of the
+	// inconsistencies, each resource is involved in.
+	violations := make([]map[string]bool, len(resources))
+	descriptions := make([][]string, len(resources))
+	for _, rule := range crcp.rules {
+		inconsistencies, err := rule.Check(patientID, resources)
+		if err != nil {
+			return fmt.Errorf("consistency rule %s failed for patient %s: %w", rule.Name(), patientID, err)
+		}
+		for _, inc := range inconsistencies {
+			log.Warningf("Resources for patient %s are inconsistent under rule %s: %s", patientID, rule.Name(), inc.Description)
+			for _, r := range inc.Resources {
+				i, ok := index[r]
+				if !ok {
+					return fmt.Errorf("consistency rule %s returned a resource which does not belong to patient %s", rule.Name(), patientID)
+				}
+				if violations[i] == nil {
+					violations[i] = map[string]bool{}
+				}
+				violations[i][rule.Name()] = true
+				descriptions[i] = append(descriptions[i], fmt.Sprintf("%s: %s", rule.Name(), inc.Description))
+			}
+		}
+	}
+
+	for i, r := range resources {
+		if violations[i] == nil {
+			if err := crcp.Output(ctx, r); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := crossResourceConsistencyCounter.Record(ctx, 1, r.Type().String(), crcp.action.String()); err != nil {
+			return err
+		}
+		if crcp.action == ConsistencyDeadLetter {
+			if err := crcp.DeadLetterResource(ctx, r, fmt.Errorf("%w: %s", ErrInconsistentResources, strings.Join(descriptions[i], "; "))); err != nil {
+				return err
+			}
+			continue
+		}
+		names := make([]string, 0, len(violations[i]))
+		for name := range violations[i] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		SetResourceAttribute(r, ConsistencyAttribute, strings.Join(names, ","))
+		if err := crcp.Output(ctx, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
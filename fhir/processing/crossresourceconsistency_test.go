@@ -0,0 +1,192 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+type consistencyTestResource struct {
+	resourceType cpb.ResourceTypeCode_Value
+	json         string
+}
+
+var consistencyTestResources = []consistencyTestResource{
+	{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p1","gender":"female","birthDate":"2000-06-15"}`},
+	// Before the birthDate.
+	{cpb.ResourceTypeCode_ENCOUNTER, `{"resourceType":"Encounter","id":"e1","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Patient/p1"},"period":{"start":"1999-01-01T10:00:00Z"}}`},
+	// In the same year as the birthDate, so not known to be before it.
+	{cpb.ResourceTypeCode_CONDITION, `{"resourceType":"Condition","id":"c1","subject":{"reference":"Patient/p1"},"onsetDateTime":"2000"}`},
+	// The stated age is correct.
+	{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"o1","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"30525-0"}]},"subject":{"reference":"Patient/p1"},"effectiveDateTime":"2020-06-14","valueQuantity":{"value":19,"unit":"years","system":"http://unitsofmeasure.org","code":"a"}}`},
+	// The stated age is wrong.
+	{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"o2","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"30525-0"}]},"subject":{"reference":"Patient/p1"},"effectiveDateTime":"2020-06-14","valueQuantity":{"value":45,"unit":"years","system":"http://unitsofmeasure.org","code":"a"}}`},
+	{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p2","gender":"male","birthDate":"1980-01-01"}`},
+	{cpb.ResourceTypeCode_ENCOUNTER, `{"resourceType":"Encounter","id":"e2","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Patient/p2"},"period":{"start":"2001-01-01"}}`},
+	// Belongs to no patient.
+	{cpb.ResourceTypeCode_ORGANIZATION, `{"resourceType":"Organization","id":"org1"}`},
+}
+
+func processConsistencyTestResources(t *testing.T, p *processing.Pipeline) {
+	t.Helper()
+	for _, r := range consistencyTestResources {
+		if err := p.ProcessWithAttributes(context.Background(), r.resourceType, "https://example.com/"+r.resourceType.String(), []byte(r.json), map[string]string{"group": "g1"}); err != nil {
+			t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", r.json, err)
+		}
+	}
+	if err := p.Finalize(context.Background()); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+}
+
+// resourceID returns the id of a resource written by a test.
+func resourceID(t *testing.T, r processing.ResourceWrapper) string {
+	t.Helper()
+	rawJSON, err := r.JSON()
+	if err != nil {
+		t.Fatalf("JSON() returned unexpected error: %v", err)
+	}
+	_, afterID, _ := strings.Cut(string(rawJSON), `"id":"`)
+	id, _, _ := strings.Cut(afterID, `"`)
+	return id
+}
+
+func TestCrossResourceConsistencyProcessor_Flag(t *testing.T) {
+	cases := []struct {
+		name        string
+		maxBuffered int
+	}{
+		{name: "InMemory"},
+		{name: "Spilled", maxBuffered: 1},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := &processing.TestSink{}
+			cp, err := processing.NewCrossResourceConsistencyProcessorWithOptions(
+				[]processing.ConsistencyRule{processing.NewBirthDateConsistencyRule(), processing.NewGenderConsistencyRule()},
+				&processing.CrossResourceConsistencyProcessorOptions{MaxBufferedResources: tc.maxBuffered, SpillDirectory: t.TempDir()})
+			if err != nil {
+				t.Fatalf("NewCrossResourceConsistencyProcessorWithOptions() returned unexpected error: %v", err)
+			}
+			p, err := processing.NewPipeline([]processing.Processor{cp}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			processConsistencyTestResources(t, p)
+
+			if len(ts.WrittenResources) != len(consistencyTestResources) {
+				t.Fatalf("unexpected number of written resources. got: %d, want: %d", len(ts.WrittenResources), len(consistencyTestResources))
+			}
+			gotFlagged := map[string]string{}
+			for _, r := range ts.WrittenResources {
+				id := resourceID(t, r)
+				if v, ok := processing.ResourceAttribute(r, processing.ConsistencyAttribute); ok {
+					gotFlagged[id] = v
+				}
+				// Attributes and source URLs survive spilling.
+				if v, _ := processing.ResourceAttribute(r, "group"); v != "g1" {
+					t.Errorf("resource %s has group attribute %q, want g1", id, v)
+				}
+				if want := "https://example.com/" + r.Type().String(); r.SourceURL() != want {
+					t.Errorf("resource %s has source URL %q, want %q", id, r.SourceURL(), want)
+				}
+			}
+			wantFlagged := map[string]string{"p1": "birth_date", "e1": "birth_date", "o2": "birth_date"}
+			if diff := cmp.Diff(wantFlagged, gotFlagged); diff != "" {
+				t.Errorf("unexpected resources flagged (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCrossResourceConsistencyProcessor_DeadLetter(t *testing.T) {
+	ts := &processing.TestSink{}
+	var deadLettered []string
+	opts := &processing.PipelineOptions{
+		DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+			if !errors.Is(reason, processing.ErrInconsistentResources) {
+				t.Errorf("unexpected dead letter reason. got: %v, want: %v", reason, processing.ErrInconsistentResources)
+			}
+			deadLettered = append(deadLettered, resourceID(t, resource))
+			return nil
+		},
+	}
+	cp, err := processing.NewCrossResourceConsistencyProcessorWithOptions([]processing.ConsistencyRule{processing.NewBirthDateConsistencyRule()}, &processing.CrossResourceConsistencyProcessorOptions{Action: processing.ConsistencyDeadLetter})
+	if err != nil {
+		t.Fatalf("NewCrossResourceConsistencyProcessorWithOptions() returned unexpected error: %v", err)
+	}
+	p, err := processing.NewPipelineWithOptions([]processing.Processor{cp}, []processing.Sink{ts}, opts)
+	if err != nil {
+		t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+	}
+	processConsistencyTestResources(t, p)
+
+	sort.Strings(deadLettered)
+	if diff := cmp.Diff([]string{"e1", "o2", "p1"}, deadLettered); diff != "" {
+		t.Errorf("unexpected resources dead lettered (-want +got):\n%s", diff)
+	}
+	if got, want := len(ts.WrittenResources), len(consistencyTestResources)-3; got != want {
+		t.Errorf("unexpected number of written resources. got: %d, want: %d", got, want)
+	}
+}
+
+func TestGenderConsistencyRule(t *testing.T) {
+	ts := &processing.TestSink{}
+	cp, err := processing.NewCrossResourceConsistencyProcessor([]processing.ConsistencyRule{processing.NewGenderConsistencyRule()})
+	if err != nil {
+		t.Fatalf("NewCrossResourceConsistencyProcessor() returned unexpected error: %v", err)
+	}
+	p, err := processing.NewPipeline([]processing.Processor{cp}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	for _, json := range []string{
+		`{"resourceType":"Patient","id":"p1","gender":"female"}`,
+		`{"resourceType":"Patient","id":"p1","gender":"male"}`,
+		`{"resourceType":"Patient","id":"p2","gender":"male"}`,
+		`{"resourceType":"Patient","id":"p2","gender":"male"}`,
+	} {
+		if err := p.Process(context.Background(), cpb.ResourceTypeCode_PATIENT, "", []byte(json)); err != nil {
+			t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", json, err)
+		}
+	}
+	if err := p.Finalize(context.Background()); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+	var flagged []string
+	for _, r := range ts.WrittenResources {
+		if _, ok := processing.ResourceAttribute(r, processing.ConsistencyAttribute); ok {
+			flagged = append(flagged, resourceID(t, r))
+		}
+	}
+	if diff := cmp.Diff([]string{"p1", "p1"}, flagged); diff != "" {
+		t.Errorf("unexpected resources flagged (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewCrossResourceConsistencyProcessor_NoRules(t *testing.T) {
+	if _, err := processing.NewCrossResourceConsistencyProcessor(nil); err == nil {
+		t.Errorf("NewCrossResourceConsistencyProcessor(nil) succeeded, want error")
+	}
+}
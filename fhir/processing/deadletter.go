@@ -0,0 +1,125 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// DeadLetterRecord is a single line of the NDJSON written by the dead letter
+// function returned by NewNDJSONDeadLetterFunction, and read by
+// ReplayDeadLetters.
+type DeadLetterRecord struct {
+	// Type is the FHIR resource type name, for example "Patient".
+	Type      string          `json:"type"`
+	SourceURL string          `json:"sourceURL"`
+	Error     string          `json:"error"`
+	Time      time.Time       `json:"time"`
+	Resource  json.RawMessage `json:"resource"`
+}
+
+// NewNDJSONDeadLetterFunction returns a DeadLetterFunction which writes each
+// dead lettered resource to w as a line of NDJSON holding a DeadLetterRecord,
+// with the resource annotated with its source URL and the reason it was
+// dropped. The output may be passed to ReplayDeadLetters once the cause has
+// been fixed. It is safe to call the returned function from multiple
+// goroutines.
+func NewNDJSONDeadLetterFunction(w io.Writer) DeadLetterFunction {
+	var mu sync.Mutex
+	return func(ctx context.Context, resource ResourceWrapper, reason error) error {
+		rawJSON, err := resource.JSON()
+		if err != nil {
+			return err
+		}
+		rawJSON, err = normalizeNDJSONLine(rawJSON)
+		if err != nil {
+			return err
+		}
+		name, err := bulkfhir.ResourceTypeCodeToName(resource.Type())
+		if err != nil {
+			return err
+		}
+		record := DeadLetterRecord{
+			Type:      name,
+			SourceURL: resource.SourceURL(),
+			Time:      time.Now().UTC(),
+			Resource:  rawJSON,
+		}
+		if reason != nil {
+			record.Error = reason.Error()
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal dead letter record for %s resource: %w", name, err)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		_, err = w.Write(append(line, '\n'))
+		return err
+	}
+}
+
+// ReplayDeadLetters reads the DeadLetterRecords written by the function
+// returned by NewNDJSONDeadLetterFunction from r, and passes each resource
+// through the pipeline again with its original source URL (the recorded error
+// is only informational, and is ignored). Blank lines are skipped.
+//
+// As with ProcessFile, the pipeline is not finalized; call Pipeline.Finalize
+// once replay is complete.
+func ReplayDeadLetters(ctx context.Context, p *Pipeline, r io.Reader) error {
+	s := bufio.NewScanner(r)
+	// Records hold a whole resource, so need the same buffer as NDJSON files.
+	s.Buffer(make([]byte, initialNDJSONBufferSize), maxNDJSONLineSize)
+	line := 0
+	replayed := 0
+	for s.Scan() {
+		line++
+		data := s.Bytes()
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+		var record DeadLetterRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return fmt.Errorf("dead letter record %d: %w", line, err)
+		}
+		if len(record.Resource) == 0 {
+			return fmt.Errorf("dead letter record %d has no resource", line)
+		}
+		resourceType, err := bulkfhir.ResourceTypeCodeFromName(record.Type)
+		if err != nil {
+			return fmt.Errorf("dead letter record %d: %w", line, err)
+		}
+		if err := p.Process(ctx, resourceType, record.SourceURL, record.Resource); err != nil {
+			return fmt.Errorf("dead letter record %d: %w", line, err)
+		}
+		replayed++
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("failed to read dead letter records: %w", err)
+	}
+	log.Infof("Replayed %d dead lettered resources.", replayed)
+	return nil
+}
@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestReplayDeadLetters(t *testing.T) {
+	ctx := context.Background()
+	rfp, err := processing.NewRequiredFieldsProcessor(map[cpb.ResourceTypeCode_Value][]string{
+		cpb.ResourceTypeCode_OBSERVATION: {"subject"},
+	})
+	if err != nil {
+		t.Fatalf("NewRequiredFieldsProcessor() returned unexpected error: %v", err)
+	}
+	var deadLetters bytes.Buffer
+	opts := &processing.PipelineOptions{DeadLetter: processing.NewNDJSONDeadLetterFunction(&deadLetters)}
+	p, err := processing.NewPipelineWithOptions([]processing.Processor{rfp}, []processing.Sink{&processing.TestSink{}}, opts)
+	if err != nil {
+		t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+	}
+	inputs := []struct {
+		sourceURL string
+		json      string
+	}{
+		{"https://example.com/data/1.ndjson", `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"c"},"subject":{"reference":"Patient/1"}}`},
+		{"https://example.com/data/1.ndjson", `{"resourceType":"Observation","id":"2","status":"final","code":{"text":"c"}}`},
+		{"https://example.com/data/2.ndjson", `{"resourceType":"Observation","id":"3","status":"final","code":{"text":"c"}}`},
+	}
+	for _, in := range inputs {
+		if err := p.Process(ctx, cpb.ResourceTypeCode_OBSERVATION, in.sourceURL, []byte(in.json)); err != nil {
+			t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+		}
+	}
+
+	// Each dead lettered resource is annotated with the error.
+	lines := strings.Split(strings.TrimSpace(deadLetters.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected number of dead letter records. got: %d, want: 2", len(lines))
+	}
+	var record processing.DeadLetterRecord
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("failed to parse dead letter record %s: %v", lines[0], err)
+	}
+	if record.Type != "Observation" || !strings.Contains(record.Error, processing.ErrMissingRequiredField.Error()) || record.Time.IsZero() {
+		t.Errorf("unexpected dead letter record: %+v", record)
+	}
+
+	// Replay into a pipeline without the processor, as if the cause was fixed.
+	ts := &processing.TestSink{}
+	replay, err := processing.NewPipeline(nil, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	if err := processing.ReplayDeadLetters(ctx, replay, &deadLetters); err != nil {
+		t.Fatalf("ReplayDeadLetters() returned unexpected error: %v", err)
+	}
+	if len(ts.WrittenResources) != 2 {
+		t.Fatalf("unexpected number of replayed resources. got: %d, want: 2", len(ts.WrittenResources))
+	}
+	for i, r := range ts.WrittenResources {
+		want := inputs[i+1]
+		if r.Type() != cpb.ResourceTypeCode_OBSERVATION || r.SourceURL() != want.sourceURL {
+			t.Errorf("replayed resource %d has type %s and source URL %q, want OBSERVATION and %q", i, r.Type(), r.SourceURL(), want.sourceURL)
+		}
+		got, err := r.JSON()
+		if err != nil {
+			t.Fatalf("JSON() returned unexpected error: %v", err)
+		}
+		if diff := cmp.Diff(testhelpers.NormalizeJSONString(t, want.json), testhelpers.NormalizeJSONString(t, string(got))); diff != "" {
+			t.Errorf("replayed resource %d differs (-want +got):\n%s", i, diff)
+		}
+	}
+}
+
+func TestReplayDeadLetters_InvalidRecord(t *testing.T) {
+	p, err := processing.NewPipeline(nil, nil)
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	for _, in := range []string{
+		`not json`,
+		`{"type":"Patient","sourceURL":"u","error":"e"}`,
+		`{"type":"NotAType","resource":{"resourceType":"NotAType"}}`,
+	} {
+		if err := processing.ReplayDeadLetters(context.Background(), p, strings.NewReader(in)); err == nil {
+			t.Errorf("ReplayDeadLetters(%s) succeeded, want error", in)
+		}
+	}
+}
@@ -166,7 +166,7 @@ func (dp *documentsProcessor) downloadFileAndUpdateResource(ctx context.Context,
 		return nil
 	}
 
-	req, err := http.NewRequest(http.MethodGet, url, http.NoBody)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, http.NoBody)
 	if err != nil {
 		return err
 	}
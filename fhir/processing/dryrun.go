@@ -0,0 +1,146 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// maxDryRunDeadLetters is the number of dropped resources described in a
+// DryRunReport. Later ones are only counted.
+const maxDryRunDeadLetters = 100
+
+// DryRunReport summarises the resources passed through a Pipeline in dry-run
+// mode (see PipelineOptions.DryRun).
+type DryRunReport struct {
+	// Processed holds the number of resources passed to Process for each
+	// resource type.
+	Processed map[cpb.ResourceTypeCode_Value]int
+	// Written holds the number of resources which would have been written to the
+	// sinks for each resource type.
+	Written map[cpb.ResourceTypeCode_Value]int
+	// DeadLettered holds the number of resources dropped by processors for each
+	// resource type.
+	DeadLettered map[cpb.ResourceTypeCode_Value]int
+	// DeadLetters describes the first 100 resources dropped by processors.
+	DeadLetters []DryRunDeadLetter
+}
+
+// DryRunDeadLetter describes a resource dropped by a processor during a dry
+// run.
+type DryRunDeadLetter struct {
+	ResourceType cpb.ResourceTypeCode_Value
+	SourceURL    string
+	// Reason is the reason the processor gave for dropping the resource.
+	Reason string
+}
+
+// DryRunReport returns a summary of the resources passed through the pipeline
+// so far, if it was created with PipelineOptions.DryRun. Otherwise, the report
+// is empty.
+func (p *Pipeline) DryRunReport() DryRunReport {
+	if p.dryRun == nil {
+		return DryRunReport{}
+	}
+	return p.dryRun.report()
+}
+
+// dryRunRecorder counts the resources passed through a Pipeline in dry-run
+// mode. Its methods may be called from the goroutines of processors.
+type dryRunRecorder struct {
+	mu           sync.Mutex
+	processedN   map[cpb.ResourceTypeCode_Value]int
+	writtenN     map[cpb.ResourceTypeCode_Value]int
+	deadLettered map[cpb.ResourceTypeCode_Value]int
+	deadLetters  []DryRunDeadLetter
+}
+
+func (d *dryRunRecorder) processed(resourceType cpb.ResourceTypeCode_Value) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	incrementCount(&d.processedN, resourceType)
+}
+
+func (d *dryRunRecorder) written(resource ResourceWrapper) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	incrementCount(&d.writtenN, resource.Type())
+}
+
+// deadLetter is the DeadLetterFunction of a Pipeline in dry-run mode.
+func (d *dryRunRecorder) deadLetter(ctx context.Context, resource ResourceWrapper, reason error) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	incrementCount(&d.deadLettered, resource.Type())
+	if len(d.deadLetters) < maxDryRunDeadLetters {
+		d.deadLetters = append(d.deadLetters, DryRunDeadLetter{ResourceType: resource.Type(), SourceURL: resource.SourceURL(), Reason: reason.Error()})
+	}
+	return nil
+}
+
+// report returns a copy of the counts.
+func (d *dryRunRecorder) report() DryRunReport {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	copyCounts := func(m map[cpb.ResourceTypeCode_Value]int) map[cpb.ResourceTypeCode_Value]int {
+		c := map[cpb.ResourceTypeCode_Value]int{}
+		for k, v := range m {
+			c[k] = v
+		}
+		return c
+	}
+	return DryRunReport{
+		Processed:    copyCounts(d.processedN),
+		Written:      copyCounts(d.writtenN),
+		DeadLettered: copyCounts(d.deadLettered),
+		DeadLetters:  append([]DryRunDeadLetter(nil), d.deadLetters...),
+	}
+}
+
+func incrementCount(m *map[cpb.ResourceTypeCode_Value]int, resourceType cpb.ResourceTypeCode_Value) {
+	if *m == nil {
+		*m = map[cpb.ResourceTypeCode_Value]int{}
+	}
+	(*m)[resourceType]++
+}
+
+// log logs the report.
+func (r DryRunReport) log() {
+	types := map[cpb.ResourceTypeCode_Value]bool{}
+	for _, m := range []map[cpb.ResourceTypeCode_Value]int{r.Processed, r.Written, r.DeadLettered} {
+		for t := range m {
+			types[t] = true
+		}
+	}
+	sorted := make([]cpb.ResourceTypeCode_Value, 0, len(types))
+	for t := range types {
+		sorted = append(sorted, t)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].String() < sorted[j].String() })
+
+	log.Infof("Dry run complete; nothing was written.")
+	for _, t := range sorted {
+		log.Infof("Dry run: %s: %d processed, %d would be written, %d dropped", t, r.Processed[t], r.Written[t], r.DeadLettered[t])
+	}
+	for _, dl := range r.DeadLetters {
+		log.Warningf("Dry run: dropped %s resource from %s: %s", dl.ResourceType, dl.SourceURL, dl.Reason)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+)
+
+// ErrDuplicateID is passed (wrapped) as the dead letter reason for resources
+// whose id has already been seen in the same source file.
+var ErrDuplicateID = errors.New("duplicate resource id within a single source file")
+
+var intraFileDuplicateCounter *metrics.Counter = metrics.NewCounter("intra-file-duplicate-counter", "Count of FHIR Resources dropped because a resource with the same id was already seen in the same source file. The counter is tagged by the FHIR Resource type ex) OBSERVATION.", "1", aggregation.Count, "FHIRResourceType")
+
+type intraFileDuplicateDetectorProcessor struct {
+	BaseProcessor
+	sourceURL string
+	// seen holds the {type}/{id} of every resource seen from sourceURL.
+	seen map[string]bool
+}
+
+// Assert intraFileDuplicateDetectorProcessor satisfies the Processor interface.
+var _ Processor = &intraFileDuplicateDetectorProcessor{}
+
+// NewIntraFileDuplicateDetectorProcessor creates a Processor which drops
+// resources with the same type and id as a resource previously seen from the
+// same source URL, passing them to the pipeline's dead letter function (or
+// logging them if there is none). Some servers erroneously include a resource
+// more than once in a single result file.
+//
+// The set of seen ids is reset whenever the source URL changes, so resources
+// from a file must be processed consecutively (as they are by the fetcher), and
+// duplicates across different files are not detected.
+func NewIntraFileDuplicateDetectorProcessor() Processor {
+	return &intraFileDuplicateDetectorProcessor{seen: map[string]bool{}}
+}
+
+// idJSON holds the subset of a resource needed to read its id.
+type idJSON struct {
+	ID string `json:"id"`
+}
+
+func (dp *intraFileDuplicateDetectorProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	if resource.SourceURL() != dp.sourceURL {
+		dp.sourceURL = resource.SourceURL()
+		dp.seen = map[string]bool{}
+	}
+
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var res idJSON
+	if err := json.Unmarshal(rawJSON, &res); err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	if res.ID == "" {
+		return dp.Output(ctx, resource)
+	}
+
+	key := fmt.Sprintf("%s/%s", resource.Type(), res.ID)
+	if !dp.seen[key] {
+		dp.seen[key] = true
+		return dp.Output(ctx, resource)
+	}
+	if err := intraFileDuplicateCounter.Record(ctx, 1, resource.Type().String()); err != nil {
+		return err
+	}
+	return dp.DeadLetterResource(ctx, resource, fmt.Errorf("%w: %s in %s", ErrDuplicateID, key, dp.sourceURL))
+}
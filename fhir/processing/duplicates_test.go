@@ -0,0 +1,84 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestIntraFileDuplicateDetectorProcessor(t *testing.T) {
+	ctx := context.Background()
+	ts := &processing.TestSink{}
+	var deadLetterReasons []error
+	opts := &processing.PipelineOptions{
+		DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+			deadLetterReasons = append(deadLetterReasons, reason)
+			return nil
+		},
+	}
+	p, err := processing.NewPipelineWithOptions([]processing.Processor{processing.NewIntraFileDuplicateDetectorProcessor()}, []processing.Sink{ts}, opts)
+	if err != nil {
+		t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+	}
+
+	inputs := []struct {
+		sourceURL string
+		json      string
+	}{
+		{"url1", `{"resourceType":"Patient","id":"1"}`},
+		{"url1", `{"resourceType":"Patient","id":"2"}`},
+		// Duplicate within url1.
+		{"url1", `{"resourceType":"Patient","id":"1","gender":"male"}`},
+		// Same id in a different file is not a duplicate.
+		{"url2", `{"resourceType":"Patient","id":"1"}`},
+		// Resources without ids are always passed through.
+		{"url2", `{"resourceType":"Patient"}`},
+		{"url2", `{"resourceType":"Patient"}`},
+	}
+	for _, in := range inputs {
+		if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, in.sourceURL, []byte(in.json)); err != nil {
+			t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", in.json, err)
+		}
+	}
+
+	var got []string
+	for _, r := range ts.WrittenResources {
+		json, err := r.JSON()
+		if err != nil {
+			t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+		}
+		got = append(got, r.SourceURL()+" "+string(json))
+	}
+	want := []string{
+		`url1 {"resourceType":"Patient","id":"1"}`,
+		`url1 {"resourceType":"Patient","id":"2"}`,
+		`url2 {"resourceType":"Patient","id":"1"}`,
+		`url2 {"resourceType":"Patient"}`,
+		`url2 {"resourceType":"Patient"}`,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected written resources (-want +got):\n%s", diff)
+	}
+	if len(deadLetterReasons) != 1 || !errors.Is(deadLetterReasons[0], processing.ErrDuplicateID) {
+		t.Errorf("unexpected dead letter reasons. got: %v, want: [%v]", deadLetterReasons, processing.ErrDuplicateID)
+	}
+}
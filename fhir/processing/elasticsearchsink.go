@@ -0,0 +1,366 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+)
+
+// ErrElasticsearchIndexFailures is returned (wrapped, along with an
+// *ElasticsearchDocumentError for each failed document) if Elasticsearch
+// reports that it failed to index some of the documents in a bulk request.
+var ErrElasticsearchIndexFailures = errors.New("Elasticsearch failed to index some documents")
+
+// ResourceTypePlaceholder is replaced by the lowercase resource type name in
+// Elasticsearch index patterns.
+const ResourceTypePlaceholder = "{resourceType}"
+
+// DefaultElasticsearchIndexPattern is the index pattern used by
+// NewElasticsearchSink if none is given, which indexes Patient resources into
+// the fhir-patient index, for example.
+const DefaultElasticsearchIndexPattern = "fhir-" + ResourceTypePlaceholder
+
+const (
+	defaultElasticsearchMaxBatchDocuments = 500
+	defaultElasticsearchMaxBatchBytes     = 5 * 1024 * 1024
+	defaultElasticsearchFlushInterval     = 5 * time.Second
+)
+
+// ElasticsearchSinkOptions contains optional parameters used by
+// NewElasticsearchSinkWithOptions.
+type ElasticsearchSinkOptions struct {
+	// If set, requests use basic authentication.
+	Username string
+	Password string
+	// If set, requests use API key authentication. This is the base64 encoded
+	// key, as returned by the create API key API.
+	APIKey string
+	// The maximum number of documents in each bulk request. Defaults to 500.
+	MaxBatchDocuments int
+	// The approximate maximum size of each bulk request in bytes. Defaults to
+	// 5MiB.
+	MaxBatchBytes int
+	// Buffered documents are sent if no bulk request has been made for this
+	// long. Defaults to 5 seconds. If negative, documents are only sent when a
+	// batch is full, and by Finalize.
+	FlushInterval time.Duration
+	// The HTTP client used for requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+// ElasticsearchDocumentError describes a document which Elasticsearch failed
+// to index.
+type ElasticsearchDocumentError struct {
+	Index  string
+	ID     string
+	Status int
+	// The Elasticsearch error type and reason, for example
+	// "mapper_parsing_exception".
+	Type   string
+	Reason string
+}
+
+func (e *ElasticsearchDocumentError) Error() string {
+	return fmt.Sprintf("failed to index document %s in %s (status %d): %s: %s", e.ID, e.Index, e.Status, e.Type, e.Reason)
+}
+
+// elasticsearchBulkResponse holds the subset of a bulk API response needed to
+// read per-document errors.
+type elasticsearchBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Index  string `json:"_index"`
+		ID     string `json:"_id"`
+		Status int    `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+type elasticsearchSink struct {
+	addrs        []string
+	indexPattern string
+	opts         ElasticsearchSinkOptions
+	client       *http.Client
+
+	mu sync.Mutex
+	// batch holds the bulk request body for the buffered documents.
+	batch     bytes.Buffer
+	batchDocs int
+	lastFlush time.Time
+	// nextAddr is the index of the address to send the next request to.
+	nextAddr int
+	// flushErr holds errors from flushes in the background, to be returned by
+	// the next call to Write or Finalize.
+	flushErr error
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Assert elasticsearchSink satisfies the Sink interface.
+var _ Sink = &elasticsearchSink{}
+
+// NewElasticsearchSink creates a Sink which indexes resources into
+// Elasticsearch (or OpenSearch) using the bulk API. Each resource is indexed
+// with its id as the document ID, into the index given by replacing
+// ResourceTypePlaceholder in indexPattern with the lowercase resource type, so
+// rewriting a resource updates the existing document. If indexPattern is
+// empty, DefaultElasticsearchIndexPattern is used.
+//
+// Documents are sent in batches, when a batch is full, periodically, and when
+// Finalize is called. Requests are sent to each of addrs (the base URLs of
+// the cluster's nodes) in turn, and are retried on the next address if a node
+// is unavailable. If Elasticsearch fails to index some documents, an error
+// wrapping ErrElasticsearchIndexFailures is returned by Write or Finalize.
+//
+// ctx is used for periodic flushes. It is threadsafe to call Write on this
+// Sink from multiple goroutines.
+func NewElasticsearchSink(ctx context.Context, addrs []string, indexPattern string) (Sink, error) {
+	return NewElasticsearchSinkWithOptions(ctx, addrs, indexPattern, nil)
+}
+
+// NewElasticsearchSinkWithOptions is like NewElasticsearchSink, but allows
+// optional parameters to be set.
+func NewElasticsearchSinkWithOptions(ctx context.Context, addrs []string, indexPattern string, opts *ElasticsearchSinkOptions) (Sink, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("at least one Elasticsearch address must be given")
+	}
+	if indexPattern == "" {
+		indexPattern = DefaultElasticsearchIndexPattern
+	}
+	// Documents are identified by resource id alone, so resources of different
+	// types must be in different indices.
+	if !strings.Contains(indexPattern, ResourceTypePlaceholder) {
+		return nil, fmt.Errorf("Elasticsearch index pattern %q must contain %s", indexPattern, ResourceTypePlaceholder)
+	}
+	if opts == nil {
+		opts = &ElasticsearchSinkOptions{}
+	}
+	es := &elasticsearchSink{
+		indexPattern: indexPattern,
+		opts:         *opts,
+		client:       opts.HTTPClient,
+		lastFlush:    time.Now(),
+		done:         make(chan struct{}),
+	}
+	for _, addr := range addrs {
+		es.addrs = append(es.addrs, strings.TrimRight(addr, "/"))
+	}
+	if es.client == nil {
+		es.client = http.DefaultClient
+	}
+	if es.opts.MaxBatchDocuments <= 0 {
+		es.opts.MaxBatchDocuments = defaultElasticsearchMaxBatchDocuments
+	}
+	if es.opts.MaxBatchBytes <= 0 {
+		es.opts.MaxBatchBytes = defaultElasticsearchMaxBatchBytes
+	}
+	if es.opts.FlushInterval == 0 {
+		es.opts.FlushInterval = defaultElasticsearchFlushInterval
+	}
+	if es.opts.FlushInterval > 0 {
+		es.wg.Add(1)
+		go es.flushPeriodically(ctx)
+	}
+	return es, nil
+}
+
+func (es *elasticsearchSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var res idJSON
+	if err := json.Unmarshal(rawJSON, &res); err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	if res.ID == "" {
+		return fmt.Errorf("%s resource has no id to use as the Elasticsearch document ID", resource.Type())
+	}
+	doc, err := normalizeNDJSONLine(rawJSON)
+	if err != nil {
+		return err
+	}
+	name, err := bulkfhir.ResourceTypeCodeToName(resource.Type())
+	if err != nil {
+		return err
+	}
+	type indexAction struct {
+		Index string `json:"_index"`
+		ID    string `json:"_id"`
+	}
+	action, err := json.Marshal(map[string]indexAction{
+		"index": {Index: strings.ReplaceAll(es.indexPattern, ResourceTypePlaceholder, strings.ToLower(name)), ID: res.ID},
+	})
+	if err != nil {
+		return err
+	}
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if err := es.takeFlushErr(); err != nil {
+		return err
+	}
+	es.batch.Write(action)
+	es.batch.WriteByte('\n')
+	es.batch.Write(doc)
+	es.batch.WriteByte('\n')
+	es.batchDocs++
+	if es.batchDocs >= es.opts.MaxBatchDocuments || es.batch.Len() >= es.opts.MaxBatchBytes {
+		return es.flush(ctx)
+	}
+	return nil
+}
+
+// Finalize sends any buffered documents.
+func (es *elasticsearchSink) Finalize(ctx context.Context) error {
+	close(es.done)
+	es.wg.Wait()
+
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return errors.Join(es.takeFlushErr(), es.flush(ctx))
+}
+
+func (es *elasticsearchSink) flushPeriodically(ctx context.Context) {
+	defer es.wg.Done()
+	ticker := time.NewTicker(es.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-es.done:
+			return
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		es.mu.Lock()
+		if time.Since(es.lastFlush) >= es.opts.FlushInterval {
+			es.flushErr = errors.Join(es.flushErr, es.flush(ctx))
+		}
+		es.mu.Unlock()
+	}
+}
+
+// takeFlushErr returns and clears any error from a background flush. es.mu
+// must be held.
+func (es *elasticsearchSink) takeFlushErr() error {
+	err := es.flushErr
+	es.flushErr = nil
+	return err
+}
+
+// flush sends the buffered documents in a bulk request. es.mu must be held.
+func (es *elasticsearchSink) flush(ctx context.Context) error {
+	es.lastFlush = time.Now()
+	if es.batchDocs == 0 {
+		return nil
+	}
+	body := es.batch.Bytes()
+	numDocs := es.batchDocs
+	// The batch is discarded even if the request fails, as it would otherwise
+	// be retried (and likely fail again) by every subsequent flush.
+	defer func() {
+		es.batch.Reset()
+		es.batchDocs = 0
+	}()
+
+	var errs []error
+	for i := 0; i < len(es.addrs); i++ {
+		addr := es.addrs[es.nextAddr]
+		es.nextAddr = (es.nextAddr + 1) % len(es.addrs)
+		resp, retryable, err := es.bulk(ctx, addr, body)
+		if err == nil {
+			return resp.documentErrors(numDocs)
+		}
+		errs = append(errs, err)
+		if !retryable {
+			break
+		}
+	}
+	return fmt.Errorf("failed to index %d documents in Elasticsearch: %w", numDocs, errors.Join(errs...))
+}
+
+// bulk sends a bulk request to addr, returning whether the request may be
+// retried on another node if it failed.
+func (es *elasticsearchSink) bulk(ctx context.Context, addr string, body []byte) (*elasticsearchBulkResponse, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, addr+"/_bulk", bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Accept", "application/json")
+	if es.opts.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+es.opts.APIKey)
+	} else if es.opts.Username != "" {
+		req.SetBasicAuth(es.opts.Username, es.opts.Password)
+	}
+	resp, err := es.client.Do(req)
+	if err != nil {
+		return nil, ctx.Err() == nil, fmt.Errorf("bulk request to %s failed: %w", addr, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, true, fmt.Errorf("failed to read bulk response from %s: %w", addr, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return nil, retryable, fmt.Errorf("bulk request to %s returned status %d: %s", addr, resp.StatusCode, respBody)
+	}
+	var bulkResp elasticsearchBulkResponse
+	if err := json.Unmarshal(respBody, &bulkResp); err != nil {
+		return nil, false, fmt.Errorf("failed to parse bulk response from %s: %w", addr, err)
+	}
+	return &bulkResp, false, nil
+}
+
+// documentErrors returns an error for the documents which failed to be
+// indexed, if any.
+func (r *elasticsearchBulkResponse) documentErrors(numDocs int) error {
+	if !r.Errors {
+		return nil
+	}
+	var errs []error
+	for _, item := range r.Items {
+		for _, result := range item {
+			if result.Error == nil {
+				continue
+			}
+			errs = append(errs, &ElasticsearchDocumentError{
+				Index:  result.Index,
+				ID:     result.ID,
+				Status: result.Status,
+				Type:   result.Error.Type,
+				Reason: result.Error.Reason,
+			})
+		}
+	}
+	return fmt.Errorf("%w: %d of %d documents failed: %w", ErrElasticsearchIndexFailures, len(errs), numDocs, errors.Join(errs...))
+}
@@ -0,0 +1,223 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// fakeElasticsearch is a minimal implementation of the Elasticsearch bulk API,
+// which fails to index documents with IDs in failIDs.
+type fakeElasticsearch struct {
+	t       *testing.T
+	failIDs map[string]bool
+
+	mu sync.Mutex
+	// requests holds the "index/id" of the documents in each bulk request.
+	requests [][]string
+	docs     map[string]string
+	auth     []string
+}
+
+func (fe *fakeElasticsearch) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || req.URL.Path != "/_bulk" {
+		fe.t.Errorf("unexpected request %s %s", req.Method, req.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		fe.t.Errorf("unexpected Content-Type %q", ct)
+	}
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+	fe.auth = append(fe.auth, req.Header.Get("Authorization"))
+
+	var docs []string
+	var items []string
+	hasErrors := false
+	s := bufio.NewScanner(req.Body)
+	for s.Scan() {
+		var action struct {
+			Index struct {
+				Index string `json:"_index"`
+				ID    string `json:"_id"`
+			} `json:"index"`
+		}
+		if err := json.Unmarshal(s.Bytes(), &action); err != nil {
+			fe.t.Fatalf("failed to parse bulk action %s: %v", s.Bytes(), err)
+		}
+		if !s.Scan() {
+			fe.t.Fatal("bulk request ended without a document")
+		}
+		key := action.Index.Index + "/" + action.Index.ID
+		docs = append(docs, key)
+		if fe.failIDs[action.Index.ID] {
+			hasErrors = true
+			items = append(items, fmt.Sprintf(`{"index": {"_index": %q, "_id": %q, "status": 400, "error": {"type": "mapper_parsing_exception", "reason": "failed to parse"}}}`, action.Index.Index, action.Index.ID))
+			continue
+		}
+		fe.docs[key] = s.Text()
+		items = append(items, fmt.Sprintf(`{"index": {"_index": %q, "_id": %q, "status": 201}}`, action.Index.Index, action.Index.ID))
+	}
+	fe.requests = append(fe.requests, docs)
+	fmt.Fprintf(w, `{"took": 1, "errors": %t, "items": [%s]}`, hasErrors, strings.Join(items, ","))
+}
+
+func newFakeElasticsearch(t *testing.T, failIDs ...string) (*fakeElasticsearch, *httptest.Server) {
+	fe := &fakeElasticsearch{t: t, failIDs: map[string]bool{}, docs: map[string]string{}}
+	for _, id := range failIDs {
+		fe.failIDs[id] = true
+	}
+	server := httptest.NewServer(fe)
+	t.Cleanup(server.Close)
+	return fe, server
+}
+
+func TestElasticsearchSink(t *testing.T) {
+	ctx := context.Background()
+	fe, server := newFakeElasticsearch(t)
+	// The first node is unavailable, so requests should fail over to the second.
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	opts := &processing.ElasticsearchSinkOptions{APIKey: "key", MaxBatchDocuments: 2, FlushInterval: -1}
+	sink, err := processing.NewElasticsearchSinkWithOptions(ctx, []string{unavailable.URL, server.URL + "/"}, "", opts)
+	if err != nil {
+		t.Fatalf("NewElasticsearchSinkWithOptions() returned unexpected error: %v", err)
+	}
+	resources := []*testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte(`{"resourceType":"Patient","id":"p1"}`)},
+		{resourceType: cpb.ResourceTypeCode_OBSERVATION, json: []byte("{\n  \"resourceType\": \"Observation\",\n  \"id\": \"o1\"\n}")},
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte(`{"resourceType":"Patient","id":"p2"}`)},
+	}
+	for _, r := range resources {
+		if err := sink.Write(ctx, r); err != nil {
+			t.Fatalf("sink.Write() returned unexpected error: %v", err)
+		}
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("sink.Finalize() returned unexpected error: %v", err)
+	}
+
+	wantRequests := [][]string{
+		{"fhir-patient/p1", "fhir-observation/o1"},
+		// The remaining document is sent by Finalize.
+		{"fhir-patient/p2"},
+	}
+	if diff := cmp.Diff(wantRequests, fe.requests); diff != "" {
+		t.Errorf("unexpected bulk requests (-want +got):\n%s", diff)
+	}
+	wantDocs := map[string]string{
+		"fhir-patient/p1":     `{"resourceType":"Patient","id":"p1"}`,
+		"fhir-observation/o1": `{"resourceType":"Observation","id":"o1"}`,
+		"fhir-patient/p2":     `{"resourceType":"Patient","id":"p2"}`,
+	}
+	if diff := cmp.Diff(wantDocs, fe.docs); diff != "" {
+		t.Errorf("unexpected indexed documents (-want +got):\n%s", diff)
+	}
+	for _, auth := range fe.auth {
+		if auth != "ApiKey key" {
+			t.Errorf("unexpected Authorization header %q, want %q", auth, "ApiKey key")
+		}
+	}
+}
+
+func TestElasticsearchSink_DocumentErrors(t *testing.T) {
+	ctx := context.Background()
+	fe, server := newFakeElasticsearch(t, "bad")
+	sink, err := processing.NewElasticsearchSinkWithOptions(ctx, []string{server.URL}, "search-{resourceType}-v1", &processing.ElasticsearchSinkOptions{FlushInterval: -1})
+	if err != nil {
+		t.Fatalf("NewElasticsearchSinkWithOptions() returned unexpected error: %v", err)
+	}
+	for _, id := range []string{"good", "bad"} {
+		r := &testResourceWrapper{resourceType: cpb.ResourceTypeCode_ENCOUNTER, json: []byte(fmt.Sprintf(`{"resourceType":"Encounter","id":%q}`, id))}
+		if err := sink.Write(ctx, r); err != nil {
+			t.Fatalf("sink.Write() returned unexpected error: %v", err)
+		}
+	}
+	err = sink.Finalize(ctx)
+	if !errors.Is(err, processing.ErrElasticsearchIndexFailures) {
+		t.Fatalf("sink.Finalize() returned unexpected error. got: %v, want: %v", err, processing.ErrElasticsearchIndexFailures)
+	}
+	var docErr *processing.ElasticsearchDocumentError
+	if !errors.As(err, &docErr) {
+		t.Fatalf("sink.Finalize() error %v does not contain an ElasticsearchDocumentError", err)
+	}
+	wantDocErr := &processing.ElasticsearchDocumentError{Index: "search-encounter-v1", ID: "bad", Status: 400, Type: "mapper_parsing_exception", Reason: "failed to parse"}
+	if diff := cmp.Diff(wantDocErr, docErr); diff != "" {
+		t.Errorf("unexpected document error (-want +got):\n%s", diff)
+	}
+	if _, ok := fe.docs["search-encounter-v1/good"]; !ok {
+		t.Errorf("document search-encounter-v1/good was not indexed")
+	}
+}
+
+func TestElasticsearchSink_FlushInterval(t *testing.T) {
+	ctx := context.Background()
+	fe, server := newFakeElasticsearch(t)
+	sink, err := processing.NewElasticsearchSinkWithOptions(ctx, []string{server.URL}, "", &processing.ElasticsearchSinkOptions{FlushInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewElasticsearchSinkWithOptions() returned unexpected error: %v", err)
+	}
+	if err := sink.Write(ctx, &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte(`{"resourceType":"Patient","id":"p1"}`)}); err != nil {
+		t.Fatalf("sink.Write() returned unexpected error: %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		fe.mu.Lock()
+		n := len(fe.requests)
+		fe.mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("buffered document was not sent before Finalize")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("sink.Finalize() returned unexpected error: %v", err)
+	}
+	if len(fe.requests) != 1 {
+		t.Errorf("unexpected number of bulk requests. got: %d, want: 1", len(fe.requests))
+	}
+}
+
+func TestNewElasticsearchSink_InvalidArguments(t *testing.T) {
+	ctx := context.Background()
+	if _, err := processing.NewElasticsearchSink(ctx, nil, ""); err == nil {
+		t.Error("NewElasticsearchSink() with no addresses succeeded, want error")
+	}
+	if _, err := processing.NewElasticsearchSink(ctx, []string{"http://localhost:9200"}, "fhir"); err == nil {
+		t.Error("NewElasticsearchSink() with an index pattern without a resource type succeeded, want error")
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	rpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+var emptyFieldCleanupCounter *metrics.Counter = metrics.NewCounter("empty-field-cleanup-counter", "Count of FHIR Resources which had empty or whitespace-only string fields removed. The counter is tagged by the FHIR Resource type ex) OBSERVATION.", "1", aggregation.Count, "FHIRResourceType")
+
+// EmptyFieldCleanupProcessorOptions contains optional parameters used by
+// NewEmptyFieldCleanupProcessorWithOptions.
+type EmptyFieldCleanupProcessorOptions struct {
+	// Fields of each resource type which are left as they are, even if empty,
+	// for fields where an empty value is meaningful. Fields are given as dot
+	// separated paths of FHIR JSON field names, as for
+	// NewRequiredFieldsProcessor, and everything within them is also left as it
+	// is.
+	Allowlist map[cpb.ResourceTypeCode_Value][]string
+}
+
+type emptyFieldCleanupProcessor struct {
+	BaseProcessor
+	// allowlist holds the allowlisted paths for each resource type.
+	allowlist map[cpb.ResourceTypeCode_Value]map[string]bool
+}
+
+// Assert emptyFieldCleanupProcessor satisfies the Processor interface.
+var _ Processor = &emptyFieldCleanupProcessor{}
+
+// NewEmptyFieldCleanupProcessor creates a Processor which removes string
+// fields which are empty or only whitespace, which some sources emit instead
+// of leaving the field out (in violation of FHIR). Any elements, and repeated
+// field entries, which are left empty by this are removed too. For example,
+// {"name": [{"family": "", "given": [" ", "Ann"]}, {"text": ""}]} becomes
+// {"name": [{"given": ["Ann"]}]}.
+//
+// Only string values are removed; empty strings with extensions (for example,
+// a data absent reason) are kept, as are other primitive values such as false
+// or 0. Contained resources are not modified. Resources without empty strings
+// are passed through unchanged, without being marked as mutated.
+func NewEmptyFieldCleanupProcessor() Processor {
+	return &emptyFieldCleanupProcessor{}
+}
+
+// NewEmptyFieldCleanupProcessorWithOptions is like
+// NewEmptyFieldCleanupProcessor, but with the given options. opts may be nil.
+func NewEmptyFieldCleanupProcessorWithOptions(opts *EmptyFieldCleanupProcessorOptions) (Processor, error) {
+	efcp := &emptyFieldCleanupProcessor{}
+	if opts == nil || len(opts.Allowlist) == 0 {
+		return efcp, nil
+	}
+	containedFields := (&rpb.ContainedResource{}).ProtoReflect().Descriptor().Fields()
+	efcp.allowlist = map[cpb.ResourceTypeCode_Value]map[string]bool{}
+	for resourceType, paths := range opts.Allowlist {
+		resourceField := containedFields.ByName(protoreflect.Name(strings.ToLower(resourceType.String())))
+		if resourceField == nil {
+			return nil, fmt.Errorf("unsupported resource type %s", resourceType)
+		}
+		efcp.allowlist[resourceType] = map[string]bool{}
+		for _, path := range paths {
+			if _, err := parseRequiredField(resourceField.Message(), path); err != nil {
+				return nil, fmt.Errorf("invalid allowlisted field for %s: %w", resourceType, err)
+			}
+			efcp.allowlist[resourceType][path] = true
+		}
+	}
+	return efcp, nil
+}
+
+func (efcp *emptyFieldCleanupProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	// Check the JSON before the proto, so that resources without empty strings
+	// are not marked as mutated.
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var parsed any
+	if err := json.Unmarshal(rawJSON, &parsed); err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	if !hasBlankString(parsed) {
+		return efcp.Output(ctx, resource)
+	}
+
+	cr, err := resource.Proto()
+	if err != nil {
+		return err
+	}
+	msg := cr.ProtoReflect()
+	populated := msg.WhichOneof(msg.Descriptor().Oneofs().Get(0))
+	if populated == nil {
+		return fmt.Errorf("%s resource from %s has no content", resource.Type(), resource.SourceURL())
+	}
+	if cleanEmptyFields(msg.Get(populated).Message(), "", efcp.allowlist[resource.Type()]) {
+		if err := emptyFieldCleanupCounter.Record(ctx, 1, resource.Type().String()); err != nil {
+			return err
+		}
+	}
+	return efcp.Output(ctx, resource)
+}
+
+// hasBlankString returns whether v (parsed JSON) holds a string value which is
+// empty or only whitespace.
+func hasBlankString(v any) bool {
+	switch v := v.(type) {
+	case string:
+		return strings.TrimSpace(v) == ""
+	case []any:
+		for _, e := range v {
+			if hasBlankString(e) {
+				return true
+			}
+		}
+	case map[string]any:
+		for _, e := range v {
+			if hasBlankString(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cleanEmptyFields removes the blank string primitives within msg (which is at
+// the given path), along with any elements and list entries left empty by
+// their removal, skipping allowlisted paths. It returns whether anything was
+// removed.
+func cleanEmptyFields(msg protoreflect.Message, path string, allowlist map[string]bool) bool {
+	// Collect the fields first, as msg must not be modified while ranging over
+	// it.
+	var fields []protoreflect.FieldDescriptor
+	msg.Range(func(fd protoreflect.FieldDescriptor, _ protoreflect.Value) bool {
+		if fd.Message() != nil {
+			fields = append(fields, fd)
+		}
+		return true
+	})
+
+	changed := false
+	for _, fd := range fields {
+		fieldPath := fd.JSONName()
+		if path != "" {
+			fieldPath = path + "." + fieldPath
+		}
+		if allowlist[fieldPath] {
+			continue
+		}
+		if !fd.IsList() {
+			elemChanged, remove := cleanEmptyElement(msg.Get(fd).Message(), fieldPath, allowlist)
+			changed = changed || elemChanged
+			if remove {
+				msg.Clear(fd)
+			}
+			continue
+		}
+		list := msg.Get(fd).List()
+		kept := msg.NewField(fd).List()
+		for i := 0; i < list.Len(); i++ {
+			elemChanged, remove := cleanEmptyElement(list.Get(i).Message(), fieldPath, allowlist)
+			changed = changed || elemChanged
+			if !remove {
+				kept.Append(list.Get(i))
+			}
+		}
+		switch {
+		case kept.Len() == 0:
+			msg.Clear(fd)
+		case kept.Len() < list.Len():
+			msg.Set(fd, protoreflect.ValueOfList(kept))
+		}
+	}
+	return changed
+}
+
+// cleanEmptyElement cleans the element m (which is at the given path) as for
+// cleanEmptyFields. It returns whether anything was removed, and whether m
+// should itself be removed, because it is a blank string primitive or was left
+// empty.
+func cleanEmptyElement(m protoreflect.Message, path string, allowlist map[string]bool) (changed, remove bool) {
+	changed = cleanEmptyFields(m, path, allowlist)
+	valueField := m.Descriptor().Fields().ByName("value")
+	isPrimitive := valueField != nil && valueField.Message() == nil
+	if !isPrimitive {
+		return changed, changed && populatedFieldCount(m) == 0
+	}
+	if valueField.Kind() != protoreflect.StringKind || strings.TrimSpace(m.Get(valueField).String()) != "" {
+		return changed, false
+	}
+	// Keep primitives which have an id or extensions, such as a data absent
+	// reason, even if their value is blank.
+	if populatedFieldCount(m) > 0 && !(populatedFieldCount(m) == 1 && m.Has(valueField)) {
+		return changed, false
+	}
+	return true, true
+}
+
+// populatedFieldCount returns the number of populated fields in m.
+func populatedFieldCount(m protoreflect.Message) int {
+	n := 0
+	m.Range(func(protoreflect.FieldDescriptor, protoreflect.Value) bool {
+		n++
+		return true
+	})
+	return n
+}
@@ -0,0 +1,116 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestEmptyFieldCleanupProcessor(t *testing.T) {
+	cases := []struct {
+		name      string
+		allowlist map[cpb.ResourceTypeCode_Value][]string
+		input     typedResource
+		want      string
+	}{
+		{
+			name:  "EmptyAndWhitespaceStrings",
+			input: typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","name":[{"family":"","given":[" ","Ann"]},{"text":"\t"}],"telecom":[{"system":"phone","value":"  "}]}`},
+			want:  `{"resourceType":"Patient","id":"1","name":[{"given":["Ann"]}],"telecom":[{"system":"phone"}]}`,
+		},
+		{
+			name:  "EmptyElementsPruned",
+			input: typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","address":[{"line":["",""],"city":" "}],"maritalStatus":{"text":"","coding":[{"display":""}]}}`},
+			want:  `{"resourceType":"Patient","id":"1"}`,
+		},
+		{
+			name:  "OtherPrimitivesKept",
+			input: typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","active":false,"multipleBirthInteger":0,"name":[{"family":""}]}`},
+			want:  `{"resourceType":"Patient","id":"1","active":false,"multipleBirthInteger":0}`,
+		},
+		{
+			name:  "EmptyStringWithExtensionKept",
+			input: typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","name":[{"family":"","_family":{"extension":[{"url":"http://hl7.org/fhir/StructureDefinition/data-absent-reason","valueCode":"unknown"}]}}]}`},
+			want:  `{"resourceType":"Patient","id":"1","name":[{"_family":{"extension":[{"url":"http://hl7.org/fhir/StructureDefinition/data-absent-reason","valueCode":"unknown"}]}}]}`,
+		},
+		{
+			name:      "Allowlist",
+			allowlist: map[cpb.ResourceTypeCode_Value][]string{cpb.ResourceTypeCode_PATIENT: {"name.given"}},
+			input:     typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","name":[{"family":"","given":["","Ann"]}]}`},
+			want:      `{"resourceType":"Patient","id":"1","name":[{"given":["","Ann"]}]}`,
+		},
+		{
+			name:      "AllowlistForOtherResourceType",
+			allowlist: map[cpb.ResourceTypeCode_Value][]string{cpb.ResourceTypeCode_PRACTITIONER: {"name.given"}},
+			input:     typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","name":[{"family":"","given":["","Ann"]}]}`},
+			want:      `{"resourceType":"Patient","id":"1","name":[{"given":["Ann"]}]}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := processing.NewEmptyFieldCleanupProcessorWithOptions(&processing.EmptyFieldCleanupProcessorOptions{Allowlist: tc.allowlist})
+			if err != nil {
+				t.Fatalf("NewEmptyFieldCleanupProcessorWithOptions() returned unexpected error: %v", err)
+			}
+			written := runProcessor(t, p, []typedResource{tc.input})
+			if len(written) != 1 {
+				t.Fatalf("unexpected number of resources written. got: %d, want: 1", len(written))
+			}
+			if diff := cmp.Diff(mustUnmarshal(t, tc.want), written[0]); diff != "" {
+				t.Errorf("EmptyFieldCleanupProcessor returned unexpected resource (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestEmptyFieldCleanupProcessor_UnchangedResourceNotMutated(t *testing.T) {
+	// The key order is not the marshaller's, so would change if the resource
+	// was marshalled again.
+	input := `{"resourceType":"Patient","name":[{"given":["Ann"]}],"id":"1"}`
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline([]processing.Processor{processing.NewEmptyFieldCleanupProcessor()}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "", []byte(input)); err != nil {
+		t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+	got, err := ts.WrittenResources[0].JSON()
+	if err != nil {
+		t.Fatalf("JSON() returned unexpected error: %v", err)
+	}
+	if string(got) != input {
+		t.Errorf("EmptyFieldCleanupProcessor modified resource without empty fields. got: %s, want: %s", got, input)
+	}
+}
+
+func TestNewEmptyFieldCleanupProcessorWithOptions_InvalidAllowlist(t *testing.T) {
+	opts := &processing.EmptyFieldCleanupProcessorOptions{
+		Allowlist: map[cpb.ResourceTypeCode_Value][]string{cpb.ResourceTypeCode_PATIENT: {"name.notAField"}},
+	}
+	if _, err := processing.NewEmptyFieldCleanupProcessorWithOptions(opts); err == nil {
+		t.Errorf("NewEmptyFieldCleanupProcessorWithOptions(%v) succeeded, want error", opts.Allowlist)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"unicode/utf8"
+
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+)
+
+// ErrInvalidUTF8 is passed as the dead letter reason for resources whose JSON
+// is not valid UTF-8.
+var ErrInvalidUTF8 = errors.New("resource JSON contains invalid UTF-8")
+
+var encodingSanitizerCounter *metrics.Counter = metrics.NewCounter("encoding-sanitizer-counter", "Count of FHIR Resources containing invalid UTF-8. The counter is tagged by the FHIR Resource type ex) OBSERVATION and action taken ex) REPLACED.", "1", aggregation.Count, "FHIRResourceType", "Action")
+
+// EncodingSanitizerMode determines how an EncodingSanitizerProcessor handles
+// resources containing invalid UTF-8.
+type EncodingSanitizerMode int
+
+const (
+	// ReplaceInvalidUTF8 replaces each invalid byte sequence with the Unicode
+	// replacement character (U+FFFD).
+	ReplaceInvalidUTF8 EncodingSanitizerMode = iota
+	// DeadLetterInvalidUTF8 drops resources containing invalid UTF-8, passing
+	// them to the pipeline's dead letter function.
+	DeadLetterInvalidUTF8
+)
+
+type encodingSanitizerProcessor struct {
+	BaseProcessor
+	mode EncodingSanitizerMode
+}
+
+// Assert encodingSanitizerProcessor satisfies the Processor interface.
+var _ Processor = &encodingSanitizerProcessor{}
+
+// NewEncodingSanitizerProcessor creates a Processor which detects resources
+// whose JSON contains invalid UTF-8 byte sequences (which cannot be parsed into
+// protos), and handles them according to mode.
+//
+// This processor operates on the raw resource JSON, and must come before any
+// other processors in the pipeline.
+func NewEncodingSanitizerProcessor(mode EncodingSanitizerMode) Processor {
+	return &encodingSanitizerProcessor{mode: mode}
+}
+
+func (esp *encodingSanitizerProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	if utf8.Valid(rawJSON) {
+		return esp.Output(ctx, resource)
+	}
+
+	if esp.mode == DeadLetterInvalidUTF8 {
+		if err := encodingSanitizerCounter.Record(ctx, 1, resource.Type().String(), "DEAD_LETTERED"); err != nil {
+			return err
+		}
+		return esp.DeadLetterResource(ctx, resource, ErrInvalidUTF8)
+	}
+
+	if err := setJSON(resource, bytes.ToValidUTF8(rawJSON, []byte(string(utf8.RuneError)))); err != nil {
+		return err
+	}
+	if err := encodingSanitizerCounter.Record(ctx, 1, resource.Type().String(), "REPLACED"); err != nil {
+		return err
+	}
+	return esp.Output(ctx, resource)
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestEncodingSanitizerProcessor(t *testing.T) {
+	validJSON := `{"resourceType":"Patient","id":"1","name":[{"family":"Müller"}]}`
+	invalidJSON := "{\"resourceType\":\"Patient\",\"id\":\"1\",\"name\":[{\"family\":\"M\xfcller\"}]}"
+	cases := []struct {
+		name             string
+		mode             processing.EncodingSanitizerMode
+		json             string
+		wantJSON         string
+		wantDeadLettered bool
+	}{
+		{
+			name:     "ValidUnchanged",
+			mode:     processing.ReplaceInvalidUTF8,
+			json:     validJSON,
+			wantJSON: validJSON,
+		},
+		{
+			name:     "Replace",
+			mode:     processing.ReplaceInvalidUTF8,
+			json:     invalidJSON,
+			wantJSON: `{"resourceType":"Patient","id":"1","name":[{"family":"M` + "�" + `ller"}]}`,
+		},
+		{
+			name:             "DeadLetter",
+			mode:             processing.DeadLetterInvalidUTF8,
+			json:             invalidJSON,
+			wantDeadLettered: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := &processing.TestSink{}
+			var deadLetterReasons []error
+			opts := &processing.PipelineOptions{
+				DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+					deadLetterReasons = append(deadLetterReasons, reason)
+					return nil
+				},
+			}
+			p, err := processing.NewPipelineWithOptions([]processing.Processor{processing.NewEncodingSanitizerProcessor(tc.mode)}, []processing.Sink{ts}, opts)
+			if err != nil {
+				t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+			}
+			if err := p.Process(context.Background(), cpb.ResourceTypeCode_PATIENT, "", []byte(tc.json)); err != nil {
+				t.Fatalf("pipeline.Process(..., %q) returned unexpected error: %v", tc.json, err)
+			}
+
+			if tc.wantDeadLettered {
+				if len(ts.WrittenResources) != 0 {
+					t.Errorf("unexpected number of written resources. got: %d, want: 0", len(ts.WrittenResources))
+				}
+				if len(deadLetterReasons) != 1 || !errors.Is(deadLetterReasons[0], processing.ErrInvalidUTF8) {
+					t.Errorf("unexpected dead letter reasons. got: %v, want: [%v]", deadLetterReasons, processing.ErrInvalidUTF8)
+				}
+				return
+			}
+			if len(ts.WrittenResources) != 1 {
+				t.Fatalf("unexpected number of written resources. got: %d, want: 1", len(ts.WrittenResources))
+			}
+			// Check the resource can now be parsed.
+			if _, err := ts.WrittenResources[0].Proto(); err != nil && !errors.Is(err, processing.ErrorDoNotModifyProto) {
+				t.Errorf("writtenResource.Proto() returned unexpected error: %v", err)
+			}
+			gotJSON, err := ts.WrittenResources[0].JSON()
+			if err != nil {
+				t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+			}
+			if string(gotJSON) != tc.wantJSON {
+				t.Errorf("unexpected output JSON. got: %s, want: %s", gotJSON, tc.wantJSON)
+			}
+		})
+	}
+}
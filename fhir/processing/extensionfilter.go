@@ -0,0 +1,192 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+)
+
+var extensionFilterCounter *metrics.Counter = metrics.NewCounter("extension-filter-counter", "Count of extensions removed from FHIR Resources by an extension filter. The counter is tagged by the FHIR Resource type ex) OBSERVATION.", "1", aggregation.Count, "FHIRResourceType")
+
+type extensionFilterProcessor struct {
+	BaseProcessor
+	urls map[string]bool
+	// If true, urls lists the extensions which are removed; otherwise it lists
+	// the only extensions which are kept.
+	deny bool
+}
+
+// Assert extensionFilterProcessor satisfies the Processor interface.
+var _ Processor = &extensionFilterProcessor{}
+
+// NewExtensionFilterProcessor creates a Processor which removes every extension
+// and modifier extension whose url is not in allowedURLs, anywhere in a
+// resource (including in contained resources, on primitive elements and
+// within other extensions).
+//
+// Extensions nested inside an allowed extension whose url is not absolute
+// (such as the "ombCategory" parts of the US Core race extension) are part of
+// the definition of their parent, and so are kept. Extensions left with no
+// value or nested extensions after filtering are removed.
+//
+// Resources are only modified if an extension is removed.
+func NewExtensionFilterProcessor(allowedURLs []string) Processor {
+	return newExtensionFilterProcessor(allowedURLs, false)
+}
+
+// NewExtensionDenylistProcessor creates a Processor which removes every
+// extension and modifier extension whose url is in deniedURLs. It is otherwise
+// the same as NewExtensionFilterProcessor.
+func NewExtensionDenylistProcessor(deniedURLs []string) Processor {
+	return newExtensionFilterProcessor(deniedURLs, true)
+}
+
+func newExtensionFilterProcessor(urls []string, deny bool) *extensionFilterProcessor {
+	efp := &extensionFilterProcessor{urls: map[string]bool{}, deny: deny}
+	for _, u := range urls {
+		efp.urls[u] = true
+	}
+	return efp
+}
+
+func (efp *extensionFilterProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	res, err := decodeResourceJSON(rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+
+	removed := efp.walk(res, false)
+	if removed == 0 {
+		return efp.Output(ctx, resource)
+	}
+	if err := extensionFilterCounter.Record(ctx, int64(removed), resource.Type().String()); err != nil {
+		return err
+	}
+	if err := setResourceJSON(resource, res); err != nil {
+		return err
+	}
+	return efp.Output(ctx, resource)
+}
+
+// walk removes filtered extensions within the given JSON value, returning the
+// number of extensions removed. inExtension is true if v is itself an
+// extension.
+func (efp *extensionFilterProcessor) walk(v any, inExtension bool) int {
+	removed := 0
+	switch t := v.(type) {
+	case map[string]any:
+		for k, child := range t {
+			if k == "extension" || k == "modifierExtension" {
+				list, ok := child.([]any)
+				if !ok {
+					continue
+				}
+				kept, n := efp.filterExtensions(list, inExtension && k == "extension")
+				removed += n
+				if len(kept) == 0 {
+					delete(t, k)
+				} else {
+					t[k] = kept
+				}
+				continue
+			}
+			if n := efp.walk(child, false); n > 0 {
+				removed += n
+				// Primitive element extensions are held in a sibling "_" prefixed
+				// property, which must be removed if it is now empty.
+				if strings.HasPrefix(k, "_") && pruneEmptyElement(t, k) {
+					delete(t, k)
+				}
+			}
+		}
+	case []any:
+		for _, child := range t {
+			removed += efp.walk(child, false)
+		}
+	}
+	return removed
+}
+
+// filterExtensions returns the extensions in list which should be kept, and
+// the number which were removed (including any nested extensions).
+// nestedInExtension is true if list holds the parts of a complex extension.
+func (efp *extensionFilterProcessor) filterExtensions(list []any, nestedInExtension bool) ([]any, int) {
+	removed := 0
+	kept := []any{}
+	for _, e := range list {
+		ext, ok := e.(map[string]any)
+		if !ok {
+			kept = append(kept, e)
+			continue
+		}
+		url, _ := ext["url"].(string)
+		// Relative urls of nested extensions are only meaningful as part of their
+		// parent, so are kept along with the parent.
+		if !(nestedInExtension && !strings.Contains(url, ":")) && efp.urls[url] == efp.deny {
+			removed++
+			continue
+		}
+		if n := efp.walk(ext, true); n > 0 {
+			removed += n
+			if !hasExtensionContent(ext) {
+				continue
+			}
+		}
+		kept = append(kept, ext)
+	}
+	return kept, removed
+}
+
+// hasExtensionContent returns whether the extension has a value or nested
+// extensions, one of which is required by FHIR.
+func hasExtensionContent(ext map[string]any) bool {
+	for k := range ext {
+		if k == "extension" || strings.HasPrefix(k, "value") {
+			return true
+		}
+	}
+	return false
+}
+
+// pruneEmptyElement replaces empty elements in the "_" prefixed primitive
+// element property m[k] with null, returning whether the property no longer
+// holds any elements.
+func pruneEmptyElement(m map[string]any, k string) bool {
+	switch t := m[k].(type) {
+	case map[string]any:
+		return len(t) == 0
+	case []any:
+		empty := true
+		for i, e := range t {
+			if em, ok := e.(map[string]any); ok && len(em) == 0 {
+				t[i] = nil
+			}
+			if t[i] != nil {
+				empty = false
+			}
+		}
+		return empty
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+const extensionFilterInput = `{
+	"resourceType": "Patient",
+	"id": "1",
+	"extension": [
+		{"url": "http://allowed/race", "extension": [
+			{"url": "ombCategory", "valueString": "a"},
+			{"url": "http://denied/nested", "valueString": "b"}
+		]},
+		{"url": "http://denied/complex", "extension": [
+			{"url": "part", "valueString": "c"}
+		]},
+		{"url": "http://allowed/wrapper", "extension": [
+			{"url": "http://denied/only-part", "valueString": "d"}
+		]}
+	],
+	"modifierExtension": [
+		{"url": "http://denied/modifier", "valueBoolean": true}
+	],
+	"birthDate": "2000-01-01",
+	"_birthDate": {"extension": [{"url": "http://denied/primitive", "valueString": "e"}]},
+	"name": [{
+		"given": ["A", "B"],
+		"_given": [null, {"extension": [{"url": "http://denied/given", "valueString": "f"}]}]
+	}],
+	"multipleBirthDecimal": 1.10
+}`
+
+func TestExtensionFilterProcessor(t *testing.T) {
+	cases := []struct {
+		name      string
+		processor processing.Processor
+		input     string
+		want      string
+	}{
+		{
+			name:      "Allowlist",
+			processor: processing.NewExtensionFilterProcessor([]string{"http://allowed/race", "http://allowed/wrapper"}),
+			input:     extensionFilterInput,
+			want: `{
+				"resourceType": "Patient",
+				"id": "1",
+				"extension": [
+					{"url": "http://allowed/race", "extension": [
+						{"url": "ombCategory", "valueString": "a"}
+					]}
+				],
+				"birthDate": "2000-01-01",
+				"name": [{"given": ["A", "B"]}],
+				"multipleBirthDecimal": 1.10
+			}`,
+		},
+		{
+			name:      "Denylist",
+			processor: processing.NewExtensionDenylistProcessor([]string{"http://denied/nested", "http://denied/modifier", "http://denied/given"}),
+			input:     extensionFilterInput,
+			want: `{
+				"resourceType": "Patient",
+				"id": "1",
+				"extension": [
+					{"url": "http://allowed/race", "extension": [
+						{"url": "ombCategory", "valueString": "a"}
+					]},
+					{"url": "http://denied/complex", "extension": [
+						{"url": "part", "valueString": "c"}
+					]},
+					{"url": "http://allowed/wrapper", "extension": [
+						{"url": "http://denied/only-part", "valueString": "d"}
+					]}
+				],
+				"birthDate": "2000-01-01",
+				"_birthDate": {"extension": [{"url": "http://denied/primitive", "valueString": "e"}]},
+				"name": [{"given": ["A", "B"]}],
+				"multipleBirthDecimal": 1.10
+			}`,
+		},
+		{
+			name:      "NothingRemoved",
+			processor: processing.NewExtensionDenylistProcessor([]string{"http://other"}),
+			input:     extensionFilterInput,
+			want:      extensionFilterInput,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{tc.processor}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			if err := p.Process(context.Background(), cpb.ResourceTypeCode_PATIENT, "", []byte(tc.input)); err != nil {
+				t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+			}
+			if len(ts.WrittenResources) != 1 {
+				t.Fatalf("unexpected number of written resources. got: %d, want: 1", len(ts.WrittenResources))
+			}
+			got, err := ts.WrittenResources[0].JSON()
+			if err != nil {
+				t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(testhelpers.NormalizeJSON(t, []byte(tc.want)), testhelpers.NormalizeJSON(t, got)); diff != "" {
+				t.Errorf("unexpected output JSON (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
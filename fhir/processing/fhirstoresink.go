@@ -123,7 +123,12 @@ func (dfss *directFHIRStoreSink) uploadWorker(ctx context.Context) {
 
 	for fhirJSON := range dfss.fhirJSONs {
 		err := c.UploadResource([]byte(fhirJSON))
-		if err != nil {
+		if errors.Is(err, fhirstore.ErrorOperationOutcomeWarning) {
+			// The resource was uploaded, so this is not treated as a failure, but
+			// it is recorded in the error file for inspection.
+			log.Warningf("warning uploading resource: %v", err)
+			dfss.writeError(fhirJSON, err)
+		} else if err != nil {
 			// TODO(b/211490544): consider adding an auto-retrying mechanism in the
 			// future.
 			log.Errorf("error uploading resource: %v", err)
@@ -232,7 +237,7 @@ func (gbfss *gcsBasedFHIRStoreSink) Write(ctx context.Context, resource Resource
 		}
 		// Use the stored context from NewFHIRStoreSink, in case ctx is cancelled
 		// before subsequent Write calls.
-		gbfss.ndjsonSink, err = newGCSNDJSONSink(gbfss.ndjsonSinkCtx, gbfss.gcsEndpoint, gbfss.gcsBucket, fhir.ToFHIRInstant(transactionTime))
+		gbfss.ndjsonSink, err = newGCSNDJSONSink(gbfss.ndjsonSinkCtx, gbfss.gcsEndpoint, gbfss.gcsBucket, fhir.ToFHIRInstant(transactionTime), nil)
 		if err != nil {
 			return err
 		}
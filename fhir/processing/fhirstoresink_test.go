@@ -555,6 +555,47 @@ func TestDirectFHIRStoreSink_Errors(t *testing.T) {
 	}
 }
 
+func TestDirectFHIRStoreSink_OperationOutcomeWarnings(t *testing.T) {
+	resourceJSON := []byte(`{"resourceType":"Patient","id":"PatientID"}`)
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(`{"resourceType":"OperationOutcome","issue":[{"severity":"warning","code":"informational","diagnostics":"unknown code system"}]}`))
+	}))
+	defer testServer.Close()
+
+	outputPrefix := t.TempDir()
+	ctx := context.Background()
+	sink, err := processing.NewFHIRStoreSink(ctx, &processing.FHIRStoreSinkConfig{
+		FHIRStoreConfig: &fhirstore.Config{
+			CloudHealthcareEndpoint: testServer.URL,
+			ProjectID:               "test",
+			Location:                "loc",
+			DatasetID:               "dataset",
+			FHIRStoreID:             "fhirstore",
+			PreferOperationOutcome:  true,
+		},
+		MaxWorkers:          1,
+		ErrorFileOutputPath: outputPrefix,
+	})
+	if err != nil {
+		t.Fatalf("NewFHIRStoreSink unexpected error: %v", err)
+	}
+	p, err := processing.NewPipeline(nil, []processing.Sink{sink})
+	if err != nil {
+		t.Fatalf("failed to create pipeline: %v", err)
+	}
+	if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "", resourceJSON); err != nil {
+		t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+	}
+	// Warnings are not upload failures, so Finalize succeeds even though
+	// NoFailOnUploadErrors is not set.
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+	testhelpers.CheckErrorNDJSONFile(t, outputPrefix, []testhelpers.ErrorNDJSONLine{
+		{Err: "OperationOutcome from API server, StatusCode: 200 Issues: [warning informational: unknown code system]", FHIRResource: string(resourceJSON)},
+	})
+}
+
 func TestGCSBasedFHIRStoreSink(t *testing.T) {
 	ctx := context.Background()
 
@@ -0,0 +1,113 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/fhir"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// Placeholders which may be used in an NDJSON sink's FilenameTemplate.
+const (
+	// FilenameResourceType is replaced with the FHIR resource type of the
+	// resources in the file (for example Patient).
+	FilenameResourceType = "{resource_type}"
+	// FilenameIndex is replaced with the index of the file, which is zero
+	// padded to four digits, and counts from zero separately for each resource
+	// type (if FilenameResourceType is used).
+	FilenameIndex = "{index}"
+	// FilenameGroup is replaced with the sink's Group.
+	FilenameGroup = "{group}"
+	// FilenameTransactionTime is replaced with the export's transaction time,
+	// as a FHIR instant.
+	FilenameTransactionTime = "{transaction_time}"
+)
+
+// DefaultFilenameGroup is the value of the FilenameGroup placeholder if no
+// group is set, which is appropriate for exports of all patients.
+const DefaultFilenameGroup = "all"
+
+var filenamePlaceholderRegex = regexp.MustCompile(`\{[^{}]*\}`)
+
+// filenameTemplate generates the names of the files written by an ndjsonSink.
+type filenameTemplate struct {
+	template        string
+	group           string
+	transactionTime *bulkfhir.TransactionTime
+	perType         bool
+}
+
+// newFilenameTemplate validates the template, which must contain
+// FilenameIndex (so that file names are unique), and may only contain the
+// placeholders above. transactionTime must be set if FilenameTransactionTime
+// is used.
+func newFilenameTemplate(template, group string, transactionTime *bulkfhir.TransactionTime) (*filenameTemplate, error) {
+	if !strings.Contains(template, FilenameIndex) {
+		return nil, fmt.Errorf("filename template %q must contain %s", template, FilenameIndex)
+	}
+	if strings.ContainsAny(template, `/\`) || strings.ContainsAny(group, `/\`) {
+		return nil, fmt.Errorf("filename template %q and group %q may not contain path separators", template, group)
+	}
+	for _, p := range filenamePlaceholderRegex.FindAllString(template, -1) {
+		switch p {
+		case FilenameResourceType, FilenameIndex, FilenameGroup:
+		case FilenameTransactionTime:
+			if transactionTime == nil {
+				return nil, fmt.Errorf("filename template %q uses %s, but no TransactionTime was given", template, p)
+			}
+		default:
+			return nil, fmt.Errorf("filename template %q contains unknown placeholder %s", template, p)
+		}
+	}
+	if group == "" {
+		group = DefaultFilenameGroup
+	}
+	return &filenameTemplate{
+		template:        template,
+		group:           group,
+		transactionTime: transactionTime,
+		perType:         strings.Contains(template, FilenameResourceType),
+	}, nil
+}
+
+// filename returns the name of the file with the given index, for resources of
+// the given type.
+func (ft *filenameTemplate) filename(resourceType cpb.ResourceTypeCode_Value, index int) (string, error) {
+	replacements := []string{
+		FilenameIndex, fmt.Sprintf("%04d", index),
+		FilenameGroup, ft.group,
+	}
+	if ft.perType {
+		name, err := bulkfhir.ResourceTypeCodeToName(resourceType)
+		if err != nil {
+			return "", err
+		}
+		replacements = append(replacements, FilenameResourceType, name)
+	}
+	if strings.Contains(ft.template, FilenameTransactionTime) {
+		tt, err := ft.transactionTime.Get()
+		if err != nil {
+			return "", err
+		}
+		replacements = append(replacements, FilenameTransactionTime, fhir.ToFHIRInstant(tt))
+	}
+	return strings.NewReplacer(replacements...).Replace(ft.template), nil
+}
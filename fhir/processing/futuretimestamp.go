@@ -0,0 +1,266 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/fhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// ErrFutureTimestamp is passed (wrapped) as the dead letter reason for
+// resources with timestamps in the future, if the FutureTimestampDeadLetter
+// action is used.
+var ErrFutureTimestamp = errors.New("resource has a timestamp in the future")
+
+// FutureTimestampAttribute is the ResourceWrapper attribute which the
+// processor returned by NewFutureTimestampProcessor sets to a comma separated
+// list of the paths of any future timestamps found, if the
+// FutureTimestampFlag action is used.
+const FutureTimestampAttribute = "future_timestamps"
+
+var futureTimestampCounter *metrics.Counter = metrics.NewCounter("future-timestamp-counter", "Count of FHIR Resources with timestamps in the future. The counter is tagged by the FHIR Resource type ex) OBSERVATION, and the action taken.", "1", aggregation.Count, "FHIRResourceType", "Action")
+
+// FutureTimestampAction is the action taken by NewFutureTimestampProcessor on
+// resources with timestamps in the future.
+type FutureTimestampAction int
+
+const (
+	// FutureTimestampFlag sets the FutureTimestampAttribute of the resource, and
+	// logs a warning. The resource is not modified.
+	FutureTimestampFlag FutureTimestampAction = iota
+	// FutureTimestampClamp replaces future timestamps with the current time, at
+	// the same precision as the original value (so the date 2999-01 becomes the
+	// current month, for example).
+	FutureTimestampClamp
+	// FutureTimestampDeadLetter passes the resource to the pipeline's dead letter
+	// function.
+	FutureTimestampDeadLetter
+)
+
+func (a FutureTimestampAction) String() string {
+	switch a {
+	case FutureTimestampFlag:
+		return "flag"
+	case FutureTimestampClamp:
+		return "clamp"
+	case FutureTimestampDeadLetter:
+		return "dead_letter"
+	default:
+		return fmt.Sprintf("FutureTimestampAction(%d)", int(a))
+	}
+}
+
+// DefaultFutureTimestampFields are the fields checked by
+// NewFutureTimestampProcessor, in addition to meta.lastUpdated, which is
+// checked for every resource type.
+var DefaultFutureTimestampFields = map[cpb.ResourceTypeCode_Value][]string{
+	cpb.ResourceTypeCode_CONDITION:          {"onsetDateTime", "recordedDate"},
+	cpb.ResourceTypeCode_ENCOUNTER:          {"period.start", "period.end"},
+	cpb.ResourceTypeCode_MEDICATION_REQUEST: {"authoredOn"},
+	cpb.ResourceTypeCode_OBSERVATION:        {"effectiveDateTime", "effectiveInstant", "effectivePeriod.start", "effectivePeriod.end", "issued"},
+	cpb.ResourceTypeCode_PROCEDURE:          {"performedDateTime", "performedPeriod.start", "performedPeriod.end"},
+}
+
+// FutureTimestampProcessorOptions contains optional parameters used by
+// NewFutureTimestampProcessorWithOptions.
+type FutureTimestampProcessorOptions struct {
+	// Fields checked in resources of every type, as dot separated paths of FHIR
+	// JSON field names (for example "meta.lastUpdated"). If a path traverses a
+	// list, every element is checked.
+	Fields []string
+	// Fields checked in resources of specific types, in addition to Fields.
+	ResourceFields map[cpb.ResourceTypeCode_Value][]string
+}
+
+type futureTimestampProcessor struct {
+	BaseProcessor
+	tolerance time.Duration
+	action    FutureTimestampAction
+	// resourceFields holds the paths of Fields and ResourceFields for each type
+	// with ResourceFields, split into their parts.
+	resourceFields map[cpb.ResourceTypeCode_Value][][]string
+	commonFields   [][]string
+}
+
+// Assert futureTimestampProcessor satisfies the Processor interface.
+var _ Processor = &futureTimestampProcessor{}
+
+// NewFutureTimestampProcessor creates a Processor which checks the
+// meta.lastUpdated of every resource, and the DefaultFutureTimestampFields of
+// some resource types, for date, dateTime and instant values later than the
+// current time plus tolerance, and takes the given action on resources with
+// any. Partial dates are in the future if their start is (so 2999 is, but the
+// current year is not).
+func NewFutureTimestampProcessor(tolerance time.Duration, action FutureTimestampAction) (Processor, error) {
+	return NewFutureTimestampProcessorWithOptions(tolerance, action, &FutureTimestampProcessorOptions{
+		Fields:         []string{"meta.lastUpdated"},
+		ResourceFields: DefaultFutureTimestampFields,
+	})
+}
+
+// NewFutureTimestampProcessorWithOptions is like NewFutureTimestampProcessor,
+// but checks the fields given by opts.
+func NewFutureTimestampProcessorWithOptions(tolerance time.Duration, action FutureTimestampAction, opts *FutureTimestampProcessorOptions) (Processor, error) {
+	switch action {
+	case FutureTimestampFlag, FutureTimestampClamp, FutureTimestampDeadLetter:
+	default:
+		return nil, fmt.Errorf("unknown FutureTimestampAction %d", action)
+	}
+	if opts == nil {
+		opts = &FutureTimestampProcessorOptions{}
+	}
+	splitPaths := func(paths []string) ([][]string, error) {
+		var split [][]string
+		for _, p := range paths {
+			parts := strings.Split(p, ".")
+			for _, part := range parts {
+				if part == "" {
+					return nil, fmt.Errorf("invalid field path %q", p)
+				}
+			}
+			split = append(split, parts)
+		}
+		return split, nil
+	}
+	ftp := &futureTimestampProcessor{
+		tolerance:      tolerance,
+		action:         action,
+		resourceFields: map[cpb.ResourceTypeCode_Value][][]string{},
+	}
+	var err error
+	if ftp.commonFields, err = splitPaths(opts.Fields); err != nil {
+		return nil, err
+	}
+	for resourceType, paths := range opts.ResourceFields {
+		split, err := splitPaths(paths)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", resourceType, err)
+		}
+		ftp.resourceFields[resourceType] = append(append([][]string{}, ftp.commonFields...), split...)
+	}
+	return ftp, nil
+}
+
+func (ftp *futureTimestampProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	fields, ok := ftp.resourceFields[resource.Type()]
+	if !ok {
+		fields = ftp.commonFields
+	}
+	if len(fields) == 0 {
+		return ftp.Output(ctx, resource)
+	}
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	res, err := decodeResourceJSON(rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+
+	now := time.Now()
+	limit := now.Add(ftp.tolerance)
+	var future []string
+	for _, parts := range fields {
+		visitTimestamps(res, parts, parts[0], func(value, path string, set func(string)) {
+			t, err := fhir.ParseFHIRDateTime(value)
+			if err != nil || !t.After(limit) {
+				return
+			}
+			future = append(future, path)
+			if ftp.action == FutureTimestampClamp {
+				set(clampedTimestamp(value, now))
+			}
+		})
+	}
+	if len(future) == 0 {
+		return ftp.Output(ctx, resource)
+	}
+	sort.Strings(future)
+	if err := futureTimestampCounter.Record(ctx, 1, resource.Type().String(), ftp.action.String()); err != nil {
+		return err
+	}
+
+	switch ftp.action {
+	case FutureTimestampDeadLetter:
+		return ftp.DeadLetterResource(ctx, resource, fmt.Errorf("%w: %s", ErrFutureTimestamp, strings.Join(future, ", ")))
+	case FutureTimestampClamp:
+		if err := setResourceJSON(resource, res); err != nil {
+			return err
+		}
+	default:
+		log.Warningf("%s resource from %s has timestamps in the future: %s", resource.Type(), resource.SourceURL(), strings.Join(future, ", "))
+		SetResourceAttribute(resource, FutureTimestampAttribute, strings.Join(future, ","))
+	}
+	return ftp.Output(ctx, resource)
+}
+
+// visitTimestamps calls f for each string value at the given path of fields
+// within v, with the value's full path (including list indices), and a
+// function which replaces the value.
+func visitTimestamps(v any, parts []string, path string, f func(value, path string, set func(string))) {
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return
+	}
+	key := parts[0]
+	child, ok := obj[key]
+	if !ok {
+		return
+	}
+	visitChild := func(child any, path string, set func(string)) {
+		if len(parts) == 1 {
+			if value, ok := child.(string); ok {
+				f(value, path, set)
+			}
+			return
+		}
+		visitTimestamps(child, parts[1:], path+"."+parts[1], f)
+	}
+	if list, ok := child.([]any); ok {
+		for i := range list {
+			i := i
+			visitChild(list[i], fmt.Sprintf("%s[%d]", path, i), func(value string) { list[i] = value })
+		}
+		return
+	}
+	visitChild(child, path, func(value string) { obj[key] = value })
+}
+
+// clampedTimestamp returns now in the same format as value: a date of the same
+// precision, or an instant.
+func clampedTimestamp(value string, now time.Time) string {
+	switch len(value) {
+	case len("2006"):
+		return now.UTC().Format("2006")
+	case len("2006-01"):
+		return now.UTC().Format("2006-01")
+	case len("2006-01-02"):
+		return now.UTC().Format("2006-01-02")
+	default:
+		return fhir.ToFHIRInstant(now.UTC())
+	}
+}
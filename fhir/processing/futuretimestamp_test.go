@@ -0,0 +1,188 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/fhir"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// futureObservation has a future meta.lastUpdated and effectivePeriod.end, and
+// a past issued.
+const futureObservation = `{
+	"resourceType": "Observation",
+	"id": "1",
+	"meta": {"lastUpdated": "2999-01-01T00:00:00Z"},
+	"status": "final",
+	"code": {"text": "c"},
+	"effectivePeriod": {"start": "2020-01-01", "end": "2999-06"},
+	"issued": "2020-01-01T00:00:00.000Z",
+	"valueQuantity": {"value": 1.50}
+}`
+
+// runFutureTimestampProcessor processes resourceJSON with the given processor,
+// returning the written resource (if any) and the dead letter reason (if any).
+func runFutureTimestampProcessor(t *testing.T, p processing.Processor, resourceType cpb.ResourceTypeCode_Value, resourceJSON string) (processing.ResourceWrapper, error) {
+	t.Helper()
+	ts := &processing.TestSink{}
+	var reason error
+	pipeline, err := processing.NewPipelineWithOptions([]processing.Processor{p}, []processing.Sink{ts}, &processing.PipelineOptions{
+		DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, r error) error {
+			reason = r
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+	}
+	if err := pipeline.Process(context.Background(), resourceType, "", []byte(resourceJSON)); err != nil {
+		t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+	}
+	if len(ts.WrittenResources) == 0 {
+		return nil, reason
+	}
+	return ts.WrittenResources[0], reason
+}
+
+func TestFutureTimestampProcessor_Flag(t *testing.T) {
+	p, err := processing.NewFutureTimestampProcessor(time.Hour, processing.FutureTimestampFlag)
+	if err != nil {
+		t.Fatalf("NewFutureTimestampProcessor() returned unexpected error: %v", err)
+	}
+	written, _ := runFutureTimestampProcessor(t, p, cpb.ResourceTypeCode_OBSERVATION, futureObservation)
+	if written == nil {
+		t.Fatal("flagged resource was not written")
+	}
+	got, _ := processing.ResourceAttribute(written, processing.FutureTimestampAttribute)
+	if want := "effectivePeriod.end,meta.lastUpdated"; got != want {
+		t.Errorf("unexpected %s attribute. got: %q, want: %q", processing.FutureTimestampAttribute, got, want)
+	}
+}
+
+func TestFutureTimestampProcessor_Clamp(t *testing.T) {
+	p, err := processing.NewFutureTimestampProcessor(time.Hour, processing.FutureTimestampClamp)
+	if err != nil {
+		t.Fatalf("NewFutureTimestampProcessor() returned unexpected error: %v", err)
+	}
+	start := time.Now()
+	written, _ := runFutureTimestampProcessor(t, p, cpb.ResourceTypeCode_OBSERVATION, futureObservation)
+	if written == nil {
+		t.Fatal("clamped resource was not written")
+	}
+	gotJSON, err := written.JSON()
+	if err != nil {
+		t.Fatalf("JSON() returned unexpected error: %v", err)
+	}
+	var got struct {
+		Meta struct {
+			LastUpdated string `json:"lastUpdated"`
+		} `json:"meta"`
+		EffectivePeriod struct {
+			Start string `json:"start"`
+			End   string `json:"end"`
+		} `json:"effectivePeriod"`
+		Issued        string `json:"issued"`
+		ValueQuantity struct {
+			Value json.Number `json:"value"`
+		} `json:"valueQuantity"`
+	}
+	if err := json.Unmarshal(gotJSON, &got); err != nil {
+		t.Fatalf("failed to unmarshal clamped resource: %v", err)
+	}
+	lastUpdated, err := fhir.ParseFHIRInstant(got.Meta.LastUpdated)
+	if err != nil {
+		t.Fatalf("clamped meta.lastUpdated %q is not an instant: %v", got.Meta.LastUpdated, err)
+	}
+	if lastUpdated.Before(start.Truncate(time.Millisecond)) || lastUpdated.After(time.Now()) {
+		t.Errorf("meta.lastUpdated was not clamped to the current time. got: %s", got.Meta.LastUpdated)
+	}
+	// Partial dates are clamped at the same precision. This may flake if run at
+	// the very end of a month.
+	if want := time.Now().UTC().Format("2006-01"); got.EffectivePeriod.End != want {
+		t.Errorf("unexpected clamped effectivePeriod.end. got: %q, want: %q", got.EffectivePeriod.End, want)
+	}
+	if got.EffectivePeriod.Start != "2020-01-01" || got.Issued != "2020-01-01T00:00:00.000Z" || got.ValueQuantity.Value != "1.50" {
+		t.Errorf("unexpected changes to other fields: %s", gotJSON)
+	}
+}
+
+func TestFutureTimestampProcessor_DeadLetter(t *testing.T) {
+	p, err := processing.NewFutureTimestampProcessor(time.Hour, processing.FutureTimestampDeadLetter)
+	if err != nil {
+		t.Fatalf("NewFutureTimestampProcessor() returned unexpected error: %v", err)
+	}
+	written, reason := runFutureTimestampProcessor(t, p, cpb.ResourceTypeCode_OBSERVATION, futureObservation)
+	if written != nil {
+		t.Error("resource with future timestamps was written")
+	}
+	if !errors.Is(reason, processing.ErrFutureTimestamp) {
+		t.Errorf("unexpected dead letter reason. got: %v, want: %v", reason, processing.ErrFutureTimestamp)
+	}
+}
+
+func TestFutureTimestampProcessor_CustomFields(t *testing.T) {
+	opts := &processing.FutureTimestampProcessorOptions{
+		ResourceFields: map[cpb.ResourceTypeCode_Value][]string{cpb.ResourceTypeCode_PATIENT: {"birthDate", "name.period.end"}},
+	}
+	p, err := processing.NewFutureTimestampProcessorWithOptions(0, processing.FutureTimestampFlag, opts)
+	if err != nil {
+		t.Fatalf("NewFutureTimestampProcessorWithOptions() returned unexpected error: %v", err)
+	}
+	// The tolerance allows timestamps slightly in the future.
+	soon := fhir.ToFHIRInstant(time.Now().Add(time.Hour))
+	cases := []struct {
+		name string
+		json string
+		want string
+	}{
+		{
+			name: "Future",
+			json: `{"resourceType":"Patient","id":"1","meta":{"lastUpdated":"2999-01-01T00:00:00Z"},"birthDate":"2999","name":[{"period":{"end":"2000"}},{"period":{"end":"` + soon + `"}}]}`,
+			want: "birthDate,name[1].period.end",
+		},
+		{
+			name: "Past",
+			json: `{"resourceType":"Patient","id":"1","birthDate":"2000-01-01","name":[{"period":{"end":"2000"}}]}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			written, _ := runFutureTimestampProcessor(t, p, cpb.ResourceTypeCode_PATIENT, tc.json)
+			if written == nil {
+				t.Fatal("resource was not written")
+			}
+			if got, _ := processing.ResourceAttribute(written, processing.FutureTimestampAttribute); got != tc.want {
+				t.Errorf("unexpected %s attribute. got: %q, want: %q", processing.FutureTimestampAttribute, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewFutureTimestampProcessor_Invalid(t *testing.T) {
+	if _, err := processing.NewFutureTimestampProcessor(0, processing.FutureTimestampAction(99)); err == nil {
+		t.Error("NewFutureTimestampProcessor() with an unknown action succeeded, want error")
+	}
+	if _, err := processing.NewFutureTimestampProcessorWithOptions(0, processing.FutureTimestampFlag, &processing.FutureTimestampProcessorOptions{Fields: []string{"meta..lastUpdated"}}); err == nil {
+		t.Error("NewFutureTimestampProcessorWithOptions() with an invalid path succeeded, want error")
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+)
+
+var idempotentSinkSkippedCounter *metrics.Counter = metrics.NewCounter("idempotent-sink-skipped-counter", "Count of FHIR Resources not written because an identical resource was already written by a previous run. The counter is tagged by the FHIR Resource type ex) OBSERVATION.", "1", aggregation.Count, "FHIRResourceType")
+
+// SeenStore records the resources which an IdempotentSink has successfully
+// written, so that they can be skipped by later runs. Keys combine the type,
+// id and content hash of a resource. Implementations must be safe for
+// concurrent use. If an implementation is also an io.Closer, it is closed
+// when the IdempotentSink is finalized.
+type SeenStore interface {
+	// Seen returns true if key has been recorded.
+	Seen(ctx context.Context, key string) (bool, error)
+	// Record records that the resource with key has been written.
+	Record(ctx context.Context, key string) error
+}
+
+type inMemorySeenStore struct {
+	mu   sync.Mutex
+	seen map[string]bool
+}
+
+func (imss *inMemorySeenStore) Seen(ctx context.Context, key string) (bool, error) {
+	imss.mu.Lock()
+	defer imss.mu.Unlock()
+	return imss.seen[key], nil
+}
+
+func (imss *inMemorySeenStore) Record(ctx context.Context, key string) error {
+	imss.mu.Lock()
+	defer imss.mu.Unlock()
+	imss.seen[key] = true
+	return nil
+}
+
+// NewInMemorySeenStore returns a SeenStore which does not persist keys
+// anywhere, for skipping resources written earlier in the same process.
+func NewInMemorySeenStore() SeenStore {
+	return &inMemorySeenStore{seen: map[string]bool{}}
+}
+
+type localFileSeenStore struct {
+	mu   sync.Mutex
+	seen map[string]bool
+	file *os.File
+}
+
+func (lfss *localFileSeenStore) Seen(ctx context.Context, key string) (bool, error) {
+	lfss.mu.Lock()
+	defer lfss.mu.Unlock()
+	return lfss.seen[key], nil
+}
+
+func (lfss *localFileSeenStore) Record(ctx context.Context, key string) error {
+	lfss.mu.Lock()
+	defer lfss.mu.Unlock()
+	if lfss.seen[key] {
+		return nil
+	}
+	// Each key is written as it is recorded, so that the keys recorded before a
+	// crash are not lost.
+	if _, err := lfss.file.WriteString(key + "\n"); err != nil {
+		return fmt.Errorf("failed to record written resource in %s: %w", lfss.file.Name(), err)
+	}
+	lfss.seen[key] = true
+	return nil
+}
+
+func (lfss *localFileSeenStore) Close() error {
+	return lfss.file.Close()
+}
+
+// NewLocalFileSeenStore returns a SeenStore which persists keys to a local
+// file at the given path, one per line. Keys recorded by previous runs are
+// loaded from the file if it exists, and new keys are appended to it.
+func NewLocalFileSeenStore(path string) (SeenStore, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open seen store %s: %w", path, err)
+	}
+	seen := map[string]bool{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if key := s.Text(); key != "" {
+			seen[key] = true
+		}
+	}
+	if err := s.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read seen store %s: %w", path, err)
+	}
+	return &localFileSeenStore{seen: seen, file: f}, nil
+}
+
+type idempotentSink struct {
+	inner Sink
+	seen  SeenStore
+}
+
+// Assert idempotentSink satisfies the Sink interface.
+var _ Sink = &idempotentSink{}
+
+// NewIdempotentSink wraps the inner Sink so that resources which it has
+// already successfully written (as recorded in seen) are skipped, making a
+// pipeline safe to re-run after a partial failure without writing everything
+// again. Resources are identified by their type, id and content hash: the
+// ContentHashAttribute if it is set (see NewContentHashProcessor), or
+// otherwise the ResourceHash of their JSON. Resources without an id are always
+// written. A resource is recorded in seen once the inner Write returns
+// without error; note that for sinks which buffer resources, this may be
+// before the resource is actually stored. If seen is nil, an in-memory
+// SeenStore is used.
+func NewIdempotentSink(inner Sink, seen SeenStore) Sink {
+	if seen == nil {
+		seen = NewInMemorySeenStore()
+	}
+	return &idempotentSink{inner: inner, seen: seen}
+}
+
+// Write is Sink.Write. It passes the resource on to the wrapped Sink, unless it
+// has already been written.
+func (is *idempotentSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	key, err := idempotencyKey(resource)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return is.inner.Write(ctx, resource)
+	}
+	seen, err := is.seen.Seen(ctx, key)
+	if err != nil {
+		return fmt.Errorf("failed to check whether %s was already written: %w", key, err)
+	}
+	if seen {
+		return idempotentSinkSkippedCounter.Record(ctx, 1, resource.Type().String())
+	}
+	if err := is.inner.Write(ctx, resource); err != nil {
+		return err
+	}
+	if err := is.seen.Record(ctx, key); err != nil {
+		return fmt.Errorf("failed to record that %s was written: %w", key, err)
+	}
+	return nil
+}
+
+// Finalize is Sink.Finalize. It finalizes the wrapped Sink, and closes the
+// SeenStore if it is an io.Closer.
+func (is *idempotentSink) Finalize(ctx context.Context) error {
+	err := is.inner.Finalize(ctx)
+	if c, ok := is.seen.(io.Closer); ok {
+		err = errors.Join(err, c.Close())
+	}
+	return err
+}
+
+// idempotencyKey returns the SeenStore key for the resource, or an empty
+// string if it has no id.
+func idempotencyKey(resource ResourceWrapper) (string, error) {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return "", err
+	}
+	var res idJSON
+	if err := json.Unmarshal(rawJSON, &res); err != nil {
+		return "", fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	if res.ID == "" {
+		return "", nil
+	}
+	hash, ok := ResourceAttribute(resource, ContentHashAttribute)
+	if !ok {
+		hash = ResourceHash(rawJSON)
+	}
+	return fmt.Sprintf("%s/%s@%s", resource.Type(), res.ID, hash), nil
+}
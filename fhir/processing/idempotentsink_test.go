@@ -0,0 +1,121 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// failingSink is a TestSink which fails to write resources with the given id,
+// if it is non-empty.
+type failingSink struct {
+	processing.TestSink
+	failID string
+}
+
+var errFailingSink = errors.New("failing sink")
+
+func (fs *failingSink) Write(ctx context.Context, resource processing.ResourceWrapper) error {
+	id, err := patientID(resource)
+	if err != nil {
+		return err
+	}
+	if fs.failID != "" && id == fs.failID {
+		return errFailingSink
+	}
+	return fs.TestSink.Write(ctx, resource)
+}
+
+func TestIdempotentSink(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "seen.txt")
+
+	// run writes the resources through an IdempotentSink, returning the ids of
+	// the resources written to the inner sink.
+	run := func(failID string, resources ...string) []string {
+		t.Helper()
+		seen, err := processing.NewLocalFileSeenStore(path)
+		if err != nil {
+			t.Fatalf("NewLocalFileSeenStore() returned unexpected error: %v", err)
+		}
+		inner := &failingSink{failID: failID}
+		p, err := processing.NewPipeline([]processing.Processor{processing.NewContentHashProcessor()}, []processing.Sink{processing.NewIdempotentSink(inner, seen)})
+		if err != nil {
+			t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+		}
+		for _, r := range resources {
+			err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "", []byte(r))
+			if err != nil && !errors.Is(err, errFailingSink) {
+				t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+			}
+		}
+		if err := p.Finalize(ctx); err != nil {
+			t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+		}
+		var ids []string
+		for _, r := range inner.WrittenResources {
+			id, err := patientID(r)
+			if err != nil {
+				t.Fatalf("failed to read id of written resource: %v", err)
+			}
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	// The first run fails part way through.
+	got := run("2",
+		`{"resourceType":"Patient","id":"1"}`,
+		`{"resourceType":"Patient","id":"2"}`,
+		`{"resourceType":"Patient","id":"3","gender":"male"}`)
+	if diff := cmp.Diff([]string{"1", "3"}, got); diff != "" {
+		t.Errorf("unexpected resources written by the first run (-want +got):\n%s", diff)
+	}
+
+	// The re-run skips resources already written (ignoring changes to
+	// meta.lastUpdated), but writes the failed, changed and id-less resources.
+	got = run("",
+		`{"resourceType":"Patient","id":"1","meta":{"lastUpdated":"2024-01-01T00:00:00Z"}}`,
+		`{"resourceType":"Patient","id":"2"}`,
+		`{"resourceType":"Patient","id":"3","gender":"female"}`,
+		`{"resourceType":"Patient"}`)
+	if diff := cmp.Diff([]string{"2", "3", ""}, got); diff != "" {
+		t.Errorf("unexpected resources written by the second run (-want +got):\n%s", diff)
+	}
+}
+
+// patientID returns the id of the resource, read from its JSON.
+func patientID(resource processing.ResourceWrapper) (string, error) {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rawJSON, &res); err != nil {
+		return "", err
+	}
+	return res.ID, nil
+}
@@ -0,0 +1,192 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+)
+
+// ErrInvalidSystem is passed (wrapped) as the dead letter reason for resources
+// with an identifier or coding system which is not an absolute URI, if
+// SystemNormalizationRules.RejectInvalid is set.
+var ErrInvalidSystem = errors.New("identifier or coding system is not an absolute URI")
+
+var identifierSystemCounter *metrics.Counter = metrics.NewCounter("identifier-system-normalize-counter", "Count of identifier and coding systems rewritten to their canonical form. The counter is tagged by the FHIR Resource type ex) OBSERVATION.", "1", aggregation.Count, "FHIRResourceType")
+
+// systemElements are the JSON properties which hold Identifiers or Codings
+// (either singly or in a list). CodeableConcepts hold their Codings in a
+// "coding" property.
+var systemElements = map[string]bool{
+	"identifier":      true,
+	"valueIdentifier": true,
+	"coding":          true,
+	"valueCoding":     true,
+	// Meta.tag and Meta.security.
+	"tag":      true,
+	"security": true,
+}
+
+// bareOID matches an OID without the urn:oid: prefix.
+var bareOID = regexp.MustCompile(`^[0-2](\.(0|[1-9][0-9]*))+$`)
+
+// SystemNormalizationRules configures how NewIdentifierSystemNormalizeProcessor
+// rewrites identifier and coding systems. The rules are applied in the order
+// of the fields below.
+type SystemNormalizationRules struct {
+	// If true, bare OIDs (such as 2.16.840.1.113883.4.1) are given the urn:oid:
+	// prefix required by FHIR.
+	PrefixBareOIDs bool
+	// If set to "http" or "https", http and https systems are rewritten to use
+	// this scheme. Note that most FHIR defined systems (such as
+	// http://loinc.org) use http.
+	Scheme string
+	// If true, trailing slashes are removed from http and https systems.
+	TrimTrailingSlash bool
+	// Aliases maps systems (after the rules above have been applied) to their
+	// canonical form, for example an OID to the equivalent URI.
+	Aliases map[string]string
+	// If true, resources with a system which is not an absolute URI (after
+	// normalization) are passed to the pipeline's dead letter function.
+	RejectInvalid bool
+}
+
+type identifierSystemProcessor struct {
+	BaseProcessor
+	rules SystemNormalizationRules
+}
+
+// Assert identifierSystemProcessor satisfies the Processor interface.
+var _ Processor = &identifierSystemProcessor{}
+
+// NewIdentifierSystemNormalizeProcessor creates a Processor which rewrites the
+// system of every Identifier and Coding (including those within
+// CodeableConcepts, and meta tags and security labels) anywhere in a resource
+// to a canonical form, according to rules. This allows resources from sources
+// which use inconsistent forms of the same system to be matched.
+//
+// Resources are only modified if a system is changed.
+func NewIdentifierSystemNormalizeProcessor(rules *SystemNormalizationRules) (Processor, error) {
+	if rules == nil {
+		rules = &SystemNormalizationRules{}
+	}
+	if rules.Scheme != "" && rules.Scheme != "http" && rules.Scheme != "https" {
+		return nil, fmt.Errorf("invalid scheme %q, must be http or https", rules.Scheme)
+	}
+	return &identifierSystemProcessor{rules: *rules}, nil
+}
+
+func (isp *identifierSystemProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	if !bytes.Contains(rawJSON, []byte(`"system"`)) {
+		return isp.Output(ctx, resource)
+	}
+	res, err := decodeResourceJSON(rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+
+	var invalid []string
+	changed := isp.walk(res, false, &invalid)
+	if isp.rules.RejectInvalid && len(invalid) > 0 {
+		sort.Strings(invalid)
+		return isp.DeadLetterResource(ctx, resource, fmt.Errorf("%w: %s", ErrInvalidSystem, strings.Join(invalid, ", ")))
+	}
+	if changed == 0 {
+		return isp.Output(ctx, resource)
+	}
+	if err := identifierSystemCounter.Record(ctx, int64(changed), resource.Type().String()); err != nil {
+		return err
+	}
+	if err := setResourceJSON(resource, res); err != nil {
+		return err
+	}
+	return isp.Output(ctx, resource)
+}
+
+// walk normalizes the systems within the given JSON value, returning the number
+// changed. hasSystem is true if v is an Identifier or Coding (or a list of
+// them). Systems which are not absolute URIs are appended to invalid.
+func (isp *identifierSystemProcessor) walk(v any, hasSystem bool, invalid *[]string) int {
+	changed := 0
+	switch t := v.(type) {
+	case map[string]any:
+		if system, ok := t["system"].(string); ok && hasSystem {
+			normalized := isp.normalize(system)
+			if normalized != system {
+				t["system"] = normalized
+				changed++
+			}
+			if !isAbsoluteURI(normalized) {
+				*invalid = append(*invalid, normalized)
+			}
+		}
+		for k, child := range t {
+			changed += isp.walk(child, systemElements[k], invalid)
+		}
+	case []any:
+		for _, child := range t {
+			changed += isp.walk(child, hasSystem, invalid)
+		}
+	}
+	return changed
+}
+
+// normalize returns the canonical form of system.
+func (isp *identifierSystemProcessor) normalize(system string) string {
+	if isp.rules.PrefixBareOIDs && bareOID.MatchString(system) {
+		system = "urn:oid:" + system
+	}
+	if rest, ok := cutHTTPScheme(system); ok {
+		if isp.rules.Scheme != "" {
+			system = isp.rules.Scheme + "://" + rest
+		}
+		if isp.rules.TrimTrailingSlash && !strings.ContainsAny(rest, "?#") {
+			system = strings.TrimRight(system, "/")
+		}
+	}
+	if alias, ok := isp.rules.Aliases[system]; ok {
+		system = alias
+	}
+	return system
+}
+
+// cutHTTPScheme returns system without its http:// or https:// prefix (which is
+// matched case insensitively), and whether it had one.
+func cutHTTPScheme(system string) (string, bool) {
+	for _, prefix := range []string{"http://", "https://"} {
+		if len(system) >= len(prefix) && strings.EqualFold(system[:len(prefix)], prefix) {
+			return system[len(prefix):], true
+		}
+	}
+	return "", false
+}
+
+func isAbsoluteURI(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme != "" && (u.Opaque != "" || u.Host != "")
+}
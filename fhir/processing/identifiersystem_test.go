@@ -0,0 +1,136 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+const identifierSystemInput = `{
+	"resourceType": "Patient",
+	"id": "1",
+	"meta": {"tag": [{"system": "HTTPS://example.com/tags/", "code": "a"}]},
+	"identifier": [
+		{"system": "2.16.840.1.113883.4.1", "value": "123-45-6789"},
+		{"system": "https://example.com/mrn/", "value": "1", "assigner": {"identifier": {"system": "https://example.com/orgs", "value": "o"}}}
+	],
+	"maritalStatus": {"coding": [{"system": "https://terminology.hl7.org/CodeSystem/v3-MaritalStatus", "code": "M"}]},
+	"telecom": [{"system": "phone", "value": "555"}],
+	"multipleBirthDecimal": 1.10
+}`
+
+func TestIdentifierSystemNormalizeProcessor(t *testing.T) {
+	cases := []struct {
+		name  string
+		rules *processing.SystemNormalizationRules
+		want  string
+	}{
+		{
+			name: "AllRules",
+			rules: &processing.SystemNormalizationRules{
+				PrefixBareOIDs:    true,
+				Scheme:            "http",
+				TrimTrailingSlash: true,
+				Aliases:           map[string]string{"urn:oid:2.16.840.1.113883.4.1": "http://hl7.org/fhir/sid/us-ssn"},
+			},
+			want: `{
+				"resourceType": "Patient",
+				"id": "1",
+				"meta": {"tag": [{"system": "http://example.com/tags", "code": "a"}]},
+				"identifier": [
+					{"system": "http://hl7.org/fhir/sid/us-ssn", "value": "123-45-6789"},
+					{"system": "http://example.com/mrn", "value": "1", "assigner": {"identifier": {"system": "http://example.com/orgs", "value": "o"}}}
+				],
+				"maritalStatus": {"coding": [{"system": "http://terminology.hl7.org/CodeSystem/v3-MaritalStatus", "code": "M"}]},
+				"telecom": [{"system": "phone", "value": "555"}],
+				"multipleBirthDecimal": 1.10
+			}`,
+		},
+		{
+			name:  "NoRules",
+			rules: nil,
+			want:  identifierSystemInput,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			isp, err := processing.NewIdentifierSystemNormalizeProcessor(tc.rules)
+			if err != nil {
+				t.Fatalf("NewIdentifierSystemNormalizeProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{isp}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			if err := p.Process(context.Background(), cpb.ResourceTypeCode_PATIENT, "", []byte(identifierSystemInput)); err != nil {
+				t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+			}
+			if len(ts.WrittenResources) != 1 {
+				t.Fatalf("unexpected number of written resources. got: %d, want: 1", len(ts.WrittenResources))
+			}
+			got, err := ts.WrittenResources[0].JSON()
+			if err != nil {
+				t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+			}
+			if diff := cmp.Diff(testhelpers.NormalizeJSON(t, []byte(tc.want)), testhelpers.NormalizeJSON(t, got)); diff != "" {
+				t.Errorf("unexpected output JSON (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestIdentifierSystemNormalizeProcessor_RejectInvalid(t *testing.T) {
+	isp, err := processing.NewIdentifierSystemNormalizeProcessor(&processing.SystemNormalizationRules{RejectInvalid: true})
+	if err != nil {
+		t.Fatalf("NewIdentifierSystemNormalizeProcessor() returned unexpected error: %v", err)
+	}
+	ts := &processing.TestSink{}
+	var deadLetterReasons []error
+	opts := &processing.PipelineOptions{
+		DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+			deadLetterReasons = append(deadLetterReasons, reason)
+			return nil
+		},
+	}
+	p, err := processing.NewPipelineWithOptions([]processing.Processor{isp}, []processing.Sink{ts}, opts)
+	if err != nil {
+		t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+	}
+	// The bare OID is not an absolute URI, as PrefixBareOIDs is not set.
+	if err := p.Process(context.Background(), cpb.ResourceTypeCode_PATIENT, "", []byte(identifierSystemInput)); err != nil {
+		t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+	}
+	if len(ts.WrittenResources) != 0 {
+		t.Errorf("unexpected number of written resources. got: %d, want: 0", len(ts.WrittenResources))
+	}
+	if len(deadLetterReasons) != 1 || !errors.Is(deadLetterReasons[0], processing.ErrInvalidSystem) {
+		t.Errorf("unexpected dead letter reasons. got: %v, want: [%v]", deadLetterReasons, processing.ErrInvalidSystem)
+	}
+}
+
+func TestNewIdentifierSystemNormalizeProcessor_InvalidScheme(t *testing.T) {
+	if _, err := processing.NewIdentifierSystemNormalizeProcessor(&processing.SystemNormalizationRules{Scheme: "ftp"}); err == nil {
+		t.Error("NewIdentifierSystemNormalizeProcessor() succeeded with an invalid scheme, want error")
+	}
+}
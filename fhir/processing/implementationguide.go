@@ -0,0 +1,519 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// ErrNonconformantImplementationGuide is passed (wrapped) as the dead letter
+// reason for resources which do not conform to the profile of an
+// implementation guide for their type.
+var ErrNonconformantImplementationGuide = errors.New("resource does not conform to the implementation guide")
+
+var implementationGuideCounter *metrics.Counter = metrics.NewCounter("implementation-guide-counter", "Count of FHIR Resources which did not conform to the implementation guide. The counter is tagged by the FHIR Resource type ex) EXPLANATION_OF_BENEFIT.", "1", aggregation.Count, "FHIRResourceType")
+
+// ImplementationGuidePackage holds the resource profiles and ValueSets of a
+// FHIR implementation guide package, loaded with
+// LoadImplementationGuidePackage.
+type ImplementationGuidePackage struct {
+	// Name and Version are the name and version of the package, from its
+	// package.json, for example hl7.fhir.us.carin-bb and 2.0.0.
+	Name    string
+	Version string
+
+	// profiles holds the resource profiles in the package, keyed by URL.
+	profiles map[string]*igProfile
+	// valueSets holds the codes of the ValueSets in the package whose codes
+	// could be enumerated, keyed by URL.
+	valueSets map[string]valueSetCodes
+}
+
+// igProfile is a resource profile in an implementation guide package.
+type igProfile struct {
+	def          *profileDefinition
+	resourceType cpb.ResourceTypeCode_Value
+	version      string
+	abstract     bool
+}
+
+// valueSetCodes holds the codes in a ValueSet, keyed by code system.
+type valueSetCodes map[string]map[string]bool
+
+// contains returns true if the code from the given code system is in the
+// ValueSet. If system is empty, the code may be from any of its code systems.
+func (vsc valueSetCodes) contains(system, code string) bool {
+	if system != "" {
+		return vsc[system][code]
+	}
+	for _, codes := range vsc {
+		if codes[code] {
+			return true
+		}
+	}
+	return false
+}
+
+// igResourceHeader holds the fields used to identify the resources in an
+// implementation guide package.
+type igResourceHeader struct {
+	ResourceType string `json:"resourceType"`
+	URL          string `json:"url"`
+	Version      string `json:"version"`
+	Kind         string `json:"kind"`
+	Derivation   string `json:"derivation"`
+	Type         string `json:"type"`
+	Abstract     bool   `json:"abstract"`
+}
+
+// LoadImplementationGuidePackage loads a FHIR implementation guide package in
+// the NPM style .tgz format, as published for each version of an
+// implementation guide (for example, the package.tgz of CARIN Blue Button
+// 2.0.0). The StructureDefinitions which profile resources, and the ValueSets
+// and CodeSystems, are loaded from the package directory; examples and other
+// files are ignored.
+func LoadImplementationGuidePackage(r io.Reader) (*ImplementationGuidePackage, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read implementation guide package: %w", err)
+	}
+	defer zr.Close()
+
+	ig := &ImplementationGuidePackage{profiles: map[string]*igProfile{}, valueSets: map[string]valueSetCodes{}}
+	var valueSets []valueSet
+	codeSystems := map[string][]string{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read implementation guide package: %w", err)
+		}
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		dir, file := path.Split(name)
+		if hdr.Typeflag != tar.TypeReg || dir != "package/" || !strings.HasSuffix(file, ".json") || strings.HasPrefix(file, ".") {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s from implementation guide package: %w", name, err)
+		}
+		if file == "package.json" {
+			var manifest struct {
+				Name    string `json:"name"`
+				Version string `json:"version"`
+			}
+			if err := json.Unmarshal(data, &manifest); err != nil {
+				return nil, fmt.Errorf("failed to parse %s from implementation guide package: %w", name, err)
+			}
+			ig.Name, ig.Version = manifest.Name, manifest.Version
+			continue
+		}
+		if err := ig.addResource(data, &valueSets, codeSystems); err != nil {
+			return nil, fmt.Errorf("failed to load %s from implementation guide package: %w", name, err)
+		}
+	}
+	if ig.Name == "" {
+		return nil, errors.New("implementation guide package has no package/package.json")
+	}
+	for _, vs := range valueSets {
+		if codes, ok := vs.codes(codeSystems); ok {
+			ig.valueSets[vs.URL] = codes
+		}
+	}
+	return ig, nil
+}
+
+// addResource adds a resource from the package to ig. ValueSets and the codes
+// of CodeSystems are collected to be resolved once the whole package has been
+// read.
+func (ig *ImplementationGuidePackage) addResource(data []byte, valueSets *[]valueSet, codeSystems map[string][]string) error {
+	var hdr igResourceHeader
+	if err := json.Unmarshal(data, &hdr); err != nil {
+		return err
+	}
+	switch hdr.ResourceType {
+	case "StructureDefinition":
+		if hdr.Kind != "resource" || hdr.Derivation != "constraint" {
+			return nil
+		}
+		resourceType, err := bulkfhir.ResourceTypeCodeFromName(hdr.Type)
+		if err != nil {
+			return err
+		}
+		def, err := parseProfileDefinition(data)
+		if err != nil {
+			return err
+		}
+		ig.profiles[def.url] = &igProfile{def: def, resourceType: resourceType, version: hdr.Version, abstract: hdr.Abstract}
+	case "ValueSet":
+		var vs valueSet
+		if err := json.Unmarshal(data, &vs); err != nil {
+			return err
+		}
+		*valueSets = append(*valueSets, vs)
+	case "CodeSystem":
+		var cs struct {
+			Content string    `json:"content"`
+			Concept []concept `json:"concept"`
+		}
+		if err := json.Unmarshal(data, &cs); err != nil {
+			return err
+		}
+		if cs.Content == "complete" {
+			codeSystems[hdr.URL] = conceptCodes(cs.Concept)
+		}
+	}
+	return nil
+}
+
+// concept is a concept of a CodeSystem or ValueSet, or a code in a ValueSet
+// expansion, which may have nested concepts.
+type concept struct {
+	Code     string    `json:"code"`
+	Concept  []concept `json:"concept"`
+	System   string    `json:"system"`
+	Contains []concept `json:"contains"`
+}
+
+// conceptCodes returns the codes of concepts, including nested concepts.
+func conceptCodes(concepts []concept) []string {
+	var codes []string
+	for _, c := range concepts {
+		if c.Code != "" {
+			codes = append(codes, c.Code)
+		}
+		codes = append(codes, conceptCodes(c.Concept)...)
+	}
+	return codes
+}
+
+// valueSet holds the fields used from a ValueSet.
+type valueSet struct {
+	URL     string `json:"url"`
+	Compose *struct {
+		Include []valueSetInclude `json:"include"`
+		Exclude []valueSetInclude `json:"exclude"`
+	} `json:"compose"`
+	Expansion *struct {
+		Contains []concept `json:"contains"`
+	} `json:"expansion"`
+}
+
+// valueSetInclude holds the fields used from ValueSet.compose.include and
+// exclude.
+type valueSetInclude struct {
+	System   string            `json:"system"`
+	Concept  []concept         `json:"concept"`
+	Filter   []json.RawMessage `json:"filter"`
+	ValueSet []string          `json:"valueSet"`
+}
+
+// codes returns the codes in the ValueSet, from its expansion if it has one,
+// or else its composition. It returns false if the codes cannot be enumerated,
+// because the composition uses filters, other ValueSets, or code systems which
+// are not in the package.
+func (vs valueSet) codes(codeSystems map[string][]string) (valueSetCodes, bool) {
+	codes := valueSetCodes{}
+	add := func(system, code string) {
+		if codes[system] == nil {
+			codes[system] = map[string]bool{}
+		}
+		codes[system][code] = true
+	}
+	if vs.Expansion != nil {
+		var addContains func([]concept)
+		addContains = func(contains []concept) {
+			for _, c := range contains {
+				if c.Code != "" {
+					add(c.System, c.Code)
+				}
+				addContains(c.Contains)
+			}
+		}
+		addContains(vs.Expansion.Contains)
+		return codes, true
+	}
+	if vs.Compose == nil {
+		return nil, false
+	}
+	for _, inc := range vs.Compose.Include {
+		if inc.System == "" || len(inc.Filter) > 0 || len(inc.ValueSet) > 0 {
+			return nil, false
+		}
+		if len(inc.Concept) > 0 {
+			for _, code := range conceptCodes(inc.Concept) {
+				add(inc.System, code)
+			}
+			continue
+		}
+		all, ok := codeSystems[inc.System]
+		if !ok {
+			return nil, false
+		}
+		for _, code := range all {
+			add(inc.System, code)
+		}
+	}
+	for _, exc := range vs.Compose.Exclude {
+		if exc.System == "" || len(exc.Filter) > 0 || len(exc.ValueSet) > 0 || len(exc.Concept) == 0 {
+			return nil, false
+		}
+		for _, code := range conceptCodes(exc.Concept) {
+			delete(codes[exc.System], code)
+		}
+	}
+	return codes, true
+}
+
+// ImplementationGuideProcessorOptions contains optional parameters used by
+// NewImplementationGuideProcessorWithOptions.
+type ImplementationGuideProcessorOptions struct {
+	// Profiles maps resource types to the URL of the profile in the
+	// implementation guide which resources of the type are validated against if
+	// they do not declare one of the guide's profiles in meta.profile. This is
+	// needed for types with several profiles in the guide, such as the
+	// ExplanationOfBenefit profiles of CARIN Blue Button.
+	Profiles map[cpb.ResourceTypeCode_Value]string
+}
+
+type implementationGuideProcessor struct {
+	BaseProcessor
+	ig *ImplementationGuidePackage
+	// defaults holds the profiles which resources of each type are validated
+	// against if they do not declare any of the guide's profiles.
+	defaults map[cpb.ResourceTypeCode_Value][]*igProfile
+}
+
+// Assert implementationGuideProcessor satisfies the Processor interface.
+var _ Processor = &implementationGuideProcessor{}
+
+// NewImplementationGuideProcessor creates a Processor which validates
+// resources against the profile for their type in the given implementation
+// guide package, and dead letters those which do not conform with
+// ErrNonconformantImplementationGuide, describing each issue found.
+//
+// Resources which declare profiles from the guide in meta.profile are
+// validated against each of them, and a declared version (url|version) must
+// match the guide's version of the profile. Resources which declare none of
+// the guide's profiles are validated against the guide's (non-abstract)
+// profile for their type; if the guide has several, which to use must be set
+// with NewImplementationGuideProcessorWithOptions, or else such resources are
+// dead lettered. Resources of types the guide does not profile are passed
+// through.
+//
+// Validation is as for NewProfileDeclarationProcessorWithOptions, and also
+// checks the required terminology bindings to ValueSets in the package whose
+// codes can be enumerated. Bindings to other ValueSets (such as those of the
+// base FHIR specification) are not checked.
+func NewImplementationGuideProcessor(igPackage *ImplementationGuidePackage) (Processor, error) {
+	return NewImplementationGuideProcessorWithOptions(igPackage, nil)
+}
+
+// NewImplementationGuideProcessorWithOptions is like
+// NewImplementationGuideProcessor, but with the given options. opts may be
+// nil.
+func NewImplementationGuideProcessorWithOptions(igPackage *ImplementationGuidePackage, opts *ImplementationGuideProcessorOptions) (Processor, error) {
+	if opts == nil {
+		opts = &ImplementationGuideProcessorOptions{}
+	}
+	if igPackage == nil {
+		return nil, errors.New("no implementation guide package given")
+	}
+	igp := &implementationGuideProcessor{ig: igPackage, defaults: map[cpb.ResourceTypeCode_Value][]*igProfile{}}
+	for _, p := range igPackage.profiles {
+		if !p.abstract {
+			igp.defaults[p.resourceType] = append(igp.defaults[p.resourceType], p)
+		}
+	}
+	for _, profiles := range igp.defaults {
+		sort.Slice(profiles, func(i, j int) bool { return profiles[i].def.url < profiles[j].def.url })
+	}
+	for resourceType, url := range opts.Profiles {
+		p, ok := igPackage.profiles[url]
+		if !ok {
+			return nil, fmt.Errorf("implementation guide %s has no profile %s", igPackage.Name, url)
+		}
+		if p.resourceType != resourceType {
+			return nil, fmt.Errorf("profile %s for %s is a profile of %s", url, resourceType, p.resourceType)
+		}
+		igp.defaults[resourceType] = []*igProfile{p}
+	}
+	return igp, nil
+}
+
+func (igp *implementationGuideProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var declared declaredProfiles
+	if err := json.Unmarshal(rawJSON, &declared); err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+
+	var profiles []*igProfile
+	var issues []string
+	for _, d := range declared.Meta.Profile {
+		url, version, _ := strings.Cut(d, "|")
+		p, ok := igp.ig.profiles[url]
+		if !ok {
+			continue
+		}
+		switch {
+		case p.resourceType != resource.Type():
+			issues = append(issues, fmt.Sprintf("declares profile %s, which is a profile of %s", url, p.resourceType))
+		case version != "" && p.version != "" && version != p.version:
+			issues = append(issues, fmt.Sprintf("declares version %s of profile %s, but the implementation guide has version %s", version, url, p.version))
+		default:
+			profiles = append(profiles, p)
+		}
+	}
+	if len(profiles) == 0 && len(issues) == 0 {
+		defaults := igp.defaults[resource.Type()]
+		switch len(defaults) {
+		case 0:
+			return igp.Output(ctx, resource)
+		case 1:
+			profiles = defaults
+		default:
+			urls := make([]string, 0, len(defaults))
+			for _, p := range defaults {
+				urls = append(urls, p.def.url)
+			}
+			issues = append(issues, fmt.Sprintf("declares none of the implementation guide's %s profiles: %s", resource.Type(), strings.Join(urls, ", ")))
+		}
+	}
+
+	if len(profiles) > 0 {
+		parsed, err := decodeResourceJSON(rawJSON)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+		}
+		for _, p := range profiles {
+			for _, v := range p.def.validate(parsed) {
+				issues = append(issues, fmt.Sprintf("%s (%s)", v, p.def.url))
+			}
+			for _, v := range p.def.validateBindings(parsed, igp.ig.valueSets) {
+				issues = append(issues, fmt.Sprintf("%s (%s)", v, p.def.url))
+			}
+		}
+	}
+	if len(issues) == 0 {
+		return igp.Output(ctx, resource)
+	}
+	if err := implementationGuideCounter.Record(ctx, 1, resource.Type().String()); err != nil {
+		return err
+	}
+	return igp.DeadLetterResource(ctx, resource, fmt.Errorf("%w %s#%s: %s", ErrNonconformantImplementationGuide, igp.ig.Name, igp.ig.Version, strings.Join(issues, "; ")))
+}
+
+// validateBindings returns a description of each value in the parsed JSON
+// resource which is not in the ValueSet of a required binding of the profile.
+// Bindings to ValueSets which are not in valueSets are not checked.
+func (pd *profileDefinition) validateBindings(resource map[string]any, valueSets map[string]valueSetCodes) []string {
+	var violations []string
+	for _, pb := range pd.bindings {
+		codes, ok := valueSets[pb.valueSet]
+		if !ok {
+			continue
+		}
+		for _, v := range elementPathValues(resource, pb.names) {
+			if code, ok := codedValue(v, codes); !ok {
+				violations = append(violations, fmt.Sprintf("%s %s is not in the required ValueSet %s", pb.path, code, pb.valueSet))
+			}
+		}
+	}
+	sort.Strings(violations)
+	return violations
+}
+
+// elementPathValues returns the values of the element with the given path of
+// names within the parsed JSON resource, across every occurrence of its
+// parent elements.
+func elementPathValues(resource map[string]any, names []string) []any {
+	parents := []map[string]any{resource}
+	for _, name := range names[:len(names)-1] {
+		var next []map[string]any
+		for _, p := range parents {
+			for _, v := range elementValues(p, name) {
+				if m, ok := v.(map[string]any); ok {
+					next = append(next, m)
+				}
+			}
+		}
+		parents = next
+	}
+	var values []any
+	for _, p := range parents {
+		values = append(values, elementValues(p, names[len(names)-1])...)
+	}
+	return values
+}
+
+// codedValue checks a code, Coding or CodeableConcept JSON value against the
+// codes of a ValueSet, returning a description of the value and whether it
+// is in the ValueSet. A CodeableConcept is in the ValueSet if any of its
+// codings are. Values which are not coded (such as a primitive's extensions)
+// are reported as being in the ValueSet.
+func codedValue(v any, codes valueSetCodes) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return fmt.Sprintf("%q", v), codes.contains("", v)
+	case map[string]any:
+		if codings, ok := v["coding"].([]any); ok || v["text"] != nil {
+			var described []string
+			for _, c := range codings {
+				coding, _ := c.(map[string]any)
+				d, ok := codedValue(coding, codes)
+				if ok {
+					return "", true
+				}
+				described = append(described, d)
+			}
+			if len(described) == 0 {
+				return "(with no codings)", false
+			}
+			return strings.Join(described, ", "), false
+		}
+		code, ok := v["code"].(string)
+		if !ok {
+			return "", true
+		}
+		system, _ := v["system"].(string)
+		if system == "" {
+			return fmt.Sprintf("%q", code), codes.contains("", code)
+		}
+		return fmt.Sprintf("%s|%s", system, code), codes.contains(system, code)
+	}
+	return "", true
+}
@@ -0,0 +1,289 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// testIGFiles are the files of a small implementation guide package, with a
+// Patient profile requiring an identifier type from a ValueSet in the
+// package, and two ExplanationOfBenefit profiles (and an abstract one).
+var testIGFiles = map[string]string{
+	"package/package.json": `{"name":"example.fhir.test-ig","version":"2.0.0"}`,
+	"package/StructureDefinition-test-patient.json": `{
+		"resourceType": "StructureDefinition",
+		"url": "http://example.com/fhir/StructureDefinition/test-patient",
+		"version": "2.0.0",
+		"kind": "resource",
+		"derivation": "constraint",
+		"type": "Patient",
+		"snapshot": {
+			"element": [
+				{"id": "Patient", "path": "Patient"},
+				{"id": "Patient.identifier", "path": "Patient.identifier", "min": 1, "max": "*"},
+				{"id": "Patient.identifier.type", "path": "Patient.identifier.type", "min": 1, "max": "1", "binding": {"strength": "required", "valueSet": "http://example.com/fhir/ValueSet/test-identifier-type|2.0.0"}},
+				{"id": "Patient.gender", "path": "Patient.gender", "min": 0, "max": "1", "binding": {"strength": "required", "valueSet": "http://hl7.org/fhir/ValueSet/administrative-gender|4.0.1"}}
+			]
+		}
+	}`,
+	"package/StructureDefinition-test-eob.json": `{
+		"resourceType": "StructureDefinition",
+		"url": "http://example.com/fhir/StructureDefinition/test-eob",
+		"version": "2.0.0",
+		"kind": "resource",
+		"derivation": "constraint",
+		"abstract": true,
+		"type": "ExplanationOfBenefit",
+		"differential": {"element": [{"id": "ExplanationOfBenefit", "path": "ExplanationOfBenefit"}]}
+	}`,
+	"package/StructureDefinition-test-eob-inpatient.json": `{
+		"resourceType": "StructureDefinition",
+		"url": "http://example.com/fhir/StructureDefinition/test-eob-inpatient",
+		"version": "2.0.0",
+		"kind": "resource",
+		"derivation": "constraint",
+		"type": "ExplanationOfBenefit",
+		"differential": {"element": [{"id": "ExplanationOfBenefit.billablePeriod", "path": "ExplanationOfBenefit.billablePeriod", "min": 1}]}
+	}`,
+	"package/StructureDefinition-test-eob-pharmacy.json": `{
+		"resourceType": "StructureDefinition",
+		"url": "http://example.com/fhir/StructureDefinition/test-eob-pharmacy",
+		"version": "2.0.0",
+		"kind": "resource",
+		"derivation": "constraint",
+		"type": "ExplanationOfBenefit",
+		"differential": {"element": [{"id": "ExplanationOfBenefit.item", "path": "ExplanationOfBenefit.item", "min": 1}]}
+	}`,
+	"package/StructureDefinition-test-extension.json": `{
+		"resourceType": "StructureDefinition",
+		"url": "http://example.com/fhir/StructureDefinition/test-extension",
+		"kind": "complex-type",
+		"derivation": "constraint",
+		"type": "Extension"
+	}`,
+	"package/ValueSet-test-identifier-type.json": `{
+		"resourceType": "ValueSet",
+		"url": "http://example.com/fhir/ValueSet/test-identifier-type",
+		"compose": {
+			"include": [
+				{"system": "http://example.com/fhir/CodeSystem/test-identifier-type"},
+				{"system": "http://terminology.hl7.org/CodeSystem/v2-0203", "concept": [{"code": "MB"}]}
+			]
+		}
+	}`,
+	"package/CodeSystem-test-identifier-type.json": `{
+		"resourceType": "CodeSystem",
+		"url": "http://example.com/fhir/CodeSystem/test-identifier-type",
+		"content": "complete",
+		"concept": [{"code": "um", "concept": [{"code": "pat"}]}]
+	}`,
+	"package/.index.json": `{"index-version": 1}`,
+	// Examples are not loaded, so this invalid profile is ignored.
+	"package/example/StructureDefinition-invalid.json": `{"resourceType":"StructureDefinition","kind":"resource","derivation":"constraint","type":"NotAResource"}`,
+}
+
+func testIGPackage(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("failed to write package: %v", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("failed to write package: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("failed to write package: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to write package: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestImplementationGuideProcessor(t *testing.T) {
+	ig, err := processing.LoadImplementationGuidePackage(bytes.NewReader(testIGPackage(t, testIGFiles)))
+	if err != nil {
+		t.Fatalf("LoadImplementationGuidePackage() returned unexpected error: %v", err)
+	}
+	if ig.Name != "example.fhir.test-ig" || ig.Version != "2.0.0" {
+		t.Errorf("LoadImplementationGuidePackage() returned unexpected package %s#%s, want example.fhir.test-ig#2.0.0", ig.Name, ig.Version)
+	}
+
+	cases := []struct {
+		name  string
+		opts  *processing.ImplementationGuideProcessorOptions
+		input typedResource
+		// wantErr is true if the resource should be dead lettered.
+		wantErr bool
+	}{
+		{
+			name:  "Conformant",
+			input: typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","gender":"other","identifier":[{"type":{"coding":[{"system":"http://terminology.hl7.org/CodeSystem/v2-0203","code":"MB"}]}},{"type":{"coding":[{"system":"http://example.com/other","code":"x"},{"system":"http://example.com/fhir/CodeSystem/test-identifier-type","code":"pat"}]}}]}`},
+		},
+		{
+			name:    "MissingElement",
+			input:   typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1"}`},
+			wantErr: true,
+		},
+		{
+			name:    "CodeNotInValueSet",
+			input:   typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","identifier":[{"type":{"coding":[{"system":"http://terminology.hl7.org/CodeSystem/v2-0203","code":"MR"}]}}]}`},
+			wantErr: true,
+		},
+		{
+			name:    "TextOnlyNotInValueSet",
+			input:   typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","identifier":[{"type":{"text":"member"}}]}`},
+			wantErr: true,
+		},
+		{
+			name:  "DeclaredProfile",
+			input: typedResource{cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, `{"resourceType":"ExplanationOfBenefit","id":"1","meta":{"profile":["http://example.com/fhir/StructureDefinition/test-eob-pharmacy|2.0.0"]},"item":[{"sequence":1}]}`},
+		},
+		{
+			name:    "DeclaredProfileNonconformant",
+			input:   typedResource{cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, `{"resourceType":"ExplanationOfBenefit","id":"1","meta":{"profile":["http://example.com/fhir/StructureDefinition/test-eob-pharmacy"]},"billablePeriod":{"start":"2020"}}`},
+			wantErr: true,
+		},
+		{
+			name:    "DeclaredOtherVersion",
+			input:   typedResource{cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, `{"resourceType":"ExplanationOfBenefit","id":"1","meta":{"profile":["http://example.com/fhir/StructureDefinition/test-eob-pharmacy|1.0.0"]},"item":[{"sequence":1}]}`},
+			wantErr: true,
+		},
+		{
+			name:    "UndeclaredWithSeveralProfiles",
+			input:   typedResource{cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, `{"resourceType":"ExplanationOfBenefit","id":"1","item":[{"sequence":1}]}`},
+			wantErr: true,
+		},
+		{
+			name:  "UndeclaredWithProfileOption",
+			opts:  &processing.ImplementationGuideProcessorOptions{Profiles: map[cpb.ResourceTypeCode_Value]string{cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT: "http://example.com/fhir/StructureDefinition/test-eob-inpatient"}},
+			input: typedResource{cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, `{"resourceType":"ExplanationOfBenefit","id":"1","billablePeriod":{"start":"2020"}}`},
+		},
+		{
+			name:  "UnprofiledType",
+			input: typedResource{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"c"}}`},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := processing.NewImplementationGuideProcessorWithOptions(ig, tc.opts)
+			if err != nil {
+				t.Fatalf("NewImplementationGuideProcessorWithOptions() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			var reasons []error
+			pipeline, err := processing.NewPipelineWithOptions([]processing.Processor{p}, []processing.Sink{ts}, &processing.PipelineOptions{
+				DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+					reasons = append(reasons, reason)
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+			}
+			ctx := context.Background()
+			if err := pipeline.Process(ctx, tc.input.resourceType, "", []byte(tc.input.json)); err != nil {
+				t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+			}
+			if err := pipeline.Finalize(ctx); err != nil {
+				t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+			}
+
+			if !tc.wantErr {
+				if len(ts.WrittenResources) != 1 || len(reasons) != 0 {
+					t.Errorf("resource was dead lettered, want written. dead letter reasons: %v", reasons)
+				}
+				return
+			}
+			if len(ts.WrittenResources) != 0 || len(reasons) != 1 {
+				t.Fatalf("resource was written, want dead lettered")
+			}
+			if !errors.Is(reasons[0], processing.ErrNonconformantImplementationGuide) {
+				t.Errorf("unexpected dead letter reason. got: %v, want: %v", reasons[0], processing.ErrNonconformantImplementationGuide)
+			}
+		})
+	}
+}
+
+func TestNewImplementationGuideProcessor_Invalid(t *testing.T) {
+	ig, err := processing.LoadImplementationGuidePackage(bytes.NewReader(testIGPackage(t, testIGFiles)))
+	if err != nil {
+		t.Fatalf("LoadImplementationGuidePackage() returned unexpected error: %v", err)
+	}
+	cases := []struct {
+		name     string
+		profiles map[cpb.ResourceTypeCode_Value]string
+	}{
+		{
+			name:     "UnknownProfile",
+			profiles: map[cpb.ResourceTypeCode_Value]string{cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT: "http://example.com/other"},
+		},
+		{
+			name:     "ProfileOfOtherType",
+			profiles: map[cpb.ResourceTypeCode_Value]string{cpb.ResourceTypeCode_PATIENT: "http://example.com/fhir/StructureDefinition/test-eob-inpatient"},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := processing.NewImplementationGuideProcessorWithOptions(ig, &processing.ImplementationGuideProcessorOptions{Profiles: tc.profiles}); err == nil {
+				t.Errorf("NewImplementationGuideProcessorWithOptions() succeeded, want error")
+			}
+		})
+	}
+}
+
+func TestLoadImplementationGuidePackage_Invalid(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "NotGzip",
+			data: []byte("not a package"),
+		},
+		{
+			name: "NoPackageJSON",
+			data: testIGPackage(t, map[string]string{"package/ValueSet-a.json": `{"resourceType":"ValueSet"}`}),
+		},
+		{
+			name: "InvalidProfile",
+			data: testIGPackage(t, map[string]string{
+				"package/package.json":               `{"name":"example.fhir.test-ig","version":"1.0.0"}`,
+				"package/StructureDefinition-a.json": `{"resourceType":"StructureDefinition","kind":"resource","derivation":"constraint","type":"NotAResource"}`,
+			}),
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := processing.LoadImplementationGuidePackage(bytes.NewReader(tc.data)); err == nil {
+				t.Errorf("LoadImplementationGuidePackage() succeeded, want error")
+			}
+		})
+	}
+}
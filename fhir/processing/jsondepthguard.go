@@ -0,0 +1,94 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"fmt"
+)
+
+type jsonDepthGuardProcessor struct {
+	BaseProcessor
+	maxDepth int
+}
+
+// Assert jsonDepthGuardProcessor satisfies the Processor interface.
+var _ Processor = &jsonDepthGuardProcessor{}
+
+// NewJSONDepthGuardProcessor creates a Processor which passes resources whose
+// JSON objects and arrays are nested more than maxDepth deep to the pipeline's
+// dead letter function (with a reason wrapping ErrResourceTooDeep). The
+// resource's top level object has a depth of 1. A maxDepth of zero (or less)
+// is not checked.
+//
+// Unlike NewResourceLimitsProcessor, the depth is found by scanning the raw
+// JSON bytes, without parsing the resource, so that deeply nested resources
+// from untrusted sources cannot cause excessive recursion when converted to
+// protos. This processor must therefore come before any processors which call
+// ResourceWrapper.Proto(). JSON which is otherwise invalid is passed on
+// unchanged, to fail wherever it is parsed.
+func NewJSONDepthGuardProcessor(maxDepth int) Processor {
+	return &jsonDepthGuardProcessor{maxDepth: maxDepth}
+}
+
+func (jdg *jsonDepthGuardProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	if jdg.maxDepth <= 0 {
+		return jdg.Output(ctx, resource)
+	}
+	json, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	if jsonExceedsDepth(json, jdg.maxDepth) {
+		if err := resourceLimitsCounter.Record(ctx, 1, resource.Type().String(), "JSON_DEPTH"); err != nil {
+			return err
+		}
+		return jdg.DeadLetterResource(ctx, resource, fmt.Errorf("%w: JSON nesting limit %d", ErrResourceTooDeep, jdg.maxDepth))
+	}
+	return jdg.Output(ctx, resource)
+}
+
+// jsonExceedsDepth returns whether the objects and arrays in the given JSON are
+// nested more than maxDepth deep. Brackets within strings are ignored. The
+// scan stops as soon as the limit is exceeded.
+func jsonExceedsDepth(json []byte, maxDepth int) bool {
+	depth := 0
+	inString := false
+	for i := 0; i < len(json); i++ {
+		c := json[i]
+		if inString {
+			switch c {
+			case '\\':
+				// Skip the escaped character, which may be a quote.
+				i++
+			case '"':
+				inString = false
+			}
+			continue
+		}
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+			if depth > maxDepth {
+				return true
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestJSONDepthGuardProcessor(t *testing.T) {
+	// Depth 4: resource, code, coding list, coding.
+	observation := `{"resourceType":"Observation","id":"1","status":"final","code":{"coding":[{"system":"s","code":"c"}],"text":"{[{[\"\\"{["}}`
+	deep := `{"resourceType":"Observation","id":"1","extension":` + strings.Repeat(`[{"extension":`, 10000) + `[]` + strings.Repeat(`}]`, 10000) + `}`
+	cases := []struct {
+		name        string
+		json        string
+		maxDepth    int
+		wantWritten bool
+	}{
+		{name: "WithinLimit", json: observation, maxDepth: 4, wantWritten: true},
+		{name: "ExceedsLimit", json: observation, maxDepth: 3},
+		{name: "VeryDeep", json: deep, maxDepth: 100},
+		{name: "NoLimit", json: observation, maxDepth: 0, wantWritten: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := &processing.TestSink{}
+			var reason error
+			pipeline, err := processing.NewPipelineWithOptions([]processing.Processor{processing.NewJSONDepthGuardProcessor(tc.maxDepth)}, []processing.Sink{ts}, &processing.PipelineOptions{
+				DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, r error) error {
+					reason = r
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+			}
+			if err := pipeline.Process(context.Background(), cpb.ResourceTypeCode_OBSERVATION, "", []byte(tc.json)); err != nil {
+				t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+			}
+			if got := len(ts.WrittenResources) == 1; got != tc.wantWritten {
+				t.Errorf("unexpected resource written. got: %v, want: %v", got, tc.wantWritten)
+			}
+			if !tc.wantWritten && !errors.Is(reason, processing.ErrResourceTooDeep) {
+				t.Errorf("unexpected dead letter reason. got: %v, want: %v", reason, processing.ErrResourceTooDeep)
+			}
+		})
+	}
+}
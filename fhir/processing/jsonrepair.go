@@ -0,0 +1,236 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+)
+
+var jsonRepairCounter *metrics.Counter = metrics.NewCounter("json-repair-counter", "Count of repairs made to FHIR Resource JSON which would otherwise be rejected when parsed. The counter is tagged by the FHIR Resource type ex) OBSERVATION and the repair rule ex) NUMERIC_STRINGS.", "1", aggregation.Count, "FHIRResourceType", "Rule")
+
+// JSONRepairRule is a fixup applied by the JSONRepairProcessor to work around
+// a common way in which servers produce invalid FHIR JSON.
+type JSONRepairRule int
+
+const (
+	// RepairNumericStrings replaces strings holding a JSON number with the
+	// number itself, for elements which are always numeric (decimal, integer,
+	// unsignedInt or positiveInt) in R4. These are the value[x] choices of those
+	// types (e.g. valueDecimal), other unambiguously numeric elements listed in
+	// numericElements (e.g. Timing.repeat.period), and the value of a Quantity or
+	// Money (recognised by having a unit, code, comparator or currency, which
+	// the string valued Identifier and ContactPoint do not have). Strings which
+	// are not valid numbers are left unchanged.
+	RepairNumericStrings JSONRepairRule = iota
+	// RepairMissingResourceType adds the resourceType to a resource which does
+	// not have one, using the type it was exported as. Contained resources
+	// without a resourceType are given the type of a Reference to them (i.e. a
+	// Reference with a "#id" reference and a type); contained resources with no
+	// such Reference are left unchanged.
+	RepairMissingResourceType
+)
+
+func (r JSONRepairRule) String() string {
+	switch r {
+	case RepairNumericStrings:
+		return "NUMERIC_STRINGS"
+	case RepairMissingResourceType:
+		return "MISSING_RESOURCE_TYPE"
+	default:
+		return fmt.Sprintf("JSONRepairRule(%d)", int(r))
+	}
+}
+
+// numericElements holds the names of elements other than value[x] which are
+// numeric wherever they are a primitive in R4 (some, such as period, are also
+// the names of complex elements, but those are never strings).
+var numericElements = map[string]bool{
+	"count": true, "countMax": true, "dimensions": true,
+	"duration": true, "durationMax": true, "factor": true, "frequency": true,
+	"frequencyMax": true, "lowerLimit": true, "multipleBirthInteger": true,
+	"numberOfInstances": true, "numberOfSeries": true, "offset": true,
+	"period": true, "periodMax": true, "rank": true, "sequence": true,
+	"total": true, "upperLimit": true,
+}
+
+// numericValueTypes are the value[x] suffixes of the numeric primitive types.
+var numericValueTypes = []string{"Decimal", "Integer", "UnsignedInt", "PositiveInt"}
+
+var jsonNumberREGEX = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+type jsonRepairProcessor struct {
+	BaseProcessor
+	rules []JSONRepairRule
+}
+
+// Assert jsonRepairProcessor satisfies the Processor interface.
+var _ Processor = &jsonRepairProcessor{}
+
+// NewJSONRepairProcessor creates a Processor which repairs resource JSON with
+// each of the given rules (see the documentation of each JSONRepairRule), so
+// that resources from servers which produce slightly invalid FHIR can be
+// parsed. The repairs are made to the raw JSON, so the processor must come
+// before any processor or sink which calls Proto(). Resources which need no
+// repairs are passed through unchanged.
+func NewJSONRepairProcessor(rules []JSONRepairRule) (Processor, error) {
+	for _, r := range rules {
+		switch r {
+		case RepairNumericStrings, RepairMissingResourceType:
+		default:
+			return nil, fmt.Errorf("unknown JSONRepairRule %d", r)
+		}
+	}
+	return &jsonRepairProcessor{rules: rules}, nil
+}
+
+func (jrp *jsonRepairProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	res, err := decodeResourceJSON(rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	repaired := false
+	for _, r := range jrp.rules {
+		n := 0
+		switch r {
+		case RepairNumericStrings:
+			n = repairNumericStrings(res)
+		case RepairMissingResourceType:
+			n, err = repairMissingResourceType(resource, res)
+			if err != nil {
+				return err
+			}
+		}
+		if n == 0 {
+			continue
+		}
+		repaired = true
+		if err := jsonRepairCounter.Record(ctx, int64(n), resource.Type().String(), r.String()); err != nil {
+			return err
+		}
+	}
+	if repaired {
+		if err := setResourceJSON(resource, res); err != nil {
+			return err
+		}
+	}
+	return jrp.Output(ctx, resource)
+}
+
+// repairNumericStrings applies RepairNumericStrings to v, returning the number
+// of strings replaced.
+func repairNumericStrings(v any) int {
+	n := 0
+	switch v := v.(type) {
+	case map[string]any:
+		_, hasUnit := v["unit"]
+		_, hasCode := v["code"]
+		_, hasComparator := v["comparator"]
+		_, hasCurrency := v["currency"]
+		isQuantity := hasUnit || hasCode || hasComparator || hasCurrency
+		for k, child := range v {
+			if s, ok := child.(string); ok {
+				if (isNumericElement(k) || (k == "value" && isQuantity)) && jsonNumberREGEX.MatchString(strings.TrimSpace(s)) {
+					v[k] = json.Number(strings.TrimSpace(s))
+					n++
+				}
+				continue
+			}
+			n += repairNumericStrings(child)
+		}
+	case []any:
+		for _, child := range v {
+			n += repairNumericStrings(child)
+		}
+	}
+	return n
+}
+
+func isNumericElement(name string) bool {
+	if numericElements[name] {
+		return true
+	}
+	for _, t := range numericValueTypes {
+		if name == "value"+t {
+			return true
+		}
+	}
+	return false
+}
+
+// repairMissingResourceType applies RepairMissingResourceType to res, returning
+// the number of resourceTypes added.
+func repairMissingResourceType(resource ResourceWrapper, res map[string]any) (int, error) {
+	n := 0
+	if _, ok := res["resourceType"]; !ok {
+		name, err := bulkfhir.ResourceTypeCodeToName(resource.Type())
+		if err != nil {
+			return 0, err
+		}
+		res["resourceType"] = name
+		n++
+	}
+	contained, _ := res["contained"].([]any)
+	if len(contained) == 0 {
+		return n, nil
+	}
+	// Find the types of the local references to contained resources.
+	localTypes := map[string]string{}
+	var walk func(v any)
+	walk = func(v any) {
+		switch v := v.(type) {
+		case map[string]any:
+			ref, _ := v["reference"].(string)
+			typ, _ := v["type"].(string)
+			if strings.HasPrefix(ref, "#") && typ != "" {
+				localTypes[ref[1:]] = typ
+			}
+			for _, child := range v {
+				walk(child)
+			}
+		case []any:
+			for _, child := range v {
+				walk(child)
+			}
+		}
+	}
+	walk(res)
+	for _, c := range contained {
+		cr, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		if _, ok := cr["resourceType"]; ok {
+			continue
+		}
+		id, _ := cr["id"].(string)
+		if typ, ok := localTypes[id]; ok && id != "" {
+			cr["resourceType"] = typ
+			n++
+		}
+	}
+	return n, nil
+}
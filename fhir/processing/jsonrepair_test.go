@@ -0,0 +1,75 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestJSONRepairProcessor(t *testing.T) {
+	cases := []struct {
+		name  string
+		rules []processing.JSONRepairRule
+		input typedResource
+		want  string
+	}{
+		{
+			name:  "NumericStrings",
+			rules: []processing.JSONRepairRule{processing.RepairNumericStrings},
+			input: typedResource{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"1","identifier":[{"system":"s","value":"007"}],"valueQuantity":{"value":" 1.50 ","unit":"mg"},"referenceRange":[{"low":{"value":"1e2","code":"mg"},"high":{"value":"lots","unit":"mg"}}],"component":[{"code":{"text":"c"},"valueInteger":"-3"}],"extension":[{"url":"u","valueDecimal":"0.1"},{"url":"v","valueString":"2"}]}`},
+			want:  `{"resourceType":"Observation","id":"1","identifier":[{"system":"s","value":"007"}],"valueQuantity":{"value":1.50,"unit":"mg"},"referenceRange":[{"low":{"value":1e2,"code":"mg"},"high":{"value":"lots","unit":"mg"}}],"component":[{"code":{"text":"c"},"valueInteger":-3}],"extension":[{"url":"u","valueDecimal":0.1},{"url":"v","valueString":"2"}]}`,
+		},
+		{
+			name:  "NumericStringsOtherElements",
+			rules: []processing.JSONRepairRule{processing.RepairNumericStrings},
+			input: typedResource{cpb.ResourceTypeCode_MEDICATION_REQUEST, `{"resourceType":"MedicationRequest","id":"1","dosageInstruction":[{"sequence":"1","timing":{"repeat":{"frequency":"2","period":"1","periodUnit":"d"}}}],"dispenseRequest":{"validityPeriod":{"start":"2020"}}}`},
+			want:  `{"resourceType":"MedicationRequest","id":"1","dosageInstruction":[{"sequence":1,"timing":{"repeat":{"frequency":2,"period":1,"periodUnit":"d"}}}],"dispenseRequest":{"validityPeriod":{"start":"2020"}}}`,
+		},
+		{
+			name:  "MissingResourceType",
+			rules: []processing.JSONRepairRule{processing.RepairMissingResourceType},
+			input: typedResource{cpb.ResourceTypeCode_OBSERVATION, `{"id":"1","contained":[{"id":"p"},{"id":"q"},{"resourceType":"Device","id":"d"}],"performer":[{"reference":"#p","type":"Practitioner"},{"reference":"#q"}]}`},
+			want:  `{"resourceType":"Observation","id":"1","contained":[{"resourceType":"Practitioner","id":"p"},{"id":"q"},{"resourceType":"Device","id":"d"}],"performer":[{"reference":"#p","type":"Practitioner"},{"reference":"#q"}]}`,
+		},
+		{
+			name:  "NoRules",
+			input: typedResource{cpb.ResourceTypeCode_OBSERVATION, `{"id":"1","valueDecimal":"1"}`},
+			want:  `{"id":"1","valueDecimal":"1"}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := processing.NewJSONRepairProcessor(tc.rules)
+			if err != nil {
+				t.Fatalf("NewJSONRepairProcessor() returned unexpected error: %v", err)
+			}
+			got := runProcessor(t, p, []typedResource{tc.input})
+			if diff := cmp.Diff([]map[string]any{mustUnmarshal(t, tc.want)}, got); diff != "" {
+				t.Errorf("unexpected written resources (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNewJSONRepairProcessor_Invalid(t *testing.T) {
+	if _, err := processing.NewJSONRepairProcessor([]processing.JSONRepairRule{processing.JSONRepairRule(99)}); err == nil {
+		t.Error("NewJSONRepairProcessor() with an unknown rule succeeded, want error")
+	}
+}
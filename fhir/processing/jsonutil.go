@@ -0,0 +1,43 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// decodeResourceJSON parses resource JSON into a map, for processors which
+// operate on the raw JSON. Numbers are preserved exactly, as FHIR decimals may
+// have arbitrary precision.
+func decodeResourceJSON(rawJSON []byte) (map[string]any, error) {
+	d := json.NewDecoder(bytes.NewReader(rawJSON))
+	d.UseNumber()
+	var res map[string]any
+	if err := d.Decode(&res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// setResourceJSON replaces the resource with the given map, which was obtained
+// from decodeResourceJSON and then modified.
+func setResourceJSON(resource ResourceWrapper, res map[string]any) error {
+	newJSON, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	return setJSON(resource, newJSON)
+}
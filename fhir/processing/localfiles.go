@@ -0,0 +1,98 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+)
+
+const (
+	// maxNDJSONLineSize is the maximum size of a single resource read from a
+	// local NDJSON file.
+	maxNDJSONLineSize = 10 * 1024 * 1024
+	// initialNDJSONBufferSize is the initial buffer size used when reading local
+	// NDJSON files.
+	initialNDJSONBufferSize = 5 * 1024
+)
+
+// ProcessFile reads FHIR resources from a local NDJSON file, passing each one
+// through the pipeline with the file path as its source URL. The resource type
+// of each line is read from its resourceType field, so files may contain a mix
+// of resource types. Blank lines are skipped.
+//
+// The pipeline is not finalized, so that several files may be processed with
+// the same pipeline; call Pipeline.Finalize once all files are processed.
+func ProcessFile(ctx context.Context, p *Pipeline, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	// The default bufio.MaxScanTokenSize of 64kB is too small for some resources.
+	s.Buffer(make([]byte, initialNDJSONBufferSize), maxNDJSONLineSize)
+	line := 0
+	for s.Scan() {
+		line++
+		data := s.Bytes()
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+		resourceType, err := bulkfhir.ResourceTypeCodeFromJSON(data)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if err := p.Process(ctx, resourceType, path, data); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return nil
+}
+
+// ProcessDirectory calls ProcessFile for each file with a .ndjson extension in
+// the given directory (but not its subdirectories), in lexical order. As with
+// ProcessFile, the pipeline is not finalized.
+func ProcessDirectory(ctx context.Context, p *Pipeline, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".ndjson") {
+			paths = append(paths, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := ProcessFile(ctx, p, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+)
+
+func TestProcessDirectory(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.ndjson":   "{\"resourceType\":\"Patient\",\"id\":\"1\"}\n\n{\"resourceType\":\"Encounter\",\"id\":\"2\"}\n",
+		"b.ndjson":   `{"resourceType":"Observation","id":"3"}`,
+		"ignore.txt": `{"resourceType":"Patient","id":"4"}`,
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "sub.ndjson"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline(nil, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	if err := processing.ProcessDirectory(context.Background(), p, dir); err != nil {
+		t.Fatalf("ProcessDirectory() returned unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, r := range ts.WrittenResources {
+		got = append(got, r.Type().String()+" "+filepath.Base(r.SourceURL()))
+	}
+	want := []string{"PATIENT a.ndjson", "ENCOUNTER a.ndjson", "OBSERVATION b.ndjson"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected processed resources (-want +got):\n%s", diff)
+	}
+}
+
+func TestProcessFile_InvalidResource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.ndjson")
+	if err := os.WriteFile(path, []byte("{\"resourceType\":\"Patient\"}\n{\"id\":\"1\"}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := processing.NewPipeline(nil, nil)
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	if err := processing.ProcessFile(context.Background(), p, path); err == nil {
+		t.Errorf("ProcessFile() with a resource missing resourceType returned nil error")
+	}
+}
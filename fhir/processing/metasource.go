@@ -0,0 +1,109 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+)
+
+// MetaSourceProcessorOptions contains optional parameters used by
+// NewMetaSourceProcessor.
+type MetaSourceProcessorOptions struct {
+	// If true, meta.source is replaced even if the resource already has one.
+	Override bool
+}
+
+type metaSourceProcessor struct {
+	BaseProcessor
+	sourceURI string
+	override  bool
+}
+
+// Assert metaSourceProcessor satisfies the Processor interface.
+var _ Processor = &metaSourceProcessor{}
+
+// NewMetaSourceProcessor creates a Processor which records where each resource
+// came from in its meta.source element. If sourceURI is empty, the resource's
+// SourceURL (without any query string, which may hold credentials) is used,
+// and resources without a SourceURL are left unchanged. Resources which
+// already have a meta.source are left unchanged unless opts.Override is set.
+func NewMetaSourceProcessor(sourceURI string, opts *MetaSourceProcessorOptions) Processor {
+	if opts == nil {
+		opts = &MetaSourceProcessorOptions{}
+	}
+	return &metaSourceProcessor{sourceURI: sourceURI, override: opts.Override}
+}
+
+func (msp *metaSourceProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	source := msp.sourceURI
+	if source == "" {
+		var err error
+		if source, err = redactedSourceURL(resource); err != nil {
+			return err
+		}
+	}
+	if source == "" {
+		return msp.Output(ctx, resource)
+	}
+
+	meta, err := mutableMeta(resource)
+	if err != nil {
+		return err
+	}
+	if meta.GetSource() == nil || msp.override {
+		meta.Source = &dpb.Uri{Value: source}
+	}
+	return msp.Output(ctx, resource)
+}
+
+// redactedSourceURL returns the resource's SourceURL without any query string
+// or user info, which may hold credentials.
+func redactedSourceURL(resource ResourceWrapper) (string, error) {
+	u, err := url.Parse(resource.SourceURL())
+	if err != nil {
+		return "", fmt.Errorf("invalid source URL for %s resource: %w", resource.Type(), err)
+	}
+	u.RawQuery = ""
+	u.User = nil
+	return u.String(), nil
+}
+
+// mutableMeta returns the meta element of the resource's proto for
+// modification, creating it if the resource does not have one.
+func mutableMeta(resource ResourceWrapper) (*dpb.Meta, error) {
+	cr, err := resource.Proto()
+	if err != nil {
+		return nil, err
+	}
+	msg := cr.ProtoReflect()
+	populated := msg.WhichOneof(msg.Descriptor().Oneofs().Get(0))
+	if populated == nil {
+		return nil, fmt.Errorf("%s resource from %s has no content", resource.Type(), resource.SourceURL())
+	}
+	res := msg.Get(populated).Message()
+	metaField := res.Descriptor().Fields().ByName("meta")
+	if metaField == nil {
+		return nil, fmt.Errorf("%s resource has no meta element", resource.Type())
+	}
+	meta, ok := res.Mutable(metaField).Message().Interface().(*dpb.Meta)
+	if !ok {
+		return nil, fmt.Errorf("%s resource has an unexpected meta type", resource.Type())
+	}
+	return meta, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+)
+
+// validNamespaceRegex matches namespaces which may be prepended to an id while
+// keeping it within the FHIR id character set.
+var validNamespaceRegex = regexp.MustCompile(`^[A-Za-z0-9\-\.]+$`)
+
+type namespaceProcessor struct {
+	BaseProcessor
+	prefix string
+}
+
+// Assert namespaceProcessor satisfies the Processor interface.
+var _ Processor = &namespaceProcessor{}
+
+// NewNamespaceProcessor creates a Processor which prepends a namespace to the id
+// of every resource, and to the id in all of its relative literal references,
+// so that data from multiple source systems can be stored together without id
+// collisions. For example, with the prefix "sysA", Patient/1 becomes
+// Patient/sysA-1, and references to it are rewritten to match.
+//
+// Resources whose namespaced id (or any namespaced reference) would exceed the
+// FHIR id length limit are dead lettered with ErrInvalidID.
+//
+// This processor operates on the resource JSON. If it is used together with
+// NewCanonicalizeIDProcessor, the canonicalize processor should come first.
+func NewNamespaceProcessor(prefix string) (Processor, error) {
+	if !validNamespaceRegex.MatchString(prefix) {
+		return nil, fmt.Errorf("namespace %q must be non-empty and contain only the characters [A-Za-z0-9\\-\\.]", prefix)
+	}
+	return &namespaceProcessor{prefix: prefix + "-"}, nil
+}
+
+func (np *namespaceProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	res, err := decodeResourceJSON(rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+
+	invalid := []string{}
+	namespaced := func(id string) string {
+		n := np.prefix + id
+		if !validIDRegex.MatchString(n) {
+			invalid = append(invalid, n)
+		}
+		return n
+	}
+	if id, ok := res["id"].(string); ok {
+		res["id"] = namespaced(id)
+	}
+	walkReferences(res, namespaced)
+	if len(invalid) > 0 {
+		return np.DeadLetterResource(ctx, resource, fmt.Errorf("%w: %q", ErrInvalidID, invalid))
+	}
+
+	if err := setResourceJSON(resource, res); err != nil {
+		return err
+	}
+	return np.Output(ctx, resource)
+}
@@ -0,0 +1,115 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestNamespaceProcessor(t *testing.T) {
+	cases := []struct {
+		name         string
+		resourceType cpb.ResourceTypeCode_Value
+		jsonIn       string
+		wantJSON     string
+	}{
+		{
+			name:         "ID",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			jsonIn:       `{"resourceType":"Patient","id":"1"}`,
+			wantJSON:     `{"resourceType":"Patient","id":"sysA-1"}`,
+		},
+		{
+			name:         "References",
+			resourceType: cpb.ResourceTypeCode_ENCOUNTER,
+			jsonIn:       `{"resourceType":"Encounter","id":"enc1","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Patient/1"},"partOf":{"reference":"Encounter/2/_history/3"},"serviceProvider":{"reference":"https://example.com/fhir/Organization/1"}}`,
+			wantJSON:     `{"resourceType":"Encounter","id":"sysA-enc1","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Patient/sysA-1"},"partOf":{"reference":"Encounter/sysA-2/_history/3"},"serviceProvider":{"reference":"https://example.com/fhir/Organization/1"}}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			np, err := processing.NewNamespaceProcessor("sysA")
+			if err != nil {
+				t.Fatalf("NewNamespaceProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{np}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			if err := p.Process(context.Background(), tc.resourceType, "", []byte(tc.jsonIn)); err != nil {
+				t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", tc.jsonIn, err)
+			}
+			if len(ts.WrittenResources) != 1 {
+				t.Fatalf("unexpected number of written resources. got: %d, want: 1", len(ts.WrittenResources))
+			}
+			gotJSON, err := ts.WrittenResources[0].JSON()
+			if err != nil {
+				t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+			}
+			normalizedWantJSON := testhelpers.NormalizeJSON(t, []byte(tc.wantJSON))
+			normalizedGotJSON := testhelpers.NormalizeJSON(t, gotJSON)
+			if !cmp.Equal(normalizedGotJSON, normalizedWantJSON) {
+				t.Errorf("pipeline.Process(..., %s) produced unexpected output. got: %s, want: %s", tc.jsonIn, normalizedGotJSON, normalizedWantJSON)
+			}
+		})
+	}
+}
+
+func TestNamespaceProcessor_TooLong(t *testing.T) {
+	np, err := processing.NewNamespaceProcessor("sysA")
+	if err != nil {
+		t.Fatalf("NewNamespaceProcessor() returned unexpected error: %v", err)
+	}
+	ts := &processing.TestSink{}
+	var deadLettered []error
+	opts := &processing.PipelineOptions{
+		DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+			deadLettered = append(deadLettered, reason)
+			return nil
+		},
+	}
+	p, err := processing.NewPipelineWithOptions([]processing.Processor{np}, []processing.Sink{ts}, opts)
+	if err != nil {
+		t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+	}
+	json := `{"resourceType":"Patient","id":"` + strings.Repeat("a", 62) + `"}`
+	if err := p.Process(context.Background(), cpb.ResourceTypeCode_PATIENT, "", []byte(json)); err != nil {
+		t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", json, err)
+	}
+	if len(ts.WrittenResources) != 0 {
+		t.Errorf("unexpected number of written resources. got: %d, want: 0", len(ts.WrittenResources))
+	}
+	if len(deadLettered) != 1 || !errors.Is(deadLettered[0], processing.ErrInvalidID) {
+		t.Errorf("unexpected dead letter reasons. got: %v, want: [%v]", deadLettered, processing.ErrInvalidID)
+	}
+}
+
+func TestNewNamespaceProcessor_InvalidPrefix(t *testing.T) {
+	for _, prefix := range []string{"", "sys_A", "sys/A"} {
+		if _, err := processing.NewNamespaceProcessor(prefix); err == nil {
+			t.Errorf("NewNamespaceProcessor(%q) returned nil error", prefix)
+		}
+	}
+}
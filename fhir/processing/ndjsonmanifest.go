@@ -0,0 +1,137 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"sync"
+)
+
+// NDJSONManifestFilename is the name of the manifest written alongside the
+// NDJSON files by the NDJSON sinks if NDJSONSinkOptions.Manifest is set.
+const NDJSONManifestFilename = "manifest.json"
+
+// NDJSONManifest is the content of the manifest written by the NDJSON sinks,
+// which allows consumers of the files to verify that they are complete and
+// unmodified.
+type NDJSONManifest struct {
+	// Files holds an entry for each file written, sorted by name.
+	Files []NDJSONManifestFile `json:"files"`
+}
+
+// NDJSONManifestFile describes a single file in an NDJSONManifest.
+type NDJSONManifestFile struct {
+	// Name is the name of the file, relative to the manifest.
+	Name string `json:"name"`
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+	// SHA256 is the hex encoded SHA-256 hash of the file's content.
+	SHA256 string `json:"sha256"`
+	// ResourceCount is the number of resources (lines) in the file.
+	ResourceCount int `json:"resourceCount"`
+}
+
+// ndjsonManifestBuilder collects the entries of an NDJSONManifest as the files
+// of an ndjsonSink are written.
+type ndjsonManifestBuilder struct {
+	// createFile creates files without adding them to the manifest, and is
+	// used to write the manifest itself.
+	createFile createFileFunc
+
+	mu    sync.Mutex
+	files []NDJSONManifestFile
+}
+
+// wrap returns a createFileFunc which creates files with createFile, and adds
+// each to the manifest when it is closed. The hash, size and resource count of
+// each file are computed as it is written, so the files are not read again.
+func (mb *ndjsonManifestBuilder) wrap(createFile createFileFunc) createFileFunc {
+	return func(ctx context.Context, filename string) (io.WriteCloser, error) {
+		w, err := createFile(ctx, filename)
+		if err != nil {
+			return nil, err
+		}
+		return &manifestWriteCloser{manifest: mb, name: filename, w: w, hash: sha256.New()}, nil
+	}
+}
+
+// write writes the manifest of all files closed so far.
+func (mb *ndjsonManifestBuilder) write(ctx context.Context) error {
+	mb.mu.Lock()
+	manifest := NDJSONManifest{Files: append([]NDJSONManifestFile{}, mb.files...)}
+	mb.mu.Unlock()
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Name < manifest.Files[j].Name })
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	w, err := mb.createFile(ctx, NDJSONManifestFilename)
+	if err != nil {
+		return fmt.Errorf("error creating NDJSON manifest: %w", err)
+	}
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		w.Close()
+		return fmt.Errorf("error writing NDJSON manifest: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error closing NDJSON manifest: %w", err)
+	}
+	return nil
+}
+
+// manifestWriteCloser hashes and counts the data written to w, and adds the
+// file to the manifest once it is closed.
+type manifestWriteCloser struct {
+	manifest *ndjsonManifestBuilder
+	name     string
+	w        io.WriteCloser
+	hash     hash.Hash
+	size     int64
+	lines    int
+}
+
+func (mwc *manifestWriteCloser) Write(p []byte) (int, error) {
+	n, err := mwc.w.Write(p)
+	mwc.hash.Write(p[:n])
+	mwc.size += int64(n)
+	// Resources never contain raw newlines (see normalizeNDJSONLine), so each
+	// newline ends a resource.
+	mwc.lines += bytes.Count(p[:n], []byte{'\n'})
+	return n, err
+}
+
+func (mwc *manifestWriteCloser) Close() error {
+	if err := mwc.w.Close(); err != nil {
+		return err
+	}
+	mwc.manifest.mu.Lock()
+	defer mwc.manifest.mu.Unlock()
+	mwc.manifest.files = append(mwc.manifest.files, NDJSONManifestFile{
+		Name:          mwc.name,
+		Size:          mwc.size,
+		SHA256:        hex.EncodeToString(mwc.hash.Sum(nil)),
+		ResourceCount: mwc.lines,
+	})
+	return nil
+}
@@ -15,7 +15,11 @@
 package processing
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"sync"
@@ -24,6 +28,8 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/google/bulk_fhir_tools/azureblob"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
 	"github.com/google/bulk_fhir_tools/gcs"
 	log "github.com/google/bulk_fhir_tools/internal/logger"
 	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
@@ -36,6 +42,10 @@ const numWorkers = 10
 const numResourcesPerShard = 1000 // this must be greater than zero.
 const retryableWorkerErrLimit = 10
 
+// DefaultNDJSONWriteBufferSize is the default size in bytes of the write
+// buffer of each file written by the NDJSON sinks.
+const DefaultNDJSONWriteBufferSize = 1024 * 1024
+
 var (
 	ndjsonChannelSizeCounter *metrics.Counter = metrics.NewCounter("ndjson-store-channel-size-counter", "The number of unread FHIR Resources that are waiting in the channel to be uploaded to GCS or saved locally as ndjson.", "1", aggregation.LastValueInGCPMaxValueInLocal)
 	ndjsonSinkErrors         *metrics.Counter = metrics.NewCounter("ndjson-sink-errors", "The number of errors encountered in the GCS or local NDJSON write workers. Will have an ErrorType of FILE if it was a file operation related error, or will have ErrorType of JSON_MARSHAL if related to marshaling or fetching the FHIR JSON.", "1", aggregation.Count, "ErrorType")
@@ -49,6 +59,28 @@ const (
 // ErrWorkerError indicates one or more workers had fatal errors.
 var ErrWorkerError = fmt.Errorf("at least one upload worker encountered errors, check the logs for details")
 
+// utf8BOM is the UTF-8 byte order mark.
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// normalizeNDJSONLine returns the JSON of a resource in a form suitable for a
+// line of an NDJSON file: without a byte order mark, and without any carriage
+// returns or newlines (which a processor may have introduced, for example by
+// setting pretty printed JSON). The output of the NDJSON sinks is therefore
+// guaranteed to use only \n line separators, and to have no byte order mark.
+func normalizeNDJSONLine(line []byte) ([]byte, error) {
+	line = bytes.TrimPrefix(line, utf8BOM)
+	if !bytes.ContainsAny(line, "\r\n") {
+		return line, nil
+	}
+	// Raw carriage returns and newlines may only appear as whitespace between
+	// tokens in valid JSON, so are removed by compacting it.
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, line); err != nil {
+		return nil, fmt.Errorf("resource JSON contains line breaks and is not valid JSON: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
 type createFileFunc func(ctx context.Context, filename string) (io.WriteCloser, error)
 
 type fileKey struct {
@@ -69,19 +101,78 @@ type ndjsonSink struct {
 	// worker.
 	workerErr bool
 
-	createFile createFileFunc
+	createFile      createFileFunc
+	writeBufferSize int
+	// filenames generates file names if a FilenameTemplate was given. The
+	// indices of the files are allocated from nextIndex, by resource type if
+	// the template contains the resource type.
+	filenames   *filenameTemplate
+	nextIndexMu sync.Mutex
+	nextIndex   map[cpb.ResourceTypeCode_Value]int
+
+	// manifest collects the manifest of the files written, if one is to be
+	// written.
+	manifest *ndjsonManifestBuilder
 
 	resourceChan     chan ResourceWrapper
 	workerCompleteWG *sync.WaitGroup
 }
 
+// NDJSONSinkOptions contains optional parameters used by
+// NewNDJSONSinkWithOptions.
+type NDJSONSinkOptions struct {
+	// The size in bytes of the write buffer of each file. Each of the sink's
+	// workers has one file open at a time. Defaults to
+	// DefaultNDJSONWriteBufferSize.
+	WriteBufferSize int
+	// If set, the template for the names of the files written, which may
+	// contain the placeholders FilenameResourceType, FilenameIndex (which is
+	// required), FilenameGroup and FilenameTransactionTime, for example
+	// "group-{group}_{transaction_time}_{resource_type}_{index}.ndjson". If the
+	// template contains FilenameResourceType, each file holds resources of a
+	// single type. Otherwise, files are named fhir_data_{worker}_{index}.ndjson.
+	FilenameTemplate string
+	// The value of the FilenameGroup placeholder, typically the group ID of the
+	// export. Defaults to DefaultFilenameGroup.
+	Group string
+	// The export's transaction time, which must be set before any resources are
+	// written if FilenameTemplate contains FilenameTransactionTime.
+	TransactionTime *bulkfhir.TransactionTime
+	// If true, a manifest listing the name, size, SHA-256 hash and resource
+	// count of each file written is written to NDJSONManifestFilename by
+	// Finalize, as JSON holding an NDJSONManifest.
+	Manifest bool
+}
+
+// filenameTemplate returns the filenameTemplate for the options, or nil if no
+// FilenameTemplate is set.
+func (o *NDJSONSinkOptions) filenameTemplate() (*filenameTemplate, error) {
+	if o.FilenameTemplate == "" {
+		return nil, nil
+	}
+	return newFilenameTemplate(o.FilenameTemplate, o.Group, o.TransactionTime)
+}
+
 // NewNDJSONSink creates a new Sink which writes resources to NDJSON files in
-// the given directory. Resources are grouped by the URL they were retrieved
-// from, with their file name containing the resource type and an incremented
-// index to distinguish them.
+// the given directory, with up to 1000 resources in each. Lines are separated
+// by \n (never \r\n), and files have no byte order mark. Use
+// NewNDJSONSinkWithOptions to name the files with a template.
 //
 // It is threadsafe to call Write on this Sink from multiple goroutines.
 func NewNDJSONSink(ctx context.Context, directory string) (Sink, error) {
+	return NewNDJSONSinkWithOptions(ctx, directory, nil)
+}
+
+// NewNDJSONSinkWithOptions is like NewNDJSONSink, but allows optional
+// parameters to be set.
+func NewNDJSONSinkWithOptions(ctx context.Context, directory string, opts *NDJSONSinkOptions) (Sink, error) {
+	if opts == nil {
+		opts = &NDJSONSinkOptions{}
+	}
+	filenames, err := opts.filenameTemplate()
+	if err != nil {
+		return nil, err
+	}
 	if stat, err := os.Stat(directory); err != nil {
 		return nil, fmt.Errorf("could not stat directory %q - %w", directory, err)
 	} else if !stat.IsDir() {
@@ -93,31 +184,31 @@ func NewNDJSONSink(ctx context.Context, directory string) (Sink, error) {
 		return os.Create(filename)
 	}
 
-	sink := &ndjsonSink{
-		workerErrMut:     &sync.Mutex{},
-		workerErr:        false,
-		createFile:       createFile,
-		resourceChan:     make(chan ResourceWrapper, 100),
-		workerCompleteWG: &sync.WaitGroup{},
-	}
-
-	for i := 0; i < numWorkers; i++ {
-		go sink.writeWorker(i)
-		sink.workerCompleteWG.Add(1)
-	}
-
-	return sink, nil
+	return startNDJSONSink(createFile, opts.WriteBufferSize, filenames, opts.Manifest), nil
 }
 
 // NewGCSNDJSONSink returns a Sink which writes NDJSON files to GCS. See
 // NewNDJSONSink for additional documentation.
 func NewGCSNDJSONSink(ctx context.Context, endpoint, bucket, directory string) (Sink, error) {
-	return newGCSNDJSONSink(ctx, endpoint, bucket, directory)
+	return newGCSNDJSONSink(ctx, endpoint, bucket, directory, nil)
+}
+
+// NewGCSNDJSONSinkWithOptions is like NewGCSNDJSONSink, but allows optional
+// parameters to be set.
+func NewGCSNDJSONSinkWithOptions(ctx context.Context, endpoint, bucket, directory string, opts *NDJSONSinkOptions) (Sink, error) {
+	return newGCSNDJSONSink(ctx, endpoint, bucket, directory, opts)
 }
 
 // newGCSNDJSONSink returns the raw ndjsonSink, so that it can be embedded in
 // gcsBasedFHIRStoreSink without a cast.
-func newGCSNDJSONSink(ctx context.Context, endpoint, bucket, directory string) (*ndjsonSink, error) {
+func newGCSNDJSONSink(ctx context.Context, endpoint, bucket, directory string, opts *NDJSONSinkOptions) (*ndjsonSink, error) {
+	if opts == nil {
+		opts = &NDJSONSinkOptions{}
+	}
+	filenames, err := opts.filenameTemplate()
+	if err != nil {
+		return nil, err
+	}
 	gcsClient, err := gcs.NewClient(ctx, bucket, endpoint)
 	if err != nil {
 		return nil, err
@@ -128,19 +219,103 @@ func newGCSNDJSONSink(ctx context.Context, endpoint, bucket, directory string) (
 		return gcsClient.GetFileWriter(ctx, gcs.JoinPath(directory, filename)), nil
 	}
 
+	return startNDJSONSink(createFile, opts.WriteBufferSize, filenames, opts.Manifest), nil
+}
+
+// AzureBlobNDJSONSinkOptions contains optional parameters used by
+// NewAzureBlobNDJSONSink.
+type AzureBlobNDJSONSinkOptions struct {
+	// If true, files are gzip compressed, and have a .gz suffix.
+	Gzip bool
+	// The size in bytes of the write buffer of each file. Defaults to
+	// DefaultNDJSONWriteBufferSize.
+	WriteBufferSize int
+}
+
+// NewAzureBlobNDJSONSink returns a Sink which writes NDJSON files to block
+// blobs named {prefix}/{file name} in the Azure Blob Storage container at
+// containerURL. Blocks are uploaded as data is written, and each blob is
+// committed once its file is complete (and at the latest by Finalize). See
+// NewNDJSONSink for additional documentation.
+func NewAzureBlobNDJSONSink(ctx context.Context, containerURL, prefix string, cred azureblob.Credential, opts *AzureBlobNDJSONSinkOptions) (Sink, error) {
+	client, err := azureblob.NewClient(containerURL, cred)
+	if err != nil {
+		return nil, err
+	}
+	if opts == nil {
+		opts = &AzureBlobNDJSONSinkOptions{}
+	}
+	gzipFiles := opts.Gzip
+
+	// This closure captures the Azure client and the `prefix` parameter.
+	createFile := func(ctx context.Context, filename string) (io.WriteCloser, error) {
+		if !gzipFiles {
+			return client.GetFileWriter(ctx, azureblob.JoinPath(prefix, filename)), nil
+		}
+		w := client.GetFileWriter(ctx, azureblob.JoinPath(prefix, filename+".gz"))
+		return &gzipWriteCloser{Writer: gzip.NewWriter(w), underlying: w}, nil
+	}
+	return startNDJSONSink(createFile, opts.WriteBufferSize, nil, false), nil
+}
+
+// gzipWriteCloser closes the underlying writer after closing the gzip writer.
+type gzipWriteCloser struct {
+	*gzip.Writer
+	underlying io.WriteCloser
+}
+
+func (gwc *gzipWriteCloser) Close() error {
+	if err := gwc.Writer.Close(); err != nil {
+		gwc.underlying.Close()
+		return err
+	}
+	return gwc.underlying.Close()
+}
+
+// bufferedWriteCloser flushes the buffered data before closing the underlying
+// writer.
+type bufferedWriteCloser struct {
+	*bufio.Writer
+	underlying io.WriteCloser
+}
+
+func (bwc *bufferedWriteCloser) Close() error {
+	if err := bwc.Writer.Flush(); err != nil {
+		bwc.underlying.Close()
+		return err
+	}
+	return bwc.underlying.Close()
+}
+
+// startNDJSONSink creates an ndjsonSink which writes files created by
+// createFile through buffers of writeBufferSize bytes (or
+// DefaultNDJSONWriteBufferSize if it is not positive), and starts its workers.
+// filenames may be nil, for the default file names. If manifest is true, a
+// manifest of the files is written by Finalize.
+func startNDJSONSink(createFile createFileFunc, writeBufferSize int, filenames *filenameTemplate, manifest bool) *ndjsonSink {
+	if writeBufferSize <= 0 {
+		writeBufferSize = DefaultNDJSONWriteBufferSize
+	}
 	sink := &ndjsonSink{
 		workerErrMut:     &sync.Mutex{},
 		workerErr:        false,
 		createFile:       createFile,
+		writeBufferSize:  writeBufferSize,
+		filenames:        filenames,
+		nextIndex:        map[cpb.ResourceTypeCode_Value]int{},
 		resourceChan:     make(chan ResourceWrapper, 100),
 		workerCompleteWG: &sync.WaitGroup{},
 	}
+	if manifest {
+		sink.manifest = &ndjsonManifestBuilder{createFile: createFile}
+		sink.createFile = sink.manifest.wrap(createFile)
+	}
 
 	for i := 0; i < numWorkers; i++ {
 		go sink.writeWorker(i)
 		sink.workerCompleteWG.Add(1)
 	}
-	return sink, nil
+	return sink
 }
 
 // Write writes the resource to the ndjsonSink. For an ndjsonSink or gcsNDJSONSink, Write is
@@ -162,27 +337,55 @@ func (ns *ndjsonSink) Write(ctx context.Context, resource ResourceWrapper) error
 	return nil
 }
 
+// workerShard is a file being written by a writeWorker.
+type workerShard struct {
+	name  string
+	w     io.WriteCloser
+	count int
+}
+
 func (ns *ndjsonSink) writeWorker(workerID int) {
-	var currFileShard io.WriteCloser = nil
-	var err error
-	itemsProcessed := 0
+	// shards holds the current file for each resource type if the file names
+	// contain the resource type, or for INVALID_UNINITIALIZED otherwise.
+	shards := map[cpb.ResourceTypeCode_Value]*workerShard{}
+	shardsCreated := 0
 	retryableErrCount := 0
 
 	for r := range ns.resourceChan {
-		// Close the currFileShard and update it with a new file, if needed.
-		if itemsProcessed%numResourcesPerShard == 0 || currFileShard == nil {
-			if currFileShard != nil {
-				if err := currFileShard.Close(); err != nil {
-					log.Errorf("error closing file (ndjsonsink): %v", err)
-					recordNDJSONSinkError(errTypeFile)
-					time.Sleep(time.Second)
-					ns.resourceChan <- r
-					retryableErrCount++
-					continue
-				}
-			}
+		key := cpb.ResourceTypeCode_INVALID_UNINITIALIZED
+		if ns.filenames != nil && ns.filenames.perType {
+			key = r.Type()
+		}
+		shard := shards[key]
 
-			currFileShard, err = ns.createFile(context.Background(), fmt.Sprintf("fhir_data_%d_%d.ndjson", workerID, itemsProcessed/numResourcesPerShard))
+		// Close the shard and replace it with a new file, if needed.
+		if shard != nil && shard.count >= numResourcesPerShard {
+			if err := shard.w.Close(); err != nil {
+				log.Errorf("error closing file (ndjsonsink): %v", err)
+				recordNDJSONSinkError(errTypeFile)
+				time.Sleep(time.Second)
+				ns.resourceChan <- r
+				retryableErrCount++
+				continue
+			}
+			shard = nil
+		}
+		if shard == nil {
+			name, err := ns.filename(workerID, shardsCreated, key)
+			if err != nil {
+				log.Errorf("error naming file (ndjsonsink): %v", err)
+				recordNDJSONSinkError(errTypeFile)
+				time.Sleep(time.Second)
+				ns.resourceChan <- r
+				retryableErrCount++
+				continue
+			}
+			shardsCreated++
+			shard = &workerShard{name: name}
+			shards[key] = shard
+		}
+		if shard.w == nil {
+			w, err := ns.createFile(context.Background(), shard.name)
 			if err != nil {
 				log.Errorf("error creating file (ndjsonsink): %v", err)
 				recordNDJSONSinkError(errTypeFile)
@@ -191,9 +394,13 @@ func (ns *ndjsonSink) writeWorker(workerID int) {
 				retryableErrCount++
 				continue
 			}
+			shard.w = &bufferedWriteCloser{Writer: bufio.NewWriterSize(w, ns.writeBufferSize), underlying: w}
 		}
 
 		json, err := r.JSON()
+		if err == nil {
+			json, err = normalizeNDJSONLine(json)
+		}
 		if err != nil {
 			// This is not a retryable error and we do not need to fail the pipeline for this either.
 			// So we log an error, increment the error count, and continue processing other
@@ -202,7 +409,12 @@ func (ns *ndjsonSink) writeWorker(workerID int) {
 			recordNDJSONSinkError(errTypeJSONMarshal)
 			continue
 		}
-		_, err = currFileShard.Write(append(json, byte('\n')))
+		// The newline is written separately to avoid copying json (which may be
+		// large) to append it.
+		_, err = shard.w.Write(json)
+		if err == nil {
+			_, err = shard.w.Write([]byte{'\n'})
+		}
 		if err != nil {
 			log.Errorf("error writing FHIR resource to file (ndjsonsink): %v", err)
 			recordNDJSONSinkError(errTypeFile)
@@ -221,11 +433,14 @@ func (ns *ndjsonSink) writeWorker(workerID int) {
 			return
 		}
 
-		itemsProcessed++
+		shard.count++
 	}
 
-	if currFileShard != nil {
-		if err := currFileShard.Close(); err != nil {
+	for _, shard := range shards {
+		if shard.w == nil {
+			continue
+		}
+		if err := shard.w.Close(); err != nil {
 			log.Errorf("error closing file (ndjsonsink): %v", err)
 			// If the final file's close doesn't work, we set the error flag.
 			ns.setWorkerErr()
@@ -235,6 +450,22 @@ func (ns *ndjsonSink) writeWorker(workerID int) {
 	ns.workerCompleteWG.Done()
 }
 
+// filename returns the name of a new file for the given worker, which has
+// created shardsCreated files so far, for resources with the given key.
+func (ns *ndjsonSink) filename(workerID, shardsCreated int, key cpb.ResourceTypeCode_Value) (string, error) {
+	if ns.filenames == nil {
+		return fmt.Sprintf("fhir_data_%d_%d.ndjson", workerID, shardsCreated), nil
+	}
+	ns.nextIndexMu.Lock()
+	defer ns.nextIndexMu.Unlock()
+	name, err := ns.filenames.filename(key, ns.nextIndex[key])
+	if err != nil {
+		return "", err
+	}
+	ns.nextIndex[key]++
+	return name, nil
+}
+
 func (ns *ndjsonSink) setWorkerErr() {
 	ns.workerErrMut.Lock()
 	ns.workerErr = true
@@ -251,6 +482,9 @@ func (ns *ndjsonSink) Finalize(ctx context.Context) error {
 		return ErrWorkerError
 	}
 
+	if ns.manifest != nil {
+		return ns.manifest.write(ctx)
+	}
 	return nil
 }
 
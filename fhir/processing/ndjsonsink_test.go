@@ -15,15 +15,27 @@
 package processing_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/google/bulk_fhir_tools/bulkfhir"
 	"github.com/google/bulk_fhir_tools/fhir/processing"
 	"github.com/google/bulk_fhir_tools/testhelpers"
 
@@ -70,6 +82,249 @@ func TestNDJSONSink(t *testing.T) {
 	}
 }
 
+func TestNDJSONSink_ResourcesLargerThanWriteBuffer(t *testing.T) {
+	ctx := context.Background()
+	large := []byte(strings.Repeat("a", 100))
+	small := []byte("b")
+
+	tempdir := t.TempDir()
+	sink, err := processing.NewNDJSONSinkWithOptions(ctx, tempdir, &processing.NDJSONSinkOptions{WriteBufferSize: 16})
+	if err != nil {
+		t.Fatalf("NewNDJSONSinkWithOptions() returned unexpected error: %v", err)
+	}
+	for _, json := range [][]byte{large, small, large} {
+		if err := sink.Write(ctx, &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: json}); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+
+	wantDataLines := [][]byte{large, small, large}
+	gotData := testhelpers.ReadAllFHIRJSON(t, tempdir, false)
+	if !cmp.Equal(gotData, wantDataLines, cmpopts.SortSlices(func(a, b []byte) bool { return string(a) < string(b) })) {
+		t.Errorf("unexpected data in file shards. got: %s, want: %s", gotData, wantDataLines)
+	}
+}
+
+func TestNDJSONSink_FilenameTemplate(t *testing.T) {
+	ctx := context.Background()
+	tt := bulkfhir.NewTransactionTime()
+	tt.Set(time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC))
+	tempdir := t.TempDir()
+	sink, err := processing.NewNDJSONSinkWithOptions(ctx, tempdir, &processing.NDJSONSinkOptions{
+		FilenameTemplate: "group-{group}_{transaction_time}_{resource_type}_{index}.ndjson",
+		TransactionTime:  tt,
+	})
+	if err != nil {
+		t.Fatalf("NewNDJSONSinkWithOptions() returned unexpected error: %v", err)
+	}
+	testdata := []testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p1")},
+		{resourceType: cpb.ResourceTypeCode_OBSERVATION, json: []byte("o1")},
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("p2")},
+	}
+	for _, td := range testdata {
+		td := td
+		if err := sink.Write(ctx, &td); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+
+	// The resources may be written by different workers, so there may be one or
+	// two Patient files.
+	prefix := "group-all_2024-01-05T00:00:00.000+00:00_"
+	got := map[string]string{}
+	entries, err := os.ReadDir(tempdir)
+	if err != nil {
+		t.Fatalf("ReadDir() returned unexpected error: %v", err)
+	}
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(tempdir, e.Name()))
+		if err != nil {
+			t.Fatalf("ReadFile() returned unexpected error: %v", err)
+		}
+		got[e.Name()] = string(data)
+	}
+	want := map[string]string{prefix + "Observation_0000.ndjson": "o1\n"}
+	if len(got) == 2 {
+		want[prefix+"Patient_0000.ndjson"] = "p1\np2\n"
+	} else {
+		for _, name := range []string{prefix + "Patient_0000.ndjson", prefix + "Patient_0001.ndjson"} {
+			// Either Patient may be in either file.
+			if got[name] == "p2\n" {
+				want[name] = "p2\n"
+			} else {
+				want[name] = "p1\n"
+			}
+		}
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected files written (-want +got):\n%s", diff)
+	}
+}
+
+func TestNDJSONSink_Manifest(t *testing.T) {
+	ctx := context.Background()
+	tempdir := t.TempDir()
+	sink, err := processing.NewNDJSONSinkWithOptions(ctx, tempdir, &processing.NDJSONSinkOptions{
+		FilenameTemplate: "{resource_type}_{index}.ndjson",
+		Manifest:         true,
+	})
+	if err != nil {
+		t.Fatalf("NewNDJSONSinkWithOptions() returned unexpected error: %v", err)
+	}
+	testdata := []testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte(`{"resourceType":"Patient","id":"p1"}`)},
+		{resourceType: cpb.ResourceTypeCode_OBSERVATION, json: []byte(`{"resourceType":"Observation","id":"o1"}`)},
+		{resourceType: cpb.ResourceTypeCode_OBSERVATION, json: []byte(`{"resourceType":"Observation","id":"o2"}`)},
+	}
+	for _, td := range testdata {
+		td := td
+		if err := sink.Write(ctx, &td); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(tempdir, processing.NDJSONManifestFilename))
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	var got processing.NDJSONManifest
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("failed to parse manifest %s: %v", data, err)
+	}
+
+	// The manifest should describe every other file in the directory. The
+	// resources may be written by different workers, so there may be one or two
+	// Observation files.
+	var want processing.NDJSONManifest
+	resources := 0
+	entries, err := os.ReadDir(tempdir)
+	if err != nil {
+		t.Fatalf("ReadDir() returned unexpected error: %v", err)
+	}
+	for _, e := range entries {
+		if e.Name() == processing.NDJSONManifestFilename {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(tempdir, e.Name()))
+		if err != nil {
+			t.Fatalf("ReadFile() returned unexpected error: %v", err)
+		}
+		hash := sha256.Sum256(content)
+		count := bytes.Count(content, []byte{'\n'})
+		resources += count
+		want.Files = append(want.Files, processing.NDJSONManifestFile{
+			Name:          e.Name(),
+			Size:          int64(len(content)),
+			SHA256:        hex.EncodeToString(hash[:]),
+			ResourceCount: count,
+		})
+	}
+	if resources != len(testdata) {
+		t.Errorf("unexpected number of resources written. got: %d, want: %d", resources, len(testdata))
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected manifest (-want +got):\n%s", diff)
+	}
+}
+
+func TestNewNDJSONSinkWithOptions_InvalidFilenameTemplate(t *testing.T) {
+	for _, template := range []string{
+		"{resource_type}.ndjson",
+		"{resource_type}_{index}_{unknown}.ndjson",
+		"{transaction_time}_{index}.ndjson",
+		"dir/{index}.ndjson",
+	} {
+		if _, err := processing.NewNDJSONSinkWithOptions(context.Background(), t.TempDir(), &processing.NDJSONSinkOptions{FilenameTemplate: template}); err == nil {
+			t.Errorf("NewNDJSONSinkWithOptions() with FilenameTemplate %q succeeded, want error", template)
+		}
+	}
+}
+
+func TestNDJSONSink_LFLineEndingsWithoutBOM(t *testing.T) {
+	ctx := context.Background()
+	testdata := [][]byte{
+		append([]byte{0xef, 0xbb, 0xbf}, `{"resourceType":"Patient","id":"1"}`...),
+		[]byte("{\r\n  \"resourceType\": \"Patient\",\r\n  \"id\": \"2\"\n}"),
+	}
+
+	tempdir := t.TempDir()
+	sink, err := processing.NewNDJSONSink(ctx, tempdir)
+	if err != nil {
+		t.Fatalf("NewNDJSONSink() returned unexpected error: %v", err)
+	}
+	for _, json := range testdata {
+		if err := sink.Write(ctx, &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: json}); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+
+	files, err := os.ReadDir(tempdir)
+	if err != nil {
+		t.Fatalf("failed to read output directory: %v", err)
+	}
+	var lines []string
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(tempdir, f.Name()))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", f.Name(), err)
+		}
+		if bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}) {
+			t.Errorf("%s starts with a byte order mark", f.Name())
+		}
+		if bytes.Contains(data, []byte("\r")) {
+			t.Errorf("%s contains a carriage return: %q", f.Name(), data)
+		}
+		if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+			t.Errorf("%s does not end with a newline: %q", f.Name(), data)
+		}
+		for _, l := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+			if l != "" {
+				lines = append(lines, l)
+			}
+		}
+	}
+	want := []string{`{"resourceType":"Patient","id":"1"}`, `{"resourceType":"Patient","id":"2"}`}
+	if diff := cmp.Diff(want, lines, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Errorf("unexpected lines written (-want +got):\n%s", diff)
+	}
+}
+
+func BenchmarkNDJSONSinkWriteBufferSize(b *testing.B) {
+	ctx := context.Background()
+	json := []byte(`{"resourceType":"Observation","id":"` + strings.Repeat("x", 2000) + `"}`)
+	for _, size := range []int{4 * 1024, 64 * 1024, processing.DefaultNDJSONWriteBufferSize} {
+		b.Run(fmt.Sprintf("%dKiB", size/1024), func(b *testing.B) {
+			sink, err := processing.NewNDJSONSinkWithOptions(ctx, b.TempDir(), &processing.NDJSONSinkOptions{WriteBufferSize: size})
+			if err != nil {
+				b.Fatalf("NewNDJSONSinkWithOptions() returned unexpected error: %v", err)
+			}
+			b.SetBytes(int64(len(json) + 1))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := sink.Write(ctx, &testResourceWrapper{resourceType: cpb.ResourceTypeCode_OBSERVATION, json: json}); err != nil {
+					b.Fatalf("Write() returned unexpected error: %v", err)
+				}
+			}
+			if err := sink.Finalize(ctx); err != nil {
+				b.Fatalf("Finalize() returned unexpected error: %v", err)
+			}
+		})
+	}
+}
+
 // Note: the logic for the GCS variant is mostly the same as for the local file
 // variant, so this test is kept much simpler.
 func TestGCSNDJSONSink(t *testing.T) {
@@ -117,6 +372,49 @@ func TestGCSNDJSONSink(t *testing.T) {
 
 }
 
+func TestAzureBlobNDJSONSink(t *testing.T) {
+	for _, useGzip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Gzip=%t", useGzip), func(t *testing.T) {
+			ctx := context.Background()
+			server := testhelpers.NewAzureBlobServer(t)
+			sink, err := processing.NewAzureBlobNDJSONSink(ctx, server.URL()+"/container", "prefix", nil, &processing.AzureBlobNDJSONSinkOptions{Gzip: useGzip})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, data := range []string{"foo", "bar"} {
+				td := &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, sourceURL: "url1", json: []byte(data)}
+				if err := sink.Write(ctx, td); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := sink.Finalize(ctx); err != nil {
+				t.Fatalf("error in Finalize: %v", err)
+			}
+
+			var gotLines []string
+			for _, path := range server.GetAllPaths() {
+				if !strings.HasPrefix(path, "/container/prefix/") || strings.HasSuffix(path, ".gz") != useGzip {
+					t.Errorf("unexpected blob path %s", path)
+				}
+				data, _ := server.GetBlob(path)
+				if useGzip {
+					r, err := gzip.NewReader(bytes.NewReader(data))
+					if err != nil {
+						t.Fatalf("failed to create gzip reader for %s: %v", path, err)
+					}
+					if data, err = io.ReadAll(r); err != nil {
+						t.Fatalf("failed to decompress %s: %v", path, err)
+					}
+				}
+				gotLines = append(gotLines, strings.Fields(string(data))...)
+			}
+			if diff := cmp.Diff([]string{"foo", "bar"}, gotLines, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+				t.Errorf("unexpected data in blobs (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
 func TestNDJSONSink_WorkerError(t *testing.T) {
 	// This test will pass a fake GCS server that always returns errors.
 	ctx := context.Background()
@@ -157,9 +455,25 @@ type testResourceWrapper struct {
 	sourceURL    string
 	proto        *rpb.ContainedResource
 	json         []byte
+	attributes   map[string]string
 }
 
 func (trw *testResourceWrapper) Type() cpb.ResourceTypeCode_Value       { return trw.resourceType }
 func (trw *testResourceWrapper) SourceURL() string                      { return trw.sourceURL }
 func (trw *testResourceWrapper) Proto() (*rpb.ContainedResource, error) { return trw.proto, nil }
 func (trw *testResourceWrapper) JSON() ([]byte, error)                  { return trw.json, nil }
+func (trw *testResourceWrapper) SetJSON(json []byte) error {
+	trw.json = json
+	trw.proto = nil
+	return nil
+}
+func (trw *testResourceWrapper) Attribute(key string) (string, bool) {
+	v, ok := trw.attributes[key]
+	return v, ok
+}
+func (trw *testResourceWrapper) SetAttribute(key, value string) {
+	if trw.attributes == nil {
+		trw.attributes = map[string]string{}
+	}
+	trw.attributes[key] = value
+}
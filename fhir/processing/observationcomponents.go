@@ -0,0 +1,191 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/fhir/go/jsonformat"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// ParentObservationIDAttribute is the attribute key set by the
+// ObservationComponentSplitProcessor on each Observation it derives from a
+// component, holding the id of the Observation the component came from.
+const ParentObservationIDAttribute = "parent_observation_id"
+
+// ObservationComponentSplitProcessorOptions contains optional parameters used
+// by NewObservationComponentSplitProcessorWithOptions.
+type ObservationComponentSplitProcessorOptions struct {
+	// If true, Observations with components are replaced by the Observations
+	// derived from their components, rather than output alongside them.
+	DropOriginal bool
+}
+
+// observationContextFields are the elements copied from an Observation to
+// each of the Observations derived from its components, so that each derived
+// Observation can be analysed on its own.
+var observationContextFields = []string{
+	"status", "category", "subject", "focus", "encounter",
+	"effectiveDateTime", "effectivePeriod", "effectiveTiming", "effectiveInstant",
+	"issued", "performer", "method", "bodySite", "specimen", "device",
+}
+
+type observationComponentSplitProcessor struct {
+	BaseProcessor
+	unmarshaller *jsonformat.Unmarshaller
+	marshaller   *jsonformat.Marshaller
+	dropOriginal bool
+}
+
+// Assert observationComponentSplitProcessor satisfies the Processor interface.
+var _ Processor = &observationComponentSplitProcessor{}
+
+// NewObservationComponentSplitProcessor creates a Processor which outputs an
+// additional Observation for each component of a multi-component Observation
+// (e.g. the systolic and diastolic components of a blood pressure), which is
+// easier to query in analytics sinks such as BigQuery. See
+// NewObservationComponentSplitProcessorWithOptions for details.
+func NewObservationComponentSplitProcessor() (Processor, error) {
+	return NewObservationComponentSplitProcessorWithOptions(nil)
+}
+
+// NewObservationComponentSplitProcessorWithOptions creates a Processor which
+// outputs an Observation for each component of an Observation, after the
+// original Observation unless opts.DropOriginal is set.
+//
+// Each derived Observation has the code, value and interpretation of the
+// component, along with the status, subject, effective time and other context
+// of the original Observation. Its id is the original id suffixed with
+// "-component-" and the index of the component, and it refers back to the
+// original through derivedFrom and the ParentObservationIDAttribute.
+// Observations without components, and all other resources, are passed
+// through unchanged.
+func NewObservationComponentSplitProcessorWithOptions(opts *ObservationComponentSplitProcessorOptions) (Processor, error) {
+	if opts == nil {
+		opts = &ObservationComponentSplitProcessorOptions{}
+	}
+	unmarshaller, err := jsonformat.NewUnmarshallerWithoutValidation("UTC", fhirversion.R4)
+	if err != nil {
+		return nil, err
+	}
+	marshaller, err := jsonformat.NewMarshaller(false, "", "", fhirversion.R4)
+	if err != nil {
+		return nil, err
+	}
+	return &observationComponentSplitProcessor{
+		unmarshaller: unmarshaller,
+		marshaller:   marshaller,
+		dropOriginal: opts.DropOriginal,
+	}, nil
+}
+
+func (ocsp *observationComponentSplitProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	if resource.Type() != cpb.ResourceTypeCode_OBSERVATION {
+		return ocsp.Output(ctx, resource)
+	}
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	obs, err := decodeResourceJSON(rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse Observation JSON: %w", err)
+	}
+	components, _ := obs["component"].([]any)
+	if len(components) == 0 {
+		return ocsp.Output(ctx, resource)
+	}
+
+	// The derived Observations are built before the original is output, as the
+	// original's JSON may be modified by later processors.
+	parentID, _ := obs["id"].(string)
+	var derived []*resourceWrapper
+	for i, c := range components {
+		component, ok := c.(map[string]any)
+		if !ok {
+			continue
+		}
+		d, err := ocsp.derive(resource, obs, parentID, i, component)
+		if err != nil {
+			return fmt.Errorf("failed to split component %d of Observation %q: %w", i, parentID, err)
+		}
+		derived = append(derived, d)
+	}
+
+	if !ocsp.dropOriginal {
+		if err := ocsp.Output(ctx, resource); err != nil {
+			return err
+		}
+	}
+	for _, d := range derived {
+		if err := ocsp.Output(ctx, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// derive returns a new Observation for the component at the given index of
+// the parent Observation.
+func (ocsp *observationComponentSplitProcessor) derive(parent ResourceWrapper, obs map[string]any, parentID string, index int, component map[string]any) (*resourceWrapper, error) {
+	d := map[string]any{"resourceType": "Observation"}
+	for _, f := range observationContextFields {
+		if v, ok := obs[f]; ok {
+			d[f] = v
+		}
+	}
+	// Components have the same elements as an Observation (code, value[x],
+	// dataAbsentReason, interpretation and referenceRange), other than the
+	// element id which is not meaningful outside of the parent.
+	for k, v := range component {
+		if k != "id" {
+			d[k] = v
+		}
+	}
+	if parentID != "" {
+		d["id"] = fmt.Sprintf("%s-component-%d", parentID, index)
+		d["derivedFrom"] = []any{map[string]any{"reference": "Observation/" + parentID}}
+	}
+	derivedJSON, err := json.Marshal(d)
+	if err != nil {
+		return nil, err
+	}
+
+	rw := &resourceWrapper{
+		unmarshaller: ocsp.unmarshaller,
+		marshaller:   ocsp.marshaller,
+		resourceType: cpb.ResourceTypeCode_OBSERVATION,
+		sourceURL:    parent.SourceURL(),
+		jsonMut:      &sync.Mutex{},
+		json:         derivedJSON,
+	}
+	// Attributes set by earlier processors (e.g. the run id) apply equally to
+	// the derived Observations.
+	if prw, ok := parent.(*resourceWrapper); ok {
+		for k, v := range prw.attributes {
+			rw.SetAttribute(k, v)
+		}
+	}
+	if parentID != "" {
+		rw.SetAttribute(ParentObservationIDAttribute, parentID)
+	}
+	return rw, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+const bloodPressureJSON = `{"resourceType":"Observation","id":"bp","status":"final","code":{"text":"blood pressure"},"subject":{"reference":"Patient/1"},"effectiveDateTime":"2020-01-01","component":[{"id":"c0","code":{"text":"systolic"},"valueQuantity":{"value":120,"unit":"mmHg"}},{"code":{"text":"diastolic"},"valueQuantity":{"value":80.5,"unit":"mmHg"}}]}`
+
+func TestObservationComponentSplitProcessor(t *testing.T) {
+	systolic := `{"resourceType":"Observation","id":"bp-component-0","status":"final","code":{"text":"systolic"},"subject":{"reference":"Patient/1"},"effectiveDateTime":"2020-01-01","valueQuantity":{"value":120,"unit":"mmHg"},"derivedFrom":[{"reference":"Observation/bp"}]}`
+	diastolic := `{"resourceType":"Observation","id":"bp-component-1","status":"final","code":{"text":"diastolic"},"subject":{"reference":"Patient/1"},"effectiveDateTime":"2020-01-01","valueQuantity":{"value":80.5,"unit":"mmHg"},"derivedFrom":[{"reference":"Observation/bp"}]}`
+	heartRate := `{"resourceType":"Observation","id":"hr","status":"final","code":{"text":"heart rate"},"valueQuantity":{"value":60}}`
+	patient := `{"resourceType":"Patient","id":"1"}`
+
+	cases := []struct {
+		name string
+		opts *processing.ObservationComponentSplitProcessorOptions
+		want []string
+	}{
+		{
+			name: "KeepOriginal",
+			want: []string{bloodPressureJSON, systolic, diastolic, heartRate, patient},
+		},
+		{
+			name: "DropOriginal",
+			opts: &processing.ObservationComponentSplitProcessorOptions{DropOriginal: true},
+			want: []string{systolic, diastolic, heartRate, patient},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := processing.NewObservationComponentSplitProcessorWithOptions(tc.opts)
+			if err != nil {
+				t.Fatalf("NewObservationComponentSplitProcessorWithOptions() returned unexpected error: %v", err)
+			}
+			got := runProcessor(t, p, []typedResource{
+				{cpb.ResourceTypeCode_OBSERVATION, bloodPressureJSON},
+				{cpb.ResourceTypeCode_OBSERVATION, heartRate},
+				{cpb.ResourceTypeCode_PATIENT, patient},
+			})
+			var want []map[string]any
+			for _, w := range tc.want {
+				want = append(want, mustUnmarshal(t, w))
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("unexpected written resources (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestObservationComponentSplitProcessor_Attributes(t *testing.T) {
+	ctx := context.Background()
+	p, err := processing.NewObservationComponentSplitProcessor()
+	if err != nil {
+		t.Fatalf("NewObservationComponentSplitProcessor() returned unexpected error: %v", err)
+	}
+	ts := &processing.TestSink{}
+	pipeline, err := processing.NewPipeline([]processing.Processor{processing.NewContentHashProcessor(), p}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	if err := pipeline.Process(ctx, cpb.ResourceTypeCode_OBSERVATION, "https://example.com/Observation_0.ndjson", []byte(bloodPressureJSON)); err != nil {
+		t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+	}
+	if len(ts.WrittenResources) != 3 {
+		t.Fatalf("got %d written resources, want 3", len(ts.WrittenResources))
+	}
+	parentHash, ok := processing.ResourceAttribute(ts.WrittenResources[0], processing.ContentHashAttribute)
+	if !ok {
+		t.Fatalf("parent Observation has no ContentHashAttribute")
+	}
+	for _, d := range ts.WrittenResources[1:] {
+		if got, _ := processing.ResourceAttribute(d, processing.ContentHashAttribute); got != parentHash {
+			t.Errorf("Attribute(ContentHashAttribute) = %q, want the parent's %q", got, parentHash)
+		}
+		if got := d.SourceURL(); got != "https://example.com/Observation_0.ndjson" {
+			t.Errorf("SourceURL() = %q, want the parent's source URL", got)
+		}
+		if got, _ := processing.ResourceAttribute(d, processing.ParentObservationIDAttribute); got != "bp" {
+			t.Errorf("Attribute(ParentObservationIDAttribute) = %q, want %q", got, "bp")
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// maxOpenPartitionFiles is the maximum number of files a partitioned NDJSON
+// sink keeps open at once.
+const maxOpenPartitionFiles = 100
+
+// defaultPartitionWriteBufferSize is smaller than DefaultNDJSONWriteBufferSize,
+// as there may be up to maxOpenPartitionFiles buffers at a time.
+const defaultPartitionWriteBufferSize = 64 * 1024
+
+// PartitionFunction returns the partition key for a resource, which is used as
+// the name (without extension) of the file the resource is written to.
+type PartitionFunction func(resource ResourceWrapper) (string, error)
+
+type partitionFile struct {
+	key  string
+	f    *os.File
+	w    *bufio.Writer
+	elem *list.Element
+}
+
+func (pf *partitionFile) close() error {
+	if err := pf.w.Flush(); err != nil {
+		pf.f.Close()
+		return err
+	}
+	return pf.f.Close()
+}
+
+type partitionedNDJSONSink struct {
+	directory       string
+	partitionFunc   PartitionFunction
+	maxOpenFiles    int
+	writeBufferSize int
+
+	mu sync.Mutex
+	// open holds the currently open files, and lru orders their keys from most
+	// to least recently written.
+	open map[string]*partitionFile
+	lru  *list.List
+	// created records the partitions whose files have been created by this
+	// sink, so that they are appended to (rather than truncated) if reopened.
+	created map[string]bool
+}
+
+// Assert partitionedNDJSONSink satisfies the Sink interface.
+var _ Sink = &partitionedNDJSONSink{}
+
+// NewPartitionedNDJSONSink creates a new Sink which writes each resource to
+// the NDJSON file {directory}/{key}.ndjson, where key is returned by
+// partitionFunc. Any existing file for a partition is overwritten. Partition
+// keys must be valid file names, and may not contain path separators.
+//
+// Files are opened lazily when the first resource for a partition is written.
+// To avoid running out of file descriptors when there are many partitions, at
+// most 100 files are kept open at a time; the least recently written file is
+// closed (and later reopened for appending if needed) when the limit is
+// reached. Finalize flushes and closes all files. As for NewNDJSONSink, lines
+// are separated by \n, and files have no byte order mark.
+//
+// It is threadsafe to call Write on this Sink from multiple goroutines.
+func NewPartitionedNDJSONSink(directory string, partitionFunc PartitionFunction) (Sink, error) {
+	return NewPartitionedNDJSONSinkWithOptions(directory, partitionFunc, nil)
+}
+
+// PartitionedNDJSONSinkOptions contains optional parameters used by
+// NewPartitionedNDJSONSinkWithOptions.
+type PartitionedNDJSONSinkOptions struct {
+	// The size in bytes of the write buffer of each open file. Defaults to
+	// 64KiB, as up to 100 files may be open at a time.
+	WriteBufferSize int
+}
+
+// NewPartitionedNDJSONSinkWithOptions is like NewPartitionedNDJSONSink, but
+// allows optional parameters to be set.
+func NewPartitionedNDJSONSinkWithOptions(directory string, partitionFunc PartitionFunction, opts *PartitionedNDJSONSinkOptions) (Sink, error) {
+	if opts == nil {
+		opts = &PartitionedNDJSONSinkOptions{}
+	}
+	writeBufferSize := opts.WriteBufferSize
+	if writeBufferSize <= 0 {
+		writeBufferSize = defaultPartitionWriteBufferSize
+	}
+	if stat, err := os.Stat(directory); err != nil {
+		return nil, fmt.Errorf("could not stat directory %q - %w", directory, err)
+	} else if !stat.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", directory)
+	}
+	return &partitionedNDJSONSink{
+		directory:       directory,
+		partitionFunc:   partitionFunc,
+		maxOpenFiles:    maxOpenPartitionFiles,
+		writeBufferSize: writeBufferSize,
+		open:            map[string]*partitionFile{},
+		lru:             list.New(),
+		created:         map[string]bool{},
+	}, nil
+}
+
+func (pns *partitionedNDJSONSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	key, err := pns.partitionFunc(resource)
+	if err != nil {
+		return fmt.Errorf("failed to compute partition key: %w", err)
+	}
+	if key == "" || key == "." || key == ".." || strings.ContainsAny(key, `/\`) {
+		return fmt.Errorf("invalid partition key %q", key)
+	}
+	json, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	json, err = normalizeNDJSONLine(json)
+	if err != nil {
+		return err
+	}
+
+	pns.mu.Lock()
+	defer pns.mu.Unlock()
+	pf, err := pns.getFile(key)
+	if err != nil {
+		return err
+	}
+	if _, err := pf.w.Write(json); err != nil {
+		return fmt.Errorf("failed to write to partition %s: %w", key, err)
+	}
+	if err := pf.w.WriteByte('\n'); err != nil {
+		return fmt.Errorf("failed to write to partition %s: %w", key, err)
+	}
+	return nil
+}
+
+// getFile returns the open file for the partition, opening it (and closing the
+// least recently used file if necessary) if it is not already open. It must be
+// called with pns.mu held.
+func (pns *partitionedNDJSONSink) getFile(key string) (*partitionFile, error) {
+	if pf, ok := pns.open[key]; ok {
+		pns.lru.MoveToFront(pf.elem)
+		return pf, nil
+	}
+
+	if len(pns.open) >= pns.maxOpenFiles {
+		oldest := pns.lru.Back().Value.(*partitionFile)
+		pns.lru.Remove(oldest.elem)
+		delete(pns.open, oldest.key)
+		if err := oldest.close(); err != nil {
+			return nil, fmt.Errorf("failed to close partition %s: %w", oldest.key, err)
+		}
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if pns.created[key] {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	f, err := os.OpenFile(filepath.Join(pns.directory, key+".ndjson"), flags, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open partition %s: %w", key, err)
+	}
+	pns.created[key] = true
+	pf := &partitionFile{key: key, f: f, w: bufio.NewWriterSize(f, pns.writeBufferSize)}
+	pf.elem = pns.lru.PushFront(pf)
+	pns.open[key] = pf
+	return pf, nil
+}
+
+func (pns *partitionedNDJSONSink) Finalize(ctx context.Context) error {
+	pns.mu.Lock()
+	defer pns.mu.Unlock()
+	var firstErr error
+	for key, pf := range pns.open {
+		if err := pf.close(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to close partition %s: %w", key, err)
+		}
+	}
+	pns.open = map[string]*partitionFile{}
+	pns.lru.Init()
+	return firstErr
+}
@@ -0,0 +1,152 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestPartitionedNDJSONSink(t *testing.T) {
+	ctx := context.Background()
+	tempdir := t.TempDir()
+	// A stale file from a previous run should be overwritten.
+	if err := os.WriteFile(filepath.Join(tempdir, "p0.ndjson"), []byte("stale\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	partitionBySourceURL := func(resource processing.ResourceWrapper) (string, error) {
+		return resource.SourceURL(), nil
+	}
+	sink, err := processing.NewPartitionedNDJSONSink(tempdir, partitionBySourceURL)
+	if err != nil {
+		t.Fatalf("NewPartitionedNDJSONSink() returned unexpected error: %v", err)
+	}
+
+	// Use more partitions than the sink keeps open at once, and write to each
+	// partition several times, so that files are closed and reopened.
+	numPartitions := 150
+	numRounds := 3
+	for round := 0; round < numRounds; round++ {
+		for p := 0; p < numPartitions; p++ {
+			r := &testResourceWrapper{
+				resourceType: cpb.ResourceTypeCode_PATIENT,
+				sourceURL:    fmt.Sprintf("p%d", p),
+				json:         []byte(fmt.Sprintf("%d-%d", p, round)),
+			}
+			if err := sink.Write(ctx, r); err != nil {
+				t.Fatalf("sink.Write() returned unexpected error: %v", err)
+			}
+		}
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("sink.Finalize() returned unexpected error: %v", err)
+	}
+
+	files, err := os.ReadDir(tempdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != numPartitions {
+		t.Errorf("unexpected number of files written. got: %d, want: %d", len(files), numPartitions)
+	}
+	for p := 0; p < numPartitions; p++ {
+		data, err := os.ReadFile(filepath.Join(tempdir, fmt.Sprintf("p%d.ndjson", p)))
+		if err != nil {
+			t.Fatalf("failed to read partition %d: %v", p, err)
+		}
+		got := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		var want []string
+		for round := 0; round < numRounds; round++ {
+			want = append(want, fmt.Sprintf("%d-%d", p, round))
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("unexpected data in partition %d (-want +got):\n%s", p, diff)
+		}
+	}
+}
+
+func TestPartitionedNDJSONSink_InvalidKey(t *testing.T) {
+	ctx := context.Background()
+	for _, key := range []string{"", "..", "a/b"} {
+		sink, err := processing.NewPartitionedNDJSONSink(t.TempDir(), func(processing.ResourceWrapper) (string, error) { return key, nil })
+		if err != nil {
+			t.Fatalf("NewPartitionedNDJSONSink() returned unexpected error: %v", err)
+		}
+		if err := sink.Write(ctx, &testResourceWrapper{json: []byte("{}")}); err == nil {
+			t.Errorf("sink.Write() with partition key %q returned nil error", key)
+		}
+	}
+}
+
+func TestPartitionedNDJSONSink_ResourcesLargerThanWriteBuffer(t *testing.T) {
+	ctx := context.Background()
+	tempdir := t.TempDir()
+	sink, err := processing.NewPartitionedNDJSONSinkWithOptions(tempdir, func(processing.ResourceWrapper) (string, error) { return "p", nil }, &processing.PartitionedNDJSONSinkOptions{WriteBufferSize: 16})
+	if err != nil {
+		t.Fatalf("NewPartitionedNDJSONSinkWithOptions() returned unexpected error: %v", err)
+	}
+	large := strings.Repeat("a", 100)
+	for _, json := range []string{large, "b", large} {
+		if err := sink.Write(ctx, &testResourceWrapper{json: []byte(json)}); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(tempdir, "p.ndjson"))
+	if err != nil {
+		t.Fatalf("failed to read partition file: %v", err)
+	}
+	want := large + "\nb\n" + large + "\n"
+	if string(got) != want {
+		t.Errorf("unexpected partition file contents. got: %q, want: %q", got, want)
+	}
+}
+
+func TestPartitionedNDJSONSink_LFLineEndingsWithoutBOM(t *testing.T) {
+	ctx := context.Background()
+	tempdir := t.TempDir()
+	sink, err := processing.NewPartitionedNDJSONSink(tempdir, func(processing.ResourceWrapper) (string, error) { return "p", nil })
+	if err != nil {
+		t.Fatalf("NewPartitionedNDJSONSink() returned unexpected error: %v", err)
+	}
+	for _, json := range []string{"\xef\xbb\xbf{\"id\":\"1\"}", "{\r\n  \"id\": \"2\"\r\n}"} {
+		if err := sink.Write(ctx, &testResourceWrapper{json: []byte(json)}); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("Finalize() returned unexpected error: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(tempdir, "p.ndjson"))
+	if err != nil {
+		t.Fatalf("failed to read partition file: %v", err)
+	}
+	want := "{\"id\":\"1\"}\n{\"id\":\"2\"}\n"
+	if string(got) != want {
+		t.Errorf("unexpected partition file contents. got: %q, want: %q", got, want)
+	}
+}
@@ -0,0 +1,226 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/fhir/go/jsonformat"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// PatientIDAttribute is the attribute key set by the PatientBundleProcessor on
+// each Bundle it emits, holding the id of the Patient the Bundle is for. It is
+// not set on the Bundle of resources which belong to no patient.
+const PatientIDAttribute = "patient_id"
+
+// PatientBundleProcessorOptions contains optional parameters used by
+// NewPatientBundleProcessor.
+type PatientBundleProcessorOptions struct {
+	// If greater than zero, buffered resources are spilled to temporary files
+	// whenever more than this many are held in memory.
+	MaxBufferedResources int
+	// The directory temporary files are created in. Defaults to os.TempDir().
+	SpillDirectory string
+}
+
+type patientBundleProcessor struct {
+	BaseProcessor
+	unmarshaller *jsonformat.Unmarshaller
+	marshaller   *jsonformat.Marshaller
+
+	maxBuffered int
+
+	// buffered holds resource JSON by patient id, with resources belonging to no
+	// patient held under the empty string.
+	buffered    map[string][][]byte
+	numBuffered int
+	spilled     *patientSpillStore
+}
+
+// Assert patientBundleProcessor satisfies the Processor interface.
+var _ Processor = &patientBundleProcessor{}
+
+// NewPatientBundleProcessor creates a Processor which groups resources by the
+// patient they belong to, and on Finalize outputs a collection Bundle per
+// patient containing the Patient and all of their resources. No resources are
+// output until Finalize.
+//
+// A resource belongs to a patient if it is that Patient, or if its patient,
+// subject or beneficiary element references a Patient. Resources which belong
+// to no patient are output in a final Bundle without an id. Each patient's
+// Bundle has the same id as the Patient, and the PatientIDAttribute set.
+//
+// As all resources are held until Finalize, MaxBufferedResources may be set
+// to limit memory use by spilling resources to temporary files.
+func NewPatientBundleProcessor(opts *PatientBundleProcessorOptions) (Processor, error) {
+	if opts == nil {
+		opts = &PatientBundleProcessorOptions{}
+	}
+	unmarshaller, err := jsonformat.NewUnmarshallerWithoutValidation("UTC", fhirversion.R4)
+	if err != nil {
+		return nil, err
+	}
+	marshaller, err := jsonformat.NewMarshaller(false, "", "", fhirversion.R4)
+	if err != nil {
+		return nil, err
+	}
+	return &patientBundleProcessor{
+		unmarshaller: unmarshaller,
+		marshaller:   marshaller,
+		maxBuffered:  opts.MaxBufferedResources,
+		buffered:     map[string][][]byte{},
+		spilled:      newPatientSpillStore(opts.SpillDirectory, "patient-bundles-"),
+	}, nil
+}
+
+type patientReference struct {
+	Reference string `json:"reference"`
+}
+
+// compartmentJSON holds the fields used to find the patient a resource belongs
+// to.
+type compartmentJSON struct {
+	ID          string            `json:"id"`
+	Patient     *patientReference `json:"patient"`
+	Subject     *patientReference `json:"subject"`
+	Beneficiary *patientReference `json:"beneficiary"`
+}
+
+// patientID returns the id of the patient the resource belongs to, or the
+// empty string if there is none.
+func patientID(resourceType cpb.ResourceTypeCode_Value, resourceJSON []byte) (string, error) {
+	var c compartmentJSON
+	if err := json.Unmarshal(resourceJSON, &c); err != nil {
+		return "", err
+	}
+	if resourceType == cpb.ResourceTypeCode_PATIENT {
+		return c.ID, nil
+	}
+	for _, ref := range []*patientReference{c.Patient, c.Subject, c.Beneficiary} {
+		if ref == nil {
+			continue
+		}
+		// Handles relative, absolute and versioned references.
+		parts := strings.Split(ref.Reference, "/")
+		for i := len(parts) - 2; i >= 0; i-- {
+			if parts[i] == "Patient" && parts[i+1] != "" {
+				return parts[i+1], nil
+			}
+		}
+	}
+	return "", nil
+}
+
+func (pbp *patientBundleProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	id, err := patientID(resource.Type(), rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	// The JSON may be reused by the caller, so is copied.
+	pbp.buffered[id] = append(pbp.buffered[id], append([]byte(nil), rawJSON...))
+	pbp.numBuffered++
+	if pbp.maxBuffered > 0 && pbp.numBuffered > pbp.maxBuffered {
+		return pbp.spill()
+	}
+	return nil
+}
+
+// spill appends all buffered resources to temporary files.
+func (pbp *patientBundleProcessor) spill() error {
+	for id, resources := range pbp.buffered {
+		if err := pbp.spilled.append(id, resources); err != nil {
+			return err
+		}
+	}
+	pbp.buffered = map[string][][]byte{}
+	pbp.numBuffered = 0
+	return nil
+}
+
+type bundleEntryJSON struct {
+	Resource json.RawMessage `json:"resource"`
+}
+
+type bundleJSON struct {
+	ResourceType string            `json:"resourceType"`
+	ID           string            `json:"id,omitempty"`
+	Type         string            `json:"type"`
+	Entry        []bundleEntryJSON `json:"entry"`
+}
+
+func (pbp *patientBundleProcessor) Finalize(ctx context.Context) error {
+	defer pbp.spilled.cleanup()
+
+	ids := pbp.spilled.patientIDs()
+	for id := range pbp.buffered {
+		if !pbp.spilled.has(id) {
+			ids = append(ids, id)
+		}
+	}
+	// Sorting puts the resources belonging to no patient first, but they are
+	// output last.
+	sort.Strings(ids)
+	if len(ids) > 0 && ids[0] == "" {
+		ids = append(ids[1:], "")
+	}
+
+	for _, id := range ids {
+		resources, err := pbp.spilled.read(id)
+		if err != nil {
+			return fmt.Errorf("failed to read spilled resources: %w", err)
+		}
+		resources = append(resources, pbp.buffered[id]...)
+		if err := pbp.outputBundle(ctx, id, resources); err != nil {
+			return err
+		}
+	}
+	pbp.buffered = map[string][][]byte{}
+	pbp.numBuffered = 0
+	return nil
+}
+
+func (pbp *patientBundleProcessor) outputBundle(ctx context.Context, patientID string, resources [][]byte) error {
+	b := bundleJSON{ResourceType: "Bundle", ID: patientID, Type: "collection"}
+	for _, r := range resources {
+		b.Entry = append(b.Entry, bundleEntryJSON{Resource: r})
+	}
+	bundle, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	rw := &resourceWrapper{
+		unmarshaller: pbp.unmarshaller,
+		marshaller:   pbp.marshaller,
+		resourceType: cpb.ResourceTypeCode_BUNDLE,
+		jsonMut:      &sync.Mutex{},
+		json:         bundle,
+	}
+	if patientID != "" {
+		rw.SetAttribute(PatientIDAttribute, patientID)
+	}
+	return pbp.Output(ctx, rw)
+}
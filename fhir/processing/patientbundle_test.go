@@ -0,0 +1,132 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestPatientBundleProcessor(t *testing.T) {
+	resources := []struct {
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+	}{
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1"}`},
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"2","subject":{"reference":"Patient/1"}}`},
+		{cpb.ResourceTypeCode_ORGANIZATION, `{"resourceType":"Organization","id":"3"}`},
+		{cpb.ResourceTypeCode_ENCOUNTER, `{"resourceType":"Encounter","id":"4","subject":{"reference":"https://example.com/fhir/Patient/5/_history/1"}}`},
+		{cpb.ResourceTypeCode_COVERAGE, `{"resourceType":"Coverage","id":"6","beneficiary":{"reference":"Patient/1"}}`},
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"7","subject":{"reference":"Group/1"}}`},
+	}
+	type bundleSummary struct {
+		ID        string
+		PatientID string
+		Entries   []string
+	}
+	want := []bundleSummary{
+		{ID: "1", PatientID: "1", Entries: []string{"Patient/1", "Observation/2", "Coverage/6"}},
+		{ID: "5", PatientID: "5", Entries: []string{"Encounter/4"}},
+		{Entries: []string{"Organization/3", "Observation/7"}},
+	}
+
+	cases := []struct {
+		name                 string
+		maxBufferedResources int
+	}{
+		{name: "InMemory"},
+		{name: "Spilled", maxBufferedResources: 2},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			spillDir := t.TempDir()
+			pbp, err := processing.NewPatientBundleProcessor(&processing.PatientBundleProcessorOptions{
+				MaxBufferedResources: tc.maxBufferedResources,
+				SpillDirectory:       spillDir,
+			})
+			if err != nil {
+				t.Fatalf("NewPatientBundleProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{pbp}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			for _, r := range resources {
+				if err := p.Process(ctx, r.resourceType, "url", []byte(r.json)); err != nil {
+					t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", r.json, err)
+				}
+			}
+			if len(ts.WrittenResources) != 0 {
+				t.Errorf("resources were output before Finalize: %v", ts.WrittenResources)
+			}
+			if err := p.Finalize(ctx); err != nil {
+				t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+			}
+
+			var got []bundleSummary
+			for _, r := range ts.WrittenResources {
+				if r.Type() != cpb.ResourceTypeCode_BUNDLE {
+					t.Errorf("unexpected resource type output. got: %s, want: BUNDLE", r.Type())
+				}
+				// Parsing the proto checks that the Bundle is valid.
+				if _, err := r.Proto(); err != nil && err != processing.ErrorDoNotModifyProto {
+					t.Errorf("Bundle is not valid FHIR: %v", err)
+				}
+				bundleJSON, err := r.JSON()
+				if err != nil {
+					t.Fatalf("JSON() returned unexpected error: %v", err)
+				}
+				var bundle struct {
+					ID    string `json:"id"`
+					Type  string `json:"type"`
+					Entry []struct {
+						Resource struct {
+							ResourceType string `json:"resourceType"`
+							ID           string `json:"id"`
+						} `json:"resource"`
+					} `json:"entry"`
+				}
+				if err := json.Unmarshal(bundleJSON, &bundle); err != nil {
+					t.Fatalf("failed to unmarshal Bundle: %v", err)
+				}
+				if bundle.Type != "collection" {
+					t.Errorf("unexpected Bundle type. got: %s, want: collection", bundle.Type)
+				}
+				s := bundleSummary{ID: bundle.ID}
+				s.PatientID, _ = processing.ResourceAttribute(r, processing.PatientIDAttribute)
+				for _, e := range bundle.Entry {
+					s.Entries = append(s.Entries, e.Resource.ResourceType+"/"+e.Resource.ID)
+				}
+				got = append(got, s)
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Errorf("unexpected Bundles output (-want +got):\n%s", diff)
+			}
+
+			if entries, err := os.ReadDir(spillDir); err != nil || len(entries) != 0 {
+				t.Errorf("temporary files were not cleaned up: %v, %v", entries, err)
+			}
+		})
+	}
+}
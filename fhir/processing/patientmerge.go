@@ -0,0 +1,485 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/fhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+var patientMergeCounter *metrics.Counter = metrics.NewCounter("patient-merge-counter", "Count of Patient resources found to refer to the same person as another Patient resource. The counter is tagged by the action taken ex) MERGED.", "1", aggregation.Count, "Action")
+
+// PatientMergeStrategy determines what a PatientMergeProcessor does with
+// Patient resources which refer to the same person.
+type PatientMergeStrategy int
+
+const (
+	// MergePatients replaces each set of matching Patients with a single
+	// survivor, which gains the identifiers of the others and a "replaces" link
+	// to each of them. The others are dropped, and references to them from
+	// other resources are rewritten to refer to the survivor.
+	MergePatients PatientMergeStrategy = iota
+	// LinkPatients keeps every Patient, adding "seealso" links between the
+	// survivor of each set of matching Patients and the others. References are
+	// not rewritten.
+	LinkPatients
+)
+
+// PatientMergeProcessorOptions contains optional parameters used by
+// NewPatientMergeProcessorWithOptions.
+type PatientMergeProcessorOptions struct {
+	// If set, only shared identifiers with one of these systems are considered
+	// a match. Otherwise, identifiers with any (non-empty) system are.
+	IdentifierSystems []string
+}
+
+type bufferedPatient struct {
+	resource ResourceWrapper
+	res      map[string]any
+	id       string
+}
+
+type patientMergeProcessor struct {
+	BaseProcessor
+	strategy          PatientMergeStrategy
+	identifierSystems map[string]bool
+	patients          []bufferedPatient
+	// referencing holds the non-Patient resources which may refer to a Patient,
+	// when merging.
+	referencing []ResourceWrapper
+}
+
+// Assert patientMergeProcessor satisfies the Processor interface.
+var _ Processor = &patientMergeProcessor{}
+
+// NewPatientMergeProcessor creates a Processor which finds Patient resources
+// which refer to the same person, and merges or links them according to
+// strategy.
+//
+// Two Patients match if either has a link (of any type) to the other, or if
+// they share an identifier with the same system and value. Identifiers without
+// a system are ignored, as their values may be from unrelated namespaces.
+// Matching is transitive, so if A matches B and B matches C, all three are
+// merged even if A and C do not match directly.
+//
+// Within each set of matching Patients, the survivor is chosen from those
+// without a "replaced-by" link (or from all of them, if every Patient has
+// one), preferring the most recent meta.lastUpdated, then the lowest id.
+//
+// As matches can only be found once every Patient has been seen, Patients are
+// held until Finalize. When merging, so are all other resources which may
+// refer to a Patient, which requires enough memory to hold most of a batch.
+// Only relative references (Patient/id) are rewritten; absolute and
+// conditional references, and references from resources which passed through
+// an earlier batch, are not. Fields of the merged-away Patients other than
+// their identifiers (such as names and addresses) are discarded rather than
+// combined with the survivor's.
+func NewPatientMergeProcessor(strategy PatientMergeStrategy) (Processor, error) {
+	return NewPatientMergeProcessorWithOptions(strategy, nil)
+}
+
+// NewPatientMergeProcessorWithOptions is like NewPatientMergeProcessor, but
+// with the given options. opts may be nil.
+func NewPatientMergeProcessorWithOptions(strategy PatientMergeStrategy, opts *PatientMergeProcessorOptions) (Processor, error) {
+	switch strategy {
+	case MergePatients, LinkPatients:
+	default:
+		return nil, fmt.Errorf("unknown PatientMergeStrategy %d", strategy)
+	}
+	pmp := &patientMergeProcessor{strategy: strategy}
+	if opts != nil && len(opts.IdentifierSystems) > 0 {
+		pmp.identifierSystems = map[string]bool{}
+		for _, s := range opts.IdentifierSystems {
+			pmp.identifierSystems[s] = true
+		}
+	}
+	return pmp, nil
+}
+
+func (pmp *patientMergeProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	if resource.Type() != cpb.ResourceTypeCode_PATIENT {
+		if pmp.strategy == MergePatients && bytes.Contains(rawJSON, []byte("Patient/")) {
+			pmp.referencing = append(pmp.referencing, resource)
+			return nil
+		}
+		return pmp.Output(ctx, resource)
+	}
+
+	res, err := decodeResourceJSON(rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	id, _ := res["id"].(string)
+	if id == "" {
+		return pmp.Output(ctx, resource)
+	}
+	pmp.patients = append(pmp.patients, bufferedPatient{resource: resource, res: res, id: id})
+	return nil
+}
+
+func (pmp *patientMergeProcessor) Finalize(ctx context.Context) error {
+	patients, referencing := pmp.patients, pmp.referencing
+	pmp.patients, pmp.referencing = nil, nil
+
+	// Find the sets of matching patients with a union-find over their indices.
+	parent := make([]int, len(patients))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	union := func(i, j int) {
+		if ri, rj := find(i), find(j); ri != rj {
+			parent[max(ri, rj)] = min(ri, rj)
+		}
+	}
+	byID := map[string]int{}
+	byIdentifier := map[string]int{}
+	for i, p := range patients {
+		if j, ok := byID[p.id]; ok {
+			union(i, j)
+		} else {
+			byID[p.id] = i
+		}
+		for _, key := range pmp.identifierKeys(p.res) {
+			if j, ok := byIdentifier[key]; ok {
+				union(i, j)
+			} else {
+				byIdentifier[key] = i
+			}
+		}
+	}
+	for i, p := range patients {
+		for _, l := range patientLinks(p.res) {
+			if j, ok := byID[l.target]; ok {
+				union(i, j)
+			}
+		}
+	}
+	var roots []int
+	groups := map[int][]int{}
+	for i := range patients {
+		r := find(i)
+		if groups[r] == nil {
+			roots = append(roots, r)
+		}
+		groups[r] = append(groups[r], i)
+	}
+
+	// survivors maps the ids of merged-away patients to the id of their
+	// survivor.
+	survivors := map[string]string{}
+	for _, r := range roots {
+		members := groups[r]
+		if len(members) == 1 {
+			if err := pmp.Output(ctx, patients[members[0]].resource); err != nil {
+				return err
+			}
+			continue
+		}
+		s := choosePatientSurvivor(patients, members)
+		var err error
+		if pmp.strategy == MergePatients {
+			err = pmp.merge(ctx, patients, members, s, survivors)
+		} else {
+			err = pmp.link(ctx, patients, members, s)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, resource := range referencing {
+		if err := pmp.rewriteReferences(resource, survivors); err != nil {
+			return err
+		}
+		if err := pmp.Output(ctx, resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// merge outputs the survivor s of the matching patients members, with the
+// identifiers of the others and links to them, and adds the ids of the others
+// to survivors.
+func (pmp *patientMergeProcessor) merge(ctx context.Context, patients []bufferedPatient, members []int, s int, survivors map[string]string) error {
+	sp := patients[s]
+	memberIDs := map[string]bool{}
+	for _, m := range members {
+		memberIDs[patients[m].id] = true
+	}
+
+	identifiers, _ := sp.res["identifier"].([]any)
+	seen := map[string]bool{}
+	for _, i := range identifiers {
+		seen[identifierDedupKey(i)] = true
+	}
+	var merged []string
+	mergedIDs := map[string]bool{}
+	for _, m := range members {
+		if m == s {
+			continue
+		}
+		p := patients[m]
+		others, _ := p.res["identifier"].([]any)
+		for _, i := range others {
+			if k := identifierDedupKey(i); !seen[k] {
+				seen[k] = true
+				identifiers = append(identifiers, i)
+			}
+		}
+		if p.id != sp.id && !mergedIDs[p.id] {
+			mergedIDs[p.id] = true
+			merged = append(merged, p.id)
+			survivors[p.id] = sp.id
+		}
+	}
+	if len(identifiers) > 0 {
+		sp.res["identifier"] = identifiers
+	}
+
+	// Links between members are replaced with a "replaces" link to each of the
+	// merged-away patients.
+	links, _ := sp.res["link"].([]any)
+	var kept []any
+	for _, l := range links {
+		if target, ok := patientLinkTarget(l); ok && memberIDs[target] {
+			continue
+		}
+		kept = append(kept, l)
+	}
+	sort.Strings(merged)
+	for _, id := range merged {
+		kept = append(kept, newPatientLink(id, "replaces"))
+	}
+	sp.res["link"] = kept
+
+	if err := setResourceJSON(sp.resource, sp.res); err != nil {
+		return err
+	}
+	if err := patientMergeCounter.Record(ctx, int64(len(members)-1), "MERGED"); err != nil {
+		return err
+	}
+	log.Infof("Merged Patients %s into Patient %s.", strings.Join(merged, ", "), sp.id)
+	return pmp.Output(ctx, sp.resource)
+}
+
+// link outputs each of the matching patients members, with "seealso" links
+// between the survivor s and the others (where they are not already linked).
+func (pmp *patientMergeProcessor) link(ctx context.Context, patients []bufferedPatient, members []int, s int) error {
+	addLink := func(p bufferedPatient, target string) bool {
+		if p.id == target {
+			return false
+		}
+		for _, l := range patientLinks(p.res) {
+			if l.target == target {
+				return false
+			}
+		}
+		links, _ := p.res["link"].([]any)
+		p.res["link"] = append(links, newPatientLink(target, "seealso"))
+		return true
+	}
+	changed := map[int]bool{}
+	for _, m := range members {
+		if m == s {
+			continue
+		}
+		if addLink(patients[m], patients[s].id) {
+			changed[m] = true
+		}
+		if addLink(patients[s], patients[m].id) {
+			changed[s] = true
+		}
+	}
+	for _, m := range members {
+		if changed[m] {
+			if err := setResourceJSON(patients[m].resource, patients[m].res); err != nil {
+				return err
+			}
+		}
+		if err := pmp.Output(ctx, patients[m].resource); err != nil {
+			return err
+		}
+	}
+	return patientMergeCounter.Record(ctx, int64(len(members)-1), "LINKED")
+}
+
+// rewriteReferences rewrites the relative references within resource to any
+// of the merged-away patients in survivors.
+func (pmp *patientMergeProcessor) rewriteReferences(resource ResourceWrapper, survivors map[string]string) error {
+	if len(survivors) == 0 {
+		return nil
+	}
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	res, err := decodeResourceJSON(rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	rewritten := 0
+	walkReferenceStrings(res, func(ref string) string {
+		if !strings.HasPrefix(ref, "Patient/") {
+			return ref
+		}
+		return rewriteReference(ref, func(id string) string {
+			if s, ok := survivors[id]; ok {
+				rewritten++
+				return s
+			}
+			return id
+		})
+	})
+	if rewritten == 0 {
+		return nil
+	}
+	return setResourceJSON(resource, res)
+}
+
+// identifierKeys returns the system|value keys of the identifiers of the given
+// Patient which are considered for matching.
+func (pmp *patientMergeProcessor) identifierKeys(res map[string]any) []string {
+	identifiers, _ := res["identifier"].([]any)
+	var keys []string
+	for _, i := range identifiers {
+		obj, _ := i.(map[string]any)
+		system, _ := obj["system"].(string)
+		value, _ := obj["value"].(string)
+		if system == "" || value == "" {
+			continue
+		}
+		if pmp.identifierSystems != nil && !pmp.identifierSystems[system] {
+			continue
+		}
+		keys = append(keys, system+"|"+value)
+	}
+	return keys
+}
+
+// identifierDedupKey returns a key identifying the given identifier JSON value, for
+// removing duplicates when merging.
+func identifierDedupKey(identifier any) string {
+	obj, _ := identifier.(map[string]any)
+	system, _ := obj["system"].(string)
+	value, _ := obj["value"].(string)
+	if value == "" {
+		// Identifiers without a value are compared in full.
+		b, _ := json.Marshal(identifier)
+		return string(b)
+	}
+	return system + "|" + value
+}
+
+type patientLink struct {
+	target, linkType string
+}
+
+// patientLinks returns the links of the given Patient to other Patients (links
+// to RelatedPerson resources are ignored).
+func patientLinks(res map[string]any) []patientLink {
+	links, _ := res["link"].([]any)
+	var out []patientLink
+	for _, l := range links {
+		target, ok := patientLinkTarget(l)
+		if !ok {
+			continue
+		}
+		linkType, _ := l.(map[string]any)["type"].(string)
+		out = append(out, patientLink{target: target, linkType: linkType})
+	}
+	return out
+}
+
+// patientLinkTarget returns the id of the Patient referred to by the given
+// Patient.link JSON value.
+func patientLinkTarget(link any) (string, bool) {
+	obj, _ := link.(map[string]any)
+	other, _ := obj["other"].(map[string]any)
+	ref, _ := other["reference"].(string)
+	id, ok := strings.CutPrefix(ref, "Patient/")
+	if !ok {
+		return "", false
+	}
+	id, _, _ = strings.Cut(id, "/_history/")
+	return id, id != ""
+}
+
+func newPatientLink(id, linkType string) map[string]any {
+	return map[string]any{
+		"other": map[string]any{"reference": "Patient/" + id},
+		"type":  linkType,
+	}
+}
+
+// choosePatientSurvivor returns the index of the patient which survives a merge of the
+// given matching patients.
+func choosePatientSurvivor(patients []bufferedPatient, members []int) int {
+	var candidates []int
+	for _, m := range members {
+		replaced := false
+		for _, l := range patientLinks(patients[m].res) {
+			if l.linkType == "replaced-by" {
+				replaced = true
+			}
+		}
+		if !replaced {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = members
+	}
+	lastUpdated := func(i int) time.Time {
+		meta, _ := patients[i].res["meta"].(map[string]any)
+		s, _ := meta["lastUpdated"].(string)
+		t, err := fhir.ParseFHIRInstant(s)
+		if err != nil {
+			return time.Time{}
+		}
+		return t
+	}
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		bt, ct := lastUpdated(best), lastUpdated(c)
+		if ct.After(bt) || (ct.Equal(bt) && patients[c].id < patients[best].id) {
+			best = c
+		}
+	}
+	return best
+}
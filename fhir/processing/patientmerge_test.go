@@ -0,0 +1,162 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+type typedResource struct {
+	resourceType cpb.ResourceTypeCode_Value
+	json         string
+}
+
+// runPatientMergeProcessor processes and finalizes the given resources,
+// returning the JSON of the written resources, in order.
+func runPatientMergeProcessor(t *testing.T, p processing.Processor, resources []typedResource) []map[string]any {
+	t.Helper()
+	ts := &processing.TestSink{}
+	pipeline, err := processing.NewPipeline([]processing.Processor{p}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	for _, r := range resources {
+		if err := pipeline.Process(ctx, r.resourceType, "", []byte(r.json)); err != nil {
+			t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+		}
+	}
+	if err := pipeline.Finalize(ctx); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+	var written []map[string]any
+	for _, w := range ts.WrittenResources {
+		rawJSON, err := w.JSON()
+		if err != nil {
+			t.Fatalf("JSON() returned unexpected error: %v", err)
+		}
+		var res map[string]any
+		if err := json.Unmarshal(rawJSON, &res); err != nil {
+			t.Fatalf("failed to unmarshal written resource: %v", err)
+		}
+		written = append(written, res)
+	}
+	return written
+}
+
+func mustUnmarshal(t *testing.T, s string) map[string]any {
+	t.Helper()
+	var res map[string]any
+	if err := json.Unmarshal([]byte(s), &res); err != nil {
+		t.Fatalf("failed to unmarshal %s: %v", s, err)
+	}
+	return res
+}
+
+func TestPatientMergeProcessor_Merge(t *testing.T) {
+	p, err := processing.NewPatientMergeProcessor(processing.MergePatients)
+	if err != nil {
+		t.Fatalf("NewPatientMergeProcessor() returned unexpected error: %v", err)
+	}
+	got := runPatientMergeProcessor(t, p, []typedResource{
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"a","meta":{"lastUpdated":"2020-01-01T00:00:00Z"},"identifier":[{"system":"mrn","value":"1"},{"system":"ssn","value":"2"}]}`},
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"o1","status":"final","code":{"text":"c"},"subject":{"reference":"Patient/a"}}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"b","meta":{"lastUpdated":"2021-01-01T00:00:00Z"},"identifier":[{"system":"mrn","value":"1"}]}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"c","identifier":[{"system":"mrn","value":"3"}]}`},
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"o2","status":"final","code":{"text":"c"}}`},
+		// An identifier without a system is not a match.
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"d","identifier":[{"value":"1"}]}`},
+	})
+	want := []map[string]any{
+		// o2 does not refer to a Patient, so it is not held until Finalize.
+		mustUnmarshal(t, `{"resourceType":"Observation","id":"o2","status":"final","code":{"text":"c"}}`),
+		mustUnmarshal(t, `{"resourceType":"Patient","id":"b","meta":{"lastUpdated":"2021-01-01T00:00:00Z"},"identifier":[{"system":"mrn","value":"1"},{"system":"ssn","value":"2"}],"link":[{"other":{"reference":"Patient/a"},"type":"replaces"}]}`),
+		mustUnmarshal(t, `{"resourceType":"Patient","id":"c","identifier":[{"system":"mrn","value":"3"}]}`),
+		mustUnmarshal(t, `{"resourceType":"Patient","id":"d","identifier":[{"value":"1"}]}`),
+		mustUnmarshal(t, `{"resourceType":"Observation","id":"o1","status":"final","code":{"text":"c"},"subject":{"reference":"Patient/b"}}`),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected written resources (-want +got):\n%s", diff)
+	}
+}
+
+func TestPatientMergeProcessor_MergeByLink(t *testing.T) {
+	p, err := processing.NewPatientMergeProcessor(processing.MergePatients)
+	if err != nil {
+		t.Fatalf("NewPatientMergeProcessor() returned unexpected error: %v", err)
+	}
+	// b is more recent, but has been replaced by a. c is linked to b, so is also
+	// merged into a.
+	got := runPatientMergeProcessor(t, p, []typedResource{
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"a","meta":{"lastUpdated":"2020-01-01T00:00:00Z"}}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"b","meta":{"lastUpdated":"2021-01-01T00:00:00Z"},"link":[{"other":{"reference":"Patient/a"},"type":"replaced-by"}]}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"c","link":[{"other":{"reference":"Patient/b"},"type":"seealso"},{"other":{"reference":"RelatedPerson/r"},"type":"seealso"}]}`},
+		{cpb.ResourceTypeCode_ENCOUNTER, `{"resourceType":"Encounter","id":"e","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Patient/c/_history/2"},"participant":[{"individual":{"reference":"Practitioner/c"}}]}`},
+	})
+	want := []map[string]any{
+		mustUnmarshal(t, `{"resourceType":"Patient","id":"a","meta":{"lastUpdated":"2020-01-01T00:00:00Z"},"link":[{"other":{"reference":"Patient/b"},"type":"replaces"},{"other":{"reference":"Patient/c"},"type":"replaces"}]}`),
+		mustUnmarshal(t, `{"resourceType":"Encounter","id":"e","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Patient/a/_history/2"},"participant":[{"individual":{"reference":"Practitioner/c"}}]}`),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected written resources (-want +got):\n%s", diff)
+	}
+}
+
+func TestPatientMergeProcessor_Link(t *testing.T) {
+	p, err := processing.NewPatientMergeProcessor(processing.LinkPatients)
+	if err != nil {
+		t.Fatalf("NewPatientMergeProcessor() returned unexpected error: %v", err)
+	}
+	got := runPatientMergeProcessor(t, p, []typedResource{
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"a","identifier":[{"system":"mrn","value":"1"}]}`},
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"o1","status":"final","code":{"text":"c"},"subject":{"reference":"Patient/b"}}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"b","identifier":[{"system":"mrn","value":"1"}]}`},
+	})
+	want := []map[string]any{
+		mustUnmarshal(t, `{"resourceType":"Observation","id":"o1","status":"final","code":{"text":"c"},"subject":{"reference":"Patient/b"}}`),
+		mustUnmarshal(t, `{"resourceType":"Patient","id":"a","identifier":[{"system":"mrn","value":"1"}],"link":[{"other":{"reference":"Patient/b"},"type":"seealso"}]}`),
+		mustUnmarshal(t, `{"resourceType":"Patient","id":"b","identifier":[{"system":"mrn","value":"1"}],"link":[{"other":{"reference":"Patient/a"},"type":"seealso"}]}`),
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected written resources (-want +got):\n%s", diff)
+	}
+}
+
+func TestPatientMergeProcessor_IdentifierSystems(t *testing.T) {
+	p, err := processing.NewPatientMergeProcessorWithOptions(processing.MergePatients, &processing.PatientMergeProcessorOptions{IdentifierSystems: []string{"mrn"}})
+	if err != nil {
+		t.Fatalf("NewPatientMergeProcessorWithOptions() returned unexpected error: %v", err)
+	}
+	got := runPatientMergeProcessor(t, p, []typedResource{
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"a","identifier":[{"system":"insurance","value":"1"}]}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"b","identifier":[{"system":"insurance","value":"1"}]}`},
+	})
+	if len(got) != 2 {
+		t.Errorf("Patients with a shared identifier in an ignored system were merged: %v", got)
+	}
+}
+
+func TestNewPatientMergeProcessor_Invalid(t *testing.T) {
+	if _, err := processing.NewPatientMergeProcessor(processing.PatientMergeStrategy(99)); err == nil {
+		t.Error("NewPatientMergeProcessor() with an unknown strategy succeeded, want error")
+	}
+}
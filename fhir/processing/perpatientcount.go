@@ -0,0 +1,129 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// UnknownPatient is the key under which PerPatientCountProcessor counts
+// resources which belong to no identifiable patient.
+const UnknownPatient = "unknown"
+
+// PatientResourceCounts holds the number of resources of each type belonging
+// to each patient, keyed by patient id.
+type PatientResourceCounts map[string]map[cpb.ResourceTypeCode_Value]int
+
+// PerPatientCountProcessor is a Processor which counts the resources of each
+// type belonging to each patient as they pass through, for data quality review
+// of an export (for example, to catch patients with no claims). Resources are
+// passed through unchanged.
+//
+// A resource belongs to a patient if it is that Patient, or if its patient,
+// subject or beneficiary element references a Patient, as for
+// NewPatientBundleProcessor. Resources which belong to no patient are counted
+// under UnknownPatient.
+type PerPatientCountProcessor struct {
+	BaseProcessor
+
+	mu     sync.Mutex
+	counts PatientResourceCounts
+}
+
+// Assert PerPatientCountProcessor satisfies the Processor interface.
+var _ Processor = &PerPatientCountProcessor{}
+
+// NewPerPatientCountProcessor creates a new PerPatientCountProcessor. The
+// counts may be read with Counts once the pipeline has been finalized.
+func NewPerPatientCountProcessor() *PerPatientCountProcessor {
+	return &PerPatientCountProcessor{counts: PatientResourceCounts{}}
+}
+
+// Process is Processor.Process.
+func (pcp *PerPatientCountProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	id, err := patientID(resource.Type(), rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	if id == "" {
+		id = UnknownPatient
+	}
+
+	pcp.mu.Lock()
+	if pcp.counts[id] == nil {
+		pcp.counts[id] = map[cpb.ResourceTypeCode_Value]int{}
+	}
+	pcp.counts[id][resource.Type()]++
+	pcp.mu.Unlock()
+
+	return pcp.Output(ctx, resource)
+}
+
+// Finalize is Processor.Finalize. It logs a summary of the counts.
+func (pcp *PerPatientCountProcessor) Finalize(ctx context.Context) error {
+	pcp.mu.Lock()
+	defer pcp.mu.Unlock()
+	patients := len(pcp.counts)
+	unknown := 0
+	if c, ok := pcp.counts[UnknownPatient]; ok {
+		patients--
+		for _, n := range c {
+			unknown += n
+		}
+	}
+	log.Infof("Counted resources for %d patients, with %d resources belonging to no patient.", patients, unknown)
+	return nil
+}
+
+// Counts returns a copy of the counts so far.
+func (pcp *PerPatientCountProcessor) Counts() PatientResourceCounts {
+	pcp.mu.Lock()
+	defer pcp.mu.Unlock()
+	counts := make(PatientResourceCounts, len(pcp.counts))
+	for id, c := range pcp.counts {
+		counts[id] = make(map[cpb.ResourceTypeCode_Value]int, len(c))
+		for resourceType, n := range c {
+			counts[id][resourceType] = n
+		}
+	}
+	return counts
+}
+
+// PatientsWithout returns the sorted ids of the patients counted so far which
+// have no resources of the given type (for example, patients with no
+// ExplanationOfBenefit). UnknownPatient is not included.
+func (pcp *PerPatientCountProcessor) PatientsWithout(resourceType cpb.ResourceTypeCode_Value) []string {
+	pcp.mu.Lock()
+	defer pcp.mu.Unlock()
+	var ids []string
+	for id, c := range pcp.counts {
+		if id != UnknownPatient && c[resourceType] == 0 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
@@ -0,0 +1,55 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestPerPatientCountProcessor(t *testing.T) {
+	resources := []typedResource{
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p1"}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p2"}`},
+		{cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, `{"resourceType":"ExplanationOfBenefit","id":"e1","patient":{"reference":"Patient/p1"}}`},
+		{cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT, `{"resourceType":"ExplanationOfBenefit","id":"e2","patient":{"reference":"https://example.com/fhir/Patient/p1/_history/2"}}`},
+		{cpb.ResourceTypeCode_COVERAGE, `{"resourceType":"Coverage","id":"c1","status":"active","beneficiary":{"reference":"Patient/p2"}}`},
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"o1","status":"final","subject":{"reference":"Patient/p3"}}`},
+		{cpb.ResourceTypeCode_ORGANIZATION, `{"resourceType":"Organization","id":"org1"}`},
+	}
+	pcp := processing.NewPerPatientCountProcessor()
+	written := runProcessor(t, pcp, resources)
+	if len(written) != len(resources) {
+		t.Errorf("unexpected number of resources passed through. got: %d, want: %d", len(written), len(resources))
+	}
+
+	want := processing.PatientResourceCounts{
+		"p1":                      {cpb.ResourceTypeCode_PATIENT: 1, cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT: 2},
+		"p2":                      {cpb.ResourceTypeCode_PATIENT: 1, cpb.ResourceTypeCode_COVERAGE: 1},
+		"p3":                      {cpb.ResourceTypeCode_OBSERVATION: 1},
+		processing.UnknownPatient: {cpb.ResourceTypeCode_ORGANIZATION: 1},
+	}
+	if diff := cmp.Diff(want, pcp.Counts()); diff != "" {
+		t.Errorf("Counts() returned unexpected counts (-want +got):\n%s", diff)
+	}
+	wantWithout := []string{"p2", "p3"}
+	if diff := cmp.Diff(wantWithout, pcp.PatientsWithout(cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT)); diff != "" {
+		t.Errorf("PatientsWithout(EXPLANATION_OF_BENEFIT) returned unexpected patients (-want +got):\n%s", diff)
+	}
+}
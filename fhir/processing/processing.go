@@ -19,10 +19,13 @@ package processing
 import (
 	"context"
 	"errors"
+	"fmt"
+	"runtime/debug"
 	"sync"
 
 	"github.com/google/fhir/go/fhirversion"
 	"github.com/google/fhir/go/jsonformat"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
 	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
 	"github.com/google/bulk_fhir_tools/internal/metrics"
 
@@ -49,13 +52,70 @@ type ResourceWrapper interface {
 	JSON() ([]byte, error)
 }
 
+// ErrorJSONNotSettable is returned (wrapped) by processors which operate on the raw JSON of
+// resources, if the ResourceWrapper does not implement JSONSetter.
+var ErrorJSONNotSettable = errors.New("the resource does not support replacing its JSON")
+
+// JSONSetter is implemented by ResourceWrappers whose JSON can be replaced. The ResourceWrappers
+// created by Pipeline implement it.
+type JSONSetter interface {
+	// SetJSON replaces the resource with the given FHIR JSON, for processors which need to operate
+	// on the raw JSON (for example, to fix data which cannot be parsed into a proto). Any proto
+	// previously returned by Proto() must not be used afterwards. If you call this in a Sink, the
+	// resource is not modified and the ErrorDoNotModifyProto error is returned.
+	SetJSON(json []byte) error
+}
+
+// AttributeHolder is implemented by ResourceWrappers which carry attributes: metadata which
+// accompany the resource through the pipeline, and are not part of the FHIR resource itself. The
+// ResourceWrappers created by Pipeline implement it. Use ResourceAttribute and
+// SetResourceAttribute to access the attributes of any ResourceWrapper.
+type AttributeHolder interface {
+	// Attribute returns the value of an attribute previously set on the resource with SetAttribute
+	// or Pipeline.ProcessWithAttributes, and whether it was set.
+	Attribute(key string) (string, bool)
+	// SetAttribute sets an attribute on the resource, overwriting any previous value. This should
+	// only be called by processors; sinks may read attributes but must not set them.
+	SetAttribute(key, value string)
+}
+
+// ResourceAttribute returns the value of an attribute of the resource, and whether it was set.
+// Resources which do not implement AttributeHolder have no attributes.
+func ResourceAttribute(resource ResourceWrapper, key string) (string, bool) {
+	if ah, ok := resource.(AttributeHolder); ok {
+		return ah.Attribute(key)
+	}
+	return "", false
+}
+
+// SetResourceAttribute sets an attribute on the resource, if it implements AttributeHolder. It is
+// a no-op otherwise.
+func SetResourceAttribute(resource ResourceWrapper, key, value string) {
+	if ah, ok := resource.(AttributeHolder); ok {
+		ah.SetAttribute(key, value)
+	}
+}
+
+// setJSON replaces the JSON of the resource, returning ErrorJSONNotSettable (wrapped) if it does
+// not implement JSONSetter.
+func setJSON(resource ResourceWrapper, json []byte) error {
+	js, ok := resource.(JSONSetter)
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrorJSONNotSettable, resource)
+	}
+	return js.SetJSON(json)
+}
+
 type resourceWrapper struct {
 	unmarshaller *jsonformat.Unmarshaller
 	marshaller   *jsonformat.Marshaller
 	resourceType cpb.ResourceTypeCode_Value
 	sourceURL    string
 	proto        *rpb.ContainedResource
+	attributes   map[string]string
 
+	// jsonMut guards json, and the lazy parsing of proto from json (which may
+	// happen concurrently when sinks are written to concurrently).
 	jsonMut *sync.Mutex
 	json    []byte
 	// By default, the json field is cleared when the proto is accessed, on the
@@ -74,6 +134,9 @@ func (rw *resourceWrapper) SourceURL() string {
 }
 
 func (rw *resourceWrapper) Proto() (*rpb.ContainedResource, error) {
+	rw.jsonMut.Lock()
+	defer rw.jsonMut.Unlock()
+
 	if rw.proto == nil {
 		proto, err := rw.unmarshaller.UnmarshalR4(rw.json)
 		if err != nil {
@@ -90,9 +153,7 @@ func (rw *resourceWrapper) Proto() (*rpb.ContainedResource, error) {
 
 	// Clear the json so that it is not out of sync if the proto is mutated. Later calls to JSON()
 	// will cause the JSON to be regenerated from the Proto.
-	rw.jsonMut.Lock()
 	rw.json = nil
-	rw.jsonMut.Unlock()
 
 	return rw.proto, nil
 }
@@ -119,15 +180,47 @@ func (rw *resourceWrapper) JSON() ([]byte, error) {
 	return json, nil
 }
 
-// Verify resourceWrapper satisfies the ResourceWrapper interface.
+func (rw *resourceWrapper) SetJSON(json []byte) error {
+	rw.jsonMut.Lock()
+	defer rw.jsonMut.Unlock()
+	if rw.doneMutating {
+		return ErrorDoNotModifyProto
+	}
+	rw.json = json
+	// Clear the proto so that it is regenerated from the new JSON on the next call to Proto().
+	rw.proto = nil
+	return nil
+}
+
+func (rw *resourceWrapper) Attribute(key string) (string, bool) {
+	v, ok := rw.attributes[key]
+	return v, ok
+}
+
+func (rw *resourceWrapper) SetAttribute(key, value string) {
+	if rw.attributes == nil {
+		rw.attributes = map[string]string{}
+	}
+	rw.attributes[key] = value
+}
+
+// Verify resourceWrapper satisfies the ResourceWrapper, JSONSetter and AttributeHolder interfaces.
 var _ ResourceWrapper = &resourceWrapper{}
+var _ JSONSetter = &resourceWrapper{}
+var _ AttributeHolder = &resourceWrapper{}
 
 var operationOutcomeCounter *metrics.Counter = metrics.NewCounter("operation-outcome-counter", "Count of the severity and error code of the operation outcomes returned from the bulk fhir server.", "1", aggregation.Count, "Severity", "Code")
 var fhirResourceCounter *metrics.Counter = metrics.NewCounter("fhir-resource-counter", "Count of FHIR Resources processed by Bulk FHIR Fetch run. The counter is tagged by the FHIR Resource type ex) OBSERVATION.", "1", aggregation.Count, "FHIRResourceType")
+var deadLetterCounter *metrics.Counter = metrics.NewCounter("dead-letter-counter", "Count of FHIR Resources dropped from the pipeline by a processor. The counter is tagged by the FHIR Resource type ex) OBSERVATION.", "1", aggregation.Count, "FHIRResourceType")
 
 // OutputFunction is the signature of both Processor.Process and Sink.Write.
 type OutputFunction func(ctx context.Context, resource ResourceWrapper) error
 
+// DeadLetterFunction is called with resources that a processor was unable to
+// process and has dropped from the pipeline, along with the reason they were
+// dropped. Returning an error stops the pipeline.
+type DeadLetterFunction func(ctx context.Context, resource ResourceWrapper, reason error) error
+
 // Processor defines a pipeline stage which may mutate resources before they are
 // written.
 //
@@ -157,6 +250,9 @@ type Processor interface {
 // BaseProcessor may call .sink(...) to pass on processed resources.
 type BaseProcessor struct {
 	Output OutputFunction
+	// DeadLetter is called by DeadLetterResource, if set. It is set by the
+	// Pipeline from PipelineOptions.DeadLetter.
+	DeadLetter DeadLetterFunction
 }
 
 // SetOutput is Processor.SetOutput. This implementation saves the provided
@@ -165,6 +261,31 @@ func (brp *BaseProcessor) SetOutput(output OutputFunction) {
 	brp.Output = output
 }
 
+// SetDeadLetter saves the provided dead letter function so that it can be
+// called by DeadLetterResource.
+func (brp *BaseProcessor) SetDeadLetter(deadLetter DeadLetterFunction) {
+	brp.DeadLetter = deadLetter
+}
+
+// DeadLetterResource should be called by processors which drop a resource
+// rather than passing it on to Output. If no dead letter function has been set,
+// the resource is logged and counted, and then discarded.
+func (brp *BaseProcessor) DeadLetterResource(ctx context.Context, resource ResourceWrapper, reason error) error {
+	if err := deadLetterCounter.Record(ctx, 1, resource.Type().String()); err != nil {
+		return err
+	}
+	if brp.DeadLetter != nil {
+		return brp.DeadLetter(ctx, resource, reason)
+	}
+	log.Warningf("Dropping %s resource from %s: %v", resource.Type(), resource.SourceURL(), reason)
+	return nil
+}
+
+// deadLetterSetter is implemented by processors which embed BaseProcessor.
+type deadLetterSetter interface {
+	SetDeadLetter(deadLetter DeadLetterFunction)
+}
+
 // Finalize is Processor.Finalize. This implementation is a no-op.
 func (brp *BaseProcessor) Finalize(ctx context.Context) error {
 	return nil
@@ -193,13 +314,63 @@ type Pipeline struct {
 	processors   []Processor
 	sinks        []Sink
 	pipelineFunc OutputFunction
+
+	recoverPanics   bool
+	deadLetter      DeadLetterFunction
+	concurrentSinks bool
+	// dryRun is set if the pipeline was created with PipelineOptions.DryRun.
+	dryRun *dryRunRecorder
+}
+
+// PipelineOptions holds optional parameters for NewPipelineWithOptions.
+type PipelineOptions struct {
+	// DeadLetter is called with resources which processors drop from the
+	// pipeline. If unset, dropped resources are logged and discarded.
+	DeadLetter DeadLetterFunction
+
+	// RecoverPanics causes panics in processors and sinks (or while parsing a
+	// resource) to be recovered, and converted into errors wrapping
+	// ErrProcessingPanic. If DeadLetter is set, the resource being processed is
+	// passed to it and processing continues; otherwise Process returns the error.
+	// This is off by default as panics usually indicate bugs, but may be useful
+	// for resilience when ingesting untrusted data.
+	RecoverPanics bool
+
+	// ConcurrentSinks causes each resource to be written to all sinks
+	// concurrently, rather than one after another, so that a slow sink does not
+	// delay writes to the others. Each sink still receives one Write call at a
+	// time. Errors from all sinks are joined. Sinks must not call SetAttribute
+	// when this is enabled.
+	ConcurrentSinks bool
+
+	// DryRun causes resources to be passed through the processors as usual, but
+	// not written to the sinks, so that a pipeline's configuration can be
+	// validated without writing anything. Resources dropped by processors are
+	// not passed to DeadLetter either. Instead, the resources processed, written
+	// and dropped are counted, and reported by Pipeline.DryRunReport and logged
+	// by Finalize. Finalize does not finalize the sinks.
+	DryRun bool
 }
 
+// ErrProcessingPanic is wrapped by the errors returned (or passed as the dead
+// letter reason) when PipelineOptions.RecoverPanics is set and processing a
+// resource panics.
+var ErrProcessingPanic = errors.New("panic while processing resource")
+
 // NewPipeline constructs a new Pipeline, plumbing together the given Processors
 // and Sinks. Both processors and sinks may be empty if no processing or output
 // is required. Note that processors and sinks should not be shared between
 // pipelines.
 func NewPipeline(processors []Processor, sinks []Sink) (*Pipeline, error) {
+	return NewPipelineWithOptions(processors, sinks, nil)
+}
+
+// NewPipelineWithOptions is like NewPipeline, but allows optional parameters to
+// be specified. opts may be nil.
+func NewPipelineWithOptions(processors []Processor, sinks []Sink, opts *PipelineOptions) (*Pipeline, error) {
+	if opts == nil {
+		opts = &PipelineOptions{}
+	}
 	unmarshaller, err := jsonformat.NewUnmarshallerWithoutValidation("UTC", fhirversion.R4)
 	if err != nil {
 		return nil, err
@@ -213,6 +384,14 @@ func NewPipeline(processors []Processor, sinks []Sink) (*Pipeline, error) {
 		marshaller:   marshaller,
 		processors:   processors,
 		sinks:        sinks,
+
+		recoverPanics:   opts.RecoverPanics,
+		deadLetter:      opts.DeadLetter,
+		concurrentSinks: opts.ConcurrentSinks,
+	}
+	if opts.DryRun {
+		p.dryRun = &dryRunRecorder{}
+		p.deadLetter = p.dryRun.deadLetter
 	}
 	// Build the pipeline function by applying each processing step on top of the
 	// sinks, starting from the last so that the processing steps are applied in
@@ -222,16 +401,27 @@ func NewPipeline(processors []Processor, sinks []Sink) (*Pipeline, error) {
 	p.pipelineFunc = p.writeToSinks
 	for i := len(processors) - 1; i >= 0; i-- {
 		processors[i].SetOutput(p.pipelineFunc)
+		if dls, ok := processors[i].(deadLetterSetter); ok && p.deadLetter != nil {
+			dls.SetDeadLetter(p.deadLetter)
+		}
 		p.pipelineFunc = processors[i].Process
 	}
 	return p, nil
 }
 
-// writeToSinks writes the resource to each sink sequentially.
+// writeToSinks writes the resource to each sink, sequentially unless the
+// pipeline was created with ConcurrentSinks.
 func (p *Pipeline) writeToSinks(ctx context.Context, resource ResourceWrapper) error {
 	if rw, ok := resource.(*resourceWrapper); ok {
 		rw.doneMutating = true
 	}
+	if p.dryRun != nil {
+		p.dryRun.written(resource)
+		return nil
+	}
+	if p.concurrentSinks && len(p.sinks) > 1 {
+		return p.writeToSinksConcurrently(ctx, resource)
+	}
 	for _, s := range p.sinks {
 		if err := s.Write(ctx, resource); err != nil {
 			return err
@@ -240,6 +430,37 @@ func (p *Pipeline) writeToSinks(ctx context.Context, resource ResourceWrapper) e
 	return nil
 }
 
+// writeToSinksConcurrently writes the resource to each sink in a separate
+// goroutine, and waits for all writes to complete. A panic in any sink is
+// re-raised in the calling goroutine, so that it is handled the same way as
+// when writing sequentially.
+func (p *Pipeline) writeToSinksConcurrently(ctx context.Context, resource ResourceWrapper) error {
+	errs := make([]error, len(p.sinks))
+	panics := make([]any, len(p.sinks))
+	wg := &sync.WaitGroup{}
+	for i, s := range p.sinks {
+		i, s := i, s
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("Panic while writing %s resource to sink %d: %v\n%s", resource.Type(), i, r, debug.Stack())
+					panics[i] = r
+				}
+			}()
+			errs[i] = s.Write(ctx, resource)
+		}()
+	}
+	wg.Wait()
+	for _, r := range panics {
+		if r != nil {
+			panic(r)
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // Process a single FHIR resource. The resource is passed through the processing
 // steps to the sinks.
 //
@@ -254,6 +475,13 @@ func (p *Pipeline) writeToSinks(ctx context.Context, resource ResourceWrapper) e
 //
 // It is not safe to call this function from multiple Goroutines.
 func (p *Pipeline) Process(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, sourceURL string, json []byte) error {
+	return p.ProcessWithAttributes(ctx, resourceType, sourceURL, json, nil)
+}
+
+// ProcessWithAttributes is like Process, but sets the given attributes on the
+// resource (see ResourceWrapper.Attribute) before it is passed through the
+// processing steps. attributes may be nil.
+func (p *Pipeline) ProcessWithAttributes(ctx context.Context, resourceType cpb.ResourceTypeCode_Value, sourceURL string, json []byte, attributes map[string]string) error {
 	//  Since a processor/sink may have internal parallelism, json []byte may
 	//  still be processed by a parallel processor/sink after Process() returns.
 	//  json []byte should be a copy in case it is overwritten after Process()
@@ -269,10 +497,45 @@ func (p *Pipeline) Process(ctx context.Context, resourceType cpb.ResourceTypeCod
 		jsonMut:      &sync.Mutex{},
 		json:         cp,
 	}
+	for k, v := range attributes {
+		rw.SetAttribute(k, v)
+	}
 	if err := fhirResourceCounter.Record(ctx, 1, resourceType.String()); err != nil {
 		return err
 	}
-	if resourceType == cpb.ResourceTypeCode_OPERATION_OUTCOME {
+	if p.dryRun != nil {
+		p.dryRun.processed(resourceType)
+	}
+	if p.recoverPanics {
+		return p.processRecoveringPanics(ctx, rw)
+	}
+	return p.process(ctx, rw)
+}
+
+// processRecoveringPanics calls process, converting any panic into an error
+// which is either returned or passed to the dead letter function.
+func (p *Pipeline) processRecoveringPanics(ctx context.Context, rw *resourceWrapper) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		log.Errorf("Recovered from panic while processing %s resource from %s: %v\n%s", rw.resourceType, rw.sourceURL, r, debug.Stack())
+		reason := fmt.Errorf("%w: %s resource from %s: %v", ErrProcessingPanic, rw.resourceType, rw.sourceURL, r)
+		if p.deadLetter == nil {
+			err = reason
+			return
+		}
+		if err = deadLetterCounter.Record(ctx, 1, rw.resourceType.String()); err != nil {
+			return
+		}
+		err = p.deadLetter(ctx, rw, reason)
+	}()
+	return p.process(ctx, rw)
+}
+
+func (p *Pipeline) process(ctx context.Context, rw *resourceWrapper) error {
+	if rw.resourceType == cpb.ResourceTypeCode_OPERATION_OUTCOME {
 		op, err := rw.Proto()
 		if err != nil {
 			return err
@@ -288,13 +551,19 @@ func (p *Pipeline) Process(ctx context.Context, resourceType cpb.ResourceTypeCod
 }
 
 // Finalize calls finalize on all of the underlying Processors and Sinks in the
-// pipeline, returning the first error seen.
+// pipeline, returning the first error seen. In dry-run mode (see
+// PipelineOptions.DryRun) the sinks are not finalized, and the DryRunReport is
+// logged instead.
 func (p *Pipeline) Finalize(ctx context.Context) error {
 	for _, pr := range p.processors {
 		if err := pr.Finalize(ctx); err != nil {
 			return err
 		}
 	}
+	if p.dryRun != nil {
+		p.dryRun.report().log()
+		return nil
+	}
 	for _, s := range p.sinks {
 		if err := s.Finalize(ctx); err != nil {
 			return err
@@ -0,0 +1,56 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+)
+
+// runProcessor runs the given resources through a Pipeline containing only
+// the Processor p, and returns the JSON of the written resources, in order.
+func runProcessor(t *testing.T, p processing.Processor, resources []typedResource) []map[string]any {
+	t.Helper()
+	ts := &processing.TestSink{}
+	pipeline, err := processing.NewPipeline([]processing.Processor{p}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	for _, r := range resources {
+		if err := pipeline.Process(ctx, r.resourceType, "", []byte(r.json)); err != nil {
+			t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+		}
+	}
+	if err := pipeline.Finalize(ctx); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+	var written []map[string]any
+	for _, w := range ts.WrittenResources {
+		rawJSON, err := w.JSON()
+		if err != nil {
+			t.Fatalf("JSON() returned unexpected error: %v", err)
+		}
+		var res map[string]any
+		if err := json.Unmarshal(rawJSON, &res); err != nil {
+			t.Fatalf("failed to unmarshal written resource: %v", err)
+		}
+		written = append(written, res)
+	}
+	return written
+}
@@ -16,13 +16,17 @@ package processing_test
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/bulk_fhir_tools/fhir/processing"
 	"github.com/google/bulk_fhir_tools/internal/metrics"
 
 	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	rpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
 )
 
 // testProcessor is a no-op processor for testing.
@@ -133,3 +137,265 @@ func TestMalformedOperationOutcomeCounter(t *testing.T) {
 		t.Errorf("GetResults() returned unexpected count (-want +got): \n%s", diff)
 	}
 }
+
+func TestResourceWrapperSetJSONInSink(t *testing.T) {
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline([]processing.Processor{}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Process(context.Background(), cpb.ResourceTypeCode_ACCOUNT, "", []byte("data")); err != nil {
+		t.Fatalf("p.Process() returned unexpected error: %v", err)
+	}
+	if err := ts.WrittenResources[0].(processing.JSONSetter).SetJSON([]byte("other")); !errors.Is(err, processing.ErrorDoNotModifyProto) {
+		t.Errorf("SetJSON() in sink returned unexpected error. got: %v, want: %v", err, processing.ErrorDoNotModifyProto)
+	}
+}
+
+// minimalResourceWrapper implements only ResourceWrapper, and not the optional
+// JSONSetter and AttributeHolder interfaces.
+type minimalResourceWrapper struct {
+	json []byte
+}
+
+func (mrw *minimalResourceWrapper) Type() cpb.ResourceTypeCode_Value       { return cpb.ResourceTypeCode_PATIENT }
+func (mrw *minimalResourceWrapper) SourceURL() string                      { return "" }
+func (mrw *minimalResourceWrapper) Proto() (*rpb.ContainedResource, error) { return nil, nil }
+func (mrw *minimalResourceWrapper) JSON() ([]byte, error)                  { return mrw.json, nil }
+
+func TestMinimalResourceWrapper(t *testing.T) {
+	r := &minimalResourceWrapper{json: []byte(`{"resourceType":"Patient","id":"1"}`)}
+	processing.SetResourceAttribute(r, "key", "value")
+	if v, ok := processing.ResourceAttribute(r, "key"); ok {
+		t.Errorf("ResourceAttribute() returned %q for a resource without attributes", v)
+	}
+
+	p, err := processing.NewNamespaceProcessor("ns")
+	if err != nil {
+		t.Fatalf("NewNamespaceProcessor() returned unexpected error: %v", err)
+	}
+	p.SetOutput(func(ctx context.Context, resource processing.ResourceWrapper) error { return nil })
+	if err := p.Process(context.Background(), r); !errors.Is(err, processing.ErrorJSONNotSettable) {
+		t.Errorf("Process() returned unexpected error. got: %v, want: %v", err, processing.ErrorJSONNotSettable)
+	}
+}
+
+// deadLetterProcessor dead letters every resource.
+type deadLetterProcessor struct {
+	processing.BaseProcessor
+}
+
+func (dlp *deadLetterProcessor) Process(ctx context.Context, resource processing.ResourceWrapper) error {
+	return dlp.DeadLetterResource(ctx, resource, errors.New("dropped"))
+}
+
+func TestDeadLetter(t *testing.T) {
+	cases := []struct {
+		name       string
+		deadLetter bool
+	}{
+		{name: "WithDeadLetterFunction", deadLetter: true},
+		{name: "WithoutDeadLetterFunction", deadLetter: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metrics.ResetAll()
+			ts := &processing.TestSink{}
+			var deadLettered []processing.ResourceWrapper
+			opts := &processing.PipelineOptions{}
+			if tc.deadLetter {
+				opts.DeadLetter = func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+					deadLettered = append(deadLettered, resource)
+					return nil
+				}
+			}
+			p, err := processing.NewPipelineWithOptions([]processing.Processor{&deadLetterProcessor{}}, []processing.Sink{ts}, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Process(context.Background(), cpb.ResourceTypeCode_ACCOUNT, "", []byte("data")); err != nil {
+				t.Fatalf("p.Process() returned unexpected error: %v", err)
+			}
+			if len(ts.WrittenResources) != 0 {
+				t.Errorf("TestSink captured %d resources, want 0", len(ts.WrittenResources))
+			}
+			wantDeadLettered := 0
+			if tc.deadLetter {
+				wantDeadLettered = 1
+			}
+			if len(deadLettered) != wantDeadLettered {
+				t.Errorf("DeadLetter called with %d resources, want %d", len(deadLettered), wantDeadLettered)
+			}
+			gotCount, _, err := metrics.GetResults()
+			if err != nil {
+				t.Errorf("GetResults failed; err = %s", err)
+			}
+			if diff := cmp.Diff(map[string]int64{"ACCOUNT": 1}, gotCount["dead-letter-counter"].Count); diff != "" {
+				t.Errorf("GetResults() return unexpected count (-want +got): \n%s", diff)
+			}
+		})
+	}
+}
+
+// accountDeadLetterProcessor dead letters Account resources, and outputs all
+// others.
+type accountDeadLetterProcessor struct {
+	processing.BaseProcessor
+}
+
+func (adlp *accountDeadLetterProcessor) Process(ctx context.Context, resource processing.ResourceWrapper) error {
+	if resource.Type() == cpb.ResourceTypeCode_ACCOUNT {
+		return adlp.DeadLetterResource(ctx, resource, errors.New("dropped"))
+	}
+	return adlp.Output(ctx, resource)
+}
+
+func TestPipeline_DryRun(t *testing.T) {
+	ctx := context.Background()
+	ts := &processing.TestSink{}
+	deadLetterCalled := false
+	opts := &processing.PipelineOptions{
+		DryRun: true,
+		DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+			deadLetterCalled = true
+			return nil
+		},
+	}
+	p, err := processing.NewPipelineWithOptions([]processing.Processor{&accountDeadLetterProcessor{}}, []processing.Sink{ts}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rt := range []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_ACCOUNT, cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_PATIENT} {
+		if err := p.Process(ctx, rt, "url", []byte(`{"resourceType":"Patient"}`)); err != nil {
+			t.Fatalf("p.Process() returned unexpected error: %v", err)
+		}
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("p.Finalize() returned unexpected error: %v", err)
+	}
+
+	if len(ts.WrittenResources) != 0 {
+		t.Errorf("TestSink captured %d resources, want 0", len(ts.WrittenResources))
+	}
+	if ts.FinalizeCalled {
+		t.Errorf("Finalize called on TestSink in dry run")
+	}
+	if deadLetterCalled {
+		t.Errorf("DeadLetter called in dry run")
+	}
+	want := processing.DryRunReport{
+		Processed:    map[cpb.ResourceTypeCode_Value]int{cpb.ResourceTypeCode_ACCOUNT: 1, cpb.ResourceTypeCode_PATIENT: 2},
+		Written:      map[cpb.ResourceTypeCode_Value]int{cpb.ResourceTypeCode_PATIENT: 2},
+		DeadLettered: map[cpb.ResourceTypeCode_Value]int{cpb.ResourceTypeCode_ACCOUNT: 1},
+		DeadLetters:  []processing.DryRunDeadLetter{{ResourceType: cpb.ResourceTypeCode_ACCOUNT, SourceURL: "url", Reason: "dropped"}},
+	}
+	if diff := cmp.Diff(want, p.DryRunReport()); diff != "" {
+		t.Errorf("DryRunReport() returned unexpected diff (-want +got):\n%s", diff)
+	}
+}
+
+// panicProcessor panics when processing a resource.
+type panicProcessor struct {
+	processing.BaseProcessor
+}
+
+func (pp *panicProcessor) Process(ctx context.Context, resource processing.ResourceWrapper) error {
+	panic("bad resource")
+}
+
+func TestRecoverPanics(t *testing.T) {
+	cases := []struct {
+		name       string
+		deadLetter bool
+	}{
+		{name: "WithDeadLetterFunction", deadLetter: true},
+		{name: "WithoutDeadLetterFunction", deadLetter: false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := &processing.TestSink{}
+			var deadLetterReasons []error
+			opts := &processing.PipelineOptions{RecoverPanics: true}
+			if tc.deadLetter {
+				opts.DeadLetter = func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+					deadLetterReasons = append(deadLetterReasons, reason)
+					return nil
+				}
+			}
+			p, err := processing.NewPipelineWithOptions([]processing.Processor{&panicProcessor{}}, []processing.Sink{ts}, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.Process(context.Background(), cpb.ResourceTypeCode_ACCOUNT, "url1", []byte("data"))
+
+			gotReason := err
+			if tc.deadLetter {
+				if err != nil {
+					t.Fatalf("p.Process() returned unexpected error: %v", err)
+				}
+				if len(deadLetterReasons) != 1 {
+					t.Fatalf("DeadLetter called with %d resources, want 1", len(deadLetterReasons))
+				}
+				gotReason = deadLetterReasons[0]
+			}
+			if !errors.Is(gotReason, processing.ErrProcessingPanic) {
+				t.Errorf("unexpected panic error. got: %v, want: %v", gotReason, processing.ErrProcessingPanic)
+			}
+			if gotReason != nil && !strings.Contains(gotReason.Error(), "url1") {
+				t.Errorf("panic error %q does not include the source URL", gotReason)
+			}
+			if len(ts.WrittenResources) != 0 {
+				t.Errorf("TestSink captured %d resources, want 0", len(ts.WrittenResources))
+			}
+		})
+	}
+}
+
+// blockingSink is a Sink whose Write waits for release to be closed before
+// returning err.
+type blockingSink struct {
+	processing.TestSink
+	release chan struct{}
+	err     error
+}
+
+func (bs *blockingSink) Write(ctx context.Context, resource processing.ResourceWrapper) error {
+	select {
+	case <-bs.release:
+	case <-time.After(5 * time.Second):
+		return errors.New("timed out waiting for release")
+	}
+	return bs.err
+}
+
+// releasingSink is a Sink whose Write closes release.
+type releasingSink struct {
+	processing.TestSink
+	release chan struct{}
+	err     error
+}
+
+func (rs *releasingSink) Write(ctx context.Context, resource processing.ResourceWrapper) error {
+	close(rs.release)
+	return rs.err
+}
+
+func TestConcurrentSinks(t *testing.T) {
+	errBlocking := errors.New("blocking sink error")
+	errReleasing := errors.New("releasing sink error")
+	release := make(chan struct{})
+	// The first sink can only complete once the second has been written to, so
+	// this only succeeds if the sinks are written to concurrently.
+	sinks := []processing.Sink{
+		&blockingSink{release: release, err: errBlocking},
+		&releasingSink{release: release, err: errReleasing},
+	}
+	p, err := processing.NewPipelineWithOptions(nil, sinks, &processing.PipelineOptions{ConcurrentSinks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Process(context.Background(), cpb.ResourceTypeCode_PATIENT, "url1", []byte(`{"resourceType":"Patient","id":"1"}`))
+	if !errors.Is(err, errBlocking) || !errors.Is(err, errReleasing) {
+		t.Errorf("p.Process() returned unexpected error. got: %v, want errors from both sinks", err)
+	}
+}
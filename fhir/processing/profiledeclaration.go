@@ -0,0 +1,367 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// ErrUndeclaredProfile is passed (wrapped) as the dead letter reason for
+// resources which do not declare all of the expected profiles in meta.profile.
+var ErrUndeclaredProfile = errors.New("resource does not declare the expected profiles")
+
+// ErrNonconformantProfile is passed (wrapped) as the dead letter reason for
+// resources which do not conform to the expected profiles, if validation is
+// enabled.
+var ErrNonconformantProfile = errors.New("resource does not conform to the expected profiles")
+
+var profileDeclarationCounter *metrics.Counter = metrics.NewCounter("profile-declaration-counter", "Count of FHIR Resources which did not declare or conform to the expected profiles. The counter is tagged by the FHIR Resource type ex) OBSERVATION, and the reason (undeclared or nonconformant).", "1", aggregation.Count, "FHIRResourceType", "Reason")
+
+// ProfileDeclarationProcessorOptions contains optional parameters used by
+// NewProfileDeclarationProcessorWithOptions.
+type ProfileDeclarationProcessorOptions struct {
+	// The FHIR JSON StructureDefinitions of the expected profiles, which are
+	// required if validation is enabled.
+	StructureDefinitions [][]byte
+}
+
+type profileDeclarationProcessor struct {
+	BaseProcessor
+	expected map[cpb.ResourceTypeCode_Value][]string
+	// profiles holds the parsed StructureDefinitions of the expected profiles,
+	// keyed by URL, if validation is enabled.
+	profiles map[string]*profileDefinition
+}
+
+// Assert profileDeclarationProcessor satisfies the Processor interface.
+var _ Processor = &profileDeclarationProcessor{}
+
+// NewProfileDeclarationProcessor creates a Processor which checks that
+// resources declare the profiles expected for their type in meta.profile, and
+// dead letters those which do not. For example, {PATIENT:
+// {"http://hl7.org/fhir/us/core/StructureDefinition/us-core-patient"}}
+// requires Patients to declare the US Core Patient profile. A declared profile
+// with a version (url|version) matches an expected profile without one.
+// Resources of types with no expected profiles are passed through.
+//
+// If validate is true, resources must also conform to the expected profiles,
+// whose StructureDefinitions must be given with
+// NewProfileDeclarationProcessorWithOptions.
+func NewProfileDeclarationProcessor(expected map[cpb.ResourceTypeCode_Value][]string, validate bool) (Processor, error) {
+	return NewProfileDeclarationProcessorWithOptions(expected, validate, nil)
+}
+
+// NewProfileDeclarationProcessorWithOptions is like
+// NewProfileDeclarationProcessor, but with the given options. opts may be nil.
+//
+// Validation is structural, checking the cardinality (min and max) of each
+// element constrained by the profile's snapshot (or, if it has none, its
+// differential), including elements which a profile prohibits with a max of 0.
+// Slices, invariants, terminology bindings and type profiles are not checked.
+// Resources which fail validation are dead lettered with
+// ErrNonconformantProfile.
+func NewProfileDeclarationProcessorWithOptions(expected map[cpb.ResourceTypeCode_Value][]string, validate bool, opts *ProfileDeclarationProcessorOptions) (Processor, error) {
+	if opts == nil {
+		opts = &ProfileDeclarationProcessorOptions{}
+	}
+	pdp := &profileDeclarationProcessor{expected: expected}
+	for resourceType, urls := range expected {
+		if _, err := bulkfhir.ResourceTypeCodeToName(resourceType); err != nil {
+			return nil, err
+		}
+		if len(urls) == 0 {
+			return nil, fmt.Errorf("no expected profiles given for %s", resourceType)
+		}
+	}
+	if !validate {
+		return pdp, nil
+	}
+
+	definitions := map[string]*profileDefinition{}
+	for _, sd := range opts.StructureDefinitions {
+		def, err := parseProfileDefinition(sd)
+		if err != nil {
+			return nil, err
+		}
+		definitions[def.url] = def
+	}
+	pdp.profiles = map[string]*profileDefinition{}
+	for resourceType, urls := range expected {
+		name, _ := bulkfhir.ResourceTypeCodeToName(resourceType)
+		for _, url := range urls {
+			def, ok := definitions[url]
+			if !ok {
+				return nil, fmt.Errorf("no StructureDefinition given for expected %s profile %s", resourceType, url)
+			}
+			if def.resourceType != name {
+				return nil, fmt.Errorf("expected %s profile %s is a profile of %s", resourceType, url, def.resourceType)
+			}
+			pdp.profiles[url] = def
+		}
+	}
+	return pdp, nil
+}
+
+// declaredProfiles holds the meta.profile of a resource.
+type declaredProfiles struct {
+	Meta struct {
+		Profile []string `json:"profile"`
+	} `json:"meta"`
+}
+
+func (pdp *profileDeclarationProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	expected, ok := pdp.expected[resource.Type()]
+	if !ok {
+		return pdp.Output(ctx, resource)
+	}
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var declared declaredProfiles
+	if err := json.Unmarshal(rawJSON, &declared); err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	declaredURLs := map[string]bool{}
+	for _, p := range declared.Meta.Profile {
+		url, _, _ := strings.Cut(p, "|")
+		declaredURLs[url] = true
+	}
+	var missing []string
+	for _, url := range expected {
+		if !declaredURLs[url] {
+			missing = append(missing, url)
+		}
+	}
+	if len(missing) > 0 {
+		if err := profileDeclarationCounter.Record(ctx, 1, resource.Type().String(), "undeclared"); err != nil {
+			return err
+		}
+		return pdp.DeadLetterResource(ctx, resource, fmt.Errorf("%w: %s", ErrUndeclaredProfile, strings.Join(missing, ", ")))
+	}
+	if pdp.profiles == nil {
+		return pdp.Output(ctx, resource)
+	}
+
+	var parsed map[string]any
+	if err := json.Unmarshal(rawJSON, &parsed); err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	var violations []string
+	for _, url := range expected {
+		for _, v := range pdp.profiles[url].validate(parsed) {
+			violations = append(violations, fmt.Sprintf("%s (%s)", v, url))
+		}
+	}
+	if len(violations) > 0 {
+		if err := profileDeclarationCounter.Record(ctx, 1, resource.Type().String(), "nonconformant"); err != nil {
+			return err
+		}
+		return pdp.DeadLetterResource(ctx, resource, fmt.Errorf("%w: %s", ErrNonconformantProfile, strings.Join(violations, "; ")))
+	}
+	return pdp.Output(ctx, resource)
+}
+
+// profileDefinition holds the constraints of a profile which are validated by
+// the processor returned by NewProfileDeclarationProcessor.
+type profileDefinition struct {
+	url          string
+	resourceType string
+	elements     []profileElement
+	// bindings holds the required terminology bindings of the profile, which
+	// are only checked by the processor returned by
+	// NewImplementationGuideProcessor.
+	bindings []profileBinding
+}
+
+// profileBinding is a required terminology binding of an element of a
+// profile.
+type profileBinding struct {
+	path     string
+	names    []string
+	valueSet string
+}
+
+// profileElement is the cardinality of an element of a profile.
+type profileElement struct {
+	// path is the element's path, such as Patient.name.family.
+	path string
+	// names holds the names of the fields along the path from the resource,
+	// such as [name, family].
+	names    []string
+	min, max int
+	// unbounded is true if the element has no max (max is "*").
+	unbounded bool
+}
+
+// structureDefinition holds the fields used from a StructureDefinition.
+type structureDefinition struct {
+	ResourceType string `json:"resourceType"`
+	URL          string `json:"url"`
+	Type         string `json:"type"`
+	Snapshot     struct {
+		Element []elementDefinition `json:"element"`
+	} `json:"snapshot"`
+	Differential struct {
+		Element []elementDefinition `json:"element"`
+	} `json:"differential"`
+}
+
+// elementDefinition holds the fields used from an ElementDefinition.
+type elementDefinition struct {
+	ID        string `json:"id"`
+	Path      string `json:"path"`
+	SliceName string `json:"sliceName"`
+	Min       *int   `json:"min"`
+	Max       string `json:"max"`
+	Binding   *struct {
+		Strength string `json:"strength"`
+		ValueSet string `json:"valueSet"`
+	} `json:"binding"`
+}
+
+func parseProfileDefinition(data []byte) (*profileDefinition, error) {
+	var sd structureDefinition
+	if err := json.Unmarshal(data, &sd); err != nil {
+		return nil, fmt.Errorf("failed to parse StructureDefinition: %w", err)
+	}
+	if sd.ResourceType != "StructureDefinition" || sd.URL == "" || sd.Type == "" {
+		return nil, fmt.Errorf("invalid StructureDefinition %q: must have a url and type", sd.URL)
+	}
+	elements := sd.Snapshot.Element
+	if len(elements) == 0 {
+		elements = sd.Differential.Element
+	}
+	def := &profileDefinition{url: sd.URL, resourceType: sd.Type}
+	for _, ed := range elements {
+		// Slices (and the elements within them) only constrain some of the
+		// values of an element, so are not checked.
+		if ed.SliceName != "" || strings.Contains(ed.ID, ":") {
+			continue
+		}
+		names := strings.Split(ed.Path, ".")
+		if names[0] != sd.Type {
+			return nil, fmt.Errorf("invalid StructureDefinition %s: element %q is not within %s", sd.URL, ed.Path, sd.Type)
+		}
+		if len(names) == 1 {
+			continue
+		}
+		if ed.Binding != nil && ed.Binding.Strength == "required" && ed.Binding.ValueSet != "" {
+			valueSet, _, _ := strings.Cut(ed.Binding.ValueSet, "|")
+			def.bindings = append(def.bindings, profileBinding{path: ed.Path, names: names[1:], valueSet: valueSet})
+		}
+		pe := profileElement{path: ed.Path, names: names[1:], unbounded: true}
+		if ed.Min != nil {
+			pe.min = *ed.Min
+		}
+		if ed.Max != "" && ed.Max != "*" {
+			max, err := strconv.Atoi(ed.Max)
+			if err != nil {
+				return nil, fmt.Errorf("invalid StructureDefinition %s: element %q has invalid max %q", sd.URL, ed.Path, ed.Max)
+			}
+			pe.max, pe.unbounded = max, false
+		}
+		if pe.min == 0 && pe.unbounded {
+			continue
+		}
+		def.elements = append(def.elements, pe)
+	}
+	return def, nil
+}
+
+// validate returns a description of each way in which the parsed JSON
+// resource does not conform to the profile.
+func (pd *profileDefinition) validate(resource map[string]any) []string {
+	var violations []string
+	for _, pe := range pd.elements {
+		parents := []map[string]any{resource}
+		for _, name := range pe.names[:len(pe.names)-1] {
+			var next []map[string]any
+			for _, p := range parents {
+				for _, v := range elementValues(p, name) {
+					if m, ok := v.(map[string]any); ok {
+						next = append(next, m)
+					}
+				}
+			}
+			parents = next
+		}
+		// The cardinality applies within each occurrence of the parent element,
+		// so elements of absent parents are not checked.
+		for _, p := range parents {
+			n := len(elementValues(p, pe.names[len(pe.names)-1]))
+			if n < pe.min {
+				violations = append(violations, fmt.Sprintf("%s has %d values, min is %d", pe.path, n, pe.min))
+			} else if !pe.unbounded && n > pe.max {
+				violations = append(violations, fmt.Sprintf("%s has %d values, max is %d", pe.path, n, pe.max))
+			}
+		}
+	}
+	sort.Strings(violations)
+	return violations
+}
+
+// elementValues returns the values of the named element in the JSON object
+// obj. Repeated elements are flattened, and a primitive element which only has
+// extensions (in _name) counts as a value. Choice elements (such as
+// value[x]) match any of their types.
+func elementValues(obj map[string]any, name string) []any {
+	var keys []string
+	if prefix, ok := strings.CutSuffix(name, "[x]"); ok {
+		for k := range obj {
+			if rest, ok := strings.CutPrefix(strings.TrimPrefix(k, "_"), prefix); ok && rest != "" && unicode.IsUpper(rune(rest[0])) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+	} else {
+		keys = []string{name, "_" + name}
+	}
+
+	var values []any
+	// A primitive may have both a value and extensions, in name and _name,
+	// which are one value (or, for repeated primitives, aligned lists).
+	counted := map[string]int{}
+	for _, k := range keys {
+		v, ok := obj[k]
+		if !ok || v == nil {
+			continue
+		}
+		base := strings.TrimPrefix(k, "_")
+		list, isList := v.([]any)
+		if !isList {
+			list = []any{v}
+		}
+		if len(list) <= counted[base] {
+			continue
+		}
+		values = append(values, list[counted[base]:]...)
+		counted[base] = len(list)
+	}
+	return values
+}
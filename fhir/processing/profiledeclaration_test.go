@@ -0,0 +1,185 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+const testPatientProfile = "http://example.com/fhir/StructureDefinition/test-patient"
+
+// testPatientProfileDefinition requires a name with a family name, and
+// prohibits deceased[x].
+const testPatientProfileDefinition = `{
+	"resourceType": "StructureDefinition",
+	"url": "http://example.com/fhir/StructureDefinition/test-patient",
+	"type": "Patient",
+	"differential": {
+		"element": [
+			{"id": "Patient", "path": "Patient"},
+			{"id": "Patient.name", "path": "Patient.name", "min": 1},
+			{"id": "Patient.name.family", "path": "Patient.name.family", "min": 1, "max": "1"},
+			{"id": "Patient.identifier:mrn", "path": "Patient.identifier", "sliceName": "mrn", "min": 1},
+			{"id": "Patient.deceased[x]", "path": "Patient.deceased[x]", "max": "0"}
+		]
+	}
+}`
+
+func TestProfileDeclarationProcessor(t *testing.T) {
+	expected := map[cpb.ResourceTypeCode_Value][]string{cpb.ResourceTypeCode_PATIENT: {testPatientProfile}}
+	cases := []struct {
+		name     string
+		validate bool
+		input    typedResource
+		// wantErr is the expected dead letter reason, or nil if the resource
+		// should be written.
+		wantErr error
+	}{
+		{
+			name:  "Declared",
+			input: typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","meta":{"profile":["http://example.com/other","http://example.com/fhir/StructureDefinition/test-patient"]}}`},
+		},
+		{
+			name:  "DeclaredWithVersion",
+			input: typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","meta":{"profile":["http://example.com/fhir/StructureDefinition/test-patient|2.0"]}}`},
+		},
+		{
+			name:    "Undeclared",
+			input:   typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","meta":{"profile":["http://example.com/other"]}}`},
+			wantErr: processing.ErrUndeclaredProfile,
+		},
+		{
+			name:    "NoMeta",
+			input:   typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1"}`},
+			wantErr: processing.ErrUndeclaredProfile,
+		},
+		{
+			name:  "OtherResourceType",
+			input: typedResource{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"c"}}`},
+		},
+		{
+			name:     "Conformant",
+			validate: true,
+			input:    typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","meta":{"profile":["http://example.com/fhir/StructureDefinition/test-patient"]},"name":[{"family":"A"},{"_family":{"extension":[{"url":"http://hl7.org/fhir/StructureDefinition/data-absent-reason","valueCode":"unknown"}]}}]}`},
+		},
+		{
+			name:     "MissingRequiredElement",
+			validate: true,
+			input:    typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","meta":{"profile":["http://example.com/fhir/StructureDefinition/test-patient"]},"name":[{"family":"A"},{"given":["B"]}]}`},
+			wantErr:  processing.ErrNonconformantProfile,
+		},
+		{
+			name:     "ProhibitedChoiceElement",
+			validate: true,
+			input:    typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","meta":{"profile":["http://example.com/fhir/StructureDefinition/test-patient"]},"name":[{"family":"A"}],"deceasedBoolean":true}`},
+			wantErr:  processing.ErrNonconformantProfile,
+		},
+		{
+			name:     "UndeclaredWithValidation",
+			validate: true,
+			input:    typedResource{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"1","name":[{"family":"A"}]}`},
+			wantErr:  processing.ErrUndeclaredProfile,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := processing.NewProfileDeclarationProcessorWithOptions(expected, tc.validate, &processing.ProfileDeclarationProcessorOptions{
+				StructureDefinitions: [][]byte{[]byte(testPatientProfileDefinition)},
+			})
+			if err != nil {
+				t.Fatalf("NewProfileDeclarationProcessorWithOptions() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			var reasons []error
+			pipeline, err := processing.NewPipelineWithOptions([]processing.Processor{p}, []processing.Sink{ts}, &processing.PipelineOptions{
+				DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+					reasons = append(reasons, reason)
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+			}
+			ctx := context.Background()
+			if err := pipeline.Process(ctx, tc.input.resourceType, "", []byte(tc.input.json)); err != nil {
+				t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+			}
+			if err := pipeline.Finalize(ctx); err != nil {
+				t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+			}
+
+			if tc.wantErr == nil {
+				if len(ts.WrittenResources) != 1 || len(reasons) != 0 {
+					t.Errorf("resource was dead lettered, want written. dead letter reasons: %v", reasons)
+				}
+				return
+			}
+			if len(ts.WrittenResources) != 0 || len(reasons) != 1 {
+				t.Fatalf("resource was written, want dead lettered with %v", tc.wantErr)
+			}
+			if !errors.Is(reasons[0], tc.wantErr) {
+				t.Errorf("unexpected dead letter reason. got: %v, want: %v", reasons[0], tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewProfileDeclarationProcessor_Invalid(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected map[cpb.ResourceTypeCode_Value][]string
+		validate bool
+		sds      []string
+	}{
+		{
+			name:     "NoProfiles",
+			expected: map[cpb.ResourceTypeCode_Value][]string{cpb.ResourceTypeCode_PATIENT: nil},
+		},
+		{
+			name:     "ValidateWithoutStructureDefinition",
+			expected: map[cpb.ResourceTypeCode_Value][]string{cpb.ResourceTypeCode_PATIENT: {testPatientProfile}},
+			validate: true,
+		},
+		{
+			name:     "ProfileOfOtherType",
+			expected: map[cpb.ResourceTypeCode_Value][]string{cpb.ResourceTypeCode_OBSERVATION: {testPatientProfile}},
+			validate: true,
+			sds:      []string{testPatientProfileDefinition},
+		},
+		{
+			name:     "InvalidStructureDefinition",
+			expected: map[cpb.ResourceTypeCode_Value][]string{cpb.ResourceTypeCode_PATIENT: {testPatientProfile}},
+			validate: true,
+			sds:      []string{`{"resourceType":"StructureDefinition"}`},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := &processing.ProfileDeclarationProcessorOptions{}
+			for _, sd := range tc.sds {
+				opts.StructureDefinitions = append(opts.StructureDefinitions, []byte(sd))
+			}
+			if _, err := processing.NewProfileDeclarationProcessorWithOptions(tc.expected, tc.validate, opts); err == nil {
+				t.Errorf("NewProfileDeclarationProcessorWithOptions() succeeded, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/time/rate"
+)
+
+type rateLimitedSink struct {
+	inner   Sink
+	limiter *rate.Limiter
+}
+
+// Assert rateLimitedSink satisfies the Sink interface.
+var _ Sink = &rateLimitedSink{}
+
+// NewRateLimitedSink wraps the inner Sink so that Write is called on it at
+// most rps times per second on average, allowing bursts of up to burst writes.
+// This is intended to avoid overwhelming destinations with strict QPS limits.
+//
+// Write blocks while the limit is exceeded, and returns early with an error if
+// ctx is cancelled while waiting. Finalize is not rate limited.
+func NewRateLimitedSink(inner Sink, rps float64, burst int) (Sink, error) {
+	if rps <= 0 {
+		return nil, fmt.Errorf("rate limit must be positive, got %v", rps)
+	}
+	if burst < 1 {
+		return nil, fmt.Errorf("burst must be at least 1, got %d", burst)
+	}
+	return &rateLimitedSink{
+		inner:   inner,
+		limiter: rate.NewLimiter(rate.Limit(rps), burst),
+	}, nil
+}
+
+// Write is Sink.Write. It waits until the rate limit allows another write and
+// then passes the resource on to the wrapped Sink.
+func (rls *rateLimitedSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	if err := rls.limiter.Wait(ctx); err != nil {
+		return fmt.Errorf("error waiting for rate limiter: %w", err)
+	}
+	return rls.inner.Write(ctx, resource)
+}
+
+// Finalize is Sink.Finalize. It calls Finalize on the wrapped Sink
+// immediately.
+func (rls *rateLimitedSink) Finalize(ctx context.Context) error {
+	return rls.inner.Finalize(ctx)
+}
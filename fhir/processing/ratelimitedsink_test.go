@@ -0,0 +1,85 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestRateLimitedSink(t *testing.T) {
+	ctx := context.Background()
+	ts := &processing.TestSink{}
+	// Allow one write immediately, and then one every 10ms.
+	sink, err := processing.NewRateLimitedSink(ts, 100, 1)
+	if err != nil {
+		t.Fatalf("NewRateLimitedSink() returned unexpected error: %v", err)
+	}
+
+	start := time.Now()
+	numWrites := 6
+	for i := 0; i < numWrites; i++ {
+		if err := sink.Write(ctx, &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT}); err != nil {
+			t.Fatalf("sink.Write() returned unexpected error: %v", err)
+		}
+	}
+	if elapsed, minElapsed := time.Since(start), 40*time.Millisecond; elapsed < minElapsed {
+		t.Errorf("%d writes took %s, want at least %s", numWrites, elapsed, minElapsed)
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("sink.Finalize() returned unexpected error: %v", err)
+	}
+	if len(ts.WrittenResources) != numWrites {
+		t.Errorf("unexpected number of resources written to inner sink. got: %d, want: %d", len(ts.WrittenResources), numWrites)
+	}
+	if !ts.FinalizeCalled {
+		t.Errorf("Finalize not called on inner sink")
+	}
+}
+
+func TestRateLimitedSink_ContextCancelled(t *testing.T) {
+	ts := &processing.TestSink{}
+	sink, err := processing.NewRateLimitedSink(ts, 0.001, 1)
+	if err != nil {
+		t.Fatalf("NewRateLimitedSink() returned unexpected error: %v", err)
+	}
+	// The first write consumes the only token in the bucket.
+	if err := sink.Write(context.Background(), &testResourceWrapper{}); err != nil {
+		t.Fatalf("sink.Write() returned unexpected error: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sink.Write(ctx, &testResourceWrapper{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("sink.Write() with cancelled context returned unexpected error. got: %v, want: %v", err, context.Canceled)
+	}
+	if len(ts.WrittenResources) != 1 {
+		t.Errorf("unexpected number of resources written to inner sink. got: %d, want: %d", len(ts.WrittenResources), 1)
+	}
+}
+
+func TestNewRateLimitedSink_InvalidParameters(t *testing.T) {
+	if _, err := processing.NewRateLimitedSink(&processing.TestSink{}, 0, 1); err == nil {
+		t.Errorf("NewRateLimitedSink() with zero rate returned nil error")
+	}
+	if _, err := processing.NewRateLimitedSink(&processing.TestSink{}, 1, 0); err == nil {
+		t.Errorf("NewRateLimitedSink() with zero burst returned nil error")
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// ResourceKey identifies a resource by its type and id.
+type ResourceKey struct {
+	ResourceType cpb.ResourceTypeCode_Value
+	ID           string
+}
+
+func (rk ResourceKey) String() string {
+	return fmt.Sprintf("%s/%s", rk.ResourceType, rk.ID)
+}
+
+// ChangeType is the kind of change a Reconciler found for a resource.
+type ChangeType int
+
+const (
+	// ResourceAdded indicates a resource which is not in the baseline.
+	ResourceAdded ChangeType = iota
+	// ResourceChanged indicates a resource whose content hash differs from the
+	// baseline.
+	ResourceChanged
+	// ResourceDeleted indicates a resource which is in the baseline, but not in
+	// the new export.
+	ResourceDeleted
+)
+
+func (ct ChangeType) String() string {
+	switch ct {
+	case ResourceAdded:
+		return "ADDED"
+	case ResourceChanged:
+		return "CHANGED"
+	case ResourceDeleted:
+		return "DELETED"
+	default:
+		return fmt.Sprintf("ChangeType(%d)", int(ct))
+	}
+}
+
+// ChangeEvent describes a difference between the baseline and a new export.
+type ChangeEvent struct {
+	Change ChangeType
+	Key    ResourceKey
+	// Hash is the content hash of the resource in the new export, or for
+	// deletions, in the baseline.
+	Hash string
+	// Resource is the resource from the new export. It is nil for deletions.
+	Resource ResourceWrapper
+}
+
+// ChangeFunction is called by a Reconciler with each change it finds.
+type ChangeFunction func(ctx context.Context, event ChangeEvent) error
+
+// ResourceHash returns the content hash used by Reconciler for the given
+// resource JSON.
+func ResourceHash(json []byte) string {
+	sum := sha256.Sum256(json)
+	return hex.EncodeToString(sum[:])
+}
+
+// Reconciler is a Sink which compares the resources of a full export against a
+// baseline (typically from the previous full export), to compute incremental
+// changes for servers which do not reliably report deletions with _since.
+//
+// Resources are compared by the hash of their JSON as it reaches the sink, so
+// serialization must be stable between exports (for example, processors which
+// add timestamps will cause every resource to be reported as changed).
+// Resources without an id cannot be reconciled, and are logged and skipped.
+type Reconciler struct {
+	onChange ChangeFunction
+
+	mu       sync.Mutex
+	baseline map[ResourceKey]string
+	hashes   map[ResourceKey]string
+}
+
+// Assert Reconciler satisfies the Sink interface.
+var _ Sink = &Reconciler{}
+
+// NewReconciler creates a new Reconciler. baseline maps each resource in the
+// previous export to its ResourceHash, and may be nil for the first export.
+// onChange is called for each added or changed resource as it is written, and
+// for each deleted resource when the Reconciler is finalized.
+func NewReconciler(baseline map[ResourceKey]string, onChange ChangeFunction) *Reconciler {
+	b := make(map[ResourceKey]string, len(baseline))
+	for k, v := range baseline {
+		b[k] = v
+	}
+	return &Reconciler{onChange: onChange, baseline: b, hashes: map[ResourceKey]string{}}
+}
+
+// Write is Sink.Write. It is threadsafe to call Write from multiple goroutines,
+// but onChange is not called concurrently.
+func (r *Reconciler) Write(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var res idJSON
+	if err := json.Unmarshal(rawJSON, &res); err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	if res.ID == "" {
+		log.Warningf("Skipping reconciliation of %s resource from %s without an id", resource.Type(), resource.SourceURL())
+		return nil
+	}
+	key := ResourceKey{ResourceType: resource.Type(), ID: res.ID}
+	hash := ResourceHash(rawJSON)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.hashes[key]; ok {
+		log.Warningf("Skipping reconciliation of duplicate resource %s from %s", key, resource.SourceURL())
+		return nil
+	}
+	r.hashes[key] = hash
+
+	baselineHash, ok := r.baseline[key]
+	switch {
+	case !ok:
+		return r.onChange(ctx, ChangeEvent{Change: ResourceAdded, Key: key, Hash: hash, Resource: resource})
+	case baselineHash != hash:
+		return r.onChange(ctx, ChangeEvent{Change: ResourceChanged, Key: key, Hash: hash, Resource: resource})
+	default:
+		return nil
+	}
+}
+
+// Finalize is Sink.Finalize. It reports each resource in the baseline which was
+// not written as deleted, in a deterministic order.
+func (r *Reconciler) Finalize(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var deleted []ResourceKey
+	for key := range r.baseline {
+		if _, ok := r.hashes[key]; !ok {
+			deleted = append(deleted, key)
+		}
+	}
+	sort.Slice(deleted, func(i, j int) bool {
+		if deleted[i].ResourceType != deleted[j].ResourceType {
+			return deleted[i].ResourceType < deleted[j].ResourceType
+		}
+		return deleted[i].ID < deleted[j].ID
+	})
+	for _, key := range deleted {
+		if err := r.onChange(ctx, ChangeEvent{Change: ResourceDeleted, Key: key, Hash: r.baseline[key]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hashes returns the ResourceHash of every resource written so far. Once the
+// Reconciler has been finalized, this may be saved as the baseline for
+// reconciling the next export.
+func (r *Reconciler) Hashes() map[ResourceKey]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hashes := make(map[ResourceKey]string, len(r.hashes))
+	for k, v := range r.hashes {
+		hashes[k] = v
+	}
+	return hashes
+}
@@ -0,0 +1,93 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestReconciler(t *testing.T) {
+	ctx := context.Background()
+	unchanged := `{"resourceType":"Patient","id":"1"}`
+	changedOld := `{"resourceType":"Patient","id":"2","gender":"male"}`
+	changedNew := `{"resourceType":"Patient","id":"2","gender":"female"}`
+	deleted := `{"resourceType":"Patient","id":"3"}`
+	added := `{"resourceType":"Patient","id":"4"}`
+
+	patientKey := func(id string) processing.ResourceKey {
+		return processing.ResourceKey{ResourceType: cpb.ResourceTypeCode_PATIENT, ID: id}
+	}
+	baseline := map[processing.ResourceKey]string{
+		patientKey("1"): processing.ResourceHash([]byte(unchanged)),
+		patientKey("2"): processing.ResourceHash([]byte(changedOld)),
+		patientKey("3"): processing.ResourceHash([]byte(deleted)),
+	}
+
+	type change struct {
+		Change processing.ChangeType
+		Key    processing.ResourceKey
+		Hash   string
+		JSON   string
+	}
+	var got []change
+	r := processing.NewReconciler(baseline, func(ctx context.Context, e processing.ChangeEvent) error {
+		c := change{Change: e.Change, Key: e.Key, Hash: e.Hash}
+		if e.Resource != nil {
+			json, err := e.Resource.JSON()
+			if err != nil {
+				t.Fatalf("Resource.JSON() returned unexpected error: %v", err)
+			}
+			c.JSON = string(json)
+		}
+		got = append(got, c)
+		return nil
+	})
+	p, err := processing.NewPipeline(nil, []processing.Sink{r})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	for _, json := range []string{unchanged, changedNew, added, `{"resourceType":"Patient"}`} {
+		if err := p.Process(ctx, cpb.ResourceTypeCode_PATIENT, "url", []byte(json)); err != nil {
+			t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", json, err)
+		}
+	}
+	if err := p.Finalize(ctx); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+
+	want := []change{
+		{Change: processing.ResourceChanged, Key: patientKey("2"), Hash: processing.ResourceHash([]byte(changedNew)), JSON: changedNew},
+		{Change: processing.ResourceAdded, Key: patientKey("4"), Hash: processing.ResourceHash([]byte(added)), JSON: added},
+		{Change: processing.ResourceDeleted, Key: patientKey("3"), Hash: processing.ResourceHash([]byte(deleted))},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected changes (-want +got):\n%s", diff)
+	}
+
+	wantHashes := map[processing.ResourceKey]string{
+		patientKey("1"): processing.ResourceHash([]byte(unchanged)),
+		patientKey("2"): processing.ResourceHash([]byte(changedNew)),
+		patientKey("4"): processing.ResourceHash([]byte(added)),
+	}
+	if diff := cmp.Diff(wantHashes, r.Hashes()); diff != "" {
+		t.Errorf("unexpected Hashes() (-want +got):\n%s", diff)
+	}
+}
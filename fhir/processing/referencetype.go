@@ -0,0 +1,310 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	apb "github.com/google/fhir/go/proto/google/fhir/proto/annotations_go_proto"
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+	rpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// ErrInvalidReferenceType is passed (wrapped) as the dead letter reason for
+// resources with references to disallowed resource types, if the
+// ReferenceTypeDeadLetter action is used.
+var ErrInvalidReferenceType = errors.New("resource has a reference to a disallowed resource type")
+
+// ReferenceTypeAttribute is the ResourceWrapper attribute which the processor
+// returned by NewReferenceTypeValidationProcessorWithOptions sets to a comma
+// separated list of the paths of any references to disallowed types, if the
+// ReferenceTypeFlag action is used.
+const ReferenceTypeAttribute = "invalid_reference_types"
+
+var referenceTypeCounter *metrics.Counter = metrics.NewCounter("reference-type-validation-counter", "Count of FHIR Resources with references to disallowed resource types. The counter is tagged by the FHIR Resource type ex) OBSERVATION, and the action taken.", "1", aggregation.Count, "FHIRResourceType", "Action")
+
+// ReferenceTypeAction is the action taken by
+// NewReferenceTypeValidationProcessor on resources with references to
+// disallowed resource types.
+type ReferenceTypeAction int
+
+const (
+	// ReferenceTypeDeadLetter passes the resource to the pipeline's dead letter
+	// function.
+	ReferenceTypeDeadLetter ReferenceTypeAction = iota
+	// ReferenceTypeFlag sets the ReferenceTypeAttribute of the resource, and
+	// logs a warning. The resource is not modified.
+	ReferenceTypeFlag
+)
+
+func (a ReferenceTypeAction) String() string {
+	switch a {
+	case ReferenceTypeDeadLetter:
+		return "dead_letter"
+	case ReferenceTypeFlag:
+		return "flag"
+	default:
+		return fmt.Sprintf("ReferenceTypeAction(%d)", int(a))
+	}
+}
+
+// DefaultReferenceTypeRules are rules for NewReferenceTypeValidationProcessor
+// covering the references to patients and encounters of common resource
+// types, with the allowed types taken from the FHIR specification.
+var DefaultReferenceTypeRules = map[cpb.ResourceTypeCode_Value]map[string][]cpb.ResourceTypeCode_Value{
+	cpb.ResourceTypeCode_CONDITION:              {"subject": nil, "encounter": nil},
+	cpb.ResourceTypeCode_COVERAGE:               {"beneficiary": nil},
+	cpb.ResourceTypeCode_ENCOUNTER:              {"subject": nil},
+	cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT: {"patient": nil},
+	cpb.ResourceTypeCode_MEDICATION_REQUEST:     {"subject": nil, "encounter": nil},
+	cpb.ResourceTypeCode_OBSERVATION:            {"subject": nil, "encounter": nil},
+	cpb.ResourceTypeCode_PROCEDURE:              {"subject": nil, "encounter": nil},
+}
+
+// ReferenceTypeValidationProcessorOptions contains optional parameters used by
+// NewReferenceTypeValidationProcessorWithOptions.
+type ReferenceTypeValidationProcessorOptions struct {
+	// The action taken on resources with references to disallowed types.
+	// Defaults to ReferenceTypeDeadLetter.
+	Action ReferenceTypeAction
+}
+
+// referenceTypeRule is a parsed reference field path, and the names of the
+// resource types it may reference.
+type referenceTypeRule struct {
+	requiredField
+	allowed map[string]bool
+}
+
+type referenceTypeProcessor struct {
+	BaseProcessor
+	action ReferenceTypeAction
+	rules  map[cpb.ResourceTypeCode_Value][]referenceTypeRule
+}
+
+// Assert referenceTypeProcessor satisfies the Processor interface.
+var _ Processor = &referenceTypeProcessor{}
+
+// NewReferenceTypeValidationProcessor creates a Processor which checks that
+// the Reference fields listed for each resource type in rules refer to one of
+// the allowed resource types, passing resources which do not to the pipeline's
+// dead letter function. This catches references to the wrong type of resource
+// (such as an Encounter.subject which references an Organization), which pass
+// structural validation but break joins downstream.
+//
+// Fields are given as dot separated paths of FHIR JSON field names (as in
+// NewRequiredFieldsProcessor), each mapped to the resource types it may
+// reference. If no types are given, the targets allowed by the FHIR
+// specification are used. The referenced type is taken from the reference
+// (relative, absolute or conditional), and from the Reference's type field;
+// references from which no type can be determined (such as references to
+// contained resources, or urn:uuid: references without a type) are not
+// checked. Resources of types with no rules are passed through.
+// DefaultReferenceTypeRules may be used as a starting point.
+func NewReferenceTypeValidationProcessor(rules map[cpb.ResourceTypeCode_Value]map[string][]cpb.ResourceTypeCode_Value) (Processor, error) {
+	return NewReferenceTypeValidationProcessorWithOptions(rules, nil)
+}
+
+// NewReferenceTypeValidationProcessorWithOptions is like
+// NewReferenceTypeValidationProcessor, but takes the action given by opts.
+func NewReferenceTypeValidationProcessorWithOptions(rules map[cpb.ResourceTypeCode_Value]map[string][]cpb.ResourceTypeCode_Value, opts *ReferenceTypeValidationProcessorOptions) (Processor, error) {
+	if opts == nil {
+		opts = &ReferenceTypeValidationProcessorOptions{}
+	}
+	switch opts.Action {
+	case ReferenceTypeDeadLetter, ReferenceTypeFlag:
+	default:
+		return nil, fmt.Errorf("unknown ReferenceTypeAction %d", opts.Action)
+	}
+	containedFields := (&rpb.ContainedResource{}).ProtoReflect().Descriptor().Fields()
+	rtp := &referenceTypeProcessor{action: opts.Action, rules: map[cpb.ResourceTypeCode_Value][]referenceTypeRule{}}
+	for resourceType, fields := range rules {
+		resourceField := containedFields.ByName(protoreflect.Name(strings.ToLower(resourceType.String())))
+		if resourceField == nil {
+			return nil, fmt.Errorf("unsupported resource type %s", resourceType)
+		}
+		paths := make([]string, 0, len(fields))
+		for path := range fields {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			rule, err := parseReferenceTypeRule(resourceField.Message(), path, fields[path])
+			if err != nil {
+				return nil, fmt.Errorf("invalid reference type rule for %s: %w", resourceType, err)
+			}
+			rtp.rules[resourceType] = append(rtp.rules[resourceType], rule)
+		}
+	}
+	return rtp, nil
+}
+
+// parseReferenceTypeRule parses the Reference field at path within md. If
+// allowed is empty, the types allowed by the FHIR specification are used.
+func parseReferenceTypeRule(md protoreflect.MessageDescriptor, path string, allowed []cpb.ResourceTypeCode_Value) (referenceTypeRule, error) {
+	rf, err := parseRequiredField(md, path)
+	if err != nil {
+		return referenceTypeRule{}, err
+	}
+	fd := rf.fields[len(rf.fields)-1]
+	if fd.Message() == nil || fd.Message().FullName() != referenceDescriptor.FullName() {
+		return referenceTypeRule{}, fmt.Errorf("%q is not a Reference", path)
+	}
+	rule := referenceTypeRule{requiredField: rf, allowed: map[string]bool{}}
+	for _, resourceType := range allowed {
+		name, err := bulkfhir.ResourceTypeCodeToName(resourceType)
+		if err != nil {
+			return referenceTypeRule{}, fmt.Errorf("%q: %w", path, err)
+		}
+		rule.allowed[name] = true
+	}
+	if len(allowed) > 0 {
+		return rule, nil
+	}
+	for _, name := range proto.GetExtension(fd.Options(), apb.E_ValidReferenceType).([]string) {
+		if name == "Resource" {
+			return referenceTypeRule{}, fmt.Errorf("%q may reference any resource type, so the allowed types must be given", path)
+		}
+		rule.allowed[name] = true
+	}
+	if len(rule.allowed) == 0 {
+		return referenceTypeRule{}, fmt.Errorf("%q has no allowed types in the FHIR specification, so they must be given", path)
+	}
+	return rule, nil
+}
+
+func (rtp *referenceTypeProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rules, ok := rtp.rules[resource.Type()]
+	if !ok {
+		return rtp.Output(ctx, resource)
+	}
+	cr, err := resource.Proto()
+	if err != nil {
+		return err
+	}
+	msg := cr.ProtoReflect()
+	populated := msg.WhichOneof(msg.Descriptor().Oneofs().Get(0))
+	if populated == nil {
+		return fmt.Errorf("%s resource from %s has no content", resource.Type(), resource.SourceURL())
+	}
+	res := msg.Get(populated).Message()
+
+	var problems, paths []string
+	for _, rule := range rules {
+		var ruleErr error
+		visitPath(res, rule.fields, func(m protoreflect.Message) {
+			if ruleErr != nil {
+				return
+			}
+			ref, ok := m.Interface().(*dpb.Reference)
+			if !ok {
+				ruleErr = fmt.Errorf("unexpected reference type %T", m.Interface())
+				return
+			}
+			problem, err := rule.check(ref)
+			if err != nil {
+				ruleErr = err
+				return
+			}
+			if problem != "" {
+				problems = append(problems, fmt.Sprintf("%s: %s", rule.path, problem))
+				if len(paths) == 0 || paths[len(paths)-1] != rule.path {
+					paths = append(paths, rule.path)
+				}
+			}
+		})
+		if ruleErr != nil {
+			return ruleErr
+		}
+	}
+	if len(problems) == 0 {
+		return rtp.Output(ctx, resource)
+	}
+	if err := referenceTypeCounter.Record(ctx, 1, resource.Type().String(), rtp.action.String()); err != nil {
+		return err
+	}
+	if rtp.action == ReferenceTypeDeadLetter {
+		return rtp.DeadLetterResource(ctx, resource, fmt.Errorf("%w: %s", ErrInvalidReferenceType, strings.Join(problems, ", ")))
+	}
+	log.Warningf("%s resource from %s has references to disallowed types: %s", resource.Type(), resource.SourceURL(), strings.Join(problems, ", "))
+	SetResourceAttribute(resource, ReferenceTypeAttribute, strings.Join(paths, ","))
+	return rtp.Output(ctx, resource)
+}
+
+// check returns a description of why ref is to a disallowed type, or an empty
+// string if it is allowed (or its type cannot be determined).
+func (rule referenceTypeRule) check(ref *dpb.Reference) (string, error) {
+	refStr, err := referenceString(ref)
+	if err != nil {
+		return "", err
+	}
+	refType := referencedType(refStr)
+	typeField := ref.GetType().GetValue()
+	if i := strings.LastIndex(typeField, "/"); i >= 0 {
+		// An absolute URL such as
+		// http://hl7.org/fhir/StructureDefinition/Patient.
+		typeField = typeField[i+1:]
+	}
+	switch {
+	case refType != "" && typeField != "" && refType != typeField:
+		return fmt.Sprintf("reference %q does not match its type %s", refStr, typeField), nil
+	case refType != "" && !rule.allowed[refType]:
+		return fmt.Sprintf("reference %q has type %s, want %s", refStr, refType, rule.allowedNames()), nil
+	case refType == "" && typeField != "" && !rule.allowed[typeField]:
+		return fmt.Sprintf("reference type %s is not allowed, want %s", typeField, rule.allowedNames()), nil
+	}
+	return "", nil
+}
+
+// allowedNames returns the allowed types, in a deterministic order.
+func (rule referenceTypeRule) allowedNames() string {
+	names := make([]string, 0, len(rule.allowed))
+	for name := range rule.allowed {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " or ")
+}
+
+// referencedType returns the resource type of a relative (Type/id), absolute
+// ({base}/Type/id) or conditional ([{base}/]Type?params) reference, possibly to a
+// specific version, or an empty string if it cannot be determined.
+func referencedType(ref string) string {
+	switch {
+	case ref == "", strings.HasPrefix(ref, "#"), strings.HasPrefix(ref, "urn:"):
+		return ""
+	}
+	if typeName, _, ok := strings.Cut(ref, "?"); ok {
+		return typeName[strings.LastIndex(typeName, "/")+1:]
+	}
+	ref, _, _ = strings.Cut(ref, "/_history/")
+	parts := strings.Split(ref, "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2]
+}
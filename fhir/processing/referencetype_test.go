@@ -0,0 +1,163 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestReferenceTypeValidationProcessor(t *testing.T) {
+	rules := map[cpb.ResourceTypeCode_Value]map[string][]cpb.ResourceTypeCode_Value{
+		// Encounter.subject may reference a Patient or Group.
+		cpb.ResourceTypeCode_ENCOUNTER: {"subject": nil, "participant.individual": {cpb.ResourceTypeCode_PRACTITIONER}},
+	}
+	cases := []struct {
+		name      string
+		reference string
+		wantValid bool
+	}{
+		{name: "Relative", reference: `{"reference":"Patient/1"}`, wantValid: true},
+		{name: "RelativeOtherAllowedType", reference: `{"reference":"Group/1"}`, wantValid: true},
+		{name: "Absolute", reference: `{"reference":"https://example.com/fhir/Patient/1/_history/2"}`, wantValid: true},
+		{name: "Conditional", reference: `{"reference":"Patient?identifier=x|1"}`, wantValid: true},
+		{name: "TypeField", reference: `{"reference":"urn:uuid:0b3d2cd4-2a9c-4fbe-a4a6-4d8b7e4b0d2c","type":"Patient"}`, wantValid: true},
+		{name: "UnknownType", reference: `{"reference":"urn:uuid:0b3d2cd4-2a9c-4fbe-a4a6-4d8b7e4b0d2c"}`, wantValid: true},
+		{name: "Contained", reference: `{"reference":"#p1"}`, wantValid: true},
+		{name: "IdentifierOnly", reference: `{"identifier":{"value":"1"}}`, wantValid: true},
+		{name: "RelativeDisallowed", reference: `{"reference":"Organization/1"}`},
+		{name: "AbsoluteDisallowed", reference: `{"reference":"https://example.com/fhir/Organization/1"}`},
+		{name: "ConditionalDisallowed", reference: `{"reference":"Organization?identifier=x|1"}`},
+		{name: "TypeFieldDisallowed", reference: `{"identifier":{"value":"1"},"type":"http://hl7.org/fhir/StructureDefinition/Organization"}`},
+		{name: "TypeFieldMismatch", reference: `{"reference":"Patient/1","type":"Group"}`},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := processing.NewReferenceTypeValidationProcessor(rules)
+			if err != nil {
+				t.Fatalf("NewReferenceTypeValidationProcessor() returned unexpected error: %v", err)
+			}
+			input := `{"resourceType":"Encounter","id":"1","status":"finished","class":{"code":"AMB"},"subject":` + tc.reference + `,"participant":[{"individual":{"reference":"Practitioner/1"}}]}`
+			written, reason := runReferenceTypeProcessor(t, p, input)
+			if tc.wantValid {
+				if written == nil {
+					t.Errorf("valid resource was dead lettered with reason: %v", reason)
+				}
+				return
+			}
+			if written != nil {
+				t.Errorf("resource with invalid reference was written")
+			}
+			if !errors.Is(reason, processing.ErrInvalidReferenceType) {
+				t.Errorf("unexpected dead letter reason. got: %v, want: %v", reason, processing.ErrInvalidReferenceType)
+			}
+		})
+	}
+}
+
+func TestReferenceTypeValidationProcessor_Flag(t *testing.T) {
+	rules := map[cpb.ResourceTypeCode_Value]map[string][]cpb.ResourceTypeCode_Value{
+		cpb.ResourceTypeCode_ENCOUNTER: {"subject": nil, "participant.individual": {cpb.ResourceTypeCode_PRACTITIONER}},
+	}
+	p, err := processing.NewReferenceTypeValidationProcessorWithOptions(rules, &processing.ReferenceTypeValidationProcessorOptions{Action: processing.ReferenceTypeFlag})
+	if err != nil {
+		t.Fatalf("NewReferenceTypeValidationProcessorWithOptions() returned unexpected error: %v", err)
+	}
+	input := `{"resourceType":"Encounter","id":"1","status":"finished","class":{"code":"AMB"},"subject":{"reference":"Organization/1"},"participant":[{"individual":{"reference":"Practitioner/1"}},{"individual":{"reference":"RelatedPerson/1"}}]}`
+	written, reason := runReferenceTypeProcessor(t, p, input)
+	if written == nil {
+		t.Fatalf("flagged resource was not written, dead letter reason: %v", reason)
+	}
+	got, _ := processing.ResourceAttribute(written, processing.ReferenceTypeAttribute)
+	if want := "participant.individual,subject"; got != want {
+		t.Errorf("unexpected %s attribute. got: %q, want: %q", processing.ReferenceTypeAttribute, got, want)
+	}
+}
+
+func TestReferenceTypeValidationProcessor_OtherResourceType(t *testing.T) {
+	p, err := processing.NewReferenceTypeValidationProcessor(processing.DefaultReferenceTypeRules)
+	if err != nil {
+		t.Fatalf("NewReferenceTypeValidationProcessor() returned unexpected error: %v", err)
+	}
+	ts := &processing.TestSink{}
+	pipeline, err := processing.NewPipeline([]processing.Processor{p}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	input := `{"resourceType":"Patient","id":"1","managingOrganization":{"reference":"Patient/2"}}`
+	if err := pipeline.Process(context.Background(), cpb.ResourceTypeCode_PATIENT, "", []byte(input)); err != nil {
+		t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+	}
+	if len(ts.WrittenResources) != 1 {
+		t.Errorf("resource of a type with no rules was not written")
+	}
+}
+
+func TestNewReferenceTypeValidationProcessor_Invalid(t *testing.T) {
+	cases := []struct {
+		name  string
+		rules map[cpb.ResourceTypeCode_Value]map[string][]cpb.ResourceTypeCode_Value
+	}{
+		{
+			name:  "UnknownField",
+			rules: map[cpb.ResourceTypeCode_Value]map[string][]cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_ENCOUNTER: {"subjects": nil}},
+		},
+		{
+			name:  "NotAReference",
+			rules: map[cpb.ResourceTypeCode_Value]map[string][]cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_ENCOUNTER: {"status": {cpb.ResourceTypeCode_PATIENT}}},
+		},
+		{
+			name:  "AnyResourceTypeAllowed",
+			rules: map[cpb.ResourceTypeCode_Value]map[string][]cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_OBSERVATION: {"focus": nil}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := processing.NewReferenceTypeValidationProcessor(tc.rules); err == nil {
+				t.Errorf("NewReferenceTypeValidationProcessor() succeeded, want error")
+			}
+		})
+	}
+}
+
+// runReferenceTypeProcessor processes the Encounter resourceJSON with the
+// given processor, returning the written resource (if any) and the dead letter
+// reason (if any).
+func runReferenceTypeProcessor(t *testing.T, p processing.Processor, resourceJSON string) (processing.ResourceWrapper, error) {
+	t.Helper()
+	ts := &processing.TestSink{}
+	var reason error
+	pipeline, err := processing.NewPipelineWithOptions([]processing.Processor{p}, []processing.Sink{ts}, &processing.PipelineOptions{
+		DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, r error) error {
+			reason = r
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+	}
+	if err := pipeline.Process(context.Background(), cpb.ResourceTypeCode_ENCOUNTER, "", []byte(resourceJSON)); err != nil {
+		t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+	}
+	if len(ts.WrittenResources) == 0 {
+		return nil, reason
+	}
+	return ts.WrittenResources[0], reason
+}
@@ -0,0 +1,160 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+	rpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/resources/bundle_and_contained_resource_go_proto"
+)
+
+// ErrMissingRequiredField is passed (wrapped) as the dead letter reason for
+// resources which are missing a field required by a RequiredFieldsProcessor.
+var ErrMissingRequiredField = errors.New("resource is missing a required field")
+
+var requiredFieldsCounter *metrics.Counter = metrics.NewCounter("required-fields-counter", "Count of FHIR Resources dropped because they were missing a required field. The counter is tagged by the FHIR Resource type ex) OBSERVATION.", "1", aggregation.Count, "FHIRResourceType")
+
+// DefaultRequiredFields are rules for NewRequiredFieldsProcessor covering
+// fields of common resource types which downstream consumers typically rely
+// on.
+var DefaultRequiredFields = map[cpb.ResourceTypeCode_Value][]string{
+	cpb.ResourceTypeCode_CONDITION:              {"code", "subject"},
+	cpb.ResourceTypeCode_ENCOUNTER:              {"status", "class", "subject"},
+	cpb.ResourceTypeCode_EXPLANATION_OF_BENEFIT: {"status", "patient"},
+	cpb.ResourceTypeCode_MEDICATION_REQUEST:     {"status", "intent", "subject"},
+	cpb.ResourceTypeCode_OBSERVATION:            {"status", "code", "subject"},
+	cpb.ResourceTypeCode_PROCEDURE:              {"status", "code", "subject"},
+}
+
+// requiredField is a parsed field path.
+type requiredField struct {
+	path   string
+	fields []protoreflect.FieldDescriptor
+}
+
+type requiredFieldsProcessor struct {
+	BaseProcessor
+	rules map[cpb.ResourceTypeCode_Value][]requiredField
+}
+
+// Assert requiredFieldsProcessor satisfies the Processor interface.
+var _ Processor = &requiredFieldsProcessor{}
+
+// NewRequiredFieldsProcessor creates a Processor which checks that resources
+// have the fields listed for their type in rules populated, passing resources
+// which do not to the pipeline's dead letter function. This is a much cheaper
+// (and less thorough) check than full profile validation, intended to enforce
+// the specific invariants downstream systems depend on.
+//
+// Fields are given as dot separated paths of FHIR JSON field names, for
+// example "code" or "code.coding". For choice types, use the name without the
+// type suffix (for example "value" rather than "valueQuantity"). If a path
+// traverses a repeated field, at least one element must have the remainder of
+// the path populated. Resources of types with no rules are passed through.
+// DefaultRequiredFields may be used as a starting point.
+func NewRequiredFieldsProcessor(rules map[cpb.ResourceTypeCode_Value][]string) (Processor, error) {
+	containedFields := (&rpb.ContainedResource{}).ProtoReflect().Descriptor().Fields()
+	rfp := &requiredFieldsProcessor{rules: map[cpb.ResourceTypeCode_Value][]requiredField{}}
+	for resourceType, paths := range rules {
+		resourceField := containedFields.ByName(protoreflect.Name(strings.ToLower(resourceType.String())))
+		if resourceField == nil {
+			return nil, fmt.Errorf("unsupported resource type %s", resourceType)
+		}
+		for _, path := range paths {
+			rf, err := parseRequiredField(resourceField.Message(), path)
+			if err != nil {
+				return nil, fmt.Errorf("invalid required field for %s: %w", resourceType, err)
+			}
+			rfp.rules[resourceType] = append(rfp.rules[resourceType], rf)
+		}
+	}
+	return rfp, nil
+}
+
+func parseRequiredField(md protoreflect.MessageDescriptor, path string) (requiredField, error) {
+	rf := requiredField{path: path}
+	for _, name := range strings.Split(path, ".") {
+		if md == nil {
+			return requiredField{}, fmt.Errorf("%q traverses a primitive field", path)
+		}
+		fd := md.Fields().ByJSONName(name)
+		if fd == nil {
+			return requiredField{}, fmt.Errorf("%q: %s has no field %q", path, md.Name(), name)
+		}
+		rf.fields = append(rf.fields, fd)
+		md = fd.Message()
+	}
+	return rf, nil
+}
+
+func (rfp *requiredFieldsProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rules, ok := rfp.rules[resource.Type()]
+	if !ok {
+		return rfp.Output(ctx, resource)
+	}
+	cr, err := resource.Proto()
+	if err != nil {
+		return err
+	}
+	msg := cr.ProtoReflect()
+	populated := msg.WhichOneof(msg.Descriptor().Oneofs().Get(0))
+	if populated == nil {
+		return fmt.Errorf("%s resource from %s has no content", resource.Type(), resource.SourceURL())
+	}
+	res := msg.Get(populated).Message()
+
+	var missing []string
+	for _, rf := range rules {
+		if !hasPath(res, rf.fields) {
+			missing = append(missing, rf.path)
+		}
+	}
+	if len(missing) == 0 {
+		return rfp.Output(ctx, resource)
+	}
+	if err := requiredFieldsCounter.Record(ctx, 1, resource.Type().String()); err != nil {
+		return err
+	}
+	return rfp.DeadLetterResource(ctx, resource, fmt.Errorf("%w: %s", ErrMissingRequiredField, strings.Join(missing, ", ")))
+}
+
+// hasPath returns whether the given path of fields is populated in msg.
+func hasPath(msg protoreflect.Message, fields []protoreflect.FieldDescriptor) bool {
+	fd, rest := fields[0], fields[1:]
+	if fd.IsList() {
+		list := msg.Get(fd).List()
+		if len(rest) == 0 {
+			return list.Len() > 0
+		}
+		for i := 0; i < list.Len(); i++ {
+			if hasPath(list.Get(i).Message(), rest) {
+				return true
+			}
+		}
+		return false
+	}
+	if !msg.Has(fd) {
+		return false
+	}
+	return len(rest) == 0 || hasPath(msg.Get(fd).Message(), rest)
+}
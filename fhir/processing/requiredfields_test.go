@@ -0,0 +1,112 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestRequiredFieldsProcessor(t *testing.T) {
+	rules := map[cpb.ResourceTypeCode_Value][]string{
+		cpb.ResourceTypeCode_OBSERVATION: {"code.coding.code", "subject", "value"},
+	}
+	cases := []struct {
+		name         string
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+		wantMissing  []string
+	}{
+		{
+			name:         "AllPresent",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         `{"resourceType":"Observation","id":"1","status":"final","code":{"coding":[{"system":"s"},{"code":"c"}]},"subject":{"reference":"Patient/1"},"valueString":"v"}`,
+		},
+		{
+			name:         "MissingFields",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         `{"resourceType":"Observation","id":"1","status":"final","code":{"coding":[{"system":"s"}]}}`,
+			wantMissing:  []string{"code.coding.code", "subject", "value"},
+		},
+		{
+			name:         "NoRulesForType",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         `{"resourceType":"Patient","id":"1"}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rfp, err := processing.NewRequiredFieldsProcessor(rules)
+			if err != nil {
+				t.Fatalf("NewRequiredFieldsProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			var deadLetterReasons []error
+			opts := &processing.PipelineOptions{
+				DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+					deadLetterReasons = append(deadLetterReasons, reason)
+					return nil
+				},
+			}
+			p, err := processing.NewPipelineWithOptions([]processing.Processor{rfp}, []processing.Sink{ts}, opts)
+			if err != nil {
+				t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+			}
+			if err := p.Process(context.Background(), tc.resourceType, "", []byte(tc.json)); err != nil {
+				t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", tc.json, err)
+			}
+
+			if len(tc.wantMissing) == 0 {
+				if len(ts.WrittenResources) != 1 || len(deadLetterReasons) != 0 {
+					t.Errorf("resource was not passed through: written %d, dead lettered: %v", len(ts.WrittenResources), deadLetterReasons)
+				}
+				return
+			}
+			if len(ts.WrittenResources) != 0 || len(deadLetterReasons) != 1 {
+				t.Fatalf("resource was not dead lettered: written %d, dead lettered: %v", len(ts.WrittenResources), deadLetterReasons)
+			}
+			if !errors.Is(deadLetterReasons[0], processing.ErrMissingRequiredField) {
+				t.Errorf("unexpected dead letter reason. got: %v, want: %v", deadLetterReasons[0], processing.ErrMissingRequiredField)
+			}
+			for _, field := range tc.wantMissing {
+				if !strings.Contains(deadLetterReasons[0].Error(), field) {
+					t.Errorf("dead letter reason %q does not name missing field %s", deadLetterReasons[0], field)
+				}
+			}
+		})
+	}
+}
+
+func TestNewRequiredFieldsProcessor_InvalidRules(t *testing.T) {
+	cases := []map[cpb.ResourceTypeCode_Value][]string{
+		{cpb.ResourceTypeCode_OBSERVATION: {"notAField"}},
+		{cpb.ResourceTypeCode_OBSERVATION: {"valueQuantity"}},
+		{cpb.ResourceTypeCode_OBSERVATION: {"status.value.code"}},
+	}
+	for _, rules := range cases {
+		if _, err := processing.NewRequiredFieldsProcessor(rules); err == nil {
+			t.Errorf("NewRequiredFieldsProcessor(%v) returned nil error", rules)
+		}
+	}
+	if _, err := processing.NewRequiredFieldsProcessor(processing.DefaultRequiredFields); err != nil {
+		t.Errorf("NewRequiredFieldsProcessor(DefaultRequiredFields) returned unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+
+	apb "github.com/google/fhir/go/proto/google/fhir/proto/annotations_go_proto"
+)
+
+var (
+	// ErrResourceTooLarge is passed (wrapped) as the dead letter reason for
+	// resources whose JSON is larger than a ResourceLimitsProcessor allows.
+	ErrResourceTooLarge = errors.New("resource JSON is too large")
+	// ErrResourceTooDeep is passed (wrapped) as the dead letter reason for
+	// resources which are nested more deeply than a ResourceLimitsProcessor or
+	// JSONDepthGuardProcessor allows.
+	ErrResourceTooDeep = errors.New("resource is nested too deeply")
+)
+
+var resourceLimitsCounter *metrics.Counter = metrics.NewCounter("resource-limits-counter", "Count of FHIR Resources dropped because they exceeded a size or nesting depth limit. The counter is tagged by the FHIR Resource type ex) OBSERVATION and the limit exceeded ex) SIZE or DEPTH.", "1", aggregation.Count, "FHIRResourceType", "LimitType")
+
+type resourceLimitsProcessor struct {
+	BaseProcessor
+	maxBytes        int
+	maxNestingDepth int
+}
+
+// Assert resourceLimitsProcessor satisfies the Processor interface.
+var _ Processor = &resourceLimitsProcessor{}
+
+// NewResourceLimitsProcessor creates a Processor which passes resources whose
+// JSON is larger than maxBytes, or whose elements are nested more than
+// maxNestingDepth deep, to the pipeline's dead letter function. This allows
+// resources which a FHIR store would reject to be caught before they are
+// uploaded. A limit of zero (or less) is not checked.
+//
+// Depth is computed from the resource proto, counting the resource itself and
+// each complex element (such as a CodeableConcept, or a BackboneElement) on
+// the path to the most deeply nested element. Primitive elements and choice
+// type wrappers are not counted, so this is close to the nesting depth of the
+// resource's JSON.
+func NewResourceLimitsProcessor(maxBytes, maxNestingDepth int) Processor {
+	return &resourceLimitsProcessor{maxBytes: maxBytes, maxNestingDepth: maxNestingDepth}
+}
+
+func (rlp *resourceLimitsProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	if rlp.maxBytes > 0 {
+		json, err := resource.JSON()
+		if err != nil {
+			return err
+		}
+		if len(json) > rlp.maxBytes {
+			return rlp.reject(ctx, resource, "SIZE", fmt.Errorf("%w: %d bytes, limit %d", ErrResourceTooLarge, len(json), rlp.maxBytes))
+		}
+	}
+	if rlp.maxNestingDepth > 0 {
+		cr, err := resource.Proto()
+		if err != nil {
+			return err
+		}
+		msg := cr.ProtoReflect()
+		populated := msg.WhichOneof(msg.Descriptor().Oneofs().Get(0))
+		if populated == nil {
+			return fmt.Errorf("%s resource from %s has no content", resource.Type(), resource.SourceURL())
+		}
+		if exceedsDepth(msg.Get(populated).Message(), 0, rlp.maxNestingDepth) {
+			return rlp.reject(ctx, resource, "DEPTH", fmt.Errorf("%w: limit %d", ErrResourceTooDeep, rlp.maxNestingDepth))
+		}
+	}
+	return rlp.Output(ctx, resource)
+}
+
+func (rlp *resourceLimitsProcessor) reject(ctx context.Context, resource ResourceWrapper, limitType string, reason error) error {
+	if err := resourceLimitsCounter.Record(ctx, 1, resource.Type().String(), limitType); err != nil {
+		return err
+	}
+	return rlp.DeadLetterResource(ctx, resource, reason)
+}
+
+// exceedsDepth returns whether msg, at the given depth, has elements nested
+// more than maxDepth deep. The recursion stops as soon as the limit is
+// exceeded.
+func exceedsDepth(msg protoreflect.Message, depth, maxDepth int) bool {
+	if countsTowardsDepth(msg.Descriptor()) {
+		depth++
+		if depth > maxDepth {
+			return true
+		}
+	}
+	exceeded := false
+	msg.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if fd.Message() == nil || fd.IsMap() {
+			return true
+		}
+		if fd.IsList() {
+			list := v.List()
+			for i := 0; i < list.Len() && !exceeded; i++ {
+				exceeded = exceedsDepth(list.Get(i).Message(), depth, maxDepth)
+			}
+		} else {
+			exceeded = exceedsDepth(v.Message(), depth, maxDepth)
+		}
+		return !exceeded
+	})
+	return exceeded
+}
+
+// countsTowardsDepth returns false for FHIR primitive types and choice type
+// wrappers, which do not add a level of nesting in FHIR JSON.
+func countsTowardsDepth(md protoreflect.MessageDescriptor) bool {
+	opts := md.Options()
+	if proto.GetExtension(opts, apb.E_IsChoiceType).(bool) {
+		return false
+	}
+	return proto.GetExtension(opts, apb.E_StructureDefinitionKind).(apb.StructureDefinitionKindValue) != apb.StructureDefinitionKindValue_KIND_PRIMITIVE_TYPE
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestResourceLimitsProcessor(t *testing.T) {
+	// The Observation is nested 3 deep: Observation.code.coding. The primitive
+	// elements and the choice type value[x] do not add to the depth.
+	observation := `{"resourceType":"Observation","id":"1","status":"final","code":{"coding":[{"system":"s","code":"c"}]},"valueString":"v"}`
+	cases := []struct {
+		name            string
+		maxBytes        int
+		maxNestingDepth int
+		json            string
+		wantErr         error
+	}{
+		{
+			name:            "WithinLimits",
+			maxBytes:        len(observation),
+			maxNestingDepth: 3,
+			json:            observation,
+		},
+		{
+			name:     "TooLarge",
+			maxBytes: len(observation) - 1,
+			json:     observation,
+			wantErr:  processing.ErrResourceTooLarge,
+		},
+		{
+			name:            "TooDeep",
+			maxNestingDepth: 2,
+			json:            observation,
+			wantErr:         processing.ErrResourceTooDeep,
+		},
+		{
+			name:            "PrimitivesOnly",
+			maxNestingDepth: 1,
+			json:            `{"resourceType":"Observation","id":"1","status":"final","valueString":"v"}`,
+		},
+		{
+			name: "NoLimits",
+			json: observation,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rlp := processing.NewResourceLimitsProcessor(tc.maxBytes, tc.maxNestingDepth)
+			ts := &processing.TestSink{}
+			var deadLetterReasons []error
+			opts := &processing.PipelineOptions{
+				DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+					deadLetterReasons = append(deadLetterReasons, reason)
+					return nil
+				},
+			}
+			p, err := processing.NewPipelineWithOptions([]processing.Processor{rlp}, []processing.Sink{ts}, opts)
+			if err != nil {
+				t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+			}
+			if err := p.Process(context.Background(), cpb.ResourceTypeCode_OBSERVATION, "", []byte(tc.json)); err != nil {
+				t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", tc.json, err)
+			}
+
+			if tc.wantErr == nil {
+				if len(ts.WrittenResources) != 1 || len(deadLetterReasons) != 0 {
+					t.Errorf("resource was not passed through: written %d, dead lettered: %v", len(ts.WrittenResources), deadLetterReasons)
+				}
+				return
+			}
+			if len(ts.WrittenResources) != 0 {
+				t.Errorf("resource exceeding limits was written")
+			}
+			if len(deadLetterReasons) != 1 || !errors.Is(deadLetterReasons[0], tc.wantErr) {
+				t.Errorf("unexpected dead letter reasons. got: %v, want: [%v]", deadLetterReasons, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/fhir"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// ErrOutsideRetentionWindow is passed (wrapped) as the dead letter reason for
+// resources older than the retention window, if the RetentionDeadLetter action
+// is used.
+var ErrOutsideRetentionWindow = errors.New("resource is older than the retention window")
+
+// ErrNoRetentionDate is passed (wrapped) as the dead letter reason for
+// resources with no usable date, if the RetentionDeadLetter action is used for
+// them.
+var ErrNoRetentionDate = errors.New("resource has no date to apply the retention window to")
+
+var retentionWindowCounter *metrics.Counter = metrics.NewCounter("retention-window-counter", "Count of FHIR Resources removed or passed on by the retention window processor because they were older than the window or had no usable date. The counter is tagged by the FHIR Resource type ex) OBSERVATION, the reason ex) expired, and the action taken.", "1", aggregation.Count, "FHIRResourceType", "Reason", "Action")
+
+// RetentionAction is the action taken by NewRetentionWindowProcessor on
+// resources which are older than the retention window, or which have no usable
+// date.
+type RetentionAction int
+
+const (
+	// RetentionDrop drops the resource.
+	RetentionDrop RetentionAction = iota
+	// RetentionDeadLetter passes the resource to the pipeline's dead letter
+	// function.
+	RetentionDeadLetter
+	// RetentionKeep passes the resource on unchanged.
+	RetentionKeep
+)
+
+func (a RetentionAction) String() string {
+	switch a {
+	case RetentionDrop:
+		return "drop"
+	case RetentionDeadLetter:
+		return "dead_letter"
+	case RetentionKeep:
+		return "keep"
+	default:
+		return fmt.Sprintf("RetentionAction(%d)", int(a))
+	}
+}
+
+// RetentionWindowProcessorOptions contains optional parameters used by
+// NewRetentionWindowProcessorWithOptions.
+type RetentionWindowProcessorOptions struct {
+	// The fields holding the date of resources of every type, as dot separated
+	// paths of FHIR JSON field names, in order of preference: the first field
+	// with a valid date, dateTime or instant is used. If a path traverses a
+	// list, the latest date in the list is used. Defaults to meta.lastUpdated.
+	DateFields []string
+	// The fields holding the date of resources of specific types, which are used
+	// instead of DateFields for those types. For example, Observations might use
+	// effectiveDateTime and then meta.lastUpdated.
+	ResourceDateFields map[cpb.ResourceTypeCode_Value][]string
+	// The action taken on resources older than the window. Defaults to
+	// RetentionDrop.
+	Action RetentionAction
+	// The action taken on resources with no usable date in any of their date
+	// fields. Defaults to RetentionDrop, so that resources which may be older
+	// than the window are not ingested.
+	NoDateAction RetentionAction
+}
+
+type retentionWindowProcessor struct {
+	BaseProcessor
+	maxAge         time.Duration
+	action         RetentionAction
+	noDateAction   RetentionAction
+	commonFields   [][]string
+	resourceFields map[cpb.ResourceTypeCode_Value][][]string
+}
+
+// Assert retentionWindowProcessor satisfies the Processor interface.
+var _ Processor = &retentionWindowProcessor{}
+
+// NewRetentionWindowProcessor creates a Processor which enforces a retention
+// policy: resources whose meta.lastUpdated is more than maxAge before the
+// current time are dropped, as are resources with no lastUpdated. Unlike a
+// fixed cutoff, the window moves with the current time, so the same pipeline
+// can be run repeatedly under the same policy.
+func NewRetentionWindowProcessor(maxAge time.Duration) (Processor, error) {
+	return NewRetentionWindowProcessorWithOptions(maxAge, nil)
+}
+
+// NewRetentionWindowProcessorWithOptions is like NewRetentionWindowProcessor,
+// but allows the date fields and the actions taken to be configured. opts may
+// be nil.
+func NewRetentionWindowProcessorWithOptions(maxAge time.Duration, opts *RetentionWindowProcessorOptions) (Processor, error) {
+	if maxAge <= 0 {
+		return nil, fmt.Errorf("the retention window must be positive, got %s", maxAge)
+	}
+	if opts == nil {
+		opts = &RetentionWindowProcessorOptions{}
+	}
+	for _, a := range []RetentionAction{opts.Action, opts.NoDateAction} {
+		switch a {
+		case RetentionDrop, RetentionDeadLetter, RetentionKeep:
+		default:
+			return nil, fmt.Errorf("unknown RetentionAction %d", a)
+		}
+	}
+	splitPaths := func(paths []string) ([][]string, error) {
+		var split [][]string
+		for _, p := range paths {
+			parts := strings.Split(p, ".")
+			for _, part := range parts {
+				if part == "" {
+					return nil, fmt.Errorf("invalid field path %q", p)
+				}
+			}
+			split = append(split, parts)
+		}
+		return split, nil
+	}
+	rwp := &retentionWindowProcessor{
+		maxAge:         maxAge,
+		action:         opts.Action,
+		noDateAction:   opts.NoDateAction,
+		resourceFields: map[cpb.ResourceTypeCode_Value][][]string{},
+	}
+	fields := opts.DateFields
+	if len(fields) == 0 {
+		fields = []string{"meta.lastUpdated"}
+	}
+	var err error
+	if rwp.commonFields, err = splitPaths(fields); err != nil {
+		return nil, err
+	}
+	for resourceType, paths := range opts.ResourceDateFields {
+		if rwp.resourceFields[resourceType], err = splitPaths(paths); err != nil {
+			return nil, fmt.Errorf("%s: %w", resourceType, err)
+		}
+	}
+	return rwp, nil
+}
+
+func (rwp *retentionWindowProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	fields, ok := rwp.resourceFields[resource.Type()]
+	if !ok {
+		fields = rwp.commonFields
+	}
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	res, err := decodeResourceJSON(rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+
+	cutoff := time.Now().Add(-rwp.maxAge)
+	for _, parts := range fields {
+		var latest time.Time
+		var latestValue string
+		visitTimestamps(res, parts, parts[0], func(value, path string, set func(string)) {
+			end, err := fhirDateTimeEnd(value)
+			if err == nil && end.After(latest) {
+				latest, latestValue = end, value
+			}
+		})
+		if latest.IsZero() {
+			continue
+		}
+		if latest.After(cutoff) {
+			return rwp.Output(ctx, resource)
+		}
+		reason := fmt.Errorf("%w: %s %s is before %s", ErrOutsideRetentionWindow, strings.Join(parts, "."), latestValue, fhir.ToFHIRInstant(cutoff))
+		return rwp.apply(ctx, resource, rwp.action, "expired", reason)
+	}
+	return rwp.apply(ctx, resource, rwp.noDateAction, "no_date", ErrNoRetentionDate)
+}
+
+// apply takes the action on a resource outside the retention window, or with
+// no date.
+func (rwp *retentionWindowProcessor) apply(ctx context.Context, resource ResourceWrapper, action RetentionAction, reason string, err error) error {
+	if err := retentionWindowCounter.Record(ctx, 1, resource.Type().String(), reason, action.String()); err != nil {
+		return err
+	}
+	switch action {
+	case RetentionKeep:
+		return rwp.Output(ctx, resource)
+	case RetentionDeadLetter:
+		return rwp.DeadLetterResource(ctx, resource, err)
+	default:
+		return nil
+	}
+}
+
+// fhirDateTimeEnd parses a FHIR date, dateTime or instant, returning the end of
+// the period it covers: for example, the start of 2021 for the date 2020.
+func fhirDateTimeEnd(value string) (time.Time, error) {
+	t, err := fhir.ParseFHIRDateTime(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	switch len(value) {
+	case len("2006"):
+		return t.AddDate(1, 0, 0), nil
+	case len("2006-01"):
+		return t.AddDate(0, 1, 0), nil
+	case len("2006-01-02"):
+		return t.AddDate(0, 0, 1), nil
+	default:
+		return t, nil
+	}
+}
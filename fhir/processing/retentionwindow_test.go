@@ -0,0 +1,138 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/fhir"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestRetentionWindowProcessor(t *testing.T) {
+	recent := fhir.ToFHIRInstant(time.Now().Add(-24 * time.Hour))
+	old := fhir.ToFHIRInstant(time.Now().Add(-60 * 24 * time.Hour))
+	thisYear := time.Now().Format("2006")
+
+	cases := []struct {
+		name         string
+		opts         *processing.RetentionWindowProcessorOptions
+		resourceType cpb.ResourceTypeCode_Value
+		json         string
+		wantWritten  bool
+		wantReason   error
+	}{
+		{
+			name:         "recent lastUpdated",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         fmt.Sprintf(`{"resourceType":"Patient","id":"1","meta":{"lastUpdated":%q}}`, recent),
+			wantWritten:  true,
+		},
+		{
+			name:         "old lastUpdated is dropped",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         fmt.Sprintf(`{"resourceType":"Patient","id":"1","meta":{"lastUpdated":%q}}`, old),
+		},
+		{
+			name:         "no lastUpdated is dropped",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         `{"resourceType":"Patient","id":"1"}`,
+		},
+		{
+			name:         "old lastUpdated is dead lettered",
+			opts:         &processing.RetentionWindowProcessorOptions{Action: processing.RetentionDeadLetter},
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         fmt.Sprintf(`{"resourceType":"Patient","id":"1","meta":{"lastUpdated":%q}}`, old),
+			wantReason:   processing.ErrOutsideRetentionWindow,
+		},
+		{
+			name:         "no date is kept",
+			opts:         &processing.RetentionWindowProcessorOptions{NoDateAction: processing.RetentionKeep},
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         `{"resourceType":"Patient","id":"1","meta":{"lastUpdated":"invalid"}}`,
+			wantWritten:  true,
+		},
+		{
+			name:         "no date is dead lettered",
+			opts:         &processing.RetentionWindowProcessorOptions{NoDateAction: processing.RetentionDeadLetter},
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         `{"resourceType":"Patient","id":"1"}`,
+			wantReason:   processing.ErrNoRetentionDate,
+		},
+		{
+			name: "clinical date is preferred to lastUpdated",
+			opts: &processing.RetentionWindowProcessorOptions{
+				ResourceDateFields: map[cpb.ResourceTypeCode_Value][]string{cpb.ResourceTypeCode_OBSERVATION: {"effectiveDateTime", "meta.lastUpdated"}},
+			},
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         fmt.Sprintf(`{"resourceType":"Observation","id":"1","effectiveDateTime":%q,"meta":{"lastUpdated":%q}}`, old, recent),
+		},
+		{
+			name: "falls back to lastUpdated",
+			opts: &processing.RetentionWindowProcessorOptions{
+				ResourceDateFields: map[cpb.ResourceTypeCode_Value][]string{cpb.ResourceTypeCode_OBSERVATION: {"effectiveDateTime", "meta.lastUpdated"}},
+			},
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			json:         fmt.Sprintf(`{"resourceType":"Observation","id":"1","meta":{"lastUpdated":%q}}`, recent),
+			wantWritten:  true,
+		},
+		{
+			name:         "latest date in a list is used",
+			opts:         &processing.RetentionWindowProcessorOptions{DateFields: []string{"period.start"}},
+			resourceType: cpb.ResourceTypeCode_ENCOUNTER,
+			json:         fmt.Sprintf(`{"resourceType":"Encounter","id":"1","period":[{"start":%q},{"start":%q}]}`, old, recent),
+			wantWritten:  true,
+		},
+		{
+			name:         "partial date covering the window is kept",
+			opts:         &processing.RetentionWindowProcessorOptions{DateFields: []string{"birthDate"}},
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			json:         fmt.Sprintf(`{"resourceType":"Patient","id":"1","birthDate":%q}`, thisYear),
+			wantWritten:  true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := processing.NewRetentionWindowProcessorWithOptions(30*24*time.Hour, tc.opts)
+			if err != nil {
+				t.Fatalf("NewRetentionWindowProcessorWithOptions() returned unexpected error: %v", err)
+			}
+			written, reason := runFutureTimestampProcessor(t, p, tc.resourceType, tc.json)
+			if gotWritten := written != nil; gotWritten != tc.wantWritten {
+				t.Errorf("unexpected resource written: got %v, want %v", gotWritten, tc.wantWritten)
+			}
+			if !errors.Is(reason, tc.wantReason) {
+				t.Errorf("unexpected dead letter reason. got: %v, want: %v", reason, tc.wantReason)
+			}
+		})
+	}
+}
+
+func TestNewRetentionWindowProcessor_Errors(t *testing.T) {
+	if _, err := processing.NewRetentionWindowProcessor(0); err == nil {
+		t.Error("NewRetentionWindowProcessor(0) returned nil error")
+	}
+	if _, err := processing.NewRetentionWindowProcessorWithOptions(time.Hour, &processing.RetentionWindowProcessorOptions{DateFields: []string{"meta..lastUpdated"}}); err == nil {
+		t.Error("NewRetentionWindowProcessorWithOptions() with an invalid field path returned nil error")
+	}
+	if _, err := processing.NewRetentionWindowProcessorWithOptions(time.Hour, &processing.RetentionWindowProcessorOptions{Action: processing.RetentionAction(10)}); err == nil {
+		t.Error("NewRetentionWindowProcessorWithOptions() with an unknown action returned nil error")
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/uuid"
+
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+)
+
+// DefaultRunIDTagSystem is the system of the meta.tag added by the processor
+// returned by NewRunIDProcessor, if no other system is configured.
+const DefaultRunIDTagSystem = "https://github.com/google/bulk_fhir_tools/run-id"
+
+// RunIDProcessorOptions contains optional parameters used by
+// NewRunIDProcessor.
+type RunIDProcessorOptions struct {
+	// The system of the tag. Defaults to DefaultRunIDTagSystem.
+	TagSystem string
+}
+
+type runIDProcessor struct {
+	BaseProcessor
+	runID  string
+	system string
+}
+
+// Assert runIDProcessor satisfies the Processor interface.
+var _ Processor = &runIDProcessor{}
+
+// NewRunIDProcessor creates a Processor which adds a meta.tag with the code
+// runID to every resource, so that all of the resources loaded by a run can
+// later be found (for example, by searching a FHIR store with _tag). Any
+// existing tag with the same system (for example, from a previous run) is
+// replaced. If runID is empty, a random UUID is generated and logged.
+func NewRunIDProcessor(runID string, opts *RunIDProcessorOptions) Processor {
+	if opts == nil {
+		opts = &RunIDProcessorOptions{}
+	}
+	if runID == "" {
+		runID = uuid.New().String()
+		log.Infof("Tagging resources with generated run ID %s", runID)
+	}
+	system := opts.TagSystem
+	if system == "" {
+		system = DefaultRunIDTagSystem
+	}
+	return &runIDProcessor{runID: runID, system: system}
+}
+
+func (rip *runIDProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	meta, err := mutableMeta(resource)
+	if err != nil {
+		return err
+	}
+	setTag(meta, rip.system, rip.runID)
+	return rip.Output(ctx, resource)
+}
+
+// setTag adds a meta.tag with the given system and code, replacing any
+// existing tags with the same system.
+func setTag(meta *dpb.Meta, system, code string) {
+	tags := meta.GetTag()[:0]
+	for _, t := range meta.GetTag() {
+		if t.GetSystem().GetValue() != system {
+			tags = append(tags, t)
+		}
+	}
+	meta.Tag = append(tags, &dpb.Coding{
+		System: &dpb.Uri{Value: system},
+		Code:   &dpb.Code{Value: code},
+	})
+}
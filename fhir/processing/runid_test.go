@@ -0,0 +1,96 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+	"github.com/google/uuid"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestRunIDProcessor(t *testing.T) {
+	cases := []struct {
+		name string
+		opts *processing.RunIDProcessorOptions
+		json string
+		want string
+	}{
+		{
+			name: "NoMeta",
+			json: `{"resourceType":"Patient","id":"1"}`,
+			want: `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"https://github.com/google/bulk_fhir_tools/run-id","code":"run-1"}]}}`,
+		},
+		{
+			name: "ExistingTags",
+			opts: &processing.RunIDProcessorOptions{TagSystem: "https://example.com/run-id"},
+			json: `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"https://example.com/other","code":"a"},{"system":"https://example.com/run-id","code":"run-0"}]}}`,
+			want: `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"https://example.com/other","code":"a"},{"system":"https://example.com/run-id","code":"run-1"}]}}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := processWithRunID(t, "run-1", tc.opts, tc.json)
+			if testhelpers.NormalizeJSONString(t, string(got)) != testhelpers.NormalizeJSONString(t, tc.want) {
+				t.Errorf("unexpected resource JSON. got: %s, want: %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRunIDProcessor_GeneratedRunID(t *testing.T) {
+	got := processWithRunID(t, "", nil, `{"resourceType":"Patient","id":"1"}`)
+	var res struct {
+		Meta struct {
+			Tag []struct {
+				Code string `json:"code"`
+			} `json:"tag"`
+		} `json:"meta"`
+	}
+	if err := json.Unmarshal(got, &res); err != nil {
+		t.Fatalf("failed to unmarshal resource: %v", err)
+	}
+	if len(res.Meta.Tag) != 1 {
+		t.Fatalf("unexpected number of tags. got: %d, want: 1", len(res.Meta.Tag))
+	}
+	if _, err := uuid.Parse(res.Meta.Tag[0].Code); err != nil {
+		t.Errorf("generated run ID %q is not a UUID: %v", res.Meta.Tag[0].Code, err)
+	}
+}
+
+func processWithRunID(t *testing.T, runID string, opts *processing.RunIDProcessorOptions, resourceJSON string) []byte {
+	t.Helper()
+	ts := &processing.TestSink{}
+	p, err := processing.NewPipeline([]processing.Processor{processing.NewRunIDProcessor(runID, opts)}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	if err := p.Process(context.Background(), cpb.ResourceTypeCode_PATIENT, "", []byte(resourceJSON)); err != nil {
+		t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", resourceJSON, err)
+	}
+	if len(ts.WrittenResources) != 1 {
+		t.Fatalf("unexpected number of resources written. got: %d, want: 1", len(ts.WrittenResources))
+	}
+	got, err := ts.WrittenResources[0].JSON()
+	if err != nil {
+		t.Fatalf("JSON() returned unexpected error: %v", err)
+	}
+	return got
+}
@@ -0,0 +1,441 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+)
+
+// maxSchemaProfileValues is the maximum number of distinct values profiled for
+// a field. Fields with more values are marked as having too many values.
+const maxSchemaProfileValues = 50
+
+// defaultSchemaDriftThreshold is the default for
+// SchemaProfileProcessorOptions.DriftThreshold.
+const defaultSchemaDriftThreshold = 0.1
+
+// DefaultSchemaProfileValueFields are the field names whose values are
+// profiled by default. These are coded fields with a small set of values;
+// free text fields are not profiled, as their values may identify patients.
+var DefaultSchemaProfileValueFields = []string{"status", "intent", "gender", "use", "system", "code"}
+
+var schemaDriftCounter *metrics.Counter = metrics.NewCounter("schema-drift-counter", "Count of differences found between the schema profile of the resources processed and the baseline profile. The counter is tagged by the FHIR Resource type ex) OBSERVATION, and the kind of drift ex) rate_change.", "1", aggregation.Count, "FHIRResourceType", "Kind")
+
+// SchemaProfile is the profile of the resources processed by a
+// SchemaProfileProcessor, keyed by FHIR resource type name (for example,
+// ExplanationOfBenefit). It may be marshalled to JSON, and compared with the
+// profile of a later run with CompareSchemaProfiles.
+type SchemaProfile map[string]*ResourceTypeSchemaProfile
+
+// ResourceTypeSchemaProfile is the profile of the resources of a single type.
+type ResourceTypeSchemaProfile struct {
+	// Resources is the number of resources of the type.
+	Resources int `json:"resources"`
+	// Fields holds the profile of each field which appeared in the resources,
+	// keyed by its dot separated path, such as name.given. Repeated fields
+	// are flattened.
+	Fields map[string]*FieldSchemaProfile `json:"fields"`
+}
+
+// FieldSchemaProfile is the profile of a single field.
+type FieldSchemaProfile struct {
+	// Count is the number of resources in which the field was populated.
+	Count int `json:"count"`
+	// Rate is the fraction of resources of the type in which the field was
+	// populated.
+	Rate float64 `json:"rate"`
+	// Values holds the number of resources with each value of the field, if
+	// the field's values are profiled (see
+	// SchemaProfileProcessorOptions.ValueFields). Only string values are
+	// counted.
+	Values map[string]int `json:"values,omitempty"`
+	// TooManyValues is true if the field had too many distinct values to
+	// profile, in which case Values is not set.
+	TooManyValues bool `json:"tooManyValues,omitempty"`
+}
+
+// SchemaProfileProcessorOptions contains optional parameters used by
+// NewSchemaProfileProcessorWithOptions.
+type SchemaProfileProcessorOptions struct {
+	// If set, the profile is written to this local file as JSON by Finalize.
+	ReportPath string
+	// If set, the profile is compared with this baseline (for example, the
+	// profile of a previous run read with ReadSchemaProfile) by Finalize, and
+	// each difference found is logged as a warning and counted.
+	Baseline SchemaProfile
+	// The smallest change in a field's population rate (or in the fraction of
+	// a field's values which have a particular value) which is reported as
+	// drift. Defaults to 0.1.
+	DriftThreshold float64
+	// The names of the fields whose values are profiled, wherever they appear
+	// (for example, "code" profiles both code and code.coding.code). Defaults
+	// to DefaultSchemaProfileValueFields.
+	ValueFields []string
+}
+
+// SchemaProfileProcessor is a Processor which profiles the fields of the
+// resources of each type which pass through it: which fields appear, their
+// population rates, and the distribution of the values of coded fields.
+// Comparing the profiles of successive runs detects drift in the data a
+// server sends (for example, a field which used to be populated in every
+// resource dropping to half of them) before it breaks downstream consumers.
+// Resources are passed through unchanged.
+type SchemaProfileProcessor struct {
+	BaseProcessor
+	opts        SchemaProfileProcessorOptions
+	valueFields map[string]bool
+
+	mu      sync.Mutex
+	profile SchemaProfile
+}
+
+// Assert SchemaProfileProcessor satisfies the Processor interface.
+var _ Processor = &SchemaProfileProcessor{}
+
+// NewSchemaProfileProcessor creates a new SchemaProfileProcessor. The profile
+// may be read with Profile once the pipeline has been finalized.
+func NewSchemaProfileProcessor() *SchemaProfileProcessor {
+	return NewSchemaProfileProcessorWithOptions(nil)
+}
+
+// NewSchemaProfileProcessorWithOptions is like NewSchemaProfileProcessor, but
+// with the given options. opts may be nil.
+func NewSchemaProfileProcessorWithOptions(opts *SchemaProfileProcessorOptions) *SchemaProfileProcessor {
+	if opts == nil {
+		opts = &SchemaProfileProcessorOptions{}
+	}
+	spp := &SchemaProfileProcessor{opts: *opts, valueFields: map[string]bool{}, profile: SchemaProfile{}}
+	if spp.opts.DriftThreshold <= 0 {
+		spp.opts.DriftThreshold = defaultSchemaDriftThreshold
+	}
+	if spp.opts.ValueFields == nil {
+		spp.opts.ValueFields = DefaultSchemaProfileValueFields
+	}
+	for _, f := range spp.opts.ValueFields {
+		spp.valueFields[f] = true
+	}
+	return spp
+}
+
+// Process is Processor.Process.
+func (spp *SchemaProfileProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	res, err := decodeResourceJSON(rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	name, err := bulkfhir.ResourceTypeCodeToName(resource.Type())
+	if err != nil {
+		return err
+	}
+	// Each field (and value) is counted at most once per resource.
+	fields := map[string]bool{}
+	values := map[string]map[string]bool{}
+	spp.collectFields(res, "", fields, values)
+
+	spp.mu.Lock()
+	tp, ok := spp.profile[name]
+	if !ok {
+		tp = &ResourceTypeSchemaProfile{Fields: map[string]*FieldSchemaProfile{}}
+		spp.profile[name] = tp
+	}
+	tp.Resources++
+	for path := range fields {
+		fp, ok := tp.Fields[path]
+		if !ok {
+			fp = &FieldSchemaProfile{}
+			tp.Fields[path] = fp
+		}
+		fp.Count++
+		if fieldValues, ok := values[path]; ok && !fp.TooManyValues {
+			if fp.Values == nil {
+				fp.Values = map[string]int{}
+			}
+			for v := range fieldValues {
+				fp.Values[v]++
+			}
+			if len(fp.Values) > maxSchemaProfileValues {
+				fp.Values, fp.TooManyValues = nil, true
+			}
+		}
+	}
+	spp.mu.Unlock()
+
+	return spp.Output(ctx, resource)
+}
+
+// collectFields adds the path of each field within the JSON value v to
+// fields, and the string values of the fields in valueFields to values.
+func (spp *SchemaProfileProcessor) collectFields(v any, path string, fields map[string]bool, values map[string]map[string]bool) {
+	switch v := v.(type) {
+	case map[string]any:
+		for key, child := range v {
+			if path == "" && key == "resourceType" {
+				continue
+			}
+			childPath := key
+			if path != "" {
+				childPath = path + "." + key
+			}
+			fields[childPath] = true
+			spp.collectFields(child, childPath, fields, values)
+			if s, ok := child.(string); ok && spp.valueFields[key] {
+				if values[childPath] == nil {
+					values[childPath] = map[string]bool{}
+				}
+				values[childPath][s] = true
+			}
+			if list, ok := child.([]any); ok && spp.valueFields[key] {
+				for _, item := range list {
+					if s, ok := item.(string); ok {
+						if values[childPath] == nil {
+							values[childPath] = map[string]bool{}
+						}
+						values[childPath][s] = true
+					}
+				}
+			}
+		}
+	case []any:
+		for _, item := range v {
+			spp.collectFields(item, path, fields, values)
+		}
+	}
+}
+
+// Finalize is Processor.Finalize. It logs a summary of the profile, writes it
+// to ReportPath and compares it with the Baseline, if they are set.
+func (spp *SchemaProfileProcessor) Finalize(ctx context.Context) error {
+	profile := spp.Profile()
+	types := make([]string, 0, len(profile))
+	for name := range profile {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	for _, name := range types {
+		log.Infof("Schema profile: %d %s resources with %d distinct fields.", profile[name].Resources, name, len(profile[name].Fields))
+	}
+
+	if spp.opts.ReportPath != "" {
+		data, err := json.MarshalIndent(profile, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(spp.opts.ReportPath, append(data, '\n'), 0644); err != nil {
+			return fmt.Errorf("failed to write schema profile to %s: %w", spp.opts.ReportPath, err)
+		}
+	}
+
+	if spp.opts.Baseline != nil {
+		drifts := CompareSchemaProfiles(spp.opts.Baseline, profile, spp.opts.DriftThreshold)
+		for _, d := range drifts {
+			log.Warningf("Schema drift: %s", d)
+			if err := schemaDriftCounter.Record(ctx, 1, d.ResourceType, string(d.Kind)); err != nil {
+				return err
+			}
+		}
+		log.Infof("Found %d differences from the baseline schema profile.", len(drifts))
+	}
+	return spp.BaseProcessor.Finalize(ctx)
+}
+
+// Profile returns a copy of the profile so far.
+func (spp *SchemaProfileProcessor) Profile() SchemaProfile {
+	spp.mu.Lock()
+	defer spp.mu.Unlock()
+	profile := make(SchemaProfile, len(spp.profile))
+	for name, tp := range spp.profile {
+		fields := make(map[string]*FieldSchemaProfile, len(tp.Fields))
+		for path, fp := range tp.Fields {
+			copied := *fp
+			copied.Rate = float64(fp.Count) / float64(tp.Resources)
+			if fp.Values != nil {
+				copied.Values = make(map[string]int, len(fp.Values))
+				for v, n := range fp.Values {
+					copied.Values[v] = n
+				}
+			}
+			fields[path] = &copied
+		}
+		profile[name] = &ResourceTypeSchemaProfile{Resources: tp.Resources, Fields: fields}
+	}
+	return profile
+}
+
+// ReadSchemaProfile reads a SchemaProfile written to a local file by a
+// SchemaProfileProcessor (see SchemaProfileProcessorOptions.ReportPath).
+func ReadSchemaProfile(path string) (SchemaProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema profile %s: %w", path, err)
+	}
+	var profile SchemaProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("failed to parse schema profile %s: %w", path, err)
+	}
+	return profile, nil
+}
+
+// SchemaDriftKind is a kind of difference found by CompareSchemaProfiles.
+type SchemaDriftKind string
+
+const (
+	// DriftNewResourceType is a resource type which is not in the baseline.
+	DriftNewResourceType SchemaDriftKind = "new_resource_type"
+	// DriftMissingResourceType is a resource type in the baseline which is no
+	// longer present.
+	DriftMissingResourceType SchemaDriftKind = "missing_resource_type"
+	// DriftNewField is a field which is not in the baseline.
+	DriftNewField SchemaDriftKind = "new_field"
+	// DriftMissingField is a field in the baseline which is no longer
+	// populated.
+	DriftMissingField SchemaDriftKind = "missing_field"
+	// DriftRateChange is a change in a field's population rate.
+	DriftRateChange SchemaDriftKind = "rate_change"
+	// DriftNewValue is a value of a profiled field which is not in the
+	// baseline.
+	DriftNewValue SchemaDriftKind = "new_value"
+	// DriftValueRateChange is a change in the fraction of a profiled field's
+	// values which have a particular value.
+	DriftValueRateChange SchemaDriftKind = "value_rate_change"
+)
+
+// SchemaDrift is a difference between two SchemaProfiles.
+type SchemaDrift struct {
+	Kind         SchemaDriftKind
+	ResourceType string
+	// Field and Value are set for the kinds of drift which apply to them.
+	Field string
+	Value string
+	// BaselineRate and Rate are the population rates of the field (or, for
+	// the value kinds, the fraction of the field's values which have the value)
+	// in the baseline and current profiles.
+	BaselineRate float64
+	Rate         float64
+}
+
+func (sd SchemaDrift) String() string {
+	switch sd.Kind {
+	case DriftNewResourceType, DriftMissingResourceType:
+		return fmt.Sprintf("%s: %s", sd.Kind, sd.ResourceType)
+	case DriftNewValue:
+		return fmt.Sprintf("%s: %s.%s has new value %q", sd.Kind, sd.ResourceType, sd.Field, sd.Value)
+	case DriftValueRateChange:
+		return fmt.Sprintf("%s: %s.%s value %q changed from %.1f%% to %.1f%%", sd.Kind, sd.ResourceType, sd.Field, sd.Value, sd.BaselineRate*100, sd.Rate*100)
+	default:
+		return fmt.Sprintf("%s: %s.%s population changed from %.1f%% to %.1f%%", sd.Kind, sd.ResourceType, sd.Field, sd.BaselineRate*100, sd.Rate*100)
+	}
+}
+
+// CompareSchemaProfiles returns the differences between the baseline and
+// current profiles: resource types and fields which have appeared or
+// disappeared, changes in population rates of at least threshold, and new
+// values (and changes of at least threshold in the distribution of values) of
+// profiled fields. The differences are sorted by resource type and field.
+func CompareSchemaProfiles(baseline, current SchemaProfile, threshold float64) []SchemaDrift {
+	var drifts []SchemaDrift
+	for name := range baseline {
+		if _, ok := current[name]; !ok {
+			drifts = append(drifts, SchemaDrift{Kind: DriftMissingResourceType, ResourceType: name})
+		}
+	}
+	for name, tp := range current {
+		btp, ok := baseline[name]
+		if !ok {
+			drifts = append(drifts, SchemaDrift{Kind: DriftNewResourceType, ResourceType: name})
+			continue
+		}
+		for path, bfp := range btp.Fields {
+			if _, ok := tp.Fields[path]; !ok && bfp.Count > 0 {
+				drifts = append(drifts, SchemaDrift{Kind: DriftMissingField, ResourceType: name, Field: path, BaselineRate: bfp.Rate})
+			}
+		}
+		for path, fp := range tp.Fields {
+			bfp, ok := btp.Fields[path]
+			if !ok {
+				drifts = append(drifts, SchemaDrift{Kind: DriftNewField, ResourceType: name, Field: path, Rate: fp.Rate})
+				continue
+			}
+			if driftExceeds(fp.Rate, bfp.Rate, threshold) {
+				drifts = append(drifts, SchemaDrift{Kind: DriftRateChange, ResourceType: name, Field: path, BaselineRate: bfp.Rate, Rate: fp.Rate})
+			}
+			drifts = append(drifts, compareFieldValues(name, path, bfp, fp, threshold)...)
+		}
+	}
+	sort.Slice(drifts, func(i, j int) bool {
+		a, b := drifts[i], drifts[j]
+		if a.ResourceType != b.ResourceType {
+			return a.ResourceType < b.ResourceType
+		}
+		if a.Field != b.Field {
+			return a.Field < b.Field
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Value < b.Value
+	})
+	return drifts
+}
+
+// compareFieldValues returns the differences between the values of a field in
+// the baseline and current profiles, if they were profiled in both.
+func compareFieldValues(resourceType, path string, baseline, current *FieldSchemaProfile, threshold float64) []SchemaDrift {
+	if baseline.Values == nil || current.Values == nil {
+		return nil
+	}
+	var drifts []SchemaDrift
+	for v, n := range current.Values {
+		bn, ok := baseline.Values[v]
+		if !ok {
+			drifts = append(drifts, SchemaDrift{Kind: DriftNewValue, ResourceType: resourceType, Field: path, Value: v, Rate: float64(n) / float64(current.Count)})
+			continue
+		}
+		rate, baselineRate := float64(n)/float64(current.Count), float64(bn)/float64(baseline.Count)
+		if driftExceeds(rate, baselineRate, threshold) {
+			drifts = append(drifts, SchemaDrift{Kind: DriftValueRateChange, ResourceType: resourceType, Field: path, Value: v, BaselineRate: baselineRate, Rate: rate})
+		}
+	}
+	for v, bn := range baseline.Values {
+		if _, ok := current.Values[v]; !ok {
+			baselineRate := float64(bn) / float64(baseline.Count)
+			if driftExceeds(baselineRate, 0, threshold) {
+				drifts = append(drifts, SchemaDrift{Kind: DriftValueRateChange, ResourceType: resourceType, Field: path, Value: v, BaselineRate: baselineRate})
+			}
+		}
+	}
+	return drifts
+}
+
+// driftExceeds returns whether the change from baseline to rate is at least
+// threshold, allowing for floating point error so that, for example, a change
+// from 50% to 40% meets a threshold of 0.1.
+func driftExceeds(rate, baseline, threshold float64) bool {
+	return math.Abs(rate-baseline) >= threshold-1e-9
+}
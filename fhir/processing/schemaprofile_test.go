@@ -0,0 +1,119 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestSchemaProfileProcessor(t *testing.T) {
+	resources := []typedResource{
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p1","gender":"female","name":[{"family":"Smith","given":["Jane"]},{"given":["J"]}]}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p2","gender":"male"}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p3","gender":"female","birthDate":"1970-01-01"}`},
+		{cpb.ResourceTypeCode_PATIENT, `{"resourceType":"Patient","id":"p4"}`},
+		{cpb.ResourceTypeCode_OBSERVATION, `{"resourceType":"Observation","id":"o1","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"1234-5"}]}}`},
+	}
+	reportPath := filepath.Join(t.TempDir(), "profile.json")
+	spp := processing.NewSchemaProfileProcessorWithOptions(&processing.SchemaProfileProcessorOptions{ReportPath: reportPath})
+	written := runProcessor(t, spp, resources)
+	if diff := cmp.Diff(mustUnmarshal(t, resources[0].json), written[0]); diff != "" {
+		t.Errorf("SchemaProfileProcessor modified the resource (-want +got):\n%s", diff)
+	}
+	if len(written) != len(resources) {
+		t.Errorf("unexpected number of resources passed through. got: %d, want: %d", len(written), len(resources))
+	}
+
+	want := processing.SchemaProfile{
+		"Patient": {
+			Resources: 4,
+			Fields: map[string]*processing.FieldSchemaProfile{
+				"id":          {Count: 4, Rate: 1},
+				"gender":      {Count: 3, Rate: 0.75, Values: map[string]int{"female": 2, "male": 1}},
+				"name":        {Count: 1, Rate: 0.25},
+				"name.family": {Count: 1, Rate: 0.25},
+				"name.given":  {Count: 1, Rate: 0.25},
+				"birthDate":   {Count: 1, Rate: 0.25},
+			},
+		},
+		"Observation": {
+			Resources: 1,
+			Fields: map[string]*processing.FieldSchemaProfile{
+				"id":                 {Count: 1, Rate: 1},
+				"status":             {Count: 1, Rate: 1, Values: map[string]int{"final": 1}},
+				"code":               {Count: 1, Rate: 1},
+				"code.coding":        {Count: 1, Rate: 1},
+				"code.coding.system": {Count: 1, Rate: 1, Values: map[string]int{"http://loinc.org": 1}},
+				"code.coding.code":   {Count: 1, Rate: 1, Values: map[string]int{"1234-5": 1}},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, spp.Profile()); diff != "" {
+		t.Errorf("Profile() returned unexpected profile (-want +got):\n%s", diff)
+	}
+	report, err := processing.ReadSchemaProfile(reportPath)
+	if err != nil {
+		t.Fatalf("ReadSchemaProfile() returned unexpected error: %v", err)
+	}
+	if diff := cmp.Diff(want, report); diff != "" {
+		t.Errorf("unexpected profile report (-want +got):\n%s", diff)
+	}
+}
+
+func TestCompareSchemaProfiles(t *testing.T) {
+	baseline := processing.SchemaProfile{
+		"Patient": {
+			Resources: 10,
+			Fields: map[string]*processing.FieldSchemaProfile{
+				"id":        {Count: 10, Rate: 1},
+				"gender":    {Count: 10, Rate: 1, Values: map[string]int{"female": 5, "male": 5}},
+				"birthDate": {Count: 9, Rate: 0.9},
+				"telecom":   {Count: 2, Rate: 0.2},
+			},
+		},
+		"Coverage": {Resources: 1, Fields: map[string]*processing.FieldSchemaProfile{"id": {Count: 1, Rate: 1}}},
+	}
+	current := processing.SchemaProfile{
+		"Patient": {
+			Resources: 10,
+			Fields: map[string]*processing.FieldSchemaProfile{
+				"id":        {Count: 10, Rate: 1},
+				"gender":    {Count: 10, Rate: 1, Values: map[string]int{"female": 5, "male": 4, "unknown": 1}},
+				"birthDate": {Count: 4, Rate: 0.4},
+				"address":   {Count: 1, Rate: 0.1},
+			},
+		},
+		"Observation": {Resources: 1, Fields: map[string]*processing.FieldSchemaProfile{"id": {Count: 1, Rate: 1}}},
+	}
+	got := processing.CompareSchemaProfiles(baseline, current, 0.1)
+	want := []processing.SchemaDrift{
+		{Kind: processing.DriftMissingResourceType, ResourceType: "Coverage"},
+		{Kind: processing.DriftNewResourceType, ResourceType: "Observation"},
+		{Kind: processing.DriftNewField, ResourceType: "Patient", Field: "address", Rate: 0.1},
+		{Kind: processing.DriftRateChange, ResourceType: "Patient", Field: "birthDate", BaselineRate: 0.9, Rate: 0.4},
+		{Kind: processing.DriftNewValue, ResourceType: "Patient", Field: "gender", Value: "unknown", Rate: 0.1},
+		{Kind: processing.DriftValueRateChange, ResourceType: "Patient", Field: "gender", Value: "male", BaselineRate: 0.5, Rate: 0.4},
+		{Kind: processing.DriftMissingField, ResourceType: "Patient", Field: "telecom", BaselineRate: 0.2},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("CompareSchemaProfiles() returned unexpected drift (-want +got):\n%s", diff)
+	}
+}
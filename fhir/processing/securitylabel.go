@@ -0,0 +1,147 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+
+	dpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/datatypes_go_proto"
+)
+
+// ConfidentialitySystem is the system of the confidentiality codes which
+// NewSecurityLabelProcessor requires in meta.security.
+const ConfidentialitySystem = "http://terminology.hl7.org/CodeSystem/v3-Confidentiality"
+
+// ErrMissingSecurityLabel is passed (wrapped) as the dead letter reason for
+// resources without a confidentiality security label, if the
+// SecurityLabelRequire action is used.
+var ErrMissingSecurityLabel = errors.New("resource has no confidentiality security label")
+
+var securityLabelCounter *metrics.Counter = metrics.NewCounter("security-label-counter", "Count of FHIR Resources without a confidentiality security label. The counter is tagged by the FHIR Resource type ex) OBSERVATION, and the action taken.", "1", aggregation.Count, "FHIRResourceType", "Action")
+
+// confidentialityDisplays maps each code of ConfidentialitySystem to its
+// display.
+var confidentialityDisplays = map[string]string{
+	"U": "unrestricted",
+	"L": "low",
+	"M": "moderate",
+	"N": "normal",
+	"R": "restricted",
+	"V": "very restricted",
+}
+
+// SecurityLabelAction is the action taken by NewSecurityLabelProcessor on
+// resources without a confidentiality security label.
+type SecurityLabelAction int
+
+const (
+	// SecurityLabelAdd adds the default label to the resource's meta.security.
+	SecurityLabelAdd SecurityLabelAction = iota
+	// SecurityLabelRequire passes the resource to the pipeline's dead letter
+	// function.
+	SecurityLabelRequire
+)
+
+func (a SecurityLabelAction) String() string {
+	switch a {
+	case SecurityLabelAdd:
+		return "add"
+	case SecurityLabelRequire:
+		return "require"
+	default:
+		return fmt.Sprintf("SecurityLabelAction(%d)", int(a))
+	}
+}
+
+type securityLabelProcessor struct {
+	BaseProcessor
+	defaultLabel string
+	action       SecurityLabelAction
+}
+
+// Assert securityLabelProcessor satisfies the Processor interface.
+var _ Processor = &securityLabelProcessor{}
+
+// NewSecurityLabelProcessor creates a Processor which ensures that every
+// resource's meta.security contains a Coding from ConfidentialitySystem (such
+// as N for normal, or R for restricted), enforcing a data classification
+// policy at ingestion. Resources without one are either given the
+// defaultLabel code (SecurityLabelAdd), creating the meta element if needed,
+// or dropped to the dead letter function (SecurityLabelRequire). defaultLabel
+// is only used with SecurityLabelAdd, and must be a code of
+// ConfidentialitySystem.
+func NewSecurityLabelProcessor(defaultLabel string, action SecurityLabelAction) (Processor, error) {
+	switch action {
+	case SecurityLabelAdd:
+		if _, ok := confidentialityDisplays[defaultLabel]; !ok {
+			return nil, fmt.Errorf("default security label %q is not a code of %s", defaultLabel, ConfidentialitySystem)
+		}
+	case SecurityLabelRequire:
+	default:
+		return nil, fmt.Errorf("unknown SecurityLabelAction %d", action)
+	}
+	return &securityLabelProcessor{defaultLabel: defaultLabel, action: action}, nil
+}
+
+// securityLabels holds the meta.security of a resource.
+type securityLabels struct {
+	Meta struct {
+		Security []struct {
+			System string `json:"system"`
+			Code   string `json:"code"`
+		} `json:"security"`
+	} `json:"meta"`
+}
+
+func (slp *securityLabelProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	// Check the JSON rather than the proto, so that labelled resources are not
+	// marked as mutated.
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var labels securityLabels
+	if err := json.Unmarshal(rawJSON, &labels); err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	for _, s := range labels.Meta.Security {
+		if s.System == ConfidentialitySystem && s.Code != "" {
+			return slp.Output(ctx, resource)
+		}
+	}
+
+	if err := securityLabelCounter.Record(ctx, 1, resource.Type().String(), slp.action.String()); err != nil {
+		return err
+	}
+	if slp.action == SecurityLabelRequire {
+		return slp.DeadLetterResource(ctx, resource, fmt.Errorf("%w: %s resource from %s", ErrMissingSecurityLabel, resource.Type(), resource.SourceURL()))
+	}
+	meta, err := mutableMeta(resource)
+	if err != nil {
+		return err
+	}
+	meta.Security = append(meta.Security, &dpb.Coding{
+		System:  &dpb.Uri{Value: ConfidentialitySystem},
+		Code:    &dpb.Code{Value: slp.defaultLabel},
+		Display: &dpb.String{Value: confidentialityDisplays[slp.defaultLabel]},
+	})
+	return slp.Output(ctx, resource)
+}
@@ -0,0 +1,119 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestSecurityLabelProcessor(t *testing.T) {
+	const labelled = `{"resourceType":"Patient","id":"1","meta":{"security":[{"system":"http://terminology.hl7.org/CodeSystem/v3-Confidentiality","code":"R"}]}}`
+	cases := []struct {
+		name   string
+		action processing.SecurityLabelAction
+		json   string
+		// want is the written resource, or empty if the resource should be dead
+		// lettered.
+		want string
+	}{
+		{
+			name:   "AddNoMeta",
+			action: processing.SecurityLabelAdd,
+			json:   `{"resourceType":"Patient","id":"1"}`,
+			want:   `{"resourceType":"Patient","id":"1","meta":{"security":[{"system":"http://terminology.hl7.org/CodeSystem/v3-Confidentiality","code":"N","display":"normal"}]}}`,
+		},
+		{
+			name:   "AddOtherSecurityLabels",
+			action: processing.SecurityLabelAdd,
+			json:   `{"resourceType":"Patient","id":"1","meta":{"versionId":"2","security":[{"system":"http://terminology.hl7.org/CodeSystem/v3-ActReason","code":"HTEST"}]}}`,
+			want:   `{"resourceType":"Patient","id":"1","meta":{"versionId":"2","security":[{"system":"http://terminology.hl7.org/CodeSystem/v3-ActReason","code":"HTEST"},{"system":"http://terminology.hl7.org/CodeSystem/v3-Confidentiality","code":"N","display":"normal"}]}}`,
+		},
+		{
+			name:   "AddAlreadyLabelled",
+			action: processing.SecurityLabelAdd,
+			json:   labelled,
+			want:   labelled,
+		},
+		{
+			name:   "RequireMissing",
+			action: processing.SecurityLabelRequire,
+			json:   `{"resourceType":"Patient","id":"1","meta":{"security":[{"system":"http://terminology.hl7.org/CodeSystem/v3-ActReason","code":"HTEST"}]}}`,
+		},
+		{
+			name:   "RequireLabelled",
+			action: processing.SecurityLabelRequire,
+			json:   labelled,
+			want:   labelled,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := processing.NewSecurityLabelProcessor("N", tc.action)
+			if err != nil {
+				t.Fatalf("NewSecurityLabelProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			var reasons []error
+			pipeline, err := processing.NewPipelineWithOptions([]processing.Processor{p}, []processing.Sink{ts}, &processing.PipelineOptions{
+				DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+					reasons = append(reasons, reason)
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+			}
+			if err := pipeline.Process(context.Background(), cpb.ResourceTypeCode_PATIENT, "", []byte(tc.json)); err != nil {
+				t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+			}
+
+			if tc.want == "" {
+				if len(reasons) != 1 || len(ts.WrittenResources) != 0 {
+					t.Fatalf("unlabelled resource was not dead lettered. got %d reasons and %d written resources", len(reasons), len(ts.WrittenResources))
+				}
+				if !errors.Is(reasons[0], processing.ErrMissingSecurityLabel) {
+					t.Errorf("unexpected dead letter reason. got: %v, want: %v", reasons[0], processing.ErrMissingSecurityLabel)
+				}
+				return
+			}
+			if len(ts.WrittenResources) != 1 {
+				t.Fatalf("unexpected number of written resources. got: %d, want: 1 (dead letter reasons: %v)", len(ts.WrittenResources), reasons)
+			}
+			got, err := ts.WrittenResources[0].JSON()
+			if err != nil {
+				t.Fatalf("JSON() returned unexpected error: %v", err)
+			}
+			if testhelpers.NormalizeJSONString(t, string(got)) != testhelpers.NormalizeJSONString(t, tc.want) {
+				t.Errorf("unexpected resource JSON. got: %s, want: %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNewSecurityLabelProcessor_Invalid(t *testing.T) {
+	if _, err := processing.NewSecurityLabelProcessor("X", processing.SecurityLabelAdd); err == nil {
+		t.Error("NewSecurityLabelProcessor() with an unknown confidentiality code succeeded, want error")
+	}
+	if _, err := processing.NewSecurityLabelProcessor("N", processing.SecurityLabelAction(99)); err == nil {
+		t.Error("NewSecurityLabelProcessor() with an unknown action succeeded, want error")
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	"github.com/google/bulk_fhir_tools/sftp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// sftpClient is the part of sftp.Client used by the SFTP Sink.
+type sftpClient interface {
+	Create(name string) (io.WriteCloser, error)
+	Commit(name string) error
+	Discard(name string) error
+	Close() error
+}
+
+// Assert sftp.Client satisfies the sftpClient interface.
+var _ sftpClient = &sftp.Client{}
+
+type sftpFile struct {
+	f    io.WriteCloser
+	w    *bufio.Writer
+	name string
+}
+
+type sftpSink struct {
+	client          sftpClient
+	writeBufferSize int
+
+	mu    sync.Mutex
+	files map[cpb.ResourceTypeCode_Value]*sftpFile
+}
+
+// Assert sftpSink satisfies the Sink interface.
+var _ Sink = &sftpSink{}
+
+// SFTPSinkOptions contains optional parameters used by
+// NewSFTPSinkWithOptions.
+type SFTPSinkOptions struct {
+	// The size in bytes of the write buffer of each file. Defaults to
+	// DefaultNDJSONWriteBufferSize.
+	WriteBufferSize int
+}
+
+// NewSFTPSink creates a new Sink which writes resources to NDJSON files named
+// {resource type}.ndjson (for example Patient.ndjson) in remoteDir on the SFTP
+// server at addr (host:port). remoteDir, and any missing parents, are created
+// if they do not exist. ctx bounds the time taken to connect to the server.
+//
+// Files are written to temporary names in remoteDir, and only renamed to their
+// final names (replacing any existing files) by Finalize, so that partially
+// written files are never visible under the final names. Finalize closes the
+// files and the connection to the server. As for NewNDJSONSink, lines are
+// separated by \n, and files have no byte order mark.
+//
+// It is threadsafe to call Write on this Sink from multiple goroutines.
+func NewSFTPSink(ctx context.Context, addr string, creds *sftp.Credentials, remoteDir string) (Sink, error) {
+	return NewSFTPSinkWithOptions(ctx, addr, creds, remoteDir, nil)
+}
+
+// NewSFTPSinkWithOptions is like NewSFTPSink, but allows optional parameters
+// to be set.
+func NewSFTPSinkWithOptions(ctx context.Context, addr string, creds *sftp.Credentials, remoteDir string, opts *SFTPSinkOptions) (Sink, error) {
+	if opts == nil {
+		opts = &SFTPSinkOptions{}
+	}
+	client, err := sftp.NewClient(ctx, addr, creds, remoteDir)
+	if err != nil {
+		return nil, err
+	}
+	writeBufferSize := opts.WriteBufferSize
+	if writeBufferSize <= 0 {
+		writeBufferSize = DefaultNDJSONWriteBufferSize
+	}
+	return &sftpSink{
+		client:          client,
+		writeBufferSize: writeBufferSize,
+		files:           map[cpb.ResourceTypeCode_Value]*sftpFile{},
+	}, nil
+}
+
+func (ss *sftpSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	json, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	json, err = normalizeNDJSONLine(json)
+	if err != nil {
+		return err
+	}
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	sf, err := ss.getFile(resource.Type())
+	if err != nil {
+		return err
+	}
+	if _, err := sf.w.Write(json); err != nil {
+		return fmt.Errorf("failed to write to %s: %w", sf.name, err)
+	}
+	if err := sf.w.WriteByte('\n'); err != nil {
+		return fmt.Errorf("failed to write to %s: %w", sf.name, err)
+	}
+	return nil
+}
+
+// getFile returns the file for the resource type, creating it if necessary. It
+// must be called with ss.mu held.
+func (ss *sftpSink) getFile(resourceType cpb.ResourceTypeCode_Value) (*sftpFile, error) {
+	if sf, ok := ss.files[resourceType]; ok {
+		return sf, nil
+	}
+	name, err := bulkfhir.ResourceTypeCodeToName(resourceType)
+	if err != nil {
+		return nil, err
+	}
+	name += ".ndjson"
+	f, err := ss.client.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	sf := &sftpFile{f: f, w: bufio.NewWriterSize(f, ss.writeBufferSize), name: name}
+	ss.files[resourceType] = sf
+	return sf, nil
+}
+
+func (ss *sftpSink) Finalize(ctx context.Context) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var errs []error
+	for _, sf := range ss.files {
+		if err := ss.commit(sf); err != nil {
+			errs = append(errs, err)
+			// Don't leave the partial file behind.
+			ss.client.Discard(sf.name)
+		}
+	}
+	ss.files = map[cpb.ResourceTypeCode_Value]*sftpFile{}
+	if err := ss.client.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// commit flushes and closes the file, then moves it to its final name.
+func (ss *sftpSink) commit(sf *sftpFile) error {
+	if err := sf.w.Flush(); err != nil {
+		sf.f.Close()
+		return fmt.Errorf("failed to write to %s: %w", sf.name, err)
+	}
+	if err := sf.f.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", sf.name, err)
+	}
+	return ss.client.Commit(sf.name)
+}
@@ -0,0 +1,149 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/sftp"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/crypto/ssh"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestSFTPSink(t *testing.T) {
+	ctx := context.Background()
+	server := testhelpers.NewSFTPServer(t)
+	outDir := filepath.Join(server.Dir(), "exports", "today")
+	if err := os.MkdirAll(outDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A file from a previous run should be replaced.
+	if err := os.WriteFile(filepath.Join(outDir, "Patient.ndjson"), []byte("stale\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	creds := &sftp.Credentials{
+		User:            server.User(),
+		Password:        server.Password(),
+		HostKeyCallback: ssh.FixedHostKey(server.HostKey()),
+	}
+	sink, err := processing.NewSFTPSink(ctx, server.Addr(), creds, "exports/today")
+	if err != nil {
+		t.Fatalf("NewSFTPSink() returned unexpected error: %v", err)
+	}
+
+	resources := []*testResourceWrapper{
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte(`{"id":"p1"}`)},
+		{resourceType: cpb.ResourceTypeCode_OBSERVATION, json: []byte(`{"id":"o1"}`)},
+		{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte("{\r\n  \"id\": \"p2\"\r\n}")},
+	}
+	for _, r := range resources {
+		if err := sink.Write(ctx, r); err != nil {
+			t.Fatalf("sink.Write() returned unexpected error: %v", err)
+		}
+	}
+
+	// Nothing should be visible under the final names until Finalize.
+	data, err := os.ReadFile(filepath.Join(outDir, "Patient.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "stale\n" {
+		t.Errorf("Patient.ndjson was modified before Finalize: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(outDir, "Observation.ndjson")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Observation.ndjson exists before Finalize: %v", err)
+	}
+
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("sink.Finalize() returned unexpected error: %v", err)
+	}
+
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gotFiles []string
+	for _, e := range entries {
+		gotFiles = append(gotFiles, e.Name())
+	}
+	sort.Strings(gotFiles)
+	wantFiles := []string{"Observation.ndjson", "Patient.ndjson"}
+	if diff := cmp.Diff(wantFiles, gotFiles); diff != "" {
+		t.Errorf("unexpected files written (-want +got):\n%s", diff)
+	}
+
+	wantContents := map[string]string{
+		"Observation.ndjson": "{\"id\":\"o1\"}\n",
+		"Patient.ndjson":     "{\"id\":\"p1\"}\n{\"id\":\"p2\"}\n",
+	}
+	for name, want := range wantContents {
+		got, err := os.ReadFile(filepath.Join(outDir, name))
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", name, err)
+		}
+		if string(got) != want {
+			t.Errorf("unexpected contents of %s. got: %q, want: %q", name, got, want)
+		}
+	}
+}
+
+func TestSFTPSinkWithOptions_WriteBufferSize(t *testing.T) {
+	ctx := context.Background()
+	server := testhelpers.NewSFTPServer(t)
+	creds := &sftp.Credentials{
+		User:            server.User(),
+		Password:        server.Password(),
+		HostKeyCallback: ssh.FixedHostKey(server.HostKey()),
+	}
+	// A buffer smaller than a line is flushed to the server on every write.
+	sink, err := processing.NewSFTPSinkWithOptions(ctx, server.Addr(), creds, "out", &processing.SFTPSinkOptions{WriteBufferSize: 4})
+	if err != nil {
+		t.Fatalf("NewSFTPSinkWithOptions() returned unexpected error: %v", err)
+	}
+	for _, id := range []string{"p1", "p2"} {
+		if err := sink.Write(ctx, &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte(`{"id":"` + id + `"}`)}); err != nil {
+			t.Fatalf("sink.Write() returned unexpected error: %v", err)
+		}
+	}
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("sink.Finalize() returned unexpected error: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(server.Dir(), "out", "Patient.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "{\"id\":\"p1\"}\n{\"id\":\"p2\"}\n"; string(got) != want {
+		t.Errorf("unexpected contents of Patient.ndjson. got: %q, want: %q", got, want)
+	}
+}
+
+func TestSFTPSink_RequiresHostKeyCallback(t *testing.T) {
+	server := testhelpers.NewSFTPServer(t)
+	creds := &sftp.Credentials{User: server.User(), Password: server.Password()}
+	_, err := processing.NewSFTPSink(context.Background(), server.Addr(), creds, "out")
+	if !errors.Is(err, sftp.ErrNoHostKeyCallback) {
+		t.Errorf("NewSFTPSink() returned unexpected error. got: %v, want: %v", err, sftp.ErrNoHostKeyCallback)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+)
+
+// DefaultSourceURLTagSystem is the system of the meta.tag added by the
+// processor returned by NewSourceURLTagProcessor, if no other system is
+// configured.
+const DefaultSourceURLTagSystem = "https://github.com/google/bulk_fhir_tools/source-url"
+
+// SourceURLTagProcessorOptions contains optional parameters used by
+// NewSourceURLTagProcessorWithOptions.
+type SourceURLTagProcessorOptions struct {
+	// The system of the tag. Defaults to DefaultSourceURLTagSystem.
+	TagSystem string
+}
+
+type sourceURLTagProcessor struct {
+	BaseProcessor
+	system string
+}
+
+// Assert sourceURLTagProcessor satisfies the Processor interface.
+var _ Processor = &sourceURLTagProcessor{}
+
+// NewSourceURLTagProcessor creates a Processor which adds a meta.tag with the
+// resource's SourceURL (the NDJSON file it was read from, without any query
+// string, which may hold credentials) as the code, so that stored resources
+// can be traced back to the exact file the server produced. Any existing tag
+// with the same system is replaced, and resources without a SourceURL are
+// left unchanged.
+//
+// Unlike NewMetaSourceProcessor, this does not overwrite meta.source, which
+// the server may have set to something meaningful.
+func NewSourceURLTagProcessor() Processor {
+	return NewSourceURLTagProcessorWithOptions(nil)
+}
+
+// NewSourceURLTagProcessorWithOptions is like NewSourceURLTagProcessor, but
+// with the given options. opts may be nil.
+func NewSourceURLTagProcessorWithOptions(opts *SourceURLTagProcessorOptions) Processor {
+	if opts == nil {
+		opts = &SourceURLTagProcessorOptions{}
+	}
+	system := opts.TagSystem
+	if system == "" {
+		system = DefaultSourceURLTagSystem
+	}
+	return &sourceURLTagProcessor{system: system}
+}
+
+func (stp *sourceURLTagProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	source, err := redactedSourceURL(resource)
+	if err != nil {
+		return err
+	}
+	if source == "" {
+		return stp.Output(ctx, resource)
+	}
+	meta, err := mutableMeta(resource)
+	if err != nil {
+		return err
+	}
+	setTag(meta, stp.system, source)
+	return stp.Output(ctx, resource)
+}
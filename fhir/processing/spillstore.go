@@ -0,0 +1,128 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// patientSpillStore holds lines of data by patient id in temporary files, for
+// processors which buffer resources per patient until Finalize and may need to
+// spill them to disk to limit memory use.
+type patientSpillStore struct {
+	parent  string
+	pattern string
+	// dir is created when lines are first appended. spilled holds the patient
+	// ids with lines in dir.
+	dir     string
+	spilled map[string]bool
+}
+
+// newPatientSpillStore creates a patientSpillStore which creates its temporary
+// directory within parent (or the default temporary directory if parent is
+// empty), with a name starting with pattern as for os.MkdirTemp.
+func newPatientSpillStore(parent, pattern string) *patientSpillStore {
+	return &patientSpillStore{parent: parent, pattern: pattern, spilled: map[string]bool{}}
+}
+
+// file returns the temporary file holding lines for a patient. The id is hex
+// encoded to avoid any issues with special characters in file names.
+func (s *patientSpillStore) file(patientID string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(patientID))+".ndjson")
+}
+
+// has returns whether any lines have been appended for a patient.
+func (s *patientSpillStore) has(patientID string) bool {
+	return s.spilled[patientID]
+}
+
+// patientIDs returns the ids of the patients with lines in the store, in no
+// particular order.
+func (s *patientSpillStore) patientIDs() []string {
+	var ids []string
+	for id := range s.spilled {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// append appends lines to the temporary file for a patient. The lines must not
+// contain newlines.
+func (s *patientSpillStore) append(patientID string, lines [][]byte) error {
+	if s.dir == "" {
+		dir, err := os.MkdirTemp(s.parent, s.pattern)
+		if err != nil {
+			return err
+		}
+		s.dir = dir
+	}
+	f, err := os.OpenFile(s.file(patientID), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, l := range lines {
+		w.Write(l)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to spill resources: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to spill resources: %w", err)
+	}
+	s.spilled[patientID] = true
+	return nil
+}
+
+// read returns the lines appended for a patient, in the order they were
+// appended.
+func (s *patientSpillStore) read(patientID string) ([][]byte, error) {
+	if !s.spilled[patientID] {
+		return nil, nil
+	}
+	f, err := os.Open(s.file(patientID))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines [][]byte
+	sc := bufio.NewScanner(f)
+	// Lines hold a whole resource, so need the same buffer as NDJSON files.
+	sc.Buffer(make([]byte, initialNDJSONBufferSize), maxNDJSONLineSize)
+	for sc.Scan() {
+		lines = append(lines, append([]byte(nil), sc.Bytes()...))
+	}
+	return lines, sc.Err()
+}
+
+// cleanup removes the temporary directory, if one was created, and empties the
+// store so that it can be reused.
+func (s *patientSpillStore) cleanup() {
+	if s.dir != "" {
+		if err := os.RemoveAll(s.dir); err != nil {
+			log.Warningf("Failed to remove temporary directory %s: %v", s.dir, err)
+		}
+	}
+	s.dir = ""
+	s.spilled = map[string]bool{}
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+)
+
+// ErrTestData is passed (wrapped) as the dead letter reason for resources
+// dropped by the processor returned by NewTestDataFilterProcessor.
+var ErrTestData = errors.New("resource is test data")
+
+var testDataFilterCounter *metrics.Counter = metrics.NewCounter("test-data-filter-counter", "Count of FHIR Resources dropped because they were identified as test data. The counter is tagged by the FHIR Resource type ex) OBSERVATION.", "1", aggregation.Count, "FHIRResourceType")
+
+// TestDataCoding is a meta tag or security label which marks a resource as
+// test data. An empty System matches any system.
+type TestDataCoding struct {
+	System string `json:"system"`
+	Code   string `json:"code"`
+}
+
+// HL7TestDataCoding is the HL7 "test health data" code, which marks resources
+// as test data when used as a security label (and, by some servers, as a tag).
+var HL7TestDataCoding = TestDataCoding{System: "http://terminology.hl7.org/CodeSystem/v3-ActReason", Code: "HTEST"}
+
+// TestDataRules configures which resources NewTestDataFilterProcessor
+// identifies as test data. A resource matching any of the rules is dropped.
+type TestDataRules struct {
+	// Codings which mark a resource as test data when present in meta.tag.
+	Tags []TestDataCoding
+	// Codings which mark a resource as test data when present in meta.security.
+	SecurityLabels []TestDataCoding
+	// Regular expressions which mark a resource as test data when they match its
+	// whole id, for example "example(-.*)?".
+	IDPatterns []string
+}
+
+type testDataFilterProcessor struct {
+	BaseProcessor
+	rules      TestDataRules
+	idPatterns []*regexp.Regexp
+}
+
+// Assert testDataFilterProcessor satisfies the Processor interface.
+var _ Processor = &testDataFilterProcessor{}
+
+// NewTestDataFilterProcessor creates a Processor which drops resources
+// identified as test data by rules, passing them to the pipeline's dead letter
+// function (with a reason wrapping ErrTestData), so that synthetic records
+// which leak into an export never reach production storage. If rules is nil,
+// resources with HL7TestDataCoding in meta.tag or meta.security are dropped.
+func NewTestDataFilterProcessor(rules *TestDataRules) (Processor, error) {
+	if rules == nil {
+		rules = &TestDataRules{
+			Tags:           []TestDataCoding{HL7TestDataCoding},
+			SecurityLabels: []TestDataCoding{HL7TestDataCoding},
+		}
+	}
+	tdfp := &testDataFilterProcessor{rules: *rules}
+	for _, p := range rules.IDPatterns {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid id pattern %q: %w", p, err)
+		}
+		tdfp.idPatterns = append(tdfp.idPatterns, re)
+	}
+	return tdfp, nil
+}
+
+// testDataJSON holds the elements of a resource checked for test data.
+type testDataJSON struct {
+	ID   string `json:"id"`
+	Meta struct {
+		Tag      []TestDataCoding `json:"tag"`
+		Security []TestDataCoding `json:"security"`
+	} `json:"meta"`
+}
+
+func (tdfp *testDataFilterProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var res testDataJSON
+	if err := json.Unmarshal(rawJSON, &res); err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+	reason := tdfp.match(res)
+	if reason == "" {
+		return tdfp.Output(ctx, resource)
+	}
+	if err := testDataFilterCounter.Record(ctx, 1, resource.Type().String()); err != nil {
+		return err
+	}
+	return tdfp.DeadLetterResource(ctx, resource, fmt.Errorf("%w: %s resource %q %s", ErrTestData, resource.Type(), res.ID, reason))
+}
+
+// match returns a description of the first rule which res matches, or an empty
+// string if it matches none.
+func (tdfp *testDataFilterProcessor) match(res testDataJSON) string {
+	if c, ok := matchCoding(res.Meta.Tag, tdfp.rules.Tags); ok {
+		return fmt.Sprintf("has meta.tag %s|%s", c.System, c.Code)
+	}
+	if c, ok := matchCoding(res.Meta.Security, tdfp.rules.SecurityLabels); ok {
+		return fmt.Sprintf("has meta.security %s|%s", c.System, c.Code)
+	}
+	for _, re := range tdfp.idPatterns {
+		if re.MatchString(res.ID) {
+			return fmt.Sprintf("has an id matching %s", re)
+		}
+	}
+	return ""
+}
+
+// matchCoding returns the first of codings which matches one of rules.
+func matchCoding(codings, rules []TestDataCoding) (TestDataCoding, bool) {
+	for _, c := range codings {
+		for _, r := range rules {
+			if c.Code == r.Code && (r.System == "" || c.System == r.System) {
+				return c, true
+			}
+		}
+	}
+	return TestDataCoding{}, false
+}
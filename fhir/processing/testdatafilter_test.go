@@ -0,0 +1,122 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestTestDataFilterProcessor(t *testing.T) {
+	customRules := &processing.TestDataRules{
+		Tags:       []processing.TestDataCoding{{Code: "synthetic"}},
+		IDPatterns: []string{"example(-.*)?"},
+	}
+	cases := []struct {
+		name  string
+		rules *processing.TestDataRules
+		json  string
+		// wantReason is a substring of the dead letter reason, or empty if the
+		// resource should be kept.
+		wantReason string
+	}{
+		{
+			name:       "DefaultTag",
+			json:       `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"http://terminology.hl7.org/CodeSystem/v3-ActReason","code":"HTEST"}]}}`,
+			wantReason: `PATIENT resource "1" has meta.tag http://terminology.hl7.org/CodeSystem/v3-ActReason|HTEST`,
+		},
+		{
+			name:       "DefaultSecurityLabel",
+			json:       `{"resourceType":"Patient","id":"1","meta":{"security":[{"system":"http://terminology.hl7.org/CodeSystem/v3-Confidentiality","code":"N"},{"system":"http://terminology.hl7.org/CodeSystem/v3-ActReason","code":"HTEST"}]}}`,
+			wantReason: "has meta.security http://terminology.hl7.org/CodeSystem/v3-ActReason|HTEST",
+		},
+		{
+			name: "DefaultOtherSystem",
+			json: `{"resourceType":"Patient","id":"example","meta":{"tag":[{"system":"https://example.com/tags","code":"HTEST"}]}}`,
+		},
+		{
+			name:       "CustomTagAnySystem",
+			rules:      customRules,
+			json:       `{"resourceType":"Patient","id":"1","meta":{"tag":[{"system":"https://example.com/tags","code":"synthetic"}]}}`,
+			wantReason: "has meta.tag https://example.com/tags|synthetic",
+		},
+		{
+			name:       "CustomIDPattern",
+			rules:      customRules,
+			json:       `{"resourceType":"Patient","id":"example-2"}`,
+			wantReason: "has an id matching ^(?:example(-.*)?)$",
+		},
+		{
+			name:  "CustomIDPatternMatchesWholeID",
+			rules: customRules,
+			json:  `{"resourceType":"Patient","id":"counterexample"}`,
+		},
+		{
+			name:  "CustomRulesIgnoreDefault",
+			rules: customRules,
+			json:  `{"resourceType":"Patient","id":"1","meta":{"security":[{"system":"http://terminology.hl7.org/CodeSystem/v3-ActReason","code":"HTEST"}]}}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := processing.NewTestDataFilterProcessor(tc.rules)
+			if err != nil {
+				t.Fatalf("NewTestDataFilterProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			var reasons []error
+			pipeline, err := processing.NewPipelineWithOptions([]processing.Processor{p}, []processing.Sink{ts}, &processing.PipelineOptions{
+				DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+					reasons = append(reasons, reason)
+					return nil
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+			}
+			if err := pipeline.Process(context.Background(), cpb.ResourceTypeCode_PATIENT, "", []byte(tc.json)); err != nil {
+				t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+			}
+
+			if tc.wantReason == "" {
+				if len(reasons) != 0 || len(ts.WrittenResources) != 1 {
+					t.Errorf("resource was not kept. dead letter reasons: %v", reasons)
+				}
+				return
+			}
+			if len(reasons) != 1 || len(ts.WrittenResources) != 0 {
+				t.Fatalf("test resource was not dropped. got %d reasons and %d written resources", len(reasons), len(ts.WrittenResources))
+			}
+			if !errors.Is(reasons[0], processing.ErrTestData) {
+				t.Errorf("unexpected dead letter reason. got: %v, want: %v", reasons[0], processing.ErrTestData)
+			}
+			if !strings.Contains(reasons[0].Error(), tc.wantReason) {
+				t.Errorf("dead letter reason %q does not contain %q", reasons[0], tc.wantReason)
+			}
+		})
+	}
+}
+
+func TestNewTestDataFilterProcessor_InvalidPattern(t *testing.T) {
+	if _, err := processing.NewTestDataFilterProcessor(&processing.TestDataRules{IDPatterns: []string{"example("}}); err == nil {
+		t.Error("NewTestDataFilterProcessor() with an invalid id pattern succeeded, want error")
+	}
+}
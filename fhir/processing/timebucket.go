@@ -0,0 +1,104 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/bulk_fhir_tools/fhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// TimeBucketAttribute is the ResourceWrapper attribute which the processor
+// returned by NewTimeBucketProcessor sets to the resource's time bucket key.
+const TimeBucketAttribute = "time_bucket"
+
+// TimeBucketGranularity is the size of the time windows used by
+// NewTimeBucketProcessor.
+type TimeBucketGranularity int
+
+const (
+	// DailyTimeBuckets produces bucket keys of the form 2006-01-02.
+	DailyTimeBuckets TimeBucketGranularity = iota
+	// MonthlyTimeBuckets produces bucket keys of the form 2006-01.
+	MonthlyTimeBuckets
+)
+
+func (g TimeBucketGranularity) layout() (string, error) {
+	switch g {
+	case DailyTimeBuckets:
+		return "2006-01-02", nil
+	case MonthlyTimeBuckets:
+		return "2006-01", nil
+	default:
+		return "", fmt.Errorf("unknown TimeBucketGranularity %d", g)
+	}
+}
+
+type timeBucketProcessor struct {
+	BaseProcessor
+	layout        string
+	defaultBucket string
+}
+
+// Assert timeBucketProcessor satisfies the Processor interface.
+var _ Processor = &timeBucketProcessor{}
+
+// NewTimeBucketProcessor creates a Processor which sets the TimeBucketAttribute
+// of each resource to a key identifying the day or month (in UTC) of the
+// resource's meta.lastUpdated timestamp. Resources without a valid
+// meta.lastUpdated are assigned defaultBucket. Resources are not modified, so
+// this may be used to route resources to time-partitioned destinations.
+func NewTimeBucketProcessor(granularity TimeBucketGranularity, defaultBucket string) (Processor, error) {
+	layout, err := granularity.layout()
+	if err != nil {
+		return nil, err
+	}
+	return &timeBucketProcessor{layout: layout, defaultBucket: defaultBucket}, nil
+}
+
+// lastUpdatedJSON holds the subset of a resource needed to read
+// meta.lastUpdated.
+type lastUpdatedJSON struct {
+	Meta struct {
+		LastUpdated string `json:"lastUpdated"`
+	} `json:"meta"`
+}
+
+func (tbp *timeBucketProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	// The JSON is read rather than the proto, as calling Proto() would cause the
+	// JSON to be regenerated for sinks.
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	var res lastUpdatedJSON
+	if err := json.Unmarshal(rawJSON, &res); err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+
+	bucket := tbp.defaultBucket
+	if res.Meta.LastUpdated != "" {
+		if t, err := fhir.ParseFHIRInstant(res.Meta.LastUpdated); err != nil {
+			log.Warningf("Invalid meta.lastUpdated %q in %s resource, using the default time bucket: %v", res.Meta.LastUpdated, resource.Type(), err)
+		} else {
+			bucket = t.UTC().Format(tbp.layout)
+		}
+	}
+	SetResourceAttribute(resource, TimeBucketAttribute, bucket)
+	return tbp.Output(ctx, resource)
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestTimeBucketProcessor(t *testing.T) {
+	cases := []struct {
+		name        string
+		granularity processing.TimeBucketGranularity
+		json        string
+		wantBucket  string
+	}{
+		{
+			name:        "Daily",
+			granularity: processing.DailyTimeBuckets,
+			json:        `{"resourceType":"Patient","id":"1","meta":{"lastUpdated":"2023-04-05T10:11:12.345Z"}}`,
+			wantBucket:  "2023-04-05",
+		},
+		{
+			name:        "Monthly",
+			granularity: processing.MonthlyTimeBuckets,
+			json:        `{"resourceType":"Patient","id":"1","meta":{"lastUpdated":"2023-04-05T10:11:12Z"}}`,
+			wantBucket:  "2023-04",
+		},
+		{
+			name:        "ConvertedToUTC",
+			granularity: processing.DailyTimeBuckets,
+			json:        `{"resourceType":"Patient","id":"1","meta":{"lastUpdated":"2023-04-05T23:30:00-05:00"}}`,
+			wantBucket:  "2023-04-06",
+		},
+		{
+			name:        "MissingLastUpdated",
+			granularity: processing.DailyTimeBuckets,
+			json:        `{"resourceType":"Patient","id":"1"}`,
+			wantBucket:  "unknown",
+		},
+		{
+			name:        "InvalidLastUpdated",
+			granularity: processing.DailyTimeBuckets,
+			json:        `{"resourceType":"Patient","id":"1","meta":{"lastUpdated":"yesterday"}}`,
+			wantBucket:  "unknown",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tbp, err := processing.NewTimeBucketProcessor(tc.granularity, "unknown")
+			if err != nil {
+				t.Fatalf("NewTimeBucketProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{tbp}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			if err := p.Process(context.Background(), cpb.ResourceTypeCode_PATIENT, "", []byte(tc.json)); err != nil {
+				t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", tc.json, err)
+			}
+			got, ok := processing.ResourceAttribute(ts.WrittenResources[0], processing.TimeBucketAttribute)
+			if !ok || got != tc.wantBucket {
+				t.Errorf("unexpected time bucket attribute. got: %q (set: %t), want: %q", got, ok, tc.wantBucket)
+			}
+			gotJSON, err := ts.WrittenResources[0].JSON()
+			if err != nil {
+				t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+			}
+			if string(gotJSON) != tc.json {
+				t.Errorf("resource JSON was modified. got: %s, want: %s", gotJSON, tc.json)
+			}
+		})
+	}
+}
+
+func TestNewTimeBucketProcessor_InvalidGranularity(t *testing.T) {
+	if _, err := processing.NewTimeBucketProcessor(processing.TimeBucketGranularity(42), ""); err == nil {
+		t.Errorf("NewTimeBucketProcessor() with invalid granularity returned nil error")
+	}
+}
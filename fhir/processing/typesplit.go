@@ -0,0 +1,93 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+
+	"github.com/google/bulk_fhir_tools/bulkfhir"
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+var typeSplitCounter *metrics.Counter = metrics.NewCounter("type-split-counter", "Count of FHIR Resources whose resourceType did not match the type of the file they were read from. The counter is tagged by the type of the file and the resourceType of the resource.", "1", aggregation.Count, "DeclaredResourceType", "FHIRResourceType")
+
+type typeSplitProcessor struct {
+	BaseProcessor
+	// warnedURLs holds the source URLs for which a mismatched type has been
+	// logged, so that it is only logged once per file.
+	warnedURLs map[string]bool
+}
+
+// Assert typeSplitProcessor satisfies the Processor interface.
+var _ Processor = &typeSplitProcessor{}
+
+// NewTypeSplitProcessor creates a Processor which sets the type of each
+// resource from its resourceType field, overriding the type it was passed to
+// the pipeline with (which is usually the type the server listed for the
+// result file it was read from). This is the canonical way to ensure that
+// resources are grouped by their actual type in per-type sinks (such as an
+// NDJSON sink whose filename template contains FilenameResourceType, or the
+// BigQuery sink) when a server returns files containing a mix of resource
+// types.
+//
+// Resources whose JSON has no recognised resourceType are passed through
+// unchanged. The processor should come first in the pipeline, as it reads
+// each resource's JSON, which is cheapest before any processor has accessed
+// the proto.
+func NewTypeSplitProcessor() Processor {
+	return &typeSplitProcessor{warnedURLs: map[string]bool{}}
+}
+
+func (tsp *typeSplitProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	resourceType, err := bulkfhir.ResourceTypeCodeFromJSON(rawJSON)
+	if err != nil || resourceType == resource.Type() {
+		return tsp.Output(ctx, resource)
+	}
+	if err := typeSplitCounter.Record(ctx, 1, resource.Type().String(), resourceType.String()); err != nil {
+		return err
+	}
+	if !tsp.warnedURLs[resource.SourceURL()] {
+		tsp.warnedURLs[resource.SourceURL()] = true
+		log.Warningf("%s file %s contains resources of other types (such as %s); using the type of each resource", resource.Type(), resource.SourceURL(), resourceType)
+	}
+	return tsp.Output(ctx, withResourceType(resource, resourceType))
+}
+
+// withResourceType returns resource with its type replaced by resourceType.
+func withResourceType(resource ResourceWrapper, resourceType cpb.ResourceTypeCode_Value) ResourceWrapper {
+	if rw, ok := resource.(*resourceWrapper); ok {
+		rw.resourceType = resourceType
+		return rw
+	}
+	return &retypedResource{ResourceWrapper: resource, resourceType: resourceType}
+}
+
+// retypedResource overrides the type of a ResourceWrapper.
+type retypedResource struct {
+	ResourceWrapper
+	resourceType cpb.ResourceTypeCode_Value
+}
+
+func (rr *retypedResource) Type() cpb.ResourceTypeCode_Value {
+	return rr.resourceType
+}
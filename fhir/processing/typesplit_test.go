@@ -0,0 +1,136 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// mixedPatientFile holds the lines of a result file listed by the server as
+// Patient data, which also contains other resource types.
+var mixedPatientFile = []string{
+	`{"resourceType":"Patient","id":"p1"}`,
+	`{"resourceType":"Observation","id":"o1","status":"final","code":{"text":"c"}}`,
+	`{"resourceType":"Patient","id":"p2"}`,
+	`{"resourceType":"Encounter","id":"e1","status":"finished","class":{"code":"AMB"}}`,
+}
+
+func TestTypeSplitProcessor(t *testing.T) {
+	ts := &processing.TestSink{}
+	pipeline, err := processing.NewPipeline([]processing.Processor{processing.NewTypeSplitProcessor()}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	ctx := context.Background()
+	for _, line := range mixedPatientFile {
+		if err := pipeline.Process(ctx, cpb.ResourceTypeCode_PATIENT, "https://example.com/Patient.ndjson", []byte(line)); err != nil {
+			t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+		}
+	}
+	if err := pipeline.Finalize(ctx); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+
+	var got []cpb.ResourceTypeCode_Value
+	for _, r := range ts.WrittenResources {
+		got = append(got, r.Type())
+		if r.SourceURL() != "https://example.com/Patient.ndjson" {
+			t.Errorf("unexpected source URL %q", r.SourceURL())
+		}
+	}
+	want := []cpb.ResourceTypeCode_Value{cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_OBSERVATION, cpb.ResourceTypeCode_PATIENT, cpb.ResourceTypeCode_ENCOUNTER}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected resource types (-want +got):\n%s", diff)
+	}
+}
+
+func TestTypeSplitProcessor_NDJSONSink(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	sink, err := processing.NewNDJSONSinkWithOptions(ctx, dir, &processing.NDJSONSinkOptions{FilenameTemplate: "{resource_type}_{index}.ndjson"})
+	if err != nil {
+		t.Fatalf("NewNDJSONSinkWithOptions() returned unexpected error: %v", err)
+	}
+	pipeline, err := processing.NewPipeline([]processing.Processor{processing.NewTypeSplitProcessor()}, []processing.Sink{sink})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	for _, line := range mixedPatientFile {
+		if err := pipeline.Process(ctx, cpb.ResourceTypeCode_PATIENT, "https://example.com/Patient.ndjson", []byte(line)); err != nil {
+			t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+		}
+	}
+	if err := pipeline.Finalize(ctx); err != nil {
+		t.Fatalf("pipeline.Finalize() returned unexpected error: %v", err)
+	}
+
+	// Every file should only hold resources of the type it is named for.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir() returned unexpected error: %v", err)
+	}
+	var gotTypes []string
+	for _, e := range entries {
+		fileType, _, _ := strings.Cut(e.Name(), "_")
+		gotTypes = append(gotTypes, fileType)
+		f, err := os.Open(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", e.Name(), err)
+		}
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			if !strings.Contains(s.Text(), `"resourceType":"`+fileType+`"`) {
+				t.Errorf("%s contains a resource of another type: %s", e.Name(), s.Text())
+			}
+		}
+		f.Close()
+	}
+	sort.Strings(gotTypes)
+	if diff := cmp.Diff([]string{"Encounter", "Observation", "Patient"}, gotTypes); diff != "" {
+		t.Errorf("unexpected files written (-want +got):\n%s", diff)
+	}
+}
+
+func TestTypeSplitProcessor_NoResourceType(t *testing.T) {
+	ts := &processing.TestSink{}
+	pipeline, err := processing.NewPipeline([]processing.Processor{processing.NewTypeSplitProcessor()}, []processing.Sink{ts})
+	if err != nil {
+		t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+	}
+	for _, line := range []string{`{"id":"1"}`, `{"resourceType":"NotAResource","id":"1"}`} {
+		if err := pipeline.Process(context.Background(), cpb.ResourceTypeCode_PATIENT, "", []byte(line)); err != nil {
+			t.Fatalf("pipeline.Process() returned unexpected error: %v", err)
+		}
+	}
+	for _, r := range ts.WrittenResources {
+		if r.Type() != cpb.ResourceTypeCode_PATIENT {
+			t.Errorf("resource with no recognised resourceType has type %v, want %v", r.Type(), cpb.ResourceTypeCode_PATIENT)
+		}
+	}
+	if len(ts.WrittenResources) != 2 {
+		t.Errorf("%d resources were written, want 2", len(ts.WrittenResources))
+	}
+}
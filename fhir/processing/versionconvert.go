@@ -0,0 +1,230 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/bulk_fhir_tools/internal/metrics"
+	"github.com/google/bulk_fhir_tools/internal/metrics/aggregation"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// ErrUnsupportedConversion is passed (wrapped) as the dead letter reason for
+// resources which the version conversion processor cannot convert.
+var ErrUnsupportedConversion = errors.New("resource cannot be converted between FHIR versions")
+
+var versionConvertCounter *metrics.Counter = metrics.NewCounter("version-convert-counter", "Count of FHIR Resources passed through the FHIR version conversion processor. The counter is tagged by the FHIR Resource type ex) OBSERVATION and result ex) CONVERTED.", "1", aggregation.Count, "FHIRResourceType", "Result")
+
+// resourceConverter converts a single resource (as generic JSON) in place. It
+// returns an error wrapping ErrUnsupportedConversion if the resource cannot be
+// converted.
+type resourceConverter func(res map[string]any) error
+
+type versionConvertProcessor struct {
+	BaseProcessor
+	converters map[cpb.ResourceTypeCode_Value]resourceConverter
+}
+
+// Assert versionConvertProcessor satisfies the Processor interface.
+var _ Processor = &versionConvertProcessor{}
+
+// NewVersionConvertProcessor creates a Processor which converts resources from
+// one FHIR version to another. This is a best-effort conversion, which
+// currently only supports converting STU3 Patient, Observation and Coverage
+// resources to R4:
+//
+//   - Patient.animal is moved to the standard patient-animal extension.
+//   - Observation.context is moved to Observation.encounter,
+//     Observation.comment to Observation.note, and Observation.related entries
+//     of type has-member and derived-from to Observation.hasMember and
+//     Observation.derivedFrom.
+//   - Coverage.grouping is converted to Coverage.class entries. Coverage.sequence
+//     has no R4 equivalent, and is dropped.
+//
+// Resources of other types, and resources using STU3 features with no R4
+// equivalent (Observation values of type Attachment, Observation.context
+// referencing an EpisodeOfCare, or other types of Observation.related), are
+// dead lettered.
+//
+// The pipeline parses resources as R4, so this processor operates on the
+// resource JSON, and must come before any other processors in the pipeline.
+func NewVersionConvertProcessor(from, to fhirversion.Version) (Processor, error) {
+	if from != fhirversion.STU3 || to != fhirversion.R4 {
+		return nil, fmt.Errorf("conversion from FHIR %s to %s is not supported", from, to)
+	}
+	return &versionConvertProcessor{
+		converters: map[cpb.ResourceTypeCode_Value]resourceConverter{
+			cpb.ResourceTypeCode_PATIENT:     stu3ToR4Patient,
+			cpb.ResourceTypeCode_OBSERVATION: stu3ToR4Observation,
+			cpb.ResourceTypeCode_COVERAGE:    stu3ToR4Coverage,
+		},
+	}, nil
+}
+
+func (vcp *versionConvertProcessor) Process(ctx context.Context, resource ResourceWrapper) error {
+	convert, ok := vcp.converters[resource.Type()]
+	if !ok {
+		return vcp.deadLetter(ctx, resource, fmt.Errorf("%w: unsupported resource type %s", ErrUnsupportedConversion, resource.Type()))
+	}
+
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	res, err := decodeResourceJSON(rawJSON)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s resource JSON: %w", resource.Type(), err)
+	}
+
+	if err := convert(res); err != nil {
+		if errors.Is(err, ErrUnsupportedConversion) {
+			return vcp.deadLetter(ctx, resource, err)
+		}
+		return err
+	}
+
+	if err := setResourceJSON(resource, res); err != nil {
+		return err
+	}
+	if err := versionConvertCounter.Record(ctx, 1, resource.Type().String(), "CONVERTED"); err != nil {
+		return err
+	}
+	return vcp.Output(ctx, resource)
+}
+
+func (vcp *versionConvertProcessor) deadLetter(ctx context.Context, resource ResourceWrapper, reason error) error {
+	if err := versionConvertCounter.Record(ctx, 1, resource.Type().String(), "DEAD_LETTERED"); err != nil {
+		return err
+	}
+	return vcp.DeadLetterResource(ctx, resource, reason)
+}
+
+const patientAnimalExtensionURL = "http://hl7.org/fhir/StructureDefinition/patient-animal"
+
+func stu3ToR4Patient(res map[string]any) error {
+	animal, ok := res["animal"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	delete(res, "animal")
+	var subExtensions []any
+	for _, field := range []string{"species", "breed", "genderStatus"} {
+		if v, ok := animal[field]; ok {
+			subExtensions = append(subExtensions, map[string]any{"url": field, "valueCodeableConcept": v})
+		}
+	}
+	extensions, _ := res["extension"].([]any)
+	res["extension"] = append(extensions, map[string]any{
+		"url":       patientAnimalExtensionURL,
+		"extension": subExtensions,
+	})
+	return nil
+}
+
+func stu3ToR4Observation(res map[string]any) error {
+	if _, ok := res["valueAttachment"]; ok {
+		return fmt.Errorf("%w: Observation.valueAttachment has no R4 equivalent", ErrUnsupportedConversion)
+	}
+	components, _ := res["component"].([]any)
+	for _, c := range components {
+		if cm, ok := c.(map[string]any); ok {
+			if _, ok := cm["valueAttachment"]; ok {
+				return fmt.Errorf("%w: Observation.component.valueAttachment has no R4 equivalent", ErrUnsupportedConversion)
+			}
+		}
+	}
+
+	if obsContext, ok := res["context"].(map[string]any); ok {
+		if ref, _ := obsContext["reference"].(string); strings.HasPrefix(ref, "EpisodeOfCare/") {
+			return fmt.Errorf("%w: Observation.context references an EpisodeOfCare", ErrUnsupportedConversion)
+		}
+		delete(res, "context")
+		res["encounter"] = obsContext
+	}
+
+	if comment, ok := res["comment"].(string); ok {
+		delete(res, "comment")
+		notes, _ := res["note"].([]any)
+		res["note"] = append(notes, map[string]any{"text": comment})
+	}
+
+	if related, ok := res["related"].([]any); ok {
+		delete(res, "related")
+		for _, r := range related {
+			rm, _ := r.(map[string]any)
+			var field string
+			switch rm["type"] {
+			case "has-member":
+				field = "hasMember"
+			case "derived-from":
+				field = "derivedFrom"
+			default:
+				return fmt.Errorf("%w: Observation.related of type %v has no R4 equivalent", ErrUnsupportedConversion, rm["type"])
+			}
+			targets, _ := res[field].([]any)
+			res[field] = append(targets, rm["target"])
+		}
+	}
+	return nil
+}
+
+const coverageClassSystem = "http://terminology.hl7.org/CodeSystem/coverage-class"
+
+// coverageGroupingFields lists the STU3 Coverage.grouping value and display
+// fields, along with the R4 coverage-class code they map to.
+var coverageGroupingFields = []struct{ value, display, code string }{
+	{"group", "groupDisplay", "group"},
+	{"subGroup", "subGroupDisplay", "subgroup"},
+	{"plan", "planDisplay", "plan"},
+	{"subPlan", "subPlanDisplay", "subplan"},
+	{"class", "classDisplay", "class"},
+	{"subClass", "subClassDisplay", "subclass"},
+}
+
+func stu3ToR4Coverage(res map[string]any) error {
+	delete(res, "sequence")
+	grouping, ok := res["grouping"].(map[string]any)
+	if !ok {
+		return nil
+	}
+	delete(res, "grouping")
+	classes, _ := res["class"].([]any)
+	for _, f := range coverageGroupingFields {
+		value, ok := grouping[f.value]
+		if !ok {
+			continue
+		}
+		class := map[string]any{
+			"type": map[string]any{
+				"coding": []any{map[string]any{"system": coverageClassSystem, "code": f.code}},
+			},
+			"value": value,
+		}
+		if display, ok := grouping[f.display]; ok {
+			class["name"] = display
+		}
+		classes = append(classes, class)
+	}
+	if len(classes) > 0 {
+		res["class"] = classes
+	}
+	return nil
+}
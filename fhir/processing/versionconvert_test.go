@@ -0,0 +1,164 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/google/fhir/go/fhirversion"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+func TestVersionConvertProcessor(t *testing.T) {
+	cases := []struct {
+		name         string
+		resourceType cpb.ResourceTypeCode_Value
+		jsonIn       string
+		wantJSON     string
+	}{
+		{
+			name:         "PatientUnchanged",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			jsonIn:       `{"resourceType":"Patient","id":"1","gender":"female","birthDate":"1970-01-01"}`,
+			wantJSON:     `{"resourceType":"Patient","id":"1","gender":"female","birthDate":"1970-01-01"}`,
+		},
+		{
+			name:         "PatientAnimal",
+			resourceType: cpb.ResourceTypeCode_PATIENT,
+			jsonIn:       `{"resourceType":"Patient","id":"1","animal":{"species":{"text":"dog"},"breed":{"text":"corgi"}}}`,
+			wantJSON: `{"resourceType":"Patient","id":"1","extension":[{"url":"http://hl7.org/fhir/StructureDefinition/patient-animal","extension":[` +
+				`{"url":"species","valueCodeableConcept":{"text":"dog"}},{"url":"breed","valueCodeableConcept":{"text":"corgi"}}]}]}`,
+		},
+		{
+			name:         "Observation",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			jsonIn: `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"panel"},"context":{"reference":"Encounter/2"},"comment":"a comment",` +
+				`"valueQuantity":{"value":1.50},"related":[{"type":"has-member","target":{"reference":"Observation/3"}},{"type":"derived-from","target":{"reference":"Observation/4"}}]}`,
+			wantJSON: `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"panel"},"encounter":{"reference":"Encounter/2"},"note":[{"text":"a comment"}],` +
+				`"valueQuantity":{"value":1.50},"hasMember":[{"reference":"Observation/3"}],"derivedFrom":[{"reference":"Observation/4"}]}`,
+		},
+		{
+			name:         "Coverage",
+			resourceType: cpb.ResourceTypeCode_COVERAGE,
+			jsonIn: `{"resourceType":"Coverage","id":"1","status":"active","beneficiary":{"reference":"Patient/1"},"payor":[{"reference":"Organization/1"}],"sequence":"1",` +
+				`"grouping":{"group":"G1","groupDisplay":"Group One","plan":"P1"}}`,
+			wantJSON: `{"resourceType":"Coverage","id":"1","status":"active","beneficiary":{"reference":"Patient/1"},"payor":[{"reference":"Organization/1"}],"class":[` +
+				`{"type":{"coding":[{"system":"http://terminology.hl7.org/CodeSystem/coverage-class","code":"group"}]},"value":"G1","name":"Group One"},` +
+				`{"type":{"coding":[{"system":"http://terminology.hl7.org/CodeSystem/coverage-class","code":"plan"}]},"value":"P1"}]}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			vcp, err := processing.NewVersionConvertProcessor(fhirversion.STU3, fhirversion.R4)
+			if err != nil {
+				t.Fatalf("NewVersionConvertProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			p, err := processing.NewPipeline([]processing.Processor{vcp}, []processing.Sink{ts})
+			if err != nil {
+				t.Fatalf("NewPipeline() returned unexpected error: %v", err)
+			}
+			if err := p.Process(context.Background(), tc.resourceType, "", []byte(tc.jsonIn)); err != nil {
+				t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", tc.jsonIn, err)
+			}
+			if len(ts.WrittenResources) != 1 {
+				t.Fatalf("unexpected number of written resources. got: %d, want: 1", len(ts.WrittenResources))
+			}
+			gotJSON, err := ts.WrittenResources[0].JSON()
+			if err != nil {
+				t.Fatalf("writtenResource.JSON() returned unexpected error: %v", err)
+			}
+			normalizedWantJSON := testhelpers.NormalizeJSON(t, []byte(tc.wantJSON))
+			normalizedGotJSON := testhelpers.NormalizeJSON(t, gotJSON)
+			if !cmp.Equal(normalizedGotJSON, normalizedWantJSON) {
+				t.Errorf("pipeline.Process(..., %s) produced unexpected output. got: %s, want: %s", tc.jsonIn, normalizedGotJSON, normalizedWantJSON)
+			}
+			// The converted resource must be valid R4.
+			if _, err := ts.WrittenResources[0].Proto(); err != nil && !errors.Is(err, processing.ErrorDoNotModifyProto) {
+				t.Errorf("converted resource could not be parsed as R4: %v", err)
+			}
+		})
+	}
+}
+
+func TestVersionConvertProcessor_DeadLetter(t *testing.T) {
+	cases := []struct {
+		name         string
+		resourceType cpb.ResourceTypeCode_Value
+		jsonIn       string
+	}{
+		{
+			name:         "UnsupportedResourceType",
+			resourceType: cpb.ResourceTypeCode_ENCOUNTER,
+			jsonIn:       `{"resourceType":"Encounter","id":"1"}`,
+		},
+		{
+			name:         "ObservationValueAttachment",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			jsonIn:       `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"x"},"valueAttachment":{"url":"http://example.com"}}`,
+		},
+		{
+			name:         "ObservationEpisodeOfCareContext",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			jsonIn:       `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"x"},"context":{"reference":"EpisodeOfCare/1"}}`,
+		},
+		{
+			name:         "ObservationUnsupportedRelatedType",
+			resourceType: cpb.ResourceTypeCode_OBSERVATION,
+			jsonIn:       `{"resourceType":"Observation","id":"1","status":"final","code":{"text":"x"},"related":[{"type":"replaces","target":{"reference":"Observation/2"}}]}`,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			vcp, err := processing.NewVersionConvertProcessor(fhirversion.STU3, fhirversion.R4)
+			if err != nil {
+				t.Fatalf("NewVersionConvertProcessor() returned unexpected error: %v", err)
+			}
+			ts := &processing.TestSink{}
+			var reasons []error
+			opts := &processing.PipelineOptions{
+				DeadLetter: func(ctx context.Context, resource processing.ResourceWrapper, reason error) error {
+					reasons = append(reasons, reason)
+					return nil
+				},
+			}
+			p, err := processing.NewPipelineWithOptions([]processing.Processor{vcp}, []processing.Sink{ts}, opts)
+			if err != nil {
+				t.Fatalf("NewPipelineWithOptions() returned unexpected error: %v", err)
+			}
+			if err := p.Process(context.Background(), tc.resourceType, "", []byte(tc.jsonIn)); err != nil {
+				t.Fatalf("pipeline.Process(..., %s) returned unexpected error: %v", tc.jsonIn, err)
+			}
+			if len(ts.WrittenResources) != 0 {
+				t.Errorf("unexpected number of written resources. got: %d, want: 0", len(ts.WrittenResources))
+			}
+			if len(reasons) != 1 || !errors.Is(reasons[0], processing.ErrUnsupportedConversion) {
+				t.Errorf("unexpected dead letter reasons. got: %v, want: [%v]", reasons, processing.ErrUnsupportedConversion)
+			}
+		})
+	}
+}
+
+func TestNewVersionConvertProcessor_UnsupportedVersions(t *testing.T) {
+	if _, err := processing.NewVersionConvertProcessor(fhirversion.R4, fhirversion.STU3); err == nil {
+		t.Errorf("NewVersionConvertProcessor(R4, STU3) returned nil error")
+	}
+}
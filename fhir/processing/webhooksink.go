@@ -0,0 +1,242 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/google/bulk_fhir_tools/internal/logger"
+)
+
+// ErrWebhookDeliveryFailed is returned (wrapped) by the Finalize method of a
+// webhook Sink if any resources could not be delivered.
+var ErrWebhookDeliveryFailed = errors.New("failed to deliver resources to the webhook")
+
+// WebhookSignatureHeader is the header in which a webhook Sink sends the
+// signature of each request body, as returned by WebhookSignature.
+const WebhookSignatureHeader = "X-FHIR-Signature-256"
+
+const (
+	defaultWebhookMaxRetries     = 3
+	defaultWebhookInitialBackoff = time.Second
+	maxWebhookBackoff            = 30 * time.Second
+)
+
+// WebhookSignature returns the signature of a webhook request body, as sent in
+// the WebhookSignatureHeader: "sha256=" followed by the hex encoded
+// HMAC-SHA256 of the body, keyed with the secret. Receivers should compute the
+// signature of the body they receive, and compare it to the header with
+// hmac.Equal.
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookSinkOptions contains optional parameters used by
+// NewWebhookSinkWithOptions.
+type WebhookSinkOptions struct {
+	// The maximum number of resources sent in each request. Defaults to 1.
+	MaxBatchResources int
+	// The number of times a failed request is retried. Defaults to 3. If
+	// negative, requests are not retried.
+	MaxRetries int
+	// The time waited before the first retry, which is doubled for each
+	// subsequent retry. Defaults to 1 second.
+	InitialBackoff time.Duration
+	// The HTTP client used for requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+type webhookSink struct {
+	url    string
+	secret string
+	opts   WebhookSinkOptions
+	client *http.Client
+
+	mu    sync.Mutex
+	batch [][]byte
+	// delivered and failed count resources, and firstErr holds the first
+	// delivery error, to be returned by Finalize.
+	delivered int
+	failed    int
+	firstErr  error
+}
+
+// Assert webhookSink satisfies the Sink interface.
+var _ Sink = &webhookSink{}
+
+// NewWebhookSink creates a Sink which POSTs resources to the webhook at url,
+// with each request body signed with secret (see WebhookSignature). By
+// default each resource is sent in its own request, with the resource JSON as
+// the body; if MaxBatchResources is greater than one, resources are sent in
+// batches, as the entries of a collection Bundle.
+//
+// Requests which fail with a network error, a 429 or a 5xx status are retried
+// with exponential backoff. Resources which still cannot be delivered do not
+// stop the pipeline; instead, Finalize returns an error wrapping
+// ErrWebhookDeliveryFailed with the number of undelivered resources and the
+// first error.
+//
+// It is threadsafe to call Write on this Sink from multiple goroutines.
+func NewWebhookSink(url, secret string) (Sink, error) {
+	return NewWebhookSinkWithOptions(url, secret, nil)
+}
+
+// NewWebhookSinkWithOptions is like NewWebhookSink, but allows optional
+// parameters to be set.
+func NewWebhookSinkWithOptions(url, secret string, opts *WebhookSinkOptions) (Sink, error) {
+	if url == "" {
+		return nil, errors.New("a webhook URL must be given")
+	}
+	if secret == "" {
+		return nil, errors.New("a webhook secret must be given")
+	}
+	if opts == nil {
+		opts = &WebhookSinkOptions{}
+	}
+	ws := &webhookSink{url: url, secret: secret, opts: *opts, client: opts.HTTPClient}
+	if ws.client == nil {
+		ws.client = http.DefaultClient
+	}
+	if ws.opts.MaxBatchResources <= 0 {
+		ws.opts.MaxBatchResources = 1
+	}
+	if ws.opts.MaxRetries == 0 {
+		ws.opts.MaxRetries = defaultWebhookMaxRetries
+	}
+	if ws.opts.InitialBackoff <= 0 {
+		ws.opts.InitialBackoff = defaultWebhookInitialBackoff
+	}
+	return ws, nil
+}
+
+func (ws *webhookSink) Write(ctx context.Context, resource ResourceWrapper) error {
+	rawJSON, err := resource.JSON()
+	if err != nil {
+		return err
+	}
+	doc, err := normalizeNDJSONLine(rawJSON)
+	if err != nil {
+		return err
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.batch = append(ws.batch, doc)
+	if len(ws.batch) >= ws.opts.MaxBatchResources {
+		return ws.flush(ctx)
+	}
+	return nil
+}
+
+// Finalize sends any buffered resources, and returns an error if any resources
+// could not be delivered.
+func (ws *webhookSink) Finalize(ctx context.Context) error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if err := ws.flush(ctx); err != nil {
+		return err
+	}
+	if ws.failed > 0 {
+		return fmt.Errorf("%w: %d of %d resources were not delivered to %s, first error: %w", ErrWebhookDeliveryFailed, ws.failed, ws.failed+ws.delivered, ws.url, ws.firstErr)
+	}
+	return nil
+}
+
+// flush sends the buffered resources. Delivery errors are recorded rather than
+// returned; only errors building the request are returned. ws.mu must be held.
+func (ws *webhookSink) flush(ctx context.Context) error {
+	if len(ws.batch) == 0 {
+		return nil
+	}
+	n := len(ws.batch)
+	body := ws.batch[0]
+	if n > 1 {
+		b := bundleJSON{ResourceType: "Bundle", Type: "collection"}
+		for _, r := range ws.batch {
+			b.Entry = append(b.Entry, bundleEntryJSON{Resource: r})
+		}
+		var err error
+		if body, err = json.Marshal(b); err != nil {
+			return err
+		}
+	}
+	ws.batch = nil
+
+	if err := ws.send(ctx, body); err != nil {
+		log.Warningf("Failed to deliver %d resources to webhook %s: %v", n, ws.url, err)
+		ws.failed += n
+		if ws.firstErr == nil {
+			ws.firstErr = err
+		}
+		return nil
+	}
+	ws.delivered += n
+	return nil
+}
+
+// send POSTs the body to the webhook, retrying if appropriate.
+func (ws *webhookSink) send(ctx context.Context, body []byte) error {
+	signature := WebhookSignature(ws.secret, body)
+	backoff := ws.opts.InitialBackoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retryable bool
+		retryable, err = ws.post(ctx, body, signature)
+		if err == nil || !retryable || attempt >= ws.opts.MaxRetries {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		}
+		backoff = min(2*backoff, maxWebhookBackoff)
+	}
+}
+
+// post makes a single request to the webhook, returning whether it may be
+// retried if it failed.
+func (ws *webhookSink) post(ctx context.Context, body []byte, signature string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ws.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/fhir+json")
+	req.Header.Set(WebhookSignatureHeader, signature)
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return ctx.Err() == nil, fmt.Errorf("webhook request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4*1024))
+	retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retryable, fmt.Errorf("webhook request returned status %d: %s", resp.StatusCode, respBody)
+}
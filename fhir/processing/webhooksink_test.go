@@ -0,0 +1,191 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package processing_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/bulk_fhir_tools/fhir/processing"
+	"github.com/google/bulk_fhir_tools/testhelpers"
+	"github.com/google/go-cmp/cmp"
+
+	cpb "github.com/google/fhir/go/proto/google/fhir/proto/r4/core/codes_go_proto"
+)
+
+// fakeWebhook records the bodies of the requests it receives which have a
+// valid signature, and responds to the first failures requests with status.
+type fakeWebhook struct {
+	t        *testing.T
+	secret   string
+	failures int
+	status   int
+
+	mu       sync.Mutex
+	requests int
+	bodies   []string
+}
+
+func (fw *fakeWebhook) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		fw.t.Fatalf("failed to read request body: %v", err)
+	}
+	want := processing.WebhookSignature(fw.secret, body)
+	if got := req.Header.Get(processing.WebhookSignatureHeader); !hmac.Equal([]byte(got), []byte(want)) {
+		fw.t.Errorf("unexpected signature %q, want %q", got, want)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.requests++
+	if fw.requests <= fw.failures {
+		w.WriteHeader(fw.status)
+		return
+	}
+	fw.bodies = append(fw.bodies, string(body))
+}
+
+func newFakeWebhook(t *testing.T, failures, status int) (*fakeWebhook, *httptest.Server) {
+	fw := &fakeWebhook{t: t, secret: "secret", failures: failures, status: status}
+	server := httptest.NewServer(fw)
+	t.Cleanup(server.Close)
+	return fw, server
+}
+
+func writeWebhookPatients(t *testing.T, sink processing.Sink, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		r := &testResourceWrapper{resourceType: cpb.ResourceTypeCode_PATIENT, json: []byte(fmt.Sprintf(`{"resourceType":"Patient","id":%q}`, id))}
+		if err := sink.Write(context.Background(), r); err != nil {
+			t.Fatalf("sink.Write() returned unexpected error: %v", err)
+		}
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	ctx := context.Background()
+	fw, server := newFakeWebhook(t, 0, 0)
+	sink, err := processing.NewWebhookSink(server.URL, fw.secret)
+	if err != nil {
+		t.Fatalf("NewWebhookSink() returned unexpected error: %v", err)
+	}
+	writeWebhookPatients(t, sink, "p1", "p2")
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("sink.Finalize() returned unexpected error: %v", err)
+	}
+
+	want := []string{`{"resourceType":"Patient","id":"p1"}`, `{"resourceType":"Patient","id":"p2"}`}
+	if diff := cmp.Diff(want, fw.bodies); diff != "" {
+		t.Errorf("unexpected request bodies (-want +got):\n%s", diff)
+	}
+}
+
+func TestWebhookSink_Batching(t *testing.T) {
+	ctx := context.Background()
+	fw, server := newFakeWebhook(t, 0, 0)
+	sink, err := processing.NewWebhookSinkWithOptions(server.URL, fw.secret, &processing.WebhookSinkOptions{MaxBatchResources: 2})
+	if err != nil {
+		t.Fatalf("NewWebhookSinkWithOptions() returned unexpected error: %v", err)
+	}
+	writeWebhookPatients(t, sink, "p1", "p2", "p3")
+	if err := sink.Finalize(ctx); err != nil {
+		t.Fatalf("sink.Finalize() returned unexpected error: %v", err)
+	}
+
+	if len(fw.bodies) != 2 {
+		t.Fatalf("unexpected number of requests. got: %d, want: 2", len(fw.bodies))
+	}
+	wantBundle := `{"resourceType":"Bundle","type":"collection","entry":[{"resource":{"resourceType":"Patient","id":"p1"}},{"resource":{"resourceType":"Patient","id":"p2"}}]}`
+	if diff := cmp.Diff(testhelpers.NormalizeJSONString(t, wantBundle), testhelpers.NormalizeJSONString(t, fw.bodies[0])); diff != "" {
+		t.Errorf("unexpected batch body (-want +got):\n%s", diff)
+	}
+	// The remaining resource is sent by Finalize, on its own.
+	if diff := cmp.Diff(`{"resourceType":"Patient","id":"p3"}`, fw.bodies[1]); diff != "" {
+		t.Errorf("unexpected final body (-want +got):\n%s", diff)
+	}
+}
+
+func TestWebhookSink_Retries(t *testing.T) {
+	cases := []struct {
+		name          string
+		failures      int
+		status        int
+		wantRequests  int
+		wantDelivered bool
+	}{
+		{
+			name:          "RetryableStatus",
+			failures:      2,
+			status:        http.StatusServiceUnavailable,
+			wantRequests:  3,
+			wantDelivered: true,
+		},
+		{
+			name:         "RetriesExhausted",
+			failures:     10,
+			status:       http.StatusTooManyRequests,
+			wantRequests: 4,
+		},
+		{
+			name:         "NonRetryableStatus",
+			failures:     1,
+			status:       http.StatusBadRequest,
+			wantRequests: 1,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+			fw, server := newFakeWebhook(t, tc.failures, tc.status)
+			opts := &processing.WebhookSinkOptions{MaxRetries: 3, InitialBackoff: time.Millisecond}
+			sink, err := processing.NewWebhookSinkWithOptions(server.URL, fw.secret, opts)
+			if err != nil {
+				t.Fatalf("NewWebhookSinkWithOptions() returned unexpected error: %v", err)
+			}
+			// Delivery failures are only reported by Finalize.
+			writeWebhookPatients(t, sink, "p1")
+			err = sink.Finalize(ctx)
+			if tc.wantDelivered {
+				if err != nil {
+					t.Errorf("sink.Finalize() returned unexpected error: %v", err)
+				}
+			} else if !errors.Is(err, processing.ErrWebhookDeliveryFailed) {
+				t.Errorf("sink.Finalize() returned unexpected error. got: %v, want: %v", err, processing.ErrWebhookDeliveryFailed)
+			}
+			if fw.requests != tc.wantRequests {
+				t.Errorf("unexpected number of requests. got: %d, want: %d", fw.requests, tc.wantRequests)
+			}
+		})
+	}
+}
+
+func TestNewWebhookSink_InvalidArguments(t *testing.T) {
+	if _, err := processing.NewWebhookSink("", "secret"); err == nil {
+		t.Error("NewWebhookSink() with no URL succeeded, want error")
+	}
+	if _, err := processing.NewWebhookSink("http://localhost:8080", ""); err == nil {
+		t.Error("NewWebhookSink() with no secret succeeded, want error")
+	}
+}
@@ -31,6 +31,24 @@ func ParseFHIRInstant(instant string) (time.Time, error) {
 	return t, nil
 }
 
+// dateLayouts are the layouts of the partial and full dates allowed in FHIR
+// date and dateTime values, keyed by length.
+var dateLayouts = map[int]string{
+	len("2006"):       "2006",
+	len("2006-01"):    "2006-01",
+	len("2006-01-02"): "2006-01-02",
+}
+
+// ParseFHIRDateTime parses a FHIR date, dateTime or instant string into a
+// time.Time. Dates (which may be partial, such as 2006 or 2006-01) have no time
+// zone, so are parsed as the start of the period in UTC.
+func ParseFHIRDateTime(dateTime string) (time.Time, error) {
+	if layout, ok := dateLayouts[len(dateTime)]; ok {
+		return time.Parse(layout, dateTime)
+	}
+	return ParseFHIRInstant(dateTime)
+}
+
 // ToFHIRInstant takes a time.Time and returns the string FHIR Instant
 // representation of it.
 func ToFHIRInstant(t time.Time) string {
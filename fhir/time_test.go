@@ -98,6 +98,32 @@ func TestParseFHIRInstant_Invalid(t *testing.T) {
 	}
 }
 
+func TestParseFHIRDateTime(t *testing.T) {
+	tests := []struct {
+		dateTime string
+		want     time.Time
+	}{
+		{"2012", time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"2012-06", time.Date(2012, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"2012-06-03", time.Date(2012, 6, 3, 0, 0, 0, 0, time.UTC)},
+		{"2012-06-03T23:45:32.123Z", time.Date(2012, 6, 3, 23, 45, 32, 123000000, time.UTC)},
+		{"2009-09-28T02:37:43-05:00", time.Date(2009, 9, 28, 2, 37, 43, 0, time.FixedZone("EST", -5*60*60))},
+	}
+	for _, tc := range tests {
+		got, err := fhir.ParseFHIRDateTime(tc.dateTime)
+		if err != nil {
+			t.Errorf("ParseFHIRDateTime(%q) returned unexpected error: %v", tc.dateTime, err)
+			continue
+		}
+		if !tc.want.Equal(got) {
+			t.Errorf("ParseFHIRDateTime(%q) returned incorrect time, got: %v want: %v", tc.dateTime, got, tc.want)
+		}
+	}
+	if _, err := fhir.ParseFHIRDateTime("2012-6-3"); err == nil {
+		t.Errorf("ParseFHIRDateTime(%q) succeeded, want error", "2012-6-3")
+	}
+}
+
 func TestToFHIRInstant(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -24,6 +24,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strconv"
+	"strings"
 
 	healthcare "google.golang.org/api/healthcare/v1"
 	"google.golang.org/api/option"
@@ -45,6 +46,10 @@ const DefaultHealthcareEndpoint = "https://healthcare.googleapis.com/"
 // server.
 var ErrorAPIServer = errors.New("error was received from the Healthcare API server")
 
+// ErrorOperationOutcomeWarning indicates that an upload succeeded, but the
+// OperationOutcome returned by the Healthcare API server contained warnings.
+var ErrorOperationOutcomeWarning = errors.New("the Healthcare API server returned an OperationOutcome with warnings")
+
 // Client represents a FHIR store client that can be used to interact with GCP's
 // FHIR store. Do not use this directly, call NewFHIRStoreClient to create a
 // new one.
@@ -67,6 +72,12 @@ type Config struct {
 	DatasetID string
 	// FHIRStoreID is the FHIR store identifier.
 	FHIRStoreID string
+	// PreferOperationOutcome indicates that uploads should request
+	// "Prefer: return=OperationOutcome", so that the server responds with an
+	// OperationOutcome describing the result rather than echoing the resource.
+	// Error or warning issues in an otherwise successful response are then
+	// returned as an *OperationOutcomeError.
+	PreferOperationOutcome bool
 }
 
 // NewClient initializes and returns a new FHIR store client.
@@ -104,6 +115,9 @@ func (c *Client) UploadResource(fhirJSON []byte) error {
 
 	call := fhirService.Update(name, bytes.NewReader(fhirJSON))
 	call.Header().Set("Content-Type", "application/fhir+json;charset=utf-8")
+	if c.cfg.PreferOperationOutcome {
+		call.Header().Set("Prefer", preferOperationOutcome)
+	}
 
 	resp, err := call.Do()
 	if err != nil {
@@ -122,6 +136,20 @@ func (c *Client) UploadResource(fhirJSON []byte) error {
 		}
 		return fmt.Errorf("error from API server: status %d %s: %s %w", resp.StatusCode, resp.Status, respBytes, ErrorAPIServer)
 	}
+	if c.cfg.PreferOperationOutcome {
+		respBytes, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("could not read response: %v", err)
+		}
+		var oo operationOutcome
+		if err := json.Unmarshal(respBytes, &oo); err != nil || oo.ResourceType != "OperationOutcome" {
+			// Servers which do not support the Prefer header may echo the resource.
+			return nil
+		}
+		if issues := oo.reportableIssues(); len(issues) > 0 {
+			return &OperationOutcomeError{ResponseStatusCode: resp.StatusCode, Issues: issues}
+		}
+	}
 	return nil
 }
 
@@ -150,6 +178,9 @@ func (c *Client) UploadBundle(fhirBundleJSON []byte) error {
 
 	call := fhirService.ExecuteBundle(parent, bytes.NewReader(fhirBundleJSON))
 	call.Header().Set("Content-Type", "application/fhir+json;charset=utf-8")
+	if c.cfg.PreferOperationOutcome {
+		call.Header().Set("Prefer", preferOperationOutcome)
+	}
 	resp, err := call.Do()
 	if err != nil {
 		return fmt.Errorf("error executing Healthcare API call (ExecuteBundle): %v", err)
@@ -186,6 +217,22 @@ func (c *Client) UploadBundle(fhirBundleJSON []byte) error {
 		if scode > 299 {
 			errInsideBundle = true
 			log.Errorf("error uploading fhir resource in bundle: %s", r.Response.Outcome)
+			continue
+		}
+		if c.cfg.PreferOperationOutcome && len(r.Response.Outcome.Issue) > 0 {
+			oo := operationOutcome{}
+			if err := json.Unmarshal(r.Response.Outcome.Issue, &oo.Issue); err != nil {
+				return fmt.Errorf("could not unmarshal bundle entry outcome: %v", err)
+			}
+			if issues := oo.reportableIssues(); len(issues) > 0 {
+				ooErr := &OperationOutcomeError{ResponseStatusCode: scode, Issues: issues}
+				if ooErr.hasErrors() {
+					errInsideBundle = true
+					log.Errorf("error uploading fhir resource in bundle: %v", ooErr)
+				} else {
+					log.Warningf("warning uploading fhir resource in bundle: %v", ooErr)
+				}
+			}
 		}
 	}
 
@@ -236,6 +283,74 @@ func (b *BundleError) Is(target error) bool {
 	return target == ErrorAPIServer
 }
 
+// preferOperationOutcome is the value of the Prefer header set when
+// Config.PreferOperationOutcome is true.
+const preferOperationOutcome = "return=OperationOutcome"
+
+// OperationOutcomeIssue holds a single issue from an OperationOutcome returned
+// by the Healthcare API server.
+type OperationOutcomeIssue struct {
+	Severity    string `json:"severity"`
+	Code        string `json:"code"`
+	Diagnostics string `json:"diagnostics,omitempty"`
+}
+
+type operationOutcome struct {
+	ResourceType string                  `json:"resourceType"`
+	Issue        []OperationOutcomeIssue `json:"issue"`
+}
+
+// reportableIssues returns the issues with a severity of warning, error or
+// fatal (informational issues are ignored).
+func (oo *operationOutcome) reportableIssues() []OperationOutcomeIssue {
+	var issues []OperationOutcomeIssue
+	for _, i := range oo.Issue {
+		switch i.Severity {
+		case "warning", "error", "fatal":
+			issues = append(issues, i)
+		}
+	}
+	return issues
+}
+
+// OperationOutcomeError represents the error or warning issues in an
+// OperationOutcome returned by GCP FHIR Store with a successful (2xx) status,
+// when Config.PreferOperationOutcome is set. It is equivalent to ErrorAPIServer
+// if any of the issues are errors, or to ErrorOperationOutcomeWarning if they
+// are all warnings.
+type OperationOutcomeError struct {
+	ResponseStatusCode int
+	Issues             []OperationOutcomeIssue
+}
+
+// Error returns a string version of error information.
+func (o *OperationOutcomeError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "OperationOutcome from API server, StatusCode: %d Issues:", o.ResponseStatusCode)
+	for _, i := range o.Issues {
+		fmt.Fprintf(&sb, " [%s %s: %s]", i.Severity, i.Code, i.Diagnostics)
+	}
+	return sb.String()
+}
+
+// Is returns true if this error should be considered equivalent to the target
+// error (and makes this work smoothly with errors.Is calls)
+func (o *OperationOutcomeError) Is(target error) bool {
+	if o.hasErrors() {
+		return target == ErrorAPIServer
+	}
+	return target == ErrorOperationOutcomeWarning
+}
+
+func (o *OperationOutcomeError) hasErrors() bool {
+	for _, i := range o.Issues {
+		if i.Severity == "error" || i.Severity == "fatal" {
+			return true
+		}
+	}
+	return false
+}
+
 // ImportFromGCS triggers a long-running FHIR store import job from a
 // GCS location. Note wildcards can be used in the gcsURI, for example,
 // gs://BUCKET/DIRECTORY/**.ndjson imports all files with .ndjson extension
@@ -520,3 +520,112 @@ type gcsImportRequest struct {
 	ContentStructure string    `json:"contentStructure"`
 	GCSSource        gcsSource `json:"gcsSource"`
 }
+
+func TestUploadResource_PreferOperationOutcome(t *testing.T) {
+	inputJSON := []byte(`{"id": "resourceID", "resourceType": "Patient"}`)
+	cases := []struct {
+		name       string
+		response   string
+		wantErr    error
+		wantNotErr error
+	}{
+		{
+			name:     "InformationOnly",
+			response: `{"resourceType": "OperationOutcome", "issue": [{"severity": "information", "code": "informational"}]}`,
+		},
+		{
+			name:     "EchoedResource",
+			response: `{"id": "resourceID", "resourceType": "Patient"}`,
+		},
+		{
+			name:       "Warning",
+			response:   `{"resourceType": "OperationOutcome", "issue": [{"severity": "warning", "code": "informational", "diagnostics": "unknown code system"}]}`,
+			wantErr:    fhirstore.ErrorOperationOutcomeWarning,
+			wantNotErr: fhirstore.ErrorAPIServer,
+		},
+		{
+			name:       "Error",
+			response:   `{"resourceType": "OperationOutcome", "issue": [{"severity": "warning", "code": "informational"}, {"severity": "error", "code": "processing"}]}`,
+			wantErr:    fhirstore.ErrorAPIServer,
+			wantNotErr: fhirstore.ErrorOperationOutcomeWarning,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if got, want := req.Header.Get("Prefer"), "return=OperationOutcome"; got != want {
+					t.Errorf("FHIR Store test server got unexpected Prefer header. got: %q, want: %q", got, want)
+				}
+				w.Write([]byte(tc.response))
+			}))
+			defer server.Close()
+
+			c, err := fhirstore.NewClient(context.Background(), &fhirstore.Config{
+				CloudHealthcareEndpoint: server.URL,
+				ProjectID:               "projectID",
+				Location:                "us-east1",
+				DatasetID:               "datasetID",
+				FHIRStoreID:             "fhirstoreID",
+				PreferOperationOutcome:  true,
+			})
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+			err = c.UploadResource(inputJSON)
+			if tc.wantErr == nil {
+				if err != nil {
+					t.Errorf("UploadResource() returned unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("UploadResource() returned unexpected error. got: %v, want: %v", err, tc.wantErr)
+			}
+			if errors.Is(err, tc.wantNotErr) {
+				t.Errorf("UploadResource() returned error %v, which unexpectedly is %v", err, tc.wantNotErr)
+			}
+			var ooErr *fhirstore.OperationOutcomeError
+			if !errors.As(err, &ooErr) || len(ooErr.Issues) == 0 {
+				t.Errorf("UploadResource() returned error %v, want an OperationOutcomeError with issues", err)
+			}
+		})
+	}
+}
+
+func TestUploadBundle_PreferOperationOutcome(t *testing.T) {
+	cases := []struct {
+		name    string
+		issue   string
+		wantErr bool
+	}{
+		{name: "Warning", issue: `{"severity": "warning", "code": "informational"}`},
+		{name: "Error", issue: `{"severity": "error", "code": "processing"}`, wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if got, want := req.Header.Get("Prefer"), "return=OperationOutcome"; got != want {
+					t.Errorf("FHIR Store test server got unexpected Prefer header. got: %q, want: %q", got, want)
+				}
+				w.Write([]byte(`{"entry": [{"response": {"status": "200 OK", "outcome": {"issue": [` + tc.issue + `]}}}]}`))
+			}))
+			defer server.Close()
+
+			c, err := fhirstore.NewClient(context.Background(), &fhirstore.Config{
+				CloudHealthcareEndpoint: server.URL,
+				ProjectID:               "projectID",
+				Location:                "us-east1",
+				DatasetID:               "datasetID",
+				FHIRStoreID:             "fhirstoreID",
+				PreferOperationOutcome:  true,
+			})
+			if err != nil {
+				t.Fatalf("NewClient() returned unexpected error: %v", err)
+			}
+			err = c.UploadBatch([][]byte{[]byte(`{"id": "pat", "resourceType": "Patient"}`)})
+			if gotErr := errors.Is(err, fhirstore.ErrorAPIServer); gotErr != tc.wantErr {
+				t.Errorf("UploadBatch() returned unexpected error %v, want error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"cloud.google.com/go/storage"
 	"google.golang.org/api/iterator"
 	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
 )
 
 // DefaultCloudStorageEndpoint represents the default cloud storage API endpoint.
@@ -40,6 +41,9 @@ type Client struct {
 	*storage.Client
 	endpointURL string
 	bucketName  string
+	// httpClient is used for requests which the storage client does not
+	// support, such as resumable uploads which span several writers.
+	httpClient *http.Client
 }
 
 // NewClient creates and returns a new gcs client for use in writing resources to an existing GCS
@@ -48,10 +52,14 @@ type Client struct {
 // TODO(b/243677730): Add support for creating buckets.
 func NewClient(ctx context.Context, bucketName, endpointURL string) (Client, error) {
 	var storageClient *storage.Client
+	var httpClient *http.Client
 	var err error
 
 	if endpointURL == DefaultCloudStorageEndpoint {
 		storageClient, err = storage.NewClient(ctx)
+		if err == nil {
+			httpClient, _, err = htransport.NewClient(ctx, option.WithScopes(storage.ScopeReadWrite))
+		}
 	} else {
 		// When not using the default Cloud Storage endpoint, we provide an empty
 		// http.Client. This case is generally used in the test, so that the
@@ -59,9 +67,10 @@ func NewClient(ctx context.Context, bucketName, endpointURL string) (Client, err
 		// credentials in the test environment.
 		// TODO(b/211028663): we should try to find a better way to handle this
 		// case, perhaps we can set fake default creds in the test setup.
-		storageClient, err = storage.NewClient(ctx, option.WithHTTPClient(&http.Client{}), option.WithEndpoint(endpointURL))
+		httpClient = &http.Client{}
+		storageClient, err = storage.NewClient(ctx, option.WithHTTPClient(httpClient), option.WithEndpoint(endpointURL))
 	}
-	gcsClient := Client{endpointURL: endpointURL, bucketName: bucketName, Client: storageClient}
+	gcsClient := Client{endpointURL: endpointURL, bucketName: bucketName, Client: storageClient, httpClient: httpClient}
 	return gcsClient, err
 }
 
@@ -83,6 +92,12 @@ func (gcsClient Client) GetFileReader(ctx context.Context, fileName string) (io.
 	return bkt.Object(fileName).NewReader(ctx)
 }
 
+// DeleteFile deletes the file named `fileName` from the pre defined GCS
+// bucket.
+func (gcsClient Client) DeleteFile(ctx context.Context, fileName string) error {
+	return gcsClient.Bucket(gcsClient.bucketName).Object(fileName).Delete(ctx)
+}
+
 // IsBucketInProject returns true if the bucket is in the GCP project.
 func (gcsClient Client) IsBucketInProject(ctx context.Context, project string) (bool, error) {
 	it := gcsClient.Buckets(ctx, project)
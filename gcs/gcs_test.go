@@ -136,6 +136,30 @@ func TestGCSClientReadsDataFromGCS(t *testing.T) {
 
 }
 
+func TestGCSClientDeletesFile(t *testing.T) {
+	var bucketID = "TestBucket"
+	var fileName = "dir/TestFile"
+
+	server := testhelpers.NewGCSServer(t)
+	server.AddObject(bucketID, fileName, testhelpers.GCSObjectEntry{
+		Data: []byte("data"),
+	})
+
+	ctx := context.Background()
+
+	gcsClient, err := NewClient(ctx, bucketID, server.URL())
+	if err != nil {
+		t.Fatal("Unexpected error when creating NewClient: ", err)
+	}
+
+	if err := gcsClient.DeleteFile(ctx, fileName); err != nil {
+		t.Fatal("Unexpected error when deleting file: ", err)
+	}
+	if _, ok := server.GetObject(bucketID, fileName); ok {
+		t.Error("Expected file to be deleted: ", fileName)
+	}
+}
+
 func TestJoinPath(t *testing.T) {
 	for _, tc := range []struct {
 		description string
@@ -0,0 +1,267 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultResumableUploadChunkSize is the default size of the chunks sent by a
+// ResumableUpload.
+const DefaultResumableUploadChunkSize = 8 * 1024 * 1024
+
+// resumableUploadChunkAlignment is the size which every chunk except the last
+// must be a multiple of.
+const resumableUploadChunkAlignment = 256 * 1024
+
+// statusResumeIncomplete is the status with which GCS responds to chunks of an
+// upload which is not yet complete.
+const statusResumeIncomplete = 308
+
+// ErrUploadComplete is returned by ResumableUpload.Query if the upload has
+// already been completed.
+var ErrUploadComplete = errors.New("the resumable upload is already complete")
+
+// ResumableUploadOptions contains optional parameters used by
+// NewResumableUpload.
+type ResumableUploadOptions struct {
+	// The size in bytes of the chunks in which data is uploaded, which must be
+	// a multiple of 256 KiB. Data is buffered in memory until a chunk is full,
+	// and a failed upload can only resume from the end of the last chunk.
+	// Defaults to DefaultResumableUploadChunkSize.
+	ChunkSize int
+	// The content type of the object. Defaults to application/octet-stream.
+	ContentType string
+}
+
+// ResumableUpload is a GCS resumable upload session, which writes a single
+// object in chunks. Unlike the writer returned by GetFileWriter, if an upload
+// fails part way through, it can be continued from the data which GCS has
+// committed (see Query) rather than restarted, which avoids uploading large
+// objects again from the beginning.
+//
+// The object is only created once Close succeeds.
+type ResumableUpload struct {
+	ctx        context.Context
+	httpClient *http.Client
+	sessionURI string
+	chunkSize  int
+	// offset is the number of bytes committed by GCS.
+	offset int64
+	// buf holds the data written after offset, which has not been committed.
+	buf []byte
+}
+
+// NewResumableUpload starts a resumable upload of an object named fileName in
+// the pre defined GCS bucket. opts may be nil. ctx is used for all requests
+// made by the upload.
+func (gcsClient Client) NewResumableUpload(ctx context.Context, fileName string, opts *ResumableUploadOptions) (*ResumableUpload, error) {
+	if opts == nil {
+		opts = &ResumableUploadOptions{}
+	}
+	chunkSize := opts.ChunkSize
+	if chunkSize == 0 {
+		chunkSize = DefaultResumableUploadChunkSize
+	}
+	if chunkSize < 0 || chunkSize%resumableUploadChunkAlignment != 0 {
+		return nil, fmt.Errorf("resumable upload chunk size %d is not a multiple of %d", chunkSize, resumableUploadChunkAlignment)
+	}
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=resumable&name=%s",
+		strings.TrimSuffix(gcsClient.endpointURL, "/"), url.PathEscape(gcsClient.bucketName), url.QueryEscape(fileName))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Upload-Content-Type", contentType)
+	resp, err := gcsClient.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start resumable upload of %s: %w", fileName, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to start resumable upload of %s: %w", fileName, responseError(resp))
+	}
+	sessionURI := resp.Header.Get("Location")
+	if sessionURI == "" {
+		return nil, fmt.Errorf("failed to start resumable upload of %s: no session URI in response", fileName)
+	}
+	return &ResumableUpload{ctx: ctx, httpClient: gcsClient.httpClient, sessionURI: sessionURI, chunkSize: chunkSize}, nil
+}
+
+// SessionURI returns the URI of the upload session, which identifies it to
+// GCS.
+func (ru *ResumableUpload) SessionURI() string {
+	return ru.sessionURI
+}
+
+// Offset returns the number of bytes committed by GCS as of the last chunk
+// sent or the last call to Query. Data written after this is buffered until it
+// is sent.
+func (ru *ResumableUpload) Offset() int64 {
+	return ru.offset
+}
+
+// Write buffers p, and uploads each chunk of the buffered data as it becomes
+// full. If Write returns an error, the upload may be continued by calling
+// Query, and writing the data from the offset it returns.
+func (ru *ResumableUpload) Write(p []byte) (int, error) {
+	ru.buf = append(ru.buf, p...)
+	for len(ru.buf) >= ru.chunkSize {
+		if err := ru.sendChunk(ru.buf[:ru.chunkSize], false); err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Close uploads any buffered data and completes the upload, creating the
+// object.
+func (ru *ResumableUpload) Close() error {
+	return ru.sendChunk(ru.buf, true)
+}
+
+// Query asks GCS how much of the upload it has committed, discards any
+// buffered data, and returns the offset from which the upload should be
+// continued. ErrUploadComplete is returned if the upload is already complete.
+func (ru *ResumableUpload) Query() (int64, error) {
+	resp, err := ru.put(nil, "bytes */*")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return 0, ErrUploadComplete
+	case statusResumeIncomplete:
+		offset, err := committedOffset(resp)
+		if err != nil {
+			return 0, err
+		}
+		ru.offset = offset
+		ru.buf = nil
+		return offset, nil
+	default:
+		return 0, fmt.Errorf("failed to query resumable upload: %w", responseError(resp))
+	}
+}
+
+// Cancel abandons the upload. The object is not created.
+func (ru *ResumableUpload) Cancel() error {
+	req, err := http.NewRequestWithContext(ru.ctx, http.MethodDelete, ru.sessionURI, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := ru.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to cancel resumable upload: %w", err)
+	}
+	defer resp.Body.Close()
+	// GCS responds to a successful cancellation with 499.
+	if resp.StatusCode != 499 && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("failed to cancel resumable upload: %w", responseError(resp))
+	}
+	return nil
+}
+
+// sendChunk sends chunk, which starts at ru.offset, and removes the data
+// committed by GCS from ru.buf. If final is true, the upload is completed.
+func (ru *ResumableUpload) sendChunk(chunk []byte, final bool) error {
+	end := ru.offset + int64(len(chunk))
+	var contentRange string
+	switch {
+	case final && len(chunk) == 0:
+		contentRange = fmt.Sprintf("bytes */%d", end)
+	case final:
+		contentRange = fmt.Sprintf("bytes %d-%d/%d", ru.offset, end-1, end)
+	default:
+		contentRange = fmt.Sprintf("bytes %d-%d/*", ru.offset, end-1)
+	}
+	resp, err := ru.put(chunk, contentRange)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case final && (resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated):
+		ru.offset = end
+		ru.buf = nil
+		return nil
+	case !final && resp.StatusCode == statusResumeIncomplete:
+		// GCS may not commit the whole chunk, in which case the rest is sent
+		// again in the next chunk.
+		offset, err := committedOffset(resp)
+		if err != nil {
+			return err
+		}
+		if offset < ru.offset || offset > end {
+			return fmt.Errorf("resumable upload committed offset %d outside of the chunk sent (%s)", offset, contentRange)
+		}
+		ru.buf = ru.buf[offset-ru.offset:]
+		ru.offset = offset
+		return nil
+	default:
+		return fmt.Errorf("failed to upload chunk %s: %w", contentRange, responseError(resp))
+	}
+}
+
+func (ru *ResumableUpload) put(data []byte, contentRange string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ru.ctx, http.MethodPut, ru.sessionURI, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Range", contentRange)
+	resp, err := ru.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send resumable upload request: %w", err)
+	}
+	return resp, nil
+}
+
+// committedOffset returns the number of bytes committed according to the
+// Range header of a 308 response, which is absent if none are.
+func committedOffset(resp *http.Response) (int64, error) {
+	r := resp.Header.Get("Range")
+	if r == "" {
+		return 0, nil
+	}
+	last, ok := strings.CutPrefix(r, "bytes=0-")
+	if !ok {
+		return 0, fmt.Errorf("unexpected Range header in resumable upload response: %q", r)
+	}
+	n, err := strconv.ParseInt(last, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected Range header in resumable upload response: %q", r)
+	}
+	return n + 1, nil
+}
+
+// responseError returns an error describing an unexpected response.
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("unexpected HTTP status %d: %s", resp.StatusCode, body)
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcs
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/testhelpers"
+)
+
+const testChunkSize = 256 * 1024
+
+// testData returns n bytes of non-repeating test data.
+func testData(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7 / 3)
+	}
+	return data
+}
+
+func TestResumableUpload(t *testing.T) {
+	bucketID := "TestBucket"
+	fileName := "directory/large.ndjson"
+	data := testData(2*testChunkSize + 1000)
+
+	server := testhelpers.NewGCSServer(t)
+	ctx := context.Background()
+	gcsClient, err := NewClient(ctx, bucketID, server.URL())
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	upload, err := gcsClient.NewResumableUpload(ctx, fileName, &ResumableUploadOptions{ChunkSize: testChunkSize, ContentType: "application/fhir+ndjson"})
+	if err != nil {
+		t.Fatalf("NewResumableUpload() returned unexpected error: %v", err)
+	}
+	// Write in pieces which do not line up with the chunks.
+	for start := 0; start < len(data); start += 100000 {
+		end := min(start+100000, len(data))
+		if _, err := upload.Write(data[start:end]); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+	}
+	if got, want := upload.Offset(), int64(2*testChunkSize); got != want {
+		t.Errorf("Offset() before Close() = %d, want %d", got, want)
+	}
+	if err := upload.Close(); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+
+	obj, ok := server.GetObject(bucketID, fileName)
+	if !ok {
+		t.Fatalf("object %s/%s was not found", bucketID, fileName)
+	}
+	if !bytes.Equal(obj.Data, data) {
+		t.Errorf("uploaded object has %d bytes which differ from the %d bytes written", len(obj.Data), len(data))
+	}
+	if obj.ContentType != "application/fhir+ndjson" {
+		t.Errorf("uploaded object has content type %q, want application/fhir+ndjson", obj.ContentType)
+	}
+}
+
+func TestResumableUpload_Resume(t *testing.T) {
+	bucketID := "TestBucket"
+	fileName := "large.ndjson"
+	data := testData(testChunkSize + 1000)
+
+	server := testhelpers.NewGCSServer(t)
+	ctx := context.Background()
+	gcsClient, err := NewClient(ctx, bucketID, server.URL())
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	upload, err := gcsClient.NewResumableUpload(ctx, fileName, &ResumableUploadOptions{ChunkSize: testChunkSize})
+	if err != nil {
+		t.Fatalf("NewResumableUpload() returned unexpected error: %v", err)
+	}
+	// Write the first chunk and some of the next, as if the data being
+	// uploaded was then interrupted.
+	if _, err := upload.Write(data[:testChunkSize+500]); err != nil {
+		t.Fatalf("Write() returned unexpected error: %v", err)
+	}
+
+	offset, err := upload.Query()
+	if err != nil {
+		t.Fatalf("Query() returned unexpected error: %v", err)
+	}
+	if offset != testChunkSize {
+		t.Errorf("Query() = %d, want %d", offset, testChunkSize)
+	}
+	if _, err := upload.Write(data[offset:]); err != nil {
+		t.Fatalf("Write() returned unexpected error: %v", err)
+	}
+	if err := upload.Close(); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+
+	obj, ok := server.GetObject(bucketID, fileName)
+	if !ok {
+		t.Fatalf("object %s/%s was not found", bucketID, fileName)
+	}
+	if !bytes.Equal(obj.Data, data) {
+		t.Errorf("uploaded object has %d bytes which differ from the %d bytes written", len(obj.Data), len(data))
+	}
+	if _, err := upload.Query(); err == nil {
+		t.Errorf("Query() after Close() succeeded, want error")
+	}
+}
+
+func TestResumableUpload_Cancel(t *testing.T) {
+	server := testhelpers.NewGCSServer(t)
+	ctx := context.Background()
+	gcsClient, err := NewClient(ctx, "TestBucket", server.URL())
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	upload, err := gcsClient.NewResumableUpload(ctx, "cancelled", nil)
+	if err != nil {
+		t.Fatalf("NewResumableUpload() returned unexpected error: %v", err)
+	}
+	if _, err := upload.Write([]byte("data")); err != nil {
+		t.Fatalf("Write() returned unexpected error: %v", err)
+	}
+	if err := upload.Cancel(); err != nil {
+		t.Fatalf("Cancel() returned unexpected error: %v", err)
+	}
+	if err := upload.Close(); err == nil {
+		t.Errorf("Close() after Cancel() succeeded, want error")
+	}
+	if _, ok := server.GetObject("TestBucket", "cancelled"); ok {
+		t.Errorf("object was created by a cancelled upload")
+	}
+}
+
+func TestNewResumableUpload_InvalidChunkSize(t *testing.T) {
+	server := testhelpers.NewGCSServer(t)
+	ctx := context.Background()
+	gcsClient, err := NewClient(ctx, "TestBucket", server.URL())
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	if _, err := gcsClient.NewResumableUpload(ctx, "file", &ResumableUploadOptions{ChunkSize: 1000}); err == nil {
+		t.Errorf("NewResumableUpload() with chunk size 1000 succeeded, want error")
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iohelpers
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+)
+
+// MaybeGunzip returns a reader which decompresses r if it holds gzip
+// compressed data (which is detected from the gzip magic number), or
+// otherwise returns the data unchanged.
+func MaybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	gzipped, err := isGzip(br)
+	if err != nil {
+		return nil, err
+	}
+	if gzipped {
+		return gzip.NewReader(br)
+	}
+	return br, nil
+}
+
+// isGzip returns whether the data in br starts with the gzip magic number,
+// without consuming it.
+func isGzip(br *bufio.Reader) (bool, error) {
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
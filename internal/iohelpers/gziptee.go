@@ -0,0 +1,93 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package iohelpers contains io.Reader and io.Writer helpers shared by the
+// bulk FHIR tools.
+package iohelpers
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+)
+
+// ErrArchiveIncomplete is returned by GzipTeeReader.Close if the stream was
+// closed before all of it was read, in which case the archive is incomplete.
+var ErrArchiveIncomplete = errors.New("stream closed before it was fully read; the archive is incomplete")
+
+// GzipTeeReader reads plaintext from an underlying stream, while writing a
+// gzip compressed copy of everything read to an archive writer. This allows a
+// stream to be archived (compressed) and processed in a single pass.
+type GzipTeeReader struct {
+	r       io.Reader
+	closer  io.Closer
+	archive io.Writer
+	// gz is the gzip writer used to compress the stream, or nil if the
+	// stream is already gzip compressed, and copied to archive as it is.
+	gz  *gzip.Writer
+	eof bool
+}
+
+// NewGzipTeeReader returns a GzipTeeReader which reads the plaintext of r. If r
+// holds gzip compressed data (which is detected from the gzip magic number),
+// it is copied to archive unchanged and decompressed for reading, so that it is
+// not compressed twice. Otherwise, it is compressed as it is read.
+//
+// The archive is only complete once the reader has been read to EOF and then
+// closed. Close does not close archive.
+func NewGzipTeeReader(r io.ReadCloser, archive io.Writer) (*GzipTeeReader, error) {
+	br := bufio.NewReader(r)
+	gzipped, err := isGzip(br)
+	if err != nil {
+		return nil, err
+	}
+	gtr := &GzipTeeReader{closer: r, archive: archive}
+	if gzipped {
+		zr, err := gzip.NewReader(io.TeeReader(br, archive))
+		if err != nil {
+			return nil, err
+		}
+		gtr.r = zr
+		return gtr, nil
+	}
+	gtr.gz = gzip.NewWriter(archive)
+	gtr.r = io.TeeReader(br, gtr.gz)
+	return gtr, nil
+}
+
+// Read reads plaintext from the stream, adding it to the archive.
+func (gtr *GzipTeeReader) Read(p []byte) (int, error) {
+	n, err := gtr.r.Read(p)
+	if err == io.EOF {
+		gtr.eof = true
+	}
+	return n, err
+}
+
+// Close closes the underlying stream, and completes the archive. If the stream
+// was not read to EOF, ErrArchiveIncomplete is returned and the archive is
+// left truncated (so that it is not mistaken for a complete, valid archive).
+func (gtr *GzipTeeReader) Close() error {
+	closeErr := gtr.closer.Close()
+	if !gtr.eof {
+		return ErrArchiveIncomplete
+	}
+	if gtr.gz != nil {
+		if err := gtr.gz.Close(); err != nil {
+			return err
+		}
+	}
+	return closeErr
+}
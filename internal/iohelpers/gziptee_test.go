@@ -0,0 +1,96 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package iohelpers_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/internal/iohelpers"
+)
+
+func TestGzipTeeReader(t *testing.T) {
+	plaintext := strings.Repeat(`{"resourceType":"Patient","id":"1"}`+"\n", 1000)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write([]byte(plaintext)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name  string
+		input []byte
+	}{
+		{name: "Uncompressed", input: []byte(plaintext)},
+		{name: "AlreadyCompressed", input: compressed.Bytes()},
+		{name: "Empty", input: []byte{}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var archive bytes.Buffer
+			gtr, err := iohelpers.NewGzipTeeReader(io.NopCloser(bytes.NewReader(tc.input)), &archive)
+			if err != nil {
+				t.Fatalf("NewGzipTeeReader() returned unexpected error: %v", err)
+			}
+			got, err := io.ReadAll(gtr)
+			if err != nil {
+				t.Fatalf("ReadAll() returned unexpected error: %v", err)
+			}
+			if err := gtr.Close(); err != nil {
+				t.Fatalf("Close() returned unexpected error: %v", err)
+			}
+
+			want := plaintext
+			if len(tc.input) == 0 {
+				want = ""
+			}
+			if string(got) != want {
+				t.Errorf("unexpected plaintext read. got %d bytes, want %d bytes", len(got), len(want))
+			}
+			zr, err := gzip.NewReader(&archive)
+			if err != nil {
+				t.Fatalf("archive is not gzip compressed: %v", err)
+			}
+			gotArchived, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatalf("failed to decompress archive: %v", err)
+			}
+			if string(gotArchived) != want {
+				t.Errorf("unexpected archive contents. got %d bytes, want %d bytes", len(gotArchived), len(want))
+			}
+		})
+	}
+}
+
+func TestGzipTeeReader_ClosedEarly(t *testing.T) {
+	var archive bytes.Buffer
+	gtr, err := iohelpers.NewGzipTeeReader(io.NopCloser(strings.NewReader("some data")), &archive)
+	if err != nil {
+		t.Fatalf("NewGzipTeeReader() returned unexpected error: %v", err)
+	}
+	if _, err := gtr.Read(make([]byte, 4)); err != nil {
+		t.Fatalf("Read() returned unexpected error: %v", err)
+	}
+	if err := gtr.Close(); !errors.Is(err, iohelpers.ErrArchiveIncomplete) {
+		t.Errorf("Close() returned unexpected error. got: %v, want: %v", err, iohelpers.ErrArchiveIncomplete)
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sftp contains helpers that facilitate writing files to a directory
+// on an SFTP server.
+package sftp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/google/uuid"
+	pkgsftp "github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrNoHostKeyCallback is returned by NewClient if the credentials do not
+// include a HostKeyCallback.
+var ErrNoHostKeyCallback = errors.New("sftp.Credentials.HostKeyCallback must be set")
+
+// Credentials holds the credentials used to connect to an SFTP server.
+type Credentials struct {
+	User string
+	// Password authentication is attempted if Password is non-empty.
+	Password string
+	// PrivateKey is a PEM encoded private key. Public key authentication is
+	// attempted if it is set.
+	PrivateKey []byte
+	// HostKeyCallback verifies the server's host key, for example as returned
+	// by ssh.FixedHostKey or golang.org/x/crypto/ssh/knownhosts.New. It is
+	// required.
+	HostKeyCallback ssh.HostKeyCallback
+}
+
+func (c *Credentials) clientConfig() (*ssh.ClientConfig, error) {
+	if c == nil || c.HostKeyCallback == nil {
+		return nil, ErrNoHostKeyCallback
+	}
+	config := &ssh.ClientConfig{User: c.User, HostKeyCallback: c.HostKeyCallback}
+	if len(c.PrivateKey) > 0 {
+		signer, err := ssh.ParsePrivateKey(c.PrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SFTP private key: %w", err)
+		}
+		config.Auth = append(config.Auth, ssh.PublicKeys(signer))
+	}
+	if c.Password != "" {
+		config.Auth = append(config.Auth, ssh.Password(c.Password))
+	}
+	return config, nil
+}
+
+// Client writes files to a directory on an SFTP server. Each file is written
+// to a hidden temporary name by Create, and only appears under its final name
+// once Commit is called, so that partially written files are never visible.
+type Client struct {
+	sshClient *ssh.Client
+	client    *pkgsftp.Client
+	dir       string
+	// tempSuffix is unique to the Client, so that concurrent runs writing to
+	// the same directory do not interfere with each other.
+	tempSuffix string
+}
+
+// NewClient connects to the SFTP server at addr (host:port), and creates dir,
+// and any missing parents, if they do not exist. ctx bounds the time taken to
+// connect, authenticate and create the directory.
+func NewClient(ctx context.Context, addr string, creds *Credentials, dir string) (*Client, error) {
+	config, err := creds.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	sshClient, err := dial(ctx, addr, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to SFTP server %s: %w", addr, err)
+	}
+	client, err := pkgsftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("failed to start SFTP session with %s: %w", addr, err)
+	}
+	if err := client.MkdirAll(dir); err != nil {
+		client.Close()
+		sshClient.Close()
+		return nil, fmt.Errorf("failed to create remote directory %q: %w", dir, err)
+	}
+	return &Client{
+		sshClient:  sshClient,
+		client:     client,
+		dir:        dir,
+		tempSuffix: ".tmp-" + uuid.New().String(),
+	}, nil
+}
+
+// dial connects to addr and performs the SSH handshake, giving up if ctx is
+// done first.
+func dial(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake does not take a context, so the connection is closed if
+	// ctx is done before it completes.
+	handshakeDone := make(chan struct{})
+	defer close(handshakeDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-handshakeDone:
+		}
+	}()
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func (c *Client) path(name string) string {
+	return path.Join(c.dir, name)
+}
+
+func (c *Client) tempPath(name string) string {
+	return path.Join(c.dir, "."+name+c.tempSuffix)
+}
+
+// Create creates a temporary file for name in the Client's directory, and
+// returns a writer for it. Once the writer is closed, the file should be
+// moved to its final name with Commit, or removed with Discard.
+func (c *Client) Create(name string) (io.WriteCloser, error) {
+	tempPath := c.tempPath(name)
+	f, err := c.client.Create(tempPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", tempPath, err)
+	}
+	return f, nil
+}
+
+// Commit renames the temporary file for name to name, replacing any existing
+// file.
+func (c *Client) Commit(name string) error {
+	tempPath, finalPath := c.tempPath(name), c.path(name)
+	// The posix-rename extension replaces any existing file atomically. Servers
+	// without it only support renaming to a path which does not exist.
+	if err := c.client.PosixRename(tempPath, finalPath); err == nil {
+		return nil
+	}
+	if err := c.client.Remove(finalPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to replace %s: %w", finalPath, err)
+	}
+	if err := c.client.Rename(tempPath, finalPath); err != nil {
+		return fmt.Errorf("failed to rename %s to %s: %w", tempPath, finalPath, err)
+	}
+	return nil
+}
+
+// Discard removes the temporary file for name.
+func (c *Client) Discard(name string) error {
+	tempPath := c.tempPath(name)
+	if err := c.client.Remove(tempPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove %s: %w", tempPath, err)
+	}
+	return nil
+}
+
+// Close closes the SFTP session and the connection to the server.
+func (c *Client) Close() error {
+	var errs []error
+	if err := c.client.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("failed to close SFTP session: %w", err))
+	}
+	if err := c.sshClient.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		errs = append(errs, fmt.Errorf("failed to close SSH connection: %w", err))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sftp
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/bulk_fhir_tools/testhelpers"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestClient(t *testing.T, server *testhelpers.SFTPServer, dir string) *Client {
+	t.Helper()
+	creds := &Credentials{User: server.User(), Password: server.Password(), HostKeyCallback: ssh.FixedHostKey(server.HostKey())}
+	c, err := NewClient(context.Background(), server.Addr(), creds, dir)
+	if err != nil {
+		t.Fatalf("NewClient() returned unexpected error: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClient_CreateAndCommit(t *testing.T) {
+	server := testhelpers.NewSFTPServer(t)
+	c := newTestClient(t, server, "a/b")
+	outDir := filepath.Join(server.Dir(), "a", "b")
+	if err := os.WriteFile(filepath.Join(outDir, "file.txt"), []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := c.Create("file.txt")
+	if err != nil {
+		t.Fatalf("Create() returned unexpected error: %v", err)
+	}
+	if _, err := w.Write([]byte("data")); err != nil {
+		t.Fatalf("Write() returned unexpected error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() returned unexpected error: %v", err)
+	}
+	if got, err := os.ReadFile(filepath.Join(outDir, "file.txt")); err != nil || string(got) != "stale" {
+		t.Errorf("file.txt was modified before Commit: %q, %v", got, err)
+	}
+
+	if err := c.Commit("file.txt"); err != nil {
+		t.Fatalf("Commit() returned unexpected error: %v", err)
+	}
+	entries, err := os.ReadDir(outDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "file.txt" {
+		t.Errorf("unexpected files after Commit: %v", entries)
+	}
+	if got, err := os.ReadFile(filepath.Join(outDir, "file.txt")); err != nil || string(got) != "data" {
+		t.Errorf("unexpected contents of file.txt. got: %q, %v, want: %q", got, err, "data")
+	}
+}
+
+func TestClient_Discard(t *testing.T) {
+	server := testhelpers.NewSFTPServer(t)
+	c := newTestClient(t, server, "out")
+
+	w, err := c.Create("file.txt")
+	if err != nil {
+		t.Fatalf("Create() returned unexpected error: %v", err)
+	}
+	w.Close()
+	if err := c.Discard("file.txt"); err != nil {
+		t.Fatalf("Discard() returned unexpected error: %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Join(server.Dir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("unexpected files after Discard: %v", entries)
+	}
+}
+
+func TestNewClient_Errors(t *testing.T) {
+	server := testhelpers.NewSFTPServer(t)
+
+	creds := &Credentials{User: server.User(), Password: server.Password()}
+	if _, err := NewClient(context.Background(), server.Addr(), creds, "out"); !errors.Is(err, ErrNoHostKeyCallback) {
+		t.Errorf("NewClient() without a HostKeyCallback returned unexpected error. got: %v, want: %v", err, ErrNoHostKeyCallback)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	creds.HostKeyCallback = ssh.FixedHostKey(server.HostKey())
+	if _, err := NewClient(ctx, server.Addr(), creds, "out"); !errors.Is(err, context.Canceled) {
+		t.Errorf("NewClient() with a cancelled context returned unexpected error. got: %v, want: %v", err, context.Canceled)
+	}
+}
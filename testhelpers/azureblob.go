@@ -0,0 +1,141 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testhelpers
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Note: this is tested in azureblob/azureblob_test.go
+
+// AzureBlobServer provides a minimal implementation of the Azure Blob Storage
+// block blob API (Put Block and Put Block List) for use in tests.
+type AzureBlobServer struct {
+	t      *testing.T
+	mu     sync.Mutex
+	blocks map[string][]byte
+	blobs  map[string][]byte
+	// queries records the URL query of every request received.
+	queries []string
+	server  *httptest.Server
+}
+
+// NewAzureBlobServer creates a new Azure Blob Server for use in tests.
+func NewAzureBlobServer(t *testing.T) *AzureBlobServer {
+	abs := &AzureBlobServer{
+		t:      t,
+		blocks: map[string][]byte{},
+		blobs:  map[string][]byte{},
+	}
+	abs.server = httptest.NewServer(http.HandlerFunc(abs.handleHTTP))
+	t.Cleanup(func() {
+		abs.server.Close()
+	})
+	return abs
+}
+
+// URL returns the URL of the server, which should be followed by the container
+// name to form a container URL.
+func (abs *AzureBlobServer) URL() string {
+	return abs.server.URL
+}
+
+// GetBlob retrieves a committed blob by its path (/{container}/{name}).
+func (abs *AzureBlobServer) GetBlob(path string) ([]byte, bool) {
+	abs.mu.Lock()
+	defer abs.mu.Unlock()
+	data, ok := abs.blobs[path]
+	return data, ok
+}
+
+// GetAllPaths returns the paths of all committed blobs, sorted.
+func (abs *AzureBlobServer) GetAllPaths() []string {
+	abs.mu.Lock()
+	defer abs.mu.Unlock()
+	paths := make([]string, 0, len(abs.blobs))
+	for p := range abs.blobs {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Queries returns the raw URL queries of all requests received.
+func (abs *AzureBlobServer) Queries() []string {
+	abs.mu.Lock()
+	defer abs.mu.Unlock()
+	return append([]string(nil), abs.queries...)
+}
+
+func (abs *AzureBlobServer) handleHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		abs.t.Errorf("failed to read request body: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if req.Method != http.MethodPut || req.Header.Get("x-ms-version") == "" {
+		abs.t.Errorf("unexpected Azure Blob request %s %s (x-ms-version %q)", req.Method, req.URL, req.Header.Get("x-ms-version"))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	abs.mu.Lock()
+	defer abs.mu.Unlock()
+	abs.queries = append(abs.queries, req.URL.RawQuery)
+	q := req.URL.Query()
+	switch q.Get("comp") {
+	case "block":
+		abs.blocks[req.URL.Path+"\x00"+q.Get("blockid")] = body
+	case "blocklist":
+		var list struct {
+			Uncommitted []string `xml:"Uncommitted"`
+		}
+		if err := xml.Unmarshal(body, &list); err != nil {
+			abs.t.Errorf("failed to parse block list: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var data bytes.Buffer
+		for _, id := range list.Uncommitted {
+			block, ok := abs.blocks[req.URL.Path+"\x00"+id]
+			if !ok {
+				abs.t.Errorf("block list for %s references unknown block %s", req.URL.Path, id)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			data.Write(block)
+		}
+		for k := range abs.blocks {
+			if strings.HasPrefix(k, req.URL.Path+"\x00") {
+				delete(abs.blocks, k)
+			}
+		}
+		abs.blobs[req.URL.Path] = data.Bytes()
+	default:
+		abs.t.Errorf("unsupported Azure Blob request %s %s", req.Method, req.URL)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,209 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testhelpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Note: this is tested in bigquery/bigquery_test.go
+
+var (
+	bigQueryTablesPathRegex = regexp.MustCompile(`^/projects/([^/]+)/datasets/([^/]+)/tables$`)
+	bigQueryJobsPathRegex   = regexp.MustCompile(`^/projects/([^/]+)/jobs$`)
+	bigQueryJobPathRegex    = regexp.MustCompile(`^/projects/([^/]+)/jobs/([^/]+)$`)
+)
+
+type bigQueryTableReference struct {
+	ProjectID string `json:"projectId"`
+	DatasetID string `json:"datasetId"`
+	TableID   string `json:"tableId"`
+}
+
+type bigQueryJob struct {
+	JobReference struct {
+		JobID    string `json:"jobId"`
+		Location string `json:"location"`
+	} `json:"jobReference"`
+	Configuration struct {
+		Load struct {
+			SourceURIs       []string               `json:"sourceUris"`
+			DestinationTable bigQueryTableReference `json:"destinationTable"`
+		} `json:"load"`
+	} `json:"configuration"`
+	Status struct {
+		State string `json:"state"`
+	} `json:"status"`
+	Statistics struct {
+		Load struct {
+			OutputRows string `json:"outputRows"`
+		} `json:"load"`
+	} `json:"statistics"`
+}
+
+// BigQueryServer provides a minimal implementation of the BigQuery API for use
+// in tests. It supports creating tables, and load jobs from newline delimited
+// JSON files held by a GCSServer. Load jobs complete immediately.
+type BigQueryServer struct {
+	t         *testing.T
+	gcsServer *GCSServer
+	mu        sync.Mutex
+	tables    map[string][][]byte
+	jobs      map[string]*bigQueryJob
+	server    *httptest.Server
+}
+
+// NewBigQueryServer creates a new BigQuery server for use in tests, which
+// reads load job source files from gcsServer.
+func NewBigQueryServer(t *testing.T, gcsServer *GCSServer) *BigQueryServer {
+	bs := &BigQueryServer{
+		t:         t,
+		gcsServer: gcsServer,
+		tables:    map[string][][]byte{},
+		jobs:      map[string]*bigQueryJob{},
+	}
+	bs.server = httptest.NewServer(http.HandlerFunc(bs.handleHTTP))
+	t.Cleanup(func() {
+		bs.server.Close()
+	})
+	return bs
+}
+
+// URL returns the URL of the BigQuery server to be passed to the client
+// library.
+func (bs *BigQueryServer) URL() string {
+	return bs.server.URL + "/"
+}
+
+// AddTable adds an empty table to the server, in the form
+// project.dataset.table.
+func (bs *BigQueryServer) AddTable(table string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.tables[table] = nil
+}
+
+// Tables returns the sorted names of all tables on the server, in the form
+// project.dataset.table.
+func (bs *BigQueryServer) Tables() []string {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	var tables []string
+	for table := range bs.tables {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// TableRows returns the rows loaded into the given table, in the form
+// project.dataset.table.
+func (bs *BigQueryServer) TableRows(table string) [][]byte {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.tables[table]
+}
+
+func (bs *BigQueryServer) handleHTTP(w http.ResponseWriter, req *http.Request) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	var resp any
+	if m := bigQueryTablesPathRegex.FindStringSubmatch(req.URL.Path); m != nil && req.Method == http.MethodPost {
+		var table struct {
+			TableReference bigQueryTableReference `json:"tableReference"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&table); err != nil {
+			bs.t.Fatalf("failed to decode BigQuery table: %v", err)
+		}
+		name := fmt.Sprintf("%s.%s.%s", m[1], m[2], table.TableReference.TableID)
+		if _, ok := bs.tables[name]; ok {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, `{"error": {"code": 409, "message": "Already Exists: Table %s"}}`, name)
+			return
+		}
+		bs.tables[name] = nil
+		resp = table
+	} else if m := bigQueryJobsPathRegex.FindStringSubmatch(req.URL.Path); m != nil && req.Method == http.MethodPost {
+		job := &bigQueryJob{}
+		if err := json.NewDecoder(req.Body).Decode(job); err != nil {
+			bs.t.Fatalf("failed to decode BigQuery job: %v", err)
+		}
+		if msg := bs.runLoadJob(job); msg != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error": {"code": 400, "message": %q}}`, msg)
+			return
+		}
+		resp = job
+	} else if m := bigQueryJobPathRegex.FindStringSubmatch(req.URL.Path); m != nil && req.Method == http.MethodGet {
+		job, ok := bs.jobs[m[2]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintf(w, `{"error": {"code": 404, "message": "Not found: Job %s"}}`, m[2])
+			return
+		}
+		resp = job
+	} else {
+		bs.t.Errorf("BigQuery test server received an unexpected request: %s %s", req.Method, req.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		bs.t.Fatalf("failed to encode BigQuery response: %v", err)
+	}
+}
+
+// runLoadJob loads the job's source files into its destination table,
+// returning an error message if this is not possible. It must be called with
+// bs.mu held.
+func (bs *BigQueryServer) runLoadJob(job *bigQueryJob) string {
+	load := job.Configuration.Load
+	dest := load.DestinationTable
+	table := fmt.Sprintf("%s.%s.%s", dest.ProjectID, dest.DatasetID, dest.TableID)
+	if _, ok := bs.tables[table]; !ok {
+		return fmt.Sprintf("Not found: Table %s", table)
+	}
+	var rows [][]byte
+	for _, uri := range load.SourceURIs {
+		bucket, name, _ := strings.Cut(strings.TrimPrefix(uri, "gs://"), "/")
+		obj, ok := bs.gcsServer.GetObject(bucket, name)
+		if !ok {
+			return fmt.Sprintf("Not found: URI %s", uri)
+		}
+		for _, line := range bytes.Split(obj.Data, []byte("\n")) {
+			if len(line) != 0 {
+				rows = append(rows, line)
+			}
+		}
+	}
+	bs.tables[table] = append(bs.tables[table], rows...)
+
+	job.JobReference.JobID = fmt.Sprintf("job-%d", len(bs.jobs)+1)
+	job.JobReference.Location = "US"
+	job.Status.State = "DONE"
+	job.Statistics.Load.OutputRows = fmt.Sprint(len(rows))
+	bs.jobs[job.JobReference.JobID] = job
+	return ""
+}
@@ -48,6 +48,18 @@ type GCSServer struct {
 	objectsMut *sync.RWMutex
 	objects    map[gcsObjectKey]GCSObjectEntry
 	server     *httptest.Server
+
+	// sessions holds the resumable uploads in progress, keyed by session ID,
+	// and is guarded by objectsMut.
+	sessions      map[string]*gcsResumableSession
+	nextSessionID int
+}
+
+// gcsResumableSession is a resumable upload in progress.
+type gcsResumableSession struct {
+	key         gcsObjectKey
+	contentType string
+	data        []byte
 }
 
 // NewGCSServer creates a new GCS Server for use in tests.
@@ -56,6 +68,7 @@ func NewGCSServer(t *testing.T) *GCSServer {
 		t:          t,
 		objectsMut: &sync.RWMutex{},
 		objects:    map[gcsObjectKey]GCSObjectEntry{},
+		sessions:   map[string]*gcsResumableSession{},
 	}
 	gs.server = httptest.NewServer(http.HandlerFunc(gs.handleHTTP))
 	t.Cleanup(func() {
@@ -110,13 +123,23 @@ func (gs *GCSServer) URL() string {
 
 const uploadPathPrefix = "/upload/storage/v1/b/"
 
+// resumableSessionPathPrefix is the path prefix of the session URIs of
+// resumable uploads.
+const resumableSessionPathPrefix = "/upload/resumable/"
+
 // this should match for paths like:
 // /b - list buckets
 // /b/bucketName/o - list objects
 var listPathRegex = regexp.MustCompile(`^/b(?:/.*/o|)$`)
 
 func (gs *GCSServer) handleHTTP(w http.ResponseWriter, req *http.Request) {
-	if strings.HasPrefix(req.URL.Path, uploadPathPrefix) {
+	if strings.HasPrefix(req.URL.Path, resumableSessionPathPrefix) {
+		gs.handleResumableSession(w, req)
+	} else if strings.HasPrefix(req.URL.Path, uploadPathPrefix) && req.URL.Query().Get("uploadType") == "resumable" {
+		gs.handleStartResumableUpload(w, req)
+	} else if req.Method == http.MethodDelete {
+		gs.handleDelete(w, req)
+	} else if strings.HasPrefix(req.URL.Path, uploadPathPrefix) {
 		gs.handleUpload(w, req)
 	} else if listPathRegex.MatchString(req.URL.Path) {
 		gs.handleList(w, req)
@@ -253,6 +276,103 @@ func (gs *GCSServer) handleDownload(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// handleDelete handles delete object calls, which have paths like
+// /b/bucketName/o/objectName.
+func (gs *GCSServer) handleDelete(w http.ResponseWriter, req *http.Request) {
+	bucket, name, ok := strings.Cut(strings.TrimPrefix(req.URL.Path, "/b/"), "/o/")
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "unrecognised endpoint %s", req.URL.Path)
+		return
+	}
+
+	gs.objectsMut.Lock()
+	defer gs.objectsMut.Unlock()
+	key := gcsObjectKey{bucket, name}
+	if _, ok := gs.objects[key]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "object %s not found", req.URL.Path)
+		return
+	}
+	delete(gs.objects, key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleStartResumableUpload starts a resumable upload session, and returns
+// its session URI in the Location header.
+func (gs *GCSServer) handleStartResumableUpload(w http.ResponseWriter, req *http.Request) {
+	bucket := strings.Split(strings.TrimPrefix(req.URL.Path, uploadPathPrefix), "/")[0]
+	name := req.URL.Query().Get("name")
+
+	gs.objectsMut.Lock()
+	defer gs.objectsMut.Unlock()
+	id := fmt.Sprint(gs.nextSessionID)
+	gs.nextSessionID++
+	gs.sessions[id] = &gcsResumableSession{
+		key:         gcsObjectKey{bucket, name},
+		contentType: req.Header.Get("X-Upload-Content-Type"),
+	}
+	w.Header().Set("Location", gs.server.URL+resumableSessionPathPrefix+id)
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleResumableSession handles the chunks, status queries and cancellation
+// of a resumable upload session. Every chunk is committed in full, and the
+// object is created once the final chunk is received.
+func (gs *GCSServer) handleResumableSession(w http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, resumableSessionPathPrefix)
+	gs.objectsMut.Lock()
+	defer gs.objectsMut.Unlock()
+	session, ok := gs.sessions[id]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, "upload session %s not found", id)
+		return
+	}
+	if req.Method == http.MethodDelete {
+		delete(gs.sessions, id)
+		w.WriteHeader(499)
+		return
+	}
+
+	data, err := io.ReadAll(req.Body)
+	if err != nil {
+		gs.t.Fatalf("failed to read GCS resumable upload request body: %v", err)
+	}
+	var start, end int
+	var total string
+	contentRange := req.Header.Get("Content-Range")
+	if rest, ok := strings.CutPrefix(contentRange, "bytes */"); ok {
+		start, end, total = len(session.data), len(session.data)-1, rest
+	} else if _, err := fmt.Sscanf(contentRange, "bytes %d-%d/%s", &start, &end, &total); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid Content-Range %q", contentRange)
+		return
+	}
+	if start > len(session.data) || end-start+1 != len(data) {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Content-Range %q does not follow %d committed bytes", contentRange, len(session.data))
+		return
+	}
+	session.data = append(session.data[:start], data...)
+
+	if total != "*" {
+		if total != fmt.Sprint(len(session.data)) {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "upload of %d bytes does not match total %s", len(session.data), total)
+			return
+		}
+		gs.objects[session.key] = GCSObjectEntry{Data: session.data, ContentType: session.contentType}
+		delete(gs.sessions, id)
+		w.Write([]byte("{}"))
+		return
+	}
+	if len(session.data) > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", len(session.data)-1))
+	}
+	w.WriteHeader(http.StatusPermanentRedirect)
+}
+
 // ReadAllGCSFHIRJSON reads ALL files in the gcsServer, attempets to extract the FHIR json for each
 // resource, and adds it to the output [][]byte. If normalize=true, then NormalizeJSON is applied to
 // the json bytes before being added to the output.
@@ -0,0 +1,152 @@
+// Copyright 2024 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testhelpers
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Note: this is tested in fhir/processing/sftpsink_test.go
+
+// SFTPServer is an SFTP server for use in tests, which serves files from a
+// local temporary directory. It accepts password authentication with the
+// credentials returned by User and Password.
+type SFTPServer struct {
+	t        *testing.T
+	listener net.Listener
+	dir      string
+	hostKey  ssh.PublicKey
+	wg       sync.WaitGroup
+}
+
+// NewSFTPServer creates and starts a new SFTP server for use in tests.
+func NewSFTPServer(t *testing.T) *SFTPServer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatalf("failed to create host key signer: %v", err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &SFTPServer{t: t, listener: listener, dir: t.TempDir(), hostKey: signer.PublicKey()}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+			if c.User() == s.User() && string(pass) == s.Password() {
+				return nil, nil
+			}
+			return nil, errors.New("invalid credentials")
+		},
+	}
+	config.AddHostKey(signer)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serveConn(conn, config)
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		s.wg.Wait()
+	})
+	return s
+}
+
+// Addr returns the host:port address of the server.
+func (s *SFTPServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// User returns the user name accepted by the server.
+func (s *SFTPServer) User() string {
+	return "user"
+}
+
+// Password returns the password accepted by the server.
+func (s *SFTPServer) Password() string {
+	return "password"
+}
+
+// HostKey returns the server's public host key.
+func (s *SFTPServer) HostKey() ssh.PublicKey {
+	return s.hostKey
+}
+
+// Dir returns the local directory the server serves files from. Remote paths
+// are relative to this directory.
+func (s *SFTPServer) Dir() string {
+	return s.dir
+}
+
+func (s *SFTPServer) serveConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+		channel, requests, err := newChan.Accept()
+		if err != nil {
+			s.t.Errorf("failed to accept SSH channel: %v", err)
+			return
+		}
+		go func() {
+			for req := range requests {
+				// Only the sftp subsystem is supported.
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+			}
+		}()
+		server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(s.dir))
+		if err != nil {
+			s.t.Errorf("failed to create SFTP server: %v", err)
+			return
+		}
+		if err := server.Serve(); err != nil && err != io.EOF {
+			s.t.Errorf("SFTP server failed: %v", err)
+		}
+		server.Close()
+	}
+}